@@ -34,6 +34,7 @@ import (
 	"io/ioutil"
 	"math/big"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -102,6 +103,11 @@ type Client struct {
 	// Requests which result in a 4xx client error are not retried,
 	// except for 400 Bad Request due to "bad nonce" errors and 429 Too Many Requests.
 	//
+	// Idempotent requests, which are GET and POST-as-GET requests, are also retried
+	// up to 3 times when they fail with a transient network error, such as a reset
+	// connection. These retries, which have no response, always use the default
+	// backoff described below: RetryBackoff is never called with a nil resp.
+	//
 	// If RetryBackoff is nil, a truncated exponential backoff algorithm
 	// with the ceiling of 10 seconds is used, where each subsequent retry n
 	// is done after either ("Retry-After" + jitter) or (2^n seconds + jitter),
@@ -109,11 +115,58 @@ type Client struct {
 	// The jitter is a random value up to 1 second.
 	RetryBackoff func(n int, r *http.Request, resp *http.Response) time.Duration
 
-	dirMu sync.Mutex // guards writes to dir
-	dir   *Directory // cached result of Client's Discover method
+	// Trace optionally specifies hooks called during the HTTP requests
+	// made by the Client. See ClientTrace for details.
+	Trace *ClientTrace
+
+	// SignedRequestHook optionally receives each signed request the Client
+	// sends to the CA, for instance to keep a record of the actions of the
+	// account in regulated environments. The url argument is the URL of
+	// the request and jws its body: the JWS in flattened JSON serialization,
+	// with "protected", "payload" and "signature" members, as sent. It can
+	// be verified with the public key the request was signed with, usually
+	// the account key, and never contains a private key.
+	//
+	// SignedRequestHook is called with a copy of the body before each
+	// request is sent, including retries, which are signed anew. It may be
+	// called concurrently from different goroutines.
+	SignedRequestHook func(url string, jws []byte)
+
+	// UserAgent is prepended to the User-Agent header sent to the CA,
+	// which otherwise only identifies this package and the platform.
+	// CAs use it to contact the operators of misbehaving clients,
+	// so it should identify the application and, ideally, its version.
+	UserAgent string
+
+	// CAAResolver optionally looks up the CAA records checked by
+	// CheckIdentifierControl. If nil, they are not checked.
+	CAAResolver CAAResolver
+
+	// StrictDecoding makes the Client reject the responses of the CA with
+	// fields unknown to this package, for instance to detect deviations
+	// from the ACME specifications in tests. Otherwise such fields are
+	// ignored. The fields the Client requires are checked either way.
+	StrictDecoding bool
+
+	// MaxResponseBytes limits the size of the response bodies the Client
+	// reads from the CA, including certificate chains and problem documents,
+	// to protect it from a misbehaving CA. Reading a larger body fails.
+	//
+	// If zero, bodies are limited to 10 MiB.
+	MaxResponseBytes int64
+
+	dirMu    sync.Mutex // guards writes to dir and indexURL
+	dir      *Directory // cached result of Client's Discover method
+	indexURL string     // directory URL found by DiscoverFrom; see directoryURL
+
+	kidMu sync.Mutex
+	kid   string // account URL used as JWS "kid" in RFC 8555 mode; see accountKID
 
 	noncesMu sync.Mutex
 	nonces   map[string]struct{} // nonces collected from previous responses
+
+	authzMu    sync.Mutex
+	validAuthz map[AuthzID]*Authorization // valid authorizations; see rememberAuthz
 }
 
 // Discover performs ACME server discovery using c.DirectoryURL.
@@ -127,7 +180,87 @@ func (c *Client) Discover(ctx context.Context) (Directory, error) {
 	if c.dir != nil {
 		return *c.dir, nil
 	}
+	return c.fetchDirectory(ctx)
+}
+
+// DiscoverFrom is like Discover for a client given the URL of a resource,
+// such as an account or an order, but not the URL of the directory: it
+// requests resourceURL and discovers the directory it links to with
+// rel="index", as allowed by RFC 8555 section 7.1, which the client then
+// uses as if it were c.DirectoryURL.
+//
+// If c.DirectoryURL is set or the directory was already discovered,
+// DiscoverFrom is the same as Discover.
+func (c *Client) DiscoverFrom(ctx context.Context, resourceURL string) (Directory, error) {
+	c.dirMu.Lock()
+	defer c.dirMu.Unlock()
+	if c.dir != nil {
+		return *c.dir, nil
+	}
+	if c.DirectoryURL == "" && c.indexURL == "" {
+		index, err := c.fetchIndexLink(ctx, resourceURL)
+		if err != nil {
+			return Directory{}, err
+		}
+		c.indexURL = index
+	}
+	return c.fetchDirectory(ctx)
+}
 
+// fetchIndexLink returns the rel="index" link of the response to a HEAD
+// request of resourceURL, resolved against resourceURL. The status of the
+// response is ignored: RFC 8555 CAs link to the directory in all their
+// responses, including errors such as 405 for unauthenticated reads.
+func (c *Client) fetchIndexLink(ctx context.Context, resourceURL string) (string, error) {
+	base, err := url.Parse(resourceURL)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("HEAD", resourceURL, nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := c.doNoRetry(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	c.addNonce(res.Header)
+	index := linkHeader(res.Header, "index")
+	if len(index) == 0 {
+		if res.StatusCode > 299 {
+			return "", responseError(res)
+		}
+		return "", errors.New("acme: rel=index link not found")
+	}
+	u, err := base.Parse(index[0])
+	if err != nil {
+		return "", fmt.Errorf("acme: invalid rel=index link: %v", err)
+	}
+	return u.String(), nil
+}
+
+// TermsOfService fetches the directory of the CA again, bypassing the result
+// cached by Discover, which it updates, and returns the URL of the current
+// Terms of Service of the CA. The changed result reports whether the URL
+// differs from accepted, the URL of the terms the caller last accepted, which
+// must then be accepted again, for instance by calling the prompt function of
+// Register or Manager.Prompt in package autocert.
+//
+// Both url and changed are zero if the CA has no Terms of Service.
+func (c *Client) TermsOfService(ctx context.Context, accepted string) (url string, changed bool, err error) {
+	c.dirMu.Lock()
+	defer c.dirMu.Unlock()
+	dir, err := c.fetchDirectory(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	return dir.Terms, dir.Terms != "" && dir.Terms != accepted, nil
+}
+
+// fetchDirectory fetches the directory from c.DirectoryURL and caches it.
+// c.dirMu must be held.
+func (c *Client) fetchDirectory(ctx context.Context) (Directory, error) {
 	res, err := c.get(ctx, c.directoryURL(), wantStatus(http.StatusOK))
 	if err != nil {
 		return Directory{}, err
@@ -140,46 +273,130 @@ func (c *Client) Discover(ctx context.Context) (Directory, error) {
 		Authz  string `json:"new-authz"`
 		Cert   string `json:"new-cert"`
 		Revoke string `json:"revoke-cert"`
+		Nonce  string `json:"newNonce"`
+		ARI    string `json:"renewalInfo"`
 		Meta   struct {
 			Terms   string   `json:"terms-of-service"`
 			Website string   `json:"website"`
 			CAA     []string `json:"caa-identities"`
+			// RFC 8555 names of the above.
+			TermsRFC     string   `json:"termsOfService"`
+			CAARFC       []string `json:"caaIdentities"`
+			ExternalAcct bool     `json:"externalAccountRequired"`
+
+			// ACME profiles extension draft.
+			Profiles map[string]string `json:"profiles"`
 		}
-	}
-	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+		// RFC 8555 name of new-authz, only advertised
+		// by CAs supporting pre-authorization.
+		AuthzRFC string `json:"newAuthz"`
+		// RFC 8555 name of new-reg.
+		RegRFC string `json:"newAccount"`
+
+		// Unused, but known for StrictDecoding.
+		KeyChange    json.RawMessage `json:"key-change"`
+		NewOrder     json.RawMessage `json:"newOrder"`
+		RevokeRFC    json.RawMessage `json:"revokeCert"`
+		KeyChangeRFC json.RawMessage `json:"keyChange"`
+	}
+	if err := c.decodeResponse(res, &v); err != nil {
 		return Directory{}, err
 	}
+	if v.Authz == "" {
+		v.Authz = v.AuthzRFC
+	}
+	if v.Reg == "" {
+		v.Reg = v.RegRFC
+	}
+	if v.Meta.Terms == "" {
+		v.Meta.Terms = v.Meta.TermsRFC
+	}
+	if len(v.Meta.CAA) == 0 {
+		v.Meta.CAA = v.Meta.CAARFC
+	}
 	c.dir = &Directory{
 		RegURL:    v.Reg,
 		AuthzURL:  v.Authz,
 		CertURL:   v.Cert,
 		RevokeURL: v.Revoke,
+		NonceURL:  v.Nonce,
 		Terms:     v.Meta.Terms,
 		Website:   v.Meta.Website,
 		CAA:       v.Meta.CAA,
+
+		ExternalAccountRequired: v.Meta.ExternalAcct,
+		RenewalInfoURL:          v.ARI,
+		Profiles:                v.Meta.Profiles,
 	}
 	return *c.dir, nil
 }
 
+// directoryURL returns the URL of the directory: c.DirectoryURL, or the
+// one found by DiscoverFrom, or LetsEncryptURL. c.dirMu must be held.
 func (c *Client) directoryURL() string {
 	if c.DirectoryURL != "" {
 		return c.DirectoryURL
 	}
+	if c.indexURL != "" {
+		return c.indexURL
+	}
 	return LetsEncryptURL
 }
 
+// rfcMode reports whether the CA directory, if already discovered,
+// indicates an RFC 8555 compliant server.
+// Such servers require authenticated POST-as-GET requests to fetch resources.
+func (c *Client) rfcMode() bool {
+	c.dirMu.Lock()
+	defer c.dirMu.Unlock()
+	return c.dir != nil && c.dir.NonceURL != ""
+}
+
+// nonceURL returns the URL to fetch fresh nonces from.
+func (c *Client) nonceURL() string {
+	c.dirMu.Lock()
+	defer c.dirMu.Unlock()
+	if c.dir != nil && c.dir.NonceURL != "" {
+		return c.dir.NonceURL
+	}
+	return c.directoryURL()
+}
+
+// setAccountKID records the account URL uri to be used as a JWS "kid"
+// in requests to RFC 8555 compliant servers.
+func (c *Client) setAccountKID(uri string) {
+	if uri == "" {
+		return
+	}
+	c.kidMu.Lock()
+	defer c.kidMu.Unlock()
+	c.kid = uri
+}
+
+// accountKID returns the account URL previously recorded with setAccountKID,
+// or an empty string if it is unknown.
+func (c *Client) accountKID() string {
+	c.kidMu.Lock()
+	defer c.kidMu.Unlock()
+	return c.kid
+}
+
 // CreateCert requests a new certificate using the Certificate Signing Request csr encoded in DER format.
 // The exp argument indicates the desired certificate validity duration. CA may issue a certificate
 // with a different duration.
 // If the bundle argument is true, the returned value will also contain the CA (issuer) certificate chain.
+// The requested validity period may instead be set with the WithNotBefore and WithNotAfter options,
+// and the profile of the certificate with the WithProfiles option.
+// The WithCSRVerification option checks the issued certificate against csr.
 //
 // In the case where CA server does not provide the issued certificate in the response,
 // CreateCert will poll certURL using c.FetchCert, which will result in additional round-trips.
-// In such a scenario, the caller can cancel the polling with ctx.
+// In such a scenario, the caller can cancel the polling with ctx, and the WithPollInterval
+// option sets the interval between the polls.
 //
 // CreateCert returns an error if the CA's response or chain was unreasonably large.
 // Callers are encouraged to parse the returned value to ensure the certificate is valid and has the expected features.
-func (c *Client) CreateCert(ctx context.Context, csr []byte, exp time.Duration, bundle bool) (der [][]byte, certURL string, err error) {
+func (c *Client) CreateCert(ctx context.Context, csr []byte, exp time.Duration, bundle bool, opt ...OrderOption) (der [][]byte, certURL string, err error) {
 	if _, err := c.Discover(ctx); err != nil {
 		return nil, "", err
 	}
@@ -189,6 +406,7 @@ func (c *Client) CreateCert(ctx context.Context, csr []byte, exp time.Duration,
 		CSR       string `json:"csr"`
 		NotBefore string `json:"notBefore,omitempty"`
 		NotAfter  string `json:"notAfter,omitempty"`
+		Profile   string `json:"profile,omitempty"`
 	}{
 		Resource: "new-cert",
 		CSR:      base64.RawURLEncoding.EncodeToString(csr),
@@ -198,8 +416,29 @@ func (c *Client) CreateCert(ctx context.Context, csr []byte, exp time.Duration,
 	if exp > 0 {
 		req.NotAfter = now.Add(exp).Format(time.RFC3339)
 	}
+	var poll time.Duration
+	var verify bool
+	for _, o := range opt {
+		switch o := o.(type) {
+		case orderNotBeforeOpt:
+			req.NotBefore = time.Time(o).Format(time.RFC3339)
+		case orderNotAfterOpt:
+			req.NotAfter = time.Time(o).Format(time.RFC3339)
+		case orderPollIntervalOpt:
+			poll = time.Duration(o)
+		case orderVerifyCSROpt:
+			verify = true
+		case orderProfilesOpt:
+			if req.Profile, err = o.resolve(c.dir); err != nil {
+				return nil, "", err
+			}
+		default:
+			// package's fault, if we let this happen:
+			panic(fmt.Sprintf("unsupported option type %T", o))
+		}
+	}
 
-	res, err := c.post(ctx, c.Key, c.dir.CertURL, req, wantStatus(http.StatusCreated))
+	res, err := c.post(ctx, nil, c.dir.CertURL, req, wantStatus(http.StatusCreated))
 	if err != nil {
 		return nil, "", err
 	}
@@ -208,14 +447,50 @@ func (c *Client) CreateCert(ctx context.Context, csr []byte, exp time.Duration,
 	curl := res.Header.Get("Location") // cert permanent URL
 	if res.ContentLength == 0 {
 		// no cert in the body; poll until we get it
-		cert, err := c.FetchCert(ctx, curl, bundle)
+		retry := c.retryTimer()
+		if poll > 0 {
+			retry = pollTimer(poll)
+		}
+		res, err := c.fetchRetry(ctx, curl, wantStatus(http.StatusOK), retry)
+		if err != nil {
+			return nil, curl, err
+		}
+		defer res.Body.Close()
+		cert, err := c.responseCert(ctx, res, bundle)
+		if err == nil && verify {
+			if err := verifyCertDER(cert, csr); err != nil {
+				return nil, curl, err
+			}
+		}
 		return cert, curl, err
 	}
 	// slurp issued cert and CA chain, if requested
 	cert, err := c.responseCert(ctx, res, bundle)
+	if err == nil && verify {
+		if err := verifyCertDER(cert, csr); err != nil {
+			return nil, curl, err
+		}
+	}
 	return cert, curl, err
 }
 
+// verifyCertDER checks the leaf of der, a certificate chain issued for csr,
+// with VerifyIssuedCert.
+func verifyCertDER(der [][]byte, csr []byte) error {
+	req, err := x509.ParseCertificateRequest(csr)
+	if err != nil {
+		return fmt.Errorf("acme: invalid certificate request: %v", err)
+	}
+	if len(der) == 0 {
+		return errors.New("acme: CA returned no certificate")
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return fmt.Errorf("acme: invalid certificate: %v", err)
+	}
+	return VerifyIssuedCert(leaf, req)
+}
+
 // FetchCert retrieves already issued certificate from the given url, in DER format.
 // It retries the request until the certificate is successfully retrieved,
 // context is cancelled by the caller or an error response is received.
@@ -226,19 +501,58 @@ func (c *Client) CreateCert(ctx context.Context, csr []byte, exp time.Duration,
 // Callers are encouraged to parse the returned value to ensure the certificate is valid
 // and has expected features.
 func (c *Client) FetchCert(ctx context.Context, url string, bundle bool) ([][]byte, error) {
-	res, err := c.get(ctx, url, wantStatus(http.StatusOK))
+	res, err := c.fetch(ctx, url, wantStatus(http.StatusOK))
 	if err != nil {
 		return nil, err
 	}
 	return c.responseCert(ctx, res, bundle)
 }
 
+// FetchCertAlternates retrieves already issued certificate from the given url
+// along with all alternate chains the CA offers, in DER format.
+// The alternates are discovered by following Link headers with "alternate"
+// relation type, as described in RFC 8555, Section 7.4.2.
+//
+// Each item of the returned value is a full chain: the certificate followed
+// by the CA (issuer) certificates. The first item is the chain served at url,
+// which is the same value FetchCert returns with bundle argument set to true.
+// The rest follow in the order of the Link headers.
+//
+// FetchCertAlternates returns an error if the CA's response or any of the chains
+// was unreasonably large.
+func (c *Client) FetchCertAlternates(ctx context.Context, url string) ([][][]byte, error) {
+	res, err := c.fetch(ctx, url, wantStatus(http.StatusOK))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	alt := linkHeader(res.Header, "alternate")
+	if len(alt) > maxChainLen {
+		return nil, errors.New("acme: too many alternate chains")
+	}
+	chain, err := c.responseCert(ctx, res, true)
+	if err != nil {
+		return nil, err
+	}
+	chains := [][][]byte{chain}
+	for _, u := range alt {
+		chain, err := c.FetchCert(ctx, u, true)
+		if err != nil {
+			return nil, err
+		}
+		chains = append(chains, chain)
+	}
+	return chains, nil
+}
+
 // RevokeCert revokes a previously issued certificate cert, provided in DER format.
 //
 // The key argument, used to sign the request, must be authorized
 // to revoke the certificate. It's up to the CA to decide which keys are authorized.
 // For instance, the key pair of the certificate may be authorized.
 // If the key is nil, c.Key is used instead.
+//
+// RevokeCertWithAccountKey and RevokeCertWithCertKey make the choice explicit.
 func (c *Client) RevokeCert(ctx context.Context, key crypto.Signer, cert []byte, reason CRLReasonCode) error {
 	if _, err := c.Discover(ctx); err != nil {
 		return err
@@ -253,9 +567,6 @@ func (c *Client) RevokeCert(ctx context.Context, key crypto.Signer, cert []byte,
 		Cert:     base64.RawURLEncoding.EncodeToString(cert),
 		Reason:   int(reason),
 	}
-	if key == nil {
-		key = c.Key
-	}
 	res, err := c.post(ctx, key, c.dir.RevokeURL, body, wantStatus(http.StatusOK))
 	if err != nil {
 		return err
@@ -264,6 +575,34 @@ func (c *Client) RevokeCert(ctx context.Context, key crypto.Signer, cert []byte,
 	return nil
 }
 
+// RevokeCertWithAccountKey revokes cert, provided in DER format, with a request
+// signed by the account key c.Key, which in RFC 8555 mode is identified by the
+// account URL. The account must have been issued cert or be authorized for
+// all its identifiers.
+func (c *Client) RevokeCertWithAccountKey(ctx context.Context, cert []byte, reason CRLReasonCode) error {
+	return c.RevokeCert(ctx, nil, cert, reason)
+}
+
+// RevokeCertWithCertKey revokes cert, provided in DER format, with a request
+// signed by certKey, the private key of the certificate, which is embedded
+// in the request. The account key is not used, which makes this the only way
+// to revoke a certificate when the account is unavailable, as described
+// in RFC 8555, Section 7.6.
+//
+// RevokeCertWithCertKey returns an error without contacting the CA if certKey
+// does not match the public key of cert.
+func (c *Client) RevokeCertWithCertKey(ctx context.Context, certKey crypto.Signer, cert []byte, reason CRLReasonCode) error {
+	x, err := x509.ParseCertificate(cert)
+	if err != nil {
+		return fmt.Errorf("acme: invalid certificate: %v", err)
+	}
+	pub, ok := certKey.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(x.PublicKey) {
+		return errors.New("acme: key does not match the certificate public key")
+	}
+	return c.RevokeCert(ctx, certKey, cert, reason)
+}
+
 // AcceptTOS always returns true to indicate the acceptance of a CA's Terms of Service
 // during account registration. See Register method of Client for more details.
 func AcceptTOS(tosURL string) bool { return true }
@@ -284,6 +623,7 @@ func (c *Client) Register(ctx context.Context, a *Account, prompt func(tosURL st
 	if a, err = c.doReg(ctx, c.dir.RegURL, "new-reg", a); err != nil {
 		return nil, err
 	}
+	c.setAccountKID(a.URI)
 	var accept bool
 	if a.CurrentTerms != "" && a.CurrentTerms != a.AgreedTerms {
 		accept = prompt(a.CurrentTerms)
@@ -295,6 +635,41 @@ func (c *Client) Register(ctx context.Context, a *Account, prompt func(tosURL st
 	return a, err
 }
 
+// GetAccount returns the account registered with the CA for c.Key, without
+// creating one, by following the "new-reg" flow with the onlyReturnExisting
+// field of RFC 8555, Section 7.3.1. It returns ErrNoAccount if the CA holds
+// no account for the key, and records the account URL otherwise, as Register
+// does.
+//
+// CAs which do not implement RFC 8555 may ignore onlyReturnExisting and
+// create the account.
+func (c *Client) GetAccount(ctx context.Context) (*Account, error) {
+	if _, err := c.Discover(ctx); err != nil {
+		return nil, err
+	}
+	req := struct {
+		Resource           string `json:"resource"`
+		OnlyReturnExisting bool   `json:"onlyReturnExisting"`
+	}{
+		Resource:           "new-reg",
+		OnlyReturnExisting: true,
+	}
+	res, err := c.post(ctx, nil, c.dir.RegURL, req, wantStatus(http.StatusOK, http.StatusCreated))
+	if e, ok := err.(*Error); ok && strings.HasSuffix(strings.ToLower(e.ProblemType), ":accountdoesnotexist") {
+		return nil, ErrNoAccount
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	a, err := c.responseAccount(res)
+	if err != nil {
+		return nil, err
+	}
+	c.setAccountKID(a.URI)
+	return a, nil
+}
+
 // GetReg retrieves an existing registration.
 // The url argument is an Account URI.
 func (c *Client) GetReg(ctx context.Context, url string) (*Account, error) {
@@ -303,6 +678,7 @@ func (c *Client) GetReg(ctx context.Context, url string) (*Account, error) {
 		return nil, err
 	}
 	a.URI = url
+	c.setAccountKID(url)
 	return a, nil
 }
 
@@ -315,9 +691,56 @@ func (c *Client) UpdateReg(ctx context.Context, a *Account) (*Account, error) {
 		return nil, err
 	}
 	a.URI = uri
+	c.setAccountKID(uri)
 	return a, nil
 }
 
+// UpdateAccount replaces the contact URIs of the account at accountURL
+// with contacts and returns the account as updated by the CA.
+// An empty contacts removes all the contact URIs of the account.
+//
+// Each contact must be a "mailto:" or "tel:" URI, such as
+// "mailto:admin@example.com".
+func (c *Client) UpdateAccount(ctx context.Context, accountURL string, contacts []string) (*Account, error) {
+	for _, ct := range contacts {
+		if !validContact(ct) {
+			return nil, fmt.Errorf("acme: invalid contact %q: only mailto: and tel: URIs are supported", ct)
+		}
+	}
+	if contacts == nil {
+		// Sent as an empty array rather than omitted, to remove the contacts.
+		contacts = []string{}
+	}
+	req := struct {
+		Resource string   `json:"resource"`
+		Contact  []string `json:"contact"`
+	}{
+		Resource: "reg",
+		Contact:  contacts,
+	}
+	res, err := c.post(ctx, nil, accountURL, req, wantStatus(http.StatusOK, http.StatusAccepted))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	a, err := c.responseAccount(res)
+	if err != nil {
+		return nil, err
+	}
+	a.URI = accountURL
+	c.setAccountKID(accountURL)
+	return a, nil
+}
+
+// validContact reports whether ct is a non-empty mailto: or tel: URI.
+func validContact(ct string) bool {
+	u, err := url.Parse(ct)
+	if err != nil || u.Opaque == "" {
+		return false
+	}
+	return u.Scheme == "mailto" || u.Scheme == "tel"
+}
+
 // Authorize performs the initial step in an authorization flow.
 // The caller will then need to choose from and perform a set of returned
 // challenges using c.Accept in order to successfully complete authorization.
@@ -325,6 +748,15 @@ func (c *Client) UpdateReg(ctx context.Context, a *Account) (*Account, error) {
 // If an authorization has been previously granted, the CA may return
 // a valid authorization (Authorization.Status is StatusValid). If so, the caller
 // need not fulfill any challenge and can proceed to requesting a certificate.
+//
+// Authorize can be called ahead of requesting a certificate, to complete the
+// challenges in advance. The valid authorizations c obtained, from Authorize
+// or WaitAuthorization, are returned again by subsequent calls for the same
+// identifier without contacting the CA, until they expire or are revoked
+// with c.RevokeAuthorization.
+//
+// If the CA does not support creating authorizations outside of an order,
+// Authorize returns ErrPreAuthorizationNotSupported.
 func (c *Client) Authorize(ctx context.Context, domain string) (*Authorization, error) {
 	return c.authorize(ctx, "dns", domain)
 }
@@ -343,6 +775,12 @@ func (c *Client) authorize(ctx context.Context, typ, val string) (*Authorization
 	if _, err := c.Discover(ctx); err != nil {
 		return nil, err
 	}
+	if a := c.knownValidAuthz(AuthzID{Type: typ, Value: val}); a != nil {
+		return a, nil
+	}
+	if c.dir.AuthzURL == "" {
+		return nil, ErrPreAuthorizationNotSupported
+	}
 
 	type authzID struct {
 		Type  string `json:"type"`
@@ -355,20 +793,67 @@ func (c *Client) authorize(ctx context.Context, typ, val string) (*Authorization
 		Resource:   "new-authz",
 		Identifier: authzID{Type: typ, Value: val},
 	}
-	res, err := c.post(ctx, c.Key, c.dir.AuthzURL, req, wantStatus(http.StatusCreated))
+	res, err := c.post(ctx, nil, c.dir.AuthzURL, req, wantStatus(http.StatusCreated))
 	if err != nil {
 		return nil, err
 	}
 	defer res.Body.Close()
 
 	var v wireAuthz
-	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
-		return nil, fmt.Errorf("acme: invalid response: %v", err)
+	if err := c.decodeResponse(res, &v); err != nil {
+		return nil, err
 	}
 	if v.Status != StatusPending && v.Status != StatusValid {
 		return nil, fmt.Errorf("acme: unexpected status: %s", v.Status)
 	}
-	return v.authorization(res.Header.Get("Location")), nil
+	a := v.authorization(res.Header.Get("Location"))
+	if a.Identifier == (AuthzID{}) {
+		a.Identifier = AuthzID{Type: typ, Value: val}
+	}
+	c.rememberAuthz(a)
+	return a, nil
+}
+
+// rememberAuthz records a for knownValidAuthz if it is valid
+// and its expiration time is known.
+func (c *Client) rememberAuthz(a *Authorization) {
+	if a.Status != StatusValid || a.Expires.IsZero() || a.Identifier == (AuthzID{}) {
+		return
+	}
+	c.authzMu.Lock()
+	defer c.authzMu.Unlock()
+	if c.validAuthz == nil {
+		c.validAuthz = make(map[AuthzID]*Authorization)
+	}
+	c.validAuthz[a.Identifier] = a
+}
+
+// knownValidAuthz returns a copy of the authorization for id recorded by
+// rememberAuthz, or nil if there is none or it has expired.
+func (c *Client) knownValidAuthz(id AuthzID) *Authorization {
+	c.authzMu.Lock()
+	defer c.authzMu.Unlock()
+	a := c.validAuthz[id]
+	if a == nil {
+		return nil
+	}
+	if !timeNow().Before(a.Expires) {
+		delete(c.validAuthz, id)
+		return nil
+	}
+	v := *a
+	return &v
+}
+
+// forgetAuthz drops the authorization at url recorded by rememberAuthz, if any.
+func (c *Client) forgetAuthz(url string) {
+	c.authzMu.Lock()
+	defer c.authzMu.Unlock()
+	for id, a := range c.validAuthz {
+		if a.URI == url {
+			delete(c.validAuthz, id)
+		}
+	}
 }
 
 // GetAuthorization retrieves an authorization identified by the given URL.
@@ -376,14 +861,14 @@ func (c *Client) authorize(ctx context.Context, typ, val string) (*Authorization
 // If a caller needs to poll an authorization until its status is final,
 // see the WaitAuthorization method.
 func (c *Client) GetAuthorization(ctx context.Context, url string) (*Authorization, error) {
-	res, err := c.get(ctx, url, wantStatus(http.StatusOK, http.StatusAccepted))
+	res, err := c.fetch(ctx, url, wantStatus(http.StatusOK, http.StatusAccepted))
 	if err != nil {
 		return nil, err
 	}
 	defer res.Body.Close()
 	var v wireAuthz
-	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
-		return nil, fmt.Errorf("acme: invalid response: %v", err)
+	if err := c.decodeResponse(res, &v); err != nil {
+		return nil, err
 	}
 	return v.authorization(url), nil
 }
@@ -407,7 +892,8 @@ func (c *Client) RevokeAuthorization(ctx context.Context, url string) error {
 		Status:   "deactivated",
 		Delete:   true,
 	}
-	res, err := c.post(ctx, c.Key, url, req, wantStatus(http.StatusOK))
+	c.forgetAuthz(url)
+	res, err := c.post(ctx, nil, url, req, wantStatus(http.StatusOK))
 	if err != nil {
 		return err
 	}
@@ -416,41 +902,49 @@ func (c *Client) RevokeAuthorization(ctx context.Context, url string) error {
 }
 
 // WaitAuthorization polls an authorization at the given URL
-// until it is in one of the final states, StatusValid or StatusInvalid,
-// the ACME CA responded with a 4xx error code, or the context is done.
+// until it is in one of the final states, StatusValid, StatusInvalid,
+// StatusDeactivated, StatusExpired or StatusRevoked, the ACME CA responded
+// with a 4xx error code, or the context is done. The authorization is polled
+// as long as it is pending, while the CA processes the challenges, as often
+// as the Retry-After header of the CA responses requests, or else with an
+// exponential backoff from one second to maxAuthzPollInterval. A Retry-After
+// header which is invalid, zero or in the past is ignored.
 //
 // It returns a non-nil Authorization only if its Status is StatusValid.
 // In all other cases WaitAuthorization returns an error.
-// If the Status is StatusInvalid, the returned error is of type *AuthorizationError.
+// If the Status is final but not StatusValid, the returned error is of type
+// *AuthorizationError, with the errors of the failed challenges, if any.
 func (c *Client) WaitAuthorization(ctx context.Context, url string) (*Authorization, error) {
+	delay := authzPollInterval
 	for {
-		res, err := c.get(ctx, url, wantStatus(http.StatusOK, http.StatusAccepted))
+		res, err := c.fetch(ctx, url, wantStatus(http.StatusOK, http.StatusAccepted))
 		if err != nil {
 			return nil, err
 		}
 
 		var raw wireAuthz
-		err = json.NewDecoder(res.Body).Decode(&raw)
+		err = c.decodeResponse(res, &raw)
 		res.Body.Close()
 		switch {
 		case err != nil:
 			// Skip and retry.
 		case raw.Status == StatusValid:
-			return raw.authorization(url), nil
-		case raw.Status == StatusInvalid:
+			a := raw.authorization(url)
+			c.rememberAuthz(a)
+			return a, nil
+		case raw.Status == StatusInvalid, raw.Status == StatusDeactivated,
+			raw.Status == StatusExpired, raw.Status == StatusRevoked:
 			return nil, raw.error(url)
 		}
 
 		// Exponential backoff is implemented in c.get above.
 		// This is just to prevent continuously hitting the CA
 		// while waiting for a final authorization status.
-		d := retryAfter(res.Header.Get("Retry-After"))
-		if d == 0 {
-			// Given that the fastest challenges TLS-SNI and HTTP-01
-			// require a CA to make at least 1 network round trip
-			// and most likely persist a challenge state,
-			// this default delay seems reasonable.
-			d = time.Second
+		d := delay
+		if ra := retryAfter(res.Header.Get("Retry-After")); ra > 0 {
+			d = ra
+		} else if delay *= 2; delay > maxAuthzPollInterval {
+			delay = maxAuthzPollInterval
 		}
 		t := time.NewTimer(d)
 		select {
@@ -463,18 +957,29 @@ func (c *Client) WaitAuthorization(ctx context.Context, url string) (*Authorizat
 	}
 }
 
+// maxAuthzPollInterval is the longest interval between the polls of
+// WaitAuthorization when the CA does not specify one with Retry-After.
+const maxAuthzPollInterval = 10 * time.Second
+
+// authzPollInterval is the first interval between the polls of
+// WaitAuthorization. Given that the fastest challenges TLS-SNI and HTTP-01
+// require a CA to make at least 1 network round trip and most likely persist
+// a challenge state, this initial delay seems reasonable.
+// It is a variable so that tests can lower it.
+var authzPollInterval = time.Second
+
 // GetChallenge retrieves the current status of an challenge.
 //
 // A client typically polls a challenge status using this method.
 func (c *Client) GetChallenge(ctx context.Context, url string) (*Challenge, error) {
-	res, err := c.get(ctx, url, wantStatus(http.StatusOK, http.StatusAccepted))
+	res, err := c.fetch(ctx, url, wantStatus(http.StatusOK, http.StatusAccepted))
 	if err != nil {
 		return nil, err
 	}
 	defer res.Body.Close()
 	v := wireChallenge{URI: url}
-	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
-		return nil, fmt.Errorf("acme: invalid response: %v", err)
+	if err := c.decodeResponse(res, &v); err != nil {
+		return nil, err
 	}
 	return v.challenge(), nil
 }
@@ -498,7 +1003,7 @@ func (c *Client) Accept(ctx context.Context, chal *Challenge) (*Challenge, error
 		Type:     chal.Type,
 		Auth:     auth,
 	}
-	res, err := c.post(ctx, c.Key, chal.URI, req, wantStatus(
+	res, err := c.post(ctx, nil, chal.URI, req, wantStatus(
 		http.StatusOK,       // according to the spec
 		http.StatusAccepted, // Let's Encrypt: see https://goo.gl/WsJ7VT (acme-divergences.md)
 	))
@@ -507,9 +1012,10 @@ func (c *Client) Accept(ctx context.Context, chal *Challenge) (*Challenge, error
 	}
 	defer res.Body.Close()
 
-	var v wireChallenge
-	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
-		return nil, fmt.Errorf("acme: invalid response: %v", err)
+	// The response describes the accepted challenge.
+	v := wireChallenge{URI: chal.URI, Type: chal.Type}
+	if err := c.decodeResponse(res, &v); err != nil {
+		return nil, err
 	}
 	return v.challenge(), nil
 }
@@ -520,12 +1026,11 @@ func (c *Client) Accept(ctx context.Context, chal *Challenge) (*Challenge, error
 //
 // The token argument is a Challenge.Token value.
 func (c *Client) DNS01ChallengeRecord(token string) (string, error) {
-	ka, err := keyAuth(c.Key.Public(), token)
+	b, err := keyAuthDigest(c.Key.Public(), token, challengeDigest("dns-01"))
 	if err != nil {
 		return "", err
 	}
-	b := sha256.Sum256([]byte(ka))
-	return base64.RawURLEncoding.EncodeToString(b[:]), nil
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
 // HTTP01ChallengeResponse returns the response for an http-01 challenge.
@@ -564,12 +1069,11 @@ func (c *Client) HTTP01ChallengePath(token string) string {
 // The returned certificate is valid for the next 24 hours and must be presented only when
 // the server name of the TLS ClientHello matches exactly the returned name value.
 func (c *Client) TLSSNI01ChallengeCert(token string, opt ...CertOption) (cert tls.Certificate, name string, err error) {
-	ka, err := keyAuth(c.Key.Public(), token)
+	b, err := keyAuthDigest(c.Key.Public(), token, challengeDigest("tls-sni-01"))
 	if err != nil {
 		return tls.Certificate{}, "", err
 	}
-	b := sha256.Sum256([]byte(ka))
-	h := hex.EncodeToString(b[:])
+	h := hex.EncodeToString(b)
 	name = fmt.Sprintf("%s.%s.acme.invalid", h[:32], h[32:])
 	cert, err = tlsChallengeCert([]string{name}, opt)
 	if err != nil {
@@ -595,12 +1099,11 @@ func (c *Client) TLSSNI02ChallengeCert(token string, opt ...CertOption) (cert tl
 	h := hex.EncodeToString(b[:])
 	sanA := fmt.Sprintf("%s.%s.token.acme.invalid", h[:32], h[32:])
 
-	ka, err := keyAuth(c.Key.Public(), token)
+	kb, err := keyAuthDigest(c.Key.Public(), token, challengeDigest("tls-sni-02"))
 	if err != nil {
 		return tls.Certificate{}, "", err
 	}
-	b = sha256.Sum256([]byte(ka))
-	h = hex.EncodeToString(b[:])
+	h = hex.EncodeToString(kb)
 	sanB := fmt.Sprintf("%s.%s.ka.acme.invalid", h[:32], h[32:])
 
 	cert, err = tlsChallengeCert([]string{sanA, sanB}, opt)
@@ -624,12 +1127,11 @@ func (c *Client) TLSSNI02ChallengeCert(token string, opt ...CertOption) (cert tl
 // the server name in the TLS ClientHello matches the domain, and the special acme-tls/1 ALPN protocol
 // has been specified.
 func (c *Client) TLSALPN01ChallengeCert(token, domain string, opt ...CertOption) (cert tls.Certificate, err error) {
-	ka, err := keyAuth(c.Key.Public(), token)
+	digest, err := keyAuthDigest(c.Key.Public(), token, challengeDigest("tls-alpn-01"))
 	if err != nil {
 		return tls.Certificate{}, err
 	}
-	shasum := sha256.Sum256([]byte(ka))
-	extValue, err := asn1.Marshal(shasum[:])
+	extValue, err := asn1.Marshal(digest)
 	if err != nil {
 		return tls.Certificate{}, err
 	}
@@ -675,7 +1177,7 @@ func (c *Client) doReg(ctx context.Context, url string, typ string, acct *Accoun
 		req.Contact = acct.Contact
 		req.Agreement = acct.AgreedTerms
 	}
-	res, err := c.post(ctx, c.Key, url, req, wantStatus(
+	res, err := c.post(ctx, nil, url, req, wantStatus(
 		http.StatusOK,       // updates and deletes
 		http.StatusCreated,  // new account creation
 		http.StatusAccepted, // Let's Encrypt divergent implementation
@@ -684,15 +1186,29 @@ func (c *Client) doReg(ctx context.Context, url string, typ string, acct *Accoun
 		return nil, err
 	}
 	defer res.Body.Close()
+	return c.responseAccount(res)
+}
 
+// responseAccount decodes the Account of a registration response.
+func (c *Client) responseAccount(res *http.Response) (*Account, error) {
 	var v struct {
 		Contact        []string
 		Agreement      string
 		Authorizations string
 		Certificates   string
-	}
-	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
-		return nil, fmt.Errorf("acme: invalid response: %v", err)
+
+		// Unused, but known for StrictDecoding.
+		Key                    json.RawMessage
+		ID                     json.RawMessage
+		InitialIP              json.RawMessage
+		CreatedAt              json.RawMessage
+		Status                 json.RawMessage
+		TermsOfServiceAgreed   json.RawMessage
+		Orders                 json.RawMessage
+		ExternalAccountBinding json.RawMessage
+	}
+	if err := c.decodeResponse(res, &v); err != nil {
+		return nil, err
 	}
 	var tos string
 	if v := linkHeader(res.Header, "terms-of-service"); len(v) > 0 {
@@ -715,12 +1231,12 @@ func (c *Client) doReg(ctx context.Context, url string, typ string, acct *Accoun
 
 // popNonce returns a nonce value previously stored with c.addNonce
 // or fetches a fresh one from a URL by issuing a HEAD request.
-// It first tries c.directoryURL() and then the provided url if the former fails.
+// It first tries c.nonceURL() and then the provided url if the former fails.
 func (c *Client) popNonce(ctx context.Context, url string) (string, error) {
 	c.noncesMu.Lock()
 	defer c.noncesMu.Unlock()
 	if len(c.nonces) == 0 {
-		dirURL := c.directoryURL()
+		dirURL := c.nonceURL()
 		v, err := c.fetchNonce(ctx, dirURL)
 		if err != nil && url != dirURL {
 			v, err = c.fetchNonce(ctx, url)
@@ -748,6 +1264,7 @@ func (c *Client) addNonce(h http.Header) {
 	if v == "" {
 		return
 	}
+	c.traceNonce(v)
 	c.noncesMu.Lock()
 	defer c.noncesMu.Unlock()
 	if len(c.nonces) >= maxNonces {
@@ -776,6 +1293,7 @@ func (c *Client) fetchNonce(ctx context.Context, url string) (string, error) {
 		}
 		return "", errors.New("acme: nonce not found")
 	}
+	c.traceNonce(nonce)
 	return nonce, nil
 }
 
@@ -826,7 +1344,7 @@ func (c *Client) chainCert(ctx context.Context, url string, depth int) ([][]byte
 		return nil, errors.New("acme: certificate chain is too deep")
 	}
 
-	res, err := c.get(ctx, url, wantStatus(http.StatusOK))
+	res, err := c.fetch(ctx, url, wantStatus(http.StatusOK))
 	if err != nil {
 		return nil, err
 	}
@@ -875,6 +1393,75 @@ func linkHeader(h http.Header, rel string) []string {
 	return links
 }
 
+// JWKThumbprint returns the JWK thumbprint of the public part of c.Key,
+// as specified in RFC 7638, for instance to provision responses to
+// challenges with an external solver. See also KeyAuthorization.
+func (c *Client) JWKThumbprint() (string, error) {
+	if c.Key == nil {
+		return "", errors.New("acme: client has no key")
+	}
+	return JWKThumbprint(c.Key.Public())
+}
+
+// KeyAuthorization returns the key authorization of the challenge token,
+// the token followed by "." and the JWK thumbprint of c.Key, as specified in
+// RFC 8555, section 8.1. It is the response of http-01 challenges; dns-01
+// and tls-alpn-01 challenges use its SHA-256 digest, see DNS01ChallengeRecord,
+// TLSALPN01ChallengeCert and KeyAuthorizationDigest.
+func (c *Client) KeyAuthorization(token string) (string, error) {
+	if c.Key == nil {
+		return "", errors.New("acme: client has no key")
+	}
+	return keyAuth(c.Key.Public(), token)
+}
+
+// KeyAuthorizationDigest returns the digest of the key authorization of the
+// challenge token with the hash h, such as the SHA-256 digest the responses
+// of dns-01 and tls-alpn-01 challenges are derived from, for instance to
+// solve a challenge type this package does not implement. If h is zero,
+// SHA-256 is used.
+func (c *Client) KeyAuthorizationDigest(token string, h crypto.Hash) ([]byte, error) {
+	if c.Key == nil {
+		return nil, errors.New("acme: client has no key")
+	}
+	if h == 0 {
+		h = crypto.SHA256
+	}
+	return keyAuthDigest(c.Key.Public(), token, h)
+}
+
+// challengeDigests maps the challenge types whose responses are derived
+// from a digest of the key authorization to the hash of the digest.
+var challengeDigests = map[string]crypto.Hash{
+	"dns-01":      crypto.SHA256,
+	"tls-alpn-01": crypto.SHA256,
+	"tls-sni-01":  crypto.SHA256,
+	"tls-sni-02":  crypto.SHA256,
+}
+
+// challengeDigest returns the hash of the key authorization digest
+// of the challenges of type typ, SHA-256 if challengeDigests has none.
+func challengeDigest(typ string) crypto.Hash {
+	if h, ok := challengeDigests[typ]; ok {
+		return h
+	}
+	return crypto.SHA256
+}
+
+// keyAuthDigest returns the digest with h of the key authorization of token.
+func keyAuthDigest(pub crypto.PublicKey, token string, h crypto.Hash) ([]byte, error) {
+	if !h.Available() {
+		return nil, fmt.Errorf("acme: unavailable key authorization digest algorithm %v", h)
+	}
+	ka, err := keyAuth(pub, token)
+	if err != nil {
+		return nil, err
+	}
+	d := h.New()
+	d.Write([]byte(ka))
+	return d.Sum(nil), nil
+}
+
 // keyAuth generates a key authorization string for a given token.
 func keyAuth(pub crypto.PublicKey, token string) (string, error) {
 	th, err := JWKThumbprint(pub)
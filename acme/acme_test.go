@@ -7,21 +7,29 @@ package acme
 import (
 	"bytes"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -106,6 +114,245 @@ func TestDiscover(t *testing.T) {
 	}
 }
 
+func TestDiscoverMeta(t *testing.T) {
+	tt := []struct {
+		name string
+		meta string
+	}{
+		{"draft", `{
+			"terms-of-service": "https://example.com/acme/terms",
+			"website": "https://example.com/acme/",
+			"caa-identities": ["example.com", "example.net"]
+		}`},
+		{"rfc8555", `{
+			"termsOfService": "https://example.com/acme/terms",
+			"website": "https://example.com/acme/",
+			"caaIdentities": ["example.com", "example.net"],
+			"externalAccountRequired": true
+		}`},
+	}
+	for _, test := range tt {
+		t.Run(test.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"new-reg": "https://example.com/acme/new-reg", "meta": %s}`, test.meta)
+			}))
+			defer ts.Close()
+			c := Client{DirectoryURL: ts.URL}
+			dir, err := c.Discover(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "https://example.com/acme/terms"; dir.Terms != want {
+				t.Errorf("dir.Terms = %q; want %q", dir.Terms, want)
+			}
+			if want := "https://example.com/acme/"; dir.Website != want {
+				t.Errorf("dir.Website = %q; want %q", dir.Website, want)
+			}
+			if want := []string{"example.com", "example.net"}; !reflect.DeepEqual(dir.CAA, want) {
+				t.Errorf("dir.CAA = %q; want %q", dir.CAA, want)
+			}
+			if want := test.name == "rfc8555"; dir.ExternalAccountRequired != want {
+				t.Errorf("dir.ExternalAccountRequired = %v; want %v", dir.ExternalAccountRequired, want)
+			}
+		})
+	}
+}
+
+func TestDiscoverNewAccount(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"newAccount": "https://example.com/acme/new-acct", "newNonce": "https://example.com/acme/new-nonce"}`)
+	}))
+	defer ts.Close()
+	c := Client{DirectoryURL: ts.URL}
+	dir, err := c.Discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://example.com/acme/new-acct"; dir.RegURL != want {
+		t.Errorf("dir.RegURL = %q; want %q", dir.RegURL, want)
+	}
+}
+
+func TestDiscoverFrom(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	mux := http.NewServeMux()
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Link", `</dir>;rel="index"`)
+		w.Header().Set("Replay-Nonce", "nonce")
+		switch {
+		case r.URL.Path == "/dir":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"newAccount": "%[1]s/new-acct", "newNonce": "%[1]s/new-nonce"}`, ts.URL)
+		case r.URL.Path == "/acct/1" && r.Method == "POST":
+			var j struct{ Resource string }
+			decodeJWSRequest(t, &j, r)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"status": "valid", "contact": ["mailto:admin@example.com"]}`)
+		case r.URL.Path == "/acct/1":
+			// Unauthenticated reads are not allowed, but the
+			// response links to the directory nonetheless.
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	// Only the account URL is known.
+	acctURL := ts.URL + "/acct/1"
+	c := Client{Key: testKeyEC}
+	ctx := context.Background()
+	dir, err := c.DiscoverFrom(ctx, acctURL)
+	if err != nil {
+		t.Fatalf("DiscoverFrom: %v", err)
+	}
+	if want := ts.URL + "/new-acct"; dir.RegURL != want {
+		t.Errorf("dir.RegURL = %q; want %q", dir.RegURL, want)
+	}
+	if _, err := c.DiscoverFrom(ctx, acctURL); err != nil {
+		t.Fatalf("second DiscoverFrom: %v", err)
+	}
+	if _, err := c.GetReg(ctx, acctURL); err != nil {
+		t.Fatalf("GetReg: %v", err)
+	}
+	want := []string{"HEAD /acct/1", "GET /dir", "POST /acct/1"}
+	mu.Lock()
+	got := append([]string{}, requests...)
+	mu.Unlock()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("requests = %q; want %q", got, want)
+	}
+
+	// The link is required.
+	c = Client{Key: testKeyEC}
+	if _, err := c.DiscoverFrom(ctx, ts.URL+"/dir"); err != nil {
+		t.Fatalf("DiscoverFrom the directory: %v", err)
+	}
+	nolink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer nolink.Close()
+	c = Client{Key: testKeyEC}
+	if _, err := c.DiscoverFrom(ctx, nolink.URL); err == nil {
+		t.Error("DiscoverFrom succeeded without a rel=index link")
+	}
+}
+
+func TestTermsOfService(t *testing.T) {
+	terms := "https://example.com/acme/terms/2016"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"newAccount": "https://example.com/acme/new-acct", "meta": {"termsOfService": %q}}`, terms)
+	}))
+	defer ts.Close()
+	c := Client{DirectoryURL: ts.URL}
+	ctx := context.Background()
+	if _, err := c.Discover(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	url, changed, err := c.TermsOfService(ctx, "https://example.com/acme/terms/2016")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != terms || changed {
+		t.Errorf("TermsOfService = %q, %v; want %q, false", url, changed, terms)
+	}
+
+	// The CA updates its terms: the new URL is fetched despite
+	// the directory cached by Discover, which is updated.
+	terms = "https://example.com/acme/terms/2019"
+	url, changed, err = c.TermsOfService(ctx, "https://example.com/acme/terms/2016")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != terms || !changed {
+		t.Errorf("TermsOfService = %q, %v; want %q, true", url, changed, terms)
+	}
+	dir, err := c.Discover(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir.Terms != terms {
+		t.Errorf("Discover: dir.Terms = %q; want %q", dir.Terms, terms)
+	}
+
+	// Terms never accepted.
+	if _, changed, _ := c.TermsOfService(ctx, ""); !changed {
+		t.Error("TermsOfService: changed is false for terms never accepted")
+	}
+
+	// No terms at all.
+	terms = ""
+	url, changed, err = c.TermsOfService(ctx, "https://example.com/acme/terms/2019")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "" || changed {
+		t.Errorf("TermsOfService = %q, %v; want no terms", url, changed)
+	}
+}
+
+func TestGetAccount(t *testing.T) {
+	var exists bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "test-nonce")
+		if r.Method == "HEAD" {
+			return
+		}
+		var j struct {
+			Resource           string
+			OnlyReturnExisting bool
+		}
+		decodeJWSRequest(t, &j, r)
+		if j.Resource != "new-reg" || !j.OnlyReturnExisting {
+			t.Errorf("request = %+v; want new-reg with onlyReturnExisting", j)
+		}
+		if !exists {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{
+				"type": "urn:ietf:params:acme:error:accountDoesNotExist",
+				"detail": "No account exists with the provided key"
+			}`))
+			return
+		}
+		w.Header().Set("Location", "https://ca.tld/acme/acct/1")
+		w.Write([]byte(`{"status": "valid", "contact": ["mailto:admin@example.com"]}`))
+	}))
+	defer ts.Close()
+
+	c := Client{Key: testKeyEC, dir: &Directory{RegURL: ts.URL}}
+	if _, err := c.GetAccount(context.Background()); err != ErrNoAccount {
+		t.Errorf("GetAccount without account: %v; want ErrNoAccount", err)
+	}
+	if kid := c.accountKID(); kid != "" {
+		t.Errorf("account KID = %q; want none", kid)
+	}
+
+	exists = true
+	a, err := c.GetAccount(context.Background())
+	if err != nil {
+		t.Fatalf("GetAccount: %v", err)
+	}
+	if a.URI != "https://ca.tld/acme/acct/1" {
+		t.Errorf("a.URI = %q; want https://ca.tld/acme/acct/1", a.URI)
+	}
+	if want := []string{"mailto:admin@example.com"}; !reflect.DeepEqual(a.Contact, want) {
+		t.Errorf("a.Contact = %q; want %q", a.Contact, want)
+	}
+	if kid := c.accountKID(); kid != a.URI {
+		t.Errorf("account KID = %q; want %q", kid, a.URI)
+	}
+}
+
 func TestRegister(t *testing.T) {
 	contacts := []string{"mailto:admin@example.com"}
 
@@ -235,6 +482,62 @@ func TestUpdateReg(t *testing.T) {
 	}
 }
 
+func TestUpdateAccount(t *testing.T) {
+	var got []string // contacts of the last request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			w.Header().Set("Replay-Nonce", "test-nonce")
+			return
+		}
+		var j struct {
+			Resource string
+			Contact  *[]string
+		}
+		decodeJWSRequest(t, &j, r)
+		if j.Resource != "reg" {
+			t.Errorf("j.Resource = %q; want reg", j.Resource)
+		}
+		if j.Contact == nil {
+			t.Error("request without contact")
+		} else {
+			got = *j.Contact
+		}
+		b, _ := json.Marshal(got)
+		fmt.Fprintf(w, `{"contact":%s}`, b)
+	}))
+	defer ts.Close()
+
+	c := Client{Key: testKeyEC}
+	contacts := []string{"mailto:new@example.com", "tel:+12025550100"}
+	a, err := c.UpdateAccount(context.Background(), ts.URL, contacts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, contacts) {
+		t.Errorf("sent contacts %v; want %v", got, contacts)
+	}
+	if !reflect.DeepEqual(a.Contact, contacts) {
+		t.Errorf("a.Contact = %v; want %v", a.Contact, contacts)
+	}
+	if a.URI != ts.URL {
+		t.Errorf("a.URI = %q; want %q", a.URI, ts.URL)
+	}
+
+	// Removing all the contacts sends an empty array.
+	if a, err = c.UpdateAccount(context.Background(), ts.URL, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || len(got) != 0 || len(a.Contact) != 0 {
+		t.Errorf("sent contacts %#v, got %v; want an empty array", got, a.Contact)
+	}
+
+	for _, ct := range []string{"admin@example.com", "https://example.com", "mailto:", ""} {
+		if _, err := c.UpdateAccount(context.Background(), ts.URL, []string{ct}); err == nil {
+			t.Errorf("UpdateAccount accepted the contact %q", ct)
+		}
+	}
+}
+
 func TestGetReg(t *testing.T) {
 	const terms = "https://ca.tld/acme/terms"
 	const newTerms = "https://ca.tld/acme/new-terms"
@@ -445,6 +748,107 @@ func TestAuthorizeValid(t *testing.T) {
 	}
 }
 
+func TestPreAuthorization(t *testing.T) {
+	expires := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	var newAuthzCount, acceptCount int
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		if r.Method == "HEAD" {
+			return
+		}
+		switch r.URL.Path {
+		case "/":
+			// RFC 8555 directory with the optional newAuthz.
+			fmt.Fprintf(w, `{"newAuthz": %q}`, ts.URL+"/new-authz")
+		case "/new-authz":
+			newAuthzCount++
+			w.Header().Set("Location", ts.URL+"/authz/1")
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{
+				"identifier": {"type": "dns", "value": "example.com"},
+				"status": "pending",
+				"challenges": [{"type": "http-01", "uri": %q, "token": "token"}]
+			}`, ts.URL+"/chal/1")
+		case "/chal/1":
+			acceptCount++
+			fmt.Fprintf(w, `{"type": "http-01", "uri": %q, "status": "pending", "token": "token"}`, ts.URL+"/chal/1")
+		case "/authz/1":
+			fmt.Fprintf(w, `{
+				"identifier": {"type": "dns", "value": "example.com"},
+				"status": "valid",
+				"expires": %q
+			}`, expires.Format(time.RFC3339))
+		default:
+			t.Errorf("unrecognized r.URL.Path: %s", r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+
+	cl := &Client{Key: testKeyEC, DirectoryURL: ts.URL}
+	ctx := context.Background()
+	authz, err := cl.Authorize(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	if authz.Status != StatusPending {
+		t.Fatalf("authz.Status = %q; want %q", authz.Status, StatusPending)
+	}
+	if _, err := cl.Accept(ctx, authz.Challenges[0]); err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	authz, err = cl.WaitAuthorization(ctx, authz.URI)
+	if err != nil {
+		t.Fatalf("WaitAuthorization: %v", err)
+	}
+	if !authz.Expires.Equal(expires) {
+		t.Errorf("authz.Expires = %v; want %v", authz.Expires, expires)
+	}
+
+	// A subsequent certificate request reuses the valid authorization.
+	authz, err = cl.Authorize(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("second Authorize: %v", err)
+	}
+	if authz.Status != StatusValid || authz.URI != ts.URL+"/authz/1" {
+		t.Errorf("second Authorize: status %q, URI %q; want valid %s", authz.Status, authz.URI, ts.URL+"/authz/1")
+	}
+	if newAuthzCount != 1 || acceptCount != 1 {
+		t.Errorf("new-authz requests: %d, challenges accepted: %d; want 1 and 1", newAuthzCount, acceptCount)
+	}
+
+	// Another identifier is not affected.
+	if _, err := cl.Authorize(ctx, "other.example.com"); err != nil {
+		t.Fatalf("Authorize(other.example.com): %v", err)
+	}
+	if newAuthzCount != 2 {
+		t.Errorf("new-authz requests: %d; want 2", newAuthzCount)
+	}
+
+	// Nor is an expired authorization reused.
+	defer func(old func() time.Time) { timeNow = old }(timeNow)
+	timeNow = func() time.Time { return expires }
+	if _, err := cl.Authorize(ctx, "example.com"); err != nil {
+		t.Fatalf("Authorize after expiration: %v", err)
+	}
+	if newAuthzCount != 3 {
+		t.Errorf("new-authz requests: %d; want 3", newAuthzCount)
+	}
+}
+
+func TestAuthorizeNotSupported(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		// RFC 8555 directory without newAuthz.
+		fmt.Fprint(w, `{"newNonce": "https://example.com/acme/new-nonce"}`)
+	}))
+	defer ts.Close()
+	cl := &Client{Key: testKeyEC, DirectoryURL: ts.URL}
+	if _, err := cl.Authorize(context.Background(), "example.com"); err != ErrPreAuthorizationNotSupported {
+		t.Errorf("Authorize: err = %v; want ErrPreAuthorizationNotSupported", err)
+	}
+}
+
 func TestGetAuthorization(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
@@ -521,7 +925,85 @@ func TestGetAuthorization(t *testing.T) {
 	}
 }
 
+func TestGetAuthorizationDecoding(t *testing.T) {
+	tt := []struct {
+		name   string
+		body   string
+		strict bool
+		errStr string // substring of the error, if any
+	}{
+		{
+			name: "unknown fields tolerated",
+			body: `{"status":"pending","wildcard":false,"extra":1,
+				"challenges":[{"type":"http-01","url":"https://ca.tld/c","token":"t","extra":2}]}`,
+		},
+		{
+			name:   "unknown fields strict",
+			body:   `{"status":"pending","extra":1}`,
+			strict: true,
+			errStr: `unknown field "extra"`,
+		},
+		{
+			name:   "known fields strict",
+			body:   `{"status":"pending","wildcard":false,"challenges":[{"type":"http-01","url":"https://ca.tld/c"}]}`,
+			strict: true,
+		},
+		{
+			name:   "missing status",
+			body:   `{"identifier":{"type":"dns","value":"example.org"}}`,
+			errStr: "authorization has no status",
+		},
+		{
+			name:   "missing challenge type",
+			body:   `{"status":"pending","challenges":[{"token":"t"}]}`,
+			errStr: "challenge has no type",
+		},
+		{
+			name:   "malformed",
+			body:   `{"status":`,
+			errStr: `body: "{\"status\":"`,
+		},
+	}
+	for _, test := range tt {
+		t.Run(test.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(test.body))
+			}))
+			defer ts.Close()
+			cl := Client{Key: testKeyEC, StrictDecoding: test.strict}
+			_, err := cl.GetAuthorization(context.Background(), ts.URL)
+			switch {
+			case test.errStr == "" && err != nil:
+				t.Errorf("GetAuthorization: %v", err)
+			case test.errStr != "" && err == nil:
+				t.Errorf("GetAuthorization: no error; want %q", test.errStr)
+			case test.errStr != "" && !strings.Contains(err.Error(), test.errStr):
+				t.Errorf("GetAuthorization: %v; want %q", err, test.errStr)
+			}
+		})
+	}
+}
+
+func TestDecodeResponseSnippet(t *testing.T) {
+	body := `{"status":` + strings.Repeat("x", 2*maxResponseSnippet)
+	res := &http.Response{Body: ioutil.NopCloser(strings.NewReader(body))}
+	var v wireAuthz
+	err := (&Client{}).decodeResponse(res, &v)
+	if err == nil {
+		t.Fatal("decodeResponse: no error")
+	}
+	if !strings.Contains(err.Error(), `body: "{\"status\":xxx`) || !strings.HasSuffix(err.Error(), `..."`) {
+		t.Errorf("decodeResponse: %v; want a truncated snippet of the body", err)
+	}
+	if len(err.Error()) > 2*maxResponseSnippet {
+		t.Errorf("len(err) = %d; want at most %d", len(err.Error()), 2*maxResponseSnippet)
+	}
+}
+
 func TestWaitAuthorization(t *testing.T) {
+	defer func(d time.Duration) { authzPollInterval = d }(authzPollInterval)
+	authzPollInterval = time.Millisecond
+
 	t.Run("wait loop", func(t *testing.T) {
 		var count int
 		authz, err := runWaitAuthorization(context.Background(), t, func(w http.ResponseWriter, r *http.Request) {
@@ -581,6 +1063,98 @@ func TestWaitAuthorization(t *testing.T) {
 			}
 		})
 	}
+	for _, typ := range []string{"http-01", "dns-01", "tls-alpn-01"} {
+		t.Run("delayed validation "+typ, func(t *testing.T) {
+			var count int
+			authz, err := runWaitAuthorization(context.Background(), t, func(w http.ResponseWriter, r *http.Request) {
+				count++
+				w.Header().Set("Retry-After", "0")
+				authz, chal := StatusPending, StatusProcessing
+				switch {
+				case count == 1:
+					chal = StatusPending
+				case count > 4:
+					authz, chal = StatusValid, StatusValid
+				}
+				fmt.Fprintf(w, `{"status":%q,"identifier":{"type":"dns","value":"example.org"},
+					"challenges":[{"type":%q,"uri":"https://ca.tld/chal","token":"token","status":%q}]}`,
+					authz, typ, chal)
+			})
+			if err != nil {
+				t.Fatalf("non-nil error: %v", err)
+			}
+			if count != 5 {
+				t.Errorf("authorization polled %d times; want 5", count)
+			}
+			if authz.Status != StatusValid || len(authz.Challenges) != 1 || authz.Challenges[0].Status != StatusValid {
+				t.Errorf("authz = %+v; want a valid authorization with a valid challenge", authz)
+			}
+		})
+		t.Run("delayed invalidation "+typ, func(t *testing.T) {
+			var count int
+			_, err := runWaitAuthorization(context.Background(), t, func(w http.ResponseWriter, r *http.Request) {
+				count++
+				w.Header().Set("Retry-After", "0")
+				if count < 3 {
+					fmt.Fprintf(w, `{"status":"pending","challenges":[{"type":%q,"status":"processing"}]}`, typ)
+					return
+				}
+				fmt.Fprintf(w, `{"status":"invalid","identifier":{"type":"dns","value":"example.org"},
+					"challenges":[{"type":%q,"status":"invalid",
+					"error":{"type":"urn:ietf:params:acme:error:unauthorized","detail":"wrong response"}}]}`, typ)
+			})
+			ae, ok := err.(*AuthorizationError)
+			if !ok {
+				t.Fatalf("err is %v (%T); want non-nil *AuthorizationError", err, err)
+			}
+			if ae.Status != StatusInvalid || ae.Identifier != "example.org" {
+				t.Errorf("ae.Status, ae.Identifier = %q, %q; want %q, example.org", ae.Status, ae.Identifier, StatusInvalid)
+			}
+			if len(ae.Errors) != 1 || !strings.Contains(ae.Errors[0].Error(), "wrong response") {
+				t.Errorf("ae.Errors = %v; want the challenge error", ae.Errors)
+			}
+		})
+	}
+	for _, status := range []string{StatusDeactivated, StatusExpired, StatusRevoked} {
+		t.Run(status+" status", func(t *testing.T) {
+			_, err := runWaitAuthorization(context.Background(), t, func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"status":%q,"identifier":{"type":"dns","value":"example.org"}}`, status)
+			})
+			ae, ok := err.(*AuthorizationError)
+			if !ok {
+				t.Fatalf("err is %v (%T); want non-nil *AuthorizationError", err, err)
+			}
+			if ae.Status != status {
+				t.Errorf("ae.Status = %q; want %q", ae.Status, status)
+			}
+			if want := "authorization is " + status; !strings.Contains(ae.Error(), want) {
+				t.Errorf("ae.Error() = %q; want it to contain %q", ae.Error(), want)
+			}
+		})
+	}
+	for _, v := range []string{"0", "-1", "soon", "Tue, 27 Apr 2017 11:00:00 GMT"} {
+		t.Run("ignored Retry-After "+v, func(t *testing.T) {
+			defer func(d time.Duration) { authzPollInterval = d }(authzPollInterval)
+			authzPollInterval = 100 * time.Millisecond
+			var count int
+			start := time.Now()
+			_, err := runWaitAuthorization(context.Background(), t, func(w http.ResponseWriter, r *http.Request) {
+				count++
+				w.Header().Set("Retry-After", v)
+				if count > 1 {
+					fmt.Fprintf(w, `{"status":"valid"}`)
+					return
+				}
+				fmt.Fprintf(w, `{"status":"pending"}`)
+			})
+			if err != nil {
+				t.Fatalf("non-nil error: %v", err)
+			}
+			if d := time.Since(start); d < authzPollInterval {
+				t.Errorf("authorization polled again after %v; want the default interval, %v", d, authzPollInterval)
+			}
+		})
+	}
 	t.Run("context cancel", func(t *testing.T) {
 		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
 		defer cancel()
@@ -687,6 +1261,48 @@ func TestPollChallenge(t *testing.T) {
 	if chall.Token != "token1" {
 		t.Errorf("c.Token = %q; want token1", chall.Token)
 	}
+	if !chall.Validated.IsZero() || chall.Error != nil {
+		t.Errorf("c.Validated = %v, c.Error = %v; want zero values", chall.Validated, chall.Error)
+	}
+}
+
+func TestGetChallengeValidatedAndError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{
+			"type":"http-01",
+			"status":"invalid",
+			"uri":"https://ca.tld/acme/challenge/publickey/id1",
+			"token":"token1",
+			"validated":"2019-01-02T03:04:05Z",
+			"error":{
+				"type":"urn:ietf:params:acme:error:unauthorized",
+				"detail":"Invalid response from http://example.org/.well-known/acme-challenge/token1",
+				"status":403
+			}}`)
+	}))
+	defer ts.Close()
+
+	cl := Client{Key: testKeyEC}
+	chall, err := cl.GetChallenge(context.Background(), ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC); !chall.Validated.Equal(want) {
+		t.Errorf("Validated = %v; want %v", chall.Validated, want)
+	}
+	cerr, ok := chall.Error.(*Error)
+	if !ok {
+		t.Fatalf("Error = %#v; want an *Error", chall.Error)
+	}
+	if cerr.StatusCode != 403 {
+		t.Errorf("Error.StatusCode = %d; want 403", cerr.StatusCode)
+	}
+	if cerr.ProblemType != "urn:ietf:params:acme:error:unauthorized" {
+		t.Errorf("Error.ProblemType = %q; want urn:ietf:params:acme:error:unauthorized", cerr.ProblemType)
+	}
+	if !strings.HasPrefix(cerr.Detail, "Invalid response") {
+		t.Errorf("Error.Detail = %q; want it to start with \"Invalid response\"", cerr.Detail)
+	}
 }
 
 func TestAcceptChallenge(t *testing.T) {
@@ -834,6 +1450,144 @@ func TestNewCert(t *testing.T) {
 	}
 }
 
+func TestNewCertOrderOptions(t *testing.T) {
+	notBefore := time.Date(2019, time.May, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := notBefore.Add(72 * time.Hour)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			w.Header().Set("Replay-Nonce", "test-nonce")
+			return
+		}
+		var j struct {
+			NotBefore string `json:"notBefore"`
+			NotAfter  string `json:"notAfter"`
+		}
+		decodeJWSRequest(t, &j, r)
+		if want := "2019-05-01T00:00:00Z"; j.NotBefore != want {
+			t.Errorf("notBefore = %q; want %q", j.NotBefore, want)
+		}
+		if want := "2019-05-04T00:00:00Z"; j.NotAfter != want {
+			t.Errorf("notAfter = %q; want %q", j.NotAfter, want)
+		}
+
+		// The CA ignores the requested validity.
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &testKeyEC.PublicKey, testKeyEC)
+		if err != nil {
+			t.Errorf("CreateCertificate: %v", err)
+		}
+		w.Header().Set("Location", "https://ca.tld/acme/cert/1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(der)
+	}))
+	defer ts.Close()
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "example.com"},
+	}, testKeyEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Client{Key: testKeyEC, dir: &Directory{CertURL: ts.URL}}
+	// WithNotAfter overrides exp.
+	der, _, err := c.CreateCert(context.Background(), csr, time.Hour, false, WithNotBefore(notBefore), WithNotAfter(notAfter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(der) != 1 {
+		t.Errorf("got %d certificates; want 1", len(der))
+	}
+}
+
+func TestCreateCertWithProfiles(t *testing.T) {
+	var profile string
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "test-nonce")
+		switch {
+		case r.Method == "HEAD":
+			return
+		case r.URL.Path == "/":
+			fmt.Fprintf(w, `{
+				"new-cert": %q,
+				"meta": {"profiles": {
+					"classic": "The same profile you're accustomed to",
+					"tlsserver": "Certificates for TLS servers only"
+				}}
+			}`, ts.URL+"/new-cert")
+			return
+		}
+		var j struct {
+			Profile *string `json:"profile"`
+		}
+		decodeJWSRequest(t, &j, r)
+		if j.Profile == nil {
+			profile = "<none>"
+		} else {
+			profile = *j.Profile
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &testKeyEC.PublicKey, testKeyEC)
+		if err != nil {
+			t.Errorf("CreateCertificate: %v", err)
+		}
+		w.Header().Set("Location", "https://ca.tld/acme/cert/1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(der)
+	}))
+	defer ts.Close()
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "example.com"},
+	}, testKeyEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Client{Key: testKeyEC, DirectoryURL: ts.URL}
+	dir, err := c.Discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dir.Profiles) != 2 || dir.Profiles["tlsserver"] == "" {
+		t.Errorf("Directory.Profiles = %q; want classic and tlsserver", dir.Profiles)
+	}
+
+	tests := []struct {
+		opts    []OrderOption
+		profile string
+	}{
+		{nil, "<none>"},
+		{[]OrderOption{WithProfiles("shortlived", "tlsserver", "classic")}, "tlsserver"},
+		{[]OrderOption{WithProfiles("classic")}, "classic"},
+	}
+	for _, test := range tests {
+		profile = ""
+		if _, _, err := c.CreateCert(context.Background(), csr, 0, false, test.opts...); err != nil {
+			t.Errorf("CreateCert(%v): %v", test.opts, err)
+			continue
+		}
+		if profile != test.profile {
+			t.Errorf("CreateCert(%v): requested profile %q; want %q", test.opts, profile, test.profile)
+		}
+	}
+
+	profile = ""
+	if _, _, err := c.CreateCert(context.Background(), csr, 0, false, WithProfiles("shortlived")); err == nil {
+		t.Error("CreateCert with an unknown profile succeeded")
+	}
+	if profile != "" {
+		t.Error("CreateCert with an unknown profile sent a request")
+	}
+}
+
 func TestFetchCert(t *testing.T) {
 	var count byte
 	var ts *httptest.Server
@@ -856,6 +1610,40 @@ func TestFetchCert(t *testing.T) {
 	}
 }
 
+func TestFetchCertAlternates(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cert":
+			w.Header().Add("Link", fmt.Sprintf("<%s/issuer>;rel=up", ts.URL))
+			w.Header().Add("Link", fmt.Sprintf("<%s/alt>;rel=\"alternate\"", ts.URL))
+			w.Write([]byte{1})
+		case "/alt":
+			w.Header().Add("Link", fmt.Sprintf("<%s/alt-issuer>;rel=up", ts.URL))
+			w.Header().Add("Link", fmt.Sprintf("<%s/cert>;rel=\"alternate\"", ts.URL))
+			w.Write([]byte{1})
+		case "/issuer":
+			w.Write([]byte{2})
+		case "/alt-issuer":
+			w.Write([]byte{3})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	res, err := (&Client{}).FetchCertAlternates(context.Background(), ts.URL+"/cert")
+	if err != nil {
+		t.Fatalf("FetchCertAlternates: %v", err)
+	}
+	chains := [][][]byte{
+		{{1}, {2}},
+		{{1}, {3}},
+	}
+	if !reflect.DeepEqual(res, chains) {
+		t.Errorf("res = %v; want %v", res, chains)
+	}
+}
+
 func TestFetchCertRetry(t *testing.T) {
 	var count int
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -878,6 +1666,112 @@ func TestFetchCertRetry(t *testing.T) {
 	}
 }
 
+func TestCreateCertCSRVerification(t *testing.T) {
+	var pub crypto.PublicKey // of the certificates issued by ts
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "test-nonce")
+		switch {
+		case r.Method == "HEAD":
+			return
+		case r.URL.Path == "/":
+			fmt.Fprintf(w, `{"new-cert": %q}`, ts.URL+"/new-cert")
+			return
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			DNSNames:     []string{"example.com"},
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, testKeyEC)
+		if err != nil {
+			t.Errorf("CreateCertificate: %v", err)
+		}
+		w.Header().Set("Location", "https://ca.tld/acme/cert/1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(der)
+	}))
+	defer ts.Close()
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		DNSNames: []string{"example.com"},
+	}, testKeyEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Client{Key: testKeyEC, DirectoryURL: ts.URL}
+
+	pub = &testKeyEC.PublicKey
+	der, _, err := c.CreateCert(context.Background(), csr, 0, false, WithCSRVerification())
+	if err != nil {
+		t.Fatalf("CreateCert with a matching certificate: %v", err)
+	}
+	if len(der) != 1 {
+		t.Errorf("len(der) = %d; want 1", len(der))
+	}
+
+	// The CA issues the certificate for another key.
+	pub = &testKey.PublicKey
+	if _, _, err := c.CreateCert(context.Background(), csr, 0, false); err != nil {
+		t.Errorf("CreateCert without WithCSRVerification: %v", err)
+	}
+	der, certURL, err := c.CreateCert(context.Background(), csr, 0, false, WithCSRVerification())
+	var e *CertMismatchError
+	if !errors.As(err, &e) || !e.PublicKey {
+		t.Fatalf("CreateCert: err = %v; want a *CertMismatchError for the public key", err)
+	}
+	if der != nil {
+		t.Errorf("CreateCert returned the mismatching certificate")
+	}
+	if certURL != "https://ca.tld/acme/cert/1" {
+		t.Errorf("certURL = %q; want the certificate URL", certURL)
+	}
+}
+
+func TestCreateCertPollInterval(t *testing.T) {
+	var polls int
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "HEAD":
+			w.Header().Set("Replay-Nonce", "test-nonce")
+		case r.URL.Path == "/":
+			fmt.Fprintf(w, `{"new-cert": %q}`, ts.URL+"/new-cert")
+		case r.URL.Path == "/new-cert":
+			w.Header().Set("Location", ts.URL+"/cert")
+			w.WriteHeader(http.StatusCreated)
+		case polls < 2:
+			polls++
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.Write([]byte{1})
+		}
+	}))
+	defer ts.Close()
+	cl := &Client{
+		Key:          testKeyEC,
+		DirectoryURL: ts.URL,
+		// No retries, but with the poll interval.
+		RetryBackoff: func(int, *http.Request, *http.Response) time.Duration { return -1 },
+	}
+	if _, _, err := cl.CreateCert(context.Background(), []byte("csr"), 0, false); err == nil {
+		t.Fatal("CreateCert succeeded without polling")
+	}
+	polls = 0
+	start := time.Now()
+	der, _, err := cl.CreateCert(context.Background(), []byte("csr"), 0, false, WithPollInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("CreateCert: %v", err)
+	}
+	if want := [][]byte{{1}}; !reflect.DeepEqual(der, want) {
+		t.Errorf("der = %v; want %v", der, want)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("CreateCert returned after %v; want at least 2 poll intervals", d)
+	}
+}
+
 func TestFetchCertCancel(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Retry-After", "0")
@@ -980,6 +1874,101 @@ func TestRevokeCert(t *testing.T) {
 	}
 }
 
+func TestRevokeCertSigner(t *testing.T) {
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, certKey.Public(), certKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ts *httptest.Server
+	var revoked []string // "account" or "cert", for each accepted request
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		if r.Method == "HEAD" {
+			return
+		}
+		var req struct{ Protected, Payload, Signature string }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatalf("revoke request: %v", err)
+		}
+		b, _ := base64.RawURLEncoding.DecodeString(req.Protected)
+		var head struct {
+			Kid string
+			JWK json.RawMessage
+		}
+		if err := json.Unmarshal(b, &head); err != nil {
+			t.Fatalf("revoke request header: %v", err)
+		}
+		// The account key is identified by kid, other keys are embedded.
+		var pub *ecdsa.PublicKey
+		mode := "account"
+		switch {
+		case head.Kid == ts.URL+"/acct/1" && head.JWK == nil:
+			pub = &testKeyEC.PublicKey
+		case head.Kid == "" && head.JWK != nil:
+			jwk, _ := jwkEncode(certKey.Public())
+			if string(head.JWK) == jwk {
+				pub = &certKey.PublicKey
+				mode = "cert"
+			}
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(req.Signature)
+		h := sha256.Sum256([]byte(req.Protected + "." + req.Payload))
+		if pub == nil || len(sig) != 64 ||
+			!ecdsa.Verify(pub, h[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"type":"urn:ietf:params:acme:error:unauthorized","detail":"key not authorized"}`))
+			return
+		}
+		revoked = append(revoked, mode)
+	}))
+	defer ts.Close()
+
+	client := &Client{
+		Key: testKeyEC,
+		dir: &Directory{RevokeURL: ts.URL + "/revoke", NonceURL: ts.URL + "/nonce"},
+	}
+	client.setAccountKID(ts.URL + "/acct/1")
+	ctx := context.Background()
+
+	if err := client.RevokeCertWithAccountKey(ctx, cert, CRLReasonKeyCompromise); err != nil {
+		t.Errorf("RevokeCertWithAccountKey: %v", err)
+	}
+	if err := client.RevokeCertWithCertKey(ctx, certKey, cert, CRLReasonKeyCompromise); err != nil {
+		t.Errorf("RevokeCertWithCertKey: %v", err)
+	}
+	if want := []string{"account", "cert"}; !reflect.DeepEqual(revoked, want) {
+		t.Errorf("accepted revocations: %q; want %q", revoked, want)
+	}
+
+	// A key not matching the certificate is detected before contacting the CA.
+	if err := client.RevokeCertWithCertKey(ctx, wrongKey, cert, CRLReasonKeyCompromise); err == nil {
+		t.Error("RevokeCertWithCertKey: err is nil with the wrong key")
+	}
+	// Otherwise, the CA rejects it.
+	err = client.RevokeCert(ctx, wrongKey, cert, CRLReasonKeyCompromise)
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusForbidden {
+		t.Errorf("RevokeCert with the wrong key: err = %v; want a 403 *Error", err)
+	}
+	if len(revoked) != 2 {
+		t.Errorf("%d accepted revocations; want 2", len(revoked))
+	}
+}
+
 func TestNonce_add(t *testing.T) {
 	var c Client
 	c.addNonce(http.Header{"Replay-Nonce": {"nonce"}})
@@ -1399,3 +2388,56 @@ func TestDNS01ChallengeRecord(t *testing.T) {
 		t.Errorf("val = %q; want %q", val, value)
 	}
 }
+
+func TestKeyAuthorizationDigest(t *testing.T) {
+	const token = "xxx"
+	ka := token + "." + testKeyECThumbprint
+	client := &Client{Key: testKeyEC}
+
+	// The http-01 response is the key authorization itself,
+	// whose thumbprint is a SHA-256 digest.
+	if v, err := client.HTTP01ChallengeResponse(token); err != nil || v != ka {
+		t.Errorf("HTTP01ChallengeResponse = %q, %v; want %q", v, err, ka)
+	}
+	sum256 := sha256.Sum256([]byte(ka))
+	rec, err := client.DNS01ChallengeRecord(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := base64.RawURLEncoding.EncodeToString(sum256[:]); rec != want {
+		t.Errorf("DNS01ChallengeRecord = %q; want the SHA-256 digest %q", rec, want)
+	}
+
+	for _, tt := range []struct {
+		h    crypto.Hash
+		want []byte
+	}{
+		{0, sum256[:]},
+		{crypto.SHA256, sum256[:]},
+		{crypto.SHA384, func() []byte { b := sha512.Sum384([]byte(ka)); return b[:] }()},
+	} {
+		got, err := client.KeyAuthorizationDigest(token, tt.h)
+		if err != nil {
+			t.Errorf("KeyAuthorizationDigest(%v): %v", tt.h, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("KeyAuthorizationDigest(%v) = %x; want %x", tt.h, got, tt.want)
+		}
+	}
+	if _, err := client.KeyAuthorizationDigest(token, crypto.MD4); err == nil {
+		t.Error("KeyAuthorizationDigest with an unavailable hash succeeded")
+	}
+
+	// A challenge type defined with another hash uses it.
+	defer func(h crypto.Hash) { challengeDigests["dns-01"] = h }(challengeDigests["dns-01"])
+	challengeDigests["dns-01"] = crypto.SHA384
+	rec, err = client.DNS01ChallengeRecord(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum384 := sha512.Sum384([]byte(ka))
+	if want := base64.RawURLEncoding.EncodeToString(sum384[:]); rec != want {
+		t.Errorf("DNS01ChallengeRecord with SHA-384 = %q; want %q", rec, want)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// renewNowWindow is the duration of a suggested renewal window below which
+// the CA is considered to request an immediate renewal, as it does for
+// certificates affected by a mass revocation event.
+const renewNowWindow = time.Hour
+
+// RenewalInfo is the ACME Renewal Information (ARI) about a certificate,
+// as returned by Client.FetchRenewalInfo.
+type RenewalInfo struct {
+	// SuggestedWindow is when the CA suggests renewing the certificate.
+	SuggestedWindow RenewalWindow
+
+	// ExplanationURL optionally locates a page explaining the window,
+	// for instance why the certificate is about to be revoked.
+	ExplanationURL string
+
+	// RenewNow reports whether the certificate should be renewed right away,
+	// rather than at a random time within SuggestedWindow: the window has
+	// already started, or is less than an hour long, which CAs use to
+	// signal an upcoming revocation of the certificate.
+	RenewNow bool
+
+	// RetryAfter is when the renewal information should be fetched again,
+	// as indicated by the CA. It is zero if the CA did not indicate it.
+	RetryAfter time.Time
+}
+
+// RenewalWindow is a time interval within which a certificate renewal is
+// suggested.
+type RenewalWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// ARICertID returns the unique identifier of the leaf certificate used by
+// the ACME Renewal Information (ARI) extension, draft-ietf-acme-ari:
+// the base64url encoded key identifier of the issuer's public key and serial
+// number of leaf, separated by a dot.
+//
+// The key identifier is taken from the SubjectKeyId of issuer, if not nil,
+// and from the AuthorityKeyId of leaf otherwise.
+func ARICertID(leaf, issuer *x509.Certificate) (string, error) {
+	if leaf == nil {
+		return "", errors.New("acme: nil certificate")
+	}
+	keyID := leaf.AuthorityKeyId
+	if issuer != nil {
+		if len(issuer.SubjectKeyId) > 0 && len(keyID) > 0 && !bytes.Equal(issuer.SubjectKeyId, keyID) {
+			return "", errors.New("acme: issuer key identifier does not match the certificate's authority key identifier")
+		}
+		if len(issuer.SubjectKeyId) > 0 {
+			keyID = issuer.SubjectKeyId
+		}
+	}
+	if len(keyID) == 0 {
+		return "", errors.New("acme: no authority key identifier in certificate")
+	}
+	if leaf.SerialNumber == nil || leaf.SerialNumber.Sign() < 0 {
+		return "", errors.New("acme: invalid certificate serial number")
+	}
+	// The serial is encoded as the content octets of its DER INTEGER,
+	// so a leading zero is kept when the high bit is set.
+	serial := leaf.SerialNumber.Bytes()
+	if len(serial) == 0 || serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+	return base64.RawURLEncoding.EncodeToString(keyID) + "." + base64.RawURLEncoding.EncodeToString(serial), nil
+}
+
+// FetchRenewalInfo retrieves the ACME Renewal Information of the certificate
+// identified by certID, itself obtained with ARICertID.
+//
+// It returns an error if the CA does not support ARI:
+// see Directory.RenewalInfoURL.
+func (c *Client) FetchRenewalInfo(ctx context.Context, certID string) (*RenewalInfo, error) {
+	dir, err := c.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if dir.RenewalInfoURL == "" {
+		return nil, errors.New("acme: CA does not support renewal information")
+	}
+	url := strings.TrimSuffix(dir.RenewalInfoURL, "/") + "/" + certID
+	res, err := c.get(ctx, url, wantStatus(http.StatusOK))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var v struct {
+		Window         RenewalWindow `json:"suggestedWindow"`
+		ExplanationURL string        `json:"explanationURL"`
+	}
+	if err := c.decodeResponse(res, &v); err != nil {
+		return nil, err
+	}
+	if v.Window.Start.IsZero() || v.Window.End.Before(v.Window.Start) {
+		return nil, fmt.Errorf("acme: invalid renewal window [%v, %v]", v.Window.Start, v.Window.End)
+	}
+	now := timeNow()
+	info := &RenewalInfo{
+		SuggestedWindow: v.Window,
+		ExplanationURL:  v.ExplanationURL,
+		RenewNow:        !v.Window.Start.After(now) || v.Window.End.Sub(v.Window.Start) < renewNowWindow,
+	}
+	if d := retryAfter(res.Header.Get("Retry-After")); d > 0 {
+		info.RetryAfter = now.Add(d)
+	}
+	return info, nil
+}
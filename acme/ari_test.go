@@ -0,0 +1,161 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestARICertID(t *testing.T) {
+	// The example of draft-ietf-acme-ari, section 4.1.
+	keyID := []byte{
+		0x69, 0x88, 0x5b, 0x6b, 0x87, 0x46, 0x40, 0x41, 0xe1, 0xb3,
+		0x7b, 0x84, 0x7b, 0xa0, 0xae, 0x2c, 0xde, 0x01, 0xc8, 0xd4,
+	}
+	const want = "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE"
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		SubjectKeyId:          keyID,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(0x87654321),
+		DNSNames:     []string{"example.org"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, iss := range []*x509.Certificate{issuer, nil} {
+		id, err := ARICertID(leaf, iss)
+		if err != nil {
+			t.Fatalf("ARICertID(issuer %v): %v", iss != nil, err)
+		}
+		if id != want {
+			t.Errorf("ARICertID(issuer %v) = %q; want %q", iss != nil, id, want)
+		}
+	}
+
+	// A serial without its high bit set has no leading zero.
+	leaf.SerialNumber = big.NewInt(0x7f01)
+	if id, _ := ARICertID(leaf, nil); id != "aYhba4dGQEHhs3uEe6CuLN4ByNQ.fwE" {
+		t.Errorf("ARICertID = %q; want aYhba4dGQEHhs3uEe6CuLN4ByNQ.fwE", id)
+	}
+
+	leaf.AuthorityKeyId = nil
+	if _, err := ARICertID(leaf, nil); err == nil {
+		t.Error("ARICertID succeeded without a key identifier")
+	}
+}
+
+func TestFetchRenewalInfo(t *testing.T) {
+	const certID = "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE"
+	now := time.Now()
+	tt := []struct {
+		name       string
+		start, end time.Time
+		renewNow   bool
+	}{
+		{"future", now.Add(24 * time.Hour), now.Add(48 * time.Hour), false},
+		{"open", now.Add(-time.Hour), now.Add(time.Hour), true},
+		{"past", now.Add(-48 * time.Hour), now.Add(-24 * time.Hour), true},
+		{"tight", now.Add(time.Hour), now.Add(time.Hour + time.Minute), true},
+	}
+	for _, test := range tt {
+		t.Run(test.name, func(t *testing.T) {
+			var ts *httptest.Server
+			ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/":
+					fmt.Fprintf(w, `{"newNonce": %q, "renewalInfo": %q}`, ts.URL+"/nonce", ts.URL+"/renewal-info/")
+				case "/renewal-info/" + certID:
+					if r.Method != "GET" {
+						t.Errorf("r.Method = %q; want GET", r.Method)
+					}
+					w.Header().Set("Retry-After", "21600")
+					fmt.Fprintf(w, `{
+						"suggestedWindow": {"start": %q, "end": %q},
+						"explanationURL": "https://example.com/incident"
+					}`, test.start.Format(time.RFC3339), test.end.Format(time.RFC3339))
+				default:
+					http.NotFound(w, r)
+					t.Errorf("unrecognized r.URL.Path: %s", r.URL.Path)
+				}
+			}))
+			defer ts.Close()
+
+			c := &Client{DirectoryURL: ts.URL}
+			info, err := c.FetchRenewalInfo(context.Background(), certID)
+			if err != nil {
+				t.Fatalf("FetchRenewalInfo: %v", err)
+			}
+			if info.RenewNow != test.renewNow {
+				t.Errorf("info.RenewNow = %v; want %v", info.RenewNow, test.renewNow)
+			}
+			if !info.SuggestedWindow.Start.Equal(test.start.Truncate(time.Second)) || !info.SuggestedWindow.End.Equal(test.end.Truncate(time.Second)) {
+				t.Errorf("info.SuggestedWindow = %v; want [%v, %v]", info.SuggestedWindow, test.start, test.end)
+			}
+			if want := "https://example.com/incident"; info.ExplanationURL != want {
+				t.Errorf("info.ExplanationURL = %q; want %q", info.ExplanationURL, want)
+			}
+			if d := time.Until(info.RetryAfter); d < 5*time.Hour || d > 6*time.Hour {
+				t.Errorf("info.RetryAfter = %v; want about 6 hours from now", info.RetryAfter)
+			}
+		})
+	}
+}
+
+func TestFetchRenewalInfoUnsupported(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"new-reg": "https://example.com/acme/new-reg"}`)
+	}))
+	defer ts.Close()
+	c := &Client{DirectoryURL: ts.URL}
+	_, err := c.FetchRenewalInfo(context.Background(), "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE")
+	if err == nil || !strings.Contains(err.Error(), "does not support renewal information") {
+		t.Errorf("FetchRenewalInfo: %v; want an unsupported error", err)
+	}
+}
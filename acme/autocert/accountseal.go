@@ -0,0 +1,103 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"strings"
+)
+
+// KeySealer encrypts and decrypts the account key entry of a Cache, so that
+// it can be protected by a key the Cache has no access to, such as one held
+// by a hardware module or a key management service.
+//
+// Seal and Open are called with the name of the cache entry, which the
+// implementations may authenticate along with the data, so that a sealed
+// entry cannot be moved to another name. Open must fail unless data has been
+// returned by Seal for the same name.
+type KeySealer interface {
+	Seal(ctx context.Context, name string, data []byte) ([]byte, error)
+	Open(ctx context.Context, name string, data []byte) ([]byte, error)
+}
+
+// AESKeySealer returns a KeySealer encrypting the entries with AES-GCM
+// under key, which must be 16, 24 or 32 bytes long.
+func AESKeySealer(key []byte) (KeySealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return aesKeySealer{aead}, nil
+}
+
+type aesKeySealer struct {
+	aead cipher.AEAD
+}
+
+// Seal returns a random nonce followed by the encryption of data.
+func (s aesKeySealer) Seal(ctx context.Context, name string, data []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(data)+s.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, data, []byte(name)), nil
+}
+
+func (s aesKeySealer) Open(ctx context.Context, name string, data []byte) ([]byte, error) {
+	n := s.aead.NonceSize()
+	if len(data) < n {
+		return nil, errors.New("acme/autocert: sealed account key too short")
+	}
+	return s.aead.Open(nil, data[:n], data[n:], []byte(name))
+}
+
+// putAccountKey stores the PEM encoded account key data under name in
+// m.Cache, sealed with m.AccountKeySealer if any.
+func (m *Manager) putAccountKey(ctx context.Context, name string, data []byte) error {
+	if m.AccountKeySealer != nil {
+		sealed, err := m.AccountKeySealer.Seal(ctx, name, data)
+		if err != nil {
+			return err
+		}
+		data = sealed
+	}
+	return m.Cache.Put(ctx, name, data)
+}
+
+// openAccountKey returns the PEM encoded account key of the entry data
+// stored under name in m.Cache. With m.AccountKeySealer, an entry stored
+// before the sealer was set is sealed in place.
+func (m *Manager) openAccountKey(ctx context.Context, name string, data []byte) ([]byte, error) {
+	if m.AccountKeySealer == nil {
+		return data, nil
+	}
+	if isPEMKey(data) {
+		if err := m.putAccountKey(ctx, name, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	key, err := m.AccountKeySealer.Open(ctx, name, data)
+	if err != nil {
+		return nil, errors.New("acme/autocert: cannot open the account key found in cache: " + err.Error())
+	}
+	return key, nil
+}
+
+// isPEMKey reports whether data is a PEM encoded private key.
+func isPEMKey(data []byte) bool {
+	b, _ := pem.Decode(data)
+	return b != nil && strings.Contains(b.Type, "PRIVATE")
+}
@@ -0,0 +1,59 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"context"
+	"crypto/x509"
+	"time"
+
+	"github.com/robarchibald/crypto/acme"
+)
+
+// windowDelay returns how long the renewal of the current cert of dr is
+// deferred to the start of the renewal window suggested by the CA, see
+// Manager.DeferToRenewalWindow, or zero if it is not.
+func (dr *domainRenewal) windowDelay(ctx context.Context) time.Duration {
+	m := dr.m
+	m.stateMu.Lock()
+	s := m.state[dr.ck]
+	m.stateMu.Unlock()
+	if s == nil {
+		return 0
+	}
+	s.RLock()
+	leaf, chain := s.leaf, s.cert
+	s.RUnlock()
+	if leaf == nil {
+		return 0
+	}
+	var issuer *x509.Certificate
+	if len(chain) > 1 {
+		issuer, _ = x509.ParseCertificate(chain[1])
+	}
+	certID, err := acme.ARICertID(leaf, issuer)
+	if err != nil {
+		return 0
+	}
+	client, err := m.acmeClient(ctx)
+	if err != nil {
+		return 0
+	}
+	info, err := client.FetchRenewalInfo(ctx, certID)
+	if err != nil {
+		// Including when the CA does not support ARI.
+		return 0
+	}
+	now := m.now()
+	start := info.SuggestedWindow.Start
+	if info.RenewNow || !start.After(now) {
+		return 0
+	}
+	if start.After(leaf.NotAfter.Add(-m.renewalMargin())) {
+		// Waiting would risk the cert expiring before it is renewed.
+		return 0
+	}
+	return start.Sub(now)
+}
@@ -0,0 +1,177 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IssuanceRecord describes an attempt of a Manager to obtain a certificate
+// from the CA, whether it succeeded or not.
+type IssuanceRecord struct {
+	// Time is when the attempt completed, according to Manager.Now.
+	Time time.Time `json:"time"`
+	// Domain is the domain the certificate was requested for.
+	Domain string `json:"domain"`
+	// Renewal reports whether the attempt renewed an existing certificate.
+	Renewal bool `json:"renewal"`
+	// CA is the directory endpoint of the CA.
+	CA string `json:"ca"`
+	// CertURL is the URL of the issued certificate resource at the CA.
+	// It is empty if the CA did not issue a certificate.
+	CertURL string `json:"cert_url,omitempty"`
+	// Serial is the hex encoded serial number of the issued certificate
+	// and DNSNames are its subject alternative names.
+	// They are empty if the CA did not issue a certificate.
+	Serial   string   `json:"serial,omitempty"`
+	DNSNames []string `json:"dns_names,omitempty"`
+	// Fingerprint is the hex encoded SHA-256 hash of the DER encoded
+	// certificate. It is empty if the CA did not issue a certificate.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Error describes why the attempt failed. It is empty on success.
+	// An issued certificate may still be rejected by Manager.ValidateCert
+	// or fail to be cached, in which case both Serial and Error are set.
+	Error string `json:"error,omitempty"`
+}
+
+// AuditLogger records the certificate issuance attempts of a Manager.
+//
+// Implementations must be safe for concurrent use by multiple goroutines.
+// The Manager waits for LogIssuance to return before proceeding, so it
+// should not block for long.
+type AuditLogger interface {
+	LogIssuance(ctx context.Context, r *IssuanceRecord)
+}
+
+// JSONAuditLogger is an AuditLogger appending each record to a writer
+// as a line of JSON.
+type JSONAuditLogger struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// NewJSONAuditLogger returns a JSONAuditLogger writing to w.
+func NewJSONAuditLogger(w io.Writer) *JSONAuditLogger {
+	return &JSONAuditLogger{w: w}
+}
+
+// LogIssuance writes r to the underlying writer, followed by a newline.
+func (l *JSONAuditLogger) LogIssuance(ctx context.Context, r *IssuanceRecord) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		// IssuanceRecord contains only marshalable fields.
+		panic(fmt.Sprintf("acme/autocert: %v", err))
+	}
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(b); err != nil && l.err == nil {
+		l.err = err
+	}
+}
+
+// Err returns the first error encountered writing to the underlying writer.
+func (l *JSONAuditLogger) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// auditIssuance reports an issuance attempt to m.AuditLogger, if any.
+// The leaf argument is the issued cert, which may be nil.
+func (m *Manager) auditIssuance(ctx context.Context, ck certKey, renewal bool, certURL string, leaf *x509.Certificate, err error) {
+	if m.AuditLogger == nil {
+		return
+	}
+	r := &IssuanceRecord{
+		Time:    m.now(),
+		Domain:  ck.domain,
+		Renewal: renewal,
+		CA:      m.directoryURL(),
+		CertURL: certURL,
+	}
+	if leaf != nil {
+		r.Serial = fmt.Sprintf("%x", leaf.SerialNumber)
+		r.DNSNames = leaf.DNSNames
+		fp := sha256.Sum256(leaf.Raw)
+		r.Fingerprint = hex.EncodeToString(fp[:])
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	m.AuditLogger.LogIssuance(ctx, r)
+}
+
+// notifyIssued calls m.OnIssued, if any, with der, the chain of a cert
+// newly issued for ck, and logs the error it returns.
+func (m *Manager) notifyIssued(ctx context.Context, ck certKey, der [][]byte) {
+	if m.OnIssued == nil {
+		return
+	}
+	if err := m.OnIssued(ctx, ck.domain, der); err != nil {
+		log.Printf("acme/autocert: OnIssued for %q: %v", ck.domain, err)
+	}
+}
+
+// CertInfo describes a certificate held by a Manager,
+// for instance to keep an external inventory up to date.
+type CertInfo struct {
+	SerialNumber *big.Int
+	// Fingerprint is the SHA-256 hash of the DER encoded certificate.
+	Fingerprint [sha256.Size]byte
+	DNSNames    []string
+	// Issuer is the CommonName of the certificate issuer.
+	Issuer    string
+	NotBefore time.Time
+	NotAfter  time.Time
+	// RSA reports whether the certificate has an RSA key,
+	// as served to clients not supporting ECDSA.
+	RSA bool
+}
+
+// CertInfo returns information about the certificate m currently serves
+// for domain. If m holds both an ECDSA and an RSA certificate for domain,
+// the ECDSA one is described.
+//
+// Only certificates in memory are considered: CertInfo does not read
+// m.Cache, nor waits for a certificate being obtained.
+func (m *Manager) CertInfo(domain string) (*CertInfo, error) {
+	domain = m.primaryDomain(strings.TrimSuffix(domain, "."))
+	for _, ck := range []certKey{{domain: domain}, {domain: domain, isRSA: true}} {
+		m.stateMu.Lock()
+		s := m.state[ck]
+		m.stateMu.Unlock()
+		if s == nil || !s.TryRLock() {
+			continue
+		}
+		leaf := s.leaf
+		s.RUnlock()
+		if leaf == nil {
+			continue
+		}
+		return &CertInfo{
+			SerialNumber: leaf.SerialNumber,
+			Fingerprint:  sha256.Sum256(leaf.Raw),
+			DNSNames:     leaf.DNSNames,
+			Issuer:       leaf.Issuer.CommonName,
+			NotBefore:    leaf.NotBefore,
+			NotAfter:     leaf.NotAfter,
+			RSA:          ck.isRSA,
+		}, nil
+	}
+	return nil, fmt.Errorf("acme/autocert: no certificate for %q", domain)
+}
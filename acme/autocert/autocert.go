@@ -13,22 +13,26 @@ import (
 	"context"
 	"crypto"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	mathrand "math/rand"
 	"net"
 	"net/http"
 	"path"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/robarchibald/crypto/acme"
@@ -40,6 +44,11 @@ import (
 // TODO: Consider making it configurable or an exp backoff?
 var createCertRetryAfter = time.Minute
 
+// syncRenewTimeout bounds the synchronous renewals of certificates
+// below Manager.MinServingValidity.
+// It is a variable for testing.
+var syncRenewTimeout = time.Minute
+
 // pseudoRand is safe for concurrent use.
 var pseudoRand *lockedMathRand
 
@@ -85,7 +94,7 @@ func defaultHostPolicy(context.Context, string) error {
 
 // Manager is a stateful certificate manager built on top of acme.Client.
 // It obtains and refreshes certificates automatically using "tls-alpn-01",
-// "tls-sni-01", "tls-sni-02" and "http-01" challenge types,
+// "tls-sni-01", "tls-sni-02", "http-01" and "dns-01" challenge types,
 // as well as providing them to a TLS server via tls.Config.
 //
 // You must specify a cache implementation, such as DirCache,
@@ -103,11 +112,58 @@ type Manager struct {
 
 	// Cache optionally stores and retrieves previously-obtained certificates
 	// and other state. If nil, certs will only be cached for the lifetime of
-	// the Manager. Multiple Managers can share the same Cache.
+	// the Manager. Multiple Managers can share the same Cache. Independent
+	// ones, such as those of distinct deployments, can share a store
+	// through a NamespacedCache each.
 	//
 	// Using a persistent Cache, such as DirCache, is strongly recommended.
 	Cache Cache
 
+	// ChallengeCache optionally stores the short-lived data of domain
+	// ownership verification, such as http-01 token values and tls-alpn-01
+	// token certificates, which need to be visible at once to every server
+	// answering the CA's validation requests. Certificates and account keys
+	// remain in Cache.
+	//
+	// If nil, Cache is used for challenge data too.
+	ChallengeCache Cache
+
+	// HTTP01Cache and TLSALPN01Cache optionally store the challenge data of
+	// the "http-01" and "tls-alpn-01" challenges respectively, in place of
+	// ChallengeCache. In a cluster, the http-01 token values must reach
+	// every server answering on port 80 and the tls-alpn-01 token
+	// certificates every server answering on port 443, which distinct
+	// mechanisms may serve best.
+	//
+	// If nil, ChallengeCache, or else Cache, is used.
+	HTTP01Cache    Cache
+	TLSALPN01Cache Cache
+
+	// ChallengeTTL optionally bounds the lifetime of the challenge data
+	// stored in the challenge caches, or Cache. The data is deleted as soon as
+	// its authorization completes or fails; data left behind, for instance
+	// by a process which crashed during an authorization, is deleted after
+	// ChallengeTTL by a periodic sweep. An entry recording the expiration
+	// time is stored next to the data, so that the data of other Managers
+	// sharing the cache is swept too if the cache implements CacheLister.
+	//
+	// If zero, challenge data is deleted after one hour.
+	ChallengeTTL time.Duration
+
+	// HTTP01ResponseFunc optionally provides the responses to the "http-01"
+	// challenges served by HTTPHandler, for instance from a store shared by
+	// the nodes behind a CDN. It is called with the token of the challenge
+	// and returns its key authorization, see acme.Client.KeyAuthorization,
+	// and true, or false if it has no response for the token, in which case
+	// the response provisioned by the Manager, if any, is served.
+	HTTP01ResponseFunc func(token string) (keyAuth string, ok bool)
+
+	// HTTP01ResponseHeader optionally specifies headers added to the
+	// responses to "http-01" challenges served by HTTPHandler, such as
+	// a Cache-Control header for a CDN. They are not added to the
+	// Not Found responses for unknown tokens.
+	HTTP01ResponseHeader http.Header
+
 	// HostPolicy controls which domains the Manager will attempt
 	// to retrieve new certificates for. It does not affect cached certs.
 	//
@@ -122,35 +178,291 @@ type Manager struct {
 	// See GetCertificate for more details.
 	HostPolicy HostPolicy
 
+	// AdmissionFunc optionally approves the issuance of a certificate for a
+	// domain m holds no certificate for, neither in memory nor in Cache, for
+	// instance by asking an external approval service, to prevent accidental
+	// issuances for mistyped or sensitive names. It is called after
+	// HostPolicy, right before the CA is asked for the first certificate of
+	// domain, and by SubmitCSR. A non-nil error blocks the issuance and is
+	// returned as is, as with HostPolicy.
+	//
+	// The renewals of the certificates m holds are not subject to
+	// AdmissionFunc unless AdmitRenewals is set.
+	AdmissionFunc func(ctx context.Context, domain string) error
+
+	// AdmitRenewals makes the renewals of certificates subject to
+	// AdmissionFunc too. A renewal denied admission fails, and is retried
+	// as other failed renewals.
+	AdmitRenewals bool
+
+	// DefaultServerName optionally specifies the host name GetCertificate
+	// uses for the connections of clients which do not send the TLS Server
+	// Name Indication extension, such as some legacy clients and tools.
+	// It is subject to HostPolicy like any other name.
+	//
+	// If empty, GetCertificate fails for such connections.
+	DefaultServerName string
+
 	// RenewBefore optionally specifies how early certificates should
 	// be renewed before they expire.
 	//
 	// If zero, they're renewed 30 days before expiration.
+	//
+	// A failed renewal is retried within minutes if the error is transient,
+	// such as a network error or an outage of the CA, and after delays
+	// growing from an hour to a day if the CA refused the request. It is not
+	// retried until ForceRenew is called if the CA will not issue
+	// certificates for the domain, or once the Manager gives up on it.
 	RenewBefore time.Duration
 
+	// RenewStagger optionally spreads the renewals of the certificates over
+	// this period before RenewBefore, so that the certificates obtained
+	// together, such as those of a fleet of Managers started at once, do not
+	// all expire and renew together. Each certificate is renewed earlier by
+	// an offset within RenewStagger derived from its domain and key type,
+	// which is the same across restarts, in addition to the random jitter
+	// of up to an hour.
+	//
+	// If zero, only the random jitter applies.
+	RenewStagger time.Duration
+
+	// RenewSchedule optionally aligns renewals with maintenance windows,
+	// for instance the first Sunday of each month at 02:00. It returns the
+	// time of the next slot after now, or the zero time if there is none.
+	//
+	// Certificates are then renewed at every slot, without jitter and
+	// regardless of RenewBefore, as long as they still expire after the
+	// next slot. Otherwise, and for the retries of failed renewals, they are
+	// renewed according to RenewBefore.
+	RenewSchedule func(now time.Time) time.Time
+
+	// DeferToRenewalWindow optionally makes renewals wait for the renewal
+	// window the CA suggests with the ACME Renewal Information (ARI)
+	// extension, which CAs use to spread their load: a renewal due before
+	// the window of its certificate starts places its order at the start of
+	// the window instead. The renewal is not deferred if the CA asks for an
+	// immediate renewal, if the window starts when less than half of
+	// RenewBefore, or MinServingValidity, is left before the certificate
+	// expires, or if the renewal information cannot be fetched, for instance
+	// because the CA does not support ARI.
+	//
+	// ForceRenew is never deferred.
+	DeferToRenewalWindow bool
+
+	// IssuanceWindow optionally restricts when renewals place orders, to
+	// keep them out of peak traffic or change freezes. It returns the time
+	// the next window in which orders may be placed opens, or a time not
+	// after now if one is open, such as now itself.
+	//
+	// A renewal due outside of the windows is deferred to the opening of the
+	// next one, unless less than half of RenewBefore, or MinServingValidity,
+	// would then be left before the current certificate expires: the
+	// certificate is renewed right away instead. Certificates obtained for
+	// new domains, and ForceRenew, are never deferred.
+	IssuanceWindow func(now time.Time) time.Time
+
+	// WarmSpare optionally makes renewals obtain the replacement of a
+	// certificate ahead of its use, for clients sensitive to certificate
+	// changes such as those pinning keys: when due, the renewal obtains the
+	// new certificate and keeps it as a warm spare, stored in Cache under
+	// the key of the certificate suffixed with "+spare", while the current
+	// one keeps being served. The spare is activated, and served, once
+	// half of RenewBefore, or MinServingValidity if longer, is left to the
+	// current certificate, and not before its own NotBefore time.
+	//
+	// A spare pending in Cache, for instance obtained before a restart or
+	// by another Manager sharing the Cache, is activated in the same way.
+	// ForceRenew replaces the current certificate right away.
+	WarmSpare bool
+
+	// ReconcileInterval optionally specifies how often the Manager re-reads
+	// the Cache for the certificates it holds, and adopts those which have
+	// been renewed by another Manager sharing the Cache, for instance another
+	// node of a cluster, instead of renewing them again on its own schedule.
+	//
+	// If zero, the Cache is only read again when a renewal is due.
+	ReconcileInterval time.Duration
+
+	// RenewalErrorLogInterval optionally specifies how often the failures
+	// of the renewal of a certificate are logged while they keep failing
+	// with the same error, as during a long outage of the CA. The first
+	// failure and those with a different error than the previous one are
+	// logged right away; the repeated ones are only counted until the
+	// interval has elapsed, and the count logged along with the next one.
+	//
+	// If zero, the repeated failures are logged at most once an hour.
+	RenewalErrorLogInterval time.Duration
+
+	// DomainDNSCheck optionally makes the Manager check periodically that
+	// the names of the certificates it renews still resolve to the server,
+	// and log those which do not and report them to OnDomainMisconfigured,
+	// for instance after a domain was moved to another server but left in
+	// HostPolicy, whose renewals then keep failing. The check is best-effort:
+	// the lookup errors other than a missing name are ignored, and it never
+	// delays serving or renewing the certificates.
+	//
+	// The names are first checked when the Manager starts renewing their
+	// certificate.
+	DomainDNSCheck *DomainDNSCheck
+
+	// OnDomainMisconfigured is optionally called when DomainDNSCheck finds
+	// that name resolves to addrs, not all of which are addresses of the
+	// server, or to none if name does not exist. It is not called again for
+	// name until it has been found to resolve to the server again.
+	OnDomainMisconfigured func(name string, addrs []net.IP)
+
+	// CompromisedKeyCheck optionally reports whether a public key, given as
+	// a DER encoded SubjectPublicKeyInfo, is known to be compromised, for
+	// instance by looking it up in a local filter of the keys of published
+	// breaches. It is called for the key of each certificate the Manager
+	// renews when it starts renewing it and then every
+	// CompromisedKeyCheckInterval. A certificate whose key is reported is
+	// replaced right away by a certificate with a new key and, once the
+	// replacement is stored, revoked for key compromise, with a request
+	// signed by the key. If the replacement fails, the certificate is kept
+	// until a later check replaces it.
+	//
+	// With SharedCertKey, the shared key is replaced the first time it is
+	// reported, and each certificate the next time its key is checked.
+	CompromisedKeyCheck func(spki []byte) bool
+
+	// CompromisedKeyCheckInterval is the delay between the checks of the key
+	// of a certificate by CompromisedKeyCheck.
+	//
+	// If zero, the keys are checked every hour.
+	CompromisedKeyCheckInterval time.Duration
+
+	// ExpiryWarningThreshold optionally makes the Manager warn when the
+	// certificate it serves for a domain has less than ExpiryWarningThreshold
+	// of validity left, whether or not its renewal is failing, as a last
+	// safety net against renewals failing unnoticed. The certificates are
+	// checked when the Manager starts renewing them and then every hour.
+	// The warning is logged and reported to OnExpiryWarning once for each
+	// certificate.
+	//
+	// If zero, there are no warnings.
+	ExpiryWarningThreshold time.Duration
+
+	// OnExpiryWarning is optionally called when the certificate of domain,
+	// expiring at notAfter, crosses ExpiryWarningThreshold.
+	OnExpiryWarning func(domain string, notAfter time.Time)
+
+	// StartupJitter optionally specifies the maximum random delay added to
+	// the first renewal attempt of each certificate, the one scheduled when
+	// the Manager starts renewing it, typically after loading it from Cache
+	// once the process has started. It spreads the renewals of the
+	// certificates already due across the nodes of a cluster restarted at
+	// once. Cached certificates are still served right away.
+	//
+	// If zero, the first renewal attempts are not delayed.
+	StartupJitter time.Duration
+
+	// Now optionally returns the current time. It is consulted whenever
+	// the Manager checks certificate expiration or schedules renewals,
+	// which makes it possible to simulate the passage of time, for
+	// instance in tests of code depending on renewals.
+	//
+	// If nil, time.Now is used. Renewal timers still fire in real time:
+	// advancing the clock only affects the delays scheduled afterwards.
+	Now func() time.Time
+
 	// Client is used to perform low-level operations, such as account registration
 	// and requesting new certificates.
 	//
-	// If Client is nil, a zero-value acme.Client is used with acme.LetsEncryptURL
-	// as directory endpoint. If the Client.Key is nil, a new ECDSA P-256 key is
-	// generated and, if Cache is not nil, stored in cache.
+	// If Client is nil, a zero-value acme.Client is used with DirectoryURL,
+	// or acme.LetsEncryptURL, as directory endpoint. If the Client.Key is
+	// nil, a new ECDSA P-256 key is generated and, if Cache is not nil,
+	// stored in cache.
 	//
 	// Mutating the field after the first call of GetCertificate method will have no effect.
 	Client *acme.Client
 
+	// DirectoryURL optionally specifies the directory endpoint of the CA,
+	// such as that of a private step-ca deployment, when Client is nil or
+	// has no DirectoryURL. If empty, acme.LetsEncryptURL is used.
+	DirectoryURL string
+
+	// RootCAs optionally specifies the root certificates trusted for the
+	// TLS connections to the CA, such as the private root of a step-ca
+	// deployment, instead of those of the host. It requires the Client,
+	// if any, to have no HTTPClient: the Manager sets one trusting RootCAs.
+	RootCAs *x509.CertPool
+
+	// AccountKey optionally returns the account key to use with the CA
+	// whose directory endpoint is directoryURL, for instance to use distinct
+	// keys with different CAs. It is only called if the Client's Key is nil.
+	//
+	// If AccountKey is nil or returns nil, a key is generated and,
+	// if Cache is not nil, stored in cache separately for each directory.
+	AccountKey func(directoryURL string) crypto.Signer
+
+	// AccountKeyType optionally specifies the type of the account keys
+	// generated by the Manager. It is independent of CertKeyType.
+	// An account key already stored in Cache is used whatever its type.
+	//
+	// If empty, ECDSA P-256 keys are generated.
+	AccountKeyType KeyType
+
+	// AccountKeySealer optionally encrypts the account keys stored in Cache,
+	// for instance with a key derived by a hardware module, while the
+	// certificates and the other entries of Cache are stored as is.
+	// AESKeySealer returns one using a local key.
+	//
+	// An account key stored unencrypted before the AccountKeySealer was set
+	// is encrypted on first use. If nil, account keys are stored unencrypted.
+	AccountKeySealer KeySealer
+
 	// Email optionally specifies a contact email address.
 	// This is used by CAs, such as Let's Encrypt, to notify about problems
 	// with issued certificates.
 	//
-	// If the Client's account key is already registered, Email is not used.
+	// If the Client's account key is already registered, Email is not used,
+	// unless it is changed afterwards with SetEmail.
 	Email string
 
+	// Contact optionally lists additional contact URIs of the account,
+	// such as "mailto:" or "tel:" ones, registered along with Email.
+	//
+	// If the Client's account key is already registered, Contact is not used.
+	Contact []string
+
+	// UserAgent optionally identifies the application to the CA. It is
+	// appended to the User-Agent header of the requests of the ACME client,
+	// after its Client.UserAgent, if any, and "autocert". CAs use it for
+	// abuse tracking and to help operators, so it should contain the name,
+	// and ideally the version, of the application.
+	//
+	// Mutating the field after the first call of GetCertificate method will have no effect.
+	UserAgent string
+
 	// ForceRSA used to make the Manager generate RSA certificates. It is now ignored.
 	//
 	// Deprecated: the Manager will request the correct type of certificate based
 	// on what each client supports.
 	ForceRSA bool
 
+	// CertKeyType optionally specifies the type of the keys of the
+	// certificates requested by the Manager, whatever the key types
+	// supported by the TLS clients, for instance to only use RSA keys
+	// for compatibility with legacy clients.
+	//
+	// If empty, the Manager requests ECDSA P-256 certificates for the
+	// clients supporting them and RSA 2048 ones for the others.
+	CertKeyType KeyType
+
+	// SharedCertKey optionally makes the certificates of all the domains
+	// use the same private key, one of each key type, stored once in Cache,
+	// for instance to limit the storage and simplify the backups of
+	// constrained deployments. RotateSharedCertKey replaces the key of all
+	// the domains together.
+	//
+	// A shared key weakens the isolation between the domains: a compromise
+	// of the key, or a certificate of one domain revoked for key compromise,
+	// affects all the domains. The key also appears in every certificate,
+	// linking the domains served together. Keys are otherwise generated
+	// for each domain.
+	SharedCertKey bool
+
 	// ExtraExtensions are used when generating a new CSR (Certificate Request),
 	// thus allowing customization of the resulting certificate.
 	// For instance, TLS Feature Extension (RFC 7633) can be used
@@ -160,16 +472,377 @@ type Manager struct {
 	// in the template's ExtraExtensions field as is.
 	ExtraExtensions []pkix.Extension
 
-	clientMu sync.Mutex
-	client   *acme.Client // initialized by acmeClient method
+	// Subject sets the fields of the subject of the generated CSRs other than
+	// the common name, which is always the domain, for instance the
+	// organization for the private CAs honoring them. Public CAs such as
+	// Let's Encrypt ignore them.
+	//
+	// Only Country, Organization, OrganizationalUnit, Locality, Province,
+	// StreetAddress and PostalCode may be set: requesting a certificate
+	// fails otherwise.
+	Subject pkix.Name
+
+	// CertValidity optionally requests certificates valid for this long,
+	// from the time they are requested, for instance short-lived ones. CAs
+	// may ignore the request and issue certificates of their usual validity.
+	// RenewBefore must then be set to a fraction of CertValidity, otherwise
+	// certificates are renewed as soon as they are issued.
+	//
+	// If zero, the CA chooses the validity of certificates.
+	CertValidity time.Duration
+
+	// FinalizePollInterval optionally specifies the interval between the
+	// polls of the CA while it issues a requested certificate, unless the CA
+	// requests another one with a Retry-After header.
+	//
+	// If zero, the RetryBackoff of the Client is used.
+	FinalizePollInterval time.Duration
+
+	// FinalizeMaxWait optionally bounds the time to wait for the CA to issue
+	// a certificate once requested, after the domain authorizations. The
+	// issuance then fails and is retried like other failures, within the
+	// deadline of the whole issuance or renewal, which still applies.
+	//
+	// If zero, only the deadline of the whole issuance or renewal applies.
+	FinalizeMaxWait time.Duration
+
+	// MemCacheSize optionally specifies the maximum number of decoded
+	// certificates kept in memory in front of Cache, sparing the Cache
+	// round-trips and the decoding of its data. This is useful when the Cache
+	// is a remote storage.
+	//
+	// If zero or negative, or Cache is nil, no in-memory layer is used.
+	// The entries are replaced when certificates are renewed.
+	MemCacheSize int
+
+	// CertVersions optionally specifies how many previous versions of each
+	// certificate are kept in Cache when it is replaced, under the key of the
+	// certificate suffixed with "+v1" for the latest, "+v2" and so on.
+	// Rollback reverts a certificate to its latest previous version.
+	//
+	// If zero or negative, previous versions are discarded.
+	CertVersions int
+
+	// ChainBuilder optionally assembles the chain served and cached for a
+	// newly issued certificate, for instance to append a cross-signed
+	// intermediate required by older clients. It is called with the leaf
+	// certificate and the DER encoded chain returned by the CA, which starts
+	// with the leaf, and returns the chain to use instead.
+	//
+	// The returned chain must start with the same leaf and each of its
+	// certificates must be signed by the next one. Otherwise, or if
+	// ChainBuilder returns an error, the certificate is discarded as if it
+	// had been rejected by ValidateCert, which is called with the assembled
+	// chain, as is the check against PinnedIssuers.
+	ChainBuilder func(leaf *x509.Certificate, defaultChain [][]byte) ([][]byte, error)
+
+	// ValidateCert optionally checks a newly issued certificate before it is
+	// cached and served, for instance to confirm it was logged to Certificate
+	// Transparency or chains to a trusted root. The name argument is the domain
+	// the certificate was requested for.
+	//
+	// A non-nil error discards the certificate: a first-time issuance fails as
+	// if the CA had refused it and a renewal is retried later.
+	ValidateCert func(name string, cert *tls.Certificate) error
+
+	// MinServingValidity optionally specifies the minimum remaining validity
+	// of the certificates served by GetCertificate. If the certificate of a
+	// domain expires sooner, for instance because its scheduled renewals keep
+	// failing, GetCertificate first attempts to renew it synchronously, for up
+	// to a minute, and serves the old certificate if that fails.
+	// A failed attempt is not repeated for a minute.
+	//
+	// If zero, certificates are served until they expire.
+	MinServingValidity time.Duration
+
+	// ServeExpiredGracePeriod optionally lets GetCertificate serve an expired
+	// certificate for up to this long past its NotAfter time if it cannot be
+	// renewed, for instance during an extended CA outage, instead of failing
+	// the handshake. Meanwhile renewals are attempted in the background and
+	// synchronously, at most once a minute, and each failed attempt is logged.
+	//
+	// Most clients reject expired certificates, so this is only useful for
+	// services whose clients are configured to tolerate them.
+	// If zero, expired certificates are never served.
+	ServeExpiredGracePeriod time.Duration
+
+	// PlaceholderCert makes GetCertificate answer the handshakes for a
+	// domain allowed by HostPolicy, and for which no certificate is held
+	// yet, with a short-lived self-signed certificate while its first
+	// certificate is obtained in the background, rather than blocking them
+	// until it is issued, which can take seconds. The certificate issued
+	// is served as soon as it is ready.
+	//
+	// Clients verifying certificates reject the placeholder, so this trades
+	// trust warnings during the first issuance for availability, for
+	// instance to the health checks of a load balancer.
+	PlaceholderCert bool
+
+	// ReadOnly makes the Manager only serve the certificates found in Cache,
+	// leaving their issuance and renewal to another Manager sharing the Cache,
+	// for instance the leader of a cluster. A read-only Manager never contacts
+	// the CA nor arms renewal timers, and GetCertificate fails for a domain
+	// with no valid certificate in Cache. Once a certificate is due for
+	// renewal, the Cache is read again, at most once a minute, for the one
+	// renewed by the other Manager.
+	ReadOnly bool
+
+	// PinnedIssuers optionally restricts the issuers of newly issued
+	// certificates, to guard against a mis-issuing or compromised
+	// intermediate CA. Each element is the SHA-256 hash of the DER encoded
+	// SubjectPublicKeyInfo of an acceptable issuer.
+	//
+	// If non-empty, a certificate is only accepted if its chain, as returned
+	// by the CA, includes a certificate whose public key matches one of the
+	// pins. Otherwise the certificate is discarded as if it had been rejected
+	// by ValidateCert, which is only called for certificates passing this check.
+	// Previously cached certificates are not checked.
+	PinnedIssuers [][]byte
+
+	// AuditLogger optionally records every attempt to obtain a certificate
+	// from the CA, including renewals, whether it succeeds or fails.
+	// See NewJSONAuditLogger for an implementation.
+	AuditLogger AuditLogger
+
+	// OnIssued is optionally called with the chain of each certificate
+	// obtained from the CA for domain, the leaf first, including renewals,
+	// once it passed the checks of the Manager, such as PinnedIssuers and
+	// ValidateCert, and before it is cached and served, for instance to
+	// submit it to a certificate transparency log or to an inventory. An
+	// error it returns is logged, and does not prevent the certificate from
+	// being cached and served.
+	//
+	// OnIssued is called synchronously, and delays the issuance until it
+	// returns: lengthy work should be done in the background.
+	OnIssued func(ctx context.Context, domain string, chain [][]byte) error
+
+	// Tracer optionally traces the issuances and renewals of certificates,
+	// and the cache operations, with spans. A Tracer carried by the context
+	// of an operation, as set with WithTracer, takes precedence.
+	//
+	// If nil, and the context carries no Tracer, nothing is traced.
+	Tracer Tracer
+
+	// AliasDomains optionally returns additional names, such as a "www."
+	// alias, to include in the certificates requested for domain.
+	// The certificate has domain as its CommonName and first subject
+	// alternative name, followed by the aliases, and GetCertificate serves it
+	// for all of them. Each alias must be allowed by HostPolicy and is
+	// authorized with the CA the same way as domain.
+	//
+	// The aliases are only known to the Manager once it holds the certificate
+	// of their domain. An alias requested before, for instance right after
+	// a restart, gets a certificate of its own, so AliasDomains should return
+	// nil for names which are themselves aliases.
+	AliasDomains func(domain string) []string
+
+	// DropFailedAliases optionally makes the Manager obtain a certificate
+	// without the aliases returned by AliasDomains which the CA fails to
+	// authorize, or rejects in the subproblems of its error to issue the
+	// certificate, rather than no certificate at all. The names dropped are
+	// logged and reported to OnAliasesDropped, and tried again at the next
+	// renewal. The domain itself is never dropped.
+	//
+	// It is off by default since GetCertificate then fails the TLS
+	// handshakes for the names dropped, which callers may not expect.
+	DropFailedAliases bool
+
+	// OnAliasesDropped is optionally called when the Manager obtains
+	// a certificate for domain without the aliases names, as permitted by
+	// DropFailedAliases, err being the error which made it drop the last
+	// of them.
+	OnAliasesDropped func(domain string, names []string, err error)
+
+	// DNSProvider optionally makes the Manager answer "dns-01" challenges
+	// by creating TXT records with it. The dns-01 challenge type is tried
+	// after the others, and is the only one not requiring the CA to reach
+	// the server, which may be useful behind a load balancer or a firewall.
+	DNSProvider DNSProvider
+
+	// DNSPropagationCheck optionally makes the Manager wait for the TXT
+	// records created by DNSProvider to be visible before asking the CA to
+	// validate a dns-01 challenge. The challenge fails if a record is not
+	// visible in time.
+	//
+	// If nil, the CA is asked to validate as soon as DNSProvider.Present
+	// returns.
+	DNSPropagationCheck *DNSPropagationCheck
+
+	// SelfCheck optionally makes the Manager check that the responses to the
+	// "http-01" and "tls-alpn-01" challenges it provisions can be retrieved
+	// through the public name of the domain, before asking the CA to validate
+	// them, to surface errors such as split-horizon DNS or firewall rules.
+	// The Manager fetches the "http-01" response from port 80, or performs an
+	// "acme-tls/1" handshake on port 443, as the CA would. A failed check is
+	// logged, but the CA is asked to validate the challenge anyway, as it may
+	// reach the domain through another path.
+	SelfCheck bool
+
+	// OCSPStapling optionally makes GetCertificate staple OCSP responses to
+	// the certificates it serves, as required for certificates with the OCSP
+	// must-staple extension (RFC 7633), which can be requested with
+	// ExtraExtensions.
+	//
+	// The responses are fetched from the OCSP responders listed in the
+	// certificates, tried in order. A responder failing to answer is skipped
+	// for a minute. If no response can be obtained, the certificate is served
+	// without one. Responses are refreshed in the background halfway through
+	// their validity period.
+	OCSPStapling bool
+
+	// MinTLSVersion optionally sets the minimum TLS version of the config
+	// returned by TLSConfig, such as tls.VersionTLS13.
+	//
+	// If zero, TLS 1.2 is the minimum.
+	MinTLSVersion uint16
+
+	// CipherSuites optionally lists the TLS 1.0-1.2 cipher suites enabled
+	// in the config returned by TLSConfig, as in tls.Config.CipherSuites.
+	// The TLS 1.3 cipher suites are not configurable.
+	//
+	// If nil, Go's secure defaults are used.
+	CipherSuites []uint16
+
+	// MaxAttempts optionally limits the number of consecutive failed
+	// attempts to obtain a certificate for a domain, first-time issuances
+	// and renewals alike. Once the limit is reached, the Manager gives up:
+	// it calls OnGiveUp and no longer asks the CA for a certificate for the
+	// domain, for which GetCertificate returns a *GiveUpError unless it
+	// still holds a valid certificate. ForceRenew resumes the attempts.
+	//
+	// If zero, the attempts are not limited.
+	MaxAttempts int
+
+	// IssuanceDeadline optionally makes the Manager give up, as with
+	// MaxAttempts, on a domain whose attempts to obtain a certificate have
+	// been failing for this long.
+	//
+	// If zero, the Manager retries for as long as MaxAttempts permits.
+	IssuanceDeadline time.Duration
+
+	// OnGiveUp is optionally called when the Manager gives up on domain,
+	// err being the *GiveUpError then returned for it, for instance to
+	// alert an operator. The Manager also logs the fact.
+	OnGiveUp func(domain string, err error)
+
+	// WeeklyCertLimit optionally caps the number of certificates obtained
+	// from the CA for the names of a registered domain, as returned by
+	// RegisteredDomain, over any 7 days, below the limits of the CA, such as
+	// the 50 certificates per registered domain per week of Let's Encrypt.
+	// First-time issuances and renewals alike count, and the count is kept
+	// in Cache, so that it is shared by the Managers using the same Cache.
+	//
+	// Once the limit is reached, the CA is not asked for certificates for
+	// the registered domain until its oldest certificate counted is 7 days
+	// old: GetCertificate returns a *BudgetExhaustedError, the renewals are
+	// retried at that time, and OnBudgetExhausted is called.
+	//
+	// If zero, the Manager does not count the certificates.
+	WeeklyCertLimit int
 
-	stateMu sync.Mutex
-	state   map[certKey]*certState
+	// RegisteredDomain optionally returns the registered domain of a name,
+	// to which WeeklyCertLimit applies, for instance with the public suffix
+	// list of golang.org/x/net/publicsuffix.
+	//
+	// If nil, or if it returns an empty string, the last two labels of the
+	// name are used, which is wrong for public suffixes of several labels
+	// such as "co.uk".
+	RegisteredDomain func(name string) string
+
+	// OnBudgetExhausted is optionally called when the Manager refuses
+	// to obtain a certificate for domain because WeeklyCertLimit is reached,
+	// err being the *BudgetExhaustedError then returned. It is called once
+	// per registered domain until the certificates can be obtained again.
+	// The Manager also logs the fact.
+	OnBudgetExhausted func(domain string, err error)
+
+	// OnCacheLoad is optionally called when the Manager adopts cert, the
+	// certificate of domain, from Cache rather than obtaining it from the
+	// CA, as on the first request for domain after a restart, for instance
+	// to tell the certificates loaded from those issued in monitoring.
+	// It is not called for the certificates renewed or obtained for the
+	// first time.
+	OnCacheLoad func(domain string, cert *tls.Certificate)
+
+	// ExpvarName optionally specifies the name under which the Manager
+	// publishes the statistics reported by Stats with the expvar package,
+	// as served at /debug/vars.
+	// The name must be unique in the process and set before the first
+	// certificate is obtained.
+	//
+	// If empty, nothing is published.
+	ExpvarName string
+
+	// configMu guards HostPolicy, RenewBefore and Email
+	// once they are changed with the setter methods.
+	configMu sync.RWMutex
+
+	clientMu       sync.Mutex
+	client         *acme.Client // initialized by acmeClient method
+	accountURL     string       // URI of the registered account, if known
+	accountContact []string     // contact URIs the account was registered or last updated with
+	contactTried   []string     // contact URIs of the last account update attempt
+	contactTriedAt time.Time    // time of the last account update attempt
+	rootCAsClient  *http.Client // trusting RootCAs, set by acmeClient
+
+	stateMu      sync.Mutex
+	state        map[certKey]*certState
+	aliases      map[string]string            // alias name to its primary domain; see AliasDomains
+	placeholders map[certKey]*tls.Certificate // served during background issuance; see PlaceholderCert
+
+	// budgetMu guards budgets, the issuance budgets of the domains
+	// with failed attempts; see MaxAttempts.
+	budgetMu sync.Mutex
+	budgets  map[string]*issuanceBudget
+
+	// weeklyMu guards the counts of certificates of WeeklyCertLimit:
+	// weeklyPending, the number of pending orders by registered domain,
+	// weeklyIssued, the issuance times when Cache is nil, and
+	// weeklyNotified, the time until which OnBudgetExhausted was called.
+	weeklyMu       sync.Mutex
+	weeklyPending  map[string]int
+	weeklyIssued   map[string][]time.Time
+	weeklyNotified map[string]time.Time
+
+	// sharedKeyMu guards sharedKeys, the certificate keys of
+	// SharedCertKey by key type, as last read from Cache.
+	sharedKeyMu sync.Mutex
+	sharedKeys  map[KeyType]crypto.Signer
+
+	// reloadMu guards reloaded, when the Cache was last read again
+	// for the certificates due for renewal; see ReadOnly.
+	reloadMu sync.Mutex
+	reloaded map[certKey]time.Time
 
 	// renewal tracks the set of domains currently running renewal timers.
 	renewalMu sync.Mutex
 	renewal   map[certKey]*domainRenewal
 
+	// renewalPaused is set between PauseRenewal and ResumeRenewal.
+	renewalPaused atomic.Bool
+
+	// shutdownMu guards shutDown, set by Shutdown, and inflight, the
+	// number of issuances in progress. drained is closed once inflight
+	// drops to zero, and workCtx is cancelled by abandonWork when
+	// Shutdown abandons them.
+	shutdownMu  sync.Mutex
+	shutDown    bool
+	inflight    int
+	drained     chan struct{}
+	workCtx     context.Context
+	abandonWork context.CancelFunc
+
+	// statsMu guards the stats of the renewals; see Stats.
+	statsMu         sync.Mutex
+	renewalFailures map[string]int // by FailureReason; see RenewalFailures
+	expvarOnce      sync.Once
+
+	ocspMu   sync.Mutex
+	ocspDown map[string]time.Time // OCSP responder URL to when it may be queried again
+
+	memCacheOnce sync.Once
+	memCache     *certLRU // initialized by certLRU method; nil if MemCacheSize <= 0
+
 	// tokensMu guards the rest of the fields: tryHTTP01, certTokens and httpTokens.
 	tokensMu sync.RWMutex
 	// tryHTTP01 indicates whether the Manager should try "http-01" challenge type
@@ -186,9 +859,14 @@ type Manager struct {
 	// for tls-alpn.
 	// The entries are stored for the duration of the authorization flow.
 	certTokens map[string]*tls.Certificate
-	// nowFunc, if not nil, returns the current time. This may be set for
-	// testing purposes.
-	nowFunc func() time.Time
+
+	// challengeMu guards challengeExp, the expiration times of the
+	// challenge data stored by m in the challenge cache, by cache key,
+	// and the sweep of expired challenge data.
+	challengeMu  sync.Mutex
+	challengeExp map[string]time.Time
+	sweepTimer   *time.Timer // armed while challengeExp is not empty
+	sweptOnce    bool        // whether a sweep ran at the first challenge
 }
 
 // certKey is the key by which certificates are tracked in state, renewal and cache.
@@ -211,14 +889,26 @@ func (c certKey) String() string {
 
 // TLSConfig creates a new TLS config suitable for net/http.Server servers,
 // supporting HTTP/2 and the tls-alpn-01 ACME challenge type.
+// Its minimum TLS version and cipher suites are set from m.MinTLSVersion
+// and m.CipherSuites.
 func (m *Manager) TLSConfig() *tls.Config {
 	fmt.Println("autocert TLSConfig called")
+	minVersion := m.MinTLSVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	var suites []uint16
+	if m.CipherSuites != nil {
+		suites = append([]uint16{}, m.CipherSuites...)
+	}
 	return &tls.Config{
 		GetCertificate: m.GetCertificate,
 		NextProtos: []string{
 			"h2", "http/1.1", // enable HTTP/2
 			acme.ALPNProto, // enable tls-alpn ACME challenges
 		},
+		MinVersion:   minVersion,
+		CipherSuites: suites,
 	}
 }
 
@@ -232,10 +922,21 @@ func (m *Manager) TLSConfig() *tls.Config {
 // The error is propagated back to the caller of GetCertificate and is user-visible.
 // This does not affect cached certs. See HostPolicy field description for more details.
 //
+// The policy is called with a context derived from hello.Context, the context
+// of the handshake, so it can use its deadline and connection-scoped values.
+// The requests to m.Cache and the CA are made with a context keeping these
+// values but not the cancelation of the handshake, as other handshakes may
+// wait for the same certificate. Both contexts expire after 5 minutes.
+//
 // If GetCertificate is used directly, instead of via Manager.TLSConfig, package users will
 // also have to add acme.ALPNProto to NextProtos for tls-alpn-01, or use HTTPHandler
 // for http-01. (The tls-sni-* challenges have been deprecated by popular ACME providers
 // due to security issues in the ecosystem.)
+//
+// Tor onion service names must be version 3 addresses. Their certificates are
+// obtained with the tls-alpn-01 or http-01 challenges, which the CA validates
+// through the Tor network, provided it supports .onion identifiers;
+// the onion-csr-01 challenge is not supported.
 func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 	fmt.Println("autocert GetCertificate called")
 	if m.Prompt == nil {
@@ -243,6 +944,9 @@ func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate,
 	}
 
 	name := hello.ServerName
+	if name == "" {
+		name = m.DefaultServerName
+	}
 	if name == "" {
 		return nil, errors.New("acme/autocert: missing server name")
 	}
@@ -252,10 +956,22 @@ func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate,
 	if strings.ContainsAny(name, `+/\`) {
 		return nil, errors.New("acme/autocert: server name contains invalid character")
 	}
+	if isOnion(name) {
+		if err := checkOnion(name); err != nil {
+			return nil, err
+		}
+	}
 
+	// connCtx carries the values and deadline of the handshake, if any.
+	connCtx := hello.Context()
+	if connCtx == nil {
+		connCtx = context.Background()
+	}
 	// In the worst-case scenario, the timeout needs to account for caching, host policy,
 	// domain ownership verification and certificate issuance.
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	// An issuance may be waited on by other connections, so it
+	// keeps the values of connCtx but not its cancelation.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(connCtx), 5*time.Minute)
 	defer cancel()
 
 	// Check whether this is a token cert requested for TLS-SNI or TLS-ALPN challenge.
@@ -280,24 +996,161 @@ func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate,
 		domain: strings.TrimSuffix(name, "."), // golang.org/issue/18114
 		isRSA:  !supportsECDSA(hello),
 	}
+	if m.CertKeyType != "" {
+		if err := m.CertKeyType.validate(); err != nil {
+			return nil, err
+		}
+		ck.isRSA = m.CertKeyType.isRSA()
+	}
+	ck.domain = m.primaryDomain(ck.domain)
+	if m.PlaceholderCert {
+		if p := m.placeholder(ck); p != nil {
+			return p, nil
+		}
+	}
 	cert, err := m.cert(ctx, ck)
+	if err == nil && m.ReadOnly {
+		return m.readOnlyCert(ctx, ck, cert)
+	}
 	if err == nil {
-		return cert, nil
+		if m.ServeExpiredGracePeriod > 0 && !m.now().Before(cert.Leaf.NotAfter) {
+			return m.expiredCert(ctx, ck, cert)
+		}
+		if m.belowMinServingValidity(cert) {
+			if fresh, err := m.renewNow(ctx, ck, cert); err == nil {
+				return m.stapled(ctx, ck, fresh), nil
+			}
+			// Fall back to the old cert while it is still valid.
+		}
+		return m.stapled(ctx, ck, cert), nil
+	}
+	if err == ErrCacheMiss && m.ReadOnly {
+		return nil, fmt.Errorf("acme/autocert: no certificate for %q in cache and the Manager is read-only", ck.domain)
+	}
+	// The CA is not asked again for a domain m gave up on.
+	if err := m.checkIssuanceBudget(ck.domain); err != nil {
+		return nil, err
 	}
 	if err != ErrCacheMiss {
 		return nil, err
 	}
 
 	// first-time
-	if err := m.hostPolicy()(ctx, name); err != nil {
+	policyCtx, cancelPolicy := context.WithTimeout(connCtx, 5*time.Minute)
+	err = m.hostPolicy()(policyCtx, name)
+	if err == nil {
+		err = m.admit(policyCtx, ck.domain)
+	}
+	cancelPolicy()
+	if err != nil {
 		return nil, err
 	}
-	cert, err = m.createCert(ctx, ck)
+	if m.PlaceholderCert {
+		return m.issueInBackground(ck)
+	}
+	// The handshake stops waiting for a first-time issuance when canceled.
+	// The requests to the CA are aborted once no handshake waits for it.
+	waitCtx, cancelWait := context.WithTimeout(connCtx, 5*time.Minute)
+	defer cancelWait()
+	cert, err = m.createCert(waitCtx, ck)
 	if err != nil {
 		return nil, err
 	}
-	m.cachePut(ctx, ck, cert)
-	return cert, nil
+	return m.stapled(ctx, ck, cert), nil
+}
+
+// GetClientCertificate implements the tls.Config.GetClientCertificate hook,
+// allowing the certificates obtained by m to be used for outbound connections
+// to servers which require TLS client authentication.
+//
+// Only certificates already held by m are considered: GetClientCertificate
+// never requests new certificates. It picks a valid certificate, permitted for
+// client authentication, whose chain is issued by one of cri.AcceptableCAs.
+// If cri.AcceptableCAs is empty, the server accepts any CA.
+// ECDSA certificates are preferred over RSA ones.
+//
+// If no certificate matches, an empty certificate is returned
+// so that the TLS handshake proceeds without client authentication.
+func (m *Manager) GetClientCertificate(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	type entry struct {
+		ck certKey
+		s  *certState
+	}
+	m.stateMu.Lock()
+	entries := make([]entry, 0, len(m.state))
+	for ck, s := range m.state {
+		if !ck.isToken {
+			entries = append(entries, entry{ck, s})
+		}
+	}
+	m.stateMu.Unlock()
+
+	// Iterate in a stable order, ECDSA first.
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i].ck, entries[j].ck
+		if a.isRSA != b.isRSA {
+			return !a.isRSA
+		}
+		return a.domain < b.domain
+	})
+	now := m.now()
+	for _, e := range entries {
+		// A state being issued is write-locked for the whole issuance,
+		// which the handshake does not wait for.
+		if !e.s.TryRLock() {
+			continue
+		}
+		cert, err := e.s.tlscert()
+		e.s.RUnlock()
+		if err != nil {
+			continue
+		}
+		if now.After(cert.Leaf.NotAfter) || !allowsClientAuth(cert.Leaf) {
+			continue
+		}
+		if issuedByAcceptableCA(cert, cri.AcceptableCAs) {
+			return cert, nil
+		}
+	}
+	return &tls.Certificate{}, nil
+}
+
+// allowsClientAuth reports whether the extended key usage of leaf
+// permits TLS client authentication.
+func allowsClientAuth(leaf *x509.Certificate) bool {
+	if len(leaf.ExtKeyUsage) == 0 && len(leaf.UnknownExtKeyUsage) == 0 {
+		return true
+	}
+	for _, u := range leaf.ExtKeyUsage {
+		if u == x509.ExtKeyUsageClientAuth || u == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
+
+// issuedByAcceptableCA reports whether the issuer of any certificate
+// in the chain of cert is one of the DER-encoded distinguished names in cas.
+// An empty cas accepts any issuer.
+func issuedByAcceptableCA(cert *tls.Certificate, cas [][]byte) bool {
+	if len(cas) == 0 {
+		return true
+	}
+	for i, der := range cert.Certificate {
+		c := cert.Leaf
+		if i > 0 {
+			var err error
+			if c, err = x509.ParseCertificate(der); err != nil {
+				return false
+			}
+		}
+		for _, ca := range cas {
+			if bytes.Equal(c.RawIssuer, ca) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // wantsTokenCert reports whether a TLS request with SNI is made by a CA server
@@ -344,6 +1197,15 @@ func supportsECDSA(hello *tls.ClientHelloInfo) bool {
 			return false
 		}
 	}
+	// The TLS 1.3 cipher suites are independent of the certificate key type,
+	// which only the "signature_algorithms" extension, required, limits.
+	if hello.SignatureSchemes != nil {
+		for _, v := range hello.SupportedVersions {
+			if v == tls.VersionTLS13 {
+				return true
+			}
+		}
+	}
 	for _, suite := range hello.CipherSuites {
 		switch suite {
 		case tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
@@ -396,15 +1258,64 @@ func (m *Manager) HTTPHandler(fallback http.Handler) http.Handler {
 			http.Error(w, err.Error(), http.StatusForbidden)
 			return
 		}
-		data, err := m.httpToken(ctx, r.URL.Path)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
+		var data []byte
+		if m.HTTP01ResponseFunc != nil {
+			if keyAuth, ok := m.HTTP01ResponseFunc(path.Base(r.URL.Path)); ok {
+				data = []byte(keyAuth)
+			}
+		}
+		if data == nil {
+			var err error
+			if data, err = m.httpToken(ctx, r.URL.Path); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+		}
+		for k, v := range m.HTTP01ResponseHeader {
+			w.Header()[k] = append([]string(nil), v...)
 		}
 		w.Write(data)
 	})
 }
 
+// ChallengeHandler configures the Manager to provision ACME "http-01" challenge
+// responses, like HTTPHandler, and returns an http.Handler that only responds
+// to the challenges, at "/.well-known/acme-challenge/<token>" paths.
+// It responds with 404 Not Found to all other requests.
+//
+// ChallengeHandler is meant to be mounted on an existing router which serves
+// other requests on port 80, for instance:
+//
+//	mux.Handle("/.well-known/acme-challenge/", m.ChallengeHandler())
+func (m *Manager) ChallengeHandler() http.Handler {
+	return m.HTTPHandler(http.NotFoundHandler())
+}
+
+// ServeChallenges serves the ACME "http-01" challenge responses on l,
+// as ChallengeHandler, for the deployments where the requests the CA sends
+// to port 80 reach the server through another listener, such as a Unix
+// socket a reverse proxy forwards them to:
+//
+//	l, err := net.Listen("unix", "/run/app/acme.sock")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	log.Fatal(m.ServeChallenges(l))
+//
+// ServeChallenges blocks until l fails, for instance because it is closed,
+// and returns the error, which is never nil.
+func (m *Manager) ServeChallenges(l net.Listener) error {
+	srv := &http.Server{
+		Handler:           m.ChallengeHandler(),
+		ReadHeaderTimeout: challengeReadTimeout,
+	}
+	return srv.Serve(l)
+}
+
+// challengeReadTimeout bounds the time ServeChallenges waits for
+// the headers of a request.
+const challengeReadTimeout = 10 * time.Second
+
 func handleHTTPRedirect(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("autocert handleHTTPRedirect called")
 	if r.Method != "GET" && r.Method != "HEAD" {
@@ -432,17 +1343,26 @@ func (m *Manager) cert(ctx context.Context, ck certKey) (*tls.Certificate, error
 	m.stateMu.Lock()
 	if s, ok := m.state[ck]; ok {
 		m.stateMu.Unlock()
+		if err := m.waitIssued(ctx, s); err != nil {
+			return nil, err
+		}
 		s.RLock()
 		defer s.RUnlock()
 		return s.tlscert()
 	}
-	defer m.stateMu.Unlock()
 	cert, err := m.cacheGet(ctx, ck)
+	if err == ErrCacheMiss && m.ServeExpiredGracePeriod > 0 {
+		// The expired cert is kept around while it is renewed,
+		// in case the CA is unavailable.
+		cert, err = m.cacheLoad(ctx, ck, m.now().Add(-m.ServeExpiredGracePeriod))
+	}
 	if err != nil {
+		m.stateMu.Unlock()
 		return nil, err
 	}
 	signer, ok := cert.PrivateKey.(crypto.Signer)
 	if !ok {
+		m.stateMu.Unlock()
 		return nil, errors.New("acme/autocert: private key cannot sign")
 	}
 	if m.state == nil {
@@ -454,22 +1374,119 @@ func (m *Manager) cert(ctx context.Context, ck certKey) (*tls.Certificate, error
 		leaf: cert.Leaf,
 	}
 	m.state[ck] = s
-	go m.renew(ck, s.key, s.leaf.NotAfter)
+	m.addAliases(ck, s.leaf)
+	m.stateMu.Unlock()
+	if !m.ReadOnly {
+		go m.renew(ck, s.key, s.leaf.NotAfter)
+	}
+	m.cacheLoaded(ck, cert)
 	return cert, nil
 }
 
+// cacheLoaded calls m.OnCacheLoad, if any, for cert, the certificate of ck
+// adopted from m.Cache. No lock may be held.
+func (m *Manager) cacheLoaded(ck certKey, cert *tls.Certificate) {
+	if m.OnCacheLoad != nil {
+		m.OnCacheLoad(ck.domain, cert)
+	}
+}
+
+// belowMinServingValidity reports whether cert expires within m.MinServingValidity.
+func (m *Manager) belowMinServingValidity(cert *tls.Certificate) bool {
+	if m.MinServingValidity <= 0 || cert.Leaf == nil {
+		return false
+	}
+	return cert.Leaf.NotAfter.Sub(m.now()) < m.MinServingValidity
+}
+
+// expiredCert attempts to synchronously renew cert, the expired certificate of ck.
+// If that fails, it returns cert as long as it expired less than
+// m.ServeExpiredGracePeriod ago.
+func (m *Manager) expiredCert(ctx context.Context, ck certKey, cert *tls.Certificate) (*tls.Certificate, error) {
+	fresh, err := m.renewNow(ctx, ck, cert)
+	if err == nil {
+		return fresh, nil
+	}
+	exp := cert.Leaf.NotAfter
+	if m.now().After(exp.Add(m.ServeExpiredGracePeriod)) {
+		return nil, fmt.Errorf("acme/autocert: certificate for %q expired at %v and could not be renewed: %v", ck.domain, exp, err)
+	}
+	if err != errRenewalPending {
+		log.Printf("acme/autocert: WARNING: serving certificate for %q which expired at %v: renewal failed: %v", ck.domain, exp, err)
+	}
+	return cert, nil
+}
+
+// renewNow synchronously renews cert, the current certificate of ck,
+// the same way its renewal timer does.
+func (m *Manager) renewNow(ctx context.Context, ck certKey, cert *tls.Certificate) (*tls.Certificate, error) {
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("acme/autocert: private key cannot sign")
+	}
+	// Arm the renewal timer unless it already is, so that the state
+	// of dr is shared by all callers.
+	m.renew(ck, signer, cert.Leaf.NotAfter)
+	m.renewalMu.Lock()
+	dr := m.renewal[ck]
+	m.renewalMu.Unlock()
+	if dr == nil {
+		// stopRenew was called in the meantime.
+		return nil, errRenewalPending
+	}
+	ctx, cancel := context.WithTimeout(ctx, syncRenewTimeout)
+	defer cancel()
+	return dr.renewNow(ctx)
+}
+
 // cacheGet always returns a valid certificate, or an error otherwise.
 // If a cached certificate exists but is not valid, ErrCacheMiss is returned.
 func (m *Manager) cacheGet(ctx context.Context, ck certKey) (*tls.Certificate, error) {
 	fmt.Println("autocert cacheGet called")
-	if m.Cache == nil {
+	cache := m.cacheFor(ck)
+	if cache == nil {
 		return nil, ErrCacheMiss
 	}
-	data, err := m.Cache.Get(ctx, ck.String())
+	lru := m.certLRU()
+	if lru != nil {
+		if cert, ok := lru.get(ck); ok {
+			if m.now().Before(cert.Leaf.NotAfter) {
+				return cert, nil
+			}
+			lru.remove(ck)
+		}
+	}
+	tlscert, err := m.cacheLoad(ctx, ck, m.now())
 	if err != nil {
 		return nil, err
 	}
+	if lru != nil {
+		lru.add(ck, tlscert)
+	}
+	return tlscert, nil
+}
 
+// cacheLoad reads the certificate of ck from m.Cache
+// and checks that it is valid at the time now.
+// Unlike cacheGet, it bypasses the in-memory layer.
+func (m *Manager) cacheLoad(ctx context.Context, ck certKey, now time.Time) (*tls.Certificate, error) {
+	cache := m.cacheFor(ck)
+	if cache == nil {
+		return nil, ErrCacheMiss
+	}
+	getCtx, sp := m.startSpan(ctx, "autocert.cache.get", ck.domain)
+	data, err := cache.Get(getCtx, ck.String())
+	sp.end(err)
+	if err != nil {
+		return nil, err
+	}
+	return decodeCert(ck, data, now)
+}
+
+// decodeCert parses the PEM-encoded key and certificate chain stored in
+// cache for ck, as written by cachePut. It returns ErrCacheMiss if they are
+// corrupt or no longer valid at now.
+func decodeCert(ck certKey, data []byte, now time.Time) (*tls.Certificate, error) {
 	// private
 	priv, pub := pem.Decode(data)
 	if priv == nil || !strings.Contains(priv.Type, "PRIVATE") {
@@ -477,7 +1494,9 @@ func (m *Manager) cacheGet(ctx context.Context, ck certKey) (*tls.Certificate, e
 	}
 	privKey, err := parsePrivateKey(priv.Bytes)
 	if err != nil {
-		return nil, err
+		// Corrupt, for instance by a partial write.
+		log.Printf("acme/autocert: cached private key for %q is corrupt; ignoring the cached certificate: %v", ck, err)
+		return nil, ErrCacheMiss
 	}
 
 	// public
@@ -496,52 +1515,120 @@ func (m *Manager) cacheGet(ctx context.Context, ck certKey) (*tls.Certificate, e
 	}
 
 	// verify and create TLS cert
-	leaf, err := validCert(ck, pubDER, privKey, m.now())
+	leaf, err := validCert(ck, pubDER, privKey, now)
+	if err == errKeyMismatch {
+		// Served, it would fail every handshake.
+		log.Printf("acme/autocert: cached certificate for %q does not match its private key; ignoring it", ck)
+	}
 	if err != nil {
 		return nil, ErrCacheMiss
 	}
-	tlscert := &tls.Certificate{
+	return &tls.Certificate{
 		Certificate: pubDER,
 		PrivateKey:  privKey,
 		Leaf:        leaf,
-	}
-	return tlscert, nil
+	}, nil
 }
 
 func (m *Manager) cachePut(ctx context.Context, ck certKey, tlscert *tls.Certificate) error {
 	fmt.Println("autocert cachePut called")
-	if m.Cache == nil {
+	cache := m.cacheFor(ck)
+	if cache == nil {
 		return nil
 	}
 
+	data, err := encodeCert(tlscert)
+	if err != nil {
+		return err
+	}
+
+	lru := m.certLRU()
+	if lru != nil {
+		// Drop the old value first so that it is never served
+		// in case Put fails, leaving the Cache in an unknown state.
+		lru.remove(ck)
+	}
+	if m.CertVersions > 0 {
+		if err := m.keepCertVersion(ctx, cache, ck, data); err != nil {
+			return err
+		}
+	}
+	putCtx, sp := m.startSpan(ctx, "autocert.cache.put", ck.domain)
+	err = cache.Put(putCtx, ck.String(), data)
+	sp.end(err)
+	if err != nil {
+		return err
+	}
+	if lru != nil && tlscert.Leaf != nil {
+		lru.add(ck, tlscert)
+	}
+	return nil
+}
+
+// encodeCert returns the PEM-encoded key and certificate chain of tlscert,
+// as stored in cache and read by decodeCert.
+func encodeCert(tlscert *tls.Certificate) ([]byte, error) {
 	// contains PEM-encoded data
 	var buf bytes.Buffer
 
 	// private
-	switch key := tlscert.PrivateKey.(type) {
-	case *ecdsa.PrivateKey:
-		if err := encodeECDSAKey(&buf, key); err != nil {
-			return err
-		}
-	case *rsa.PrivateKey:
-		b := x509.MarshalPKCS1PrivateKey(key)
-		pb := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: b}
-		if err := pem.Encode(&buf, pb); err != nil {
-			return err
-		}
-	default:
-		return errors.New("acme/autocert: unknown private key type")
+	if err := encodeKey(&buf, tlscert.PrivateKey); err != nil {
+		return nil, err
 	}
 
 	// public
 	for _, b := range tlscert.Certificate {
 		pb := &pem.Block{Type: "CERTIFICATE", Bytes: b}
 		if err := pem.Encode(&buf, pb); err != nil {
-			return err
+			return nil, err
 		}
 	}
+	return buf.Bytes(), nil
+}
 
-	return m.Cache.Put(ctx, ck.String(), buf.Bytes())
+// cacheFor returns the Cache storing ck, which may be nil.
+func (m *Manager) cacheFor(ck certKey) Cache {
+	if ck.isToken {
+		return m.certTokenCache()
+	}
+	return m.Cache
+}
+
+// challengeCache returns the Cache storing challenge data, which may be nil.
+func (m *Manager) challengeCache() Cache {
+	if m.ChallengeCache != nil {
+		return m.ChallengeCache
+	}
+	return m.Cache
+}
+
+// httpTokenCache returns the Cache storing http-01 token values,
+// which may be nil.
+func (m *Manager) httpTokenCache() Cache {
+	if m.HTTP01Cache != nil {
+		return m.HTTP01Cache
+	}
+	return m.challengeCache()
+}
+
+// certTokenCache returns the Cache storing tls-alpn-01 token certificates,
+// which may be nil.
+func (m *Manager) certTokenCache() Cache {
+	if m.TLSALPN01Cache != nil {
+		return m.TLSALPN01Cache
+	}
+	return m.challengeCache()
+}
+
+// certLRU returns the in-memory certificates cache layer,
+// or nil if none is configured with m.MemCacheSize.
+func (m *Manager) certLRU() *certLRU {
+	m.memCacheOnce.Do(func() {
+		if m.MemCacheSize > 0 {
+			m.memCache = newCertLRU(m.MemCacheSize)
+		}
+	})
+	return m.memCache
 }
 
 func encodeECDSAKey(w io.Writer, key *ecdsa.PrivateKey) error {
@@ -550,8 +1637,22 @@ func encodeECDSAKey(w io.Writer, key *ecdsa.PrivateKey) error {
 	if err != nil {
 		return err
 	}
-	pb := &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
-	return pem.Encode(w, pb)
+	pb := &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
+	return pem.Encode(w, pb)
+}
+
+// encodeKey writes the PEM encoding of an ECDSA or RSA private key to w.
+func encodeKey(w io.Writer, key crypto.PrivateKey) error {
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		return encodeECDSAKey(w, key)
+	case *rsa.PrivateKey:
+		b := x509.MarshalPKCS1PrivateKey(key)
+		pb := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: b}
+		return pem.Encode(w, pb)
+	default:
+		return errors.New("acme/autocert: unknown private key type")
+	}
 }
 
 // createCert starts the domain ownership verification and returns a certificate
@@ -559,29 +1660,126 @@ func encodeECDSAKey(w io.Writer, key *ecdsa.PrivateKey) error {
 //
 // If the domain is already being verified, it waits for the existing verification to complete.
 // Either way, createCert blocks for the duration of the whole process.
+// The process may be waited on by other connections, so it keeps the values
+// of ctx but not its cancelation: if ctx is done before the process
+// completes, createCert returns the error of ctx, and the process is only
+// abandoned once none of the callers waiting for it is left. The following
+// calls then start it over.
 func (m *Manager) createCert(ctx context.Context, ck certKey) (*tls.Certificate, error) {
 	fmt.Println("autocert createCert called")
+	issueCtx, done, err := m.beginWork(context.WithoutCancel(ctx))
+	if err != nil {
+		return nil, err
+	}
 	// TODO: maybe rewrite this whole piece using sync.Once
 	state, err := m.certState(ck)
 	if err != nil {
+		done()
 		return nil, err
 	}
 	// state may exist if another goroutine is already working on it
 	// in which case just wait for it to finish
-	if !state.locked {
-		state.RLock()
-		defer state.RUnlock()
-		return state.tlscert()
+	if state.locked {
+		// We are the first; state is locked.
+		state.locked = false
+		issueCtx, cancel := context.WithTimeout(issueCtx, 5*time.Minute)
+		m.stateMu.Lock()
+		state.cancelIssue = cancel
+		m.stateMu.Unlock()
+		go func() {
+			defer done()
+			defer cancel()
+			if m.issue(issueCtx, ck, state) != nil {
+				return
+			}
+			// The cert is cached before done, so that
+			// Shutdown waits for it.
+			state.RLock()
+			cert, err := state.tlscert()
+			state.RUnlock()
+			if err == nil {
+				m.cachePut(issueCtx, ck, cert)
+			}
+		}()
+	} else {
+		done()
+	}
+	if err := m.waitIssued(ctx, state); err != nil {
+		return nil, err
+	}
+	state.RLock()
+	defer state.RUnlock()
+	return state.tlscert()
+}
+
+// waitIssued waits for the first-time issuance of s, if any, to complete,
+// and returns its error. If ctx is done first, it returns the error of ctx;
+// the issuance is canceled once all its waiters gave up.
+func (m *Manager) waitIssued(ctx context.Context, s *certState) error {
+	if s.issued == nil {
+		return nil
+	}
+	m.stateMu.Lock()
+	s.waiters++
+	m.stateMu.Unlock()
+	var err error
+	select {
+	case <-s.issued:
+		err = s.issueErr
+	case <-ctx.Done():
+		err = ctx.Err()
 	}
+	m.stateMu.Lock()
+	s.waiters--
+	if err != nil && s.waiters == 0 && s.cancelIssue != nil && ctx.Err() != nil {
+		s.cancelIssue()
+	}
+	m.stateMu.Unlock()
+	return err
+}
 
-	// We are the first; state is locked.
-	// Unblock the readers when domain ownership is verified
-	// and we got the cert or the process failed.
+// issue obtains the first-time certificate of ck for state, which is locked
+// and unlocked once the domain ownership is verified and the cert obtained,
+// or the process failed.
+func (m *Manager) issue(ctx context.Context, ck certKey, state *certState) (err error) {
+	defer func() {
+		state.issueErr = err
+		close(state.issued)
+	}()
 	defer state.Unlock()
-	state.locked = false
+	ctx, sp := m.startCASpan(ctx, "autocert.issue", ck.domain)
+	defer func() { sp.end(err) }()
 
-	der, leaf, err := m.authorizedCert(ctx, state.key, ck)
+	if m.SharedCertKey {
+		key, err := m.sharedCertKey(ctx, m.certKeyType(ck))
+		if err != nil {
+			m.stateMu.Lock()
+			if m.state[ck] == state {
+				delete(m.state, ck)
+			}
+			m.stateMu.Unlock()
+			return err
+		}
+		state.key = key
+	}
+	der, leaf, certURL, err := m.authorizedCert(ctx, state.key, ck)
+	if err == nil {
+		err = m.validateCert(ck, &tls.Certificate{PrivateKey: state.key, Certificate: der, Leaf: leaf})
+	}
+	m.auditIssuance(ctx, ck, false, certURL, leaf, err)
+	if err != nil && ctx.Err() != nil {
+		// The handshakes waiting for the cert gave up or the process timed
+		// out, rather than the CA refusing the cert: the following TLS
+		// hellos may try again.
+		m.stateMu.Lock()
+		if m.state[ck] == state {
+			delete(m.state, ck)
+		}
+		m.stateMu.Unlock()
+		return err
+	}
 	if err != nil {
+		m.issuanceFailed(ck.domain, err)
 		// Remove the failed state after some time,
 		// making the manager call createCert again on the following TLS hello.
 		time.AfterFunc(createCertRetryAfter, func() {
@@ -599,12 +1797,58 @@ func (m *Manager) createCert(ctx context.Context, ck certKey) (*tls.Certificate,
 			}
 			delete(m.state, ck)
 		})
-		return nil, err
+		return err
 	}
+	m.issuanceSucceeded(ck.domain)
+	m.notifyIssued(ctx, ck, der)
 	state.cert = der
 	state.leaf = leaf
+	m.stateMu.Lock()
+	m.addAliases(ck, leaf)
+	m.stateMu.Unlock()
 	go m.renew(ck, state.key, state.leaf.NotAfter)
-	return state.tlscert()
+	return nil
+}
+
+// validateCert checks the issuer of a newly issued cert against m.PinnedIssuers
+// and runs m.ValidateCert, if any.
+func (m *Manager) validateCert(ck certKey, cert *tls.Certificate) error {
+	if len(m.PinnedIssuers) > 0 {
+		if err := checkIssuerPins(cert.Certificate, m.PinnedIssuers); err != nil {
+			err = fmt.Errorf("acme/autocert: certificate for %q rejected: %v", ck.domain, err)
+			log.Print(err)
+			return err
+		}
+	}
+	if m.ValidateCert == nil {
+		return nil
+	}
+	if err := m.ValidateCert(ck.domain, cert); err != nil {
+		return fmt.Errorf("acme/autocert: certificate for %q rejected: %v", ck.domain, err)
+	}
+	return nil
+}
+
+// checkIssuerPins returns an error unless one of the issuer certificates
+// in der, which starts with the leaf, has a public key matching one of
+// the SHA-256 pins.
+func checkIssuerPins(der [][]byte, pins [][]byte) error {
+	if len(der) < 2 {
+		return errors.New("no issuer certificate to check against the pinned issuers")
+	}
+	for _, b := range der[1:] {
+		cert, err := x509.ParseCertificate(b)
+		if err != nil {
+			return fmt.Errorf("bad issuer certificate: %v", err)
+		}
+		h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(h[:], pin) {
+				return nil
+			}
+		}
+	}
+	return errors.New("no issuer certificate matches the pinned issuers")
 }
 
 // certState returns a new or existing certState.
@@ -623,22 +1867,19 @@ func (m *Manager) certState(ck certKey) (*certState, error) {
 	}
 
 	// new locked state
-	var (
-		err error
-		key crypto.Signer
-	)
-	if ck.isRSA {
-		key, err = rsa.GenerateKey(rand.Reader, 2048)
-	} else {
-		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	}
-	if err != nil {
-		return nil, err
+	var key crypto.Signer
+	if !m.SharedCertKey {
+		// Otherwise set by createCert, out of m.stateMu.
+		var err error
+		if key, err = m.certKeyType(ck).generate(); err != nil {
+			return nil, err
+		}
 	}
 
 	state := &certState{
 		key:    key,
 		locked: true,
+		issued: make(chan struct{}),
 	}
 	state.Lock() // will be unlocked by m.certState caller
 	m.state[ck] = state
@@ -647,29 +1888,180 @@ func (m *Manager) certState(ck certKey) (*certState, error) {
 
 // authorizedCert starts the domain ownership verification process and requests a new cert upon success.
 // The key argument is the certificate private key.
-func (m *Manager) authorizedCert(ctx context.Context, key crypto.Signer, ck certKey) (der [][]byte, leaf *x509.Certificate, err error) {
+// The returned certURL is set once the CA has issued a cert, even if the cert is then found invalid.
+func (m *Manager) authorizedCert(ctx context.Context, key crypto.Signer, ck certKey) (der [][]byte, leaf *x509.Certificate, certURL string, err error) {
 	fmt.Println("autocert authorizedCert called")
+	ctx, sp := m.startCASpan(ctx, "autocert.authorizedCert", ck.domain)
+	defer func() { sp.end(err) }()
+	release, err := m.reserveWeeklyCert(ctx, ck.domain)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	defer func() { release(certURL != "") }()
 	client, err := m.acmeClient(ctx)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, "", err
+	}
+
+	names, err := m.certNames(ctx, ck.domain)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	var dropped []string
+	var dropErr error
+	var verified []string
+	for _, name := range names {
+		if err := m.verify(ctx, client, name); err != nil {
+			if !m.canDropAlias(ctx, ck, name) {
+				return nil, nil, "", err
+			}
+			dropped, dropErr = append(dropped, name), err
+			continue
+		}
+		verified = append(verified, name)
+	}
+	names = verified
+	for {
+		der, certURL, err = m.requestCert(ctx, client, key, ck, names)
+		if err == nil {
+			break
+		}
+		rejected := m.rejectedAliases(ctx, ck, names, err)
+		if len(rejected) == 0 {
+			return nil, nil, "", err
+		}
+		names = removeNames(names, rejected)
+		dropped, dropErr = append(dropped, rejected...), err
+	}
+	if len(dropped) > 0 {
+		m.aliasesDropped(ck.domain, dropped, dropErr)
+	}
+	leaf, err = validCert(ck, der, key, m.now())
+	if err != nil {
+		return nil, nil, certURL, err
+	}
+	for _, name := range names[1:] {
+		if err := leaf.VerifyHostname(name); err != nil {
+			return nil, nil, certURL, err
+		}
+	}
+	if m.ChainBuilder != nil {
+		if der, err = m.buildChain(ck, der, leaf); err != nil {
+			return nil, nil, certURL, err
+		}
 	}
+	return der, leaf, certURL, nil
+}
 
-	if err := m.verify(ctx, client, ck.domain); err != nil {
-		return nil, nil, err
+// requestCert requests a certificate for names, ck.domain followed by its
+// aliases, with the key key from the CA.
+func (m *Manager) requestCert(ctx context.Context, client *acme.Client, key crypto.Signer, ck certKey, names []string) (der [][]byte, certURL string, err error) {
+	var san []string
+	if len(names) > 1 {
+		san = names
 	}
-	csr, err := certRequest(key, ck.domain, m.ExtraExtensions)
+	subject, err := m.certSubject(ck.domain)
 	if err != nil {
-		return nil, nil, err
+		return nil, "", err
 	}
-	der, _, err = client.CreateCert(ctx, csr, 0, true)
+	csr, err := certRequest(key, subject, m.ExtraExtensions, san...)
 	if err != nil {
-		return nil, nil, err
+		return nil, "", err
 	}
-	leaf, err = validCert(ck, der, key, m.now())
+	// The names of the request may differ from the authorized ones,
+	// for instance if ExtraExtensions has a subject alternative name.
+	parsed, err := x509.ParseCertificateRequest(csr)
+	if err != nil {
+		return nil, "", err
+	}
+	ids := make([]acme.AuthzID, len(names))
+	for i, name := range names {
+		ids[i] = acme.AuthzID{Type: "dns", Value: name}
+	}
+	if err := acme.ValidateCSRIdentifiers(parsed, ids); err != nil {
+		return nil, "", err
+	}
+	return m.finalizeCert(ctx, client, ck, csr)
+}
+
+// finalizeCert submits the DER encoded csr for ck to the CA and waits for the
+// certificate, within m.FinalizeMaxWait.
+func (m *Manager) finalizeCert(ctx context.Context, client *acme.Client, ck certKey, csr []byte) (der [][]byte, certURL string, err error) {
+	ctx, sp := m.startCASpan(ctx, "autocert.finalize", ck.domain)
+	defer func() { sp.end(err) }()
+	var opts []acme.OrderOption
+	if v := m.CertValidity; v > 0 {
+		now := m.now()
+		opts = append(opts, acme.WithNotBefore(now), acme.WithNotAfter(now.Add(v)))
+	}
+	if d := m.FinalizePollInterval; d > 0 {
+		opts = append(opts, acme.WithPollInterval(d))
+	}
+	finalizeCtx := ctx
+	if d := m.FinalizeMaxWait; d > 0 {
+		var cancel context.CancelFunc
+		finalizeCtx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	der, certURL, err = client.CreateCert(finalizeCtx, csr, 0, true, opts...)
 	if err != nil {
-		return nil, nil, err
+		if finalizeCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+			err = fmt.Errorf("acme/autocert: certificate for %q not issued within %v: %w", ck.domain, m.FinalizeMaxWait, err)
+		}
+		return nil, "", err
+	}
+	return der, certURL, nil
+}
+
+// certNames returns the names to request a certificate for domain:
+// domain itself followed by its aliases returned by m.AliasDomains.
+// It returns an error if the host policy rejects one of the aliases.
+func (m *Manager) certNames(ctx context.Context, domain string) ([]string, error) {
+	names := []string{domain}
+	if m.AliasDomains == nil {
+		return names, nil
+	}
+	seen := map[string]bool{domain: true}
+	for _, alias := range m.AliasDomains(domain) {
+		if seen[alias] {
+			continue
+		}
+		seen[alias] = true
+		if err := m.hostPolicy()(ctx, alias); err != nil {
+			return nil, fmt.Errorf("acme/autocert: alias %q of %q not allowed: %v", alias, domain, err)
+		}
+		names = append(names, alias)
+	}
+	return names, nil
+}
+
+// addAliases records the names other than ck.domain which leaf is valid for
+// as aliases of ck.domain, if m.AliasDomains is set.
+// Callers must hold m.stateMu.
+func (m *Manager) addAliases(ck certKey, leaf *x509.Certificate) {
+	if m.AliasDomains == nil || ck.isToken {
+		return
+	}
+	for _, name := range leaf.DNSNames {
+		if name == ck.domain {
+			continue
+		}
+		if m.aliases == nil {
+			m.aliases = make(map[string]string)
+		}
+		m.aliases[name] = ck.domain
 	}
-	return der, leaf, nil
+}
+
+// primaryDomain returns the domain name is an alias of,
+// or name itself if it is not a known alias.
+func (m *Manager) primaryDomain(name string) string {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	if d, ok := m.aliases[name]; ok {
+		return d
+	}
+	return name
 }
 
 // revokePendingAuthz revokes all authorizations idenfied by the elements of uri slice.
@@ -687,8 +2079,10 @@ func (m *Manager) revokePendingAuthz(ctx context.Context, uri []string) {
 
 // verify runs the identifier (domain) authorization flow
 // using each applicable ACME challenge type.
-func (m *Manager) verify(ctx context.Context, client *acme.Client, domain string) error {
+func (m *Manager) verify(ctx context.Context, client *acme.Client, domain string) (err error) {
 	fmt.Println("autocert verify called")
+	ctx, sp := m.startCASpan(ctx, "autocert.verify", domain)
+	defer func() { sp.end(err) }()
 	// The list of challenge types we'll try to fulfill
 	// in this specific order.
 	challengeTypes := []string{"tls-alpn-01", "tls-sni-02", "tls-sni-01"}
@@ -697,6 +2091,9 @@ func (m *Manager) verify(ctx context.Context, client *acme.Client, domain string
 		challengeTypes = append(challengeTypes, "http-01")
 	}
 	m.tokensMu.RUnlock()
+	if m.DNSProvider != nil {
+		challengeTypes = append(challengeTypes, "dns-01")
+	}
 
 	// Keep track of pending authzs and revoke the ones that did not validate.
 	pendingAuthzs := make(map[string]bool)
@@ -714,14 +2111,34 @@ func (m *Manager) verify(ctx context.Context, client *acme.Client, domain string
 		}
 	}()
 
+	// The authorization left pending by an interrupted verify, if any, is
+	// resumed rather than replaced. The one in progress is kept in cache
+	// until verify returns, after which it is valid or revoked.
+	authz := m.cachedPendingAuthz(ctx, client, domain)
+	remembered := authz != nil
+	defer func() {
+		if remembered {
+			m.forgetPendingAuthz(domain)
+		}
+	}()
+
 	// errs accumulates challenge failure errors, printed if all fail
 	errs := make(map[*acme.Challenge]error)
 	var nextTyp int // challengeType index of the next challenge type to try
-	for {
-		// Start domain authorization and get the challenge.
-		authz, err := client.Authorize(ctx, domain)
-		if err != nil {
-			return err
+	for ; ; authz = nil {
+		if authz == nil {
+			// Start domain authorization and get the challenge.
+			authz, err = client.Authorize(ctx, domain)
+			if err != nil {
+				if isOnion(domain) {
+					return fmt.Errorf("acme/autocert: CA refused onion service name %q, it may not support .onion identifiers: %v", domain, err)
+				}
+				return err
+			}
+			if authz.Status == acme.StatusPending {
+				m.rememberPendingAuthz(ctx, domain, authz.URI)
+				remembered = true
+			}
 		}
 		// No point in accepting challenges if the authorization status
 		// is in a final state.
@@ -742,17 +2159,22 @@ func (m *Manager) verify(ctx context.Context, client *acme.Client, domain string
 		}
 		if chal == nil {
 			errorMsg := fmt.Sprintf("acme/autocert: unable to authorize %q", domain)
+			if isOnion(domain) && pickChallenge("onion-csr-01", authz.Challenges) != nil {
+				errorMsg += "; the onion-csr-01 challenge is not supported"
+			}
 			for chal, err := range errs {
 				errorMsg += fmt.Sprintf("; challenge %q failed with error: %v", chal.Type, err)
 			}
 			return errors.New(errorMsg)
 		}
+		sp.setAttribute("challenge", chal.Type)
 		cleanup, err := m.fulfill(ctx, client, chal, domain)
 		if err != nil {
 			errs[chal] = err
 			continue
 		}
 		defer cleanup()
+		m.selfCheck(ctx, client, chal, domain)
 		if _, err := client.Accept(ctx, chal); err != nil {
 			errs[chal] = err
 			continue
@@ -802,6 +2224,22 @@ func (m *Manager) fulfill(ctx context.Context, client *acme.Client, chal *acme.C
 		p := client.HTTP01ChallengePath(chal.Token)
 		m.putHTTPToken(ctx, p, resp)
 		return func() { go m.deleteHTTPToken(p) }, nil
+	case "dns-01":
+		val, err := client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.DNSProvider.Present(ctx, domain, val); err != nil {
+			return nil, err
+		}
+		cleanup := func() { go m.DNSProvider.CleanUp(context.Background(), domain, val) }
+		if m.DNSPropagationCheck != nil {
+			if err := m.DNSPropagationCheck.wait(ctx, domain, val); err != nil {
+				cleanup()
+				return nil, err
+			}
+		}
+		return cleanup, nil
 	}
 	return nil, fmt.Errorf("acme/autocert: unknown challenge type %q", chal.Type)
 }
@@ -817,7 +2255,7 @@ func pickChallenge(typ string, chal []*acme.Challenge) *acme.Challenge {
 }
 
 // putCertToken stores the token certificate with the specified name
-// in both m.certTokens map and m.Cache.
+// in both m.certTokens map and the challenge cache.
 func (m *Manager) putCertToken(ctx context.Context, name string, cert *tls.Certificate) {
 	fmt.Println("autocert putCertToken called")
 	m.tokensMu.Lock()
@@ -826,19 +2264,24 @@ func (m *Manager) putCertToken(ctx context.Context, name string, cert *tls.Certi
 		m.certTokens = make(map[string]*tls.Certificate)
 	}
 	m.certTokens[name] = cert
-	m.cachePut(ctx, certKey{domain: name, isToken: true}, cert)
+	ck := certKey{domain: name, isToken: true}
+	if err := m.cachePut(ctx, ck, cert); err == nil {
+		m.putChallengeExpiry(ctx, ck.String())
+	}
 }
 
 // deleteCertToken removes the token certificate with the specified name
-// from both m.certTokens map and m.Cache.
+// from both m.certTokens map and the challenge cache.
 func (m *Manager) deleteCertToken(name string) {
 	fmt.Println("autocert deleteCertToken called")
 	m.tokensMu.Lock()
 	defer m.tokensMu.Unlock()
 	delete(m.certTokens, name)
-	if m.Cache != nil {
+	if cache := m.certTokenCache(); cache != nil {
 		ck := certKey{domain: name, isToken: true}
-		m.Cache.Delete(context.Background(), ck.String())
+		if err := cache.Delete(context.Background(), ck.String()); err == nil {
+			m.deleteChallengeExpiry(ck.String())
+		}
 	}
 }
 
@@ -851,14 +2294,15 @@ func (m *Manager) httpToken(ctx context.Context, tokenPath string) ([]byte, erro
 	if v, ok := m.httpTokens[tokenPath]; ok {
 		return v, nil
 	}
-	if m.Cache == nil {
+	cache := m.httpTokenCache()
+	if cache == nil {
 		return nil, fmt.Errorf("acme/autocert: no token at %q", tokenPath)
 	}
-	return m.Cache.Get(ctx, httpTokenCacheKey(tokenPath))
+	return cache.Get(ctx, httpTokenCacheKey(tokenPath))
 }
 
 // putHTTPToken stores an http-01 token value using tokenPath as key
-// in both in-memory map and the optional Cache.
+// in both in-memory map and the optional challenge cache.
 //
 // It ignores any error returned from Cache.Put.
 func (m *Manager) putHTTPToken(ctx context.Context, tokenPath, val string) {
@@ -870,27 +2314,31 @@ func (m *Manager) putHTTPToken(ctx context.Context, tokenPath, val string) {
 	}
 	b := []byte(val)
 	m.httpTokens[tokenPath] = b
-	if m.Cache != nil {
-		m.Cache.Put(ctx, httpTokenCacheKey(tokenPath), b)
+	if cache := m.httpTokenCache(); cache != nil {
+		if err := cache.Put(ctx, httpTokenCacheKey(tokenPath), b); err == nil {
+			m.putChallengeExpiry(ctx, httpTokenCacheKey(tokenPath))
+		}
 	}
 }
 
 // deleteHTTPToken removes an http-01 token value from both in-memory map
-// and the optional Cache, ignoring any error returned from the latter.
+// and the optional challenge cache, ignoring any error returned from the latter.
 //
-// If m.Cache is non-nil, it blocks until Cache.Delete returns without a timeout.
+// If there is a challenge cache, it blocks until Cache.Delete returns without a timeout.
 func (m *Manager) deleteHTTPToken(tokenPath string) {
 	fmt.Println("autocert deleteHTTPToken called")
 	m.tokensMu.Lock()
 	defer m.tokensMu.Unlock()
 	delete(m.httpTokens, tokenPath)
-	if m.Cache != nil {
-		m.Cache.Delete(context.Background(), httpTokenCacheKey(tokenPath))
+	if cache := m.httpTokenCache(); cache != nil {
+		if err := cache.Delete(context.Background(), httpTokenCacheKey(tokenPath)); err == nil {
+			m.deleteChallengeExpiry(httpTokenCacheKey(tokenPath))
+		}
 	}
 }
 
 // httpTokenCacheKey returns a key at which an http-01 token value may be stored
-// in the Manager's optional Cache.
+// in the Manager's optional challenge cache.
 func httpTokenCacheKey(tokenPath string) string {
 	fmt.Println("autocert httpTokenCacheKey called")
 	return path.Base(tokenPath) + "+http-01"
@@ -906,6 +2354,10 @@ func httpTokenCacheKey(tokenPath string) string {
 // The exp argument is the cert expiration time (NotAfter).
 func (m *Manager) renew(ck certKey, key crypto.Signer, exp time.Time) {
 	fmt.Println("autocert renew called")
+	m.publishExpvar()
+	if m.isShutDown() {
+		return
+	}
 	m.renewalMu.Lock()
 	defer m.renewalMu.Unlock()
 	if m.renewal[ck] != nil {
@@ -932,39 +2384,51 @@ func (m *Manager) stopRenew() {
 	}
 }
 
-func (m *Manager) accountKey(ctx context.Context) (crypto.Signer, error) {
+// accountKey returns the account key to use with the CA at directoryURL.
+// Unless m.AccountKey provides one, keys are stored in m.Cache
+// separately for each directory.
+func (m *Manager) accountKey(ctx context.Context, directoryURL string) (crypto.Signer, error) {
 	fmt.Println("autocert accountKey called")
-	const keyName = "acme_account+key"
-
-	// Previous versions of autocert stored the value under a different key.
-	const legacyKeyName = "acme_account.key"
-
-	genKey := func() (*ecdsa.PrivateKey, error) {
-		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if m.AccountKey != nil {
+		if key := m.AccountKey(directoryURL); key != nil {
+			return key, nil
+		}
 	}
 
 	if m.Cache == nil {
-		return genKey()
+		return m.accountKeyType().generate()
 	}
 
-	data, err := m.Cache.Get(ctx, keyName)
-	if err == ErrCacheMiss {
-		data, err = m.Cache.Get(ctx, legacyKeyName)
-	}
+	key, err := m.cachedAccountKey(ctx, directoryURL)
 	if err == ErrCacheMiss {
-		key, err := genKey()
+		key, err := m.accountKeyType().generate()
 		if err != nil {
 			return nil, err
 		}
 		var buf bytes.Buffer
-		if err := encodeECDSAKey(&buf, key); err != nil {
+		if err := encodeKey(&buf, key); err != nil {
 			return nil, err
 		}
-		if err := m.Cache.Put(ctx, keyName, buf.Bytes()); err != nil {
+		if err := m.putAccountKey(ctx, accountKeyCacheKey(directoryURL), buf.Bytes()); err != nil {
 			return nil, err
 		}
 		return key, nil
 	}
+	return key, err
+}
+
+// cachedAccountKey reads the account key of directoryURL from m.Cache,
+// which must not be nil. It returns ErrCacheMiss if there is none.
+func (m *Manager) cachedAccountKey(ctx context.Context, directoryURL string) (crypto.Signer, error) {
+	keyName := accountKeyCacheKey(directoryURL)
+
+	data, err := m.Cache.Get(ctx, keyName)
+	if err == nil {
+		data, err = m.openAccountKey(ctx, keyName, data)
+	}
+	if err == ErrCacheMiss {
+		data, err = m.migrateLegacyAccountKey(ctx, directoryURL, keyName)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -976,41 +2440,272 @@ func (m *Manager) accountKey(ctx context.Context) (crypto.Signer, error) {
 	return parsePrivateKey(priv.Bytes)
 }
 
-func (m *Manager) acmeClient(ctx context.Context) (*acme.Client, error) {
-	fmt.Println("autocert acmeClient called")
+// legacyAccountKeyNames are the names under which previous versions of
+// autocert stored a single account key, shared by all directories.
+var legacyAccountKeyNames = []string{"acme_account+key", "acme_account.key"}
+
+// legacyMigratedKey names the cache entry recording the directory URL
+// the legacy account key was migrated to.
+const legacyMigratedKey = "acme_account+migrated"
+
+// migrateLegacyAccountKey stores the legacy account key, if any, as the key
+// of directoryURL at keyName, and returns it. The legacy key is migrated
+// only once, to the first directory asking for it, so that the account keys
+// of other directories are generated anew rather than shared with it;
+// for those, it returns ErrCacheMiss.
+func (m *Manager) migrateLegacyAccountKey(ctx context.Context, directoryURL, keyName string) ([]byte, error) {
+	if _, err := m.Cache.Get(ctx, legacyMigratedKey); err != ErrCacheMiss {
+		if err == nil {
+			err = ErrCacheMiss
+		}
+		return nil, err
+	}
+	for _, name := range legacyAccountKeyNames {
+		data, err := m.Cache.Get(ctx, name)
+		if err == ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := m.putAccountKey(ctx, keyName, data); err != nil {
+			return nil, err
+		}
+		if err := m.Cache.Put(ctx, legacyMigratedKey, []byte(directoryURL)); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	return nil, ErrCacheMiss
+}
+
+// ExportAccountKey returns the key of the ACME account of m with the CA
+// of m.Client, for instance to back it up or to move the account to
+// another host with ImportAccountKey.
+//
+// It returns the key currently in use, if any, or the one stored in
+// m.Cache otherwise. It does not generate a key: if m has no account key
+// yet, ExportAccountKey returns ErrCacheMiss.
+func (m *Manager) ExportAccountKey() (crypto.Signer, error) {
 	m.clientMu.Lock()
 	defer m.clientMu.Unlock()
 	if m.client != nil {
-		return m.client, nil
+		return m.client.Key, nil
+	}
+	if m.Client != nil && m.Client.Key != nil {
+		return m.Client.Key, nil
+	}
+	if m.Cache == nil {
+		return nil, ErrCacheMiss
+	}
+	return m.cachedAccountKey(context.Background(), m.directoryURL())
+}
+
+// ImportAccountKey stores key in m.Cache as the key of the ACME account of m
+// with the CA of m.Client. Subsequent registrations with the CA use it,
+// reusing the account it was previously registered with, if any.
+// Only the account key entry of m.Cache is written, at the name "acme_account_"
+// followed by a hash of the CA directory URL and "+key", as a PEM block:
+// "EC PRIVATE KEY" (SEC 1) for ECDSA keys and "RSA PRIVATE KEY" (PKCS #1)
+// for RSA keys, sealed with m.AccountKeySealer if any. Cached certificates
+// are left as is.
+//
+// The key must be an *ecdsa.PrivateKey or an *rsa.PrivateKey. ImportAccountKey
+// fails if m.Cache is nil, if m.Client has a Key, or if m has already
+// registered with the CA, such as after the first call of GetCertificate.
+func (m *Manager) ImportAccountKey(key crypto.Signer) error {
+	m.clientMu.Lock()
+	defer m.clientMu.Unlock()
+	switch {
+	case m.Cache == nil:
+		return errors.New("acme/autocert: cannot import an account key without a Cache")
+	case m.client != nil || m.Client != nil && m.Client.Key != nil:
+		return errors.New("acme/autocert: account key already in use")
+	}
+	var pb *pem.Block
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		b, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		pb = &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
+	case *rsa.PrivateKey:
+		pb = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	default:
+		return fmt.Errorf("acme/autocert: unsupported account key type %T", key)
+	}
+	return m.putAccountKey(context.Background(), accountKeyCacheKey(m.directoryURL()), pem.EncodeToMemory(pb))
+}
+
+// directoryURL returns the directory endpoint of the CA of m.Client.
+func (m *Manager) directoryURL() string {
+	if m.Client != nil && m.Client.DirectoryURL != "" {
+		return m.Client.DirectoryURL
+	}
+	if m.DirectoryURL != "" {
+		return m.DirectoryURL
+	}
+	return acme.LetsEncryptURL
+}
+
+// accountKeyCacheKey returns the cache key under which the account key
+// for the CA at directoryURL is stored.
+func accountKeyCacheKey(directoryURL string) string {
+	sum := sha256.Sum256([]byte(directoryURL))
+	return "acme_account_" + hex.EncodeToString(sum[:16]) + "+key"
+}
+
+func (m *Manager) acmeClient(ctx context.Context) (*acme.Client, error) {
+	fmt.Println("autocert acmeClient called")
+	m.clientMu.Lock()
+	if m.client == nil {
+		defer m.clientMu.Unlock()
+		return m.registerClient(ctx)
+	}
+	client := m.client
+	accountURL, contact := m.pendingContact()
+	m.clientMu.Unlock()
+	if contact != nil {
+		m.updateContact(ctx, client, accountURL, contact)
 	}
+	return client, nil
+}
 
+// registerClient initializes m.client, registering the account with the CA.
+// m.clientMu must be held.
+func (m *Manager) registerClient(ctx context.Context) (*acme.Client, error) {
 	client := m.Client
 	if client == nil {
-		client = &acme.Client{DirectoryURL: acme.LetsEncryptURL}
+		client = &acme.Client{}
+	}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = m.directoryURL()
+	}
+	if m.RootCAs != nil {
+		if m.rootCAsClient == nil {
+			m.rootCAsClient = rootCAsHTTPClient(m.RootCAs)
+		}
+		switch client.HTTPClient {
+		case nil:
+			client.HTTPClient = m.rootCAsClient
+		case m.rootCAsClient:
+			// Set by a previous registration attempt.
+		default:
+			return nil, errors.New("acme/autocert: Manager.RootCAs requires a Client without HTTPClient")
+		}
+	}
+	// The suffix is there already if a previous registration attempt failed.
+	if ua := strings.TrimSpace("autocert " + m.UserAgent); !strings.HasSuffix(client.UserAgent, ua) {
+		client.UserAgent = strings.TrimSpace(client.UserAgent + " " + ua)
 	}
 	if client.Key == nil {
+		dirURL := client.DirectoryURL
+		if dirURL == "" {
+			dirURL = acme.LetsEncryptURL
+		}
 		var err error
-		client.Key, err = m.accountKey(ctx)
+		client.Key, err = m.accountKey(ctx, dirURL)
 		if err != nil {
 			return nil, err
 		}
 	}
-	var contact []string
-	if m.Email != "" {
-		contact = []string{"mailto:" + m.Email}
-	}
+	contact := m.contact()
 	a := &acme.Account{Contact: contact}
-	_, err := client.Register(ctx, a, m.Prompt)
+	a, err := client.Register(ctx, a, m.Prompt)
 	if ae, ok := err.(*acme.Error); err == nil || ok && ae.StatusCode == http.StatusConflict {
 		// conflict indicates the key is already registered
+		if err == nil {
+			m.accountURL = a.URI
+		} else {
+			m.accountURL = ae.Header.Get("Location")
+		}
+		m.accountContact = contact
 		m.client = client
 		err = nil
 	}
 	return m.client, err
 }
 
+// rootCAsHTTPClient returns an HTTP client like http.DefaultClient,
+// trusting only roots in its TLS connections.
+func rootCAsHTTPClient(roots *x509.CertPool) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = &tls.Config{RootCAs: roots}
+	return &http.Client{Transport: t}
+}
+
+// contact returns the contact URIs of the account: m.Email, if any,
+// followed by m.Contact.
+func (m *Manager) contact() []string {
+	var contact []string
+	if email := m.email(); email != "" {
+		contact = []string{"mailto:" + email}
+	}
+	return append(contact, m.Contact...)
+}
+
+// contactRetryInterval is how long a failed update of the account
+// contacts is not retried for.
+var contactRetryInterval = time.Hour
+
+// pendingContact returns the URI of the registered account and its contact
+// URIs if they changed since the registration or the last update, such as
+// after SetEmail, and were not attempted to be updated within the last
+// contactRetryInterval. It records the attempt. It returns a nil contact
+// if there is nothing to update. m.clientMu must be held.
+func (m *Manager) pendingContact() (string, []string) {
+	contact := m.contact()
+	if m.accountURL == "" || equalStrings(contact, m.accountContact) {
+		return "", nil
+	}
+	now := m.now()
+	if equalStrings(contact, m.contactTried) && now.Before(m.contactTriedAt.Add(contactRetryInterval)) {
+		return "", nil
+	}
+	m.contactTried, m.contactTriedAt = contact, now
+	return m.accountURL, contact
+}
+
+// updateContact updates the contact URIs of the account at accountURL,
+// as returned by pendingContact. m.clientMu must not be held, so that
+// an unreachable CA does not block the other users of client.
+// A failed update is logged and retried after contactRetryInterval.
+func (m *Manager) updateContact(ctx context.Context, client *acme.Client, accountURL string, contact []string) {
+	if _, err := client.UpdateAccount(ctx, accountURL, contact); err != nil {
+		log.Printf("acme/autocert: updating the account contacts: %v", err)
+		return
+	}
+	m.clientMu.Lock()
+	m.accountContact = contact
+	m.clientMu.Unlock()
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// admit calls m.AdmissionFunc, if any, before asking the CA for a
+// certificate for domain.
+func (m *Manager) admit(ctx context.Context, domain string) error {
+	if m.AdmissionFunc == nil {
+		return nil
+	}
+	return m.AdmissionFunc(ctx, domain)
+}
+
 func (m *Manager) hostPolicy() HostPolicy {
 	fmt.Println("autocert hostPolicy called")
+	m.configMu.RLock()
+	defer m.configMu.RUnlock()
 	if m.HostPolicy != nil {
 		return m.HostPolicy
 	}
@@ -1019,16 +2714,68 @@ func (m *Manager) hostPolicy() HostPolicy {
 
 func (m *Manager) renewBefore() time.Duration {
 	fmt.Println("autocert renewBefore called")
+	m.configMu.RLock()
+	defer m.configMu.RUnlock()
 	if m.RenewBefore > renewJitter {
 		return m.RenewBefore
 	}
 	return 720 * time.Hour // 30 days
 }
 
+func (m *Manager) email() string {
+	m.configMu.RLock()
+	defer m.configMu.RUnlock()
+	return m.Email
+}
+
+// SetHostPolicy replaces m.HostPolicy. Unlike assigning the field directly,
+// it is safe to call while m is in use.
+func (m *Manager) SetHostPolicy(policy HostPolicy) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.HostPolicy = policy
+}
+
+// SetEmail replaces m.Email. Unlike assigning the field directly,
+// it is safe to call while m is in use.
+// If m has already registered its account, the contacts of the account
+// are updated with the new address on the next request to the CA.
+func (m *Manager) SetEmail(email string) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.Email = email
+}
+
+// SetRenewBefore replaces m.RenewBefore. Unlike assigning the field directly,
+// it is safe to call while m is in use.
+//
+// The renewal timers which are already armed are rescheduled according
+// to the new value in the background, so SetRenewBefore does not wait for
+// them. Renewals in progress complete first and then schedule the next
+// renewal according to the new value.
+func (m *Manager) SetRenewBefore(d time.Duration) {
+	m.configMu.Lock()
+	m.RenewBefore = d
+	m.configMu.Unlock()
+
+	m.renewalMu.Lock()
+	renewals := make([]*domainRenewal, 0, len(m.renewal))
+	for _, dr := range m.renewal {
+		renewals = append(renewals, dr)
+	}
+	m.renewalMu.Unlock()
+	// reschedule waits for the renewals in progress, which hold their timer.
+	go func() {
+		for _, dr := range renewals {
+			dr.reschedule()
+		}
+	}()
+}
+
 func (m *Manager) now() time.Time {
 	fmt.Println("autocert now called")
-	if m.nowFunc != nil {
-		return m.nowFunc()
+	if m.Now != nil {
+		return m.Now()
 	}
 	return time.Now()
 }
@@ -1040,6 +2787,24 @@ type certState struct {
 	key    crypto.Signer     // private key for cert
 	cert   [][]byte          // DER encoding
 	leaf   *x509.Certificate // parsed cert[0]; always non-nil if cert != nil
+
+	// issued is closed once the first-time issuance of a state created by
+	// Manager.certState completes, with issueErr set; it is nil for the
+	// states of cached certs. waiters counts the callers waiting for the
+	// issuance, which is canceled with cancelIssue once they all gave up;
+	// both are guarded by Manager.stateMu.
+	issued      chan struct{}
+	issueErr    error
+	waiters     int
+	cancelIssue context.CancelFunc
+
+	// ocspMu guards the OCSP staple of the certificate, see Manager.stapled.
+	ocspMu         sync.Mutex
+	ocspLeaf       []byte    // DER encoding of the leaf ocspStaple is for
+	ocspStaple     []byte    // DER encoded OCSP response
+	ocspRefresh    time.Time // when to refresh ocspStaple in the background
+	ocspExpiry     time.Time // when ocspStaple expires
+	ocspRefreshing bool      // whether a background refresh is running
 }
 
 // tlscert creates a tls.Certificate from s.key and s.cert.
@@ -1059,11 +2824,23 @@ func (s *certState) tlscert() (*tls.Certificate, error) {
 	}, nil
 }
 
-// certRequest generates a CSR for the given common name cn and optional SANs.
-func certRequest(key crypto.Signer, cn string, ext []pkix.Extension, san ...string) ([]byte, error) {
+// certSubject returns the subject of the CSRs for domain: m.Subject with
+// the common name domain. It fails if m.Subject sets other fields than
+// those documented.
+func (m *Manager) certSubject(domain string) (pkix.Name, error) {
+	s := m.Subject
+	if s.CommonName != "" || s.SerialNumber != "" || len(s.Names) > 0 || len(s.ExtraNames) > 0 {
+		return pkix.Name{}, errors.New("acme/autocert: Manager.Subject may only set Country, Organization, OrganizationalUnit, Locality, Province, StreetAddress and PostalCode")
+	}
+	s.CommonName = domain
+	return s, nil
+}
+
+// certRequest generates a CSR for the given subject and optional SANs.
+func certRequest(key crypto.Signer, subject pkix.Name, ext []pkix.Extension, san ...string) ([]byte, error) {
 	fmt.Println("autocert certRequest called")
 	req := &x509.CertificateRequest{
-		Subject:         pkix.Name{CommonName: cn},
+		Subject:         subject,
 		DNSNames:        san,
 		ExtraExtensions: ext,
 	}
@@ -1097,6 +2874,10 @@ func parsePrivateKey(der []byte) (crypto.Signer, error) {
 	return nil, errors.New("acme/autocert: failed to parse private key")
 }
 
+// errKeyMismatch is returned by validCert if the leaf certificate is not
+// for the private key.
+var errKeyMismatch = errors.New("acme/autocert: private key does not match public key")
+
 // validCert parses a cert chain provided as der argument and verifies the leaf and der[0]
 // correspond to the private key, the domain and key type match, and expiration dates
 // are valid. It doesn't do any revocation checking.
@@ -1136,8 +2917,8 @@ func validCert(ck certKey, der [][]byte, key crypto.Signer, now time.Time) (leaf
 		if !ok {
 			return nil, errors.New("acme/autocert: private key type does not match public key type")
 		}
-		if pub.N.Cmp(prv.N) != 0 {
-			return nil, errors.New("acme/autocert: private key does not match public key")
+		if !prv.PublicKey.Equal(pub) {
+			return nil, errKeyMismatch
 		}
 		if !ck.isRSA && !ck.isToken {
 			return nil, errors.New("acme/autocert: key type does not match expected value")
@@ -1147,8 +2928,8 @@ func validCert(ck certKey, der [][]byte, key crypto.Signer, now time.Time) (leaf
 		if !ok {
 			return nil, errors.New("acme/autocert: private key type does not match public key type")
 		}
-		if pub.X.Cmp(prv.X) != 0 || pub.Y.Cmp(prv.Y) != 0 {
-			return nil, errors.New("acme/autocert: private key does not match public key")
+		if !prv.PublicKey.Equal(pub) {
+			return nil, errKeyMismatch
 		}
 		if ck.isRSA && !ck.isToken {
 			return nil, errors.New("acme/autocert: key type does not match expected value")
@@ -18,21 +18,30 @@ import (
 	"encoding/asn1"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
 	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/robarchibald/crypto/acme"
 	"github.com/robarchibald/crypto/acme/autocert/internal/acmetest"
+	"github.com/robarchibald/crypto/ocsp"
 )
 
 var (
@@ -77,11 +86,13 @@ type memCache struct {
 	t       *testing.T
 	mu      sync.Mutex
 	keyData map[string][]byte
+	gets    int // number of Get calls
 }
 
 func (m *memCache) Get(ctx context.Context, key string) ([]byte, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.gets++
 
 	v, ok := m.keyData[key]
 	if !ok {
@@ -132,6 +143,12 @@ func newMemCache(t *testing.T) *memCache {
 	}
 }
 
+func (m *memCache) numGets() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.gets
+}
+
 func (m *memCache) numCerts() int {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -140,7 +157,8 @@ func (m *memCache) numCerts() int {
 	for key := range m.keyData {
 		if strings.HasSuffix(key, "+token") ||
 			strings.HasSuffix(key, "+key") ||
-			strings.HasSuffix(key, "+http-01") {
+			strings.HasSuffix(key, "+http-01") ||
+			strings.HasSuffix(key, "+weekly") {
 			continue
 		}
 		res++
@@ -195,6 +213,50 @@ func clientHelloInfo(sni string, ecdsaSupport bool) *tls.ClientHelloInfo {
 	return hello
 }
 
+func TestTLSConfig(t *testing.T) {
+	man := &Manager{}
+	conf := man.TLSConfig()
+	if conf.MinVersion != tls.VersionTLS12 {
+		t.Errorf("default MinVersion = %x, want TLS 1.2", conf.MinVersion)
+	}
+	if conf.CipherSuites != nil {
+		t.Errorf("default CipherSuites = %x, want nil", conf.CipherSuites)
+	}
+	wantProtos := []string{"h2", "http/1.1", acme.ALPNProto}
+	if !reflect.DeepEqual(conf.NextProtos, wantProtos) {
+		t.Errorf("NextProtos = %q, want %q", conf.NextProtos, wantProtos)
+	}
+
+	suites := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}
+	man = &Manager{MinTLSVersion: tls.VersionTLS13, CipherSuites: suites}
+	conf = man.TLSConfig()
+	if conf.MinVersion != tls.VersionTLS13 {
+		t.Errorf("MinVersion = %x, want TLS 1.3", conf.MinVersion)
+	}
+	if !reflect.DeepEqual(conf.CipherSuites, suites) {
+		t.Errorf("CipherSuites = %x, want %x", conf.CipherSuites, suites)
+	}
+	// The config does not share the Manager's slice.
+	conf.CipherSuites[0] = 0
+	if man.CipherSuites[0] == 0 {
+		t.Error("modifying the config's CipherSuites modified the Manager's")
+	}
+
+	// The minimum version is enforced in handshakes.
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go tls.Server(c1, man.TLSConfig()).Handshake()
+	client := tls.Client(c2, &tls.Config{
+		ServerName:         exampleDomain,
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+	})
+	if err := client.Handshake(); err == nil {
+		t.Error("TLS 1.2 handshake succeeded with MinTLSVersion set to TLS 1.3")
+	}
+}
+
 func TestGetCertificate(t *testing.T) {
 	man := &Manager{Prompt: AcceptTOS}
 	defer man.stopRenew()
@@ -202,6 +264,126 @@ func TestGetCertificate(t *testing.T) {
 	testGetCertificate(t, man, "example.org", hello)
 }
 
+// memTracer is a Tracer recording its spans in memory.
+type memTracer struct {
+	mu    sync.Mutex
+	spans []*memSpan // in the order they were started
+}
+
+type memSpan struct {
+	tr     *memTracer
+	name   string
+	parent *memSpan
+	attrs  map[string]string
+	ended  bool
+	err    error
+}
+
+type memSpanKey struct{}
+
+func (tr *memTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(memSpanKey{}).(*memSpan)
+	s := &memSpan{tr: tr, name: name, parent: parent, attrs: make(map[string]string)}
+	tr.mu.Lock()
+	tr.spans = append(tr.spans, s)
+	tr.mu.Unlock()
+	return context.WithValue(ctx, memSpanKey{}, s), s
+}
+
+func (s *memSpan) SetAttribute(key, value string) {
+	s.tr.mu.Lock()
+	defer s.tr.mu.Unlock()
+	s.attrs[key] = value
+}
+
+func (s *memSpan) End(err error) {
+	s.tr.mu.Lock()
+	defer s.tr.mu.Unlock()
+	s.ended = true
+	s.err = err
+}
+
+// tree returns the names and outcomes of the spans, indented by depth.
+func (tr *memTracer) tree() string {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	var b strings.Builder
+	for _, s := range tr.spans {
+		for p := s.parent; p != nil; p = p.parent {
+			b.WriteString("  ")
+		}
+		fmt.Fprintf(&b, "%s %s\n", s.name, s.attrs["outcome"])
+	}
+	return b.String()
+}
+
+func TestTracer(t *testing.T) {
+	man := &Manager{Prompt: AcceptTOS, Cache: newMemCache(t)}
+	defer man.stopRenew()
+	url, finish := startACMEServerStub(t, getCertificateFromManager(man, true), exampleDomain)
+	defer finish()
+	man.Client = &acme.Client{DirectoryURL: url}
+
+	// The tracer of the handshake traces the issuance of its certificate.
+	tr := &memTracer{}
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	errc := make(chan error, 1)
+	go func() {
+		defer c1.Close()
+		conn := tls.Server(c1, man.TLSConfig())
+		errc <- conn.HandshakeContext(WithTracer(context.Background(), tr))
+	}()
+	client := tls.Client(c2, &tls.Config{ServerName: exampleDomain, InsecureSkipVerify: true})
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("server handshake: %v", err)
+	}
+
+	want := `autocert.cache.get miss
+autocert.issue success
+  autocert.authorizedCert success
+    autocert.verify success
+      autocert.cache.put success
+    autocert.finalize success
+autocert.cache.put success
+`
+	if got := tr.tree(); got != want {
+		t.Errorf("spans:\n%s\nwant:\n%s", got, want)
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for _, s := range tr.spans {
+		if !s.ended || s.err != nil {
+			t.Errorf("span %s: ended = %v, err = %v; want ended without error", s.name, s.ended, s.err)
+		}
+		switch s.name {
+		case "autocert.issue", "autocert.authorizedCert", "autocert.verify", "autocert.finalize":
+			if s.attrs["domain"] != exampleDomain || s.attrs["ca"] != url {
+				t.Errorf("span %s: attributes %v; want domain %q and ca %q", s.name, s.attrs, exampleDomain, url)
+			}
+		}
+		if s.name == "autocert.verify" && s.attrs["challenge"] != "tls-sni-02" {
+			t.Errorf("span %s: challenge = %q; want tls-sni-02", s.name, s.attrs["challenge"])
+		}
+	}
+}
+
+func TestTracerDisabled(t *testing.T) {
+	man := &Manager{}
+	ctx := context.Background()
+	allocs := testing.AllocsPerRun(100, func() {
+		_, sp := man.startCASpan(ctx, "autocert.issue", exampleDomain)
+		sp.setAttribute("challenge", "http-01")
+		sp.end(nil)
+	})
+	if allocs != 0 {
+		t.Errorf("spans without a Tracer allocate %v times; want 0", allocs)
+	}
+}
+
 func TestGetCertificate_trailingDot(t *testing.T) {
 	man := &Manager{Prompt: AcceptTOS}
 	defer man.stopRenew()
@@ -229,6 +411,48 @@ func TestGetCertificate_ForceRSA(t *testing.T) {
 	}
 }
 
+func TestAdmissionFunc(t *testing.T) {
+	errDenied := errors.New("not approved")
+	var mu sync.Mutex
+	var admitted []string
+	man := &Manager{
+		Prompt: AcceptTOS,
+		AdmissionFunc: func(ctx context.Context, domain string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			admitted = append(admitted, domain)
+			if domain != exampleDomain {
+				return errDenied
+			}
+			return nil
+		},
+	}
+	defer man.stopRenew()
+
+	// A denied domain is not requested from the CA.
+	ca := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("CA request %s %s for a denied domain", r.Method, r.URL.Path)
+	}))
+	man.Client = &acme.Client{DirectoryURL: ca.URL}
+	_, err := man.GetCertificate(clientHelloInfo("typo.example.org", true))
+	ca.Close()
+	if err != errDenied {
+		t.Errorf("GetCertificate for a denied domain: err = %v; want %v", err, errDenied)
+	}
+
+	// An approved domain is issued a certificate.
+	testGetCertificate(t, man, exampleDomain, clientHelloInfo(exampleDomain, true))
+	// Admission is not asked again for a domain m holds a certificate for.
+	if _, err := man.GetCertificate(clientHelloInfo(exampleDomain, true)); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"typo.example.org", exampleDomain}; !reflect.DeepEqual(admitted, want) {
+		t.Errorf("admitted %q; want %q", admitted, want)
+	}
+}
+
 func TestGetCertificate_nilPrompt(t *testing.T) {
 	man := &Manager{}
 	defer man.stopRenew()
@@ -241,6 +465,44 @@ func TestGetCertificate_nilPrompt(t *testing.T) {
 	}
 }
 
+func TestGetCertificate_onCacheLoad(t *testing.T) {
+	var mu sync.Mutex
+	var loaded []string
+	onCacheLoad := func(domain string, cert *tls.Certificate) {
+		mu.Lock()
+		defer mu.Unlock()
+		if cert == nil || cert.Leaf == nil {
+			t.Errorf("OnCacheLoad(%q) called without a parsed certificate", domain)
+		}
+		loaded = append(loaded, domain)
+	}
+	cache := newMemCache(t)
+
+	// A fresh issuance is not a cache load.
+	man := &Manager{Prompt: AcceptTOS, Cache: cache, OnCacheLoad: onCacheLoad}
+	defer man.stopRenew()
+	testGetCertificate(t, man, exampleDomain, clientHelloInfo(exampleDomain, true))
+	mu.Lock()
+	if len(loaded) != 0 {
+		t.Errorf("OnCacheLoad called for %q after issuance", loaded)
+	}
+	mu.Unlock()
+
+	// Another Manager finds the certificate in the cache, once.
+	other := &Manager{Prompt: AcceptTOS, Cache: cache, OnCacheLoad: onCacheLoad}
+	defer other.stopRenew()
+	for i := 0; i < 2; i++ {
+		if _, err := other.GetCertificate(clientHelloInfo(exampleDomain, true)); err != nil {
+			t.Fatalf("%d: GetCertificate: %v", i, err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{exampleDomain}; !reflect.DeepEqual(loaded, want) {
+		t.Errorf("OnCacheLoad called for %q; want %q", loaded, want)
+	}
+}
+
 func TestGetCertificate_expiredCache(t *testing.T) {
 	// Make an expired cert and cache it.
 	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
@@ -273,6 +535,147 @@ func TestGetCertificate_expiredCache(t *testing.T) {
 	testGetCertificate(t, man, exampleDomain, hello)
 }
 
+func TestGetCertificate_mismatchedCacheKey(t *testing.T) {
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := dummyCert(leafKey.Public(), exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var certPEM bytes.Buffer
+	pem.Encode(&certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: pub})
+
+	for _, tt := range []struct {
+		name  string
+		cache func(*Manager) error
+	}{
+		{"mismatched key", func(man *Manager) error {
+			// The key of another cert, as left by a partial write.
+			return man.cachePut(context.Background(), exampleCertKey, &tls.Certificate{
+				Certificate: [][]byte{pub},
+				PrivateKey:  otherKey,
+			})
+		}},
+		{"corrupt key", func(man *Manager) error {
+			var buf bytes.Buffer
+			pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte("garbage")})
+			buf.Write(certPEM.Bytes())
+			return man.Cache.Put(context.Background(), exampleCertKey.String(), buf.Bytes())
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			man := &Manager{Prompt: AcceptTOS, Cache: newMemCache(t)}
+			defer man.stopRenew()
+			if err := tt.cache(man); err != nil {
+				t.Fatalf("caching the certificate: %v", err)
+			}
+			if _, err := man.cacheGet(context.Background(), exampleCertKey); err != ErrCacheMiss {
+				t.Fatalf("cacheGet: err = %v; want ErrCacheMiss", err)
+			}
+
+			// The cached cert is ignored, and a new one is issued and cached.
+			testGetCertificate(t, man, exampleDomain, clientHelloInfo(exampleDomain, true))
+			cert, err := man.cacheGet(context.Background(), exampleCertKey)
+			if err != nil {
+				t.Fatalf("cacheGet after issuance: %v", err)
+			}
+			if bytes.Equal(cert.Certificate[0], pub) {
+				t.Error("the mismatched certificate is still cached")
+			}
+		})
+	}
+}
+
+func TestGetCertificate_placeholder(t *testing.T) {
+	ca := startChainCAStub(t)
+	defer ca.Close()
+
+	// front holds the authorizations of the stub CA until release is closed.
+	release := make(chan struct{})
+	var front *httptest.Server
+	front = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		switch {
+		case r.Method == "HEAD":
+		case r.URL.Path == "/":
+			fmt.Fprintf(w, `{"new-reg": %q, "new-authz": %q, "new-cert": %q}`,
+				ca.URL+"/new-reg", front.URL+"/new-authz", ca.URL+"/new-cert")
+		case r.URL.Path == "/new-authz":
+			<-release
+			ca.Config.Handler.ServeHTTP(w, r)
+		default:
+			t.Errorf("unrecognized r.URL.Path: %s", r.URL.Path)
+		}
+	}))
+	defer front.Close()
+
+	issued := make(chan error, 1)
+	defer func() { testDidIssueInBackground = func(certKey, error) {} }()
+	testDidIssueInBackground = func(ck certKey, err error) { issued <- err }
+
+	man := &Manager{
+		Prompt:          AcceptTOS,
+		Cache:           newMemCache(t),
+		Client:          &acme.Client{DirectoryURL: front.URL},
+		PlaceholderCert: true,
+	}
+	defer man.stopRenew()
+	hello := clientHelloInfo(exampleDomain, true)
+
+	// The handshakes during the issuance get the same self-signed placeholder.
+	placeholder, err := man.GetCertificate(hello)
+	if err != nil {
+		t.Fatalf("GetCertificate during issuance: %v", err)
+	}
+	leaf := placeholder.Leaf
+	if err := leaf.CheckSignature(leaf.SignatureAlgorithm, leaf.RawTBSCertificate, leaf.Signature); err != nil {
+		t.Errorf("placeholder is not self-signed: %v", err)
+	}
+	if err := leaf.VerifyHostname(exampleDomain); err != nil {
+		t.Errorf("placeholder: %v", err)
+	}
+	if d := leaf.NotAfter.Sub(time.Now()); d > placeholderValidity {
+		t.Errorf("placeholder expires in %v; want at most %v", d, placeholderValidity)
+	}
+	if _, ok := placeholder.PrivateKey.(*ecdsa.PrivateKey); !ok {
+		t.Errorf("placeholder key is %T; want *ecdsa.PrivateKey", placeholder.PrivateKey)
+	}
+	again, err := man.GetCertificate(hello)
+	if err != nil {
+		t.Fatalf("second GetCertificate during issuance: %v", err)
+	}
+	if again != placeholder {
+		t.Error("second GetCertificate during issuance did not return the placeholder")
+	}
+
+	// Once issued, the certificate of the CA is served and cached.
+	close(release)
+	select {
+	case err := <-issued:
+		if err != nil {
+			t.Fatalf("background issuance: %v", err)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("background issuance took too long")
+	}
+	cert, err := man.GetCertificate(hello)
+	if err != nil {
+		t.Fatalf("GetCertificate after issuance: %v", err)
+	}
+	if err := cert.Leaf.CheckSignatureFrom(stubCA.intermediate); err != nil {
+		t.Errorf("certificate served after issuance is not from the CA: %v", err)
+	}
+	if _, err := man.cacheGet(context.Background(), exampleCertKey); err != nil {
+		t.Errorf("cacheGet after issuance: %v", err)
+	}
+}
+
 func TestGetCertificate_failedAttempt(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
@@ -317,6 +720,123 @@ func TestGetCertificate_failedAttempt(t *testing.T) {
 	}
 }
 
+// failingIssuance sets up the removal of the failed state of exampleCertKey
+// right after a failed GetCertificate call, and returns a Manager of a CA
+// rejecting every request along with the number of requests it received.
+func failingIssuance() (man *Manager, requests *int32, removed chan struct{}, cleanup func()) {
+	requests = new(int32)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+
+	d := createCertRetryAfter
+	f := testDidRemoveState
+	createCertRetryAfter = 0
+	removed = make(chan struct{}, 1)
+	testDidRemoveState = func(ck certKey) { removed <- struct{}{} }
+
+	man = &Manager{
+		Prompt: AcceptTOS,
+		Client: &acme.Client{DirectoryURL: ts.URL},
+	}
+	return man, requests, removed, func() {
+		man.stopRenew()
+		ts.Close()
+		createCertRetryAfter = d
+		testDidRemoveState = f
+	}
+}
+
+// failedGetCertificate calls man.GetCertificate for exampleDomain, which
+// must fail, and waits for the failed state to be removed.
+func failedGetCertificate(t *testing.T, man *Manager, removed chan struct{}) error {
+	t.Helper()
+	_, err := man.GetCertificate(clientHelloInfo(exampleDomain, true))
+	if err == nil {
+		t.Fatal("GetCertificate: err is nil")
+	}
+	select {
+	case <-removed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("took too long to remove the %q state", exampleCertKey)
+	}
+	return err
+}
+
+func TestGetCertificateMaxAttempts(t *testing.T) {
+	man, requests, removed, cleanup := failingIssuance()
+	defer cleanup()
+	man.MaxAttempts = 2
+	var gaveUp []string
+	man.OnGiveUp = func(domain string, err error) {
+		gaveUp = append(gaveUp, domain)
+		if _, ok := err.(*GiveUpError); !ok {
+			t.Errorf("OnGiveUp: err is %T, want *GiveUpError", err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		err := failedGetCertificate(t, man, removed)
+		if _, ok := err.(*GiveUpError); ok {
+			t.Fatalf("attempt %d: GetCertificate gave up: %v", i+1, err)
+		}
+	}
+	if len(gaveUp) != 1 || gaveUp[0] != exampleDomain {
+		t.Fatalf("OnGiveUp called for %q, want [%q]", gaveUp, exampleDomain)
+	}
+
+	// The budget is exhausted: the CA is no longer asked.
+	n := atomic.LoadInt32(requests)
+	_, err := man.GetCertificate(clientHelloInfo(exampleDomain, true))
+	gerr, ok := err.(*GiveUpError)
+	if !ok {
+		t.Fatalf("GetCertificate: err = %v, want a *GiveUpError", err)
+	}
+	if gerr.Domain != exampleDomain || gerr.Attempts != 2 || gerr.Err == nil {
+		t.Errorf("GiveUpError = %+v, want 2 attempts for %q and the last error", gerr, exampleDomain)
+	}
+	if got := atomic.LoadInt32(requests); got != n {
+		t.Errorf("CA received %d requests after the budget was exhausted", got-n)
+	}
+	if len(gaveUp) != 1 {
+		t.Errorf("OnGiveUp called %d times, want 1", len(gaveUp))
+	}
+
+	// ForceRenew resets the budget.
+	if err := man.ForceRenew(context.Background(), exampleDomain); err != nil {
+		t.Fatalf("ForceRenew: %v", err)
+	}
+	err = failedGetCertificate(t, man, removed)
+	if _, ok := err.(*GiveUpError); ok {
+		t.Errorf("GetCertificate after ForceRenew: %v", err)
+	}
+	if got := atomic.LoadInt32(requests); got == n {
+		t.Error("CA not asked after ForceRenew")
+	}
+}
+
+func TestGetCertificateIssuanceDeadline(t *testing.T) {
+	man, _, removed, cleanup := failingIssuance()
+	defer cleanup()
+	now := time.Now()
+	man.Now = func() time.Time { return now }
+	man.IssuanceDeadline = time.Hour
+
+	failedGetCertificate(t, man, removed)
+	now = now.Add(30 * time.Minute)
+	failedGetCertificate(t, man, removed)
+	if err := man.checkIssuanceBudget(exampleDomain); err != nil {
+		t.Fatalf("gave up before the deadline: %v", err)
+	}
+	now = now.Add(time.Hour)
+	failedGetCertificate(t, man, removed)
+	_, err := man.GetCertificate(clientHelloInfo(exampleDomain, true))
+	if gerr, ok := err.(*GiveUpError); !ok || gerr.Attempts != 3 {
+		t.Errorf("GetCertificate: err = %v, want a *GiveUpError after 3 attempts", err)
+	}
+}
+
 // testGetCertificate_tokenCache tests the fallback of token certificate fetches
 // to cache when Manager.certTokens misses. ecdsaSupport refers to the CA when
 // verifying the certificate token.
@@ -390,6 +910,63 @@ func TestGetCertificate_ecdsaVsRSA(t *testing.T) {
 	}
 }
 
+func TestGetCertificateKeyTypes(t *testing.T) {
+	tests := []struct {
+		account, cert KeyType
+		ecdsaHello    bool
+	}{
+		{account: ECDSAP256, cert: RSA2048, ecdsaHello: true},
+		{account: RSA2048, cert: ECDSAP384, ecdsaHello: true},
+		{account: ECDSAP384, cert: ECDSAP256, ecdsaHello: false},
+	}
+	for _, test := range tests {
+		man := &Manager{
+			Prompt:         AcceptTOS,
+			Cache:          newMemCache(t),
+			AccountKeyType: test.account,
+			CertKeyType:    test.cert,
+		}
+		url, finish := startACMEServerStub(t, getCertificateFromManager(man, test.ecdsaHello), exampleDomain)
+		man.Client = &acme.Client{DirectoryURL: url}
+		tlscert, err := man.GetCertificate(clientHelloInfo(exampleDomain, test.ecdsaHello))
+		if err != nil {
+			t.Fatalf("%s/%s: GetCertificate: %v", test.account, test.cert, err)
+		}
+		finish()
+		man.stopRenew()
+
+		if got := keyTypeOf(t, tlscert.Leaf.PublicKey); got != test.cert {
+			t.Errorf("%s/%s: leaf key type = %s", test.account, test.cert, got)
+		}
+		if got := keyTypeOf(t, man.client.Key.Public()); got != test.account {
+			t.Errorf("%s/%s: account key type = %s", test.account, test.cert, got)
+		}
+	}
+}
+
+// keyTypeOf returns the KeyType of pub.
+func keyTypeOf(t *testing.T, pub crypto.PublicKey) KeyType {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		return KeyType(fmt.Sprintf("ecdsa-p%d", pub.Curve.Params().BitSize))
+	case *rsa.PublicKey:
+		return KeyType(fmt.Sprintf("rsa-%d", pub.N.BitLen()))
+	}
+	t.Fatalf("unexpected public key type %T", pub)
+	return ""
+}
+
+func TestGetCertificateInvalidKeyTypes(t *testing.T) {
+	man := &Manager{Prompt: AcceptTOS, CertKeyType: "dsa-1024"}
+	if _, err := man.GetCertificate(clientHelloInfo(exampleDomain, true)); err == nil {
+		t.Error("GetCertificate with an invalid CertKeyType: err is nil")
+	}
+	man = &Manager{AccountKeyType: "ecdsa-p224"}
+	if _, err := man.accountKey(context.Background(), acme.LetsEncryptURL); err == nil {
+		t.Error("accountKey with an invalid AccountKeyType: err is nil")
+	}
+}
+
 func TestGetCertificate_wrongCacheKeyType(t *testing.T) {
 	cache := newMemCache(t)
 	man := &Manager{Prompt: AcceptTOS, Cache: cache}
@@ -589,36 +1166,264 @@ func testGetCertificate(t *testing.T, man *Manager, domain string, hello *tls.Cl
 
 }
 
-func TestVerifyHTTP01(t *testing.T) {
-	var (
-		http01 http.Handler
+func TestGetCertificateAliasDomains(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
 
-		authzCount      int // num. of created authorizations
-		didAcceptHTTP01 bool
-	)
+	alias := "www." + exampleDomain
+	man := &Manager{
+		Prompt:     AcceptTOS,
+		HostPolicy: HostWhitelist(exampleDomain, alias),
+		Client: &acme.Client{
+			DirectoryURL: ca.URL,
+		},
+		AliasDomains: func(domain string) []string {
+			if strings.HasPrefix(domain, "www.") {
+				return nil
+			}
+			return []string{"www." + domain}
+		},
+	}
+	defer man.stopRenew()
 
-	verifyHTTPToken := func() {
-		r := httptest.NewRequest("GET", "/.well-known/acme-challenge/token-http-01", nil)
-		w := httptest.NewRecorder()
-		http01.ServeHTTP(w, r)
-		if w.Code != http.StatusOK {
-			t.Errorf("http token: w.Code = %d; want %d", w.Code, http.StatusOK)
-		}
-		if v := w.Body.String(); !strings.HasPrefix(v, "token-http-01.") {
-			t.Errorf("http token value = %q; want 'token-http-01.' prefix", v)
-		}
+	cert, err := man.GetCertificate(clientHelloInfo(exampleDomain, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{exampleDomain, alias}; !reflect.DeepEqual(leaf.DNSNames, want) {
+		t.Errorf("cert.DNSNames = %q; want %q", leaf.DNSNames, want)
 	}
 
-	// ACME CA server stub, only the needed bits.
-	// TODO: Replace this with x/crypto/acme/autocert/internal/acmetest.
+	// The alias is served the same cert.
+	aliasCert, err := man.GetCertificate(clientHelloInfo(alias, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(aliasCert.Certificate[0], cert.Certificate[0]) {
+		t.Error("GetCertificate(alias) returned a different cert")
+	}
+}
+
+func TestGetCertificateAliasDomainsHostPolicy(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	man := &Manager{
+		Prompt:     AcceptTOS,
+		HostPolicy: HostWhitelist(exampleDomain),
+		Client: &acme.Client{
+			DirectoryURL: ca.URL,
+		},
+		AliasDomains: func(domain string) []string {
+			return []string{"www." + domain}
+		},
+	}
+	defer man.stopRenew()
+	if _, err := man.GetCertificate(clientHelloInfo(exampleDomain, true)); err == nil {
+		t.Error("GetCertificate: err is nil for an alias not allowed by HostPolicy")
+	}
+}
+
+// startFailingAliasCAStub is like startRenewalCAStub, except that the CA
+// fails to authorize alias or, if rejectCSR, refuses the CSRs including it,
+// listing it in the subproblems of its error.
+func startFailingAliasCAStub(t *testing.T, alias string, rejectCSR bool) *httptest.Server {
 	var ca *httptest.Server
 	ca = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Replay-Nonce", "nonce")
 		if r.Method == "HEAD" {
-			// a nonce request
 			return
 		}
-
+		switch r.URL.Path {
+		case "/":
+			if err := discoTmpl.Execute(w, ca.URL); err != nil {
+				t.Errorf("discoTmpl: %v", err)
+			}
+		case "/new-reg":
+			w.Write([]byte("{}"))
+		case "/new-authz":
+			var req struct {
+				Identifier struct{ Value string }
+			}
+			decodePayload(&req, r.Body)
+			w.Header().Set("Location", ca.URL+"/authz/1")
+			w.WriteHeader(http.StatusCreated)
+			if req.Identifier.Value == alias && !rejectCSR {
+				w.Write([]byte(`{"status": "invalid"}`))
+				return
+			}
+			w.Write([]byte(`{"status": "valid"}`))
+		case "/new-cert":
+			var req struct {
+				CSR string `json:"csr"`
+			}
+			decodePayload(&req, r.Body)
+			b, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+			csr, err := x509.ParseCertificateRequest(b)
+			if err != nil {
+				t.Errorf("new-cert: CSR: %v", err)
+				return
+			}
+			names := csr.DNSNames
+			if len(names) == 0 {
+				names = []string{csr.Subject.CommonName}
+			}
+			for _, name := range names {
+				if name == alias {
+					w.Header().Set("Content-Type", "application/problem+json")
+					w.WriteHeader(http.StatusForbidden)
+					fmt.Fprintf(w, `{
+						"type": "urn:ietf:params:acme:error:rejectedIdentifier",
+						"detail": "rejected identifiers",
+						"subproblems": [{
+							"type": "urn:ietf:params:acme:error:rejectedIdentifier",
+							"detail": "rejected",
+							"identifier": {"type": "dns", "value": %q}
+						}]
+					}`, alias)
+					return
+				}
+			}
+			der, err := stubCA.issue(csr.PublicKey, names...)
+			if err != nil {
+				t.Errorf("new-cert: issue: %v", err)
+				return
+			}
+			w.Header().Set("Link", fmt.Sprintf("<%s/ca-cert>; rel=up", ca.URL))
+			w.Header().Set("Location", ca.URL+"/cert/1")
+			w.WriteHeader(http.StatusCreated)
+			w.Write(der)
+		case "/ca-cert":
+			w.Write(stubCA.intermediate.Raw)
+		default:
+			t.Errorf("unrecognized r.URL.Path: %s", r.URL.Path)
+		}
+	}))
+	return ca
+}
+
+func TestGetCertificateDropFailedAliases(t *testing.T) {
+	alias := "www." + exampleDomain
+	tests := []struct {
+		name      string
+		rejectCSR bool
+		drop      bool
+	}{
+		{name: "authz failure", drop: true},
+		{name: "rejected", rejectCSR: true, drop: true},
+		{name: "authz failure not dropped"},
+		{name: "rejected not dropped", rejectCSR: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ca := startFailingAliasCAStub(t, alias, test.rejectCSR)
+			defer ca.Close()
+
+			var dropped []string
+			man := &Manager{
+				Prompt:     AcceptTOS,
+				HostPolicy: HostWhitelist(exampleDomain, alias),
+				Client:     &acme.Client{DirectoryURL: ca.URL},
+				AliasDomains: func(domain string) []string {
+					return []string{alias}
+				},
+				DropFailedAliases: test.drop,
+				OnAliasesDropped: func(domain string, names []string, err error) {
+					if domain != exampleDomain {
+						t.Errorf("OnAliasesDropped: domain = %q; want %q", domain, exampleDomain)
+					}
+					if err == nil {
+						t.Error("OnAliasesDropped: err is nil")
+					}
+					dropped = append(dropped, names...)
+				},
+			}
+			defer man.stopRenew()
+
+			cert, err := man.GetCertificate(clientHelloInfo(exampleDomain, true))
+			if !test.drop {
+				if err == nil {
+					t.Fatal("GetCertificate: err is nil for a failing alias")
+				}
+				if dropped != nil {
+					t.Errorf("dropped %q without DropFailedAliases", dropped)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{exampleDomain}; !reflect.DeepEqual(leaf.DNSNames, want) {
+				t.Errorf("cert.DNSNames = %q; want %q", leaf.DNSNames, want)
+			}
+			if want := []string{alias}; !reflect.DeepEqual(dropped, want) {
+				t.Errorf("dropped = %q; want %q", dropped, want)
+			}
+		})
+	}
+}
+
+func TestRejectedAliasesWrapped(t *testing.T) {
+	alias := "www." + exampleDomain
+	man := &Manager{DropFailedAliases: true}
+	rejected := &acme.Error{
+		ProblemType: "urn:ietf:params:acme:error:rejectedIdentifier",
+		Subproblems: []acme.Subproblem{{
+			ProblemType: "urn:ietf:params:acme:error:rejectedIdentifier",
+			Identifier:  acme.AuthzID{Type: "dns", Value: alias},
+		}},
+	}
+	names := []string{exampleDomain, alias}
+	for _, err := range []error{
+		rejected,
+		// As returned once FinalizeMaxWait expires.
+		fmt.Errorf("acme/autocert: certificate for %q not issued within %v: %w", exampleDomain, time.Minute, rejected),
+	} {
+		got := man.rejectedAliases(context.Background(), exampleCertKey, names, err)
+		if want := []string{alias}; !reflect.DeepEqual(got, want) {
+			t.Errorf("rejectedAliases(%v) = %q; want %q", err, got, want)
+		}
+	}
+}
+
+func TestVerifyHTTP01(t *testing.T) {
+	var (
+		http01 http.Handler
+
+		authzCount      int // num. of created authorizations
+		didAcceptHTTP01 bool
+	)
+
+	verifyHTTPToken := func() {
+		r := httptest.NewRequest("GET", "/.well-known/acme-challenge/token-http-01", nil)
+		w := httptest.NewRecorder()
+		http01.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("http token: w.Code = %d; want %d", w.Code, http.StatusOK)
+		}
+		if v := w.Body.String(); !strings.HasPrefix(v, "token-http-01.") {
+			t.Errorf("http token value = %q; want 'token-http-01.' prefix", v)
+		}
+	}
+
+	// ACME CA server stub, only the needed bits.
+	// TODO: Replace this with x/crypto/acme/autocert/internal/acmetest.
+	var ca *httptest.Server
+	ca = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		if r.Method == "HEAD" {
+			// a nonce request
+			return
+		}
+
 		switch r.URL.Path {
 		// Discovery.
 		case "/":
@@ -688,6 +1493,358 @@ func TestVerifyHTTP01(t *testing.T) {
 	}
 }
 
+// fakeDNSProvider is a DNSProvider recording the TXT records it holds.
+type fakeDNSProvider struct {
+	mu      sync.Mutex
+	records map[string]string // domain to TXT value
+	cleaned chan string       // domains passed to CleanUp
+}
+
+func (p *fakeDNSProvider) Present(ctx context.Context, domain, value string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.records == nil {
+		p.records = make(map[string]string)
+	}
+	p.records[domain] = value
+	return nil
+}
+
+func (p *fakeDNSProvider) CleanUp(ctx context.Context, domain, value string) error {
+	p.mu.Lock()
+	delete(p.records, domain)
+	p.mu.Unlock()
+	p.cleaned <- domain
+	return nil
+}
+
+// delayedResolver is a TXTResolver serving the records of a fakeDNSProvider
+// from its lookups number visibleAfter onwards, or never if visibleAfter is
+// negative.
+type delayedResolver struct {
+	p            *fakeDNSProvider
+	visibleAfter int
+
+	mu      sync.Mutex
+	lookups int
+}
+
+func (r *delayedResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	r.mu.Lock()
+	r.lookups++
+	n := r.lookups
+	r.mu.Unlock()
+	if r.visibleAfter < 0 || n < r.visibleAfter {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	r.p.mu.Lock()
+	defer r.p.mu.Unlock()
+	if v, ok := r.p.records[strings.TrimPrefix(name, "_acme-challenge.")]; ok {
+		return []string{v}, nil
+	}
+	return nil, nil
+}
+
+func (r *delayedResolver) lookupCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups
+}
+
+// startDNS01CAStub starts an ACME CA stub refusing all challenges but dns-01.
+// The accept function is called when the dns-01 challenge is accepted.
+func startDNS01CAStub(t *testing.T, accept func()) *httptest.Server {
+	var authzCount int
+	var ca *httptest.Server
+	ca = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		if r.Method == "HEAD" {
+			return
+		}
+		switch r.URL.Path {
+		case "/":
+			if err := discoTmpl.Execute(w, ca.URL); err != nil {
+				t.Errorf("discoTmpl: %v", err)
+			}
+		case "/new-reg":
+			w.Write([]byte("{}"))
+		case "/new-authz":
+			authzCount++
+			w.Header().Set("Location", fmt.Sprintf("%s/authz/%d", ca.URL, authzCount))
+			w.WriteHeader(http.StatusCreated)
+			if err := authzTmpl.Execute(w, ca.URL); err != nil {
+				t.Errorf("authzTmpl: %v", err)
+			}
+		case "/challenge/1", "/challenge/2":
+			http.Error(w, "won't accept tls-sni", http.StatusBadRequest)
+		case "/challenge/dns-01":
+			accept()
+			w.Write([]byte("{}"))
+		case "/authz/3":
+			w.Write([]byte(`{"status": "valid"}`))
+		default:
+			http.NotFound(w, r)
+			t.Errorf("unrecognized r.URL.Path: %s", r.URL.Path)
+		}
+	}))
+	return ca
+}
+
+func TestVerifyDNS01PropagationCheck(t *testing.T) {
+	dns := &fakeDNSProvider{cleaned: make(chan string, 1)}
+	resolvers := []*delayedResolver{{p: dns, visibleAfter: 3}, {p: dns, visibleAfter: 1}}
+	var accepted bool
+	ca := startDNS01CAStub(t, func() {
+		accepted = true
+		// The record must have been seen by all resolvers by now.
+		for i, r := range resolvers {
+			if n := r.lookupCount(); n < r.visibleAfter {
+				t.Errorf("resolver %d: dns-01 challenge accepted after %d lookups; want at least %d", i, n, r.visibleAfter)
+			}
+		}
+	})
+	defer ca.Close()
+
+	m := &Manager{
+		Client:      &acme.Client{DirectoryURL: ca.URL},
+		DNSProvider: dns,
+		DNSPropagationCheck: &DNSPropagationCheck{
+			Resolvers: []TXTResolver{resolvers[0], resolvers[1]},
+			Interval:  time.Millisecond,
+		},
+	}
+	ctx := context.Background()
+	client, err := m.acmeClient(ctx)
+	if err != nil {
+		t.Fatalf("m.acmeClient: %v", err)
+	}
+	if err := m.verify(ctx, client, exampleDomain); err != nil {
+		t.Fatalf("m.verify: %v", err)
+	}
+	if !accepted {
+		t.Error("did not accept dns-01 challenge")
+	}
+	// Only the resolver seeing the record last is polled repeatedly.
+	if n := resolvers[1].lookupCount(); n != 1 {
+		t.Errorf("resolver 1 was polled %d times; want 1", n)
+	}
+	select {
+	case d := <-dns.cleaned:
+		if d != exampleDomain {
+			t.Errorf("CleanUp domain = %q; want %q", d, exampleDomain)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("TXT record was not cleaned up")
+	}
+}
+
+func TestVerifyDNS01PropagationTimeout(t *testing.T) {
+	dns := &fakeDNSProvider{cleaned: make(chan string, 1)}
+	ca := startDNS01CAStub(t, func() {
+		t.Error("dns-01 challenge accepted before the TXT record was visible")
+	})
+	defer ca.Close()
+
+	m := &Manager{
+		Client:      &acme.Client{DirectoryURL: ca.URL},
+		DNSProvider: dns,
+		DNSPropagationCheck: &DNSPropagationCheck{
+			Resolvers: []TXTResolver{&delayedResolver{p: dns, visibleAfter: -1}},
+			Timeout:   50 * time.Millisecond,
+			Interval:  time.Millisecond,
+		},
+	}
+	ctx := context.Background()
+	client, err := m.acmeClient(ctx)
+	if err != nil {
+		t.Fatalf("m.acmeClient: %v", err)
+	}
+	err = m.verify(ctx, client, exampleDomain)
+	if err == nil || !strings.Contains(err.Error(), "_acme-challenge.example.org is not visible") {
+		t.Errorf("m.verify: %v; want a propagation timeout error", err)
+	}
+	select {
+	case <-dns.cleaned:
+	case <-time.After(10 * time.Second):
+		t.Error("TXT record was not cleaned up")
+	}
+}
+
+func TestVerifyResumesPendingAuthz(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		cached    string // status of the cached authorization, if any
+		wantNew   bool   // whether a new authorization is requested
+		wantAuthz string // authorization accepted
+	}{
+		{name: "resumed", cached: "pending", wantAuthz: "/authz/1"},
+		{name: "already valid", cached: "valid"},
+		{name: "abandoned", cached: "invalid", wantNew: true, wantAuthz: "/authz/2"},
+		{name: "none", wantNew: true, wantAuthz: "/authz/2"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newMemCache(t)
+			var (
+				mu       sync.Mutex
+				newAuthz bool
+				accepted string
+				inFlight []byte // pending authorization cached during the challenge
+			)
+			var ca *httptest.Server
+			ca = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Replay-Nonce", "nonce")
+				if r.Method == "HEAD" {
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				switch r.URL.Path {
+				case "/":
+					if err := discoTmpl.Execute(w, ca.URL); err != nil {
+						t.Errorf("discoTmpl: %v", err)
+					}
+				case "/new-reg":
+					w.Write([]byte("{}"))
+				case "/new-authz":
+					newAuthz = true
+					w.Header().Set("Location", ca.URL+"/authz/2")
+					w.WriteHeader(http.StatusCreated)
+					authzTmpl.Execute(w, ca.URL)
+				case "/authz/1", "/authz/2":
+					switch {
+					case accepted == r.URL.Path:
+						w.Write([]byte(`{"status": "valid"}`))
+					case r.URL.Path == "/authz/1" && tt.cached != "pending":
+						fmt.Fprintf(w, `{"status": %q}`, tt.cached)
+					default:
+						authzTmpl.Execute(w, ca.URL)
+					}
+				case "/challenge/2":
+					accepted = "/authz/1"
+					if newAuthz {
+						accepted = "/authz/2"
+					}
+					inFlight, _ = cache.Get(context.Background(), pendingAuthzCacheKey(exampleDomain))
+					w.Write([]byte("{}"))
+				default:
+					t.Errorf("unrecognized r.URL.Path: %s", r.URL.Path)
+				}
+			}))
+			defer ca.Close()
+
+			m := &Manager{Client: &acme.Client{DirectoryURL: ca.URL}, Cache: cache}
+			ctx := context.Background()
+			if tt.cached != "" {
+				// Left by a process which died while verifying.
+				data := fmt.Sprintf(`{"ca": %q, "authz": %q}`, ca.URL, ca.URL+"/authz/1")
+				cache.Put(ctx, pendingAuthzCacheKey(exampleDomain), []byte(data))
+			}
+			client, err := m.acmeClient(ctx)
+			if err != nil {
+				t.Fatalf("m.acmeClient: %v", err)
+			}
+			if err := m.verify(ctx, client, exampleDomain); err != nil {
+				t.Fatalf("m.verify: %v", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if newAuthz != tt.wantNew {
+				t.Errorf("new authorization requested = %v; want %v", newAuthz, tt.wantNew)
+			}
+			if accepted != tt.wantAuthz {
+				t.Errorf("challenge accepted for %q; want %q", accepted, tt.wantAuthz)
+			}
+			if tt.wantAuthz != "" && !strings.Contains(string(inFlight), ca.URL+tt.wantAuthz) {
+				t.Errorf("pending authorization cached during the challenge = %q; want %s", inFlight, tt.wantAuthz)
+			}
+			if _, err := cache.Get(ctx, pendingAuthzCacheKey(exampleDomain)); err != ErrCacheMiss {
+				t.Errorf("pending authorization still cached after verify: %v", err)
+			}
+		})
+	}
+}
+
+// recordingTransport is an http.RoundTripper recording the requests
+// sent through it.
+type recordingTransport struct {
+	mu   sync.Mutex
+	reqs []*http.Request
+	body map[string][]byte // request bodies by URL path
+}
+
+func (rt *recordingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	rt.reqs = append(rt.reqs, r)
+	if r.Body != nil {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			rt.mu.Unlock()
+			return nil, err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(b))
+		if rt.body == nil {
+			rt.body = make(map[string][]byte)
+		}
+		rt.body[r.URL.Path] = b
+	}
+	rt.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestUserAgentAndContact(t *testing.T) {
+	ca := startDNS01CAStub(t, func() {})
+	defer ca.Close()
+	rt := &recordingTransport{}
+	m := &Manager{
+		Client: &acme.Client{
+			DirectoryURL: ca.URL,
+			HTTPClient:   &http.Client{Transport: rt},
+			UserAgent:    "example-platform",
+		},
+		Email:       "admin@example.org",
+		Contact:     []string{"tel:+1-555-0100"},
+		UserAgent:   "myapp/1.2",
+		DNSProvider: &fakeDNSProvider{cleaned: make(chan string, 1)},
+	}
+	ctx := context.Background()
+	client, err := m.acmeClient(ctx)
+	if err != nil {
+		t.Fatalf("m.acmeClient: %v", err)
+	}
+	if err := m.verify(ctx, client, exampleDomain); err != nil {
+		t.Fatalf("m.verify: %v", err)
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if len(rt.reqs) == 0 {
+		t.Fatal("no request recorded")
+	}
+	const want = "example-platform autocert myapp/1.2 "
+	for _, r := range rt.reqs {
+		if ua := r.Header.Get("User-Agent"); !strings.HasPrefix(ua, want) {
+			t.Errorf("%s %s: User-Agent = %q; want %q prefix", r.Method, r.URL.Path, ua, want)
+		}
+	}
+
+	var jws struct{ Payload string }
+	if err := json.Unmarshal(rt.body["/new-reg"], &jws); err != nil {
+		t.Fatalf("new-reg request: %v", err)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		t.Fatalf("new-reg payload: %v", err)
+	}
+	var reg struct{ Contact []string }
+	if err := json.Unmarshal(payload, &reg); err != nil {
+		t.Fatalf("new-reg payload: %v", err)
+	}
+	if want := []string{"mailto:admin@example.org", "tel:+1-555-0100"}; !reflect.DeepEqual(reg.Contact, want) {
+		t.Errorf("registered contact = %q; want %q", reg.Contact, want)
+	}
+}
+
 func TestRevokeFailedAuthz(t *testing.T) {
 	// Prefill authorization URIs expected to be revoked.
 	// The challenges are selected in a specific order,
@@ -834,74 +1991,1264 @@ func TestHTTPHandlerDefaultFallback(t *testing.T) {
 	}
 }
 
-func TestAccountKeyCache(t *testing.T) {
-	m := Manager{Cache: newMemCache(t)}
-	ctx := context.Background()
-	k1, err := m.accountKey(ctx)
-	if err != nil {
-		t.Fatal(err)
-	}
-	k2, err := m.accountKey(ctx)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if !reflect.DeepEqual(k1, k2) {
-		t.Errorf("account keys don't match: k1 = %#v; k2 = %#v", k1, k2)
-	}
-}
+func TestChallengeHandler(t *testing.T) {
+	m := &Manager{HostPolicy: HostWhitelist("example.org")}
+	mux := http.NewServeMux()
+	mux.Handle("/.well-known/acme-challenge/", m.ChallengeHandler())
+	mux.HandleFunc("/app", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("app"))
+	})
+	m.putHTTPToken(context.Background(), "/.well-known/acme-challenge/token", "token-value")
 
-func TestCache(t *testing.T) {
+	tt := []struct {
+		url      string
+		wantCode int
+		wantBody string
+	}{
+		{"http://example.org/.well-known/acme-challenge/token", 200, "token-value"},
+		{"http://example.org/.well-known/acme-challenge/unknown", 404, ""},
+		{"http://other.org/.well-known/acme-challenge/token", 403, ""},
+		{"http://example.org/app", 200, "app"},
+		{"http://example.org/other", 404, ""},
+	}
+	for _, test := range tt {
+		r := httptest.NewRequest("GET", test.url, nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != test.wantCode {
+			t.Errorf("%s: w.Code = %d; want %d", test.url, w.Code, test.wantCode)
+		}
+		if test.wantBody != "" && w.Body.String() != test.wantBody {
+			t.Errorf("%s: body = %q; want %q", test.url, w.Body.String(), test.wantBody)
+		}
+		if v := w.Header().Get("Location"); v != "" {
+			t.Errorf("%s: redirected to %q", test.url, v)
+		}
+	}
+
+	// Requests outside of the challenge path are not answered
+	// even if the handler is mounted at the root.
+	r := httptest.NewRequest("GET", "http://example.org/foo", nil)
+	w := httptest.NewRecorder()
+	m.ChallengeHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("w.Code = %d; want %d", w.Code, http.StatusNotFound)
+	}
+	if !m.tryHTTP01 {
+		t.Error("m.tryHTTP01 is false; want true")
+	}
+}
+
+func TestServeChallengesUnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "acme.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skipf("Unix sockets not supported: %v", err)
+	}
+	m := &Manager{HostPolicy: HostWhitelist("example.org")}
+	m.putHTTPToken(context.Background(), "/.well-known/acme-challenge/token", "token-value")
+	served := make(chan error, 1)
+	go func() { served <- m.ServeChallenges(l) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sock)
+		},
+	}}
+	tt := []struct {
+		url      string
+		wantCode int
+		wantBody string
+	}{
+		{"http://example.org/.well-known/acme-challenge/token", 200, "token-value"},
+		{"http://example.org/.well-known/acme-challenge/unknown", 404, ""},
+		{"http://other.org/.well-known/acme-challenge/token", 403, ""},
+		{"http://example.org/app", 404, ""},
+	}
+	for _, test := range tt {
+		res, err := client.Get(test.url)
+		if err != nil {
+			t.Fatalf("%s: %v", test.url, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != test.wantCode {
+			t.Errorf("%s: status = %d; want %d", test.url, res.StatusCode, test.wantCode)
+		}
+		if test.wantBody != "" && string(body) != test.wantBody {
+			t.Errorf("%s: body = %q; want %q", test.url, body, test.wantBody)
+		}
+	}
+	if !m.tryHTTP01 {
+		t.Error("m.tryHTTP01 is false; want true")
+	}
+
+	client.CloseIdleConnections()
+	l.Close()
+	select {
+	case err := <-served:
+		if err == nil {
+			t.Error("ServeChallenges returned nil after the listener was closed")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("ServeChallenges did not return after the listener was closed")
+	}
+}
+
+func TestHTTP01ResponseFunc(t *testing.T) {
+	var tokens []string // tokens the function was called with
+	m := &Manager{
+		HostPolicy: HostWhitelist("example.org"),
+		HTTP01ResponseFunc: func(token string) (string, bool) {
+			tokens = append(tokens, token)
+			if token == "shared" {
+				return "shared.thumbprint", true
+			}
+			return "", false
+		},
+		HTTP01ResponseHeader: http.Header{"Cache-Control": {"no-store"}},
+	}
+	h := m.ChallengeHandler()
+	m.putHTTPToken(context.Background(), "/.well-known/acme-challenge/local", "local-value")
+
+	tt := []struct {
+		url          string
+		wantCode     int
+		wantBody     string
+		wantHeader   string // Cache-Control
+		wantConsults int    // cumulated calls of HTTP01ResponseFunc
+	}{
+		{"http://example.org/.well-known/acme-challenge/shared", 200, "shared.thumbprint", "no-store", 1},
+		{"http://example.org/.well-known/acme-challenge/local", 200, "local-value", "no-store", 2},
+		{"http://example.org/.well-known/acme-challenge/unknown", 404, "", "", 3},
+		{"http://other.org/.well-known/acme-challenge/shared", 403, "", "", 3},
+	}
+	for _, test := range tt {
+		r := httptest.NewRequest("GET", test.url, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.wantCode {
+			t.Errorf("%s: w.Code = %d; want %d", test.url, w.Code, test.wantCode)
+		}
+		if test.wantBody != "" && w.Body.String() != test.wantBody {
+			t.Errorf("%s: body = %q; want %q", test.url, w.Body.String(), test.wantBody)
+		}
+		if v := w.Header().Get("Cache-Control"); v != test.wantHeader {
+			t.Errorf("%s: Cache-Control = %q; want %q", test.url, v, test.wantHeader)
+		}
+		if len(tokens) != test.wantConsults {
+			t.Errorf("%s: HTTP01ResponseFunc called %d times; want %d", test.url, len(tokens), test.wantConsults)
+		}
+	}
+	if want := []string{"shared", "local", "unknown"}; !reflect.DeepEqual(tokens, want) {
+		t.Errorf("HTTP01ResponseFunc called with %q; want %q", tokens, want)
+	}
+}
+
+// dialSelfCheck makes the self-checks dial addr whatever the address
+// of the domain, and returns a function restoring the dialer.
+func dialSelfCheck(addr string) (restore func()) {
+	d := selfCheckDial
+	selfCheckDial = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	return func() { selfCheckDial = d }
+}
+
+func TestSelfCheckHTTP01(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &acme.Client{Key: key}
+	chal := &acme.Challenge{Type: "http-01", Token: "token1"}
+	ctx := context.Background()
+
+	m := &Manager{HostPolicy: HostWhitelist(exampleDomain)}
+	ts := httptest.NewServer(m.HTTPHandler(nil))
+	defer ts.Close()
+	defer dialSelfCheck(ts.Listener.Addr().String())()
+
+	cleanup, err := m.fulfill(ctx, client, chal, exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.selfCheckHTTP01(ctx, client, chal.Token, exampleDomain); err != nil {
+		t.Errorf("self-check of a provisioned response: %v", err)
+	}
+	cleanup()
+
+	// Another server, which does not know the token, answers for the domain,
+	// for instance because of a split-horizon DNS.
+	other := httptest.NewServer((&Manager{}).HTTPHandler(nil))
+	defer other.Close()
+	defer dialSelfCheck(other.Listener.Addr().String())()
+	cleanup, err = m.fulfill(ctx, client, chal, exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	if err := m.selfCheckHTTP01(ctx, client, chal.Token, exampleDomain); err == nil {
+		t.Error("self-check succeeded for a response served by no one")
+	}
+}
+
+func TestSelfCheckTLSALPN01(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &acme.Client{Key: key}
+	chal := &acme.Challenge{Type: "tls-alpn-01", Token: "token1"}
+	ctx := context.Background()
+
+	m := &Manager{Prompt: AcceptTOS}
+	ts := httptest.NewUnstartedServer(http.NotFoundHandler())
+	ts.TLS = m.TLSConfig()
+	ts.StartTLS()
+	defer ts.Close()
+
+	// Nothing provisioned yet.
+	defer dialSelfCheck(ts.Listener.Addr().String())()
+	if err := m.selfCheckTLSALPN01(ctx, exampleDomain); err == nil {
+		t.Error("self-check succeeded before the challenge was provisioned")
+	}
+
+	cleanup, err := m.fulfill(ctx, client, chal, exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	if err := m.selfCheckTLSALPN01(ctx, exampleDomain); err != nil {
+		t.Errorf("self-check of a provisioned certificate: %v", err)
+	}
+
+	// A server not answering acme-tls/1 handshakes, such as
+	// a TLS terminating load balancer, answers for the domain.
+	other := httptest.NewTLSServer(http.NotFoundHandler())
+	defer other.Close()
+	defer dialSelfCheck(other.Listener.Addr().String())()
+	if err := m.selfCheckTLSALPN01(ctx, exampleDomain); err == nil {
+		t.Error("self-check succeeded with another server")
+	}
+}
+
+func TestCachingHostPolicy(t *testing.T) {
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	inner := func(ctx context.Context, host string) error {
+		mu.Lock()
+		calls[host]++
+		mu.Unlock()
+		if host != "example.org" {
+			return fmt.Errorf("host %q not allowed", host)
+		}
+		return nil
+	}
+	now := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	p := CachingHostPolicy(inner, time.Minute)
+	p.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.Policy(ctx, "example.org"); err != nil {
+				t.Errorf("Policy(example.org): %v", err)
+			}
+			if err := p.Policy(ctx, "evil.example"); err == nil {
+				t.Error("Policy(evil.example) allowed the host")
+			}
+		}()
+	}
+	wg.Wait()
+	if calls["example.org"] != 1 || calls["evil.example"] != 1 {
+		t.Errorf("inner policy calls: %v; want one per host within the TTL", calls)
+	}
+
+	now = now.Add(time.Minute)
+	p.Policy(ctx, "example.org")
+	p.Policy(ctx, "evil.example")
+	if calls["example.org"] != 2 || calls["evil.example"] != 2 {
+		t.Errorf("inner policy calls: %v; want a second call per host after the TTL", calls)
+	}
+
+	p.Invalidate("example.org")
+	p.Policy(ctx, "example.org")
+	p.Policy(ctx, "evil.example")
+	if calls["example.org"] != 3 || calls["evil.example"] != 2 {
+		t.Errorf("inner policy calls: %v; want a new call for the invalidated host only", calls)
+	}
+	p.InvalidateAll()
+	p.Policy(ctx, "example.org")
+	p.Policy(ctx, "evil.example")
+	if calls["example.org"] != 4 || calls["evil.example"] != 3 {
+		t.Errorf("inner policy calls: %v; want a new call per host after InvalidateAll", calls)
+	}
+}
+
+func TestCachingHostPolicyMaxEntries(t *testing.T) {
+	var calls int
+	p := CachingHostPolicy(func(ctx context.Context, host string) error {
+		calls++
+		return nil
+	}, time.Hour)
+	p.MaxEntries = 2
+	ctx := context.Background()
+	for _, host := range []string{"a.example", "b.example", "a.example", "c.example", "a.example", "b.example"} {
+		p.Policy(ctx, host)
+	}
+	// b.example was evicted by c.example.
+	if calls != 4 {
+		t.Errorf("inner policy called %d times; want 4", calls)
+	}
+}
+
+func TestCachingHostPolicyContextError(t *testing.T) {
+	var calls int
+	p := CachingHostPolicy(func(ctx context.Context, host string) error {
+		calls++
+		return ctx.Err()
+	}, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.Policy(ctx, "example.org"); err != context.Canceled {
+		t.Errorf("Policy with a canceled context: %v; want context.Canceled", err)
+	}
+	if err := p.Policy(context.Background(), "example.org"); err != nil {
+		t.Errorf("Policy: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("inner policy called %d times; want 2, the context error is not remembered", calls)
+	}
+}
+
+func TestAccountKeyCache(t *testing.T) {
+	m := Manager{Cache: newMemCache(t)}
+	ctx := context.Background()
+	k1, err := m.accountKey(ctx, acme.LetsEncryptURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, err := m.accountKey(ctx, acme.LetsEncryptURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(k1, k2) {
+		t.Errorf("account keys don't match: k1 = %#v; k2 = %#v", k1, k2)
+	}
+}
+
+func TestAccountKeyExportImport(t *testing.T) {
+	ca := startDNS01CAStub(t, func() {})
+	defer ca.Close()
+	ctx := context.Background()
+
+	m1 := &Manager{Client: &acme.Client{DirectoryURL: ca.URL}, Cache: newMemCache(t)}
+	if _, err := m1.ExportAccountKey(); err != ErrCacheMiss {
+		t.Errorf("ExportAccountKey before registration: %v; want ErrCacheMiss", err)
+	}
+	client1, err := m1.acmeClient(ctx)
+	if err != nil {
+		t.Fatalf("m1.acmeClient: %v", err)
+	}
+	key, err := m1.ExportAccountKey()
+	if err != nil {
+		t.Fatalf("ExportAccountKey: %v", err)
+	}
+	if !reflect.DeepEqual(key, client1.Key) {
+		t.Fatal("exported key is not the account key in use")
+	}
+
+	// A new host, with a cached certificate of its own.
+	cache := newMemCache(t)
+	certData := []byte("cert data")
+	if err := cache.Put(ctx, exampleDomain, certData); err != nil {
+		t.Fatal(err)
+	}
+	m2 := &Manager{Client: &acme.Client{DirectoryURL: ca.URL}, Cache: cache}
+	if err := m2.ImportAccountKey(key); err != nil {
+		t.Fatalf("ImportAccountKey: %v", err)
+	}
+	if data, err := cache.Get(ctx, exampleDomain); err != nil || !bytes.Equal(data, certData) {
+		t.Errorf("cached cert = %q, %v; want %q", data, err, certData)
+	}
+	client2, err := m2.acmeClient(ctx)
+	if err != nil {
+		t.Fatalf("m2.acmeClient: %v", err)
+	}
+	if !reflect.DeepEqual(client2.Key, key) {
+		t.Error("imported key is not used for the account")
+	}
+	if err := m2.ImportAccountKey(key); err == nil {
+		t.Error("ImportAccountKey succeeded after registration")
+	}
+
+	// RSA keys are supported too, and parsed back from the cache.
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m3 := &Manager{Cache: newMemCache(t)}
+	if err := m3.ImportAccountKey(rsaKey); err != nil {
+		t.Fatalf("ImportAccountKey(RSA): %v", err)
+	}
+	got, err := m3.ExportAccountKey()
+	if err != nil {
+		t.Fatalf("ExportAccountKey: %v", err)
+	}
+	if !rsaKey.Equal(got) {
+		t.Error("exported RSA key does not match the imported one")
+	}
+}
+
+func TestAccountKeyPerDirectory(t *testing.T) {
+	ca1 := startRenewalCAStub(t)
+	defer ca1.Close()
+	ca2 := startRenewalCAStub(t)
+	defer ca2.Close()
+
+	cache := newMemCache(t)
+	ctx := context.Background()
+	clientKey := func(dirURL string) crypto.Signer {
+		m := &Manager{Prompt: AcceptTOS, Cache: cache, Client: &acme.Client{DirectoryURL: dirURL}}
+		client, err := m.acmeClient(ctx)
+		if err != nil {
+			t.Fatalf("acmeClient(%s): %v", dirURL, err)
+		}
+		return client.Key
+	}
+
+	k1 := clientKey(ca1.URL)
+	k2 := clientKey(ca2.URL)
+	if reflect.DeepEqual(k1, k2) {
+		t.Error("directories share the same account key")
+	}
+	for _, u := range []string{ca1.URL, ca2.URL} {
+		if _, err := cache.Get(ctx, accountKeyCacheKey(u)); err != nil {
+			t.Errorf("account key for %s: %v", u, err)
+		}
+	}
+
+	// New Managers reuse the stored keys.
+	if k := clientKey(ca1.URL); !reflect.DeepEqual(k, k1) {
+		t.Errorf("%s: account key not reused", ca1.URL)
+	}
+	if k := clientKey(ca2.URL); !reflect.DeepEqual(k, k2) {
+		t.Errorf("%s: account key not reused", ca2.URL)
+	}
+}
+
+func TestAccountKeyLegacyMigration(t *testing.T) {
+	cache := newMemCache(t)
+	ctx := context.Background()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := encodeECDSAKey(&buf, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Put(ctx, "acme_account+key", buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Manager{Cache: cache}
+	k, err := m.accountKey(ctx, acme.LetsEncryptURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(k, key) {
+		t.Error("legacy account key not used")
+	}
+	if _, err := cache.Get(ctx, accountKeyCacheKey(acme.LetsEncryptURL)); err != nil {
+		t.Errorf("legacy account key not migrated: %v", err)
+	}
+
+	// The other directories get keys of their own,
+	// including with a new Manager sharing the cache.
+	for _, m := range []*Manager{m, {Cache: cache}} {
+		k, err := m.accountKey(ctx, "https://ca.example/dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reflect.DeepEqual(k, key) {
+			t.Error("legacy account key migrated to a second directory")
+		}
+	}
+	if k, err := (&Manager{Cache: cache}).accountKey(ctx, acme.LetsEncryptURL); err != nil || !reflect.DeepEqual(k, key) {
+		t.Errorf("migrated account key not reused: %v", err)
+	}
+}
+
+func TestAccountKeySealer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autocert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sealer, err := AESKeySealer(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	m := &Manager{Cache: DirCache(dir), AccountKeySealer: sealer}
+	defer m.stopRenew()
+	key, err := m.accountKey(ctx, acme.LetsEncryptURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := dummyCert(certKey.Public(), exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlscert := &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: certKey}
+	if err := m.cachePut(ctx, exampleCertKey, tlscert); err != nil {
+		t.Fatal(err)
+	}
+
+	// On disk, the account key is sealed but not the certificate.
+	data, err := ioutil.ReadFile(filepath.Join(dir, accountKeyCacheKey(acme.LetsEncryptURL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isPEMKey(data) || bytes.Contains(data, []byte("PRIVATE KEY")) {
+		t.Error("account key stored unencrypted")
+	}
+	data, err = ioutil.ReadFile(filepath.Join(dir, exampleCertKey.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isPEMKey(data) {
+		t.Error("certificate entry not stored as PEM")
+	}
+
+	// The sealed key is read back.
+	m2 := &Manager{Cache: DirCache(dir), AccountKeySealer: sealer}
+	k, err := m2.accountKey(ctx, acme.LetsEncryptURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(k, key) {
+		t.Error("sealed account key not used")
+	}
+	if k, err := m2.ExportAccountKey(); err != nil || !reflect.DeepEqual(k, key) {
+		t.Errorf("ExportAccountKey: %v; want the sealed account key", err)
+	}
+
+	// But not without the sealer, nor with another one.
+	if _, err := (&Manager{Cache: DirCache(dir)}).accountKey(ctx, acme.LetsEncryptURL); err == nil {
+		t.Error("sealed account key read without the sealer")
+	}
+	other, err := AESKeySealer(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&Manager{Cache: DirCache(dir), AccountKeySealer: other}).accountKey(ctx, acme.LetsEncryptURL); err == nil {
+		t.Error("sealed account key opened with another key")
+	}
+}
+
+func TestAccountKeySealerMigration(t *testing.T) {
+	cache := newMemCache(t)
+	ctx := context.Background()
+	key, err := (&Manager{Cache: cache}).accountKey(ctx, acme.LetsEncryptURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealer, err := AESKeySealer(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Manager{Cache: cache, AccountKeySealer: sealer}
+	k, err := m.accountKey(ctx, acme.LetsEncryptURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(k, key) {
+		t.Error("unsealed account key not used")
+	}
+	name := accountKeyCacheKey(acme.LetsEncryptURL)
+	data, err := cache.Get(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isPEMKey(data) {
+		t.Error("unsealed account key not sealed on first use")
+	}
+	if _, err := sealer.Open(ctx, name, data); err != nil {
+		t.Errorf("Open: %v", err)
+	}
+	// The entry is bound to its name.
+	if _, err := sealer.Open(ctx, accountKeyCacheKey("https://ca.example/dir"), data); err == nil {
+		t.Error("sealed account key opened under another name")
+	}
+}
+
+func TestAccountKeyHook(t *testing.T) {
+	key1, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := newMemCache(t)
+	m := &Manager{
+		Cache: cache,
+		AccountKey: func(dirURL string) crypto.Signer {
+			if dirURL == "https://ca1.example/dir" {
+				return key1
+			}
+			return nil
+		},
+	}
+	ctx := context.Background()
+	k, err := m.accountKey(ctx, "https://ca1.example/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k != crypto.Signer(key1) {
+		t.Error("AccountKey result not used")
+	}
+	if _, err := cache.Get(ctx, accountKeyCacheKey("https://ca1.example/dir")); err != ErrCacheMiss {
+		t.Errorf("hook-provided key stored in cache: %v", err)
+	}
+
+	// A nil result falls back to the cache.
+	k, err = m.accountKey(ctx, "https://ca2.example/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k == crypto.Signer(key1) {
+		t.Error("got AccountKey result for another directory")
+	}
+	if _, err := cache.Get(ctx, accountKeyCacheKey("https://ca2.example/dir")); err != nil {
+		t.Errorf("generated key not stored in cache: %v", err)
+	}
+}
+
+func TestCache(t *testing.T) {
 	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		t.Fatal(err)
 	}
-	cert, err := dummyCert(ecdsaKey.Public(), exampleDomain)
+	cert, err := dummyCert(ecdsaKey.Public(), exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaCert := &tls.Certificate{
+		Certificate: [][]byte{cert},
+		PrivateKey:  ecdsaKey,
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = dummyCert(rsaKey.Public(), exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaCert := &tls.Certificate{
+		Certificate: [][]byte{cert},
+		PrivateKey:  rsaKey,
+	}
+
+	man := &Manager{Cache: newMemCache(t)}
+	defer man.stopRenew()
+	ctx := context.Background()
+
+	if err := man.cachePut(ctx, exampleCertKey, ecdsaCert); err != nil {
+		t.Fatalf("man.cachePut: %v", err)
+	}
+	if err := man.cachePut(ctx, exampleCertKeyRSA, rsaCert); err != nil {
+		t.Fatalf("man.cachePut: %v", err)
+	}
+
+	res, err := man.cacheGet(ctx, exampleCertKey)
+	if err != nil {
+		t.Fatalf("man.cacheGet: %v", err)
+	}
+	if res == nil || !bytes.Equal(res.Certificate[0], ecdsaCert.Certificate[0]) {
+		t.Errorf("man.cacheGet = %+v; want %+v", res, ecdsaCert)
+	}
+
+	res, err = man.cacheGet(ctx, exampleCertKeyRSA)
+	if err != nil {
+		t.Fatalf("man.cacheGet: %v", err)
+	}
+	if res == nil || !bytes.Equal(res.Certificate[0], rsaCert.Certificate[0]) {
+		t.Errorf("man.cacheGet = %+v; want %+v", res, rsaCert)
+	}
+}
+
+func newTestTLSCert(t testing.TB, notAfter time.Time) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := dateDummyCert(key.Public(), time.Now().Add(-time.Hour), notAfter, exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestChallengeCache(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := dummyCert(key.Public(), exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+
+	certs := newMemCache(t)
+	challenges := newMemCache(t)
+	man := &Manager{Cache: certs, ChallengeCache: challenges}
+	defer man.stopRenew()
+	ctx := context.Background()
+
+	// challenge data
+	man.putHTTPToken(ctx, "/.well-known/acme-challenge/token", "value")
+	man.putCertToken(ctx, exampleDomain, cert)
+	tokenKey := certKey{domain: exampleDomain, isToken: true}
+	for _, k := range []string{httpTokenCacheKey("/.well-known/acme-challenge/token"), tokenKey.String()} {
+		if _, err := challenges.Get(ctx, k); err != nil {
+			t.Errorf("challenge cache Get(%q): %v", k, err)
+		}
+		if _, err := certs.Get(ctx, k); err != ErrCacheMiss {
+			t.Errorf("cert cache Get(%q): %v; want ErrCacheMiss", k, err)
+		}
+	}
+	// Another Manager sharing the challenge cache serves the tokens.
+	other := &Manager{Cache: newMemCache(t), ChallengeCache: challenges}
+	if v, err := other.httpToken(ctx, "/.well-known/acme-challenge/token"); err != nil || string(v) != "value" {
+		t.Errorf("other.httpToken = %q, %v; want %q", v, err, "value")
+	}
+	if _, err := other.cacheGet(ctx, tokenKey); err != nil {
+		t.Errorf("other.cacheGet(token): %v", err)
+	}
+	man.deleteHTTPToken("/.well-known/acme-challenge/token")
+	man.deleteCertToken(exampleDomain)
+	if n := len(challenges.keyData); n != 0 {
+		t.Errorf("challenge cache has %d entries after deletion; want 0", n)
+	}
+
+	// certificates
+	if err := man.cachePut(ctx, exampleCertKey, cert); err != nil {
+		t.Fatalf("man.cachePut: %v", err)
+	}
+	if _, err := certs.Get(ctx, exampleCertKey.String()); err != nil {
+		t.Errorf("cert cache Get: %v", err)
+	}
+	if _, err := challenges.Get(ctx, exampleCertKey.String()); err != ErrCacheMiss {
+		t.Errorf("challenge cache Get: %v; want ErrCacheMiss", err)
+	}
+	if _, err := man.cacheGet(ctx, exampleCertKey); err != nil {
+		t.Errorf("man.cacheGet: %v", err)
+	}
+}
+
+func TestOnIssued(t *testing.T) {
+	ca := startChainCAStub(t)
+	defer ca.Close()
+
+	type issued struct {
+		domain string
+		chain  [][]byte
+	}
+	var (
+		mu    sync.Mutex
+		calls []issued
+	)
+	man := &Manager{
+		Prompt:     AcceptTOS,
+		HostPolicy: HostWhitelist(exampleDomain),
+		Cache:      newMemCache(t),
+		Client:     &acme.Client{DirectoryURL: ca.URL},
+		OnIssued: func(ctx context.Context, domain string, chain [][]byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			calls = append(calls, issued{domain, chain})
+			return errors.New("CT log unavailable")
+		},
+	}
+	defer man.stopRenew()
+	cert, err := man.GetCertificate(clientHelloInfo(exampleDomain, true))
+	if err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	mu.Lock()
+	if len(calls) != 1 {
+		t.Fatalf("OnIssued called %d times; want 1", len(calls))
+	}
+	got := calls[0]
+	mu.Unlock()
+	if got.domain != exampleDomain {
+		t.Errorf("OnIssued domain = %q; want %q", got.domain, exampleDomain)
+	}
+	if want := [][]byte{cert.Certificate[0], stubCA.intermediate.Raw}; !reflect.DeepEqual(got.chain, want) {
+		t.Errorf("OnIssued got a chain of %d certificates; want the leaf and the intermediate", len(got.chain))
+	}
+
+	// The error of the hook did not prevent caching.
+	cached, err := man.cacheGet(context.Background(), exampleCertKey)
+	if err != nil {
+		t.Fatalf("cacheGet: %v", err)
+	}
+	if !bytes.Equal(cached.Certificate[0], cert.Certificate[0]) {
+		t.Error("the cached certificate is not the issued one")
+	}
+
+	// Renewals are reported too.
+	dr := waitRenewal(t, man, exampleCertKey)
+	dr.timerMu.Lock()
+	_, err = dr.issue(context.Background(), false)
+	dr.timerMu.Unlock()
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(calls) != 2 || len(calls[1].chain) != 2 {
+		t.Errorf("OnIssued calls = %d, want 2 with the renewed chain", len(calls))
+	}
+}
+
+func TestRootCAs(t *testing.T) {
+	ca := newRenewalCAStub(t)
+	ca.StartTLS()
+	defer ca.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Certificate())
+
+	man := &Manager{
+		Prompt:       AcceptTOS,
+		HostPolicy:   HostWhitelist(exampleDomain),
+		DirectoryURL: ca.URL,
+		RootCAs:      roots,
+	}
+	defer man.stopRenew()
+	hello := clientHelloInfo(exampleDomain, true)
+	if _, err := man.GetCertificate(hello); err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	if man.directoryURL() != ca.URL {
+		t.Errorf("directoryURL() = %q; want %q", man.directoryURL(), ca.URL)
+	}
+
+	// Without RootCAs, the private root is not trusted.
+	man = &Manager{
+		Prompt:       AcceptTOS,
+		HostPolicy:   HostWhitelist(exampleDomain),
+		DirectoryURL: ca.URL,
+	}
+	defer man.stopRenew()
+	_, err := man.GetCertificate(hello)
+	var uerr x509.UnknownAuthorityError
+	if !errors.As(err, &uerr) {
+		t.Errorf("GetCertificate without RootCAs: err = %v; want an x509.UnknownAuthorityError", err)
+	}
+
+	// RootCAs cannot apply to an HTTPClient of the caller.
+	man = &Manager{
+		Prompt:     AcceptTOS,
+		HostPolicy: HostWhitelist(exampleDomain),
+		Client:     &acme.Client{DirectoryURL: ca.URL, HTTPClient: ca.Client()},
+		RootCAs:    roots,
+	}
+	defer man.stopRenew()
+	if _, err := man.GetCertificate(hello); err == nil || !strings.Contains(err.Error(), "RootCAs") {
+		t.Errorf("GetCertificate with RootCAs and Client.HTTPClient: err = %v; want a RootCAs error", err)
+	}
+}
+
+func TestChallengeCacheByType(t *testing.T) {
+	now := time.Now()
+	cert := newTestTLSCert(t, now.Add(time.Hour))
+	certs := &MemoryCache{}
+	challenges := &MemoryCache{}
+	httpTokens := &MemoryCache{}
+	certTokens := &MemoryCache{}
+	man := &Manager{
+		Cache:          certs,
+		ChallengeCache: challenges,
+		HTTP01Cache:    httpTokens,
+		TLSALPN01Cache: certTokens,
+		ChallengeTTL:   10 * time.Minute,
+		Now:            func() time.Time { return now },
+	}
+	defer man.stopRenew()
+	ctx := context.Background()
+
+	man.putHTTPToken(ctx, "/.well-known/acme-challenge/token", "value")
+	man.putCertToken(ctx, exampleDomain, cert)
+	httpKey := httpTokenCacheKey("/.well-known/acme-challenge/token")
+	tokenKey := certKey{domain: exampleDomain, isToken: true}.String()
+	for _, c := range []struct {
+		name  string
+		cache *MemoryCache
+		want  []string
+	}{
+		{"HTTP01Cache", httpTokens, []string{httpKey, httpKey + challengeExpirySuffix}},
+		{"TLSALPN01Cache", certTokens, []string{tokenKey, tokenKey + challengeExpirySuffix}},
+		{"ChallengeCache", challenges, nil},
+		{"Cache", certs, nil},
+	} {
+		keys, _ := c.cache.List(ctx)
+		sort.Strings(keys)
+		if len(keys) != len(c.want) || len(keys) > 0 && !reflect.DeepEqual(keys, c.want) {
+			t.Errorf("%s keys = %q; want %q", c.name, keys, c.want)
+		}
+	}
+
+	// Another Manager configured alike serves the tokens.
+	other := &Manager{
+		Cache:          &MemoryCache{},
+		HTTP01Cache:    httpTokens,
+		TLSALPN01Cache: certTokens,
+		Now:            man.Now,
+	}
+	if v, err := other.httpToken(ctx, "/.well-known/acme-challenge/token"); err != nil || string(v) != "value" {
+		t.Errorf("other.httpToken = %q, %v; want %q", v, err, "value")
+	}
+	if _, err := other.cacheGet(ctx, certKey{domain: exampleDomain, isToken: true}); err != nil {
+		t.Errorf("other.cacheGet(token): %v", err)
+	}
+
+	// The data left behind is swept from both caches.
+	now = now.Add(10 * time.Minute)
+	man.sweepChallenges(ctx)
+	for name, c := range map[string]*MemoryCache{"HTTP01Cache": httpTokens, "TLSALPN01Cache": certTokens} {
+		if keys, _ := c.List(ctx); len(keys) != 0 {
+			t.Errorf("%s keys after the TTL: %q; want none", name, keys)
+		}
+	}
+}
+
+func TestMemCacheLayer(t *testing.T) {
+	cache := newMemCache(t)
+	man := &Manager{Cache: cache, MemCacheSize: 1}
+	defer man.stopRenew()
+	ctx := context.Background()
+
+	cert := newTestTLSCert(t, time.Now().Add(24*time.Hour))
+	if err := man.cachePut(ctx, exampleCertKey, cert); err != nil {
+		t.Fatalf("man.cachePut: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		res, err := man.cacheGet(ctx, exampleCertKey)
+		if err != nil {
+			t.Fatalf("man.cacheGet: %v", err)
+		}
+		if !bytes.Equal(res.Certificate[0], cert.Certificate[0]) {
+			t.Errorf("%d: man.cacheGet returned a different cert", i)
+		}
+	}
+	if n := cache.numGets(); n != 0 {
+		t.Errorf("cache.Get called %d times; want 0", n)
+	}
+
+	// The RSA entry evicts the ECDSA one.
+	rsaCert := newTestTLSCert(t, time.Now().Add(24*time.Hour))
+	if err := man.cachePut(ctx, exampleCertKeyRSA, rsaCert); err != nil {
+		t.Fatalf("man.cachePut: %v", err)
+	}
+	if _, ok := man.certLRU().get(exampleCertKey); ok {
+		t.Errorf("%v is still in the memory cache", exampleCertKey)
+	}
+}
+
+func TestMemCacheLayerInvalidatedOnRenewal(t *testing.T) {
+	cache := newMemCache(t)
+	man := &Manager{
+		Cache:        cache,
+		MemCacheSize: 10,
+		RenewBefore:  24 * time.Hour,
+		Client:       &acme.Client{DirectoryURL: "invalid"},
+		state:        make(map[certKey]*certState),
+	}
+	defer man.stopRenew()
+	ctx := context.Background()
+
+	oldCert := newTestTLSCert(t, time.Now().Add(time.Minute))
+	if err := man.cachePut(ctx, exampleCertKey, oldCert); err != nil {
+		t.Fatalf("man.cachePut: %v", err)
+	}
+
+	// Simulate another Manager renewing the cert in the shared Cache.
+	other := &Manager{Cache: cache}
+	newCert := newTestTLSCert(t, time.Now().Add(90*24*time.Hour))
+	if err := other.cachePut(ctx, exampleCertKey, newCert); err != nil {
+		t.Fatalf("other.cachePut: %v", err)
+	}
+
+	dr := &domainRenewal{m: man, ck: exampleCertKey, key: oldCert.PrivateKey.(crypto.Signer)}
+	if _, err := dr.do(ctx); err != nil {
+		t.Fatalf("dr.do: %v", err)
+	}
+	res, err := man.cacheGet(ctx, exampleCertKey)
+	if err != nil {
+		t.Fatalf("man.cacheGet: %v", err)
+	}
+	if !bytes.Equal(res.Certificate[0], newCert.Certificate[0]) {
+		t.Error("memory cache still holds the cert replaced by renewal")
+	}
+}
+
+func BenchmarkCacheGet(b *testing.B) {
+	for _, size := range []int{0, 100} {
+		b.Run(fmt.Sprintf("MemCacheSize=%d", size), func(b *testing.B) {
+			cache := &memCache{keyData: make(map[string][]byte)}
+			man := &Manager{Cache: cache, MemCacheSize: size}
+			defer man.stopRenew()
+			ctx := context.Background()
+			if err := man.cachePut(ctx, exampleCertKey, newTestTLSCert(b, time.Now().Add(24*time.Hour))); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := man.cacheGet(ctx, exampleCertKey); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(cache.numGets())/float64(b.N), "backend-gets/op")
+		})
+	}
+}
+
+// newTestCA returns a self-signed CA certificate named cn and its key.
+func newTestCA(t *testing.T, cn string) (*x509.Certificate, crypto.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
 	if err != nil {
 		t.Fatal(err)
 	}
-	ecdsaCert := &tls.Certificate{
-		Certificate: [][]byte{cert},
-		PrivateKey:  ecdsaKey,
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
 	}
+	return ca, key
+}
 
-	rsaKey, err := rsa.GenerateKey(rand.Reader, 512)
+// newTestIssuedState returns a certState for domain whose cert is issued by ca.
+func newTestIssuedState(t *testing.T, ca *x509.Certificate, caKey crypto.Signer, domain string, eku ...x509.ExtKeyUsage) *certState {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		t.Fatal(err)
 	}
-	cert, err = dummyCert(rsaKey.Public(), exampleDomain)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  eku,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, key.Public(), caKey)
 	if err != nil {
 		t.Fatal(err)
 	}
-	rsaCert := &tls.Certificate{
-		Certificate: [][]byte{cert},
-		PrivateKey:  rsaKey,
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
 	}
+	return &certState{key: key, cert: [][]byte{der, ca.Raw}, leaf: leaf}
+}
 
-	man := &Manager{Cache: newMemCache(t)}
-	defer man.stopRenew()
-	ctx := context.Background()
+// startOCSPResponder starts an OCSP responder answering for the certs
+// issued by ca, or failing all requests if fail is set. The number of
+// requests it received is counted in hits.
+func startOCSPResponder(t *testing.T, ca *x509.Certificate, caKey crypto.Signer, fail bool, hits *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		if fail {
+			http.Error(w, "responder down", http.StatusServiceUnavailable)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("OCSP request: %v", err)
+			return
+		}
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			t.Errorf("OCSP request: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		resp, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   now.Add(-time.Minute),
+			NextUpdate:   now.Add(time.Hour),
+		}, caKey)
+		if err != nil {
+			t.Errorf("ocsp.CreateResponse: %v", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(resp)
+	}))
+}
 
-	if err := man.cachePut(ctx, exampleCertKey, ecdsaCert); err != nil {
-		t.Fatalf("man.cachePut: %v", err)
+func TestOCSPStaplingFailover(t *testing.T) {
+	ca, caKey := newTestCA(t, "ca")
+	var primaryHits, secondaryHits int32
+	primary := startOCSPResponder(t, ca, caKey, true, &primaryHits)
+	defer primary.Close()
+	secondary := startOCSPResponder(t, ca, caKey, false, &secondaryHits)
+	defer secondary.Close()
+
+	man := &Manager{Prompt: AcceptTOS, OCSPStapling: true, state: make(map[certKey]*certState)}
+	for i, domain := range []string{"a.example.org", "b.example.org"} {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(10 + i)),
+			Subject:      pkix.Name{CommonName: domain},
+			DNSNames:     []string{domain},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+			OCSPServer:   []string{primary.URL, secondary.URL},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, key.Public(), caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		man.state[certKey{domain: domain}] = &certState{key: key, cert: [][]byte{der, ca.Raw}, leaf: leaf}
 	}
-	if err := man.cachePut(ctx, exampleCertKeyRSA, rsaCert); err != nil {
-		t.Fatalf("man.cachePut: %v", err)
+
+	for i, domain := range []string{"a.example.org", "a.example.org", "b.example.org"} {
+		cert, err := man.GetCertificate(clientHelloInfo(domain, true))
+		if err != nil {
+			t.Fatalf("GetCertificate(%q): %v", domain, err)
+		}
+		if cert.OCSPStaple == nil {
+			t.Fatalf("%d: no OCSP staple for %q", i, domain)
+		}
+		resp, err := ocsp.ParseResponseForCert(cert.OCSPStaple, cert.Leaf, ca)
+		if err != nil {
+			t.Fatalf("%d: stapled response: %v", i, err)
+		}
+		if resp.Status != ocsp.Good {
+			t.Errorf("%d: stapled status = %d; want Good", i, resp.Status)
+		}
+	}
+	// The primary responder failed once and was skipped afterwards,
+	// and the staple of a.example.org was fetched only once.
+	if n := atomic.LoadInt32(&primaryHits); n != 1 {
+		t.Errorf("primary responder got %d requests; want 1", n)
+	}
+	if n := atomic.LoadInt32(&secondaryHits); n != 2 {
+		t.Errorf("secondary responder got %d requests; want 2", n)
 	}
 
-	res, err := man.cacheGet(ctx, exampleCertKey)
+	// Without stapling, no response is fetched.
+	man.OCSPStapling = false
+	cert, err := man.GetCertificate(clientHelloInfo("a.example.org", true))
 	if err != nil {
-		t.Fatalf("man.cacheGet: %v", err)
+		t.Fatal(err)
 	}
-	if res == nil || !bytes.Equal(res.Certificate[0], ecdsaCert.Certificate[0]) {
-		t.Errorf("man.cacheGet = %+v; want %+v", res, ecdsaCert)
+	if cert.OCSPStaple != nil {
+		t.Error("OCSP staple served with OCSPStapling unset")
 	}
+}
 
-	res, err = man.cacheGet(ctx, exampleCertKeyRSA)
-	if err != nil {
-		t.Fatalf("man.cacheGet: %v", err)
+func TestGetClientCertificate(t *testing.T) {
+	ca1, ca1Key := newTestCA(t, "ca1")
+	ca2, ca2Key := newTestCA(t, "ca2")
+	ca3, ca3Key := newTestCA(t, "ca3")
+	man := &Manager{
+		state: map[certKey]*certState{
+			{domain: "a.example.org"}: newTestIssuedState(t, ca1, ca1Key, "a.example.org", x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth),
+			{domain: "b.example.org"}: newTestIssuedState(t, ca2, ca2Key, "b.example.org", x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth),
+			// Not usable for client authentication.
+			{domain: "c.example.org"}: newTestIssuedState(t, ca3, ca3Key, "c.example.org", x509.ExtKeyUsageServerAuth),
+		},
 	}
-	if res == nil || !bytes.Equal(res.Certificate[0], rsaCert.Certificate[0]) {
-		t.Errorf("man.cacheGet = %+v; want %+v", res, rsaCert)
+	defer man.stopRenew()
+
+	tt := []struct {
+		cas  [][]byte
+		want string // leaf CommonName; empty means no cert
+	}{
+		{[][]byte{ca1.RawSubject}, "a.example.org"},
+		{[][]byte{ca2.RawSubject}, "b.example.org"},
+		{[][]byte{ca3.RawSubject, ca2.RawSubject}, "b.example.org"},
+		{[][]byte{ca3.RawSubject}, ""},
+		{nil, "a.example.org"},
+	}
+	for i, test := range tt {
+		cert, err := man.GetClientCertificate(&tls.CertificateRequestInfo{AcceptableCAs: test.cas})
+		if err != nil {
+			t.Fatalf("%d: GetClientCertificate: %v", i, err)
+		}
+		if cert == nil {
+			t.Fatalf("%d: GetClientCertificate returned nil cert", i)
+		}
+		var got string
+		if len(cert.Certificate) > 0 {
+			got = cert.Leaf.Subject.CommonName
+		}
+		if got != test.want {
+			t.Errorf("%d: got cert for %q; want %q", i, got, test.want)
+		}
+	}
+
+	// A state locked for its issuance is skipped rather than waited for.
+	locked := man.state[certKey{domain: "a.example.org"}]
+	locked.Lock()
+	defer locked.Unlock()
+	done := make(chan string, 1)
+	go func() {
+		cert, err := man.GetClientCertificate(&tls.CertificateRequestInfo{})
+		if err != nil || len(cert.Certificate) == 0 {
+			done <- fmt.Sprintf("GetClientCertificate: %v, %v", cert, err)
+			return
+		}
+		done <- cert.Leaf.Subject.CommonName
+	}()
+	select {
+	case got := <-done:
+		if got != "b.example.org" {
+			t.Errorf("with a.example.org locked: got cert for %q; want %q", got, "b.example.org")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("GetClientCertificate waits for a locked state")
 	}
 }
 
@@ -1033,6 +3380,9 @@ func TestManagerGetCertificateBogusSNI(t *testing.T) {
 		{".foo", "acme/autocert: server name component count invalid"},
 		{"foo.", "acme/autocert: server name component count invalid"},
 		{"fo.o", "cache.Get of fo.o"},
+		{testOnion, "cache.Get of " + testOnion},
+		{"www." + testOnion, "cache.Get of www." + testOnion},
+		{"foo.onion", "acme/autocert: onion address is not a version 3 address"},
 	}
 	for _, tt := range tests {
 		_, err := m.GetCertificate(clientHelloInfo(tt.name, true))
@@ -1043,6 +3393,269 @@ func TestManagerGetCertificateBogusSNI(t *testing.T) {
 	}
 }
 
+func TestManagerGetCertificateDefaultServerName(t *testing.T) {
+	m := Manager{
+		Prompt: AcceptTOS,
+		Cache: cacheGetFunc(func(ctx context.Context, key string) ([]byte, error) {
+			return nil, fmt.Errorf("cache.Get of %s", key)
+		}),
+		DefaultServerName: "example.org",
+	}
+	tests := []struct {
+		sni     string
+		wantErr string
+	}{
+		{"", "cache.Get of example.org"},
+		{"other.example.org", "cache.Get of other.example.org"},
+	}
+	for _, tt := range tests {
+		_, err := m.GetCertificate(clientHelloInfo(tt.sni, true))
+		if got := fmt.Sprint(err); got != tt.wantErr {
+			t.Errorf("GetCertificate(SNI = %q) = %q; want %q", tt.sni, got, tt.wantErr)
+		}
+	}
+
+	// The default name is subject to HostPolicy.
+	m = Manager{
+		Prompt:            AcceptTOS,
+		HostPolicy:        HostWhitelist("example.com"),
+		DefaultServerName: "example.org",
+	}
+	if _, err := m.GetCertificate(clientHelloInfo("", true)); err == nil || !strings.Contains(err.Error(), `"example.org" not configured`) {
+		t.Errorf("GetCertificate without SNI: %v; want a host policy error", err)
+	}
+	m.DefaultServerName = ""
+	if _, err := m.GetCertificate(clientHelloInfo("", true)); fmt.Sprint(err) != "acme/autocert: missing server name" {
+		t.Errorf("GetCertificate without SNI nor default: %v; want missing server name", err)
+	}
+}
+
+func TestHostPolicyConnContext(t *testing.T) {
+	type ctxKey struct{}
+	seen := make(chan interface{}, 1)
+	m := &Manager{
+		Prompt: AcceptTOS,
+		HostPolicy: func(ctx context.Context, host string) error {
+			_, hasDeadline := ctx.Deadline()
+			if !hasDeadline {
+				t.Error("HostPolicy context has no deadline")
+			}
+			seen <- ctx.Value(ctxKey{})
+			return errors.New("host not allowed")
+		},
+	}
+	defer m.stopRenew()
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go func() {
+		client := tls.Client(c2, &tls.Config{ServerName: exampleDomain, InsecureSkipVerify: true})
+		client.Handshake()
+		client.Close()
+	}()
+	server := tls.Server(c1, &tls.Config{GetCertificate: m.GetCertificate})
+	ctx := context.WithValue(context.Background(), ctxKey{}, "conn-value")
+	if err := server.HandshakeContext(ctx); err == nil || !strings.Contains(err.Error(), "host not allowed") {
+		t.Errorf("HandshakeContext: %v; want the HostPolicy error", err)
+	}
+	if v := <-seen; v != "conn-value" {
+		t.Errorf("HostPolicy saw context value %v; want %q", v, "conn-value")
+	}
+}
+
+func TestIssuanceCanceledWithHandshake(t *testing.T) {
+	reached := make(chan struct{})
+	aborted := make(chan struct{})
+	var ca *httptest.Server
+	ca = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		switch {
+		case r.Method == "HEAD":
+		case r.URL.Path == "/":
+			discoTmpl.Execute(w, ca.URL)
+		case r.URL.Path == "/new-reg":
+			w.Write([]byte("{}"))
+		case r.URL.Path == "/new-authz":
+			// Hang until the client gives up, which the server
+			// only notices once the request body is read.
+			io.Copy(ioutil.Discard, r.Body)
+			close(reached)
+			<-r.Context().Done()
+			close(aborted)
+		default:
+			t.Errorf("unrecognized r.URL.Path: %s", r.URL.Path)
+		}
+	}))
+	defer ca.Close()
+
+	man := &Manager{
+		Prompt: AcceptTOS,
+		Client: &acme.Client{DirectoryURL: ca.URL},
+	}
+	defer man.stopRenew()
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go func() {
+		client := tls.Client(c2, &tls.Config{ServerName: exampleDomain, InsecureSkipVerify: true})
+		client.Handshake()
+		client.Close()
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-reached
+		cancel()
+	}()
+	server := tls.Server(c1, &tls.Config{GetCertificate: man.GetCertificate})
+	if err := server.HandshakeContext(ctx); err == nil {
+		t.Fatal("HandshakeContext succeeded")
+	}
+	select {
+	case <-aborted:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the pending request to the CA was not aborted")
+	}
+
+	// The abandoned issuance completes in the background.
+	ck := certKey{domain: exampleDomain}
+	for i := 0; ; i++ {
+		man.stateMu.Lock()
+		_, ok := man.state[ck]
+		man.stateMu.Unlock()
+		if !ok {
+			break
+		}
+		if i == 100 {
+			t.Fatal("the state of the abandoned issuance was kept")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := man.checkIssuanceBudget(exampleDomain); err != nil {
+		t.Errorf("checkIssuanceBudget: %v; want the canceled attempt not counted", err)
+	}
+}
+
+func TestIssuanceOutlivesCanceledWaiter(t *testing.T) {
+	reached := make(chan struct{})
+	release := make(chan struct{})
+	ca := newRenewalCAStub(t)
+	stub := ca.Config.Handler
+	ca.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/new-authz" {
+			close(reached)
+			<-release
+		}
+		stub.ServeHTTP(w, r)
+	})
+	ca.Start()
+	defer ca.Close()
+
+	man := &Manager{
+		Prompt: AcceptTOS,
+		Client: &acme.Client{DirectoryURL: ca.URL},
+	}
+	defer man.stopRenew()
+
+	// The first caller gives up while another one waits for the cert.
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := man.createCert(ctx, exampleCertKey)
+		first <- err
+	}()
+	<-reached
+	second := make(chan error, 1)
+	go func() {
+		_, err := man.createCert(context.Background(), exampleCertKey)
+		second <- err
+	}()
+	for i := 0; ; i++ {
+		man.stateMu.Lock()
+		waiters := man.state[exampleCertKey].waiters
+		man.stateMu.Unlock()
+		if waiters == 2 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("%d callers wait for the issuance; want 2", waiters)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Errorf("canceled caller: %v; want context.Canceled", err)
+	}
+	close(release)
+	select {
+	case err := <-second:
+		if err != nil {
+			t.Errorf("second caller: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("second caller did not get the cert")
+	}
+}
+
+// testOnion is a valid version 3 onion service name.
+const testOnion = "duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.onion"
+
+func TestCheckOnion(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{testOnion, true},
+		{strings.ToUpper(testOnion), true},
+		{"www." + testOnion, true},
+		{"duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczae.onion", false}, // checksum
+		{"duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzcza1.onion", false}, // base32
+		{"3g2upl4pq6kufc4m.onion", false},                                         // version 2
+		{".onion", false},
+	}
+	for _, tt := range tests {
+		if !isOnion(tt.name) {
+			t.Errorf("isOnion(%q) = false", tt.name)
+		}
+		if err := checkOnion(tt.name); (err == nil) != tt.ok {
+			t.Errorf("checkOnion(%q) = %v; want ok = %v", tt.name, err, tt.ok)
+		}
+	}
+	if isOnion("example.org") {
+		t.Error("isOnion(example.org) = true")
+	}
+}
+
+func TestGetCertificateOnionUnsupported(t *testing.T) {
+	var ca *httptest.Server
+	ca = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		switch r.URL.Path {
+		case "/":
+			discoTmpl.Execute(w, ca.URL)
+		case "/new-reg":
+			w.Write([]byte("{}"))
+		case "/new-authz":
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"type": "urn:ietf:params:acme:error:rejectedIdentifier", "detail": "unsupported identifier"}`))
+		}
+	}))
+	defer ca.Close()
+
+	m := &Manager{
+		Prompt: AcceptTOS,
+		Client: &acme.Client{DirectoryURL: ca.URL},
+	}
+	defer m.stopRenew()
+	_, err := m.GetCertificate(clientHelloInfo(testOnion, true))
+	if err == nil || !strings.Contains(err.Error(), "may not support .onion identifiers") {
+		t.Errorf("GetCertificate(%q) = %v; want an error about .onion support", testOnion, err)
+	}
+}
+
 func TestCertRequest(t *testing.T) {
 	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
@@ -1053,7 +3666,7 @@ func TestCertRequest(t *testing.T) {
 		Id:    asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1},
 		Value: []byte("dummy"),
 	}
-	b, err := certRequest(key, "example.org", []pkix.Extension{ext}, "san.example.org")
+	b, err := certRequest(key, pkix.Name{CommonName: "example.org"}, []pkix.Extension{ext}, "san.example.org")
 	if err != nil {
 		t.Fatalf("certRequest: %v", err)
 	}
@@ -1073,6 +3686,53 @@ func TestCertRequest(t *testing.T) {
 	}
 }
 
+func TestCertRequestSubject(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Manager{Subject: pkix.Name{
+		Country:            []string{"US"},
+		Organization:       []string{"Example Corp"},
+		OrganizationalUnit: []string{"Infra"},
+	}}
+	subject, err := m.certSubject("example.org")
+	if err != nil {
+		t.Fatalf("certSubject: %v", err)
+	}
+	b, err := certRequest(key, subject, nil)
+	if err != nil {
+		t.Fatalf("certRequest: %v", err)
+	}
+	r, err := x509.ParseCertificateRequest(b)
+	if err != nil {
+		t.Fatalf("ParseCertificateRequest: %v", err)
+	}
+	if r.Subject.CommonName != "example.org" {
+		t.Errorf("CommonName = %q; want example.org", r.Subject.CommonName)
+	}
+	if !reflect.DeepEqual(r.Subject.Country, m.Subject.Country) {
+		t.Errorf("Country = %q; want %q", r.Subject.Country, m.Subject.Country)
+	}
+	if !reflect.DeepEqual(r.Subject.Organization, m.Subject.Organization) {
+		t.Errorf("Organization = %q; want %q", r.Subject.Organization, m.Subject.Organization)
+	}
+	if !reflect.DeepEqual(r.Subject.OrganizationalUnit, m.Subject.OrganizationalUnit) {
+		t.Errorf("OrganizationalUnit = %q; want %q", r.Subject.OrganizationalUnit, m.Subject.OrganizationalUnit)
+	}
+
+	for _, bad := range []pkix.Name{
+		{CommonName: "other.org"},
+		{SerialNumber: "1"},
+		{ExtraNames: []pkix.AttributeTypeAndValue{{Type: asn1.ObjectIdentifier{2, 5, 4, 42}, Value: "x"}}},
+	} {
+		m := &Manager{Subject: bad}
+		if _, err := m.certSubject("example.org"); err == nil {
+			t.Errorf("certSubject with Subject %+v succeeded", bad)
+		}
+	}
+}
+
 func TestSupportsECDSA(t *testing.T) {
 	tests := []struct {
 		CipherSuites     []uint16
@@ -1132,6 +3792,30 @@ func TestSupportsECDSA(t *testing.T) {
 	}
 }
 
+func TestSupportsECDSATLS13(t *testing.T) {
+	tls13 := []uint16{tls.TLS_AES_128_GCM_SHA256, tls.TLS_CHACHA20_POLY1305_SHA256}
+	tests := []struct {
+		name             string
+		SignatureSchemes []tls.SignatureScheme
+		ecdsaOk          bool
+	}{
+		{"ecdsa", []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PSSWithSHA256}, true},
+		{"rsa", []tls.SignatureScheme{tls.PSSWithSHA256, tls.PKCS1WithSHA256}, false},
+		{"no signature_algorithms", nil, false},
+	}
+	for _, tt := range tests {
+		result := supportsECDSA(&tls.ClientHelloInfo{
+			CipherSuites:      tls13,
+			SignatureSchemes:  tt.SignatureSchemes,
+			SupportedCurves:   []tls.CurveID{tls.X25519, tls.CurveP256},
+			SupportedVersions: []uint16{tls.VersionTLS13},
+		})
+		if result != tt.ecdsaOk {
+			t.Errorf("%s: supportsECDSA = %v; want %v", tt.name, result, tt.ecdsaOk)
+		}
+	}
+}
+
 // TODO: add same end-to-end for http-01 challenge type.
 func TestEndToEnd(t *testing.T) {
 	const domain = "example.org"
@@ -1187,3 +3871,521 @@ func TestEndToEnd(t *testing.T) {
 		t.Errorf("user server response: %q; want 'OK'", v)
 	}
 }
+
+func TestForget(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	cache := newMemCache(t)
+	man := &Manager{
+		Prompt:       AcceptTOS,
+		Cache:        cache,
+		CertVersions: 1,
+		MemCacheSize: 10,
+		HostPolicy:   HostWhitelist(exampleDomain),
+		Client:       &acme.Client{DirectoryURL: ca.URL},
+	}
+	defer man.stopRenew()
+	ctx := context.Background()
+
+	var renewals []*domainRenewal
+	for _, ck := range []certKey{exampleCertKey, {domain: exampleDomain, isRSA: true}} {
+		if _, err := man.GetCertificate(clientHelloInfo(exampleDomain, !ck.isRSA)); err != nil {
+			t.Fatal(err)
+		}
+		renewals = append(renewals, waitRenewal(t, man, ck))
+	}
+	// Keep a previous version of the certs.
+	if err := man.ForceRenew(ctx, exampleDomain); err != nil {
+		t.Fatalf("ForceRenew: %v", err)
+	}
+	// Other entries are kept.
+	if err := cache.Put(ctx, "other."+exampleDomain, []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{exampleDomain, exampleDomain + "+rsa", exampleDomain + "+v1", exampleDomain + "+rsa+v1"}
+	// The entries of the other features.
+	for _, key := range []string{csrCertCacheKey(exampleDomain), exampleDomain + "+spare", exampleDomain + "+rsa+spare", pendingAuthzCacheKey(exampleDomain)} {
+		if err := cache.Put(ctx, key, []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		if _, err := cache.Get(ctx, key); err != nil {
+			t.Fatalf("cache.Get(%q) before Forget: %v", key, err)
+		}
+	}
+
+	if err := man.Forget(ctx, exampleDomain+"."); err != nil {
+		t.Fatalf("Forget: %v", err)
+	}
+	for _, key := range keys {
+		if _, err := cache.Get(ctx, key); err != ErrCacheMiss {
+			t.Errorf("cache.Get(%q) after Forget: err = %v; want ErrCacheMiss", key, err)
+		}
+	}
+	if _, err := cache.Get(ctx, "other."+exampleDomain); err != nil {
+		t.Errorf("unrelated cache entry deleted: %v", err)
+	}
+	for _, dr := range renewals {
+		dr.timerMu.Lock()
+		stopped := dr.timer == nil
+		dr.timerMu.Unlock()
+		if !stopped {
+			t.Errorf("renewal of %s not stopped", dr.ck)
+		}
+	}
+	man.renewalMu.Lock()
+	n := len(man.renewal)
+	man.renewalMu.Unlock()
+	man.stateMu.Lock()
+	n += len(man.state)
+	man.stateMu.Unlock()
+	if n != 0 {
+		t.Errorf("%d renewals and states left after Forget", n)
+	}
+	if _, err := man.CertInfo(exampleDomain); err == nil {
+		t.Error("CertInfo: err is nil after Forget")
+	}
+	if _, err := man.cacheGet(ctx, exampleCertKey); err != ErrCacheMiss {
+		t.Errorf("cacheGet after Forget: err = %v; want ErrCacheMiss", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	// The CA must never be contacted.
+	ca := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("read-only Manager contacted the CA: %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ca.Close()
+
+	now := time.Now()
+	cache := newMemCache(t)
+	man := &Manager{
+		Prompt:     AcceptTOS,
+		Cache:      cache,
+		HostPolicy: HostWhitelist(exampleDomain, "missing."+exampleDomain),
+		Client:     &acme.Client{DirectoryURL: ca.URL},
+		ReadOnly:   true,
+		Now:        func() time.Time { return now },
+	}
+	defer man.stopRenew()
+	ctx := context.Background()
+	leader := &Manager{Cache: cache}
+
+	// A missing cert is not requested.
+	if _, err := man.GetCertificate(clientHelloInfo("missing."+exampleDomain, true)); err == nil {
+		t.Error("GetCertificate: err is nil for a cert missing from Cache")
+	}
+
+	// A cached cert is served, but not renewed even if due.
+	old := newTestTLSCert(t, now.Add(24*time.Hour))
+	if err := leader.cachePut(ctx, exampleCertKey, old); err != nil {
+		t.Fatal(err)
+	}
+	hello := clientHelloInfo(exampleDomain, true)
+	cert, err := man.GetCertificate(hello)
+	if err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	if !bytes.Equal(cert.Certificate[0], old.Certificate[0]) {
+		t.Error("GetCertificate did not serve the cached cert")
+	}
+	time.Sleep(10 * time.Millisecond) // renewals are started asynchronously
+	man.renewalMu.Lock()
+	n := len(man.renewal)
+	man.renewalMu.Unlock()
+	if n != 0 {
+		t.Errorf("%d renewal timers armed by a read-only Manager", n)
+	}
+	if err := man.ForceRenew(ctx, exampleDomain); err == nil {
+		t.Error("ForceRenew: err is nil for a read-only Manager")
+	}
+
+	// The cert renewed by the leader is adopted, once the Cache is read again.
+	renewed := newTestTLSCert(t, now.Add(90*24*time.Hour))
+	if err := leader.cachePut(ctx, exampleCertKey, renewed); err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = man.GetCertificate(hello); err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	if !bytes.Equal(cert.Certificate[0], old.Certificate[0]) {
+		t.Error("Cache read again within readOnlyReloadInterval")
+	}
+	now = now.Add(readOnlyReloadInterval)
+	if cert, err = man.GetCertificate(hello); err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	if !bytes.Equal(cert.Certificate[0], renewed.Certificate[0]) {
+		t.Error("GetCertificate did not serve the cert renewed by the leader")
+	}
+}
+
+// opaqueSigner is a crypto.Signer whose private key cannot be exported,
+// as one held by a key management service.
+type opaqueSigner struct{ crypto.Signer }
+
+func TestSetEmailUpdatesAccount(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		regs    int
+		updates [][]string // contacts of the account update requests
+	)
+	var ca *httptest.Server
+	ca = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		if r.Method == "HEAD" {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/":
+			if err := discoTmpl.Execute(w, ca.URL); err != nil {
+				t.Errorf("discoTmpl: %v", err)
+			}
+		case "/new-reg":
+			regs++
+			w.Header().Set("Location", ca.URL+"/reg/1")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("{}"))
+		case "/reg/1":
+			var req struct{ Contact []string }
+			if err := decodePayload(&req, r.Body); err != nil {
+				t.Errorf("decodePayload: %v", err)
+			}
+			updates = append(updates, req.Contact)
+			b, _ := json.Marshal(req.Contact)
+			fmt.Fprintf(w, `{"contact":%s}`, b)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ca.Close()
+
+	m := &Manager{
+		Client:  &acme.Client{DirectoryURL: ca.URL},
+		Email:   "old@example.org",
+		Contact: []string{"tel:+12025550100"},
+	}
+	ctx := context.Background()
+	if _, err := m.acmeClient(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Unchanged contacts are not updated.
+	if _, err := m.acmeClient(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if len(updates) != 0 {
+		t.Errorf("account updated with %v before SetEmail", updates)
+	}
+	mu.Unlock()
+
+	m.SetEmail("new@example.org")
+	for i := 0; i < 2; i++ {
+		if _, err := m.acmeClient(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if regs != 1 {
+		t.Errorf("registered %d times; want 1", regs)
+	}
+	want := [][]string{{"mailto:new@example.org", "tel:+12025550100"}}
+	if !reflect.DeepEqual(updates, want) {
+		t.Errorf("account updates: %v; want %v", updates, want)
+	}
+}
+
+func TestUpdateContactFailureBacksOff(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		updates int
+	)
+	var ca *httptest.Server
+	ca = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		if r.Method == "HEAD" {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/":
+			if err := discoTmpl.Execute(w, ca.URL); err != nil {
+				t.Errorf("discoTmpl: %v", err)
+			}
+		case "/new-reg":
+			w.Header().Set("Location", ca.URL+"/reg/1")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("{}"))
+		case "/reg/1":
+			updates++
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"type":"urn:ietf:params:acme:error:malformed"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ca.Close()
+
+	now := time.Now()
+	m := &Manager{
+		Client: &acme.Client{DirectoryURL: ca.URL},
+		Email:  "old@example.org",
+		Now:    func() time.Time { return now },
+	}
+	ctx := context.Background()
+	if _, err := m.acmeClient(ctx); err != nil {
+		t.Fatal(err)
+	}
+	m.SetEmail("new@example.org")
+	for i := 0; i < 3; i++ {
+		if _, err := m.acmeClient(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	if updates != 1 {
+		t.Errorf("account update attempted %d times; want 1", updates)
+	}
+	mu.Unlock()
+
+	// The failed update is retried once contactRetryInterval elapsed.
+	now = now.Add(contactRetryInterval)
+	if _, err := m.acmeClient(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if updates != 2 {
+		t.Errorf("account update attempted %d times after contactRetryInterval; want 2", updates)
+	}
+}
+
+func TestChallengeDeletedOnCompletion(t *testing.T) {
+	cache := &MemoryCache{}
+	m := &Manager{Cache: cache}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &acme.Client{Key: key}
+	ctx := context.Background()
+	for _, typ := range []string{"http-01", "tls-alpn-01"} {
+		cleanup, err := m.fulfill(ctx, client, &acme.Challenge{Type: typ, Token: "token"}, "example.org")
+		if err != nil {
+			t.Fatalf("%s: fulfill: %v", typ, err)
+		}
+		keys, _ := cache.List(ctx)
+		if len(keys) != 2 {
+			t.Errorf("%s: cache keys %q; want the challenge data and its expiry", typ, keys)
+		}
+		cleanup()
+		// The cleanup is asynchronous.
+		for i := 0; ; i++ {
+			keys, _ = cache.List(ctx)
+			if len(keys) == 0 {
+				break
+			}
+			if i == 100 {
+				t.Fatalf("%s: cache keys %q after cleanup; want none", typ, keys)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	m.challengeMu.Lock()
+	defer m.challengeMu.Unlock()
+	if len(m.challengeExp) != 0 {
+		t.Errorf("challengeExp = %v after cleanup; want empty", m.challengeExp)
+	}
+}
+
+func TestChallengeSweep(t *testing.T) {
+	now := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	cache := &MemoryCache{}
+	m := &Manager{
+		Cache:        cache,
+		ChallengeTTL: 10 * time.Minute,
+		Now:          func() time.Time { return now },
+	}
+	ctx := context.Background()
+	// Left behind by a process which crashed during an authorization.
+	cache.Put(ctx, "abandoned+http-01", []byte("value"))
+	cache.Put(ctx, "abandoned+http-01+expiry", []byte(now.Add(-time.Minute).Format(time.RFC3339Nano)))
+	// Stored by another process, still in use.
+	cache.Put(ctx, "recent+http-01", []byte("value"))
+	cache.Put(ctx, "recent+http-01+expiry", []byte(now.Add(time.Minute).Format(time.RFC3339Nano)))
+	cache.Put(ctx, "example.org", []byte("certificate"))
+	// Stored by m, never cleaned up.
+	m.putHTTPToken(ctx, "/.well-known/acme-challenge/mine", "value")
+
+	m.sweepChallenges(ctx)
+	keys, _ := cache.List(ctx)
+	sort.Strings(keys)
+	want := []string{"example.org", "mine+http-01", "mine+http-01+expiry", "recent+http-01", "recent+http-01+expiry"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("cache keys after the first sweep: %q; want %q", keys, want)
+	}
+
+	now = now.Add(10 * time.Minute)
+	m.sweepChallenges(ctx)
+	keys, _ = cache.List(ctx)
+	if want := []string{"example.org"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("cache keys after the TTL: %q; want %q", keys, want)
+	}
+}
+
+func TestExportPEM(t *testing.T) {
+	man := &Manager{Cache: newMemCache(t)}
+	defer man.stopRenew()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := stubCA.issue(&key.PublicKey, exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := [][]byte{leaf, stubCA.intermediate.Raw}
+	tlscert := &tls.Certificate{PrivateKey: key, Certificate: chain}
+	if err := man.cachePut(context.Background(), exampleCertKey, tlscert); err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM, keyPEM, err := man.ExportPEM(exampleDomain)
+	if err != nil {
+		t.Fatalf("ExportPEM: %v", err)
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("X509KeyPair: %v", err)
+	}
+	if !reflect.DeepEqual(pair.Certificate, chain) {
+		t.Errorf("exported chain of %d certificates differs from the cached one", len(pair.Certificate))
+	}
+
+	dir, err := ioutil.TempDir("", "autocert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := man.WritePEM(context.Background(), exampleDomain, certPath, keyPath); err != nil {
+		t.Fatalf("WritePEM: %v", err)
+	}
+	if _, err := tls.LoadX509KeyPair(certPath, keyPath); err != nil {
+		t.Errorf("LoadX509KeyPair: %v", err)
+	}
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(keyPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := fi.Mode().Perm(); mode != 0600 {
+			t.Errorf("key file mode = %v; want 0600", mode)
+		}
+	}
+
+	if _, _, err := man.ExportPEM("unknown.example.org"); err == nil {
+		t.Error("ExportPEM of an unknown domain succeeded")
+	}
+}
+
+func TestExportPEMNonExportableKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := stubCA.issue(&key.PublicKey, exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	man := &Manager{
+		state: map[certKey]*certState{
+			exampleCertKey: {key: opaqueSigner{key}, cert: [][]byte{der}, leaf: leaf},
+		},
+	}
+	defer man.stopRenew()
+	if _, _, err := man.ExportPEM(exampleDomain); err == nil || !strings.Contains(err.Error(), "cannot be exported") {
+		t.Errorf("ExportPEM: %v; want a non-exportable key error", err)
+	}
+}
+
+func TestSubmitCSR(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+	cache := newMemCache(t)
+	man := &Manager{
+		Prompt: AcceptTOS,
+		Cache:  cache,
+		Client: &acme.Client{DirectoryURL: ca.URL},
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{exampleDomain, "www." + exampleDomain}
+	tmpl := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: exampleDomain},
+		DNSNames: names,
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := man.SubmitCSR(context.Background(), "other.org", csr); err == nil {
+		t.Error("SubmitCSR for a domain not in the request succeeded")
+	}
+
+	cert, err := man.SubmitCSR(context.Background(), exampleDomain, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.PrivateKey != nil {
+		t.Error("cert.PrivateKey is set")
+	}
+	if !key.PublicKey.Equal(cert.Leaf.PublicKey) {
+		t.Error("leaf public key does not match the request")
+	}
+	if !reflect.DeepEqual(cert.Leaf.DNSNames, names) {
+		t.Errorf("leaf DNSNames = %q; want %q", cert.Leaf.DNSNames, names)
+	}
+
+	data, err := cache.Get(context.Background(), exampleDomain+"+csr")
+	if err != nil {
+		t.Fatalf("cache.Get: %v", err)
+	}
+	if bytes.Contains(data, []byte("PRIVATE")) {
+		t.Error("private key found in cache")
+	}
+	var blocks int
+	for rest := data; ; blocks++ {
+		var b *pem.Block
+		if b, rest = pem.Decode(rest); b == nil {
+			break
+		}
+		if b.Type != "CERTIFICATE" {
+			t.Errorf("cached PEM block type = %q; want CERTIFICATE", b.Type)
+		}
+	}
+	if blocks != len(cert.Certificate) {
+		t.Errorf("cached %d certificates; want %d", blocks, len(cert.Certificate))
+	}
+	if _, err := cache.Get(context.Background(), exampleDomain); err != ErrCacheMiss {
+		t.Errorf("cache.Get(%q): %v; want ErrCacheMiss", exampleDomain, err)
+	}
+}
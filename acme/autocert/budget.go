@@ -0,0 +1,322 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// GiveUpError is returned for a domain whose issuance budget, as set by
+// Manager.MaxAttempts and Manager.IssuanceDeadline, is exhausted: the Manager
+// no longer asks the CA for a certificate for it, until ForceRenew is called.
+type GiveUpError struct {
+	Domain   string
+	Attempts int   // number of consecutive failed attempts
+	Err      error // error of the last attempt
+}
+
+func (e *GiveUpError) Error() string {
+	return fmt.Sprintf("acme/autocert: gave up obtaining a certificate for %q after %d failed attempts: %v", e.Domain, e.Attempts, e.Err)
+}
+
+func (e *GiveUpError) Unwrap() error { return e.Err }
+
+// issuanceBudget tracks the consecutive failed attempts to obtain
+// a certificate for a domain.
+type issuanceBudget struct {
+	attempts int
+	first    time.Time    // time of the first failed attempt
+	giveUp   *GiveUpError // non-nil once the budget is exhausted
+}
+
+// checkIssuanceBudget returns a *GiveUpError if m gave up obtaining
+// a certificate for domain, and nil otherwise.
+func (m *Manager) checkIssuanceBudget(domain string) error {
+	m.budgetMu.Lock()
+	defer m.budgetMu.Unlock()
+	if b := m.budgets[domain]; b != nil && b.giveUp != nil {
+		return b.giveUp
+	}
+	return nil
+}
+
+// issuanceFailed records a failed attempt to obtain a certificate for domain.
+// Once the budget of the domain is exhausted, it logs the fact and calls
+// m.OnGiveUp, if any. The attempts refused by WeeklyCertLimit do not count.
+func (m *Manager) issuanceFailed(domain string, err error) {
+	if m.MaxAttempts <= 0 && m.IssuanceDeadline <= 0 {
+		return
+	}
+	var berr *BudgetExhaustedError
+	if errors.As(err, &berr) {
+		return
+	}
+	now := m.now()
+	m.budgetMu.Lock()
+	if m.budgets == nil {
+		m.budgets = make(map[string]*issuanceBudget)
+	}
+	b := m.budgets[domain]
+	if b == nil {
+		b = &issuanceBudget{first: now}
+		m.budgets[domain] = b
+	}
+	b.attempts++
+	exhausted := m.MaxAttempts > 0 && b.attempts >= m.MaxAttempts ||
+		m.IssuanceDeadline > 0 && now.Sub(b.first) >= m.IssuanceDeadline
+	var giveUp *GiveUpError
+	if exhausted && b.giveUp == nil {
+		giveUp = &GiveUpError{Domain: domain, Attempts: b.attempts, Err: err}
+		b.giveUp = giveUp
+	}
+	m.budgetMu.Unlock()
+
+	if giveUp == nil {
+		return
+	}
+	log.Printf("%v; no further attempts until ForceRenew is called", giveUp)
+	if m.OnGiveUp != nil {
+		m.OnGiveUp(domain, giveUp)
+	}
+}
+
+// issuanceSucceeded resets the issuance budget of domain.
+func (m *Manager) issuanceSucceeded(domain string) {
+	m.budgetMu.Lock()
+	defer m.budgetMu.Unlock()
+	delete(m.budgets, domain)
+}
+
+// ForceRenew resets the issuance budget of domain, see Manager.MaxAttempts,
+// and requests new certificates from the CA right away for those m holds for
+// domain, even if they are not due for renewal. If m holds none, for instance
+// because it gave up obtaining one, the next GetCertificate call for domain
+// asks the CA again. It fails if m is read-only.
+func (m *Manager) ForceRenew(ctx context.Context, domain string) error {
+	if m.ReadOnly {
+		return errors.New("acme/autocert: ForceRenew called on a read-only Manager")
+	}
+	if m.isShutDown() {
+		return errShutDown
+	}
+	m.issuanceSucceeded(domain)
+
+	m.stateMu.Lock()
+	for ck, s := range m.state {
+		if ck.domain != domain || ck.isToken || !s.TryRLock() {
+			continue
+		}
+		if len(s.cert) == 0 {
+			// A failed attempt, which would otherwise be
+			// kept for createCertRetryAfter.
+			delete(m.state, ck)
+		}
+		s.RUnlock()
+	}
+	m.stateMu.Unlock()
+
+	var renewals []*domainRenewal
+	m.renewalMu.Lock()
+	for ck, dr := range m.renewal {
+		if ck.domain == domain {
+			renewals = append(renewals, dr)
+		}
+	}
+	m.renewalMu.Unlock()
+	for _, dr := range renewals {
+		if err := dr.forceRenew(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// weeklyCertWindow is the period over which Manager.WeeklyCertLimit applies.
+const weeklyCertWindow = 7 * 24 * time.Hour
+
+// BudgetExhaustedError is returned for a domain whose registered domain
+// reached Manager.WeeklyCertLimit: the Manager does not ask the CA for a
+// certificate for it until RetryAt.
+type BudgetExhaustedError struct {
+	Domain           string
+	RegisteredDomain string
+	Limit            int       // Manager.WeeklyCertLimit
+	RetryAt          time.Time // when the oldest certificate counted leaves the window
+}
+
+func (e *BudgetExhaustedError) Error() string {
+	return fmt.Sprintf("acme/autocert: weekly limit of %d certificates for %q reached, cannot obtain a certificate for %q until %v", e.Limit, e.RegisteredDomain, e.Domain, e.RetryAt.Format(time.RFC3339))
+}
+
+// weeklyCerts is the JSON encoded count of certificates of a registered
+// domain stored in Cache.
+type weeklyCerts struct {
+	Issued []time.Time `json:"issued"` // oldest first
+}
+
+// WeeklyCertCount returns the number of certificates obtained for the names
+// of the registered domain of domain over the last 7 days, as counted for
+// m.WeeklyCertLimit by m and the other Managers sharing its Cache.
+// It returns 0 if m.WeeklyCertLimit is zero.
+func (m *Manager) WeeklyCertCount(ctx context.Context, domain string) (int, error) {
+	if m.WeeklyCertLimit <= 0 {
+		return 0, nil
+	}
+	m.weeklyMu.Lock()
+	defer m.weeklyMu.Unlock()
+	issued, err := m.loadWeeklyCerts(ctx, m.registeredDomain(domain), m.now())
+	return len(issued), err
+}
+
+// registeredDomain returns the registered domain of name, see
+// Manager.RegisteredDomain.
+func (m *Manager) registeredDomain(name string) string {
+	if m.RegisteredDomain != nil {
+		if d := m.RegisteredDomain(name); d != "" {
+			return d
+		}
+	}
+	labels := strings.Split(name, ".")
+	if len(labels) <= 2 {
+		return name
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+// weeklyCertsCacheKey returns the Cache key of the count of certificates
+// of the registered domain regDomain.
+func weeklyCertsCacheKey(regDomain string) string {
+	return regDomain + "+weekly"
+}
+
+// reserveWeeklyCert checks m.WeeklyCertLimit before an order for a
+// certificate for domain is placed, and counts the order as pending.
+// The returned release function must be called once the order completes,
+// with whether the CA issued the certificate, to count it.
+//
+// It returns a *BudgetExhaustedError if the limit is reached,
+// in which case it logs the fact and calls m.OnBudgetExhausted, if any.
+func (m *Manager) reserveWeeklyCert(ctx context.Context, domain string) (release func(issued bool), err error) {
+	if m.WeeklyCertLimit <= 0 {
+		return func(bool) {}, nil
+	}
+	regDomain := m.registeredDomain(domain)
+	now := m.now()
+	m.weeklyMu.Lock()
+	issued, err := m.loadWeeklyCerts(ctx, regDomain, now)
+	if err != nil {
+		m.weeklyMu.Unlock()
+		return nil, err
+	}
+	pending := m.weeklyPending[regDomain]
+	if n := len(issued) + pending; n >= m.WeeklyCertLimit {
+		berr := &BudgetExhaustedError{
+			Domain:           domain,
+			RegisteredDomain: regDomain,
+			Limit:            m.WeeklyCertLimit,
+			// Without a count of issued certs to expire,
+			// the pending orders complete within the window.
+			RetryAt: now.Add(weeklyCertWindow),
+		}
+		if k := n - m.WeeklyCertLimit; k < len(issued) {
+			berr.RetryAt = issued[k].Add(weeklyCertWindow)
+		}
+		// Once per exhaustion, although the Managers sharing
+		// the Cache may move RetryAt meanwhile.
+		notify := !now.Before(m.weeklyNotified[regDomain])
+		if notify {
+			if m.weeklyNotified == nil {
+				m.weeklyNotified = make(map[string]time.Time)
+			}
+			m.weeklyNotified[regDomain] = berr.RetryAt
+		}
+		m.weeklyMu.Unlock()
+		if notify {
+			log.Print(berr)
+			if m.OnBudgetExhausted != nil {
+				m.OnBudgetExhausted(domain, berr)
+			}
+		}
+		return nil, berr
+	}
+	if m.weeklyPending == nil {
+		m.weeklyPending = make(map[string]int)
+	}
+	m.weeklyPending[regDomain]++
+	m.weeklyMu.Unlock()
+
+	return func(issued bool) {
+		m.weeklyMu.Lock()
+		defer m.weeklyMu.Unlock()
+		if m.weeklyPending[regDomain]--; m.weeklyPending[regDomain] <= 0 {
+			delete(m.weeklyPending, regDomain)
+		}
+		if !issued {
+			return
+		}
+		// A new context: the cert is issued even if ctx is done by now.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := m.addWeeklyCert(ctx, regDomain, m.now()); err != nil {
+			log.Printf("acme/autocert: counting the certificate issued for %q: %v", domain, err)
+		}
+	}, nil
+}
+
+// loadWeeklyCerts returns the issuance times of the certificates of
+// regDomain within the window ending at now, oldest first.
+// m.weeklyMu must be held.
+func (m *Manager) loadWeeklyCerts(ctx context.Context, regDomain string, now time.Time) ([]time.Time, error) {
+	var issued []time.Time
+	if m.Cache == nil {
+		issued = m.weeklyIssued[regDomain]
+	} else {
+		data, err := m.Cache.Get(ctx, weeklyCertsCacheKey(regDomain))
+		if err == ErrCacheMiss {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("acme/autocert: reading the weekly certificate count of %q: %v", regDomain, err)
+		}
+		var wc weeklyCerts
+		if err := json.Unmarshal(data, &wc); err != nil {
+			return nil, fmt.Errorf("acme/autocert: bad weekly certificate count of %q: %v", regDomain, err)
+		}
+		issued = wc.Issued
+	}
+	start := now.Add(-weeklyCertWindow)
+	for len(issued) > 0 && !issued[0].After(start) {
+		issued = issued[1:]
+	}
+	return issued, nil
+}
+
+// addWeeklyCert counts a certificate of regDomain issued at t.
+// m.weeklyMu must be held.
+func (m *Manager) addWeeklyCert(ctx context.Context, regDomain string, t time.Time) error {
+	issued, err := m.loadWeeklyCerts(ctx, regDomain, t)
+	if err != nil {
+		return err
+	}
+	issued = append(issued[:len(issued):len(issued)], t)
+	if m.Cache == nil {
+		if m.weeklyIssued == nil {
+			m.weeklyIssued = make(map[string][]time.Time)
+		}
+		m.weeklyIssued[regDomain] = issued
+		return nil
+	}
+	data, err := json.Marshal(&weeklyCerts{Issued: issued})
+	if err != nil {
+		return err
+	}
+	return m.Cache.Put(ctx, weeklyCertsCacheKey(regDomain), data)
+}
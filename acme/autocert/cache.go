@@ -35,13 +35,89 @@ type Cache interface {
 	Delete(ctx context.Context, key string) error
 }
 
-// DirCache implements Cache using a directory on the local filesystem.
+// CacheLister is a Cache which can enumerate the keys of its entries.
+type CacheLister interface {
+	Cache
+
+	// List returns the keys of all the entries in the cache,
+	// in no particular order.
+	List(ctx context.Context) ([]string, error)
+}
+
+// DirCache implements CacheLister using a directory on the local filesystem.
 // If the directory does not exist, it will be created with 0700 permissions.
+//
+// To use different file or directory permissions, see PermDirCache.
 type DirCache string
 
 // Get reads a certificate data from the specified file name.
 func (d DirCache) Get(ctx context.Context, name string) ([]byte, error) {
-	name = filepath.Join(string(d), name)
+	return PermDirCache{Dir: string(d)}.Get(ctx, name)
+}
+
+// Put writes the certificate data to the specified file name.
+// The file will be created with 0600 permissions.
+func (d DirCache) Put(ctx context.Context, name string, data []byte) error {
+	return PermDirCache{Dir: string(d)}.Put(ctx, name, data)
+}
+
+// Delete removes the specified file name.
+func (d DirCache) Delete(ctx context.Context, name string) error {
+	return PermDirCache{Dir: string(d)}.Delete(ctx, name)
+}
+
+// List returns the names of the files in the directory.
+func (d DirCache) List(ctx context.Context) ([]string, error) {
+	return PermDirCache{Dir: string(d)}.List(ctx)
+}
+
+const (
+	defaultCacheFileMode os.FileMode = 0600
+	defaultCacheDirMode  os.FileMode = 0700
+)
+
+// PermDirCache is like DirCache but allows configuring the permission bits
+// of the files and the directory it creates. This is useful, for instance,
+// when the cached data must be readable by a group of a privilege-separated
+// process.
+//
+// The permissions are applied explicitly and are not subject to the process umask.
+type PermDirCache struct {
+	// Dir is the directory in which the data is stored.
+	Dir string
+
+	// FileMode specifies the permission bits of the cached files.
+	// If zero, 0600 is used.
+	//
+	// The cached data contains private keys. Therefore, permission bits
+	// granting access to others (o+rwx) are always cleared.
+	FileMode os.FileMode
+
+	// DirMode specifies the permission bits of Dir,
+	// used only if the directory does not exist yet.
+	// If zero, 0700 is used.
+	DirMode os.FileMode
+}
+
+func (d PermDirCache) fileMode() os.FileMode {
+	m := d.FileMode.Perm()
+	if m == 0 {
+		m = defaultCacheFileMode
+	}
+	// never make keys accessible to others
+	return m &^ 0007
+}
+
+func (d PermDirCache) dirMode() os.FileMode {
+	if m := d.DirMode.Perm(); m != 0 {
+		return m
+	}
+	return defaultCacheDirMode
+}
+
+// Get reads a certificate data from the specified file name.
+func (d PermDirCache) Get(ctx context.Context, name string) ([]byte, error) {
+	name = filepath.Join(d.Dir, name)
 	var (
 		data []byte
 		err  error
@@ -63,9 +139,9 @@ func (d DirCache) Get(ctx context.Context, name string) ([]byte, error) {
 }
 
 // Put writes the certificate data to the specified file name.
-// The file will be created with 0600 permissions.
-func (d DirCache) Put(ctx context.Context, name string, data []byte) error {
-	if err := os.MkdirAll(string(d), 0700); err != nil {
+// The file will be created with d.FileMode permissions.
+func (d PermDirCache) Put(ctx context.Context, name string, data []byte) error {
+	if err := d.mkdir(); err != nil {
 		return err
 	}
 
@@ -81,7 +157,7 @@ func (d DirCache) Put(ctx context.Context, name string, data []byte) error {
 		case <-ctx.Done():
 			// Don't overwrite the file if the context was canceled.
 		default:
-			newName := filepath.Join(string(d), name)
+			newName := filepath.Join(d.Dir, name)
 			err = os.Rename(tmp, newName)
 		}
 	}()
@@ -94,8 +170,8 @@ func (d DirCache) Put(ctx context.Context, name string, data []byte) error {
 }
 
 // Delete removes the specified file name.
-func (d DirCache) Delete(ctx context.Context, name string) error {
-	name = filepath.Join(string(d), name)
+func (d PermDirCache) Delete(ctx context.Context, name string) error {
+	name = filepath.Join(d.Dir, name)
 	var (
 		err  error
 		done = make(chan struct{})
@@ -115,13 +191,65 @@ func (d DirCache) Delete(ctx context.Context, name string) error {
 	return nil
 }
 
+// List returns the names of the files in d.Dir.
+// It returns no names if d.Dir does not exist.
+func (d PermDirCache) List(ctx context.Context) ([]string, error) {
+	var (
+		infos []os.FileInfo
+		err   error
+		done  = make(chan struct{})
+	)
+	go func() {
+		infos, err = ioutil.ReadDir(d.Dir)
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-done:
+	}
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range infos {
+		if fi.Mode().IsRegular() {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
+
+// mkdir creates d.Dir and any missing parents if it doesn't exist yet.
+// The permissions of a newly created d.Dir are set to d.dirMode regardless of umask.
+func (d PermDirCache) mkdir() error {
+	if _, err := os.Stat(d.Dir); err == nil {
+		return nil
+	}
+	mode := d.dirMode()
+	if err := os.MkdirAll(d.Dir, mode); err != nil {
+		return err
+	}
+	return os.Chmod(d.Dir, mode)
+}
+
 // writeTempFile writes b to a temporary file, closes the file and returns its path.
-func (d DirCache) writeTempFile(prefix string, b []byte) (string, error) {
+func (d PermDirCache) writeTempFile(prefix string, b []byte) (string, error) {
 	// TempFile uses 0600 permissions
-	f, err := ioutil.TempFile(string(d), prefix)
+	f, err := ioutil.TempFile(d.Dir, prefix)
 	if err != nil {
 		return "", err
 	}
+	if mode := d.fileMode(); mode != defaultCacheFileMode {
+		if err := f.Chmod(mode); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return "", err
+		}
+	}
 	if _, err := f.Write(b); err != nil {
 		f.Close()
 		return "", err
@@ -5,16 +5,33 @@
 package autocert
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
-// make sure DirCache satisfies Cache interface
-var _ Cache = DirCache("/")
+// make sure DirCache satisfies CacheLister interface
+var _ CacheLister = DirCache("/")
+
+// make sure PermDirCache satisfies CacheLister interface
+var _ CacheLister = PermDirCache{Dir: "/"}
+
+// make sure TieredCache satisfies Cache interface
+var _ Cache = &TieredCache{}
+
+// make sure MemoryCache satisfies CacheLister interface
+var _ CacheLister = &MemoryCache{}
 
 func TestDirCache(t *testing.T) {
 	dir, err := ioutil.TempDir("", "autocert")
@@ -48,6 +65,11 @@ func TestDirCache(t *testing.T) {
 		t.Error(err)
 	}
 
+	// test list
+	if keys, err := cache.List(ctx); err != nil || !reflect.DeepEqual(keys, []string{"dummy"}) {
+		t.Errorf("list: %q, %v; want [dummy]", keys, err)
+	}
+
 	// test delete
 	if err := cache.Delete(ctx, "dummy"); err != nil {
 		t.Fatalf("delete: %v", err)
@@ -55,4 +77,357 @@ func TestDirCache(t *testing.T) {
 	if _, err := cache.Get(ctx, "dummy"); err != ErrCacheMiss {
 		t.Errorf("get: %v; want ErrCacheMiss", err)
 	}
+	if keys, err := DirCache(filepath.Join(dir, "nonexistent")).List(ctx); err != nil || len(keys) != 0 {
+		t.Errorf("list of a nonexistent dir: %q, %v; want no keys", keys, err)
+	}
+}
+
+func TestPermDirCache(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file permission bits are not supported on windows")
+	}
+	dir, err := ioutil.TempDir("", "autocert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir = filepath.Join(dir, "certs") // a nonexistent dir
+	cache := PermDirCache{
+		Dir:      dir,
+		FileMode: 0664, // o+r must be dropped
+		DirMode:  0750,
+	}
+	ctx := context.Background()
+	if err := cache.Put(ctx, "dummy", []byte{1}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0750 {
+		t.Errorf("dir mode = %o; want 0750", mode)
+	}
+	fi, err = os.Stat(filepath.Join(dir, "dummy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0660 {
+		t.Errorf("file mode = %o; want 0660", mode)
+	}
+
+	// DirCache keeps the secure defaults.
+	dir2 := filepath.Join(dir, "default")
+	if err := DirCache(dir2).Put(ctx, "dummy", []byte{1}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if fi, err = os.Stat(dir2); err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0700 {
+		t.Errorf("default dir mode = %o; want 0700", mode)
+	}
+	if fi, err = os.Stat(filepath.Join(dir2, "dummy")); err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0600 {
+		t.Errorf("default file mode = %o; want 0600", mode)
+	}
+}
+
+// outageCache is a Cache failing all operations while down.
+type outageCache struct {
+	Cache
+	down bool
+}
+
+var errOutage = errors.New("cache unreachable")
+
+func (c *outageCache) Get(ctx context.Context, key string) ([]byte, error) {
+	if c.down {
+		return nil, errOutage
+	}
+	return c.Cache.Get(ctx, key)
+}
+
+func (c *outageCache) Put(ctx context.Context, key string, data []byte) error {
+	if c.down {
+		return errOutage
+	}
+	return c.Cache.Put(ctx, key, data)
+}
+
+func (c *outageCache) Delete(ctx context.Context, key string) error {
+	if c.down {
+		return errOutage
+	}
+	return c.Cache.Delete(ctx, key)
+}
+
+func TestTieredCache(t *testing.T) {
+	ctx := context.Background()
+	primary := &outageCache{Cache: newMemCache(t)}
+	secondary := newMemCache(t)
+	c := &TieredCache{Primary: primary, Secondary: secondary}
+
+	if _, err := c.Get(ctx, "nokey"); err != ErrCacheMiss {
+		t.Errorf("Get(nokey): %v; want ErrCacheMiss", err)
+	}
+
+	// Both caches are written.
+	if err := c.Put(ctx, "a", []byte("a1")); err != nil {
+		t.Fatalf("Put(a): %v", err)
+	}
+	for name, cache := range map[string]Cache{"primary": primary, "secondary": secondary} {
+		if b, err := cache.Get(ctx, "a"); err != nil || !bytes.Equal(b, []byte("a1")) {
+			t.Errorf("%s Get(a) = %q, %v; want a1", name, b, err)
+		}
+	}
+
+	// Reads fall back to the Secondary during an outage.
+	primary.down = true
+	if b, err := c.Get(ctx, "a"); err != nil || !bytes.Equal(b, []byte("a1")) {
+		t.Errorf("Get(a) during outage = %q, %v; want a1", b, err)
+	}
+	if _, err := c.Get(ctx, "nokey"); err != errOutage {
+		t.Errorf("Get(nokey) during outage: %v; want the primary error", err)
+	}
+
+	// Writes fail but are applied to the Secondary.
+	if err := c.Put(ctx, "a", []byte("a2")); err != errOutage {
+		t.Errorf("Put(a) during outage: %v; want the primary error", err)
+	}
+	if err := c.Put(ctx, "b", []byte("b1")); err != errOutage {
+		t.Errorf("Put(b) during outage: %v; want the primary error", err)
+	}
+	if err := c.Put(ctx, "c", []byte("c1")); err != errOutage {
+		t.Errorf("Put(c) during outage: %v; want the primary error", err)
+	}
+	if err := c.Delete(ctx, "c"); err != errOutage {
+		t.Errorf("Delete(c) during outage: %v; want the primary error", err)
+	}
+	if b, err := c.Get(ctx, "b"); err != nil || !bytes.Equal(b, []byte("b1")) {
+		t.Errorf("Get(b) during outage = %q, %v; want b1", b, err)
+	}
+
+	// A miss in the Primary falls back to the Secondary.
+	primary.down = false
+	if err := primary.Cache.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	primary.Cache.Put(ctx, "c", []byte("c0"))
+	if b, err := c.Get(ctx, "b"); err != nil || !bytes.Equal(b, []byte("b1")) {
+		t.Errorf("Get(b) after outage = %q, %v; want b1", b, err)
+	}
+
+	// The first success on the Primary reconciled it.
+	for key, want := range map[string]string{"a": "a2", "b": "b1"} {
+		if b, err := primary.Get(ctx, key); err != nil || string(b) != want {
+			t.Errorf("primary Get(%s) after recovery = %q, %v; want %s", key, b, err, want)
+		}
+	}
+	if _, err := primary.Get(ctx, "c"); err != ErrCacheMiss {
+		t.Errorf("primary Get(c) after recovery: %v; want ErrCacheMiss", err)
+	}
+
+	// Deleting removes both.
+	if err := c.Delete(ctx, "a"); err != nil {
+		t.Fatalf("Delete(a): %v", err)
+	}
+	if _, err := c.Get(ctx, "a"); err != ErrCacheMiss {
+		t.Errorf("Get(a) after Delete: %v; want ErrCacheMiss", err)
+	}
+}
+
+func TestTieredCacheSecondaryFailure(t *testing.T) {
+	ctx := context.Background()
+	secondary := &outageCache{Cache: newMemCache(t), down: true}
+	c := &TieredCache{Primary: newMemCache(t), Secondary: secondary}
+	if err := c.Put(ctx, "a", []byte("a1")); err != nil {
+		t.Errorf("Put with the secondary down: %v", err)
+	}
+	if b, err := c.Get(ctx, "a"); err != nil || !bytes.Equal(b, []byte("a1")) {
+		t.Errorf("Get(a) = %q, %v; want a1", b, err)
+	}
+	if err := c.Delete(ctx, "a"); err != nil {
+		t.Errorf("Delete with the secondary down: %v", err)
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	var c MemoryCache
+	ctx := context.Background()
+	if _, err := c.Get(ctx, "nonexistent"); err != ErrCacheMiss {
+		t.Errorf("Get of a missing key: %v; want ErrCacheMiss", err)
+	}
+	if err := c.Delete(ctx, "nonexistent"); err != nil {
+		t.Errorf("Delete of a missing key: %v", err)
+	}
+
+	data := []byte("data")
+	if err := c.Put(ctx, "a", data); err != nil {
+		t.Fatal(err)
+	}
+	data[0] = 'D' // the cache holds its own copy
+	got, err := c.Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "data" {
+		t.Errorf("Get(a) = %q; want data", got)
+	}
+	got[0] = 'D'
+	if got, _ := c.Get(ctx, "a"); string(got) != "data" {
+		t.Errorf("Get(a) after modifying a result = %q; want data", got)
+	}
+	c.Put(ctx, "b", []byte("other"))
+	keys, err := c.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if want := []string{"a", "b"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("List = %q; want %q", keys, want)
+	}
+
+	if err := c.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "a"); err != ErrCacheMiss {
+		t.Errorf("Get after Delete: %v; want ErrCacheMiss", err)
+	}
+	if keys, _ := c.List(ctx); !reflect.DeepEqual(keys, []string{"b"}) {
+		t.Errorf("List after Delete = %q; want [b]", keys)
+	}
+}
+
+func TestMemoryCacheMaxEntries(t *testing.T) {
+	c := &MemoryCache{MaxEntries: 2}
+	ctx := context.Background()
+	c.Put(ctx, "a", []byte("a"))
+	c.Put(ctx, "b", []byte("b"))
+	c.Get(ctx, "a") // b is now the least recently used
+	c.Put(ctx, "c", []byte("c"))
+	if _, err := c.Get(ctx, "b"); err != ErrCacheMiss {
+		t.Errorf("Get(b): %v; want ErrCacheMiss after eviction", err)
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, err := c.Get(ctx, key); err != nil {
+			t.Errorf("Get(%s): %v", key, err)
+		}
+	}
+	// Replacing an entry does not evict.
+	c.Put(ctx, "c", []byte("c2"))
+	if keys, _ := c.List(ctx); len(keys) != 2 {
+		t.Errorf("List = %q; want 2 keys", keys)
+	}
+}
+
+func TestMemoryCacheConcurrent(t *testing.T) {
+	c := &MemoryCache{MaxEntries: 50}
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := strconv.Itoa(i*100 + j)
+				if err := c.Put(ctx, key, []byte(key)); err != nil {
+					t.Error(err)
+				}
+				if data, err := c.Get(ctx, key); err == nil && string(data) != key {
+					t.Errorf("Get(%s) = %q", key, data)
+				} else if err != nil && err != ErrCacheMiss {
+					t.Error(err)
+				}
+				c.List(ctx)
+				if j%2 == 0 {
+					c.Delete(ctx, key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if keys, _ := c.List(ctx); len(keys) > 50 {
+		t.Errorf("%d keys in the cache; want at most 50", len(keys))
+	}
+}
+
+func TestNamespacedCache(t *testing.T) {
+	store := &MemoryCache{}
+	ctx := context.Background()
+	now := time.Now()
+	newCache := func(c Cache, ns string) Cache {
+		t.Helper()
+		nc, err := NamespacedCache(c, ns)
+		if err != nil {
+			t.Fatalf("NamespacedCache(%q): %v", ns, err)
+		}
+		return nc
+	}
+	a := &Manager{Cache: newCache(store, "a"), Now: func() time.Time { return now }}
+	b := &Manager{Cache: newCache(store, "b"), Now: a.Now}
+	defer a.stopRenew()
+	defer b.stopRenew()
+
+	ck := certKey{domain: exampleDomain}
+	if err := a.cachePut(ctx, ck, newTestTLSCert(t, now.Add(90*24*time.Hour))); err != nil {
+		t.Fatalf("a.cachePut: %v", err)
+	}
+	if _, err := a.accountKey(ctx, "https://ca/dir"); err != nil {
+		t.Fatalf("a.accountKey: %v", err)
+	}
+	a.putHTTPToken(ctx, "/.well-known/acme-challenge/token", "value")
+
+	all, _ := store.List(ctx)
+	if len(all) == 0 {
+		t.Fatal("no entries in the underlying cache")
+	}
+	for _, k := range all {
+		if !strings.HasPrefix(k, "a~") {
+			t.Errorf("underlying key %q; want the \"a~\" prefix", k)
+		}
+	}
+	keys, _ := a.Cache.(CacheLister).List(ctx)
+	if len(keys) != len(all) {
+		t.Errorf("a lists %q; want the %d keys of the underlying cache", keys, len(all))
+	}
+	for _, k := range keys {
+		if strings.Contains(k, namespaceSeparator) {
+			t.Errorf("a lists %q; want it without the prefix", k)
+		}
+	}
+
+	// b sees none of the entries of a.
+	if _, err := b.cacheGet(ctx, ck); err != ErrCacheMiss {
+		t.Errorf("b.cacheGet: %v; want ErrCacheMiss", err)
+	}
+	if _, err := b.httpToken(ctx, "/.well-known/acme-challenge/token"); err == nil {
+		t.Error("b.httpToken found the token of a")
+	}
+	if keys, _ := b.Cache.(CacheLister).List(ctx); len(keys) != 0 {
+		t.Errorf("b lists %q; want none", keys)
+	}
+	if err := b.cachePut(ctx, ck, newTestTLSCert(t, now.Add(90*24*time.Hour))); err != nil {
+		t.Fatalf("b.cachePut: %v", err)
+	}
+	if err := b.Cache.Delete(ctx, ck.String()); err != nil {
+		t.Fatalf("b.Cache.Delete: %v", err)
+	}
+	if _, err := a.cacheGet(ctx, ck); err != nil {
+		t.Errorf("a.cacheGet after b deleted its cert: %v", err)
+	}
+
+	// A Cache which is not a CacheLister is not made one.
+	if _, ok := newCache(struct{ Cache }{store}, "c").(CacheLister); ok {
+		t.Error("NamespacedCache of a Cache is a CacheLister")
+	}
+
+	for _, ns := range []string{"", "x~y"} {
+		if c, err := NamespacedCache(store, ns); err == nil {
+			t.Errorf("NamespacedCache(%q) = %v; want an error", ns, c)
+		}
+	}
 }
@@ -0,0 +1,49 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// buildChain returns the chain to serve and cache for the newly issued
+// certificate of ck, as assembled by m.ChainBuilder from the chain der
+// returned by the CA. It checks that the assembled chain starts with the
+// same leaf, leaf, and that each of its certificates is signed by the next.
+func (m *Manager) buildChain(ck certKey, der [][]byte, leaf *x509.Certificate) ([][]byte, error) {
+	chain, err := m.ChainBuilder(leaf, der)
+	if err == nil {
+		err = verifyChain(chain, der[0])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("acme/autocert: building the certificate chain for %q: %v", ck.domain, err)
+	}
+	return chain, nil
+}
+
+// verifyChain returns an error unless chain starts with the DER encoded
+// leaf certificate and each certificate of chain is signed by the next.
+func verifyChain(chain [][]byte, leaf []byte) error {
+	if len(chain) == 0 || !bytes.Equal(chain[0], leaf) {
+		return errors.New("the chain does not start with the issued certificate")
+	}
+	certs := make([]*x509.Certificate, len(chain))
+	for i, b := range chain {
+		cert, err := x509.ParseCertificate(b)
+		if err != nil {
+			return fmt.Errorf("bad certificate %d: %v", i, err)
+		}
+		certs[i] = cert
+	}
+	for i := 1; i < len(certs); i++ {
+		if err := certs[i-1].CheckSignatureFrom(certs[i]); err != nil {
+			return fmt.Errorf("certificate %d is not issued by certificate %d: %v", i-1, i, err)
+		}
+	}
+	return nil
+}
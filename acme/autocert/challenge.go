@@ -0,0 +1,154 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// defaultChallengeTTL is the lifetime of challenge data
+// if Manager.ChallengeTTL is zero.
+const defaultChallengeTTL = time.Hour
+
+// challengeExpirySuffix is appended to the cache key of challenge data
+// to name the cache entry recording the expiration time of the data.
+const challengeExpirySuffix = "+expiry"
+
+func (m *Manager) challengeTTL() time.Duration {
+	if m.ChallengeTTL > 0 {
+		return m.ChallengeTTL
+	}
+	return defaultChallengeTTL
+}
+
+// isHTTPTokenKey reports whether the challenge data at key
+// is an http-01 token value rather than a tls-alpn-01 token certificate.
+func isHTTPTokenKey(key string) bool {
+	return strings.HasSuffix(key, "+http-01")
+}
+
+// challengeCacheFor returns the Cache storing the challenge data at key,
+// which may be nil.
+func (m *Manager) challengeCacheFor(key string) Cache {
+	if isHTTPTokenKey(key) {
+		return m.httpTokenCache()
+	}
+	return m.certTokenCache()
+}
+
+// putChallengeExpiry records the expiration time of the challenge data
+// stored at key in its challenge cache, both in memory and next to the data,
+// and arms the sweep of expired challenge data.
+func (m *Manager) putChallengeExpiry(ctx context.Context, key string) {
+	cache := m.challengeCacheFor(key)
+	if cache == nil {
+		return
+	}
+	exp := m.now().Add(m.challengeTTL())
+	cache.Put(ctx, key+challengeExpirySuffix, []byte(exp.UTC().Format(time.RFC3339Nano)))
+
+	m.challengeMu.Lock()
+	defer m.challengeMu.Unlock()
+	if m.challengeExp == nil {
+		m.challengeExp = make(map[string]time.Time)
+	}
+	m.challengeExp[key] = exp
+	if m.sweepTimer == nil {
+		m.sweepTimer = time.AfterFunc(m.challengeTTL(), m.sweepTimerFired)
+		if !m.sweptOnce {
+			// Data left behind by a previous run may be waiting already.
+			m.sweptOnce = true
+			go m.sweepChallenges(context.Background())
+		}
+	}
+}
+
+// deleteChallengeExpiry forgets the expiration time of the challenge data
+// stored at key, once the data is deleted.
+func (m *Manager) deleteChallengeExpiry(key string) {
+	m.challengeMu.Lock()
+	delete(m.challengeExp, key)
+	m.challengeMu.Unlock()
+	if cache := m.challengeCacheFor(key); cache != nil {
+		cache.Delete(context.Background(), key+challengeExpirySuffix)
+	}
+}
+
+// sweepTimerFired runs a sweep and re-arms the timer
+// as long as m has challenge data in the cache.
+func (m *Manager) sweepTimerFired() {
+	m.sweepChallenges(context.Background())
+	m.challengeMu.Lock()
+	defer m.challengeMu.Unlock()
+	if len(m.challengeExp) == 0 {
+		m.sweepTimer = nil
+		return
+	}
+	m.sweepTimer.Reset(m.challengeTTL())
+}
+
+// sweepChallenges deletes the challenge data whose TTL elapsed from the
+// challenge caches: the data stored by m and, from a cache which is a
+// CacheLister, the data left behind by other Managers or previous runs,
+// such as those of a process which crashed during an authorization.
+func (m *Manager) sweepChallenges(ctx context.Context) {
+	now := m.now()
+	var expired []string
+	m.challengeMu.Lock()
+	for key, exp := range m.challengeExp {
+		if !now.Before(exp) {
+			expired = append(expired, key)
+		}
+	}
+	m.challengeMu.Unlock()
+
+	// Each challenge type may have its own cache; a cache shared by both
+	// is listed once for each of them.
+	for _, httpTokens := range []bool{true, false} {
+		cache := m.certTokenCache()
+		if httpTokens {
+			cache = m.httpTokenCache()
+		}
+		lister, ok := cache.(CacheLister)
+		if !ok {
+			continue
+		}
+		keys, err := lister.List(ctx)
+		if err != nil {
+			keys = nil
+		}
+		for _, k := range keys {
+			if !strings.HasSuffix(k, challengeExpirySuffix) {
+				continue
+			}
+			key := strings.TrimSuffix(k, challengeExpirySuffix)
+			if isHTTPTokenKey(key) != httpTokens {
+				continue
+			}
+			data, err := cache.Get(ctx, k)
+			if err != nil {
+				continue
+			}
+			exp, err := time.Parse(time.RFC3339Nano, string(data))
+			if err != nil || !now.Before(exp) {
+				expired = append(expired, key)
+			}
+		}
+	}
+
+	for _, key := range expired {
+		cache := m.challengeCacheFor(key)
+		if cache == nil {
+			continue
+		}
+		if err := cache.Delete(ctx, key); err != nil {
+			// Try again on the next sweep.
+			continue
+		}
+		m.deleteChallengeExpiry(key)
+	}
+}
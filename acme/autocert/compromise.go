@@ -0,0 +1,124 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"log"
+	"time"
+
+	"github.com/robarchibald/crypto/acme"
+)
+
+func (m *Manager) compromisedKeyCheckInterval() time.Duration {
+	if m.CompromisedKeyCheckInterval > 0 {
+		return m.CompromisedKeyCheckInterval
+	}
+	return time.Hour
+}
+
+// checkCompromise is called periodically by a timer if
+// Manager.CompromisedKeyCheck is set. If the key of the current cert is
+// reported compromised, it replaces the cert by one with a new key and
+// revokes it.
+func (dr *domainRenewal) checkCompromise() {
+	dr.timerMu.Lock()
+	defer dr.timerMu.Unlock()
+	if dr.timer == nil {
+		return
+	}
+	defer func() {
+		dr.compromiseTimer = time.AfterFunc(dr.m.compromisedKeyCheckInterval(), dr.checkCompromise)
+		testDidCheckCompromise(dr.ck)
+	}()
+
+	dr.m.stateMu.Lock()
+	state := dr.m.state[dr.ck]
+	dr.m.stateMu.Unlock()
+	if state == nil {
+		return
+	}
+	state.RLock()
+	key, der, leaf := state.key, state.cert, state.leaf
+	state.RUnlock()
+	if leaf == nil || !dr.m.CompromisedKeyCheck(leaf.RawSubjectPublicKeyInfo) {
+		return
+	}
+
+	log.Printf("acme/autocert: the key of the certificate for %q is compromised; replacing and revoking it", dr.ck.domain)
+	ctx, done, err := dr.m.beginWork(context.Background())
+	if err != nil {
+		log.Printf("acme/autocert: not replacing the certificate for %q with a compromised key: %v", dr.ck.domain, err)
+		return
+	}
+	defer done()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+	if err := dr.replaceCompromised(ctx, key, der[0], leaf); err != nil {
+		log.Printf("acme/autocert: replacing the certificate for %q with a compromised key: %v", dr.ck.domain, err)
+	}
+}
+
+// replaceCompromised issues a cert with a new key replacing the current
+// cert, whose key is compromised, and once the replacement is stored,
+// revokes the current cert, der, with its key. If the replacement fails,
+// the current cert is still served and not revoked: the next check tries
+// again. It must be called with dr.timerMu held.
+func (dr *domainRenewal) replaceCompromised(ctx context.Context, key crypto.Signer, der []byte, leaf *x509.Certificate) error {
+	kt := dr.m.certKeyType(dr.ck)
+	if dr.m.SharedCertKey {
+		if err := dr.m.replaceSharedKey(ctx, kt, leaf.RawSubjectPublicKeyInfo); err != nil {
+			return err
+		}
+	} else {
+		newKey, err := kt.generate()
+		if err != nil {
+			return err
+		}
+		dr.key = newKey
+	}
+	// The spare was issued for the same key.
+	dr.spare = nil
+	if cache := dr.m.cacheFor(dr.ck); cache != nil {
+		cache.Delete(ctx, spareCacheKey(dr.ck))
+	}
+
+	next, err := dr.issue(ctx, false)
+	dr.recordResult(err)
+	if err != nil {
+		return err
+	}
+	if dr.halted || dr.timer.Stop() {
+		dr.halted = false
+		dr.schedule(next)
+	}
+
+	client, err := dr.m.acmeClient(ctx)
+	if err != nil {
+		return err
+	}
+	return client.RevokeCertWithCertKey(ctx, key, der, acme.CRLReasonKeyCompromise)
+}
+
+// replaceSharedKey replaces the shared certificate key of type kt, unless
+// it was already replaced since a certificate with the compromised public
+// key spki was issued.
+func (m *Manager) replaceSharedKey(ctx context.Context, kt KeyType, spki []byte) error {
+	m.sharedKeyMu.Lock()
+	defer m.sharedKeyMu.Unlock()
+	if key, err := m.currentSharedKey(ctx, kt); err == nil && key != nil {
+		if pub, err := x509.MarshalPKIXPublicKey(key.Public()); err == nil && !bytes.Equal(pub, spki) {
+			return nil
+		}
+	}
+	_, err := m.newSharedKey(ctx, kt)
+	return err
+}
+
+// testDidCheckCompromise is called after each run of checkCompromise, in tests.
+var testDidCheckCompromise = func(ck certKey) {}
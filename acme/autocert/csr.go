@@ -0,0 +1,162 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robarchibald/crypto/acme"
+)
+
+// csrCertCacheKey returns the cache key under which the certificate
+// obtained by SubmitCSR for domain is stored.
+func csrCertCacheKey(domain string) string {
+	return domain + "+csr"
+}
+
+// SubmitCSR obtains a certificate for the DER encoded certificate request
+// csrDER, whose private key is held by the caller, for instance in a
+// hardware security module: the names of the request are authorized with
+// the CA, as GetCertificate does, and the request is then submitted as is.
+// domain must be one of these names, all of which must be allowed by the
+// host policy.
+//
+// The certificate and its chain are returned without a private key, and
+// stored in Cache under the key domain+"+csr". They are neither served by
+// GetCertificate nor renewed by m: SubmitCSR must be called again with a
+// new request before the certificate expires.
+//
+// SubmitCSR is subject to AdmissionFunc, counts against WeeklyCertLimit
+// and fails if m is read-only.
+func (m *Manager) SubmitCSR(ctx context.Context, domain string, csrDER []byte) (*tls.Certificate, error) {
+	if m.ReadOnly {
+		return nil, errors.New("acme/autocert: SubmitCSR called on a read-only Manager")
+	}
+	ctx, done, err := m.beginWork(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	domain = strings.TrimSuffix(domain, ".")
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return nil, fmt.Errorf("acme/autocert: invalid certificate request: %v", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("acme/autocert: invalid certificate request: %v", err)
+	}
+	names := csrNames(csr)
+	if !containsName(names, domain) {
+		return nil, fmt.Errorf("acme/autocert: certificate request is not for %q", domain)
+	}
+	for _, name := range names {
+		if err := m.hostPolicy()(ctx, name); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.admit(ctx, domain); err != nil {
+		return nil, err
+	}
+
+	ck := certKey{domain: domain}
+	release, err := m.reserveWeeklyCert(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	var certURL string
+	defer func() { release(certURL != "") }()
+	client, err := m.acmeClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if err := m.verify(ctx, client, name); err != nil {
+			return nil, err
+		}
+	}
+	der, certURL, err := m.finalizeCert(ctx, client, ck, csrDER)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := csrCert(der, csr, names, m.now())
+	if err != nil {
+		return nil, err
+	}
+	if m.ChainBuilder != nil {
+		if der, err = m.buildChain(ck, der, leaf); err != nil {
+			return nil, err
+		}
+	}
+	m.notifyIssued(ctx, ck, der)
+
+	if m.Cache != nil {
+		var buf bytes.Buffer
+		for _, b := range der {
+			if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: b}); err != nil {
+				return nil, err
+			}
+		}
+		if err := m.Cache.Put(ctx, csrCertCacheKey(domain), buf.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	return &tls.Certificate{Certificate: der, Leaf: leaf}, nil
+}
+
+// csrNames returns the DNS names of csr, or its common name if it has none.
+func csrNames(csr *x509.CertificateRequest) []string {
+	if len(csr.DNSNames) > 0 {
+		return csr.DNSNames
+	}
+	if cn := csr.Subject.CommonName; cn != "" {
+		return []string{cn}
+	}
+	return nil
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// csrCert parses the certificate chain der issued for csr and checks that
+// its leaf is valid at now, for names, and matches csr, as reported by
+// acme.VerifyIssuedCert.
+func csrCert(der [][]byte, csr *x509.CertificateRequest, names []string, now time.Time) (*x509.Certificate, error) {
+	if len(der) == 0 {
+		return nil, errors.New("acme/autocert: no public key found")
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, errors.New("acme/autocert: no public key found")
+	}
+	if now.Before(leaf.NotBefore) {
+		return nil, errors.New("acme/autocert: certificate is not valid yet")
+	}
+	if now.After(leaf.NotAfter) {
+		return nil, errors.New("acme/autocert: expired certificate")
+	}
+	for _, name := range names {
+		if err := leaf.VerifyHostname(name); err != nil {
+			return nil, err
+		}
+	}
+	if err := acme.VerifyIssuedCert(leaf, csr); err != nil {
+		return nil, err
+	}
+	return leaf, nil
+}
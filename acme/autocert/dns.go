@@ -0,0 +1,123 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DNSProvider provisions the TXT records answering "dns-01" challenges,
+// typically through the API of a DNS hosting service.
+//
+// Implementations must be safe for concurrent use by multiple goroutines.
+type DNSProvider interface {
+	// Present creates a TXT record with the given value at the name
+	// "_acme-challenge." followed by domain.
+	Present(ctx context.Context, domain, value string) error
+	// CleanUp removes the record created by Present.
+	CleanUp(ctx context.Context, domain, value string) error
+}
+
+// TXTResolver looks up DNS TXT records. It is implemented by *net.Resolver.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// NameServer returns a TXTResolver sending its queries to the DNS server
+// at addr, in the "host:port" form, instead of the system's resolvers.
+func NameServer(addr string) TXTResolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// DNSPropagationCheck configures how a Manager waits for the TXT record of
+// a dns-01 challenge to be visible, once created by its DNSProvider, before
+// asking the CA to validate the challenge. Asking too early wastes a
+// validation attempt, which counts towards the CA's rate limits.
+type DNSPropagationCheck struct {
+	// Resolvers are polled for the record, which must be visible to all of
+	// them. The authoritative servers of the zone, see NameServer, or public
+	// resolvers are good candidates.
+	//
+	// If empty, net.DefaultResolver is used.
+	Resolvers []TXTResolver
+
+	// Timeout is how long to wait for the record. If it is still not visible
+	// by then, the challenge fails without the CA being asked to validate it.
+	//
+	// If zero, the Manager waits for up to 2 minutes.
+	Timeout time.Duration
+
+	// Interval is the delay between polls. If zero, 5 seconds is used.
+	Interval time.Duration
+}
+
+// wait polls the resolvers of c until every one of them returns value among
+// the TXT records for the dns-01 challenge of domain.
+func (c *DNSPropagationCheck) wait(ctx context.Context, domain, value string) error {
+	name := "_acme-challenge." + domain
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = 2 * time.Minute
+	}
+	interval := c.Interval
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+	pending := c.Resolvers
+	if len(pending) == 0 {
+		pending = []TXTResolver{net.DefaultResolver}
+	}
+	total := len(pending)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var lastErr error
+	for {
+		var left []TXTResolver
+		for _, r := range pending {
+			txt, err := r.LookupTXT(ctx, name)
+			if err != nil {
+				lastErr = err
+			}
+			if !containsString(txt, value) {
+				left = append(left, r)
+			}
+		}
+		pending = left
+		if len(pending) == 0 {
+			return nil
+		}
+
+		t := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			err := fmt.Errorf("acme/autocert: TXT record %s is not visible to %d of %d resolvers after %v", name, len(pending), total, timeout)
+			if lastErr != nil {
+				err = fmt.Errorf("%v; last lookup error: %v", err, lastErr)
+			}
+			return err
+		case <-t.C:
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// IPResolver looks up the IP addresses of hosts. It is implemented by *net.Resolver.
+type IPResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// DomainDNSCheck configures how a Manager checks that the names of the
+// certificates it renews still resolve to the server, see
+// Manager.DomainDNSCheck.
+type DomainDNSCheck struct {
+	// Addrs lists the addresses the names should resolve to: those of the
+	// server, or of the load balancers in front of it, including those of
+	// the other nodes of a cluster serving the same names.
+	Addrs []net.IP
+
+	// Resolver looks up the A and AAAA records of the names.
+	//
+	// If nil, net.DefaultResolver is used.
+	Resolver IPResolver
+
+	// Interval is the delay between checks of the names of a certificate.
+	//
+	// If zero, they are checked every hour.
+	Interval time.Duration
+}
+
+// misconfigured reports whether name resolves to an address not in c.Addrs,
+// or does not exist, along with the addresses it resolves to. The other
+// lookup errors are not reported as misconfigurations.
+func (c *DomainDNSCheck) misconfigured(ctx context.Context, name string) (bool, []net.IP) {
+	r := c.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	addrs, err := r.LookupIPAddr(ctx, name)
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		return true, nil
+	case err != nil:
+		return false, nil
+	}
+	var ips []net.IP
+	bad := len(addrs) == 0
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+		if !c.hasAddr(a.IP) {
+			bad = true
+		}
+	}
+	return bad, ips
+}
+
+func (c *DomainDNSCheck) hasAddr(ip net.IP) bool {
+	for _, a := range c.Addrs {
+		if a.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *DomainDNSCheck) interval() time.Duration {
+	if c.Interval > 0 {
+		return c.Interval
+	}
+	return time.Hour
+}
+
+// checkDNS is called periodically by a timer if Manager.DomainDNSCheck is
+// set. It looks up the names of the cert and reports those newly found not
+// to resolve to the server to Manager.OnDomainMisconfigured.
+// No lock is held during the lookups.
+func (dr *domainRenewal) checkDNS() {
+	c := dr.m.DomainDNSCheck
+	dr.timerMu.Lock()
+	stopped := dr.timer == nil
+	dr.timerMu.Unlock()
+	if stopped {
+		return
+	}
+	names := dr.m.checkedNames(dr.ck)
+
+	type result struct {
+		name  string
+		bad   bool
+		addrs []net.IP
+	}
+	var results []result
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	for _, name := range names {
+		bad, addrs := c.misconfigured(ctx, name)
+		results = append(results, result{name, bad, addrs})
+	}
+	cancel()
+
+	dr.timerMu.Lock()
+	if dr.timer == nil {
+		dr.timerMu.Unlock()
+		return
+	}
+	var report []result
+	for _, r := range results {
+		if r.bad && !dr.misconfigured[r.name] {
+			report = append(report, r)
+		}
+		if r.bad {
+			if dr.misconfigured == nil {
+				dr.misconfigured = make(map[string]bool)
+			}
+			dr.misconfigured[r.name] = true
+		} else {
+			delete(dr.misconfigured, r.name)
+		}
+	}
+	dr.dnsCheckTimer = time.AfterFunc(c.interval(), dr.checkDNS)
+	dr.timerMu.Unlock()
+
+	for _, r := range report {
+		if len(r.addrs) == 0 {
+			log.Printf("acme/autocert: %q does not resolve; its renewals are likely to fail", r.name)
+		} else {
+			log.Printf("acme/autocert: %q resolves to %v, not to the addresses of the server; its renewals are likely to fail", r.name, r.addrs)
+		}
+		if dr.m.OnDomainMisconfigured != nil {
+			dr.m.OnDomainMisconfigured(r.name, r.addrs)
+		}
+	}
+	testDidCheckDNS(dr.ck)
+}
+
+// checkedNames returns the names of the current certificate of ck checked
+// by Manager.DomainDNSCheck: those of the certificate which can be looked
+// up, or ck.domain if m holds no certificate for ck.
+func (m *Manager) checkedNames(ck certKey) []string {
+	m.stateMu.Lock()
+	s := m.state[ck]
+	m.stateMu.Unlock()
+	if s == nil {
+		return []string{ck.domain}
+	}
+	s.RLock()
+	defer s.RUnlock()
+	if s.leaf == nil {
+		return []string{ck.domain}
+	}
+	var names []string
+	for _, name := range s.leaf.DNSNames {
+		if !strings.HasPrefix(name, "*.") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// testDidCheckDNS is called after each run of checkDNS, in tests.
+var testDidCheckDNS = func(ck certKey) {}
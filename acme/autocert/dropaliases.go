@@ -0,0 +1,68 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/robarchibald/crypto/acme"
+)
+
+// canDropAlias reports whether m may request the certificate of ck without
+// name, an alias which failed, as permitted by m.DropFailedAliases.
+// Nothing is dropped once ctx is done, since the failure is not the CA's.
+func (m *Manager) canDropAlias(ctx context.Context, ck certKey, name string) bool {
+	return m.DropFailedAliases && name != ck.domain && ctx.Err() == nil
+}
+
+// rejectedAliases returns the aliases of names, the names requested for the
+// certificate of ck, which err, the error of the CA refusing to issue it,
+// reports a subproblem for, if m may drop them.
+func (m *Manager) rejectedAliases(ctx context.Context, ck certKey, names []string, err error) []string {
+	var e *acme.Error
+	if !errors.As(err, &e) {
+		return nil
+	}
+	var rejected []string
+	for _, sp := range e.Subproblems {
+		for _, name := range names {
+			if strings.EqualFold(sp.Identifier.Value, name) && m.canDropAlias(ctx, ck, name) {
+				rejected = append(rejected, name)
+				break
+			}
+		}
+	}
+	return rejected
+}
+
+// removeNames returns names without the ones in remove.
+func removeNames(names, remove []string) []string {
+	var res []string
+	for _, name := range names {
+		keep := true
+		for _, r := range remove {
+			if name == r {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// aliasesDropped logs that the certificate of domain was obtained without
+// the aliases names and calls m.OnAliasesDropped, if any.
+func (m *Manager) aliasesDropped(domain string, names []string, err error) {
+	log.Printf("acme/autocert: certificate for %q obtained without the aliases %q: %v", domain, names, err)
+	if m.OnAliasesDropped != nil {
+		m.OnAliasesDropped(domain, names, err)
+	}
+}
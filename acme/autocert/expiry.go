@@ -0,0 +1,55 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"log"
+	"time"
+)
+
+// expiryCheckInterval is the delay between the checks of the expiration
+// time of a certificate against Manager.ExpiryWarningThreshold.
+var expiryCheckInterval = time.Hour
+
+// checkExpiry is called periodically by a timer if
+// Manager.ExpiryWarningThreshold is set. If the current cert expires within
+// the threshold, and was not warned about yet, it logs a warning and calls
+// Manager.OnExpiryWarning.
+func (dr *domainRenewal) checkExpiry() {
+	dr.timerMu.Lock()
+	defer dr.timerMu.Unlock()
+	if dr.timer == nil {
+		return
+	}
+	defer func() {
+		dr.expiryTimer = time.AfterFunc(expiryCheckInterval, dr.checkExpiry)
+		testDidCheckExpiry(dr.ck)
+	}()
+
+	dr.m.stateMu.Lock()
+	state := dr.m.state[dr.ck]
+	dr.m.stateMu.Unlock()
+	if state == nil {
+		return
+	}
+	state.RLock()
+	leaf := state.leaf
+	state.RUnlock()
+	if leaf == nil || leaf.NotAfter.Equal(dr.expiryWarned) {
+		return
+	}
+	left := leaf.NotAfter.Sub(dr.m.now())
+	if left >= dr.m.ExpiryWarningThreshold {
+		return
+	}
+	dr.expiryWarned = leaf.NotAfter
+	log.Printf("acme/autocert: the certificate for %q expires at %v, in less than %v", dr.ck, leaf.NotAfter.Format(time.RFC3339), dr.m.ExpiryWarningThreshold)
+	if dr.m.OnExpiryWarning != nil {
+		dr.m.OnExpiryWarning(dr.ck.domain, leaf.NotAfter)
+	}
+}
+
+// testDidCheckExpiry is called after each run of checkExpiry, in tests.
+var testDidCheckExpiry = func(ck certKey) {}
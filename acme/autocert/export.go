@@ -0,0 +1,109 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ExportPEM returns the current certificate of domain, followed by its
+// chain, and its private key, PEM encoded, for instance for a sidecar
+// process terminating TLS on its own. The ECDSA certificate is preferred
+// to the RSA one if m holds both. The certificate is read from Cache if m
+// does not hold it in memory yet, but it is never requested from the CA.
+//
+// ExportPEM returns an error if the private key cannot be exported,
+// such as a key held by a hardware module or a key management service.
+func (m *Manager) ExportPEM(domain string) (certPEM, keyPEM []byte, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return m.exportPEM(ctx, domain)
+}
+
+// WritePEM writes the PEM encoded certificate and private key of domain,
+// as returned by ExportPEM, to the files certPath and keyPath. The key file
+// is only readable by its owner. The files are replaced atomically, so that
+// a process reading them never sees a partial update.
+func (m *Manager) WritePEM(ctx context.Context, domain string, certPath, keyPath string) error {
+	certPEM, keyPEM, err := m.exportPEM(ctx, domain)
+	if err != nil {
+		return err
+	}
+	// The key first, so that a process watching certPath
+	// finds the matching key once the certificate changes.
+	if err := writeFileAtomic(keyPath, keyPEM, 0600); err != nil {
+		return err
+	}
+	return writeFileAtomic(certPath, certPEM, 0644)
+}
+
+func (m *Manager) exportPEM(ctx context.Context, domain string) (certPEM, keyPEM []byte, err error) {
+	domain = m.primaryDomain(strings.TrimSuffix(domain, "."))
+	for _, ck := range []certKey{{domain: domain}, {domain: domain, isRSA: true}} {
+		cert, err := m.cert(ctx, ck)
+		if err == ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		switch cert.PrivateKey.(type) {
+		case *ecdsa.PrivateKey, *rsa.PrivateKey:
+		default:
+			return nil, nil, fmt.Errorf("acme/autocert: the %T private key of %q cannot be exported", cert.PrivateKey, domain)
+		}
+		var key bytes.Buffer
+		if err := encodeKey(&key, cert.PrivateKey); err != nil {
+			return nil, nil, err
+		}
+		var chain bytes.Buffer
+		for _, b := range cert.Certificate {
+			if err := pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: b}); err != nil {
+				return nil, nil, err
+			}
+		}
+		return chain.Bytes(), key.Bytes(), nil
+	}
+	return nil, nil, fmt.Errorf("acme/autocert: no certificate for %q", domain)
+}
+
+// writeFileAtomic writes data to a temporary file with permissions perm
+// in the directory of name, then renames it to name.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// forgetBatchSize is the maximum number of concurrent Cache deletions
+// made by Forget, and forgetBatchPause the pause between such batches,
+// so as not to overwhelm a remote Cache.
+const (
+	forgetBatchSize  = 16
+	forgetBatchPause = 100 * time.Millisecond
+)
+
+// Forget makes m discard everything it holds for domains, for instance once
+// they are no longer allowed by HostPolicy: it stops renewing their
+// certificates, drops them from memory and deletes them from Cache, along with
+// their previous versions kept according to CertVersions, their warm spares,
+// see WarmSpare, the certificates obtained by SubmitCSR and the records of
+// their authorizations left pending with the CA. The certificates of the
+// aliases of domains, see AliasDomains, are the same and discarded too.
+//
+// The certificates are not revoked with the CA.
+//
+// Forget attempts all the deletions, which it makes in batches, and returns
+// the first error. A subsequent GetCertificate call for one of domains
+// obtains a new certificate, if HostPolicy allows it.
+func (m *Manager) Forget(ctx context.Context, domains ...string) error {
+	var keys []string
+	for _, domain := range domains {
+		domain = m.primaryDomain(strings.TrimSuffix(domain, "."))
+		for _, ck := range []certKey{{domain: domain}, {domain: domain, isRSA: true}} {
+			m.forgetCert(ck)
+			keys = append(keys, ck.String())
+			for n := 1; n <= m.CertVersions; n++ {
+				keys = append(keys, certVersionKey(ck, n))
+			}
+			keys = append(keys, spareCacheKey(ck))
+		}
+		keys = append(keys, csrCertCacheKey(domain), pendingAuthzCacheKey(domain))
+		m.issuanceSucceeded(domain)
+	}
+	if m.Cache == nil {
+		return nil
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for i := 0; i < len(keys); i += forgetBatchSize {
+		if i > 0 {
+			t := time.NewTimer(forgetBatchPause)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			case <-t.C:
+			}
+		}
+		batch := keys[i:]
+		if len(batch) > forgetBatchSize {
+			batch = batch[:forgetBatchSize]
+		}
+		for _, key := range batch {
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				if err := m.Cache.Delete(ctx, key); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("acme/autocert: deleting %q from cache: %v", key, err)
+					}
+					mu.Unlock()
+				}
+			}(key)
+		}
+		wg.Wait()
+	}
+	return firstErr
+}
+
+// forgetCert stops the renewal of the cert of ck
+// and drops it and its aliases from memory.
+func (m *Manager) forgetCert(ck certKey) {
+	m.renewalMu.Lock()
+	dr := m.renewal[ck]
+	delete(m.renewal, ck)
+	m.renewalMu.Unlock()
+	if dr != nil {
+		// Waits for a renewal in progress.
+		dr.stop()
+	}
+
+	m.stateMu.Lock()
+	delete(m.state, ck)
+	for alias, domain := range m.aliases {
+		if domain == ck.domain {
+			delete(m.aliases, alias)
+		}
+	}
+	m.stateMu.Unlock()
+
+	if lru := m.certLRU(); lru != nil {
+		lru.remove(ck)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultHostPolicyEntries is the number of decisions a CachedHostPolicy
+// holds if its MaxEntries is zero.
+const defaultHostPolicyEntries = 10000
+
+// CachedHostPolicy memoizes the decisions of a HostPolicy, for instance one
+// looking up the allowed hosts in a database, so that it is not called on
+// every TLS handshake. Its Policy method is the memoizing HostPolicy:
+//
+//	p := autocert.CachingHostPolicy(lookupHost, 5*time.Minute)
+//	m := &autocert.Manager{HostPolicy: p.Policy, ...}
+//
+// Both the accepted and the rejected hosts are remembered for the TTL,
+// but not the failures due to the context of the call, such as a timeout.
+// Concurrent calls for the same host wait for a single decision.
+type CachedHostPolicy struct {
+	// MaxEntries bounds the number of decisions held. Once reached,
+	// the decision of the least recently used host is evicted.
+	// It must be set before the first call of Policy.
+	//
+	// If zero, 10000 decisions are held.
+	MaxEntries int
+
+	inner HostPolicy
+	ttl   time.Duration
+	now   func() time.Time // for tests
+
+	mu    sync.Mutex
+	ll    *list.List // front is the most recently used
+	items map[string]*list.Element
+}
+
+type hostDecision struct {
+	host  string
+	err   error
+	exp   time.Time
+	ready chan struct{} // closed once err and exp are set
+}
+
+// CachingHostPolicy returns a CachedHostPolicy remembering the decisions
+// of inner for ttl.
+func CachingHostPolicy(inner HostPolicy, ttl time.Duration) *CachedHostPolicy {
+	return &CachedHostPolicy{
+		inner: inner,
+		ttl:   ttl,
+		now:   time.Now,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Policy implements HostPolicy: it returns the decision of the inner
+// policy for host, calling it unless a decision made less than the TTL
+// ago is held.
+func (p *CachedHostPolicy) Policy(ctx context.Context, host string) error {
+	for {
+		p.mu.Lock()
+		if e, ok := p.items[host]; ok {
+			d := e.Value.(*hostDecision)
+			select {
+			case <-d.ready:
+				if p.now().Before(d.exp) {
+					p.ll.MoveToFront(e)
+					p.mu.Unlock()
+					return d.err
+				}
+				p.remove(e)
+			default:
+				// Another call is deciding.
+				p.mu.Unlock()
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-d.ready:
+				}
+				continue
+			}
+		}
+		d := &hostDecision{host: host, ready: make(chan struct{})}
+		e := p.ll.PushFront(d)
+		p.items[host] = e
+		p.evict()
+		p.mu.Unlock()
+
+		err := p.inner(ctx, host)
+
+		p.mu.Lock()
+		d.err = err
+		d.exp = p.now().Add(p.ttl)
+		if ctx.Err() != nil {
+			// Not a decision about host: let the next call try again.
+			d.exp = time.Time{}
+			if p.items[host] == e {
+				p.remove(e)
+			}
+		}
+		close(d.ready)
+		p.mu.Unlock()
+		return err
+	}
+}
+
+// Invalidate forgets the decision held for host, if any,
+// so that the next call of Policy for host calls the inner policy.
+func (p *CachedHostPolicy) Invalidate(host string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.items[host]; ok {
+		p.remove(e)
+	}
+}
+
+// InvalidateAll forgets all the decisions held.
+func (p *CachedHostPolicy) InvalidateAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, e := range p.items {
+		p.remove(e)
+	}
+}
+
+// remove deletes the element e. p.mu must be held.
+// A decision in progress completes, but is not held.
+func (p *CachedHostPolicy) remove(e *list.Element) {
+	p.ll.Remove(e)
+	delete(p.items, e.Value.(*hostDecision).host)
+}
+
+// evict removes the least recently used decisions beyond MaxEntries.
+// p.mu must be held.
+func (p *CachedHostPolicy) evict() {
+	max := p.MaxEntries
+	if max <= 0 {
+		max = defaultHostPolicyEntries
+	}
+	for p.ll.Len() > max {
+		p.remove(p.ll.Back())
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+)
+
+// KeyType identifies the algorithm and size of the private keys generated
+// by a Manager, see Manager.AccountKeyType and Manager.CertKeyType.
+type KeyType string
+
+// The supported key types.
+const (
+	ECDSAP256 KeyType = "ecdsa-p256"
+	ECDSAP384 KeyType = "ecdsa-p384"
+	RSA2048   KeyType = "rsa-2048"
+	RSA3072   KeyType = "rsa-3072"
+	RSA4096   KeyType = "rsa-4096"
+)
+
+// keyTypes holds the parameters of the supported key types: either the
+// curve of ECDSA keys or the size of RSA keys.
+var keyTypes = map[KeyType]struct {
+	curve   elliptic.Curve
+	rsaBits int
+}{
+	ECDSAP256: {curve: elliptic.P256()},
+	ECDSAP384: {curve: elliptic.P384()},
+	RSA2048:   {rsaBits: 2048},
+	RSA3072:   {rsaBits: 3072},
+	RSA4096:   {rsaBits: 4096},
+}
+
+// validate returns an error if t is not a supported key type.
+func (t KeyType) validate() error {
+	if _, ok := keyTypes[t]; !ok {
+		return fmt.Errorf("acme/autocert: unsupported key type %q", t)
+	}
+	return nil
+}
+
+// isRSA reports whether t is an RSA key type.
+func (t KeyType) isRSA() bool {
+	return keyTypes[t].rsaBits > 0
+}
+
+// generate returns a new private key of type t.
+func (t KeyType) generate() (crypto.Signer, error) {
+	p, ok := keyTypes[t]
+	switch {
+	case !ok:
+		return nil, t.validate()
+	case p.rsaBits > 0:
+		return rsa.GenerateKey(rand.Reader, p.rsaBits)
+	default:
+		return ecdsa.GenerateKey(p.curve, rand.Reader)
+	}
+}
+
+// accountKeyType returns the type of the account keys m generates.
+func (m *Manager) accountKeyType() KeyType {
+	if m.AccountKeyType != "" {
+		return m.AccountKeyType
+	}
+	return ECDSAP256
+}
+
+// certKeyType returns the type of the key of a new certificate for ck.
+func (m *Manager) certKeyType(ck certKey) KeyType {
+	switch {
+	case m.CertKeyType != "":
+		return m.CertKeyType
+	case ck.isRSA:
+		return RSA2048
+	default:
+		return ECDSAP256
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"container/list"
+	"crypto/tls"
+	"sync"
+)
+
+// certLRU is a size-bounded, least recently used, in-memory cache
+// of decoded certificates which sits in front of Manager.Cache.
+// It is safe for concurrent use.
+type certLRU struct {
+	max int // max number of entries; always > 0
+
+	mu    sync.Mutex
+	ll    *list.List // front is the most recently used
+	items map[certKey]*list.Element
+}
+
+type lruEntry struct {
+	ck   certKey
+	cert *tls.Certificate
+}
+
+func newCertLRU(max int) *certLRU {
+	return &certLRU{
+		max:   max,
+		ll:    list.New(),
+		items: make(map[certKey]*list.Element),
+	}
+}
+
+// get returns the cached certificate for ck, if any,
+// and marks it as the most recently used.
+func (c *certLRU) get(ck certKey) (*tls.Certificate, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[ck]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*lruEntry).cert, true
+}
+
+// add stores cert under ck, replacing an existing entry.
+// If the cache is full, the least recently used entry is evicted.
+func (c *certLRU) add(ck certKey, cert *tls.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[ck]; ok {
+		e.Value.(*lruEntry).cert = cert
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.items[ck] = c.ll.PushFront(&lruEntry{ck: ck, cert: cert})
+	for c.ll.Len() > c.max {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.items, e.Value.(*lruEntry).ck)
+	}
+}
+
+// remove evicts ck from the cache. It is a noop if ck is not cached.
+func (c *certLRU) remove(ck certKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[ck]; ok {
+		c.ll.Remove(e)
+		delete(c.items, ck)
+	}
+}
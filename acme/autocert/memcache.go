@@ -0,0 +1,93 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// MemoryCache implements CacheLister in memory, for instance for tests or
+// for ephemeral deployments which must not persist data on disk. The data
+// is lost when the process exits, including the account key, so that a new
+// account is registered with the CA on each run.
+//
+// The zero value is an empty cache ready to use. It is safe for concurrent
+// use and must not be copied after first use.
+type MemoryCache struct {
+	// MaxEntries optionally limits the number of entries in the cache.
+	// Once the limit is reached, Put evicts the least recently used entry,
+	// which may be the account key.
+	//
+	// If zero, the number of entries is not limited.
+	MaxEntries int
+
+	mu    sync.Mutex
+	ll    *list.List // front is the most recently used
+	items map[string]*list.Element
+}
+
+type memEntry struct {
+	key  string
+	data []byte
+}
+
+// Get returns a copy of the data stored under key, or ErrCacheMiss.
+func (c *MemoryCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	c.ll.MoveToFront(e)
+	return append([]byte(nil), e.Value.(*memEntry).data...), nil
+}
+
+// Put stores a copy of data under key, replacing an existing entry.
+func (c *MemoryCache) Put(ctx context.Context, key string, data []byte) error {
+	data = append([]byte(nil), data...)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.items == nil {
+		c.ll = list.New()
+		c.items = make(map[string]*list.Element)
+	}
+	if e, ok := c.items[key]; ok {
+		e.Value.(*memEntry).data = data
+		c.ll.MoveToFront(e)
+		return nil
+	}
+	c.items[key] = c.ll.PushFront(&memEntry{key: key, data: data})
+	for c.MaxEntries > 0 && c.ll.Len() > c.MaxEntries {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.items, e.Value.(*memEntry).key)
+	}
+	return nil
+}
+
+// Delete removes the entry of key, if any.
+func (c *MemoryCache) Delete(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.ll.Remove(e)
+		delete(c.items, key)
+	}
+	return nil
+}
+
+// List returns the keys of the entries in the cache.
+func (c *MemoryCache) List(ctx context.Context) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.items))
+	for key := range c.items {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// namespaceSeparator separates the namespace of a NamespacedCache
+// from the keys of its entries in the underlying cache.
+const namespaceSeparator = "~"
+
+// NamespacedCache returns a Cache storing its entries in c, each under
+// its key prefixed with namespace and a "~", so that several independent
+// Managers, each with its own namespace, can share one store such as a
+// database without their certificates, account keys, challenge data and
+// other entries colliding.
+//
+// The returned Cache is a CacheLister if c is one, listing only the keys
+// of namespace, without the prefix.
+//
+// It returns an error if namespace is empty or contains a "~".
+func NamespacedCache(c Cache, namespace string) (Cache, error) {
+	if namespace == "" || strings.Contains(namespace, namespaceSeparator) {
+		return nil, fmt.Errorf("acme/autocert: invalid cache namespace %q", namespace)
+	}
+	nc := namespacedCache{c: c, prefix: namespace + namespaceSeparator}
+	if l, ok := c.(CacheLister); ok {
+		return namespacedLister{nc, l}, nil
+	}
+	return nc, nil
+}
+
+type namespacedCache struct {
+	c      Cache
+	prefix string
+}
+
+func (c namespacedCache) Get(ctx context.Context, key string) ([]byte, error) {
+	return c.c.Get(ctx, c.prefix+key)
+}
+
+func (c namespacedCache) Put(ctx context.Context, key string, data []byte) error {
+	return c.c.Put(ctx, c.prefix+key, data)
+}
+
+func (c namespacedCache) Delete(ctx context.Context, key string) error {
+	return c.c.Delete(ctx, c.prefix+key)
+}
+
+// namespacedLister is a namespacedCache whose underlying cache is a CacheLister.
+type namespacedLister struct {
+	namespacedCache
+	l CacheLister
+}
+
+func (c namespacedLister) List(ctx context.Context) ([]string, error) {
+	all, err := c.l.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, k := range all {
+		if strings.HasPrefix(k, c.prefix) {
+			keys = append(keys, strings.TrimPrefix(k, c.prefix))
+		}
+	}
+	return keys, nil
+}
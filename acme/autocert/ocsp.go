@@ -0,0 +1,195 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/robarchibald/crypto/ocsp"
+)
+
+const (
+	// ocspTimeout bounds the time spent fetching an OCSP response
+	// from all the responders of a certificate.
+	ocspTimeout = 10 * time.Second
+
+	// ocspResponderBackoff is how long an OCSP responder which failed
+	// to answer is skipped, so that a dead responder is not queried
+	// on every handshake.
+	ocspResponderBackoff = time.Minute
+
+	// ocspMaxAge is how long an OCSP response without a NextUpdate time
+	// is stapled.
+	ocspMaxAge = time.Hour
+
+	// maxOCSPResponseSize is the max size of an OCSP response, in bytes.
+	maxOCSPResponseSize = 1 << 16
+)
+
+// stapled returns cert with an OCSP response stapled, if m.OCSPStapling is
+// set and a response can be obtained. The cert must be the one held by m
+// for ck.
+//
+// A missing or expired response is fetched synchronously, while a response
+// past the middle of its validity period is refreshed in the background.
+func (m *Manager) stapled(ctx context.Context, ck certKey, cert *tls.Certificate) *tls.Certificate {
+	if !m.OCSPStapling || len(cert.Certificate) < 2 || cert.Leaf == nil {
+		return cert
+	}
+	m.stateMu.Lock()
+	s := m.state[ck]
+	m.stateMu.Unlock()
+	if s == nil {
+		return cert
+	}
+
+	s.ocspMu.Lock()
+	defer s.ocspMu.Unlock()
+	if !bytes.Equal(s.ocspLeaf, cert.Certificate[0]) {
+		// The staple, if any, is for a previous certificate.
+		s.ocspLeaf = cert.Certificate[0]
+		s.ocspStaple = nil
+	}
+	now := m.now()
+	switch {
+	case s.ocspStaple == nil || !now.Before(s.ocspExpiry):
+		// Other handshakes wait for this fetch, holding s.ocspMu.
+		ctx, cancel := context.WithTimeout(ctx, ocspTimeout)
+		defer cancel()
+		der, resp, err := m.fetchOCSP(ctx, cert)
+		if err != nil {
+			s.ocspStaple = nil
+			return cert
+		}
+		s.setStaple(der, resp, now)
+	case !now.Before(s.ocspRefresh) && !s.ocspRefreshing:
+		s.ocspRefreshing = true
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), ocspTimeout)
+			defer cancel()
+			der, resp, err := m.fetchOCSP(ctx, cert)
+			s.ocspMu.Lock()
+			defer s.ocspMu.Unlock()
+			s.ocspRefreshing = false
+			if err == nil && bytes.Equal(s.ocspLeaf, cert.Certificate[0]) {
+				s.setStaple(der, resp, m.now())
+			}
+		}()
+	}
+	stapled := *cert
+	stapled.OCSPStaple = s.ocspStaple
+	return &stapled
+}
+
+// setStaple records der, the encoding of resp, as the staple of s.
+// The caller must hold s.ocspMu.
+func (s *certState) setStaple(der []byte, resp *ocsp.Response, now time.Time) {
+	s.ocspStaple = der
+	s.ocspExpiry = resp.NextUpdate
+	if s.ocspExpiry.IsZero() {
+		s.ocspExpiry = now.Add(ocspMaxAge)
+	}
+	start := resp.ThisUpdate
+	if start.IsZero() || start.After(now) {
+		start = now
+	}
+	s.ocspRefresh = start.Add(s.ocspExpiry.Sub(start) / 2)
+}
+
+// fetchOCSP obtains an OCSP response for the leaf of cert, issued by the
+// second certificate of its chain, from the responders listed in the leaf.
+// They are tried in order, skipping those which recently failed.
+func (m *Manager) fetchOCSP(ctx context.Context, cert *tls.Certificate) ([]byte, *ocsp.Response, error) {
+	leaf := cert.Leaf
+	if len(leaf.OCSPServer) == 0 {
+		return nil, nil, errors.New("acme/autocert: certificate has no OCSP responder")
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var errs []string
+	for _, url := range leaf.OCSPServer {
+		if !m.ocspResponderUp(url) {
+			errs = append(errs, fmt.Sprintf("%s: skipped after a recent failure", url))
+			continue
+		}
+		der, resp, err := m.queryOCSP(ctx, url, req, leaf, issuer)
+		if err == nil {
+			return der, resp, nil
+		}
+		m.ocspResponderFailed(url)
+		errs = append(errs, fmt.Sprintf("%s: %v", url, err))
+	}
+	return nil, nil, fmt.Errorf("acme/autocert: no OCSP response for %q: %s", leaf.Subject.CommonName, strings.Join(errs, "; "))
+}
+
+// queryOCSP sends the OCSP request req to the responder at url.
+func (m *Manager) queryOCSP(ctx context.Context, url string, req []byte, leaf, issuer *x509.Certificate) ([]byte, *ocsp.Response, error) {
+	r, err := http.NewRequest("POST", url, bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	r.Header.Set("Content-Type", "application/ocsp-request")
+	hc := http.DefaultClient
+	if m.Client != nil && m.Client.HTTPClient != nil {
+		hc = m.Client.HTTPClient
+	}
+	res, err := hc.Do(r.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("responder status %s", res.Status)
+	}
+	der, err := ioutil.ReadAll(io.LimitReader(res.Body, maxOCSPResponseSize+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(der) > maxOCSPResponseSize {
+		return nil, nil, errors.New("response too big")
+	}
+	resp, err := ocsp.ParseResponseForCert(der, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.Status == ocsp.Unknown {
+		return nil, nil, errors.New("certificate status unknown")
+	}
+	return der, resp, nil
+}
+
+// ocspResponderUp reports whether the OCSP responder at url may be queried.
+func (m *Manager) ocspResponderUp(url string) bool {
+	m.ocspMu.Lock()
+	defer m.ocspMu.Unlock()
+	return !m.now().Before(m.ocspDown[url])
+}
+
+// ocspResponderFailed makes the OCSP responder at url skipped for a while.
+func (m *Manager) ocspResponderFailed(url string) {
+	m.ocspMu.Lock()
+	defer m.ocspMu.Unlock()
+	if m.ocspDown == nil {
+		m.ocspDown = make(map[string]time.Time)
+	}
+	m.ocspDown[url] = m.now().Add(ocspResponderBackoff)
+}
@@ -0,0 +1,55 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"bytes"
+	"encoding/base32"
+	"errors"
+	"strings"
+
+	"github.com/robarchibald/crypto/sha3"
+)
+
+// Tor onion service names, as specified in rend-spec-v3, section 6,
+// end with a label encoding the service's ed25519 public key.
+// Only version 3 addresses can be validated by CAs.
+const (
+	onionSuffix       = ".onion"
+	onionAddrLen      = 56 // base32 of pubkey (32) | checksum (2) | version (1)
+	onionVersion      = 3
+	onionChecksumSalt = ".onion checksum"
+)
+
+// isOnion reports whether name is a Tor onion service name.
+func isOnion(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), onionSuffix)
+}
+
+// checkOnion returns an error if the onion service name is not a well-formed
+// version 3 address, optionally preceded by subdomains.
+func checkOnion(name string) error {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(name), onionSuffix), ".")
+	addr := labels[len(labels)-1]
+	if len(addr) != onionAddrLen {
+		return errors.New("acme/autocert: onion address is not a version 3 address")
+	}
+	b, err := base32.StdEncoding.DecodeString(strings.ToUpper(addr))
+	if err != nil {
+		return errors.New("acme/autocert: onion address is not valid base32")
+	}
+	pub, checksum, version := b[:32], b[32:34], b[34]
+	if version != onionVersion {
+		return errors.New("acme/autocert: onion address is not a version 3 address")
+	}
+	h := sha3.New256()
+	h.Write([]byte(onionChecksumSalt))
+	h.Write(pub)
+	h.Write([]byte{version})
+	if !bytes.Equal(h.Sum(nil)[:2], checksum) {
+		return errors.New("acme/autocert: onion address has an invalid checksum")
+	}
+	return nil
+}
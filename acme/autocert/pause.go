@@ -0,0 +1,47 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+// PauseRenewal pauses the renewals of the certificates m holds until
+// ResumeRenewal is called, for instance during a maintenance of the CA.
+// The renewals in progress complete but are not rescheduled, and no other
+// renewal starts, including the synchronous ones of the expired
+// certificates, which are served as long as ServeExpiredGracePeriod permits.
+// The certificates are still served, and obtained for the domains m holds
+// none for yet. ForceRenew and RotateSharedCertKey still renew certificates,
+// as does CompromisedKeyCheck.
+func (m *Manager) PauseRenewal() {
+	m.renewalPaused.Store(true)
+}
+
+// ResumeRenewal resumes the renewals paused by PauseRenewal, rescheduled
+// according to the expiration times of the current certificates: those
+// which became due while paused are renewed right away.
+func (m *Manager) ResumeRenewal() {
+	if !m.renewalPaused.Swap(false) {
+		return
+	}
+	m.renewalMu.Lock()
+	renewals := make([]*domainRenewal, 0, len(m.renewal))
+	for _, dr := range m.renewal {
+		renewals = append(renewals, dr)
+	}
+	m.renewalMu.Unlock()
+	for _, dr := range renewals {
+		dr.resume()
+	}
+}
+
+// resume reschedules the renewal if its timer fired while paused.
+// The timers which have not fired yet are left alone.
+func (dr *domainRenewal) resume() {
+	dr.timerMu.Lock()
+	defer dr.timerMu.Unlock()
+	if dr.timer == nil || !dr.idle {
+		return
+	}
+	dr.idle = false
+	dr.schedule(dr.next(dr.exp))
+}
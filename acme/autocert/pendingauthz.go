@@ -0,0 +1,81 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/robarchibald/crypto/acme"
+)
+
+// pendingAuthzCacheKey returns the cache key under which the URL of the
+// pending authorization of domain is stored while verify runs.
+func pendingAuthzCacheKey(domain string) string {
+	return domain + "+authz"
+}
+
+// pendingAuthz is the cache entry of a pending authorization.
+type pendingAuthz struct {
+	CA    string `json:"ca"`    // directory URL of the CA
+	Authz string `json:"authz"` // URL of the authorization
+}
+
+// cachedPendingAuthz returns the authorization of domain left pending in
+// cache by a previous verify which did not return, for instance because the
+// process died, if it is still pending or valid. A new authorization, which
+// counts against the rate limits of the CA, is then not needed. It returns
+// nil if there is none, and forgets it if it cannot be resumed.
+func (m *Manager) cachedPendingAuthz(ctx context.Context, client *acme.Client, domain string) *acme.Authorization {
+	if m.Cache == nil {
+		return nil
+	}
+	data, err := m.Cache.Get(ctx, pendingAuthzCacheKey(domain))
+	if err != nil {
+		return nil
+	}
+	var p pendingAuthz
+	if err := json.Unmarshal(data, &p); err != nil || p.CA != m.directoryURL() {
+		m.forgetPendingAuthz(domain)
+		return nil
+	}
+	authz, err := client.GetAuthorization(ctx, p.Authz)
+	switch {
+	case err != nil,
+		authz.Status != acme.StatusPending && authz.Status != acme.StatusValid,
+		authz.Identifier.Value != "" && authz.Identifier.Value != domain:
+		m.forgetPendingAuthz(domain)
+		return nil
+	}
+	authz.URI = p.Authz
+	return authz
+}
+
+// rememberPendingAuthz stores uri, the URL of a new pending authorization
+// of domain, in cache until verify returns. Errors are ignored: the
+// authorization can still be completed, but not resumed.
+func (m *Manager) rememberPendingAuthz(ctx context.Context, domain, uri string) {
+	if m.Cache == nil {
+		return
+	}
+	data, err := json.Marshal(pendingAuthz{CA: m.directoryURL(), Authz: uri})
+	if err != nil {
+		return
+	}
+	m.Cache.Put(ctx, pendingAuthzCacheKey(domain), data)
+}
+
+// forgetPendingAuthz removes the pending authorization of domain from
+// cache, once it is validated or revoked by verify.
+func (m *Manager) forgetPendingAuthz(domain string) {
+	if m.Cache == nil {
+		return
+	}
+	// The context of verify may be done.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	m.Cache.Delete(ctx, pendingAuthzCacheKey(domain))
+}
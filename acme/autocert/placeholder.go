@@ -0,0 +1,114 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log"
+	"math/big"
+	"time"
+)
+
+// placeholderValidity is the validity of the certificates served while the
+// first certificate of a domain is issued; see Manager.PlaceholderCert.
+// It exceeds the time a first-time issuance is allowed to take.
+const placeholderValidity = 10 * time.Minute
+
+// placeholder returns the placeholder certificate of ck if its first
+// certificate is being issued in the background, or nil.
+func (m *Manager) placeholder(ck certKey) *tls.Certificate {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	return m.placeholders[ck]
+}
+
+// issueInBackground starts the issuance of the first certificate of ck,
+// unless it is already running, and returns the placeholder certificate
+// to serve meanwhile.
+func (m *Manager) issueInBackground(ck certKey) (*tls.Certificate, error) {
+	if p := m.placeholder(ck); p != nil {
+		return p, nil
+	}
+	// The key is generated without holding stateMu,
+	// which the other handshakes need meanwhile.
+	p, err := m.placeholderCert(ck)
+	if err != nil {
+		return nil, err
+	}
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	if p := m.placeholders[ck]; p != nil {
+		// Another handshake won the race.
+		return p, nil
+	}
+	if m.placeholders == nil {
+		m.placeholders = make(map[certKey]*tls.Certificate)
+	}
+	m.placeholders[ck] = p
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		_, err := m.createCert(ctx, ck)
+		if err != nil {
+			log.Printf("acme/autocert: background issuance for %q failed: %v", ck.domain, err)
+		}
+		// The following handshakes get the certificate from m.state, or
+		// the error of the issuance until it is attempted again.
+		m.stateMu.Lock()
+		delete(m.placeholders, ck)
+		m.stateMu.Unlock()
+		testDidIssueInBackground(ck, err)
+	}()
+	return p, nil
+}
+
+// placeholderCert returns a new self-signed certificate for ck.domain,
+// valid for placeholderValidity, with a key of the type of ck.
+func (m *Manager) placeholderCert(ck certKey) (*tls.Certificate, error) {
+	key, err := m.certKeyType(ck).generate()
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := m.now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: ck.domain},
+		DNSNames:              []string{ck.domain},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(placeholderValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if m.certKeyType(ck).isRSA() {
+		tmpl.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// testDidIssueInBackground is called after each issuance started by
+// issueInBackground, in tests.
+var testDidIssueInBackground = func(ck certKey, err error) {}
@@ -0,0 +1,73 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"fmt"
+	"time"
+)
+
+// readOnlyReloadInterval is how often a read-only Manager reads the Cache
+// again for a certificate due for renewal.
+const readOnlyReloadInterval = time.Minute
+
+// readOnlyCert returns the certificate to serve for ck, whose current one is
+// cert, as a read-only Manager: cert itself, unless it is due for renewal and
+// the Cache holds one expiring later.
+func (m *Manager) readOnlyCert(ctx context.Context, ck certKey, cert *tls.Certificate) (*tls.Certificate, error) {
+	now := m.now()
+	if cert.Leaf.NotAfter.Sub(now) < m.renewBefore() {
+		if fresh := m.reloadCert(ctx, ck, cert); fresh != nil {
+			cert = fresh
+		}
+	}
+	if exp := cert.Leaf.NotAfter; !now.Before(exp) && now.After(exp.Add(m.ServeExpiredGracePeriod)) {
+		return nil, fmt.Errorf("acme/autocert: certificate for %q expired at %v and the Manager is read-only", ck.domain, exp)
+	}
+	return m.stapled(ctx, ck, cert), nil
+}
+
+// reloadCert reads the certificate of ck from the Cache again, unless it
+// did so less than readOnlyReloadInterval ago, and adopts it if it expires
+// later than cert. It returns the adopted certificate or nil.
+func (m *Manager) reloadCert(ctx context.Context, ck certKey, cert *tls.Certificate) *tls.Certificate {
+	now := m.now()
+	m.reloadMu.Lock()
+	if last, ok := m.reloaded[ck]; ok && now.Sub(last) < readOnlyReloadInterval {
+		m.reloadMu.Unlock()
+		return nil
+	}
+	if m.reloaded == nil {
+		m.reloaded = make(map[certKey]time.Time)
+	}
+	m.reloaded[ck] = now
+	m.reloadMu.Unlock()
+
+	fresh, err := m.cacheLoad(ctx, ck, now)
+	if err != nil || !fresh.Leaf.NotAfter.After(cert.Leaf.NotAfter) {
+		return nil
+	}
+	signer, ok := fresh.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil
+	}
+	m.stateMu.Lock()
+	m.state[ck] = &certState{
+		key:  signer,
+		cert: fresh.Certificate,
+		leaf: fresh.Leaf,
+	}
+	m.addAliases(ck, fresh.Leaf)
+	m.stateMu.Unlock()
+	if lru := m.certLRU(); lru != nil {
+		lru.remove(ck)
+		lru.add(ck, fresh)
+	}
+	m.cacheLoaded(ck, fresh)
+	return fresh
+}
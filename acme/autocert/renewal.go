@@ -7,7 +7,11 @@ package autocert
 import (
 	"context"
 	"crypto"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"log"
 	"sync"
 	"time"
 )
@@ -15,6 +19,9 @@ import (
 // renewJitter is the maximum deviation from Manager.RenewBefore.
 const renewJitter = time.Hour
 
+// defaultRenewalErrorLogInterval is the default of Manager.RenewalErrorLogInterval.
+const defaultRenewalErrorLogInterval = time.Hour
+
 // domainRenewal tracks the state used by the periodic timers
 // renewing a single domain's cert.
 type domainRenewal struct {
@@ -24,10 +31,82 @@ type domainRenewal struct {
 
 	timerMu sync.Mutex
 	timer   *time.Timer
+	exp     time.Time // expiration time of the current cert; guarded by timerMu
+
+	// syncFailed is the time of the last failed renewNow; guarded by timerMu.
+	syncFailed time.Time
+
+	// idle is set when the renewal timer fired while renewals were paused
+	// by Manager.PauseRenewal; guarded by timerMu.
+	idle bool
+
+	// halted is set when the renewal failed with an error which is not
+	// retried until Manager.ForceRenew; guarded by timerMu.
+	halted bool
+
+	// reconcileTimer runs reconcile every Manager.ReconcileInterval;
+	// guarded by timerMu.
+	reconcileTimer *time.Timer
+
+	// dnsCheckTimer runs checkDNS every Manager.DomainDNSCheck.Interval,
+	// and misconfigured holds the names it last found not to resolve to
+	// the server; guarded by timerMu.
+	dnsCheckTimer *time.Timer
+	misconfigured map[string]bool
+
+	// compromiseTimer runs checkCompromise every
+	// Manager.CompromisedKeyCheckInterval; guarded by timerMu.
+	compromiseTimer *time.Timer
+
+	// expiryTimer runs checkExpiry every expiryCheckInterval, and
+	// expiryWarned is the expiration time of the last cert it warned
+	// about; guarded by timerMu. See Manager.ExpiryWarningThreshold.
+	expiryTimer  *time.Timer
+	expiryWarned time.Time
+
+	// The last renewal error logged, when it was, and how many times it
+	// has been repeated since without being logged; guarded by timerMu.
+	// See Manager.RenewalErrorLogInterval.
+	loggedErr    string
+	loggedErrAt  time.Time
+	repeatedErrs int
+
+	// spare is the warm spare replacing the current cert once activated,
+	// see Manager.WarmSpare; guarded by timerMu.
+	spare *certState
+
+	// stats is a copy of the renewal state reported by Manager.Stats;
+	// guarded by Manager.statsMu.
+	stats renewalStats
+}
+
+// renewalStats is the state of a domainRenewal reported by Manager.Stats
+// and Manager.RenewalReport.
+type renewalStats struct {
+	exp      time.Time // expiration time of the current cert
+	due      time.Time // when the renewal timer fires; zero if halted
+	failures int       // failed renewals since the last successful one
+	lastAt   time.Time // when the last renewal attempt ended
+	lastErr  error     // error of the last renewal attempt
 }
 
+// syncRenewRetryAfter is how long renewNow waits after a failure
+// before attempting another synchronous renewal.
+const syncRenewRetryAfter = time.Minute
+
+var errRenewalPending = errors.New("acme/autocert: renewal in progress or recently failed")
+
+var errRenewalPaused = errors.New("acme/autocert: renewal paused")
+
+var errRenewalRemoved = errors.New("acme/autocert: certificate removed during renewal")
+
+// errRenewalDeferred is returned by domainRenewal.do when the renewal is put
+// off, for instance to the renewal window of the CA, rather than attempted.
+var errRenewalDeferred = errors.New("acme/autocert: renewal deferred")
+
 // start starts a cert renewal timer at the time
-// defined by the certificate expiration time exp.
+// defined by the certificate expiration time exp,
+// delayed by up to Manager.StartupJitter.
 //
 // If the timer is already started, calling start is a noop.
 func (dr *domainRenewal) start(exp time.Time) {
@@ -37,7 +116,38 @@ func (dr *domainRenewal) start(exp time.Time) {
 	if dr.timer != nil {
 		return
 	}
-	dr.timer = time.AfterFunc(dr.next(exp), dr.renew)
+	dr.exp = exp
+	d := dr.next(exp)
+	if j := dr.m.StartupJitter; j > 0 {
+		d += time.Duration(pseudoRand.int63n(int64(j)))
+	}
+	dr.schedule(d)
+	if d := dr.m.ReconcileInterval; d > 0 {
+		dr.reconcileTimer = time.AfterFunc(d, dr.reconcile)
+	}
+	if dr.m.DomainDNSCheck != nil {
+		dr.dnsCheckTimer = time.AfterFunc(0, dr.checkDNS)
+	}
+	if dr.m.CompromisedKeyCheck != nil {
+		dr.compromiseTimer = time.AfterFunc(0, dr.checkCompromise)
+	}
+	if dr.m.ExpiryWarningThreshold > 0 {
+		dr.expiryTimer = time.AfterFunc(0, dr.checkExpiry)
+	}
+}
+
+// reschedule restarts an armed renewal timer, for instance after
+// Manager.RenewBefore has changed.
+// If the timer is stopped or has already fired, calling reschedule is a noop.
+func (dr *domainRenewal) reschedule() {
+	dr.timerMu.Lock()
+	defer dr.timerMu.Unlock()
+	if dr.timer == nil || !dr.timer.Stop() {
+		// A renewal which has already fired schedules
+		// the next one itself.
+		return
+	}
+	dr.schedule(dr.next(dr.exp))
 }
 
 // stop stops the cert renewal timer.
@@ -51,6 +161,22 @@ func (dr *domainRenewal) stop() {
 	}
 	dr.timer.Stop()
 	dr.timer = nil
+	if dr.reconcileTimer != nil {
+		dr.reconcileTimer.Stop()
+		dr.reconcileTimer = nil
+	}
+	if dr.dnsCheckTimer != nil {
+		dr.dnsCheckTimer.Stop()
+		dr.dnsCheckTimer = nil
+	}
+	if dr.compromiseTimer != nil {
+		dr.compromiseTimer.Stop()
+		dr.compromiseTimer = nil
+	}
+	if dr.expiryTimer != nil {
+		dr.expiryTimer.Stop()
+		dr.expiryTimer = nil
+	}
 }
 
 // renew is called periodically by a timer.
@@ -62,21 +188,181 @@ func (dr *domainRenewal) renew() {
 	if dr.timer == nil {
 		return
 	}
+	if dr.m.renewalPaused.Load() {
+		// Rescheduled by ResumeRenewal.
+		dr.idle = true
+		return
+	}
 
 	fmt.Println("domainRenewal renew getting context")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	ctx, done, err := dr.m.beginWork(context.Background())
+	if err != nil {
+		// Stopped by Shutdown.
+		return
+	}
+	defer done()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
 	defer cancel()
 	// TODO: rotate dr.key at some point?
 	fmt.Println("domainRenewal renew calling do")
 	next, err := dr.do(ctx)
-	if err != nil {
-		next = renewJitter / 2
-		next += time.Duration(pseudoRand.int63n(int64(next)))
+	if err == errRenewalDeferred {
+		// Neither a success nor a failure.
+		err = nil
+	} else {
+		dr.recordResult(err)
+		dr.logResult(err)
+	}
+	var berr *BudgetExhaustedError
+	switch {
+	case errors.As(err, &berr):
+		// Nothing to do until the CA may be asked again.
+		next = berr.RetryAt.Sub(dr.m.now())
+		if next < 0 {
+			next = 0
+		}
+	case err != nil:
+		dr.m.statsMu.Lock()
+		failures := dr.stats.failures
+		dr.m.statsMu.Unlock()
+		var retry bool
+		if next, retry = retryDelay(err, failures); !retry {
+			// Rescheduled by forceRenew.
+			dr.halted = true
+			dr.m.statsMu.Lock()
+			dr.stats.due = time.Time{}
+			dr.m.statsMu.Unlock()
+			testDidRenewLoop(0, err)
+			return
+		}
 	}
-	dr.timer = time.AfterFunc(next, dr.renew)
+	dr.schedule(next)
 	testDidRenewLoop(next, err)
 }
 
+// reconcile is called periodically by a timer if Manager.ReconcileInterval
+// is set. It adopts the cert in cache if it expires later than the current one,
+// as happens when another Manager sharing the cache has renewed it,
+// and reschedules the renewal accordingly.
+func (dr *domainRenewal) reconcile() {
+	dr.timerMu.Lock()
+	defer dr.timerMu.Unlock()
+	if dr.timer == nil {
+		return
+	}
+	defer func() {
+		dr.reconcileTimer = time.AfterFunc(dr.m.ReconcileInterval, dr.reconcile)
+		testDidReconcile(dr.ck)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if lru := dr.m.certLRU(); lru != nil {
+		lru.remove(dr.ck)
+	}
+	tlscert, err := dr.m.cacheGet(ctx, dr.ck)
+	if err != nil || !tlscert.Leaf.NotAfter.After(dr.exp) {
+		return
+	}
+	signer, ok := tlscert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return
+	}
+	dr.updateState(&certState{
+		key:  signer,
+		cert: tlscert.Certificate,
+		leaf: tlscert.Leaf,
+	})
+	dr.exp = tlscert.Leaf.NotAfter
+	if dr.timer.Stop() {
+		dr.schedule(dr.next(dr.exp))
+	}
+}
+
+// renewNow renews the cert immediately, rescheduling the renewal timer
+// if it is armed, and returns the new cert.
+// To avoid blocking, it fails with errRenewalPending if a renewal is already
+// in progress or if the previous attempt failed less than syncRenewRetryAfter ago.
+func (dr *domainRenewal) renewNow(ctx context.Context) (*tls.Certificate, error) {
+	if !dr.timerMu.TryLock() {
+		return nil, errRenewalPending
+	}
+	defer dr.timerMu.Unlock()
+	if !dr.syncFailed.IsZero() && dr.m.now().Before(dr.syncFailed.Add(syncRenewRetryAfter)) {
+		return nil, errRenewalPending
+	}
+	if dr.m.renewalPaused.Load() {
+		return nil, errRenewalPaused
+	}
+	ctx, done, err := dr.m.beginWork(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	next, err := dr.do(ctx)
+	switch {
+	case err == errRenewalDeferred:
+		// The current cert is returned.
+	case err != nil:
+		dr.recordResult(err)
+		dr.syncFailed = dr.m.now()
+		return nil, err
+	default:
+		dr.recordResult(nil)
+		dr.syncFailed = time.Time{}
+	}
+	if dr.timer != nil && dr.timer.Stop() {
+		dr.schedule(next)
+	}
+	dr.m.stateMu.Lock()
+	state, ok := dr.m.state[dr.ck]
+	dr.m.stateMu.Unlock()
+	if !ok {
+		// Removed meanwhile, for instance by Forget.
+		return nil, errRenewalRemoved
+	}
+	state.RLock()
+	defer state.RUnlock()
+	return state.tlscert()
+}
+
+// forceRenew renews the cert immediately, even if it is not due,
+// rescheduling the renewal timer if it is armed.
+func (dr *domainRenewal) forceRenew(ctx context.Context) error {
+	dr.timerMu.Lock()
+	defer dr.timerMu.Unlock()
+	ctx, done, err := dr.m.beginWork(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+	next, err := dr.issue(ctx, false)
+	dr.recordResult(err)
+	if err != nil {
+		return err
+	}
+	dr.syncFailed = time.Time{}
+	if dr.timer != nil && (dr.halted || dr.timer.Stop()) {
+		dr.halted = false
+		dr.schedule(next)
+	}
+	return nil
+}
+
+// adopt makes state the current cert of dr, as Manager.Rollback does,
+// and reschedules the renewal timer according to its expiration time
+// if the timer is armed.
+func (dr *domainRenewal) adopt(state *certState) {
+	dr.timerMu.Lock()
+	defer dr.timerMu.Unlock()
+	dr.updateState(state)
+	dr.exp = state.leaf.NotAfter
+	if dr.timer != nil && dr.timer.Stop() {
+		dr.schedule(dr.next(dr.exp))
+	}
+}
+
 // updateState locks and replaces the relevant Manager.state item with the given
 // state. It additionally updates dr.key with the given state's key.
 func (dr *domainRenewal) updateState(state *certState) {
@@ -85,6 +371,7 @@ func (dr *domainRenewal) updateState(state *certState) {
 	defer dr.m.stateMu.Unlock()
 	dr.key = state.key
 	dr.m.state[dr.ck] = state
+	dr.m.addAliases(dr.ck, state.leaf)
 }
 
 // do is similar to Manager.createCert but it doesn't lock a Manager.state item.
@@ -95,14 +382,34 @@ func (dr *domainRenewal) updateState(state *certState) {
 // cached cert is far enough in the future.
 //
 // The returned value is a time interval after which the renewal should occur again.
-func (dr *domainRenewal) do(ctx context.Context) (time.Duration, error) {
+// If the renewal is deferred, for instance to the renewal window of the CA,
+// the error is errRenewalDeferred.
+func (dr *domainRenewal) do(ctx context.Context) (next time.Duration, err error) {
 	fmt.Println("domainRenewal do called")
+	ctx, sp := dr.m.startCASpan(ctx, "autocert.renew", dr.ck.domain)
+	defer func() {
+		if err == errRenewalDeferred {
+			sp.end(nil)
+		} else {
+			sp.end(err)
+		}
+	}()
 	// a race is likely unavoidable in a distributed environment
 	// but we try nonetheless
+	if lru := dr.m.certLRU(); lru != nil {
+		// Another Manager sharing the Cache may have already renewed the cert.
+		lru.remove(dr.ck)
+	}
 	if tlscert, err := dr.m.cacheGet(ctx, dr.ck); err == nil {
 		fmt.Println("domainRenewal do inside cacheGet")
 		next := dr.next(tlscert.Leaf.NotAfter)
-		if next > dr.m.renewBefore()+renewJitter {
+		fresh := next > dr.m.renewBefore()+renewJitter
+		if dr.m.RenewSchedule != nil {
+			// The cert is renewed at every slot: only a cert renewed
+			// by another Manager since is fresh.
+			fresh = next > 0 && tlscert.Leaf.NotAfter.After(dr.exp)
+		}
+		if fresh && !dr.m.belowMinServingValidity(tlscert) {
 			signer, ok := tlscert.PrivateKey.(crypto.Signer)
 			if ok {
 				fmt.Println("domainRenewal do inside ok")
@@ -113,38 +420,169 @@ func (dr *domainRenewal) do(ctx context.Context) (time.Duration, error) {
 				}
 				fmt.Println("domainRenewal do calling updateState")
 				dr.updateState(state)
+				dr.exp = tlscert.Leaf.NotAfter
+				dr.spare = nil
 				return next, nil
 			}
 		}
 	}
 
-	fmt.Println("domainRenewal do calling authorizedCert")
-	der, leaf, err := dr.m.authorizedCert(ctx, dr.key, dr.ck)
+	if dr.m.WarmSpare {
+		if d, ok, err := dr.pendingSpare(ctx); ok {
+			return d, err
+		}
+	}
+	if dr.m.DeferToRenewalWindow {
+		if d := dr.windowDelay(ctx); d > 0 {
+			return d, errRenewalDeferred
+		}
+	}
+	if d := dr.issuanceWindowDelay(); d > 0 {
+		return d, errRenewalDeferred
+	}
+
+	return dr.issue(ctx, dr.m.WarmSpare)
+}
+
+// issue requests a new certificate from the CA, unless the issuance budget
+// of the domain is exhausted, and upon success replaces dr.m.state item with
+// a new one and updates cache for the given domain. If spare is true, the
+// new certificate is instead kept as a warm spare, see Manager.WarmSpare.
+//
+// The returned value is a time interval after which the renewal should occur again.
+func (dr *domainRenewal) issue(ctx context.Context, spare bool) (next time.Duration, err error) {
+	if err := dr.m.checkIssuanceBudget(dr.ck.domain); err != nil {
+		return 0, err
+	}
+	if dr.m.AdmitRenewals {
+		if err := dr.m.admit(ctx, dr.ck.domain); err != nil {
+			return 0, err
+		}
+	}
+	key := dr.key
+	if dr.m.SharedCertKey {
+		// The shared key may have been rotated.
+		if key, err = dr.m.sharedCertKey(ctx, dr.m.certKeyType(dr.ck)); err != nil {
+			return 0, err
+		}
+	}
+	der, leaf, certURL, err := dr.m.authorizedCert(ctx, key, dr.ck)
+	defer func() {
+		dr.m.auditIssuance(ctx, dr.ck, true, certURL, leaf, err)
+		if err != nil {
+			dr.m.issuanceFailed(dr.ck.domain, err)
+		} else {
+			dr.m.issuanceSucceeded(dr.ck.domain)
+		}
+	}()
 	if err != nil {
 		return 0, err
 	}
 	state := &certState{
-		key:  dr.key,
+		key:  key,
 		cert: der,
 		leaf: leaf,
 	}
-	fmt.Println("domainRenewal do calling tlscert")
 	tlscert, err := state.tlscert()
 	if err != nil {
 		return 0, err
 	}
-	fmt.Println("domainRenewal do calling cachePut")
+	if err := dr.m.validateCert(dr.ck, tlscert); err != nil {
+		return 0, err
+	}
+	dr.m.notifyIssued(ctx, dr.ck, der)
+	if spare {
+		return dr.keepSpare(ctx, state, tlscert)
+	}
 	if err := dr.m.cachePut(ctx, dr.ck, tlscert); err != nil {
 		return 0, err
 	}
-	fmt.Println("domainRenewal do calling updateState")
 	dr.updateState(state)
+	dr.exp = leaf.NotAfter
+	dr.spare = nil
 	return dr.next(leaf.NotAfter), nil
 }
 
+// schedule arms the renewal timer to fire after d
+// and records the schedule in dr.stats.
+// It must be called with dr.timerMu held.
+func (dr *domainRenewal) schedule(d time.Duration) {
+	dr.timer = time.AfterFunc(d, dr.renew)
+	dr.m.statsMu.Lock()
+	defer dr.m.statsMu.Unlock()
+	dr.stats.exp = dr.exp
+	dr.stats.due = dr.m.now().Add(d)
+}
+
+// recordResult counts a failed renewal in dr.stats and by reason in
+// Manager.RenewalFailures, or resets the count of dr.stats if err is nil,
+// and records the outcome of the renewal and the expiration
+// time of the current cert.
+// It must be called with dr.timerMu held.
+func (dr *domainRenewal) recordResult(err error) {
+	dr.m.statsMu.Lock()
+	defer dr.m.statsMu.Unlock()
+	dr.stats.exp = dr.exp
+	dr.stats.lastAt = dr.m.now()
+	dr.stats.lastErr = err
+	if err != nil {
+		dr.stats.failures++
+		if dr.m.renewalFailures == nil {
+			dr.m.renewalFailures = make(map[string]int)
+		}
+		dr.m.renewalFailures[FailureReason(err)]++
+	} else {
+		dr.stats.failures = 0
+	}
+}
+
+// logResult logs err, the error of a renewal attempt, unless it is the same
+// as the one logged less than Manager.RenewalErrorLogInterval ago, in which
+// case it is only counted. The errors logged by the issuance budget are not
+// logged again. dr.timerMu must be held.
+func (dr *domainRenewal) logResult(err error) {
+	var berr *BudgetExhaustedError
+	var gerr *GiveUpError
+	if errors.As(err, &berr) || errors.As(err, &gerr) {
+		return
+	}
+	if err == nil {
+		if dr.repeatedErrs > 0 {
+			log.Printf("acme/autocert: renewal of %q succeeded after %d more failures: %s", dr.ck, dr.repeatedErrs, dr.loggedErr)
+		}
+		dr.loggedErr, dr.loggedErrAt, dr.repeatedErrs = "", time.Time{}, 0
+		return
+	}
+	interval := dr.m.RenewalErrorLogInterval
+	if interval <= 0 {
+		interval = defaultRenewalErrorLogInterval
+	}
+	now := dr.m.now()
+	msg := err.Error()
+	if msg == dr.loggedErr && now.Sub(dr.loggedErrAt) < interval {
+		dr.repeatedErrs++
+		return
+	}
+	if msg == dr.loggedErr && dr.repeatedErrs > 0 {
+		log.Printf("acme/autocert: renewal of %q failed %d times since %v: %v", dr.ck, dr.repeatedErrs+1, dr.loggedErrAt.Format(time.RFC3339), err)
+	} else {
+		log.Printf("acme/autocert: renewal of %q failed: %v", dr.ck, err)
+	}
+	dr.loggedErr, dr.loggedErrAt, dr.repeatedErrs = msg, now, 0
+}
+
 func (dr *domainRenewal) next(expiry time.Time) time.Duration {
 	fmt.Println("domainRenewal next called")
-	d := expiry.Sub(dr.m.now()) - dr.m.renewBefore()
+	now := dr.m.now()
+	if dr.m.RenewSchedule != nil {
+		if slot := dr.m.RenewSchedule(now); !slot.IsZero() && slot.Before(expiry) {
+			if d := slot.Sub(now); d > 0 {
+				return d
+			}
+			return 0
+		}
+	}
+	d := expiry.Sub(now) - dr.m.renewBefore() - dr.m.staggerOffset(dr.ck)
 	// add a bit of randomness to renew deadline
 	n := pseudoRand.int63n(int64(renewJitter))
 	d -= time.Duration(n)
@@ -154,4 +592,48 @@ func (dr *domainRenewal) next(expiry time.Time) time.Duration {
 	return d
 }
 
+// issuanceWindowDelay returns how long the renewal of the current cert of dr
+// is deferred to the opening of the next Manager.IssuanceWindow, or zero if
+// it is not. It must be called with dr.timerMu held.
+func (dr *domainRenewal) issuanceWindowDelay() time.Duration {
+	if dr.m.IssuanceWindow == nil || dr.exp.IsZero() {
+		return 0
+	}
+	now := dr.m.now()
+	open := dr.m.IssuanceWindow(now)
+	if !open.After(now) {
+		return 0
+	}
+	if open.After(dr.exp.Add(-dr.m.renewalMargin())) {
+		// Waiting would risk the cert expiring before it is renewed.
+		return 0
+	}
+	return open.Sub(now)
+}
+
+// renewalMargin returns how much validity must be left to the current cert
+// by the renewals delayed past the time they are due, waiting for the
+// renewal window of the CA, for an issuance window or for the activation
+// of a warm spare: half of RenewBefore, or MinServingValidity if longer.
+func (m *Manager) renewalMargin() time.Duration {
+	margin := m.renewBefore() / 2
+	if m.MinServingValidity > margin {
+		margin = m.MinServingValidity
+	}
+	return margin
+}
+
+// staggerOffset returns how much earlier than RenewBefore the certificate of
+// ck is renewed: a fixed duration within m.RenewStagger derived from ck.
+func (m *Manager) staggerOffset(ck certKey) time.Duration {
+	if m.RenewStagger <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(ck.String()))
+	return time.Duration(h.Sum64() % uint64(m.RenewStagger))
+}
+
 var testDidRenewLoop = func(next time.Duration, err error) {}
+
+var testDidReconcile = func(ck certKey) {}
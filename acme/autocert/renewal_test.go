@@ -5,16 +5,32 @@
 package autocert
 
 import (
+	"bytes"
 	"context"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -25,7 +41,7 @@ func TestRenewalNext(t *testing.T) {
 	now := time.Now()
 	man := &Manager{
 		RenewBefore: 7 * 24 * time.Hour,
-		nowFunc:     func() time.Time { return now },
+		Now:         func() time.Time { return now },
 	}
 	defer man.stopRenew()
 	tt := []struct {
@@ -47,10 +63,191 @@ func TestRenewalNext(t *testing.T) {
 	}
 }
 
-func TestRenewFromCache(t *testing.T) {
+func TestRenewalNextSchedule(t *testing.T) {
+	now := time.Date(2019, time.May, 8, 15, 4, 5, 0, time.UTC)
+	// 02:00 on the first Sunday of each month.
+	firstSunday := func(now time.Time) time.Time {
+		for m := 0; ; m++ {
+			d := time.Date(now.Year(), now.Month()+time.Month(m), 1, 2, 0, 0, 0, time.UTC)
+			for d.Weekday() != time.Sunday {
+				d = d.AddDate(0, 0, 1)
+			}
+			if d.After(now) {
+				return d
+			}
+		}
+	}
+	slot := time.Date(2019, time.June, 2, 2, 0, 0, 0, time.UTC)
+	man := &Manager{
+		RenewBefore:   7 * 24 * time.Hour,
+		RenewSchedule: firstSunday,
+		Now:           func() time.Time { return now },
+	}
+	defer man.stopRenew()
+	tt := []struct {
+		expiry   time.Time
+		min, max time.Duration
+	}{
+		// On the next slot, even before RenewBefore.
+		{now.Add(90 * 24 * time.Hour), slot.Sub(now), slot.Sub(now)},
+		// On the next slot, even after RenewBefore.
+		{slot.Add(time.Hour), slot.Sub(now), slot.Sub(now)},
+		// Expiring before the next slot.
+		{now.Add(10 * 24 * time.Hour), 3*24*time.Hour - renewJitter, 3 * 24 * time.Hour},
+		{now, 0, 1},
+	}
+
+	dr := &domainRenewal{m: man}
+	for i, test := range tt {
+		next := dr.next(test.expiry)
+		if next < test.min || test.max < next {
+			t.Errorf("%d: next = %v; want between %v and %v", i, next, test.min, test.max)
+		}
+	}
+
+	// No more slots.
+	man.RenewSchedule = func(time.Time) time.Time { return time.Time{} }
+	if next, want := dr.next(now.Add(90*24*time.Hour)), 83*24*time.Hour; next < want-renewJitter || want < next {
+		t.Errorf("without slot: next = %v; want between %v and %v", next, want-renewJitter, want)
+	}
+}
+
+func TestRenewalNextStagger(t *testing.T) {
+	now := time.Now()
+	const stagger = 7 * 24 * time.Hour
+	man := &Manager{
+		RenewBefore:  7 * 24 * time.Hour,
+		RenewStagger: stagger,
+		Now:          func() time.Time { return now },
+	}
+	defer man.stopRenew()
+	expiry := now.Add(90 * 24 * time.Hour)
+
+	a := certKey{domain: "a.example.org"}
+	b := certKey{domain: "b.example.org"}
+	offA, offB := man.staggerOffset(a), man.staggerOffset(b)
+	if offA == offB {
+		t.Errorf("%v and %v have the same offset %v", a, b, offA)
+	}
+	for _, ck := range []certKey{a, b, {domain: "a.example.org", isRSA: true}} {
+		off := man.staggerOffset(ck)
+		if off < 0 || off >= stagger {
+			t.Errorf("%v: offset %v; want within [0, %v)", ck, off, stagger)
+		}
+		// The offset is stable, including across Managers,
+		// as after a restart.
+		if again := (&Manager{RenewStagger: stagger}).staggerOffset(ck); again != off {
+			t.Errorf("%v: offset %v, then %v", ck, off, again)
+		}
+		dr := &domainRenewal{m: man, ck: ck}
+		max := 83*24*time.Hour - off
+		if next := dr.next(expiry); next < max-renewJitter || max < next {
+			t.Errorf("%v: next = %v; want between %v and %v", ck, next, max-renewJitter, max)
+		}
+	}
+	if off := man.staggerOffset(certKey{domain: "a.example.org", isRSA: true}); off == offA {
+		t.Errorf("the RSA and ECDSA certs of a.example.org have the same offset %v", off)
+	}
+
+	// Without RenewStagger, only the jitter applies.
+	man.RenewStagger = 0
+	if off := man.staggerOffset(a); off != 0 {
+		t.Errorf("offset without RenewStagger = %v; want 0", off)
+	}
+}
+
+func TestRenewScheduleReissues(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	now := time.Now()
+	man := &Manager{
+		Prompt: AcceptTOS,
+		Cache:  newMemCache(t),
+		Client: &acme.Client{
+			DirectoryURL: ca.URL,
+		},
+		RenewSchedule: func(now time.Time) time.Time { return now.Add(time.Hour) },
+		state:         make(map[certKey]*certState),
+	}
+	defer man.stopRenew()
+
+	// At a slot, a cached cert far from expiry is renewed nonetheless.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := now.Add(60 * 24 * time.Hour)
+	der, err := dateDummyCert(key.Public(), now.Add(-time.Hour), exp, exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlscert := &tls.Certificate{PrivateKey: key, Certificate: [][]byte{der}}
+	if err := man.cachePut(context.Background(), exampleCertKey, tlscert); err != nil {
+		t.Fatal(err)
+	}
+	dr := &domainRenewal{m: man, ck: exampleCertKey, key: key, exp: exp}
+	if _, err := dr.do(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !dr.exp.After(exp) {
+		t.Fatalf("dr.exp = %v; want a renewed cert expiring after %v", dr.exp, exp)
+	}
+
+	// A cert renewed since by another Manager is adopted.
+	ca.Close()
+	renewedExp := dr.exp.Add(time.Hour)
+	der, err = dateDummyCert(key.Public(), now.Add(-time.Hour), renewedExp, exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlscert = &tls.Certificate{PrivateKey: key, Certificate: [][]byte{der}}
+	if err := man.cachePut(context.Background(), exampleCertKey, tlscert); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dr.do(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !dr.exp.Equal(renewedExp.Truncate(time.Second)) {
+		t.Errorf("dr.exp = %v; want the cert cached by another Manager, expiring at %v", dr.exp, renewedExp)
+	}
+}
+
+// startRenewalCAStub runs an ACME server which authorizes any domain
+// and issues certificates for exampleDomain.
+func startRenewalCAStub(t *testing.T) *httptest.Server {
+	ca := newRenewalCAStub(t)
+	ca.Start()
+	return ca
+}
+
+// newRenewalCAStub returns the unstarted server of startRenewalCAStub,
+// to be started with Start or StartTLS.
+func newRenewalCAStub(t *testing.T) *httptest.Server {
+	caCert := func() ([]byte, error) { return dummyCert(nil, "ca") }
+	return newCAStub(t, dummyCert, caCert)
+}
+
+// startChainCAStub is like startRenewalCAStub, except that the certificates
+// are issued by stubCA and chained to its intermediate.
+func startChainCAStub(t *testing.T) *httptest.Server {
+	ca := newChainCAStub(t)
+	ca.Start()
+	return ca
+}
+
+// newChainCAStub returns the unstarted server of startChainCAStub.
+func newChainCAStub(t *testing.T) *httptest.Server {
+	caCert := func() ([]byte, error) { return stubCA.intermediate.Raw, nil }
+	return newCAStub(t, stubCA.issue, caCert)
+}
+
+// newCAStub returns an unstarted ACME server which authorizes any domain,
+// issues certificates with issue and chains them to the output of caCert.
+func newCAStub(t *testing.T, issue func(pub interface{}, san ...string) ([]byte, error), caCert func() ([]byte, error)) *httptest.Server {
 	// ACME CA server stub
 	var ca *httptest.Server
-	ca = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	ca = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Replay-Nonce", "nonce")
 		if r.Method == "HEAD" {
 			// a nonce request
@@ -82,17 +279,25 @@ func TestRenewFromCache(t *testing.T) {
 			if err != nil {
 				t.Fatalf("new-cert: CSR: %v", err)
 			}
-			der, err := dummyCert(csr.PublicKey, exampleDomain)
+			names := csr.DNSNames
+			if len(names) == 0 && csr.Subject.CommonName != "" {
+				names = []string{csr.Subject.CommonName}
+			}
+			if len(names) == 0 {
+				names = []string{exampleDomain}
+			}
+			der, err := issue(csr.PublicKey, names...)
 			if err != nil {
 				t.Fatalf("new-cert: dummyCert: %v", err)
 			}
 			chainUp := fmt.Sprintf("<%s/ca-cert>; rel=up", ca.URL)
 			w.Header().Set("Link", chainUp)
+			w.Header().Set("Location", ca.URL+"/cert/1")
 			w.WriteHeader(http.StatusCreated)
 			w.Write(der)
 		// CA chain cert
 		case "/ca-cert":
-			der, err := dummyCert(nil, "ca")
+			der, err := caCert()
 			if err != nil {
 				t.Fatalf("ca-cert: dummyCert: %v", err)
 			}
@@ -101,6 +306,73 @@ func TestRenewFromCache(t *testing.T) {
 			t.Errorf("unrecognized r.URL.Path: %s", r.URL.Path)
 		}
 	}))
+	return ca
+}
+
+// stubCA is the certificate hierarchy of startChainCAStub: it issues
+// certificates signed by an intermediate, itself signed by a root.
+var stubCA = newStubCA()
+
+type stubHierarchy struct {
+	rootKey, intermediateKey *ecdsa.PrivateKey
+	root, intermediate       *x509.Certificate
+}
+
+func newStubCA() *stubHierarchy {
+	ca := &stubHierarchy{}
+	var err error
+	if ca.rootKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		panic(err)
+	}
+	if ca.intermediateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		panic(err)
+	}
+	if ca.root, err = ca.caCert("Test Root", &ca.rootKey.PublicKey, nil, ca.rootKey); err != nil {
+		panic(err)
+	}
+	if ca.intermediate, err = ca.caCert("Test Intermediate", &ca.intermediateKey.PublicKey, ca.root, ca.rootKey); err != nil {
+		panic(err)
+	}
+	return ca
+}
+
+// caCert returns a CA certificate for pub named name, signed by parentKey
+// on behalf of parent, or self-signed if parent is nil.
+func (ca *stubHierarchy) caCert(name string, pub interface{}, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, error) {
+	t := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent = t
+	}
+	der, err := x509.CreateCertificate(rand.Reader, t, parent, pub, parentKey)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// issue returns a 90-day certificate for pub and san signed by the intermediate.
+func (ca *stubHierarchy) issue(pub interface{}, san ...string) ([]byte, error) {
+	t := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(90 * 24 * time.Hour),
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageKeyEncipherment,
+		DNSNames:              san,
+	}
+	return x509.CreateCertificate(rand.Reader, t, ca.intermediate, pub, ca.intermediateKey)
+}
+
+func TestRenewFromCache(t *testing.T) {
+	ca := startRenewalCAStub(t)
 	defer ca.Close()
 
 	man := &Manager{
@@ -327,3 +599,2983 @@ func TestRenewFromCacheAlreadyRenewed(t *testing.T) {
 		}
 	}
 }
+
+func TestRenewValidateCertRejected(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	var validated int32
+	man := &Manager{
+		Prompt:      AcceptTOS,
+		Cache:       newMemCache(t),
+		RenewBefore: 24 * time.Hour,
+		Client: &acme.Client{
+			DirectoryURL: ca.URL,
+		},
+		ValidateCert: func(name string, cert *tls.Certificate) error {
+			atomic.AddInt32(&validated, 1)
+			if name != exampleDomain {
+				t.Errorf("ValidateCert: name = %q; want %q", name, exampleDomain)
+			}
+			if cert.Leaf == nil || cert.PrivateKey == nil {
+				t.Errorf("ValidateCert: incomplete cert %+v", cert)
+			}
+			return errors.New("not logged")
+		},
+	}
+	defer man.stopRenew()
+
+	// cache an almost expired cert
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	cert, err := dateDummyCert(key.Public(), now.Add(-2*time.Hour), now.Add(time.Minute), exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlscert := &tls.Certificate{PrivateKey: key, Certificate: [][]byte{cert}}
+	if err := man.cachePut(context.Background(), exampleCertKey, tlscert); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		testDidRenewLoop = func(next time.Duration, err error) {}
+	}()
+	done := make(chan struct{})
+	testDidRenewLoop = func(next time.Duration, err error) {
+		defer close(done)
+		if err == nil {
+			t.Error("testDidRenewLoop: err is nil")
+		}
+		// The renewal is retried with the error backoff.
+		if next < renewJitter/2 || next > renewJitter {
+			t.Errorf("testDidRenewLoop: next = %v; want between %v and %v", next, renewJitter/2, renewJitter)
+		}
+		if n := atomic.LoadInt32(&validated); n != 1 {
+			t.Errorf("ValidateCert called %d times; want 1", n)
+		}
+
+		// The rejected cert must not replace the cached one.
+		tlscert, err := man.cacheGet(context.Background(), exampleCertKey)
+		if err != nil {
+			t.Fatalf("man.cacheGet: %v", err)
+		}
+		if !tlscert.Leaf.NotAfter.Before(now.Add(time.Hour)) {
+			t.Errorf("cache leaf.NotAfter = %v; want the old cert", tlscert.Leaf.NotAfter)
+		}
+	}
+
+	// trigger renew
+	hello := clientHelloInfo(exampleDomain, true)
+	if _, err := man.GetCertificate(hello); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-time.After(10 * time.Second):
+		t.Fatal("renew took too long to occur")
+	case <-done:
+	}
+}
+
+func TestGetCertificateValidateCertRejected(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	cache := newMemCache(t)
+	man := &Manager{
+		Prompt: AcceptTOS,
+		Cache:  cache,
+		Client: &acme.Client{
+			DirectoryURL: ca.URL,
+		},
+		ValidateCert: func(name string, cert *tls.Certificate) error {
+			return errors.New("untrusted chain")
+		},
+	}
+	defer man.stopRenew()
+
+	hello := clientHelloInfo(exampleDomain, true)
+	if _, err := man.GetCertificate(hello); err == nil {
+		t.Fatal("GetCertificate: err is nil")
+	}
+	if n := cache.numCerts(); n != 0 {
+		t.Errorf("found %d certificates in cache; want 0", n)
+	}
+}
+
+func TestValidateCertPinnedIssuers(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caDER, err := dummyCert(&caKey.PublicKey, "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafDER, err := dummyCert(&key.PublicKey, exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &tls.Certificate{PrivateKey: key, Certificate: [][]byte{leafDER, caDER}}
+
+	pin := sha256.Sum256(caCert.RawSubjectPublicKeyInfo)
+	otherPin := sha256.Sum256([]byte("other issuer"))
+	tests := []struct {
+		name string
+		pins [][]byte
+		ok   bool
+	}{
+		{"match", [][]byte{pin[:]}, true},
+		{"one of several", [][]byte{otherPin[:], pin[:]}, true},
+		{"mismatch", [][]byte{otherPin[:]}, false},
+		{"leaf pinned", [][]byte{leafPin(t, leafDER)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var called bool
+			man := &Manager{
+				PinnedIssuers: tt.pins,
+				ValidateCert: func(name string, cert *tls.Certificate) error {
+					called = true
+					return nil
+				},
+			}
+			err := man.validateCert(exampleCertKey, cert)
+			if (err == nil) != tt.ok {
+				t.Errorf("validateCert: %v; want ok = %v", err, tt.ok)
+			}
+			if called != tt.ok {
+				t.Errorf("ValidateCert called = %v; want %v", called, tt.ok)
+			}
+		})
+	}
+}
+
+// leafPin returns the SHA-256 pin of the public key of the DER encoded cert.
+func leafPin(t *testing.T, der []byte) []byte {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return h[:]
+}
+
+func TestGetCertificatePinnedIssuerMismatch(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	cache := newMemCache(t)
+	pin := sha256.Sum256([]byte("other issuer"))
+	man := &Manager{
+		Prompt: AcceptTOS,
+		Cache:  cache,
+		Client: &acme.Client{
+			DirectoryURL: ca.URL,
+		},
+		PinnedIssuers: [][]byte{pin[:]},
+	}
+	defer man.stopRenew()
+
+	hello := clientHelloInfo(exampleDomain, true)
+	_, err := man.GetCertificate(hello)
+	if err == nil || !strings.Contains(err.Error(), "pinned issuers") {
+		t.Fatalf("GetCertificate: %v; want pinned issuers error", err)
+	}
+	if n := cache.numCerts(); n != 0 {
+		t.Errorf("found %d certificates in cache; want 0", n)
+	}
+}
+
+func TestRenewFakeClock(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	// A cert which expires in 10 days doesn't need to be renewed yet,
+	// but the fake clock is already past RenewBefore.
+	now := time.Now()
+	man := &Manager{
+		Prompt:      AcceptTOS,
+		Cache:       newMemCache(t),
+		RenewBefore: 24 * time.Hour,
+		Client: &acme.Client{
+			DirectoryURL: ca.URL,
+		},
+		Now: func() time.Time { return now.Add(9*24*time.Hour + 12*time.Hour) },
+	}
+	defer man.stopRenew()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := dateDummyCert(key.Public(), now.Add(-time.Hour), now.Add(10*24*time.Hour), exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlscert := &tls.Certificate{PrivateKey: key, Certificate: [][]byte{cert}}
+	if err := man.cachePut(context.Background(), exampleCertKey, tlscert); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		testDidRenewLoop = func(next time.Duration, err error) {}
+	}()
+	done := make(chan struct{})
+	testDidRenewLoop = func(next time.Duration, err error) {
+		defer close(done)
+		if err != nil {
+			t.Errorf("testDidRenewLoop: %v", err)
+		}
+	}
+
+	// trigger renew
+	hello := clientHelloInfo(exampleDomain, true)
+	if _, err := man.GetCertificate(hello); err != nil {
+		t.Fatal(err)
+	}
+
+	// The timer must fire right away rather than in about 9 days.
+	select {
+	case <-time.After(10 * time.Second):
+		t.Fatal("renew took too long to occur")
+	case <-done:
+	}
+}
+
+func TestSetRenewBeforeReschedules(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	man := &Manager{
+		Prompt:      AcceptTOS,
+		Cache:       newMemCache(t),
+		RenewBefore: 24 * time.Hour,
+		Client: &acme.Client{
+			DirectoryURL: ca.URL,
+		},
+	}
+	defer man.stopRenew()
+
+	// A cert which expires in 10 days is not renewed for about 9 days.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	cert, err := dateDummyCert(key.Public(), now.Add(-time.Hour), now.Add(10*24*time.Hour), exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlscert := &tls.Certificate{PrivateKey: key, Certificate: [][]byte{cert}}
+	if err := man.cachePut(context.Background(), exampleCertKey, tlscert); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		testDidRenewLoop = func(next time.Duration, err error) {}
+	}()
+	done := make(chan struct{})
+	testDidRenewLoop = func(next time.Duration, err error) {
+		defer close(done)
+		if err != nil {
+			t.Errorf("testDidRenewLoop: %v", err)
+		}
+	}
+
+	// arm the renewal timer
+	hello := clientHelloInfo(exampleDomain, true)
+	if _, err := man.GetCertificate(hello); err != nil {
+		t.Fatal(err)
+	}
+	// The timer is armed asynchronously.
+	var dr *domainRenewal
+	for i := 0; ; i++ {
+		man.renewalMu.Lock()
+		dr = man.renewal[exampleCertKey]
+		man.renewalMu.Unlock()
+		if dr != nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("renewal timer is not armed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Once RenewBefore exceeds the cert lifetime,
+	// the armed timer must fire right away. SetRenewBefore does not wait
+	// for the timer, held here as by a renewal in progress.
+	dr.timerMu.Lock()
+	set := make(chan struct{})
+	go func() {
+		man.SetRenewBefore(11 * 24 * time.Hour)
+		close(set)
+	}()
+	select {
+	case <-time.After(10 * time.Second):
+		t.Fatal("SetRenewBefore waited for the renewal timer")
+	case <-set:
+	}
+	dr.timerMu.Unlock()
+	select {
+	case <-time.After(10 * time.Second):
+		t.Fatal("renew was not rescheduled")
+	case <-done:
+	}
+}
+
+func TestAuditLogger(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	for _, tt := range []struct {
+		name    string
+		reject  bool
+		wantErr string
+	}{
+		{"success", false, ""},
+		{"rejected", true, "untrusted chain"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := NewJSONAuditLogger(&buf)
+			man := &Manager{
+				Prompt: AcceptTOS,
+				Cache:  newMemCache(t),
+				Client: &acme.Client{
+					DirectoryURL: ca.URL,
+				},
+				AuditLogger: logger,
+			}
+			if tt.reject {
+				man.ValidateCert = func(name string, cert *tls.Certificate) error {
+					return errors.New("untrusted chain")
+				}
+			}
+			defer man.stopRenew()
+
+			hello := clientHelloInfo(exampleDomain, true)
+			_, err := man.GetCertificate(hello)
+			if (err != nil) != tt.reject {
+				t.Fatalf("GetCertificate: %v", err)
+			}
+			if err := logger.Err(); err != nil {
+				t.Fatalf("logger.Err: %v", err)
+			}
+
+			var r IssuanceRecord
+			d := json.NewDecoder(&buf)
+			if err := d.Decode(&r); err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if d.More() {
+				t.Errorf("more than one record logged: %s", buf.Bytes())
+			}
+			if r.Domain != exampleDomain || r.Renewal || r.CA != ca.URL {
+				t.Errorf("record = %+v; want domain %q and CA %q for a new cert", r, exampleDomain, ca.URL)
+			}
+			if r.CertURL != ca.URL+"/cert/1" {
+				t.Errorf("r.CertURL = %q; want %q", r.CertURL, ca.URL+"/cert/1")
+			}
+			if r.Serial == "" || len(r.DNSNames) != 1 || r.DNSNames[0] != exampleDomain {
+				t.Errorf("r.Serial = %q, r.DNSNames = %q; want serial and [%q]", r.Serial, r.DNSNames, exampleDomain)
+			}
+			if r.Time.IsZero() {
+				t.Error("r.Time is zero")
+			}
+			if len(r.Fingerprint) != 2*sha256.Size {
+				t.Errorf("r.Fingerprint = %q; want a hex SHA-256 hash", r.Fingerprint)
+			}
+			if tt.wantErr == "" && r.Error != "" || !strings.Contains(r.Error, tt.wantErr) {
+				t.Errorf("r.Error = %q; want %q", r.Error, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuditLoggerRenewalFailure(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	var buf bytes.Buffer
+	man := &Manager{
+		Prompt: AcceptTOS,
+		Cache:  newMemCache(t),
+		Client: &acme.Client{
+			DirectoryURL: ca.URL,
+		},
+		AuditLogger: NewJSONAuditLogger(&buf),
+		ValidateCert: func(name string, cert *tls.Certificate) error {
+			return errors.New("untrusted chain")
+		},
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dr := &domainRenewal{m: man, ck: exampleCertKey, key: key}
+	if _, err := dr.do(context.Background()); err == nil {
+		t.Fatal("do: err is nil")
+	}
+
+	var r IssuanceRecord
+	if err := json.Unmarshal(buf.Bytes(), &r); err != nil {
+		t.Fatalf("Unmarshal(%q): %v", buf.Bytes(), err)
+	}
+	if !r.Renewal || r.Domain != exampleDomain || !strings.Contains(r.Error, "untrusted chain") {
+		t.Errorf("record = %+v; want failed renewal of %q", r, exampleDomain)
+	}
+}
+
+func TestCertInfo(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	man := &Manager{
+		Prompt: AcceptTOS,
+		Client: &acme.Client{
+			DirectoryURL: ca.URL,
+		},
+	}
+	defer man.stopRenew()
+	if _, err := man.CertInfo(exampleDomain); err == nil {
+		t.Error("CertInfo before issuance: err is nil")
+	}
+
+	cert, err := man.GetCertificate(clientHelloInfo(exampleDomain, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := man.CertInfo(exampleDomain + ".")
+	if err != nil {
+		t.Fatalf("CertInfo: %v", err)
+	}
+	if want := sha256.Sum256(cert.Certificate[0]); info.Fingerprint != want {
+		t.Errorf("info.Fingerprint = %x; want %x", info.Fingerprint, want)
+	}
+	leaf := cert.Leaf
+	if info.SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		t.Errorf("info.SerialNumber = %v; want %v", info.SerialNumber, leaf.SerialNumber)
+	}
+	if len(info.DNSNames) != 1 || info.DNSNames[0] != exampleDomain {
+		t.Errorf("info.DNSNames = %q; want [%q]", info.DNSNames, exampleDomain)
+	}
+	if !info.NotBefore.Equal(leaf.NotBefore) || !info.NotAfter.Equal(leaf.NotAfter) {
+		t.Errorf("info validity = [%v, %v]; want [%v, %v]", info.NotBefore, info.NotAfter, leaf.NotBefore, leaf.NotAfter)
+	}
+	if info.RSA {
+		t.Error("info.RSA = true; want the ECDSA cert")
+	}
+}
+
+func TestGetCertificateMinServingValidity(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	for _, reject := range []bool{false, true} {
+		name := "renewed"
+		if reject {
+			name = "fallback"
+		}
+		t.Run(name, func(t *testing.T) {
+			var attempts int32
+			man := &Manager{
+				Prompt:             AcceptTOS,
+				Cache:              newMemCache(t),
+				RenewBefore:        2 * time.Hour,
+				MinServingValidity: 11 * 24 * time.Hour,
+				Client: &acme.Client{
+					DirectoryURL: ca.URL,
+				},
+				ValidateCert: func(name string, cert *tls.Certificate) error {
+					atomic.AddInt32(&attempts, 1)
+					if reject {
+						return errors.New("untrusted chain")
+					}
+					return nil
+				},
+			}
+			defer man.stopRenew()
+
+			// The renewal timer is not due for about 10 days,
+			// but the cert is below MinServingValidity.
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now()
+			der, err := dateDummyCert(key.Public(), now.Add(-time.Hour), now.Add(10*24*time.Hour), exampleDomain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			old := &tls.Certificate{PrivateKey: key, Certificate: [][]byte{der}}
+			if err := man.cachePut(context.Background(), exampleCertKey, old); err != nil {
+				t.Fatal(err)
+			}
+
+			hello := clientHelloInfo(exampleDomain, true)
+			for i := 0; i < 2; i++ {
+				cert, err := man.GetCertificate(hello)
+				if err != nil {
+					t.Fatalf("GetCertificate %d: %v", i, err)
+				}
+				renewed := !bytes.Equal(cert.Certificate[0], der)
+				if renewed == reject {
+					t.Errorf("GetCertificate %d: renewed = %v; want %v", i, renewed, !reject)
+				}
+			}
+			// The renewed cert is served without another attempt and
+			// a failed attempt is not repeated right away.
+			if n := atomic.LoadInt32(&attempts); n != 1 {
+				t.Errorf("got %d renewal attempts; want 1", n)
+			}
+		})
+	}
+}
+
+func TestGetCertificateExpiredInMemory(t *testing.T) {
+	// Without ServeExpiredGracePeriod, the expired cert m holds in memory
+	// is left to the renewal timer rather than renewed synchronously.
+	var requests int32
+	ca := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ca.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	der, err := dateDummyCert(key.Public(), now.Add(-90*24*time.Hour), now.Add(-time.Hour), exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	man := &Manager{
+		Prompt: AcceptTOS,
+		Client: &acme.Client{DirectoryURL: ca.URL},
+		state: map[certKey]*certState{
+			exampleCertKey: {key: key, cert: [][]byte{der}, leaf: leaf},
+		},
+	}
+	defer man.stopRenew()
+
+	cert, err := man.GetCertificate(clientHelloInfo(exampleDomain, true))
+	if err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	if !bytes.Equal(cert.Certificate[0], der) {
+		t.Error("GetCertificate did not return the cert in memory")
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("%d requests to the CA; want none", n)
+	}
+}
+
+func TestGetCertificateServeExpired(t *testing.T) {
+	// The CA is down.
+	ca := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ca.Close()
+
+	tt := []struct {
+		name  string
+		grace time.Duration
+		ok    bool
+	}{
+		{"disabled", 0, false},
+		{"within grace period", 2 * time.Hour, true},
+		{"past grace period", 30 * time.Minute, false},
+	}
+	for _, test := range tt {
+		t.Run(test.name, func(t *testing.T) {
+			man := &Manager{
+				Prompt:                  AcceptTOS,
+				Cache:                   newMemCache(t),
+				ServeExpiredGracePeriod: test.grace,
+				Client: &acme.Client{
+					DirectoryURL: ca.URL,
+					RetryBackoff: func(int, *http.Request, *http.Response) time.Duration { return -1 },
+				},
+			}
+			defer man.stopRenew()
+
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now()
+			der, err := dateDummyCert(key.Public(), now.Add(-90*24*time.Hour), now.Add(-time.Hour), exampleDomain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expired := &tls.Certificate{PrivateKey: key, Certificate: [][]byte{der}}
+			if err := man.cachePut(context.Background(), exampleCertKey, expired); err != nil {
+				t.Fatal(err)
+			}
+
+			// The first call loads the cert from the cache
+			// and the second one finds it in memory.
+			hello := clientHelloInfo(exampleDomain, true)
+			for i := 0; i < 2; i++ {
+				cert, err := man.GetCertificate(hello)
+				if !test.ok {
+					if err == nil {
+						t.Errorf("GetCertificate %d: err is nil", i)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("GetCertificate %d: %v", i, err)
+				}
+				if !bytes.Equal(cert.Certificate[0], der) {
+					t.Errorf("GetCertificate %d: did not return the expired cert", i)
+				}
+			}
+		})
+	}
+}
+
+func TestReconcileAdoptsPeerCert(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	reconciled := make(chan struct{}, 1)
+	defer func() { testDidReconcile = func(certKey) {} }()
+	testDidReconcile = func(ck certKey) {
+		select {
+		case reconciled <- struct{}{}:
+		default:
+		}
+	}
+
+	cache := newMemCache(t)
+	man := &Manager{
+		Prompt:            AcceptTOS,
+		Cache:             cache,
+		ReconcileInterval: 10 * time.Millisecond,
+		Client: &acme.Client{
+			DirectoryURL: ca.URL,
+		},
+	}
+	defer man.stopRenew()
+	hello := clientHelloInfo(exampleDomain, true)
+	old, err := man.GetCertificate(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A peer sharing the cache renews the cert.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	der, err := dateDummyCert(key.Public(), now, now.Add(180*24*time.Hour), exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &Manager{Cache: cache}
+	if err := peer.cachePut(context.Background(), exampleCertKey, &tls.Certificate{PrivateKey: key, Certificate: [][]byte{der}}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.After(10 * time.Second)
+	for {
+		select {
+		case <-reconciled:
+		case <-deadline:
+			t.Fatal("the peer cert was not adopted")
+		}
+		cert, err := man.GetCertificate(hello)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(cert.Certificate[0], der) {
+			break
+		}
+		if !bytes.Equal(cert.Certificate[0], old.Certificate[0]) {
+			t.Fatal("GetCertificate returned an unexpected cert")
+		}
+	}
+
+	// The renewal is rescheduled for the new cert.
+	dr := waitRenewal(t, man, exampleCertKey)
+	dr.timerMu.Lock()
+	exp := dr.exp
+	dr.timerMu.Unlock()
+	if !exp.Equal(now.Add(180 * 24 * time.Hour).Truncate(time.Second)) {
+		t.Errorf("dr.exp = %v; want the expiration of the peer cert", exp)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	cache := newMemCache(t)
+	man := &Manager{
+		Prompt:       AcceptTOS,
+		Cache:        cache,
+		CertVersions: 2,
+		HostPolicy:   HostWhitelist(exampleDomain),
+		Client:       &acme.Client{DirectoryURL: ca.URL},
+	}
+	defer man.stopRenew()
+	ctx := context.Background()
+	hello := clientHelloInfo(exampleDomain, true)
+
+	if err := man.Rollback(exampleDomain); err == nil {
+		t.Error("Rollback: err is nil with no previous version")
+	}
+
+	first, err := man.GetCertificate(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitRenewal(t, man, exampleCertKey)
+	if err := man.ForceRenew(ctx, exampleDomain); err != nil {
+		t.Fatalf("ForceRenew: %v", err)
+	}
+	second, err := man.GetCertificate(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(second.Certificate[0], first.Certificate[0]) {
+		t.Fatal("ForceRenew did not replace the cert")
+	}
+	if _, err := cache.Get(ctx, exampleCertKey.String()+"+v1"); err != nil {
+		t.Fatalf("previous version not kept: %v", err)
+	}
+
+	if err := man.Rollback(exampleDomain); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	cert, err := man.GetCertificate(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cert.Certificate[0], first.Certificate[0]) {
+		t.Error("GetCertificate does not serve the previous cert after Rollback")
+	}
+	cached, err := man.cacheGet(ctx, exampleCertKey)
+	if err != nil {
+		t.Fatalf("cacheGet: %v", err)
+	}
+	if !bytes.Equal(cached.Certificate[0], first.Certificate[0]) {
+		t.Error("Cache does not hold the previous cert after Rollback")
+	}
+	man.renewalMu.Lock()
+	dr := man.renewal[exampleCertKey]
+	man.renewalMu.Unlock()
+	dr.timerMu.Lock()
+	exp := dr.exp
+	dr.timerMu.Unlock()
+	if !exp.Equal(first.Leaf.NotAfter) {
+		t.Errorf("renewal exp = %v; want %v", exp, first.Leaf.NotAfter)
+	}
+
+	// The only previous version was consumed.
+	if _, err := cache.Get(ctx, exampleCertKey.String()+"+v1"); err != ErrCacheMiss {
+		t.Errorf("previous version after Rollback: err = %v; want ErrCacheMiss", err)
+	}
+	if err := man.Rollback(exampleDomain); err == nil {
+		t.Error("second Rollback: err is nil with no previous version")
+	}
+}
+
+func TestRollbackReadOnly(t *testing.T) {
+	ctx := context.Background()
+	cache := newMemCache(t)
+	// Another Manager kept a previous version of the cert in cache.
+	writer := &Manager{Cache: cache, CertVersions: 2}
+	var certs []*tls.Certificate
+	for i := 0; i < 2; i++ {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := stubCA.issue(key.Public(), exampleDomain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert := &tls.Certificate{PrivateKey: key, Certificate: [][]byte{der, stubCA.intermediate.Raw}, Leaf: leaf}
+		if err := writer.cachePut(ctx, exampleCertKey, cert); err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, cert)
+	}
+
+	man := &Manager{Cache: cache, CertVersions: 2, ReadOnly: true}
+	defer man.stopRenew()
+	if err := man.Rollback(exampleDomain); err == nil {
+		t.Error("Rollback: err is nil on a read-only Manager")
+	}
+	cached, err := man.cacheGet(ctx, exampleCertKey)
+	if err != nil {
+		t.Fatalf("cacheGet: %v", err)
+	}
+	if !bytes.Equal(cached.Certificate[0], certs[1].Certificate[0]) {
+		t.Error("Rollback on a read-only Manager changed the cached cert")
+	}
+	if _, err := cache.Get(ctx, certVersionKey(exampleCertKey, 1)); err != nil {
+		t.Errorf("previous version after Rollback: %v", err)
+	}
+	man.renewalMu.Lock()
+	n := len(man.renewal)
+	man.renewalMu.Unlock()
+	if n != 0 {
+		t.Errorf("%d renewals armed by Rollback on a read-only Manager", n)
+	}
+}
+
+// waitRenewal waits for the renewal of ck, which GetCertificate
+// starts asynchronously, and returns it.
+func waitRenewal(t *testing.T, man *Manager, ck certKey) *domainRenewal {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		man.renewalMu.Lock()
+		dr := man.renewal[ck]
+		man.renewalMu.Unlock()
+		if dr != nil {
+			return dr
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("renewal of %s not started", ck)
+		}
+	}
+}
+
+func TestStatsExpvar(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	const name = "autocert_test_stats"
+	man := &Manager{
+		Prompt:     AcceptTOS,
+		HostPolicy: HostWhitelist(exampleDomain),
+		Client:     &acme.Client{DirectoryURL: ca.URL},
+		ExpvarName: name,
+	}
+	defer man.stopRenew()
+
+	for _, hello := range []*tls.ClientHelloInfo{
+		clientHelloInfo(exampleDomain, true),
+		clientHelloInfo(exampleDomain, false),
+	} {
+		if _, err := man.GetCertificate(hello); err != nil {
+			t.Fatalf("GetCertificate(%s): %v", hello.ServerName, err)
+		}
+		waitRenewal(t, man, certKey{domain: hello.ServerName, isRSA: !supportsECDSA(hello)})
+	}
+
+	v := expvar.Get(name)
+	if v == nil {
+		t.Fatalf("expvar %q is not published", name)
+	}
+	var got struct {
+		Domains       int    `json:"domains"`
+		Certs         int    `json:"certs"`
+		NearExpiry    int    `json:"near_expiry"`
+		MinValidity   int64  `json:"min_validity_seconds"`
+		RenewalErrors int    `json:"renewal_errors"`
+		NextRenewal   string `json:"next_renewal"`
+	}
+	if err := json.Unmarshal([]byte(v.String()), &got); err != nil {
+		t.Fatalf("expvar %q: %v", name, err)
+	}
+	// An ECDSA and an RSA cert for the same domain.
+	if got.Domains != 1 || got.Certs != 2 {
+		t.Errorf("domains, certs = %d, %d; want 1, 2", got.Domains, got.Certs)
+	}
+	if got.NearExpiry != 0 || got.RenewalErrors != 0 {
+		t.Errorf("near_expiry, renewal_errors = %d, %d; want 0, 0", got.NearExpiry, got.RenewalErrors)
+	}
+	// The stub CA issues certs valid for 90 days.
+	if d := time.Duration(got.MinValidity) * time.Second; d < 89*24*time.Hour || d > 90*24*time.Hour {
+		t.Errorf("min_validity_seconds = %d; want about 90 days", got.MinValidity)
+	}
+	next, err := time.Parse(time.RFC3339, got.NextRenewal)
+	if err != nil {
+		t.Fatalf("next_renewal: %v", err)
+	}
+	if want := time.Now().Add(60 * 24 * time.Hour); next.After(want) || next.Before(want.Add(-2*renewJitter)) {
+		t.Errorf("next_renewal = %v; want about %v", next, want)
+	}
+
+	// Another Manager cannot take over the name.
+	dup := &Manager{ExpvarName: name}
+	dup.publishExpvar()
+	if expvar.Get(name).String() != v.String() {
+		t.Error("expvar replaced by another Manager")
+	}
+}
+
+func TestStats(t *testing.T) {
+	now := time.Now()
+	man := &Manager{RenewBefore: 24 * time.Hour}
+	stats := map[certKey]renewalStats{
+		{domain: "a.example.org"}: {
+			exp: now.Add(90 * 24 * time.Hour),
+			due: now.Add(89 * 24 * time.Hour),
+		},
+		{domain: "a.example.org", isRSA: true}: {
+			exp:      now.Add(12 * time.Hour),
+			due:      now.Add(time.Hour),
+			failures: 2,
+		},
+		{domain: "b.example.org"}: {
+			exp:      now.Add(-time.Hour),
+			due:      now.Add(30 * time.Minute),
+			failures: 3,
+		},
+		{domain: "starting.example.org"}: {},
+	}
+	man.renewal = make(map[certKey]*domainRenewal)
+	for ck, rs := range stats {
+		man.renewal[ck] = &domainRenewal{m: man, ck: ck, stats: rs}
+	}
+	man.Now = func() time.Time { return now }
+
+	got := man.Stats()
+	want := Stats{
+		Domains:       2,
+		Certs:         3,
+		NearExpiry:    2,
+		MinValidity:   -time.Hour,
+		RenewalErrors: 5,
+		NextRenewal:   now.Add(30 * time.Minute),
+	}
+	if got != want {
+		t.Errorf("Stats() = %+v; want %+v", got, want)
+	}
+}
+
+func TestRenewalFailures(t *testing.T) {
+	man := &Manager{}
+	a := &domainRenewal{m: man, ck: certKey{domain: "a.example.org"}, exp: time.Now().Add(time.Hour)}
+	b := &domainRenewal{m: man, ck: certKey{domain: "b.example.org"}, exp: time.Now().Add(time.Hour)}
+	man.renewal = map[certKey]*domainRenewal{a.ck: a, b.ck: b}
+	rateLimited := &acme.Error{StatusCode: http.StatusTooManyRequests, ProblemType: "urn:ietf:params:acme:error:rateLimited"}
+	dnsErr := fmt.Errorf("lookup: %w", &net.DNSError{Err: "no such host", Name: "b.example.org"})
+
+	a.recordResult(rateLimited)
+	b.recordResult(dnsErr)
+	b.recordResult(dnsErr)
+	a.recordResult(nil) // a success does not reset the counts
+	want := map[string]int{ReasonRateLimit: 1, ReasonDNS: 2}
+	if got := man.RenewalFailures(); !reflect.DeepEqual(got, want) {
+		t.Errorf("RenewalFailures() = %v; want %v", got, want)
+	}
+	if got := man.expvarStats().(map[string]interface{})["renewal_failures"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("expvar renewal_failures = %v; want %v", got, want)
+	}
+}
+
+func TestRenewalReport(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	const other = "b.example.org"
+	man := &Manager{
+		Prompt:     AcceptTOS,
+		HostPolicy: HostWhitelist(exampleDomain, other),
+		Client:     &acme.Client{DirectoryURL: ca.URL},
+	}
+	defer man.stopRenew()
+
+	for _, hello := range []*tls.ClientHelloInfo{
+		clientHelloInfo(other, true),
+		clientHelloInfo(exampleDomain, true),
+		clientHelloInfo(exampleDomain, false),
+	} {
+		if _, err := man.GetCertificate(hello); err != nil {
+			t.Fatalf("GetCertificate(%s): %v", hello.ServerName, err)
+		}
+		waitRenewal(t, man, certKey{domain: hello.ServerName, isRSA: !supportsECDSA(hello)})
+	}
+	before := time.Now()
+	if err := man.ForceRenew(context.Background(), other); err != nil {
+		t.Fatalf("ForceRenew: %v", err)
+	}
+
+	b, err := man.RenewalReport()
+	if err != nil {
+		t.Fatalf("RenewalReport: %v", err)
+	}
+	var report struct {
+		Generated time.Time            `json:"generated"`
+		Certs     []RenewalReportEntry `json:"certs"`
+	}
+	if err := json.Unmarshal(b, &report); err != nil {
+		t.Fatalf("RenewalReport: %v\n%s", err, b)
+	}
+	if report.Generated.Before(before) {
+		t.Errorf("generated = %v; want after %v", report.Generated, before)
+	}
+	type entry struct{ domain, keyType, outcome string }
+	var got []entry
+	for _, e := range report.Certs {
+		got = append(got, entry{e.Domain, e.KeyType, e.LastOutcome})
+		// The stub CA issues certs valid for 90 days, renewed 30 days before.
+		if d := time.Until(e.Expiry); d < 89*24*time.Hour || d > 90*24*time.Hour {
+			t.Errorf("%s %s: expiry = %v; want in about 90 days", e.Domain, e.KeyType, e.Expiry)
+		}
+		if e.NextRenewal == nil {
+			t.Errorf("%s %s: no next_renewal", e.Domain, e.KeyType)
+		} else if want := e.Expiry.Add(-30 * 24 * time.Hour); e.NextRenewal.After(want) || e.NextRenewal.Before(want.Add(-2*renewJitter)) {
+			t.Errorf("%s %s: next_renewal = %v; want about %v", e.Domain, e.KeyType, e.NextRenewal, want)
+		}
+		if e.Failures != 0 || e.LastError != "" {
+			t.Errorf("%s %s: failures, last_error = %d, %q; want 0, \"\"", e.Domain, e.KeyType, e.Failures, e.LastError)
+		}
+		if (e.LastAttempt != nil) != (e.Domain == other) {
+			t.Errorf("%s %s: last_attempt = %v", e.Domain, e.KeyType, e.LastAttempt)
+		}
+	}
+	want := []entry{
+		{other, "ecdsa", "success"},
+		{exampleDomain, "ecdsa", "none"},
+		{exampleDomain, "rsa", "none"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("report entries = %v; want %v\n%s", got, want, b)
+	}
+}
+
+func TestRenewalReportFailures(t *testing.T) {
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	man := &Manager{Now: func() time.Time { return now }}
+	man.renewal = map[certKey]*domainRenewal{
+		{domain: "failing.example.org"}: {stats: renewalStats{
+			exp:      now.Add(10 * 24 * time.Hour),
+			due:      now.Add(time.Hour),
+			failures: 2,
+			lastAt:   now.Add(-time.Minute),
+			lastErr:  errors.New("CA unreachable"),
+		}},
+		{domain: "halted.example.org"}: {stats: renewalStats{
+			exp:      now.Add(5 * 24 * time.Hour),
+			failures: 1,
+			lastAt:   now.Add(-time.Hour),
+			lastErr:  errors.New("rejected identifier"),
+		}},
+		{domain: "starting.example.org"}: {},
+	}
+	for ck, dr := range man.renewal {
+		dr.m, dr.ck = man, ck
+	}
+
+	b, err := man.RenewalReport()
+	if err != nil {
+		t.Fatalf("RenewalReport: %v", err)
+	}
+	want := `{"generated":"2019-06-01T12:00:00Z","certs":[` +
+		`{"domain":"failing.example.org","key_type":"ecdsa","expiry":"2019-06-11T12:00:00Z","next_renewal":"2019-06-01T13:00:00Z",` +
+		`"last_outcome":"error","last_attempt":"2019-06-01T11:59:00Z","last_error":"CA unreachable","failures":2},` +
+		`{"domain":"halted.example.org","key_type":"ecdsa","expiry":"2019-06-06T12:00:00Z",` +
+		`"last_outcome":"error","last_attempt":"2019-06-01T11:00:00Z","last_error":"rejected identifier","failures":1}]}`
+	if string(b) != want {
+		t.Errorf("RenewalReport() =\n%s\nwant\n%s", b, want)
+	}
+}
+
+func TestStartupJitter(t *testing.T) {
+	now := time.Now()
+	const jitter = 24 * time.Hour
+	// The certs expire in 90 days, so that the timers do not fire,
+	// and their renewal is due in 60 days, minus up to renewJitter.
+	const due = 60 * 24 * time.Hour
+	dues := func(m *Manager) []time.Duration {
+		m.Now = func() time.Time { return now }
+		defer m.stopRenew()
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var d []time.Duration
+		for i := 0; i < 10; i++ {
+			ck := certKey{domain: fmt.Sprintf("%d.example.org", i)}
+			m.renew(ck, key, now.Add(90*24*time.Hour))
+			m.statsMu.Lock()
+			d = append(d, m.renewal[ck].stats.due.Sub(now))
+			m.statsMu.Unlock()
+		}
+		return d
+	}
+
+	for _, d := range dues(&Manager{}) {
+		if d < due-renewJitter || d > due {
+			t.Errorf("without StartupJitter, first renewal in %v; want within [%v, %v]", d, due-renewJitter, due)
+		}
+	}
+	var delayed bool
+	for _, d := range dues(&Manager{StartupJitter: jitter}) {
+		if d < due-renewJitter || d >= due+jitter {
+			t.Errorf("first renewal in %v; want within [%v, %v)", d, due-renewJitter, due+jitter)
+		}
+		if d > due+time.Minute {
+			delayed = true
+		}
+	}
+	if !delayed {
+		t.Error("first renewals not delayed by StartupJitter")
+	}
+}
+
+func TestChainBuilder(t *testing.T) {
+	ca := startChainCAStub(t)
+	defer ca.Close()
+
+	// A cross-signed version of the root of stubCA, by an older root.
+	oldRoot, oldRootKey := newTestCA(t, "Old Root")
+	crossRoot, err := stubCA.caCert("Test Root", &stubCA.rootKey.PublicKey, oldRoot, oldRootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var defaultLen int
+	cache := newMemCache(t)
+	man := &Manager{
+		Prompt: AcceptTOS,
+		Cache:  cache,
+		Client: &acme.Client{
+			DirectoryURL: ca.URL,
+		},
+		ChainBuilder: func(leaf *x509.Certificate, chain [][]byte) ([][]byte, error) {
+			if !bytes.Equal(leaf.Raw, chain[0]) {
+				t.Errorf("ChainBuilder: leaf is not the first certificate of the chain")
+			}
+			defaultLen = len(chain)
+			return append(chain, crossRoot.Raw), nil
+		},
+	}
+	defer man.stopRenew()
+
+	cert, err := man.GetCertificate(clientHelloInfo(exampleDomain, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if defaultLen != 2 {
+		t.Fatalf("ChainBuilder got a chain of %d certificates; want 2", defaultLen)
+	}
+	if n := len(cert.Certificate); n != 3 || !bytes.Equal(cert.Certificate[2], crossRoot.Raw) {
+		t.Errorf("served chain of %d certificates does not end with the cross-signed root", n)
+	}
+
+	// The cached certificate has the same chain.
+	cached, err := man.cacheGet(context.Background(), exampleCertKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(cached.Certificate); n != 3 || !bytes.Equal(cached.Certificate[2], crossRoot.Raw) {
+		t.Errorf("cached chain of %d certificates does not end with the cross-signed root", n)
+	}
+}
+
+func TestChainBuilderInvalid(t *testing.T) {
+	other, _ := newTestCA(t, "Other")
+	tests := []struct {
+		name  string
+		build func(chain [][]byte) [][]byte
+	}{
+		{"empty", func(chain [][]byte) [][]byte { return nil }},
+		{"leaf replaced", func(chain [][]byte) [][]byte { return chain[1:] }},
+		{"unrelated intermediate", func(chain [][]byte) [][]byte { return [][]byte{chain[0], other.Raw} }},
+		{"garbage", func(chain [][]byte) [][]byte { return append(chain, []byte("garbage")) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ca := startRenewalCAStub(t)
+			defer ca.Close()
+
+			cache := newMemCache(t)
+			man := &Manager{
+				Prompt: AcceptTOS,
+				Cache:  cache,
+				Client: &acme.Client{
+					DirectoryURL: ca.URL,
+				},
+				ChainBuilder: func(leaf *x509.Certificate, chain [][]byte) ([][]byte, error) {
+					return tt.build(chain), nil
+				},
+			}
+			defer man.stopRenew()
+
+			_, err := man.GetCertificate(clientHelloInfo(exampleDomain, true))
+			if err == nil || !strings.Contains(err.Error(), "building the certificate chain") {
+				t.Fatalf("GetCertificate: %v; want a chain building error", err)
+			}
+			if n := cache.numCerts(); n != 0 {
+				t.Errorf("found %d certificates in cache; want 0", n)
+			}
+		})
+	}
+}
+
+func TestCertValidity(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	now := time.Now().UTC()
+	rt := &recordingTransport{}
+	man := &Manager{
+		Prompt: AcceptTOS,
+		Client: &acme.Client{
+			DirectoryURL: ca.URL,
+			HTTPClient:   &http.Client{Transport: rt},
+		},
+		CertValidity: 7 * 24 * time.Hour,
+		RenewBefore:  2 * 24 * time.Hour,
+		Now:          func() time.Time { return now },
+	}
+	defer man.stopRenew()
+
+	// The stub ignores the requested validity.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := man.authorizedCert(context.Background(), key, exampleCertKey); err != nil {
+		t.Fatal(err)
+	}
+
+	rt.mu.Lock()
+	body := rt.body["/new-cert"]
+	rt.mu.Unlock()
+	var req struct {
+		NotBefore string `json:"notBefore"`
+		NotAfter  string `json:"notAfter"`
+	}
+	if err := decodePayload(&req, bytes.NewReader(body)); err != nil {
+		t.Fatalf("new-cert payload: %v", err)
+	}
+	if want := now.Format(time.RFC3339); req.NotBefore != want {
+		t.Errorf("notBefore = %q; want %q", req.NotBefore, want)
+	}
+	if want := now.Add(7 * 24 * time.Hour).Format(time.RFC3339); req.NotAfter != want {
+		t.Errorf("notAfter = %q; want %q", req.NotAfter, want)
+	}
+}
+
+// startSlowCAStub runs startRenewalCAStub, except that the certificates are
+// issued once polled pending times, with the Retry-After header retryAfter
+// if not empty. The times of the polls are sent to polls.
+func startSlowCAStub(t *testing.T, pending int, retryAfter string, polls chan<- time.Time) *httptest.Server {
+	ca := startRenewalCAStub(t)
+	stub := ca.Config.Handler
+	var mu sync.Mutex
+	var issued *httptest.ResponseRecorder
+	var n int
+	ca.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/new-cert":
+			rec := httptest.NewRecorder()
+			stub.ServeHTTP(rec, r)
+			mu.Lock()
+			issued = rec
+			mu.Unlock()
+			w.Header().Set("Location", ca.URL+"/cert/1")
+			w.WriteHeader(http.StatusCreated)
+		case "/cert/1":
+			polls <- time.Now()
+			mu.Lock()
+			defer mu.Unlock()
+			if n++; n <= pending {
+				if retryAfter != "" {
+					w.Header().Set("Retry-After", retryAfter)
+				}
+				w.WriteHeader(http.StatusAccepted)
+				return
+			}
+			w.Header().Set("Link", issued.Header().Get("Link"))
+			w.Write(issued.Body.Bytes())
+		default:
+			stub.ServeHTTP(w, r)
+		}
+	})
+	return ca
+}
+
+func TestFinalizePolling(t *testing.T) {
+	tests := []struct {
+		name       string
+		interval   time.Duration
+		maxWait    time.Duration
+		pending    int
+		retryAfter string
+		minGap     time.Duration // between the polls
+		maxGap     time.Duration
+		errStr     string
+	}{
+		{name: "interval", interval: 50 * time.Millisecond, pending: 3, minGap: 50 * time.Millisecond, maxGap: 900 * time.Millisecond},
+		{name: "retry-after", interval: 10 * time.Millisecond, pending: 1, retryAfter: "1", minGap: time.Second, maxGap: 3 * time.Second},
+		{name: "max wait", interval: 10 * time.Millisecond, maxWait: 200 * time.Millisecond, pending: 1000, errStr: "not issued within 200ms"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			polls := make(chan time.Time, 1000)
+			ca := startSlowCAStub(t, test.pending, test.retryAfter, polls)
+			defer ca.Close()
+			man := &Manager{
+				Prompt:               AcceptTOS,
+				Client:               &acme.Client{DirectoryURL: ca.URL},
+				FinalizePollInterval: test.interval,
+				FinalizeMaxWait:      test.maxWait,
+			}
+			defer man.stopRenew()
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			_, _, _, err = man.authorizedCert(context.Background(), key, exampleCertKey)
+			if test.errStr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.errStr) {
+					t.Fatalf("authorizedCert: %v; want an error containing %q", err, test.errStr)
+				}
+				if d := time.Since(start); d > 5*time.Second {
+					t.Errorf("authorizedCert returned after %v", d)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("authorizedCert: %v", err)
+			}
+			close(polls)
+			var times []time.Time
+			for p := range polls {
+				times = append(times, p)
+			}
+			if len(times) != test.pending+1 {
+				t.Fatalf("%d polls; want %d", len(times), test.pending+1)
+			}
+			for i := 1; i < len(times); i++ {
+				if gap := times[i].Sub(times[i-1]); gap < test.minGap || gap > test.maxGap {
+					t.Errorf("poll %d after %v; want between %v and %v", i, gap, test.minGap, test.maxGap)
+				}
+			}
+		})
+	}
+}
+
+func TestSharedCertKey(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	pubKeys := func(man *Manager, names ...string) []interface{} {
+		t.Helper()
+		var keys []interface{}
+		for _, name := range names {
+			cert, err := man.GetCertificate(clientHelloInfo(name, true))
+			if err != nil {
+				t.Fatalf("GetCertificate(%q): %v", name, err)
+			}
+			keys = append(keys, cert.Leaf.PublicKey)
+		}
+		return keys
+	}
+	names := []string{"a.example.org", "b.example.org"}
+
+	separate := &Manager{
+		Prompt: AcceptTOS,
+		Cache:  newMemCache(t),
+		Client: &acme.Client{DirectoryURL: ca.URL},
+	}
+	defer separate.stopRenew()
+	if keys := pubKeys(separate, names...); reflect.DeepEqual(keys[0], keys[1]) {
+		t.Error("two domains share a key without SharedCertKey")
+	}
+
+	cache := newMemCache(t)
+	man := &Manager{
+		Prompt:        AcceptTOS,
+		Cache:         cache,
+		Client:        &acme.Client{DirectoryURL: ca.URL},
+		SharedCertKey: true,
+	}
+	defer man.stopRenew()
+	keys := pubKeys(man, names...)
+	if !reflect.DeepEqual(keys[0], keys[1]) {
+		t.Fatal("two domains have distinct keys with SharedCertKey")
+	}
+	ctx := context.Background()
+	stored, err := cache.Get(ctx, sharedCertKeyCacheKey(ECDSAP256))
+	if err != nil {
+		t.Fatalf("shared key not stored in cache: %v", err)
+	}
+
+	// Another Manager sharing the Cache uses the same key.
+	other := &Manager{
+		Prompt:        AcceptTOS,
+		Cache:         cache,
+		Client:        &acme.Client{DirectoryURL: ca.URL},
+		SharedCertKey: true,
+	}
+	defer other.stopRenew()
+	if k := pubKeys(other, "c.example.org"); !reflect.DeepEqual(k[0], keys[0]) {
+		t.Error("another Manager sharing the Cache uses another key")
+	}
+
+	// The rotation renews the certificates of both domains,
+	// once their renewal timers are set up.
+	for i := 0; ; i++ {
+		man.renewalMu.Lock()
+		n := len(man.renewal)
+		man.renewalMu.Unlock()
+		if n == len(names) {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("%d renewals set up; want %d", n, len(names))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := man.RotateSharedCertKey(ctx); err != nil {
+		t.Fatalf("RotateSharedCertKey: %v", err)
+	}
+	rotated := pubKeys(man, names...)
+	if !reflect.DeepEqual(rotated[0], rotated[1]) {
+		t.Error("two domains have distinct keys after the rotation")
+	}
+	if reflect.DeepEqual(rotated[0], keys[0]) {
+		t.Error("shared key not rotated")
+	}
+	if data, err := cache.Get(ctx, sharedCertKeyCacheKey(ECDSAP256)); err != nil || bytes.Equal(data, stored) {
+		t.Errorf("rotated key not stored in cache: %v", err)
+	}
+	if k := pubKeys(other, "d.example.org"); !reflect.DeepEqual(k[0], rotated[0]) {
+		t.Error("another Manager sharing the Cache still uses the key rotated since")
+	}
+
+	if err := separate.RotateSharedCertKey(ctx); err == nil {
+		t.Error("RotateSharedCertKey succeeded without SharedCertKey")
+	}
+}
+
+// fakeClock is a settable Manager.Now safe for concurrent use.
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func TestWeeklyCertLimit(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	d := createCertRetryAfter
+	f := testDidRemoveState
+	defer func() {
+		createCertRetryAfter = d
+		testDidRemoveState = f
+	}()
+	createCertRetryAfter = 0
+	removed := make(chan certKey, 10)
+	testDidRemoveState = func(ck certKey) { removed <- ck }
+
+	// Ahead of the stub CA, whose certs are valid from the second they
+	// are issued in.
+	start := time.Now().Add(time.Minute)
+	clock := &fakeClock{t: start}
+	cache := newMemCache(t)
+	var mu sync.Mutex
+	var exhausted []string
+	newManager := func() *Manager {
+		return &Manager{
+			Prompt:          AcceptTOS,
+			Cache:           cache,
+			Client:          &acme.Client{DirectoryURL: ca.URL},
+			Now:             clock.now,
+			WeeklyCertLimit: 2,
+			OnBudgetExhausted: func(domain string, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				exhausted = append(exhausted, domain)
+				if _, ok := err.(*BudgetExhaustedError); !ok {
+					t.Errorf("OnBudgetExhausted: err is %T, want *BudgetExhaustedError", err)
+				}
+			},
+		}
+	}
+	man := newManager()
+	defer man.stopRenew()
+
+	for _, name := range []string{"a.example.org", "b.example.org"} {
+		if _, err := man.GetCertificate(clientHelloInfo(name, true)); err != nil {
+			t.Fatalf("GetCertificate(%q): %v", name, err)
+		}
+		clock.advance(time.Hour)
+	}
+	if n, err := man.WeeklyCertCount(context.Background(), "example.org"); err != nil || n != 2 {
+		t.Fatalf("WeeklyCertCount = %d, %v; want 2", n, err)
+	}
+
+	// The limit is reached, for every Manager sharing the cache.
+	refused := func(man *Manager, name string, retryAt time.Time) {
+		t.Helper()
+		_, err := man.GetCertificate(clientHelloInfo(name, true))
+		berr, ok := err.(*BudgetExhaustedError)
+		if !ok {
+			t.Fatalf("GetCertificate(%q): err = %v, want a *BudgetExhaustedError", name, err)
+		}
+		if berr.RegisteredDomain != "example.org" || berr.Limit != 2 || !berr.RetryAt.Equal(retryAt) {
+			t.Errorf("BudgetExhaustedError = %+v, want example.org, limit 2 and RetryAt %v", berr, retryAt)
+		}
+		select {
+		case <-removed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("took too long to remove the %q state", name)
+		}
+	}
+	week := 7 * 24 * time.Hour
+	refused(man, "c.example.org", start.Add(week))
+	refused(man, "c.example.org", start.Add(week))
+	man2 := newManager()
+	defer man2.stopRenew()
+	refused(man2, "d.example.org", start.Add(week))
+	mu.Lock()
+	if want := []string{"c.example.org", "d.example.org"}; !reflect.DeepEqual(exhausted, want) {
+		t.Errorf("OnBudgetExhausted called for %q, want once per Manager: %q", exhausted, want)
+	}
+	mu.Unlock()
+
+	// Other registered domains are not affected.
+	if _, err := man.GetCertificate(clientHelloInfo("example.net", true)); err != nil {
+		t.Fatalf("GetCertificate(example.net): %v", err)
+	}
+
+	// Once the first cert leaves the window, one more can be obtained.
+	clock.advance(week - 2*time.Hour)
+	if _, err := man.GetCertificate(clientHelloInfo("c.example.org", true)); err != nil {
+		t.Fatalf("GetCertificate after the window rolled: %v", err)
+	}
+	refused(man, "e.example.org", start.Add(time.Hour+week))
+}
+
+func TestAdmitRenewals(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	errDenied := errors.New("not approved")
+	for _, strict := range []bool{false, true} {
+		var calls int
+		man := &Manager{
+			Prompt: AcceptTOS,
+			Cache:  newMemCache(t),
+			Client: &acme.Client{DirectoryURL: ca.URL},
+			AdmissionFunc: func(ctx context.Context, domain string) error {
+				calls++
+				return errDenied
+			},
+			AdmitRenewals: strict,
+			state:         make(map[certKey]*certState),
+		}
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dr := &domainRenewal{m: man, ck: exampleCertKey, key: key}
+		_, err = dr.do(context.Background())
+		switch {
+		case strict && (err != errDenied || calls != 1):
+			t.Errorf("AdmitRenewals: do: err = %v after %d admission calls; want %v after 1", err, calls, errDenied)
+		case !strict && (err != nil || calls != 0):
+			t.Errorf("do: err = %v after %d admission calls; want renewed without admission", err, calls)
+		}
+		man.stopRenew()
+	}
+}
+
+func TestDeferToRenewalWindow(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	// front adds ARI to the stub CA, and counts the authorizations.
+	var (
+		mu     sync.Mutex
+		window acme.RenewalWindow
+		authzs int
+	)
+	var front *httptest.Server
+	front = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		switch {
+		case r.Method == "HEAD":
+		case r.URL.Path == "/":
+			fmt.Fprintf(w, `{"new-reg": %q, "new-authz": %q, "new-cert": %q, "renewalInfo": %q}`,
+				ca.URL+"/new-reg", front.URL+"/new-authz", ca.URL+"/new-cert", front.URL+"/ari")
+		case r.URL.Path == "/new-authz":
+			mu.Lock()
+			authzs++
+			mu.Unlock()
+			ca.Config.Handler.ServeHTTP(w, r)
+		case strings.HasPrefix(r.URL.Path, "/ari/"):
+			mu.Lock()
+			defer mu.Unlock()
+			json.NewEncoder(w).Encode(map[string]acme.RenewalWindow{"suggestedWindow": window})
+		default:
+			t.Errorf("unrecognized r.URL.Path: %s", r.URL.Path)
+		}
+	}))
+	defer front.Close()
+
+	const day = 24 * time.Hour
+	for _, tt := range []struct {
+		name     string
+		disabled bool
+		start    time.Duration // of the window, from now
+		deferred bool
+	}{
+		{name: "future window", start: 10 * day, deferred: true},
+		{name: "disabled", disabled: true, start: 10 * day},
+		{name: "open window", start: -time.Hour},
+		// The cert expires in 90 days, and RenewBefore is 30 days.
+		{name: "window risking expiry", start: 80 * day},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			mu.Lock()
+			window = acme.RenewalWindow{Start: now.Add(tt.start), End: now.Add(tt.start + 2*day)}
+			authzs = 0
+			mu.Unlock()
+
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			der, err := stubCA.issue(key.Public(), exampleDomain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaf, err := x509.ParseCertificate(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+			man := &Manager{
+				Prompt:               AcceptTOS,
+				RenewBefore:          30 * day,
+				Client:               &acme.Client{DirectoryURL: front.URL},
+				DeferToRenewalWindow: !tt.disabled,
+				state: map[certKey]*certState{
+					exampleCertKey: {key: key, cert: [][]byte{der, stubCA.intermediate.Raw}, leaf: leaf},
+				},
+			}
+			defer man.stopRenew()
+			dr := &domainRenewal{m: man, ck: exampleCertKey, key: key, exp: leaf.NotAfter}
+
+			next, err := dr.do(context.Background())
+			if tt.deferred && err != errRenewalDeferred {
+				t.Fatalf("do: %v; want %v", err, errRenewalDeferred)
+			}
+			if !tt.deferred && err != nil {
+				t.Fatalf("do: %v", err)
+			}
+			mu.Lock()
+			ordered := authzs > 0
+			mu.Unlock()
+			if ordered == tt.deferred {
+				t.Errorf("order placed = %v; want %v", ordered, !tt.deferred)
+			}
+			if !tt.deferred {
+				return
+			}
+			if want := tt.start; next > want || next < want-time.Minute {
+				t.Errorf("next = %v; want the start of the window, in %v", next, want)
+			}
+			if !dr.exp.Equal(leaf.NotAfter) {
+				t.Errorf("dr.exp = %v; want the current cert kept, expiring at %v", dr.exp, leaf.NotAfter)
+			}
+		})
+	}
+}
+
+func TestIssuanceWindow(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	const day = 24 * time.Hour
+	for _, tt := range []struct {
+		name     string
+		open     time.Duration // when the next window opens, from now
+		deferred bool
+	}{
+		{name: "out of the window", open: 2 * day, deferred: true},
+		{name: "in the window", open: 0},
+		// The cert expires in 90 days, and RenewBefore is 30 days.
+		{name: "expiry imminent", open: 80 * day},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			der, err := stubCA.issue(key.Public(), exampleDomain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaf, err := x509.ParseCertificate(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now()
+			man := &Manager{
+				Prompt:      AcceptTOS,
+				RenewBefore: 30 * day,
+				Client:      &acme.Client{DirectoryURL: ca.URL},
+				Now:         func() time.Time { return now },
+				IssuanceWindow: func(at time.Time) time.Time {
+					if !at.Equal(now) {
+						t.Errorf("IssuanceWindow(%v); want it called with now, %v", at, now)
+					}
+					return at.Add(tt.open)
+				},
+				state: map[certKey]*certState{
+					exampleCertKey: {key: key, cert: [][]byte{der, stubCA.intermediate.Raw}, leaf: leaf},
+				},
+			}
+			defer man.stopRenew()
+			dr := &domainRenewal{m: man, ck: exampleCertKey, key: key, exp: leaf.NotAfter}
+
+			next, err := dr.do(context.Background())
+			if tt.deferred && err != errRenewalDeferred {
+				t.Fatalf("do: %v; want %v", err, errRenewalDeferred)
+			}
+			if !tt.deferred && err != nil {
+				t.Fatalf("do: %v", err)
+			}
+			man.stateMu.Lock()
+			renewed := man.state[exampleCertKey].leaf != leaf
+			man.stateMu.Unlock()
+			if renewed == tt.deferred {
+				t.Errorf("renewed = %v; want %v", renewed, !tt.deferred)
+			}
+			if tt.deferred && next != tt.open {
+				t.Errorf("next = %v; want the opening of the window, in %v", next, tt.open)
+			}
+		})
+	}
+}
+
+func TestDeferredRenewalNotRecorded(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := stubCA.issue(key.Public(), exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	man := &Manager{
+		RenewBefore: 30 * 24 * time.Hour,
+		IssuanceWindow: func(at time.Time) time.Time {
+			return at.Add(time.Hour)
+		},
+		state: map[certKey]*certState{
+			exampleCertKey: {key: key, cert: [][]byte{der, stubCA.intermediate.Raw}, leaf: leaf},
+		},
+	}
+	defer man.stopRenew()
+	failure := errors.New("CA unreachable")
+	dr := &domainRenewal{
+		m:            man,
+		ck:           exampleCertKey,
+		key:          key,
+		exp:          leaf.NotAfter,
+		timer:        time.AfterFunc(time.Hour, func() {}),
+		loggedErr:    failure.Error(),
+		repeatedErrs: 2,
+	}
+	defer dr.stop()
+	dr.stats.failures = 3
+	dr.stats.lastErr = failure
+
+	// The renewal deferred to the issuance window neither resets the
+	// failures of the previous attempts nor counts as one.
+	dr.renew()
+	dr.timerMu.Lock()
+	defer dr.timerMu.Unlock()
+	man.statsMu.Lock()
+	defer man.statsMu.Unlock()
+	if dr.stats.failures != 3 || dr.stats.lastErr != failure {
+		t.Errorf("stats after a deferred renewal: %d failures, last error %v; want 3 and %v", dr.stats.failures, dr.stats.lastErr, failure)
+	}
+	if dr.repeatedErrs != 2 || dr.loggedErr != failure.Error() {
+		t.Errorf("logged errors after a deferred renewal: %q repeated %d times; want %q repeated 2 times", dr.loggedErr, dr.repeatedErrs, failure)
+	}
+	if d := time.Until(dr.stats.due); d > time.Hour || d < time.Hour-time.Minute {
+		t.Errorf("renewal due in %v; want the opening of the window, in 1h", d)
+	}
+}
+
+func TestWarmSpare(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	const day = 24 * time.Hour
+	var (
+		mu     sync.Mutex
+		offset time.Duration
+	)
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return time.Now().Add(offset)
+	}
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		offset += d
+	}
+	cache := newMemCache(t)
+	newManager := func(url string) *Manager {
+		return &Manager{
+			Prompt:      AcceptTOS,
+			Cache:       cache,
+			RenewBefore: 30 * day,
+			WarmSpare:   true,
+			Client:      &acme.Client{DirectoryURL: url},
+			Now:         clock,
+			state:       make(map[certKey]*certState),
+		}
+	}
+
+	// The current cert expires in 20 days: its renewal is due, and its
+	// spare is activated 15 days before it expires.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := clock()
+	der, err := dateDummyCert(key.Public(), now.Add(-time.Hour), now.Add(20*day), exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := validCert(exampleCertKey, [][]byte{der}, key, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := &tls.Certificate{PrivateKey: key, Certificate: [][]byte{der}, Leaf: leaf}
+	if err := (&Manager{Cache: cache}).cachePut(context.Background(), exampleCertKey, current); err != nil {
+		t.Fatal(err)
+	}
+	start := func(man *Manager) *domainRenewal {
+		man.state[exampleCertKey] = &certState{key: key, cert: [][]byte{der}, leaf: leaf}
+		return &domainRenewal{m: man, ck: exampleCertKey, key: key, exp: leaf.NotAfter}
+	}
+	served := func(man *Manager) *x509.Certificate {
+		man.stateMu.Lock()
+		defer man.stateMu.Unlock()
+		return man.state[exampleCertKey].leaf
+	}
+	cached := func() *tls.Certificate {
+		data, err := cache.Get(context.Background(), exampleCertKey.String())
+		if err != nil {
+			t.Fatalf("cache.Get: %v", err)
+		}
+		tlscert, err := decodeCert(exampleCertKey, data, clock())
+		if err != nil {
+			t.Fatalf("decodeCert: %v", err)
+		}
+		return tlscert
+	}
+
+	man := newManager(ca.URL)
+	defer man.stopRenew()
+	dr := start(man)
+	next, err := dr.do(context.Background())
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	if next > 5*day || next < 5*day-time.Minute {
+		t.Errorf("next = %v; want the activation of the spare in 5 days", next)
+	}
+	if served(man) != leaf || !bytes.Equal(cached().Certificate[0], der) {
+		t.Error("the current cert was replaced before the activation of the spare")
+	}
+	if _, err := cache.Get(context.Background(), spareCacheKey(exampleCertKey)); err != nil {
+		t.Fatalf("spare not cached: %v", err)
+	}
+
+	// Another Manager, unable to reach the CA, finds the spare in cache and
+	// activates it when due.
+	other := newManager("invalid")
+	defer other.stopRenew()
+	dr = start(other)
+	if next, err := dr.do(context.Background()); err != errRenewalDeferred || next > 5*day || next < 5*day-time.Minute {
+		t.Fatalf("do with a cached spare = %v, %v; want the activation of the spare in 5 days, deferred", next, err)
+	}
+	advance(5*day + time.Minute)
+	next, err = dr.do(context.Background())
+	if err != nil {
+		t.Fatalf("do after the activation time: %v", err)
+	}
+	spare := served(other)
+	if spare == leaf || !bytes.Equal(cached().Certificate[0], spare.Raw) {
+		t.Fatal("spare not activated")
+	}
+	// The stub CA issues certs valid for 90 days.
+	if want := time.Until(spare.NotAfter) - 30*day - 5*day; next > want || next < want-renewJitter-time.Minute {
+		t.Errorf("next = %v; want the renewal of the activated spare, in about %v", next, want)
+	}
+	if _, err := cache.Get(context.Background(), spareCacheKey(exampleCertKey)); err != ErrCacheMiss {
+		t.Errorf("spare still cached after activation: %v", err)
+	}
+}
+
+func TestRenewWeeklyCertLimit(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	now := time.Now()
+	man := &Manager{
+		Prompt:          AcceptTOS,
+		Cache:           newMemCache(t),
+		RenewBefore:     24 * time.Hour,
+		Client:          &acme.Client{DirectoryURL: ca.URL},
+		Now:             func() time.Time { return now },
+		WeeklyCertLimit: 1,
+	}
+	defer man.stopRenew()
+
+	// Another cert of the registered domain was just issued.
+	release, err := man.reserveWeeklyCert(context.Background(), "www."+exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release(true)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := dateDummyCert(key.Public(), now.Add(-time.Hour), now.Add(time.Hour), exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlscert := &tls.Certificate{PrivateKey: key, Certificate: [][]byte{cert}}
+	if err := man.cachePut(context.Background(), exampleCertKey, tlscert); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		testDidRenewLoop = func(next time.Duration, err error) {}
+	}()
+	done := make(chan struct{})
+	testDidRenewLoop = func(next time.Duration, err error) {
+		defer close(done)
+		if _, ok := err.(*BudgetExhaustedError); !ok {
+			t.Errorf("renewal: err = %v, want a *BudgetExhaustedError", err)
+		}
+		// The renewal is retried once the window rolls.
+		if want := 7 * 24 * time.Hour; next != want {
+			t.Errorf("next renewal in %v, want %v", next, want)
+		}
+	}
+
+	if _, err := man.GetCertificate(clientHelloInfo(exampleDomain, true)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-time.After(10 * time.Second):
+		t.Fatal("renew took too long to occur")
+	case <-done:
+	}
+	if err := man.checkIssuanceBudget(exampleDomain); err != nil {
+		t.Errorf("refused renewal counted as a failed attempt: %v", err)
+	}
+}
+
+func TestRenewalDualCerts(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	cache := newMemCache(t)
+	man := &Manager{
+		Prompt: AcceptTOS,
+		Cache:  cache,
+		Client: &acme.Client{DirectoryURL: ca.URL},
+	}
+	defer man.stopRenew()
+
+	ecdsaHello := &tls.ClientHelloInfo{
+		ServerName:        exampleDomain,
+		CipherSuites:      []uint16{tls.TLS_AES_128_GCM_SHA256},
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedVersions: []uint16{tls.VersionTLS13},
+	}
+	rsaHello := &tls.ClientHelloInfo{
+		ServerName:       exampleDomain,
+		CipherSuites:     []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		SignatureSchemes: []tls.SignatureScheme{tls.PKCS1WithSHA256},
+	}
+	for _, hello := range []*tls.ClientHelloInfo{ecdsaHello, rsaHello, ecdsaHello} {
+		cert, err := man.GetCertificate(hello)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, isRSA := cert.Leaf.PublicKey.(*rsa.PublicKey)
+		if want := hello == rsaHello; isRSA != want {
+			t.Errorf("GetCertificate served an RSA cert: %v; want %v", isRSA, want)
+		}
+	}
+
+	// Both certs are cached and renewed on their own.
+	for _, key := range []string{exampleDomain, exampleDomain + "+rsa"} {
+		if _, err := cache.Get(context.Background(), key); err != nil {
+			t.Errorf("cache.Get(%q): %v", key, err)
+		}
+	}
+	for _, ck := range []certKey{{domain: exampleDomain}, {domain: exampleDomain, isRSA: true}} {
+		// The renewals are started asynchronously.
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			man.renewalMu.Lock()
+			dr := man.renewal[ck]
+			man.renewalMu.Unlock()
+			if dr != nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("no renewal for %v", ck)
+			}
+		}
+	}
+}
+
+func TestRenewalErrorLogInterval(t *testing.T) {
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	defer log.SetFlags(log.Flags())
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	lines := func() []string {
+		s := strings.TrimSpace(buf.String())
+		buf.Reset()
+		if s == "" {
+			return nil
+		}
+		return strings.Split(s, "\n")
+	}
+
+	clock := &fakeClock{t: time.Now()}
+	man := &Manager{Now: clock.now, RenewalErrorLogInterval: time.Hour}
+	dr := &domainRenewal{m: man, ck: exampleCertKey}
+	errCA := errors.New("CA unavailable")
+
+	// The first failure is logged, the identical ones within the interval are not.
+	for i := 0; i < 3; i++ {
+		dr.logResult(errCA)
+		clock.advance(10 * time.Minute)
+	}
+	if l := lines(); len(l) != 1 || !strings.Contains(l[0], "CA unavailable") {
+		t.Errorf("logged %q for 3 identical failures; want 1 line", l)
+	}
+
+	// A different error is logged right away.
+	dr.logResult(errors.New("rate limited"))
+	if l := lines(); len(l) != 1 || !strings.Contains(l[0], "rate limited") {
+		t.Errorf("logged %q for a new error; want 1 line", l)
+	}
+
+	// Once the interval has elapsed, the repeated failures are summarized.
+	dr.logResult(errors.New("rate limited"))
+	dr.logResult(errors.New("rate limited"))
+	if l := lines(); len(l) != 0 {
+		t.Errorf("logged %q within the interval; want nothing", l)
+	}
+	clock.advance(time.Hour)
+	dr.logResult(errors.New("rate limited"))
+	if l := lines(); len(l) != 1 || !strings.Contains(l[0], "failed 3 times") {
+		t.Errorf("logged %q after the interval; want 1 summary of 3 failures", l)
+	}
+
+	// A success reports the failures not logged yet.
+	dr.logResult(errors.New("rate limited"))
+	dr.logResult(nil)
+	if l := lines(); len(l) != 1 || !strings.Contains(l[0], "after 1 more failures") {
+		t.Errorf("logged %q on success; want 1 summary", l)
+	}
+	dr.logResult(nil)
+	dr.logResult(errCA)
+	if l := lines(); len(l) != 1 || !strings.Contains(l[0], "CA unavailable") {
+		t.Errorf("logged %q for a failure after a success; want 1 line", l)
+	}
+}
+
+// fakeIPResolver is an IPResolver answering with the addresses in addrs,
+// or a not found error for the other names.
+type fakeIPResolver struct {
+	mu    sync.Mutex
+	addrs map[string][]net.IPAddr
+}
+
+func (r *fakeIPResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addrs, ok := r.addrs[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func (r *fakeIPResolver) set(host string, ips ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	r.addrs[host] = addrs
+}
+
+func TestDomainDNSCheck(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	checked := make(chan struct{}, 1)
+	defer func() { testDidCheckDNS = func(certKey) {} }()
+	testDidCheckDNS = func(ck certKey) {
+		select {
+		case checked <- struct{}{}:
+		default:
+		}
+	}
+	// waitChecks waits for n more checks.
+	waitChecks := func(n int) {
+		for i := 0; i < n; i++ {
+			select {
+			case <-checked:
+			case <-time.After(10 * time.Second):
+				t.Fatal("the DNS check did not run")
+			}
+		}
+	}
+
+	resolver := &fakeIPResolver{addrs: make(map[string][]net.IPAddr)}
+	resolver.set(exampleDomain, "192.0.2.1", "2001:db8::1")
+	var mu sync.Mutex
+	var reported []string
+	man := &Manager{
+		Prompt: AcceptTOS,
+		Client: &acme.Client{DirectoryURL: ca.URL},
+		DomainDNSCheck: &DomainDNSCheck{
+			Addrs:    []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+			Resolver: resolver,
+			Interval: 10 * time.Millisecond,
+		},
+		OnDomainMisconfigured: func(name string, addrs []net.IP) {
+			mu.Lock()
+			defer mu.Unlock()
+			reported = append(reported, fmt.Sprintf("%s %v", name, addrs))
+		},
+	}
+	defer man.stopRenew()
+	if _, err := man.GetCertificate(clientHelloInfo(exampleDomain, true)); err != nil {
+		t.Fatal(err)
+	}
+	report := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		r := reported
+		reported = nil
+		return r
+	}
+
+	// The addresses of the server.
+	waitChecks(3)
+	if r := report(); r != nil {
+		t.Errorf("reported %q for a domain resolving to the server", r)
+	}
+
+	// The domain points elsewhere, in part: it is reported once.
+	resolver.set(exampleDomain, "192.0.2.1", "198.51.100.1")
+	waitChecks(3)
+	if r, want := report(), []string{exampleDomain + " [192.0.2.1 198.51.100.1]"}; !reflect.DeepEqual(r, want) {
+		t.Errorf("reported %q; want %q", r, want)
+	}
+
+	// Fixed, then removed: it is reported again.
+	resolver.set(exampleDomain, "192.0.2.1")
+	waitChecks(3)
+	resolver.mu.Lock()
+	delete(resolver.addrs, exampleDomain)
+	resolver.mu.Unlock()
+	waitChecks(3)
+	if r, want := report(), []string{exampleDomain + " []"}; !reflect.DeepEqual(r, want) {
+		t.Errorf("reported %q; want %q", r, want)
+	}
+}
+
+func TestCompromisedKeyCheck(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	// front adds the revocation of certificates to the stub CA.
+	type revocation struct {
+		cert   []byte
+		reason int
+		jwk    bool // whether the request is signed by the certificate key
+	}
+	revoked := make(chan revocation, 10)
+	// failIssue makes the CA refuse to issue certificates.
+	var failIssue atomic.Bool
+	var front *httptest.Server
+	front = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		switch {
+		case r.Method == "HEAD":
+		case r.URL.Path == "/":
+			fmt.Fprintf(w, `{"new-reg": %q, "new-authz": %q, "new-cert": %q, "revoke-cert": %q}`,
+				ca.URL+"/new-reg", ca.URL+"/new-authz", front.URL+"/new-cert", front.URL+"/revoke-cert")
+		case r.URL.Path == "/new-cert":
+			if failIssue.Load() {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"type": "urn:acme:error:unauthorized"}`))
+				return
+			}
+			ca.Config.Handler.ServeHTTP(w, r)
+		case r.URL.Path == "/revoke-cert":
+			var jws struct{ Protected, Payload string }
+			if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+				t.Errorf("revoke-cert: %v", err)
+				return
+			}
+			var protected struct{ JWK json.RawMessage }
+			var req struct {
+				Cert   string `json:"certificate"`
+				Reason int    `json:"reason"`
+			}
+			b, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+			json.Unmarshal(b, &protected)
+			b, _ = base64.RawURLEncoding.DecodeString(jws.Payload)
+			json.Unmarshal(b, &req)
+			cert, _ := base64.RawURLEncoding.DecodeString(req.Cert)
+			revoked <- revocation{cert: cert, reason: req.Reason, jwk: protected.JWK != nil}
+		default:
+			t.Errorf("unrecognized r.URL.Path: %s", r.URL.Path)
+		}
+	}))
+	defer front.Close()
+
+	checked := make(chan struct{}, 1)
+	defer func() { testDidCheckCompromise = func(certKey) {} }()
+	testDidCheckCompromise = func(ck certKey) {
+		select {
+		case checked <- struct{}{}:
+		default:
+		}
+	}
+
+	var mu sync.Mutex
+	compromised := make(map[string]bool)
+	man := &Manager{
+		Prompt: AcceptTOS,
+		Cache:  newMemCache(t),
+		Client: &acme.Client{DirectoryURL: front.URL},
+		CompromisedKeyCheck: func(spki []byte) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return compromised[string(spki)]
+		},
+		CompromisedKeyCheckInterval: 10 * time.Millisecond,
+	}
+	defer man.stopRenew()
+	cert, err := man.GetCertificate(clientHelloInfo(exampleDomain, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The key is found compromised, but the cert cannot be replaced:
+	// it is not revoked.
+	failIssue.Store(true)
+	mu.Lock()
+	compromised[string(cert.Leaf.RawSubjectPublicKeyInfo)] = true
+	mu.Unlock()
+	for i := 0; i < 3; i++ {
+		select {
+		case <-checked:
+		case <-time.After(10 * time.Second):
+			t.Fatal("the key check did not run")
+		}
+	}
+	select {
+	case <-revoked:
+		t.Fatal("the compromised certificate was revoked before being replaced")
+	default:
+	}
+
+	// Once the CA issues again, the cert is replaced and revoked.
+	failIssue.Store(false)
+	select {
+	case r := <-revoked:
+		if !bytes.Equal(r.cert, cert.Leaf.Raw) {
+			t.Error("revoked another certificate than the compromised one")
+		}
+		if r.reason != int(acme.CRLReasonKeyCompromise) {
+			t.Errorf("revocation reason = %d; want %d", r.reason, acme.CRLReasonKeyCompromise)
+		}
+		if !r.jwk {
+			t.Error("revocation request not signed by the certificate key")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the compromised certificate was not revoked")
+	}
+
+	man.stateMu.Lock()
+	s := man.state[exampleCertKey]
+	man.stateMu.Unlock()
+	s.RLock()
+	leaf := s.leaf
+	s.RUnlock()
+	if bytes.Equal(leaf.RawSubjectPublicKeyInfo, cert.Leaf.RawSubjectPublicKeyInfo) {
+		t.Fatal("the replacement certificate has the compromised key")
+	}
+	cached, err := man.cacheGet(context.Background(), exampleCertKey)
+	if err != nil {
+		t.Fatalf("cacheGet: %v", err)
+	}
+	if !bytes.Equal(cached.Leaf.Raw, leaf.Raw) {
+		t.Error("the replacement certificate is not cached")
+	}
+
+	// The new key is not compromised: nothing is revoked anymore.
+	for i := 0; i < 3; i++ {
+		select {
+		case <-checked:
+		case <-time.After(10 * time.Second):
+			t.Fatal("the key check did not run")
+		}
+	}
+	select {
+	case <-revoked:
+		t.Error("the replacement certificate was revoked")
+	default:
+	}
+}
+
+func TestExpiryWarning(t *testing.T) {
+	defer func(d time.Duration) { expiryCheckInterval = d }(expiryCheckInterval)
+	expiryCheckInterval = 10 * time.Millisecond
+	checked := make(chan struct{}, 1)
+	defer func() { testDidCheckExpiry = func(certKey) {} }()
+	testDidCheckExpiry = func(ck certKey) {
+		select {
+		case checked <- struct{}{}:
+		default:
+		}
+	}
+	waitChecks := func() {
+		t.Helper()
+		for i := 0; i < 3; i++ {
+			select {
+			case <-checked:
+			case <-time.After(10 * time.Second):
+				t.Fatal("the expiry check did not run")
+			}
+		}
+	}
+
+	type warning struct {
+		domain   string
+		notAfter time.Time
+	}
+	warnings := make(chan warning, 10)
+	const day = 24 * time.Hour
+	man := &Manager{
+		RenewBefore:            2 * time.Hour, // not due during the test
+		ExpiryWarningThreshold: 7 * day,
+		OnExpiryWarning: func(domain string, notAfter time.Time) {
+			warnings <- warning{domain, notAfter}
+		},
+		state: make(map[certKey]*certState),
+	}
+	defer man.stopRenew()
+	setCert := func(notAfter time.Time) *tls.Certificate {
+		cert := newTestTLSCert(t, notAfter)
+		man.stateMu.Lock()
+		man.state[exampleCertKey] = &certState{key: cert.PrivateKey.(crypto.Signer), cert: cert.Certificate, leaf: cert.Leaf}
+		man.stateMu.Unlock()
+		return cert
+	}
+
+	// The cert expires within the threshold: the warning fires once.
+	cert := setCert(time.Now().Add(3 * day))
+	man.renew(exampleCertKey, cert.PrivateKey.(crypto.Signer), cert.Leaf.NotAfter)
+	select {
+	case w := <-warnings:
+		if w.domain != exampleDomain || !w.notAfter.Equal(cert.Leaf.NotAfter) {
+			t.Errorf("OnExpiryWarning(%q, %v); want (%q, %v)", w.domain, w.notAfter, exampleDomain, cert.Leaf.NotAfter)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("OnExpiryWarning was not called")
+	}
+	waitChecks()
+	if len(warnings) != 0 {
+		t.Errorf("%d more warnings about the same certificate", len(warnings))
+	}
+
+	// Once renewed, the cert is no longer warned about.
+	setCert(time.Now().Add(60 * day))
+	waitChecks()
+	if len(warnings) != 0 {
+		t.Errorf("%d warnings about a certificate outside of the threshold", len(warnings))
+	}
+
+	// A new cert within the threshold is warned about again.
+	cert = setCert(time.Now().Add(2 * day))
+	select {
+	case w := <-warnings:
+		if !w.notAfter.Equal(cert.Leaf.NotAfter) {
+			t.Errorf("OnExpiryWarning notAfter = %v; want %v", w.notAfter, cert.Leaf.NotAfter)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("OnExpiryWarning was not called for the new certificate")
+	}
+}
+
+func TestPauseRenewal(t *testing.T) {
+	ca := startRenewalCAStub(t)
+	defer ca.Close()
+
+	man := &Manager{
+		Prompt:      AcceptTOS,
+		Cache:       newMemCache(t),
+		RenewBefore: 24 * time.Hour,
+		Client: &acme.Client{
+			DirectoryURL: ca.URL,
+		},
+	}
+	defer man.stopRenew()
+
+	// cache an almost expired cert
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	cert, err := dateDummyCert(key.Public(), now.Add(-2*time.Hour), now.Add(time.Minute), exampleDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlscert := &tls.Certificate{PrivateKey: key, Certificate: [][]byte{cert}}
+	if err := man.cachePut(context.Background(), exampleCertKey, tlscert); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		testDidRenewLoop = func(next time.Duration, err error) {}
+	}()
+	renewed := make(chan error, 1)
+	testDidRenewLoop = func(next time.Duration, err error) {
+		renewed <- err
+	}
+
+	man.PauseRenewal()
+	hello := clientHelloInfo(exampleDomain, true)
+	got, err := man.GetCertificate(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Certificate[0], cert) {
+		t.Error("GetCertificate did not return the cached cert while paused")
+	}
+
+	// wait for the renewal timer to fire and be skipped
+	var dr *domainRenewal
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		man.renewalMu.Lock()
+		dr = man.renewal[exampleCertKey]
+		man.renewalMu.Unlock()
+		if dr != nil {
+			dr.timerMu.Lock()
+			idle := dr.idle
+			dr.timerMu.Unlock()
+			if idle {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("renewal timer did not fire")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err := <-renewed:
+		t.Fatalf("renewal ran while paused: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := dr.renewNow(context.Background()); err != errRenewalPaused {
+		t.Errorf("renewNow: %v; want %v", err, errRenewalPaused)
+	}
+
+	man.ResumeRenewal()
+	select {
+	case <-time.After(10 * time.Second):
+		t.Fatal("renewal did not resume")
+	case err := <-renewed:
+		if err != nil {
+			t.Fatalf("renewal: %v", err)
+		}
+	}
+	tlscert, err = man.cacheGet(context.Background(), exampleCertKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tlscert.Leaf.NotAfter.After(now.Add(24 * time.Hour)) {
+		t.Errorf("cached cert expires %v; want renewed", tlscert.Leaf.NotAfter)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	unavailable := &acme.Error{StatusCode: http.StatusServiceUnavailable}
+	unauthorized := &acme.Error{StatusCode: http.StatusForbidden, ProblemType: "urn:ietf:params:acme:error:unauthorized"}
+	tests := []struct {
+		name     string
+		err      error
+		failures int
+		min, max time.Duration
+		retry    bool
+	}{
+		{"unknown", errors.New("boom"), 1, renewJitter / 2, renewJitter, true},
+		{"CA outage", unavailable, 1, transientRetry, 2 * transientRetry, true},
+		{"server internal", &acme.Error{StatusCode: http.StatusBadRequest, ProblemType: "urn:ietf:params:acme:error:serverInternal"}, 3, transientRetry, 2 * transientRetry, true},
+		{"deadline", fmt.Errorf("wrapped: %w", context.DeadlineExceeded), 1, transientRetry, 2 * transientRetry, true},
+		{"network", &net.OpError{Op: "dial", Err: errors.New("refused")}, 1, transientRetry, 2 * transientRetry, true},
+		{"first refusal", unauthorized, 1, renewJitter, 2 * renewJitter, true},
+		{"third refusal", unauthorized, 3, 4 * renewJitter, 5 * renewJitter, true},
+		{"many refusals", unauthorized, 20, maxPermanentRetry, maxPermanentRetry + renewJitter, true},
+		{"rate limited", &acme.Error{StatusCode: http.StatusTooManyRequests, ProblemType: "urn:ietf:params:acme:error:rateLimited"}, 1, renewJitter, 2 * renewJitter, true},
+		{"failed challenge", &acme.AuthorizationError{Identifier: exampleDomain}, 2, 2 * renewJitter, 3 * renewJitter, true},
+		{"rejected identifier", &acme.Error{StatusCode: http.StatusBadRequest, ProblemType: "urn:ietf:params:acme:error:rejectedIdentifier"}, 1, 0, 0, false},
+		{"gave up", &GiveUpError{Domain: exampleDomain, Err: unavailable}, 5, 0, 0, false},
+	}
+	for _, test := range tests {
+		d, retry := retryDelay(test.err, test.failures)
+		if retry != test.retry {
+			t.Errorf("%s: retry = %v; want %v", test.name, retry, test.retry)
+		}
+		if retry && (d < test.min || d >= test.max) {
+			t.Errorf("%s: delay = %v; want within [%v, %v)", test.name, d, test.min, test.max)
+		}
+	}
+}
+
+func TestFailureReason(t *testing.T) {
+	rateLimited := &acme.Error{StatusCode: http.StatusTooManyRequests, ProblemType: "urn:ietf:params:acme:error:rateLimited"}
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"rate limited", rateLimited, ReasonRateLimit},
+		{"wrapped rate limited", fmt.Errorf("renewal: %w", rateLimited), ReasonRateLimit},
+		{"weekly limit", &BudgetExhaustedError{Domain: exampleDomain}, ReasonRateLimit},
+		{"DNS lookup", &net.DNSError{Err: "no such host", Name: exampleDomain}, ReasonDNS},
+		{"CA DNS problem", &acme.Error{StatusCode: http.StatusBadRequest, ProblemType: "urn:ietf:params:acme:error:dns"}, ReasonDNS},
+		{"challenge DNS problem", &acme.AuthorizationError{Errors: []error{&acme.Error{ProblemType: "urn:ietf:params:acme:error:dns"}}}, ReasonDNS},
+		{"failed challenge", &acme.AuthorizationError{Errors: []error{&acme.Error{ProblemType: "urn:ietf:params:acme:error:connection"}}}, ReasonChallenge},
+		{"network", &net.OpError{Op: "dial", Err: errors.New("refused")}, ReasonNetwork},
+		{"deadline", fmt.Errorf("wrapped: %w", context.DeadlineExceeded), ReasonNetwork},
+		{"CA outage", &acme.Error{StatusCode: http.StatusServiceUnavailable}, ReasonCA},
+		{"gave up", &GiveUpError{Domain: exampleDomain, Err: rateLimited}, ReasonRateLimit},
+		{"unknown", errors.New("boom"), ReasonOther},
+	}
+	for _, test := range tests {
+		if got := FailureReason(test.err); got != test.want {
+			t.Errorf("%s: FailureReason = %q; want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRenewalRetryByErrorClass(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		problem  string
+		min, max time.Duration // zero if not retried
+	}{
+		{"transient", http.StatusServiceUnavailable, "urn:ietf:params:acme:error:serverInternal", transientRetry, 2 * transientRetry},
+		{"permanent", http.StatusForbidden, "urn:ietf:params:acme:error:unauthorized", renewJitter, 2 * renewJitter},
+		{"unrecoverable", http.StatusBadRequest, "urn:ietf:params:acme:error:rejectedIdentifier", 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var fail int32 = 1
+			var ca *httptest.Server
+			ca = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Replay-Nonce", "nonce")
+				if r.Method == "HEAD" {
+					return
+				}
+				switch r.URL.Path {
+				case "/":
+					if err := discoTmpl.Execute(w, ca.URL); err != nil {
+						t.Errorf("discoTmpl: %v", err)
+					}
+				case "/new-reg":
+					w.Write([]byte("{}"))
+				case "/new-authz":
+					w.Header().Set("Location", ca.URL+"/authz/1")
+					w.WriteHeader(http.StatusCreated)
+					w.Write([]byte(`{"status": "valid"}`))
+				case "/new-cert":
+					if atomic.LoadInt32(&fail) != 0 {
+						w.Header().Set("Content-Type", "application/problem+json")
+						w.WriteHeader(test.status)
+						fmt.Fprintf(w, `{"type": %q, "detail": "refused"}`, test.problem)
+						return
+					}
+					var req struct {
+						CSR string `json:"csr"`
+					}
+					decodePayload(&req, r.Body)
+					b, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+					csr, err := x509.ParseCertificateRequest(b)
+					if err != nil {
+						t.Errorf("new-cert: CSR: %v", err)
+						return
+					}
+					der, err := stubCA.issue(csr.PublicKey, exampleDomain)
+					if err != nil {
+						t.Errorf("new-cert: issue: %v", err)
+						return
+					}
+					w.Header().Set("Link", fmt.Sprintf("<%s/ca-cert>; rel=up", ca.URL))
+					w.Header().Set("Location", ca.URL+"/cert/1")
+					w.WriteHeader(http.StatusCreated)
+					w.Write(der)
+				case "/ca-cert":
+					w.Write(stubCA.intermediate.Raw)
+				default:
+					t.Errorf("unrecognized r.URL.Path: %s", r.URL.Path)
+				}
+			}))
+			defer ca.Close()
+
+			man := &Manager{
+				Prompt:      AcceptTOS,
+				Cache:       newMemCache(t),
+				RenewBefore: 24 * time.Hour,
+				Client: &acme.Client{
+					DirectoryURL: ca.URL,
+					RetryBackoff: func(int, *http.Request, *http.Response) time.Duration { return 0 },
+				},
+			}
+			defer man.stopRenew()
+
+			// cache an almost expired cert
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now()
+			cert, err := dateDummyCert(key.Public(), now.Add(-2*time.Hour), now.Add(time.Minute), exampleDomain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tlscert := &tls.Certificate{PrivateKey: key, Certificate: [][]byte{cert}}
+			if err := man.cachePut(context.Background(), exampleCertKey, tlscert); err != nil {
+				t.Fatal(err)
+			}
+
+			defer func() {
+				testDidRenewLoop = func(next time.Duration, err error) {}
+			}()
+			done := make(chan struct{})
+			testDidRenewLoop = func(next time.Duration, err error) {
+				defer close(done)
+				if err == nil {
+					t.Fatal("testDidRenewLoop: err is nil")
+				}
+				if next < test.min || test.max > 0 && next >= test.max {
+					t.Errorf("testDidRenewLoop: next = %v; want within [%v, %v)", next, test.min, test.max)
+				}
+			}
+			if _, err := man.GetCertificate(clientHelloInfo(exampleDomain, true)); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-time.After(10 * time.Second):
+				t.Fatal("renew took too long to occur")
+			case <-done:
+			}
+			testDidRenewLoop = func(next time.Duration, err error) {}
+
+			man.renewalMu.Lock()
+			dr := man.renewal[exampleCertKey]
+			man.renewalMu.Unlock()
+			dr.timerMu.Lock()
+			halted := dr.halted
+			dr.timerMu.Unlock()
+			if want := test.max == 0; halted != want {
+				t.Fatalf("halted = %v; want %v", halted, want)
+			}
+			if !halted {
+				return
+			}
+
+			// ForceRenew resumes the renewals.
+			atomic.StoreInt32(&fail, 0)
+			if err := man.ForceRenew(context.Background(), exampleDomain); err != nil {
+				t.Fatalf("ForceRenew: %v", err)
+			}
+			dr.timerMu.Lock()
+			defer dr.timerMu.Unlock()
+			if dr.halted {
+				t.Error("still halted after ForceRenew")
+			}
+			if !dr.timer.Stop() {
+				t.Error("renewal timer not rearmed by ForceRenew")
+			}
+		})
+	}
+}
+
+func TestRenewNowRemovedState(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	// The renewal is deferred to the next issuance window, leaving
+	// alone the state removed while it was in progress.
+	man := &Manager{
+		IssuanceWindow: func(now time.Time) time.Time { return now.Add(time.Hour) },
+		state:          make(map[certKey]*certState),
+	}
+	dr := &domainRenewal{m: man, ck: exampleCertKey, key: key, exp: now.Add(60 * 24 * time.Hour)}
+	if _, err := dr.renewNow(context.Background()); err != errRenewalRemoved {
+		t.Errorf("renewNow: %v; want %v", err, errRenewalRemoved)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		timeout time.Duration
+		drained bool // the renewal completes within timeout
+	}{
+		{name: "drained", timeout: 10 * time.Second, drained: true},
+		{name: "abandoned", timeout: 100 * time.Millisecond},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			issuing := make(chan struct{})
+			release := make(chan struct{})
+			abandoned := make(chan struct{})
+			ca := newRenewalCAStub(t)
+			h := ca.Config.Handler
+			ca.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/new-cert" {
+					// Read the body, so that the server notices
+					// when the client cancels the request.
+					b, err := io.ReadAll(r.Body)
+					if err != nil {
+						t.Errorf("new-cert: %v", err)
+					}
+					r.Body = io.NopCloser(bytes.NewReader(b))
+					close(issuing)
+					select {
+					case <-release:
+					case <-r.Context().Done():
+						close(abandoned)
+						return
+					}
+				}
+				h.ServeHTTP(w, r)
+			})
+			ca.Start()
+			defer ca.Close()
+
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			der, err := stubCA.issue(key.Public(), exampleDomain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaf, err := x509.ParseCertificate(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+			man := &Manager{
+				Prompt: AcceptTOS,
+				// Renew right away the cert, which expires in 90 days.
+				RenewBefore: 100 * 24 * time.Hour,
+				Cache:       newMemCache(t),
+				Client:      &acme.Client{DirectoryURL: ca.URL},
+				state: map[certKey]*certState{
+					exampleCertKey: {key: key, cert: [][]byte{der, stubCA.intermediate.Raw}, leaf: leaf},
+				},
+			}
+			man.renew(exampleCertKey, key, leaf.NotAfter)
+			select {
+			case <-issuing:
+			case <-time.After(10 * time.Second):
+				t.Fatal("renewal did not start")
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			done := make(chan error, 1)
+			go func() { done <- man.Shutdown(ctx) }()
+			if tt.drained {
+				select {
+				case err := <-done:
+					t.Fatalf("Shutdown returned %v before the renewal completed", err)
+				case <-time.After(100 * time.Millisecond):
+				}
+				close(release)
+			}
+			select {
+			case err := <-done:
+				if tt.drained && err != nil {
+					t.Fatalf("Shutdown: %v", err)
+				}
+				if !tt.drained && err != context.DeadlineExceeded {
+					t.Fatalf("Shutdown: %v; want %v", err, context.DeadlineExceeded)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("Shutdown did not return")
+			}
+			if !tt.drained {
+				select {
+				case <-abandoned:
+				case <-time.After(10 * time.Second):
+					t.Fatal("renewal not abandoned")
+				}
+			}
+
+			man.renewalMu.Lock()
+			n := len(man.renewal)
+			man.renewalMu.Unlock()
+			if n != 0 {
+				t.Errorf("%d renewals left after Shutdown", n)
+			}
+			_, err = man.cacheGet(context.Background(), exampleCertKey)
+			if tt.drained && err != nil {
+				t.Errorf("renewed cert not cached: %v", err)
+			}
+			if !tt.drained && err != ErrCacheMiss {
+				t.Errorf("cacheGet: %v; want %v", err, ErrCacheMiss)
+			}
+
+			if err := man.ForceRenew(context.Background(), exampleDomain); err != errShutDown {
+				t.Errorf("ForceRenew after Shutdown: %v; want %v", err, errShutDown)
+			}
+			hello := clientHelloInfo("other.example.org", true)
+			if _, err := man.GetCertificate(hello); !errors.Is(err, errShutDown) {
+				t.Errorf("GetCertificate(%q) after Shutdown: %v; want %v", hello.ServerName, err, errShutDown)
+			}
+		})
+	}
+}
+
+// slowPutCache is a Cache whose Put of key takes delay.
+type slowPutCache struct {
+	Cache
+	key   string
+	delay time.Duration
+}
+
+func (c *slowPutCache) Put(ctx context.Context, key string, data []byte) error {
+	if key == c.key {
+		time.Sleep(c.delay)
+	}
+	return c.Cache.Put(ctx, key, data)
+}
+
+func TestShutdownFirstTimeIssuance(t *testing.T) {
+	for _, placeholder := range []bool{false, true} {
+		t.Run(fmt.Sprintf("PlaceholderCert=%v", placeholder), func(t *testing.T) {
+			issuing := make(chan struct{})
+			release := make(chan struct{})
+			ca := newRenewalCAStub(t)
+			h := ca.Config.Handler
+			ca.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/new-cert" {
+					close(issuing)
+					<-release
+				}
+				h.ServeHTTP(w, r)
+			})
+			ca.Start()
+			defer ca.Close()
+
+			man := &Manager{
+				Prompt: AcceptTOS,
+				// A slow Cache leaves Shutdown time to return
+				// before the cert is cached.
+				Cache:           &slowPutCache{Cache: newMemCache(t), key: exampleCertKey.String(), delay: 200 * time.Millisecond},
+				Client:          &acme.Client{DirectoryURL: ca.URL},
+				PlaceholderCert: placeholder,
+			}
+			defer man.stopRenew()
+			go man.GetCertificate(clientHelloInfo(exampleDomain, true))
+			select {
+			case <-issuing:
+			case <-time.After(10 * time.Second):
+				t.Fatal("issuance did not start")
+			}
+
+			done := make(chan error, 1)
+			go func() { done <- man.Shutdown(context.Background()) }()
+			select {
+			case err := <-done:
+				t.Fatalf("Shutdown returned %v before the issuance completed", err)
+			case <-time.After(100 * time.Millisecond):
+			}
+			close(release)
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("Shutdown: %v", err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("Shutdown did not return")
+			}
+			if _, err := man.cacheGet(context.Background(), exampleCertKey); err != nil {
+				t.Errorf("first-time cert not cached when Shutdown returned: %v", err)
+			}
+		})
+	}
+}
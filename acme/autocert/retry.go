@@ -0,0 +1,156 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/robarchibald/crypto/acme"
+)
+
+// errorClass is the class of the error of a failed renewal, which determines
+// when the renewal is retried; see retryDelay.
+type errorClass int
+
+const (
+	errorUnknown       errorClass = iota // such as a cert rejected by ValidateCert
+	errorTransient                       // such as a network error or a CA outage
+	errorPermanent                       // refused by the CA, likely until fixed
+	errorUnrecoverable                   // never retried until ForceRenew
+)
+
+const (
+	// transientRetry is the minimum delay before retrying a renewal which
+	// failed with a transient error. A random delay of up to transientRetry
+	// is added.
+	transientRetry = 5 * time.Minute
+
+	// maxPermanentRetry caps the delay between the retries of a renewal
+	// which keeps failing with permanent errors.
+	maxPermanentRetry = 24 * time.Hour
+)
+
+// classifyError returns the class of err, an error of a renewal.
+func classifyError(err error) errorClass {
+	var gerr *GiveUpError
+	if errors.As(err, &gerr) {
+		return errorUnrecoverable
+	}
+	var aerr *acme.Error
+	if errors.As(err, &aerr) {
+		typ := strings.ToLower(aerr.ProblemType)
+		switch {
+		case strings.HasSuffix(typ, ":rejectedidentifier"), strings.HasSuffix(typ, ":unsupportedidentifier"):
+			// The CA will not issue certificates for the name.
+			return errorUnrecoverable
+		case strings.HasSuffix(typ, ":serverinternal"), strings.HasSuffix(typ, ":badnonce"):
+			return errorTransient
+		case aerr.StatusCode >= 500:
+			return errorTransient
+		case aerr.StatusCode >= 400:
+			// Including rateLimited, which is not worth retrying soon.
+			return errorPermanent
+		}
+		return errorUnknown
+	}
+	var authzErr *acme.AuthorizationError
+	if errors.As(err, &authzErr) {
+		// A challenge failed, typically because of the DNS or the
+		// firewall, which are rarely fixed within minutes.
+		return errorPermanent
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) {
+		return errorTransient
+	}
+	return errorUnknown
+}
+
+// The reasons of the failed renewals, as returned by FailureReason.
+const (
+	ReasonRateLimit = "rate_limit" // refused by the CA or WeeklyCertLimit for too many certificates
+	ReasonDNS       = "dns"        // a DNS lookup failed, locally or at the CA
+	ReasonChallenge = "challenge"  // the CA could not validate the challenges
+	ReasonNetwork   = "network"    // the CA could not be reached, or timed out
+	ReasonCA        = "ca"         // any other error response of the CA
+	ReasonOther     = "other"      // such as a cert rejected by ValidateCert
+)
+
+// FailureReason returns the reason of err, the error of a failed renewal,
+// as counted by Manager.RenewalFailures: one of the Reason constants,
+// derived from the types of err and of the errors it wraps. Its values
+// are stable, so as to label metrics.
+func FailureReason(err error) string {
+	var berr *BudgetExhaustedError
+	if errors.As(err, &berr) {
+		return ReasonRateLimit
+	}
+	var aerr *acme.Error
+	if errors.As(err, &aerr) {
+		return acmeErrorReason(aerr)
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return ReasonDNS
+	}
+	var authzErr *acme.AuthorizationError
+	if errors.As(err, &authzErr) {
+		for _, e := range authzErr.Errors {
+			if ae, ok := e.(*acme.Error); ok && acmeErrorReason(ae) == ReasonDNS {
+				return ReasonDNS
+			}
+		}
+		return ReasonChallenge
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) {
+		return ReasonNetwork
+	}
+	return ReasonOther
+}
+
+// acmeErrorReason returns the FailureReason of an error response of the CA.
+func acmeErrorReason(err *acme.Error) string {
+	typ := strings.ToLower(err.ProblemType)
+	switch {
+	case strings.HasSuffix(typ, ":ratelimited"):
+		return ReasonRateLimit
+	case strings.HasSuffix(typ, ":dns"):
+		return ReasonDNS
+	case strings.HasSuffix(typ, ":connection"), strings.HasSuffix(typ, ":tls"),
+		strings.HasSuffix(typ, ":incorrectresponse"), strings.HasSuffix(typ, ":unauthorized"):
+		// Reported for the challenges the CA could not validate.
+		return ReasonChallenge
+	}
+	return ReasonCA
+}
+
+// retryDelay returns the delay before retrying a renewal which failed with
+// err, after failures consecutive failures, and false if it must not be
+// retried until ForceRenew is called.
+func retryDelay(err error, failures int) (time.Duration, bool) {
+	switch classifyError(err) {
+	case errorTransient:
+		return transientRetry + time.Duration(pseudoRand.int63n(int64(transientRetry))), true
+	case errorPermanent:
+		// 1h, 2h, 4h, ...
+		d := renewJitter
+		for i := 1; i < failures && d < maxPermanentRetry; i++ {
+			d *= 2
+		}
+		if d > maxPermanentRetry {
+			d = maxPermanentRetry
+		}
+		return d + time.Duration(pseudoRand.int63n(int64(renewJitter))), true
+	case errorUnrecoverable:
+		return 0, false
+	}
+	next := renewJitter / 2
+	return next + time.Duration(pseudoRand.int63n(int64(next))), true
+}
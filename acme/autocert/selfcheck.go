@@ -0,0 +1,120 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/robarchibald/crypto/acme"
+)
+
+// selfCheckTimeout bounds the self-check of a challenge; see Manager.SelfCheck.
+const selfCheckTimeout = 10 * time.Second
+
+// selfCheckDial dials the public address of a domain for the self-checks.
+// It is replaced in tests.
+var selfCheckDial = (&net.Dialer{}).DialContext
+
+// selfCheck runs the self-check of the challenge chal for domain, the response
+// to which is provisioned, if m.SelfCheck is set. A failure is only logged.
+func (m *Manager) selfCheck(ctx context.Context, client *acme.Client, chal *acme.Challenge, domain string) {
+	if !m.SelfCheck {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, selfCheckTimeout)
+	defer cancel()
+	var err error
+	switch chal.Type {
+	case "http-01":
+		err = m.selfCheckHTTP01(ctx, client, chal.Token, domain)
+	case "tls-alpn-01":
+		err = m.selfCheckTLSALPN01(ctx, domain)
+	default:
+		return
+	}
+	if err != nil {
+		log.Printf("acme/autocert: self-check of the %s challenge for %q failed, the CA may fail to validate it: %v", chal.Type, domain, err)
+	}
+}
+
+// selfCheckHTTP01 fetches the http-01 challenge response for token
+// from domain, and checks that it matches the one provisioned.
+func (m *Manager) selfCheckHTTP01(ctx context.Context, client *acme.Client, token, domain string) error {
+	want, err := client.HTTP01ChallengeResponse(token)
+	if err != nil {
+		return err
+	}
+	hc := &http.Client{Transport: &http.Transport{DialContext: selfCheckDial}}
+	defer hc.CloseIdleConnections()
+	url := "http://" + domain + client.HTTP01ChallengePath(token)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<10))
+	if err != nil {
+		return err
+	}
+	if string(bytes.TrimSpace(body)) != want {
+		return fmt.Errorf("GET %s: unexpected response %q", url, body)
+	}
+	return nil
+}
+
+// selfCheckTLSALPN01 performs an acme-tls/1 handshake with domain,
+// and checks that the challenge certificate provisioned is served.
+func (m *Manager) selfCheckTLSALPN01(ctx context.Context, domain string) error {
+	m.tokensMu.RLock()
+	cert := m.certTokens[domain]
+	m.tokensMu.RUnlock()
+	if cert == nil || len(cert.Certificate) == 0 {
+		return errors.New("no challenge certificate provisioned")
+	}
+	addr := net.JoinHostPort(domain, "443")
+	conn, err := selfCheckDial(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d)
+	}
+	tc := tls.Client(conn, &tls.Config{
+		ServerName: domain,
+		NextProtos: []string{acme.ALPNProto},
+		// The challenge certificate is self-signed:
+		// it is compared to the one provisioned instead.
+		InsecureSkipVerify: true,
+	})
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return fmt.Errorf("handshake with %s: %v", addr, err)
+	}
+	st := tc.ConnectionState()
+	if st.NegotiatedProtocol != acme.ALPNProto {
+		return fmt.Errorf("%s negotiated protocol %q, not %q", addr, st.NegotiatedProtocol, acme.ALPNProto)
+	}
+	if len(st.PeerCertificates) == 0 || !bytes.Equal(st.PeerCertificates[0].Raw, cert.Certificate[0]) {
+		return fmt.Errorf("%s does not serve the challenge certificate", addr)
+	}
+	return nil
+}
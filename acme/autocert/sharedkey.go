@@ -0,0 +1,135 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/pem"
+	"errors"
+	"strings"
+)
+
+// sharedCertKeyCacheKey returns the cache key under which the certificate
+// key of type kt shared by all domains is stored; see Manager.SharedCertKey.
+func sharedCertKeyCacheKey(kt KeyType) string {
+	return "acme_shared_cert_" + string(kt) + "+key"
+}
+
+// sharedCertKey returns the certificate key of type kt shared by all domains,
+// reading it from m.Cache or generating it the first time.
+func (m *Manager) sharedCertKey(ctx context.Context, kt KeyType) (crypto.Signer, error) {
+	m.sharedKeyMu.Lock()
+	defer m.sharedKeyMu.Unlock()
+	key, err := m.currentSharedKey(ctx, kt)
+	if key != nil || err != nil {
+		return key, err
+	}
+	return m.newSharedKey(ctx, kt)
+}
+
+// currentSharedKey returns the current shared key of type kt, or nil if there
+// is none yet. The key is read again from m.Cache each time, since another
+// Manager sharing it may have rotated the key; m only keeps it without Cache.
+// m.sharedKeyMu must be held.
+func (m *Manager) currentSharedKey(ctx context.Context, kt KeyType) (crypto.Signer, error) {
+	if m.Cache == nil {
+		return m.sharedKeys[kt], nil
+	}
+	data, err := m.Cache.Get(ctx, sharedCertKeyCacheKey(kt))
+	switch {
+	case err == ErrCacheMiss:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	priv, _ := pem.Decode(data)
+	if priv == nil || !strings.Contains(priv.Type, "PRIVATE") {
+		return nil, errors.New("acme/autocert: invalid shared certificate key found in cache")
+	}
+	key, err := parsePrivateKey(priv.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	m.setSharedKey(kt, key)
+	return key, nil
+}
+
+// newSharedKey generates a new certificate key of type kt shared by all
+// domains and stores it in m.Cache. m.sharedKeyMu must be held.
+func (m *Manager) newSharedKey(ctx context.Context, kt KeyType) (crypto.Signer, error) {
+	key, err := kt.generate()
+	if err != nil {
+		return nil, err
+	}
+	if m.Cache != nil {
+		var buf bytes.Buffer
+		if err := encodeKey(&buf, key); err != nil {
+			return nil, err
+		}
+		if err := m.Cache.Put(ctx, sharedCertKeyCacheKey(kt), buf.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	m.setSharedKey(kt, key)
+	return key, nil
+}
+
+// setSharedKey records key as the shared key of type kt. m.sharedKeyMu must be held.
+func (m *Manager) setSharedKey(kt KeyType, key crypto.Signer) {
+	if m.sharedKeys == nil {
+		m.sharedKeys = make(map[KeyType]crypto.Signer)
+	}
+	m.sharedKeys[kt] = key
+}
+
+// RotateSharedCertKey replaces the certificate keys shared by all domains,
+// see Manager.SharedCertKey, with new ones, and requests new certificates
+// with them from the CA right away for all the domains m holds certificates
+// for. It returns the first error of these requests, if any; the domains
+// whose request failed keep their certificate until their next renewal,
+// which uses the new key.
+//
+// It fails if SharedCertKey is not set or if m is read-only.
+func (m *Manager) RotateSharedCertKey(ctx context.Context) error {
+	switch {
+	case !m.SharedCertKey:
+		return errors.New("acme/autocert: RotateSharedCertKey called without SharedCertKey")
+	case m.ReadOnly:
+		return errors.New("acme/autocert: RotateSharedCertKey called on a read-only Manager")
+	}
+
+	var renewals []*domainRenewal
+	m.renewalMu.Lock()
+	for _, dr := range m.renewal {
+		renewals = append(renewals, dr)
+	}
+	m.renewalMu.Unlock()
+
+	types := make(map[KeyType]bool)
+	m.sharedKeyMu.Lock()
+	for kt := range m.sharedKeys {
+		types[kt] = true
+	}
+	for _, dr := range renewals {
+		types[m.certKeyType(dr.ck)] = true
+	}
+	for kt := range types {
+		if _, err := m.newSharedKey(ctx, kt); err != nil {
+			m.sharedKeyMu.Unlock()
+			return err
+		}
+	}
+	m.sharedKeyMu.Unlock()
+
+	var firstErr error
+	for _, dr := range renewals {
+		if err := dr.forceRenew(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
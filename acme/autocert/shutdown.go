@@ -0,0 +1,98 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"context"
+	"errors"
+)
+
+// errShutDown is returned for the work refused after Manager.Shutdown.
+var errShutDown = errors.New("acme/autocert: Manager is shut down")
+
+// Shutdown stops the renewals of the certificates m holds and waits for
+// the issuances in progress to complete, so that the certificates they
+// obtain are stored in Cache rather than lost when the process exits.
+//
+// Once Shutdown is called, m refuses to ask the CA for any certificate:
+// GetCertificate fails for the domains m holds no certificate for,
+// ForceRenew and SubmitCSR fail, and no renewal starts. The certificates
+// m holds are still served.
+//
+// If ctx is done before the issuances in progress complete, they are
+// abandoned and Shutdown returns the error of ctx. Shutdown may be called
+// several times, for instance with a longer deadline.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.shutdownMu.Lock()
+	m.shutDown = true
+	var drained chan struct{}
+	if m.inflight > 0 {
+		if m.drained == nil {
+			m.drained = make(chan struct{})
+		}
+		drained = m.drained
+	}
+	m.shutdownMu.Unlock()
+
+	var err error
+	if drained != nil {
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			err = ctx.Err()
+			m.shutdownMu.Lock()
+			if m.abandonWork != nil {
+				m.abandonWork()
+			}
+			m.shutdownMu.Unlock()
+		}
+	}
+	// The renewals in progress hold the timers of their domain, which
+	// stopRenew waits for: abandoned ones return as soon as they see
+	// their context is done.
+	m.stopRenew()
+	return err
+}
+
+// beginWork records an issuance about to start with ctx, unless Shutdown
+// was called. It returns the context to issue with, which is done as well
+// if Shutdown abandons the issuance, and the func to call once done.
+func (m *Manager) beginWork(ctx context.Context) (context.Context, func(), error) {
+	m.shutdownMu.Lock()
+	defer m.shutdownMu.Unlock()
+	if m.shutDown {
+		return nil, nil, errShutDown
+	}
+	if m.workCtx == nil {
+		m.workCtx, m.abandonWork = context.WithCancel(context.Background())
+	}
+	m.inflight++
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(m.workCtx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+		m.endWork()
+	}, nil
+}
+
+// endWork records the end of an issuance recorded by beginWork,
+// unblocking Shutdown once none is left.
+func (m *Manager) endWork() {
+	m.shutdownMu.Lock()
+	defer m.shutdownMu.Unlock()
+	m.inflight--
+	if m.inflight == 0 && m.drained != nil {
+		close(m.drained)
+		m.drained = nil
+	}
+}
+
+// isShutDown reports whether Shutdown was called.
+func (m *Manager) isShutDown() bool {
+	m.shutdownMu.Lock()
+	defer m.shutdownMu.Unlock()
+	return m.shutDown
+}
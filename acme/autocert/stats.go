@@ -0,0 +1,221 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Stats summarizes the state of the certificates a Manager holds and renews.
+type Stats struct {
+	// Domains is the number of domains with a certificate.
+	Domains int
+	// Certs is the number of certificates, counting the ECDSA and
+	// RSA ones of a domain apart.
+	Certs int
+	// NearExpiry is the number of certificates expiring within RenewBefore,
+	// that is due for renewal.
+	NearExpiry int
+	// MinValidity is the remaining validity of the certificate expiring
+	// first, negative if it has expired. It is zero if there is none.
+	MinValidity time.Duration
+	// RenewalErrors is the number of failed renewals since the last
+	// successful one of their certificate, summed over certificates.
+	RenewalErrors int
+	// NextRenewal is when the next renewal is scheduled.
+	// It is the zero value if there is none.
+	NextRenewal time.Time
+}
+
+// Stats returns the current statistics of the certificates m renews.
+//
+// If m.ExpvarName is set, they are also published with the expvar package
+// as a JSON object with the keys "domains", "certs", "near_expiry",
+// "min_validity_seconds", "renewal_errors" and "next_renewal", the latter
+// being in RFC 3339 format, or empty if there is none, along with
+// "renewal_failures", the object of RenewalFailures.
+func (m *Manager) Stats() Stats {
+	m.renewalMu.Lock()
+	renewals := make([]*domainRenewal, 0, len(m.renewal))
+	for _, dr := range m.renewal {
+		renewals = append(renewals, dr)
+	}
+	m.renewalMu.Unlock()
+
+	var st Stats
+	now := m.now()
+	renewBefore := m.renewBefore()
+	domains := make(map[string]bool)
+	m.statsMu.Lock()
+	defer m.statsMu.Unlock()
+	for _, dr := range renewals {
+		rs := dr.stats
+		if rs.exp.IsZero() {
+			// Not started yet.
+			continue
+		}
+		domains[dr.ck.domain] = true
+		st.Certs++
+		left := rs.exp.Sub(now)
+		if left < renewBefore {
+			st.NearExpiry++
+		}
+		if st.Certs == 1 || left < st.MinValidity {
+			st.MinValidity = left
+		}
+		st.RenewalErrors += rs.failures
+		if !rs.due.IsZero() && (st.NextRenewal.IsZero() || rs.due.Before(st.NextRenewal)) {
+			st.NextRenewal = rs.due
+		}
+	}
+	st.Domains = len(domains)
+	return st
+}
+
+// RenewalFailures returns the number of renewals which failed since m
+// started, by FailureReason, such as ReasonRateLimit. The reasons without
+// failures are omitted. Unlike Stats.RenewalErrors, the counts are not
+// reset by a successful renewal, so that the failures can be charted by
+// reason over time.
+func (m *Manager) RenewalFailures() map[string]int {
+	m.statsMu.Lock()
+	defer m.statsMu.Unlock()
+	res := make(map[string]int, len(m.renewalFailures))
+	for reason, n := range m.renewalFailures {
+		res[reason] = n
+	}
+	return res
+}
+
+// RenewalReportEntry is the renewal state of a certificate reported by
+// Manager.RenewalReport, under the JSON keys of its fields.
+type RenewalReportEntry struct {
+	// Domain is the domain of the certificate.
+	Domain string `json:"domain"`
+	// KeyType is the type of its key, "ecdsa" or "rsa".
+	KeyType string `json:"key_type"`
+	// Expiry is when it expires.
+	Expiry time.Time `json:"expiry"`
+	// NextRenewal is when its renewal is scheduled. It is nil if renewal
+	// has given up until ForceRenew is called.
+	NextRenewal *time.Time `json:"next_renewal,omitempty"`
+	// LastOutcome is the outcome of its last renewal attempt, "success"
+	// or "error", or "none" if it has not been renewed since it was loaded
+	// or issued.
+	LastOutcome string `json:"last_outcome"`
+	// LastAttempt is when the last renewal attempt ended, if any.
+	LastAttempt *time.Time `json:"last_attempt,omitempty"`
+	// LastError is the error of the last renewal attempt, if it failed.
+	LastError string `json:"last_error,omitempty"`
+	// Failures is the number of failed renewals since the last
+	// successful one.
+	Failures int `json:"failures"`
+}
+
+// RenewalReport returns the renewal schedule of the certificates m renews,
+// for dashboards and external schedulers, as a JSON object whose "certs"
+// key is an array of RenewalReportEntry sorted by domain and key type, and
+// whose "generated" key is the time of the report.
+//
+// It is safe to call RenewalReport while renewals are running; it does
+// not wait for them.
+func (m *Manager) RenewalReport() ([]byte, error) {
+	m.renewalMu.Lock()
+	renewals := make([]*domainRenewal, 0, len(m.renewal))
+	for _, dr := range m.renewal {
+		renewals = append(renewals, dr)
+	}
+	m.renewalMu.Unlock()
+
+	entries := make([]RenewalReportEntry, 0, len(renewals))
+	m.statsMu.Lock()
+	for _, dr := range renewals {
+		rs := dr.stats
+		if rs.exp.IsZero() {
+			// Not started yet.
+			continue
+		}
+		e := RenewalReportEntry{
+			Domain:      dr.ck.domain,
+			KeyType:     "ecdsa",
+			Expiry:      rs.exp,
+			LastOutcome: "none",
+			Failures:    rs.failures,
+		}
+		if dr.ck.isRSA {
+			e.KeyType = "rsa"
+		}
+		if !rs.due.IsZero() {
+			due := rs.due
+			e.NextRenewal = &due
+		}
+		if !rs.lastAt.IsZero() {
+			at := rs.lastAt
+			e.LastAttempt = &at
+			e.LastOutcome = "success"
+			if rs.lastErr != nil {
+				e.LastOutcome = "error"
+				e.LastError = rs.lastErr.Error()
+			}
+		}
+		entries = append(entries, e)
+	}
+	m.statsMu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Domain != entries[j].Domain {
+			return entries[i].Domain < entries[j].Domain
+		}
+		return entries[i].KeyType < entries[j].KeyType
+	})
+	return json.Marshal(struct {
+		Generated time.Time            `json:"generated"`
+		Certs     []RenewalReportEntry `json:"certs"`
+	}{m.now(), entries})
+}
+
+// expvarMu serializes the publication of Manager stats,
+// so that duplicate names are detected.
+var expvarMu sync.Mutex
+
+// publishExpvar publishes m.Stats under m.ExpvarName, once, if set.
+func (m *Manager) publishExpvar() {
+	m.expvarOnce.Do(func() {
+		name := m.ExpvarName
+		if name == "" {
+			return
+		}
+		expvarMu.Lock()
+		defer expvarMu.Unlock()
+		if expvar.Get(name) != nil {
+			log.Printf("acme/autocert: expvar %q is already published; not publishing Manager stats", name)
+			return
+		}
+		expvar.Publish(name, expvar.Func(m.expvarStats))
+	})
+}
+
+// expvarStats returns m.Stats in the form published by publishExpvar.
+func (m *Manager) expvarStats() interface{} {
+	st := m.Stats()
+	var next string
+	if !st.NextRenewal.IsZero() {
+		next = st.NextRenewal.Format(time.RFC3339)
+	}
+	return map[string]interface{}{
+		"domains":              st.Domains,
+		"certs":                st.Certs,
+		"near_expiry":          st.NearExpiry,
+		"min_validity_seconds": int64(st.MinValidity / time.Second),
+		"renewal_errors":       st.RenewalErrors,
+		"next_renewal":         next,
+		"renewal_failures":     m.RenewalFailures(),
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"context"
+	"sync"
+)
+
+// TieredCache implements Cache by mirroring a Primary Cache, typically a
+// network storage shared by the nodes of a cluster, to a Secondary one,
+// typically a DirCache on local disk, so that a node keeps serving its
+// certificates while the Primary is unreachable.
+//
+// Get reads from the Primary and falls back to the Secondary if the Primary
+// fails or misses the entry. Put and Delete apply to both caches and succeed
+// if the Primary succeeds, whatever the outcome for the Secondary. When the
+// Primary fails, the operation is still applied to the Secondary and the key
+// is remembered; after the next successful operation on the Primary, the
+// entries of the keys so remembered are copied from the Secondary to the
+// Primary, or deleted from it, to reconcile them.
+//
+// A TieredCache must not be copied after first use.
+type TieredCache struct {
+	Primary   Cache
+	Secondary Cache
+
+	mu      sync.Mutex
+	seq     uint64            // last sequence number in pending
+	pending map[string]uint64 // keys to reconcile in Primary, by seq of the failure
+}
+
+// Get returns the data of key in the Primary, or else in the Secondary.
+// If both fail, the error of the Primary is returned.
+func (c *TieredCache) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := c.Primary.Get(ctx, key)
+	if err == nil || err == ErrCacheMiss {
+		c.reconcile(ctx)
+	}
+	if err == nil {
+		return data, nil
+	}
+	if data, err2 := c.Secondary.Get(ctx, key); err2 == nil {
+		return data, nil
+	}
+	return nil, err
+}
+
+// Put stores data under key in both caches, returning the error of the Primary.
+func (c *TieredCache) Put(ctx context.Context, key string, data []byte) error {
+	return c.apply(ctx, key, func(cache Cache) error {
+		return cache.Put(ctx, key, data)
+	})
+}
+
+// Delete removes key from both caches, returning the error of the Primary.
+func (c *TieredCache) Delete(ctx context.Context, key string) error {
+	return c.apply(ctx, key, func(cache Cache) error {
+		return cache.Delete(ctx, key)
+	})
+}
+
+// apply runs op on both caches. If op fails on the Primary,
+// key is remembered for reconciling it later.
+func (c *TieredCache) apply(ctx context.Context, key string, op func(Cache) error) error {
+	c.mu.Lock()
+	// The op supersedes a pending reconciliation.
+	delete(c.pending, key)
+	c.mu.Unlock()
+
+	err := op(c.Primary)
+	op(c.Secondary)
+	if err != nil {
+		c.mu.Lock()
+		if c.pending == nil {
+			c.pending = make(map[string]uint64)
+		}
+		c.seq++
+		c.pending[key] = c.seq
+		c.mu.Unlock()
+		return err
+	}
+	c.reconcile(ctx)
+	return nil
+}
+
+// reconcile copies the entries of the pending keys from the Secondary to
+// the Primary, or deletes them from the Primary if the Secondary misses them.
+// The keys which fail remain pending.
+func (c *TieredCache) reconcile(ctx context.Context) {
+	c.mu.Lock()
+	if len(c.pending) == 0 {
+		c.mu.Unlock()
+		return
+	}
+	keys := make(map[string]uint64, len(c.pending))
+	for key, seq := range c.pending {
+		keys[key] = seq
+	}
+	c.mu.Unlock()
+
+	for key, seq := range keys {
+		data, err := c.Secondary.Get(ctx, key)
+		switch {
+		case err == nil:
+			err = c.Primary.Put(ctx, key, data)
+		case err == ErrCacheMiss:
+			err = c.Primary.Delete(ctx, key)
+		}
+		if err != nil {
+			// Still failing: try again after the next success.
+			continue
+		}
+		c.mu.Lock()
+		// Unless the key failed again meanwhile.
+		if c.pending[key] == seq {
+			delete(c.pending, key)
+		}
+		c.mu.Unlock()
+	}
+}
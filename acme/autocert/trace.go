@@ -0,0 +1,114 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import "context"
+
+// Tracer starts the spans tracing the work of a Manager to obtain
+// certificates, for instance to export them with OpenTelemetry through an
+// adapter of a trace.Tracer.
+//
+// The spans are named after the operation they cover:
+//
+//	autocert.issue           first-time issuance of a certificate
+//	autocert.renew           renewal of a certificate
+//	autocert.authorizedCert  authorization of the names and certificate request
+//	autocert.verify          authorization of a name, solving a challenge
+//	autocert.finalize        submission of the CSR and wait for the certificate
+//	autocert.cache.get       read of a certificate from Cache
+//	autocert.cache.put       write of a certificate to Cache
+//
+// Their attributes include "domain", "ca", the directory URL of the CA,
+// "challenge", the type of the last challenge tried by autocert.verify, and
+// "outcome", one of "success", "error" or, for autocert.cache.get, "miss".
+//
+// Implementations must be safe for concurrent use by multiple goroutines.
+type Tracer interface {
+	// Start starts a span named name, a child of the span carried by ctx,
+	// if any, and returns a context carrying the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SetAttribute sets the attribute key of the span to value.
+	SetAttribute(key, value string)
+
+	// End ends the span. The err argument is the error the operation
+	// failed with, or nil if it succeeded.
+	End(err error)
+}
+
+type tracerKey struct{}
+
+// WithTracer returns a copy of ctx carrying t. The work of a Manager on
+// behalf of a call with the returned context, or a context derived
+// from it, is traced with t rather than Manager.Tracer.
+//
+// For instance, the context of a TLS handshake, as set with
+// tls.Conn.HandshakeContext or http.Server.ConnContext, traces the
+// certificate GetCertificate obtains for the handshake.
+func WithTracer(ctx context.Context, t Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, t)
+}
+
+// tracer returns the Tracer of ctx or else m.Tracer, which may be nil.
+func (m *Manager) tracer(ctx context.Context) Tracer {
+	if t, ok := ctx.Value(tracerKey{}).(Tracer); ok && t != nil {
+		return t
+	}
+	return m.Tracer
+}
+
+// span is a Span, or nothing if tracing is off.
+type span struct {
+	s Span
+}
+
+// startSpan starts a span named name for domain if ctx or m has a Tracer.
+// Otherwise it returns ctx and an empty span, at no cost.
+func (m *Manager) startSpan(ctx context.Context, name, domain string) (context.Context, span) {
+	t := m.tracer(ctx)
+	if t == nil {
+		return ctx, span{}
+	}
+	ctx, s := t.Start(ctx, name)
+	s.SetAttribute("domain", domain)
+	return ctx, span{s}
+}
+
+// startCASpan is like startSpan for the operations involving the CA,
+// whose spans also have the "ca" attribute.
+func (m *Manager) startCASpan(ctx context.Context, name, domain string) (context.Context, span) {
+	ctx, sp := m.startSpan(ctx, name, domain)
+	if sp.s != nil {
+		sp.s.SetAttribute("ca", m.directoryURL())
+	}
+	return ctx, sp
+}
+
+func (s span) setAttribute(key, value string) {
+	if s.s != nil {
+		s.s.SetAttribute(key, value)
+	}
+}
+
+// end records the outcome of the operation and ends the span.
+// A cache miss is not an error.
+func (s span) end(err error) {
+	if s.s == nil {
+		return
+	}
+	switch err {
+	case nil:
+		s.s.SetAttribute("outcome", "success")
+	case ErrCacheMiss:
+		s.s.SetAttribute("outcome", "miss")
+		err = nil
+	default:
+		s.s.SetAttribute("outcome", "error")
+	}
+	s.s.End(err)
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// certVersionKey returns the Cache key of the n-th previous version of the
+// cert of ck, n >= 1 being the latest one.
+func certVersionKey(ck certKey, n int) string {
+	return fmt.Sprintf("%s+v%d", ck, n)
+}
+
+// keepCertVersion moves the cert of ck stored in cache to the previous
+// versions, shifting them and dropping the oldest one beyond m.CertVersions,
+// before cachePut replaces it with data.
+func (m *Manager) keepCertVersion(ctx context.Context, cache Cache, ck certKey, data []byte) error {
+	cur, err := cache.Get(ctx, ck.String())
+	if err == ErrCacheMiss || err == nil && bytes.Equal(cur, data) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for n := m.CertVersions; n > 1; n-- {
+		if err := moveCertVersion(ctx, cache, certVersionKey(ck, n-1), certVersionKey(ck, n)); err != nil {
+			return err
+		}
+	}
+	return cache.Put(ctx, certVersionKey(ck, 1), cur)
+}
+
+// moveCertVersion copies the cache entry at key from to key to,
+// or deletes the latter if the former is missing.
+func moveCertVersion(ctx context.Context, cache Cache, from, to string) error {
+	data, err := cache.Get(ctx, from)
+	switch {
+	case err == ErrCacheMiss:
+		return cache.Delete(ctx, to)
+	case err != nil:
+		return err
+	}
+	return cache.Put(ctx, to, data)
+}
+
+// Rollback reverts the certificates of domain to their latest previous
+// versions kept in Cache, see CertVersions, for instance after a newly issued
+// certificate turns out to be unusable by some clients. The previous version
+// becomes the current one, both in Cache and for GetCertificate, and its
+// renewal is rescheduled according to its expiration time, which may mean
+// right away.
+//
+// Rollback returns an error if there is no valid previous version or if m
+// is read-only.
+func (m *Manager) Rollback(domain string) error {
+	if m.ReadOnly {
+		return errors.New("acme/autocert: Rollback called on a read-only Manager")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var found bool
+	for _, ck := range []certKey{{domain: domain}, {domain: domain, isRSA: true}} {
+		cache := m.cacheFor(ck)
+		if cache == nil || m.CertVersions <= 0 {
+			break
+		}
+		data, err := cache.Get(ctx, certVersionKey(ck, 1))
+		if err == ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		tlscert, err := decodeCert(ck, data, m.now())
+		if err != nil {
+			return fmt.Errorf("acme/autocert: previous certificate version for %q: %v", ck, err)
+		}
+		signer, ok := tlscert.PrivateKey.(crypto.Signer)
+		if !ok {
+			return fmt.Errorf("acme/autocert: previous certificate version for %q: private key cannot sign", ck)
+		}
+
+		lru := m.certLRU()
+		if lru != nil {
+			lru.remove(ck)
+		}
+		if err := cache.Put(ctx, ck.String(), data); err != nil {
+			return err
+		}
+		for n := 1; n < m.CertVersions; n++ {
+			if err := moveCertVersion(ctx, cache, certVersionKey(ck, n+1), certVersionKey(ck, n)); err != nil {
+				return err
+			}
+		}
+		if err := cache.Delete(ctx, certVersionKey(ck, m.CertVersions)); err != nil {
+			return err
+		}
+		if lru != nil {
+			lru.add(ck, tlscert)
+		}
+
+		state := &certState{
+			key:  signer,
+			cert: tlscert.Certificate,
+			leaf: tlscert.Leaf,
+		}
+		m.renewalMu.Lock()
+		dr := m.renewal[ck]
+		m.renewalMu.Unlock()
+		if dr != nil {
+			dr.adopt(state)
+		} else {
+			m.stateMu.Lock()
+			if m.state == nil {
+				m.state = make(map[certKey]*certState)
+			}
+			m.state[ck] = state
+			m.addAliases(ck, state.leaf)
+			m.stateMu.Unlock()
+			m.renew(ck, signer, state.leaf.NotAfter)
+		}
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("acme/autocert: no previous certificate version for %q", domain)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package autocert
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"time"
+)
+
+// spareCacheKey returns the cache key of the warm spare of ck,
+// see Manager.WarmSpare.
+func spareCacheKey(ck certKey) string {
+	return ck.String() + "+spare"
+}
+
+// keepSpare keeps state, a newly issued cert, as the warm spare of dr and
+// stores it in cache. It activates the spare right away if it is due, and
+// otherwise returns the delay before its activation.
+// dr.timerMu must be held.
+func (dr *domainRenewal) keepSpare(ctx context.Context, state *certState, tlscert *tls.Certificate) (time.Duration, error) {
+	if cache := dr.m.cacheFor(dr.ck); cache != nil {
+		data, err := encodeCert(tlscert)
+		if err != nil {
+			return 0, err
+		}
+		if err := cache.Put(ctx, spareCacheKey(dr.ck), data); err != nil {
+			return 0, err
+		}
+	}
+	dr.spare = state
+	d, _, err := dr.pendingSpare(ctx)
+	if err == errRenewalDeferred {
+		// The spare was issued.
+		err = nil
+	}
+	return d, err
+}
+
+// pendingSpare activates the warm spare of dr if it is due, loading it from
+// cache if dr has none. It reports whether there is a spare, and returns the
+// delay before the next renewal: that before the activation of the spare,
+// or after it, the renewal of the activated cert. Until the activation, the
+// error is errRenewalDeferred.
+// dr.timerMu must be held.
+func (dr *domainRenewal) pendingSpare(ctx context.Context) (next time.Duration, ok bool, err error) {
+	if dr.spare == nil {
+		dr.spare = dr.cachedSpare(ctx)
+	}
+	if dr.spare == nil {
+		return 0, false, nil
+	}
+	now := dr.m.now()
+	at := dr.exp.Add(-dr.m.renewalMargin())
+	if nb := dr.spare.leaf.NotBefore; at.Before(nb) {
+		at = nb
+	}
+	if now.Before(at) {
+		return at.Sub(now), true, errRenewalDeferred
+	}
+
+	state := dr.spare
+	tlscert, err := state.tlscert()
+	if err != nil {
+		dr.spare = nil
+		return 0, true, err
+	}
+	if err := dr.m.cachePut(ctx, dr.ck, tlscert); err != nil {
+		return 0, true, err
+	}
+	dr.updateState(state)
+	dr.exp = state.leaf.NotAfter
+	dr.spare = nil
+	if cache := dr.m.cacheFor(dr.ck); cache != nil {
+		// A spare left over is ignored, since it does not expire later
+		// than the current cert.
+		cache.Delete(ctx, spareCacheKey(dr.ck))
+	}
+	return dr.next(dr.exp), true, nil
+}
+
+// cachedSpare returns the warm spare of dr stored in cache, or nil if there
+// is none replacing the current cert.
+func (dr *domainRenewal) cachedSpare(ctx context.Context) *certState {
+	cache := dr.m.cacheFor(dr.ck)
+	if cache == nil {
+		return nil
+	}
+	data, err := cache.Get(ctx, spareCacheKey(dr.ck))
+	if err != nil {
+		return nil
+	}
+	tlscert, err := decodeCert(dr.ck, data, dr.m.now())
+	if err != nil || !tlscert.Leaf.NotAfter.After(dr.exp) {
+		return nil
+	}
+	signer, ok := tlscert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil
+	}
+	return &certState{
+		key:  signer,
+		cert: tlscert.Certificate,
+		leaf: tlscert.Leaf,
+	}
+}
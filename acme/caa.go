@@ -0,0 +1,146 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package acme
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// caaCritical is the issuer critical flag of CAA records, RFC 8659, section 4.1.
+const caaCritical = 128
+
+// CAARecord is a DNS Certification Authority Authorization record,
+// as defined in RFC 8659.
+type CAARecord struct {
+	Flags uint8  // The flags, e.g. 128 for the issuer critical flag.
+	Tag   string // The property tag, e.g. "issue".
+	Value string // The property value, e.g. "letsencrypt.org".
+}
+
+// CAAResolver looks up CAA records, see Client.CAAResolver.
+type CAAResolver interface {
+	// LookupCAA returns the CAA records of the DNS name, which are not
+	// inherited from its parent domains. It returns no records and a nil
+	// error if name has none.
+	LookupCAA(ctx context.Context, name string) ([]CAARecord, error)
+}
+
+// CheckIdentifierControl verifies locally that the CA could issue a
+// certificate for id, before requesting an authorization: the identifier
+// must be a valid DNS name, including a wildcard one, and not an IP address,
+// since only "dns" identifiers are supported. If c.CAAResolver is not nil,
+// the CAA records of the name, found as specified in RFC 8659, must also
+// allow an issuer among the CAA identities of the CA, see Directory.CAA.
+//
+// CAA records are not checked if the CA does not advertise its CAA identities.
+func (c *Client) CheckIdentifierControl(ctx context.Context, id AuthzID) error {
+	if id.Type != "dns" {
+		return fmt.Errorf("acme: unsupported identifier type %q", id.Type)
+	}
+	name := strings.ToLower(strings.TrimSuffix(id.Value, "."))
+	wildcard := strings.HasPrefix(name, "*.")
+	if wildcard {
+		name = name[len("*."):]
+	}
+	if net.ParseIP(name) != nil {
+		return fmt.Errorf("acme: identifier %q is an IP address", id.Value)
+	}
+	if !validDNSName(name) {
+		return fmt.Errorf("acme: identifier %q is not a valid DNS name", id.Value)
+	}
+	if c.CAAResolver == nil {
+		return nil
+	}
+
+	dir, err := c.Discover(ctx)
+	if err != nil {
+		return err
+	}
+	if len(dir.CAA) == 0 {
+		return nil
+	}
+	// Climb the DNS tree up to the first name with CAA records.
+	var records []CAARecord
+	for n := name; n != ""; {
+		if records, err = c.CAAResolver.LookupCAA(ctx, n); err != nil {
+			return fmt.Errorf("acme: looking up the CAA records of %q: %v", n, err)
+		}
+		if len(records) > 0 {
+			break
+		}
+		i := strings.IndexByte(n, '.')
+		if i < 0 {
+			break
+		}
+		n = n[i+1:]
+	}
+	if !caaAllows(records, dir.CAA, wildcard) {
+		return fmt.Errorf("acme: CAA records of %q do not allow issuance by the CA", id.Value)
+	}
+	return nil
+}
+
+// caaAllows reports whether the relevant CAA records allow one of
+// the issuer identities to issue a certificate, wildcard or not.
+func caaAllows(records []CAARecord, identities []string, wildcard bool) bool {
+	var issue, issueWild []string
+	for _, r := range records {
+		switch strings.ToLower(r.Tag) {
+		case "issue":
+			issue = append(issue, r.Value)
+		case "issuewild":
+			issueWild = append(issueWild, r.Value)
+		case "iodef":
+		default:
+			if r.Flags&caaCritical != 0 {
+				return false
+			}
+		}
+	}
+	values := issue
+	if wildcard && len(issueWild) > 0 {
+		values = issueWild
+	}
+	if len(values) == 0 {
+		// No restrictions on issuers.
+		return true
+	}
+	for _, v := range values {
+		if i := strings.IndexByte(v, ';'); i >= 0 {
+			v = v[:i]
+		}
+		v = strings.TrimSpace(v)
+		for _, id := range identities {
+			if v != "" && strings.EqualFold(v, id) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validDNSName reports whether name is a valid DNS name
+// made of letters, digits and hyphens.
+func validDNSName(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			switch {
+			case 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-':
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package acme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// mapCAAResolver is a CAAResolver serving the records of a map.
+type mapCAAResolver map[string][]CAARecord
+
+func (r mapCAAResolver) LookupCAA(ctx context.Context, name string) ([]CAARecord, error) {
+	if records, ok := r[name]; ok && records == nil {
+		return nil, errors.New("SERVFAIL")
+	}
+	return r[name], nil
+}
+
+func TestCheckIdentifierControl(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"newAuthz": "https://example.com/acme/new-authz", "meta": {"caaIdentities": ["ca.example"]}}`)
+	}))
+	defer ts.Close()
+
+	issue := func(v string) CAARecord { return CAARecord{Tag: "issue", Value: v} }
+	resolver := mapCAAResolver{
+		"allowed.example":     {issue("ca.example"), {Tag: "iodef", Value: "mailto:sec@allowed.example"}},
+		"forbidden.example":   {issue("other-ca.example")},
+		"nobody.example":      {issue(";")},
+		"params.example":      {issue(" CA.example; accounturi=https://ca.example/acct/1")},
+		"wild.example":        {issue("other-ca.example"), {Tag: "issuewild", Value: "ca.example"}},
+		"onlywild.example":    {{Tag: "issuewild", Value: "other-ca.example"}},
+		"critical.example":    {issue("ca.example"), {Flags: 128, Tag: "tbs", Value: "unknown"}},
+		"noncritical.example": {issue("ca.example"), {Tag: "tbs", Value: "unknown"}},
+		"servfail.example":    nil,
+	}
+	tests := []struct {
+		id      string
+		wantErr string // substring of the error, or empty
+	}{
+		{"allowed.example", ""},
+		{"www.allowed.example.", ""}, // inherited from the parent
+		{"unrestricted.example", ""},
+		{"forbidden.example", "do not allow"},
+		{"sub.forbidden.example", "do not allow"},
+		{"nobody.example", "do not allow"},
+		{"params.example", ""},
+		{"wild.example", "do not allow"},
+		{"*.wild.example", ""},
+		{"*.forbidden.example", "do not allow"},
+		{"onlywild.example", ""},
+		{"*.onlywild.example", "do not allow"},
+		{"critical.example", "do not allow"},
+		{"noncritical.example", ""},
+		{"servfail.example", "SERVFAIL"},
+		{"192.0.2.1", "IP address"},
+		{"2001:db8::1", "IP address"},
+		{"bad_name.example", "not a valid DNS name"},
+		{"-bad.example", "not a valid DNS name"},
+		{"", "not a valid DNS name"},
+	}
+	c := &Client{DirectoryURL: ts.URL, CAAResolver: resolver}
+	for _, tt := range tests {
+		err := c.CheckIdentifierControl(context.Background(), AuthzID{Type: "dns", Value: tt.id})
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("CheckIdentifierControl(%q): %v", tt.id, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("CheckIdentifierControl(%q): %v; want an error containing %q", tt.id, err, tt.wantErr)
+		}
+	}
+
+	if err := c.CheckIdentifierControl(context.Background(), AuthzID{Type: "ip", Value: "192.0.2.1"}); err == nil {
+		t.Error("CheckIdentifierControl accepted an \"ip\" identifier")
+	}
+
+	// Without a resolver, CAA records are not checked.
+	c = &Client{DirectoryURL: ts.URL}
+	if err := c.CheckIdentifierControl(context.Background(), AuthzID{Type: "dns", Value: "forbidden.example"}); err != nil {
+		t.Errorf("CheckIdentifierControl without CAAResolver: %v", err)
+	}
+}
+
+func TestCheckIdentifierControlNoCAAIdentities(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"newAuthz": "https://example.com/acme/new-authz"}`)
+	}))
+	defer ts.Close()
+
+	resolver := mapCAAResolver{"forbidden.example": {{Tag: "issue", Value: ";"}}}
+	c := &Client{DirectoryURL: ts.URL, CAAResolver: resolver}
+	if err := c.CheckIdentifierControl(context.Background(), AuthzID{Type: "dns", Value: "forbidden.example"}); err != nil {
+		t.Errorf("CheckIdentifierControl: %v; want no CAA check", err)
+	}
+}
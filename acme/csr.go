@@ -0,0 +1,173 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package acme
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// CSRIdentifiersError is returned by ValidateCSRIdentifiers when the
+// identifiers of a certificate request differ from the authorized ones.
+type CSRIdentifiersError struct {
+	// Extra lists the identifiers of the request which are not authorized.
+	Extra []AuthzID
+
+	// Missing lists the authorized identifiers the request lacks.
+	Missing []AuthzID
+}
+
+func (e *CSRIdentifiersError) Error() string {
+	var parts []string
+	if len(e.Extra) > 0 {
+		parts = append(parts, "extra "+formatAuthzIDs(e.Extra))
+	}
+	if len(e.Missing) > 0 {
+		parts = append(parts, "missing "+formatAuthzIDs(e.Missing))
+	}
+	return "acme: certificate request identifiers do not match the authorized identifiers: " + strings.Join(parts, "; ")
+}
+
+func formatAuthzIDs(ids []AuthzID) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = fmt.Sprintf("%s:%q", id.Type, id.Value)
+	}
+	return strings.Join(s, ", ")
+}
+
+// ValidateCSRIdentifiers checks that the identifiers of csr, its DNS names,
+// IP addresses and common name, are exactly ids, the "dns" and "ip"
+// identifiers authorized for the certificate, typically those of the
+// Authorize and AuthorizeIP calls preceding CreateCert. A CA refuses to
+// issue a certificate for a request with an extra identifier, and may
+// leave out, or refuse, a missing one; ValidateCSRIdentifiers lets callers
+// fail before submitting the request, with an error naming them.
+//
+// The returned error, if any, is a *CSRIdentifiersError.
+func ValidateCSRIdentifiers(csr *x509.CertificateRequest, ids []AuthzID) error {
+	want := make(map[AuthzID]bool)
+	for _, id := range ids {
+		want[canonicalAuthzID(id)] = true
+	}
+	have := make(map[AuthzID]bool)
+	var e CSRIdentifiersError
+	add := func(id AuthzID) {
+		id = canonicalAuthzID(id)
+		if have[id] {
+			return
+		}
+		have[id] = true
+		if !want[id] {
+			e.Extra = append(e.Extra, id)
+		}
+	}
+	for _, name := range csr.DNSNames {
+		add(AuthzID{Type: "dns", Value: name})
+	}
+	for _, ip := range csr.IPAddresses {
+		add(AuthzID{Type: "ip", Value: ip.String()})
+	}
+	if cn := csr.Subject.CommonName; cn != "" {
+		if net.ParseIP(cn) != nil {
+			add(AuthzID{Type: "ip", Value: cn})
+		} else {
+			add(AuthzID{Type: "dns", Value: cn})
+		}
+	}
+	for _, id := range ids {
+		if id = canonicalAuthzID(id); !have[id] {
+			have[id] = true // reported once
+			e.Missing = append(e.Missing, id)
+		}
+	}
+	if len(e.Extra) > 0 || len(e.Missing) > 0 {
+		return &e
+	}
+	return nil
+}
+
+// CertMismatchError is returned by VerifyIssuedCert, and by CreateCert
+// with the WithCSRVerification option, when an issued certificate does not
+// match the certificate request it was issued for.
+type CertMismatchError struct {
+	// PublicKey reports whether the public key of the certificate
+	// differs from that of the request.
+	PublicKey bool
+
+	// Extra lists the identifiers of the certificate the request lacks.
+	Extra []AuthzID
+
+	// Missing lists the identifiers of the request the certificate lacks.
+	Missing []AuthzID
+}
+
+func (e *CertMismatchError) Error() string {
+	var parts []string
+	if e.PublicKey {
+		parts = append(parts, "different public key")
+	}
+	if len(e.Extra) > 0 {
+		parts = append(parts, "extra "+formatAuthzIDs(e.Extra))
+	}
+	if len(e.Missing) > 0 {
+		parts = append(parts, "missing "+formatAuthzIDs(e.Missing))
+	}
+	return "acme: certificate does not match the certificate request: " + strings.Join(parts, "; ")
+}
+
+// VerifyIssuedCert checks that leaf, a certificate issued for csr, holds
+// the public key of csr and exactly its identifiers, as compared by
+// ValidateCSRIdentifiers: its DNS names, IP addresses and common name.
+// It catches a CA bug, or a response tampered with on the way, before the
+// certificate is trusted.
+//
+// The returned error, if any, is a *CertMismatchError.
+func VerifyIssuedCert(leaf *x509.Certificate, csr *x509.CertificateRequest) error {
+	var e CertMismatchError
+	pub, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	e.PublicKey = !ok || !pub.Equal(csr.PublicKey)
+
+	var ids []AuthzID
+	for _, name := range leaf.DNSNames {
+		ids = append(ids, AuthzID{Type: "dns", Value: name})
+	}
+	for _, ip := range leaf.IPAddresses {
+		ids = append(ids, AuthzID{Type: "ip", Value: ip.String()})
+	}
+	if cn := leaf.Subject.CommonName; cn != "" {
+		if net.ParseIP(cn) != nil {
+			ids = append(ids, AuthzID{Type: "ip", Value: cn})
+		} else {
+			ids = append(ids, AuthzID{Type: "dns", Value: cn})
+		}
+	}
+	if err, ok := ValidateCSRIdentifiers(csr, ids).(*CSRIdentifiersError); ok {
+		// The extra identifiers of the request are missing from the
+		// certificate, and the other way around.
+		e.Extra, e.Missing = err.Missing, err.Extra
+	}
+	if e.PublicKey || len(e.Extra) > 0 || len(e.Missing) > 0 {
+		return &e
+	}
+	return nil
+}
+
+// canonicalAuthzID returns id with its value in a canonical form for its
+// type: lower case for a DNS name, and the shortest form for an IP address.
+func canonicalAuthzID(id AuthzID) AuthzID {
+	switch id.Type {
+	case "dns":
+		id.Value = strings.ToLower(strings.TrimSuffix(id.Value, "."))
+	case "ip":
+		if ip := net.ParseIP(id.Value); ip != nil {
+			id.Value = ip.String()
+		}
+	}
+	return id
+}
@@ -0,0 +1,186 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package acme
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValidateCSRIdentifiers(t *testing.T) {
+	dns := func(v string) AuthzID { return AuthzID{Type: "dns", Value: v} }
+	ip := func(v string) AuthzID { return AuthzID{Type: "ip", Value: v} }
+	tests := []struct {
+		name    string
+		cn      string
+		dns     []string
+		ips     []net.IP
+		ids     []AuthzID
+		extra   []AuthzID
+		missing []AuthzID
+	}{
+		{
+			name: "match",
+			cn:   "example.org",
+			dns:  []string{"example.org", "WWW.example.org"},
+			ips:  []net.IP{net.ParseIP("2001:db8::1")},
+			ids:  []AuthzID{dns("www.example.org"), dns("example.org"), ip("2001:db8:0::1")},
+		},
+		{
+			name: "common name only",
+			cn:   "example.org",
+			ids:  []AuthzID{dns("example.org")},
+		},
+		{
+			name:  "extra SAN",
+			cn:    "example.org",
+			dns:   []string{"example.org", "www.example.org", "mail.example.org"},
+			ips:   []net.IP{net.ParseIP("192.0.2.1")},
+			ids:   []AuthzID{dns("example.org"), dns("www.example.org")},
+			extra: []AuthzID{dns("mail.example.org"), ip("192.0.2.1")},
+		},
+		{
+			name:    "missing SAN",
+			dns:     []string{"example.org"},
+			ids:     []AuthzID{dns("example.org"), dns("www.example.org"), ip("192.0.2.1")},
+			missing: []AuthzID{dns("www.example.org"), ip("192.0.2.1")},
+		},
+		{
+			name:    "common name not authorized",
+			cn:      "other.example",
+			dns:     []string{"example.org"},
+			ids:     []AuthzID{dns("example.org"), dns("www.example.org")},
+			extra:   []AuthzID{dns("other.example")},
+			missing: []AuthzID{dns("www.example.org")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+				Subject:     pkix.Name{CommonName: tt.cn},
+				DNSNames:    tt.dns,
+				IPAddresses: tt.ips,
+			}, testKeyEC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			csr, err := x509.ParseCertificateRequest(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ValidateCSRIdentifiers(csr, tt.ids)
+			if tt.extra == nil && tt.missing == nil {
+				if err != nil {
+					t.Fatalf("ValidateCSRIdentifiers: %v", err)
+				}
+				return
+			}
+			var e *CSRIdentifiersError
+			if !errors.As(err, &e) {
+				t.Fatalf("ValidateCSRIdentifiers: err = %v; want a *CSRIdentifiersError", err)
+			}
+			if !reflect.DeepEqual(e.Extra, tt.extra) {
+				t.Errorf("Extra = %q; want %q", e.Extra, tt.extra)
+			}
+			if !reflect.DeepEqual(e.Missing, tt.missing) {
+				t.Errorf("Missing = %q; want %q", e.Missing, tt.missing)
+			}
+		})
+	}
+}
+
+func TestVerifyIssuedCert(t *testing.T) {
+	dns := func(v string) AuthzID { return AuthzID{Type: "dns", Value: v} }
+	req, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:     pkix.Name{CommonName: "example.org"},
+		DNSNames:    []string{"example.org", "www.example.org"},
+		IPAddresses: []net.IP{net.ParseIP("192.0.2.1")},
+	}, testKeyEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		dns       []string
+		ips       []net.IP
+		pub       crypto.PublicKey
+		publicKey bool
+		extra     []AuthzID
+		missing   []AuthzID
+	}{
+		{
+			name: "match",
+			dns:  []string{"www.example.org", "EXAMPLE.org"},
+			ips:  []net.IP{net.ParseIP("192.0.2.1")},
+			pub:  &testKeyEC.PublicKey,
+		},
+		{
+			name:      "wrong key",
+			dns:       []string{"example.org", "www.example.org"},
+			ips:       []net.IP{net.ParseIP("192.0.2.1")},
+			pub:       &testKey.PublicKey,
+			publicKey: true,
+		},
+		{
+			name:    "different SANs",
+			dns:     []string{"example.org", "mail.example.org"},
+			pub:     &testKeyEC.PublicKey,
+			extra:   []AuthzID{dns("mail.example.org")},
+			missing: []AuthzID{dns("www.example.org"), {Type: "ip", Value: "192.0.2.1"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl := &x509.Certificate{
+				SerialNumber: big.NewInt(1),
+				Subject:      pkix.Name{CommonName: "example.org"},
+				NotBefore:    time.Now(),
+				NotAfter:     time.Now().Add(time.Hour),
+				DNSNames:     tt.dns,
+				IPAddresses:  tt.ips,
+			}
+			der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, tt.pub, testKeyEC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaf, err := x509.ParseCertificate(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = VerifyIssuedCert(leaf, csr)
+			if !tt.publicKey && tt.extra == nil && tt.missing == nil {
+				if err != nil {
+					t.Fatalf("VerifyIssuedCert: %v", err)
+				}
+				return
+			}
+			var e *CertMismatchError
+			if !errors.As(err, &e) {
+				t.Fatalf("VerifyIssuedCert: err = %v; want a *CertMismatchError", err)
+			}
+			if e.PublicKey != tt.publicKey {
+				t.Errorf("PublicKey = %v; want %v", e.PublicKey, tt.publicKey)
+			}
+			if !reflect.DeepEqual(e.Extra, tt.extra) {
+				t.Errorf("Extra = %q; want %q", e.Extra, tt.extra)
+			}
+			if !reflect.DeepEqual(e.Missing, tt.missing) {
+				t.Errorf("Missing = %q; want %q", e.Missing, tt.missing)
+			}
+		})
+	}
+}
@@ -10,15 +10,43 @@ import (
 	"crypto"
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/big"
+	"net"
 	"net/http"
+	"net/url"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// ClientTrace is a set of hooks to run at various stages of the HTTP requests
+// made by a Client, similar to net/http/httptrace. Any particular hook may be nil.
+// Hooks may be called concurrently from different goroutines.
+//
+// The hooks are meant for debugging interactions with a CA. They are never
+// passed request bodies, which are signed with the account key.
+type ClientTrace struct {
+	// SendRequest is called before a request is sent to the CA.
+	SendRequest func(method, url string)
+
+	// GotResponse is called when the CA responds to a request.
+	// If status is 400 or above, problem contains the response body,
+	// usually a problem document as described in RFC 7807.
+	// Otherwise, problem is nil.
+	GotResponse func(method, url string, status int, problem []byte)
+
+	// GotNonce is called with each nonce value received from the CA.
+	GotNonce func(nonce string)
+
+	// UsedNonce is called with the nonce value a request is signed with.
+	UsedNonce func(nonce string)
+}
+
 // retryTimer encapsulates common logic for retrying unsuccessful requests.
 // It is not safe for concurrent use.
 type retryTimer struct {
@@ -57,6 +85,21 @@ func (c *Client) retryTimer() *retryTimer {
 	return &retryTimer{backoffFn: f}
 }
 
+// pollTimer returns a retryTimer pausing for d between the attempts,
+// unless the response has a Retry-After header, with no limit on their number.
+func pollTimer(d time.Duration) *retryTimer {
+	return &retryTimer{backoffFn: func(n int, r *http.Request, res *http.Response) time.Duration {
+		if res != nil {
+			if v, ok := res.Header["Retry-After"]; ok {
+				if ra := retryAfter(v[0]); ra > 0 {
+					return ra
+				}
+			}
+		}
+		return d
+	}}
+}
+
 // defaultBackoff provides default Client.RetryBackoff implementation
 // using a truncated exponential backoff algorithm,
 // as described in Client.RetryBackoff.
@@ -73,8 +116,14 @@ func defaultBackoff(n int, r *http.Request, res *http.Response) time.Duration {
 		// stop the retries.
 		jitter = (1 + time.Duration(x.Int64())) * time.Millisecond
 	}
-	if v, ok := res.Header["Retry-After"]; ok {
-		return retryAfter(v[0]) + jitter
+	if res != nil {
+		if v, ok := res.Header["Retry-After"]; ok {
+			// An invalid, zero or past value falls back
+			// to the exponential backoff.
+			if ra := retryAfter(v[0]); ra > 0 {
+				return ra + jitter
+			}
+		}
 	}
 
 	if n < 1 {
@@ -121,13 +170,52 @@ func wantStatus(codes ...int) resOkay {
 	}
 }
 
+// maxNetErrorRetries is the number of times an idempotent request
+// failing with a transient network error is retried.
+const maxNetErrorRetries = 3
+
+// isTransientNetError reports whether err, returned by an HTTP client,
+// is a network error worth retrying, such as a refused or reset connection.
+// Errors such as TLS certificate verification failures are not transient.
+func isTransientNetError(err error) bool {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		err = ue.Err
+	}
+	var oe *net.OpError
+	return errors.As(err, &oe) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// netErrorBackoff is the backoff of the retries of transient network errors,
+// which have no response to pass to Client.RetryBackoff.
+// It is a variable so that tests can shorten it.
+var netErrorBackoff = defaultBackoff
+
+// retryNetError pauses before retrying an idempotent request r which failed
+// with err. It reports false if err is not transient or no retries are left.
+func (c *Client) retryNetError(ctx context.Context, retry *retryTimer, netRetries *int, r *http.Request, err error) bool {
+	if ctx.Err() != nil || !isTransientNetError(err) || *netRetries >= maxNetErrorRetries {
+		return false
+	}
+	*netRetries++
+	retry.inc()
+	t := &retryTimer{backoffFn: netErrorBackoff, n: *netRetries}
+	return t.backoff(ctx, r, nil) == nil
+}
+
 // get issues an unsigned GET request to the specified URL.
 // It returns a non-error value only when ok reports true.
 //
 // get retries unsuccessful attempts according to c.RetryBackoff
 // until the context is done or a non-retriable error is received.
+// Transient network errors are retried up to maxNetErrorRetries times.
 func (c *Client) get(ctx context.Context, url string, ok resOkay) (*http.Response, error) {
-	retry := c.retryTimer()
+	return c.getRetry(ctx, url, ok, c.retryTimer())
+}
+
+// getRetry is like get, pausing between the attempts with retry.
+func (c *Client) getRetry(ctx context.Context, url string, ok resOkay, retry *retryTimer) (*http.Response, error) {
+	var netRetries int
 	for {
 		req, err := http.NewRequest("GET", url, nil)
 		if err != nil {
@@ -136,6 +224,9 @@ func (c *Client) get(ctx context.Context, url string, ok resOkay) (*http.Respons
 		res, err := c.doNoRetry(ctx, req)
 		switch {
 		case err != nil:
+			if c.retryNetError(ctx, retry, &netRetries, req, err) {
+				continue
+			}
 			return nil, err
 		case ok(res):
 			return res, nil
@@ -156,17 +247,30 @@ func (c *Client) get(ctx context.Context, url string, ok resOkay) (*http.Respons
 }
 
 // post issues a signed POST request in JWS format using the provided key
-// to the specified URL.
+// to the specified URL. If key is nil, the account key c.Key is used.
 // It returns a non-error value only when ok reports true.
 //
 // post retries unsuccessful attempts according to c.RetryBackoff
 // until the context is done or a non-retriable error is received.
 // It uses postNoRetry to make individual requests.
+//
+// Network errors are only retried for POST-as-GET requests, with a body
+// of noPayload, since other requests may have changed the state at the CA
+// even though no response was received.
 func (c *Client) post(ctx context.Context, key crypto.Signer, url string, body interface{}, ok resOkay) (*http.Response, error) {
-	retry := c.retryTimer()
+	return c.postRetry(ctx, key, url, body, ok, c.retryTimer())
+}
+
+// postRetry is like post, pausing between the attempts with retry.
+func (c *Client) postRetry(ctx context.Context, key crypto.Signer, url string, body interface{}, ok resOkay, retry *retryTimer) (*http.Response, error) {
+	var netRetries int
 	for {
 		res, req, err := c.postNoRetry(ctx, key, url, body)
 		if err != nil {
+			if req != nil && body == noPayload && c.retryNetError(ctx, retry, &netRetries, req, err) {
+				// The nonce was consumed, the next attempt uses a new one.
+				continue
+			}
 			return nil, err
 		}
 		if ok(res) {
@@ -192,18 +296,62 @@ func (c *Client) post(ctx context.Context, key crypto.Signer, url string, body i
 	}
 }
 
+// postAsGet is POST-as-GET, a replacement for GET in RFC 8555
+// as described in section 6.3. It signs the request with the account key c.Key.
+func (c *Client) postAsGet(ctx context.Context, url string, ok resOkay) (*http.Response, error) {
+	return c.post(ctx, nil, url, noPayload, ok)
+}
+
+// fetch retrieves a resource at the specified URL.
+// If the CA implements RFC 8555, which requires authenticated reads,
+// fetch uses POST-as-GET. Otherwise, it issues an unsigned GET request.
+//
+// The CA mode is known only after a successful call of c.Discover.
+func (c *Client) fetch(ctx context.Context, url string, ok resOkay) (*http.Response, error) {
+	return c.fetchRetry(ctx, url, ok, c.retryTimer())
+}
+
+// fetchRetry is like fetch, pausing between the attempts with retry.
+func (c *Client) fetchRetry(ctx context.Context, url string, ok resOkay, retry *retryTimer) (*http.Response, error) {
+	if c.rfcMode() {
+		return c.postRetry(ctx, nil, url, noPayload, ok, retry)
+	}
+	return c.getRetry(ctx, url, ok, retry)
+}
+
 // postNoRetry signs the body with the given key and POSTs it to the provided url.
-// The body argument must be JSON-serializable.
+// The body argument must be JSON-serializable or noPayload.
 // It is used by c.post to retry unsuccessful attempts.
+// If the request was sent but no response received, the returned request is non-nil.
+//
+// If key is nil, the account key c.Key is used.
+// In RFC 8555 mode, the JWS also contains the url and, if key is nil
+// and the account URL is known, the key ID header.
 func (c *Client) postNoRetry(ctx context.Context, key crypto.Signer, url string, body interface{}) (*http.Response, *http.Request, error) {
 	nonce, err := c.popNonce(ctx, url)
 	if err != nil {
 		return nil, nil, err
 	}
-	b, err := jwsEncodeJSON(body, key, nonce)
+	if c.Trace != nil && c.Trace.UsedNonce != nil {
+		c.Trace.UsedNonce(nonce)
+	}
+	var kid string
+	if key == nil {
+		key = c.Key
+		kid = c.accountKID()
+	}
+	var b []byte
+	if c.rfcMode() {
+		b, err = jwsEncodeJSONURL(body, key, kid, nonce, url)
+	} else {
+		b, err = jwsEncodeJSON(body, key, nonce)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
+	if c.SignedRequestHook != nil {
+		c.SignedRequestHook(url, append([]byte(nil), b...))
+	}
 	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
 	if err != nil {
 		return nil, nil, err
@@ -211,7 +359,7 @@ func (c *Client) postNoRetry(ctx context.Context, key crypto.Signer, url string,
 	req.Header.Set("Content-Type", "application/jose+json")
 	res, err := c.doNoRetry(ctx, req)
 	if err != nil {
-		return nil, nil, err
+		return nil, req, err
 	}
 	c.addNonce(res.Header)
 	return res, req, nil
@@ -219,6 +367,10 @@ func (c *Client) postNoRetry(ctx context.Context, key crypto.Signer, url string,
 
 // doNoRetry issues a request req, replacing its context (if any) with ctx.
 func (c *Client) doNoRetry(ctx context.Context, req *http.Request) (*http.Response, error) {
+	req.Header.Set("User-Agent", c.userAgent())
+	if c.Trace != nil && c.Trace.SendRequest != nil {
+		c.Trace.SendRequest(req.Method, req.URL.String())
+	}
 	res, err := c.httpClient().Do(req.WithContext(ctx))
 	if err != nil {
 		select {
@@ -233,9 +385,101 @@ func (c *Client) doNoRetry(ctx context.Context, req *http.Request) (*http.Respon
 			return nil, err
 		}
 	}
+	limit := c.maxResponseBytes()
+	res.Body = &limitedBody{body: res.Body, n: limit, limit: limit, url: req.URL.String()}
+	c.traceResponse(req, res)
 	return res, nil
 }
 
+// defaultMaxResponseBytes is the default value of Client.MaxResponseBytes.
+const defaultMaxResponseBytes = 10 << 20
+
+func (c *Client) maxResponseBytes() int64 {
+	if c.MaxResponseBytes > 0 {
+		return c.MaxResponseBytes
+	}
+	return defaultMaxResponseBytes
+}
+
+// limitedBody is a response body failing with a *responseTooLargeError
+// once more than limit bytes have been read.
+type limitedBody struct {
+	body  io.ReadCloser
+	n     int64 // bytes left before the limit
+	limit int64
+	url   string
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.n <= 0 {
+		// Only fail if the body does not end at the limit.
+		var probe [1]byte
+		if n, err := b.body.Read(probe[:]); n == 0 {
+			return 0, err
+		}
+		return 0, &responseTooLargeError{url: b.url, limit: b.limit}
+	}
+	if int64(len(p)) > b.n {
+		p = p[:b.n]
+	}
+	n, err := b.body.Read(p)
+	b.n -= int64(n)
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	return b.body.Close()
+}
+
+// responseTooLargeError is returned when reading a response body larger
+// than Client.MaxResponseBytes.
+type responseTooLargeError struct {
+	url   string
+	limit int64
+}
+
+func (e *responseTooLargeError) Error() string {
+	return fmt.Sprintf("acme: response from %s exceeds %d bytes", e.url, e.limit)
+}
+
+// traceResponse calls c.Trace.GotResponse, if any.
+// The body of error responses is read and replaced
+// so that callers can still decode it.
+func (c *Client) traceResponse(req *http.Request, res *http.Response) {
+	if c.Trace == nil || c.Trace.GotResponse == nil {
+		return
+	}
+	var problem []byte
+	if res.StatusCode >= 400 {
+		// don't care if ReadAll returns an error:
+		// the callers would fail to decode the body anyway
+		problem, _ = ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		res.Body = ioutil.NopCloser(bytes.NewReader(problem))
+	}
+	c.Trace.GotResponse(req.Method, req.URL.String(), res.StatusCode, problem)
+}
+
+// traceNonce calls c.Trace.GotNonce, if any.
+func (c *Client) traceNonce(nonce string) {
+	if c.Trace != nil && c.Trace.GotNonce != nil {
+		c.Trace.GotNonce(nonce)
+	}
+}
+
+// packageUserAgent is the product token of this package in the User-Agent
+// header sent to the CA.
+const packageUserAgent = "robarchibald-crypto-acme"
+
+// userAgent returns the User-Agent header value to send to the CA.
+func (c *Client) userAgent() string {
+	ua := fmt.Sprintf("%s (%s; %s)", packageUserAgent, runtime.GOOS, runtime.GOARCH)
+	if c.UserAgent != "" {
+		ua = c.UserAgent + " " + ua
+	}
+	return ua
+}
+
 func (c *Client) httpClient() *http.Client {
 	if c.HTTPClient != nil {
 		return c.HTTPClient
@@ -262,11 +506,48 @@ func isRetriable(code int) bool {
 	return code <= 399 || code >= 500 || code == http.StatusTooManyRequests
 }
 
+// maxResponseSnippet is the length of the response body quoted
+// in the errors of decodeResponse.
+const maxResponseSnippet = 256
+
+// decodeResponse decodes the JSON body of res into v, disallowing unknown
+// fields if c.StrictDecoding is set, and checks the required fields of v
+// if it has a validate method. The errors quote the start of the body.
+func (c *Client) decodeResponse(res *http.Response, v interface{}) error {
+	b, err := ioutil.ReadAll(res.Body)
+	var tooLarge *responseTooLargeError
+	if errors.As(err, &tooLarge) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("acme: reading response: %v", err)
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	if c.StrictDecoding {
+		d.DisallowUnknownFields()
+	}
+	err = d.Decode(v)
+	if vv, ok := v.(interface{ validate() error }); ok && err == nil {
+		err = vv.validate()
+	}
+	if err != nil {
+		if len(b) > maxResponseSnippet {
+			b = append(b[:maxResponseSnippet:maxResponseSnippet], "..."...)
+		}
+		return fmt.Errorf("acme: invalid response: %v; body: %q", err, b)
+	}
+	return nil
+}
+
 // responseError creates an error of Error type from resp.
 func responseError(resp *http.Response) error {
-	// don't care if ReadAll returns an error:
+	// don't care if ReadAll returns an error, other than a body too large:
 	// json.Unmarshal will fail in that case anyway
-	b, _ := ioutil.ReadAll(resp.Body)
+	b, err := ioutil.ReadAll(resp.Body)
+	var tooLarge *responseTooLargeError
+	if errors.As(err, &tooLarge) {
+		return err
+	}
 	e := &wireError{Status: resp.StatusCode}
 	if err := json.Unmarshal(b, e); err != nil {
 		// this is not a regular error response:
@@ -276,6 +557,9 @@ func responseError(resp *http.Response) error {
 		if e.Detail == "" {
 			e.Detail = resp.Status
 		}
+		return e.error(resp.Header)
 	}
-	return e.error(resp.Header)
+	v := e.error(resp.Header)
+	v.RawProblem = b
+	return v
 }
@@ -5,13 +5,21 @@
 package acme
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -26,6 +34,8 @@ func TestDefaultBackoff(t *testing.T) {
 		{0, "", time.Second},        // verify the lower bound is 1
 		{100, "", 10 * time.Second}, // verify the ceiling
 		{1, "3600", time.Hour},      // verify the header value is used
+		{2, "0", 2 * time.Second},   // verify a zero header value is ignored
+		{2, "x", 2 * time.Second},   // verify an invalid header value is ignored
 		{1, "", 1 * time.Second},
 		{2, "", 2 * time.Second},
 		{3, "", 4 * time.Second},
@@ -76,6 +86,137 @@ func TestErrorResponse(t *testing.T) {
 	}
 }
 
+func TestErrorResponseRawProblem(t *testing.T) {
+	s := `{
+		"type": "urn:ietf:params:acme:error:rateLimited",
+		"detail": "too many certificates",
+		"status": 429,
+		"instance": "https://ca.tld/acme/rate-limits"
+	}`
+	res := &http.Response{
+		StatusCode: 429,
+		Status:     "429 Too Many Requests",
+		Body:       ioutil.NopCloser(strings.NewReader(s)),
+	}
+	v, ok := responseError(res).(*Error)
+	if !ok {
+		t.Fatal("responseError did not return an *Error")
+	}
+	if string(v.RawProblem) != s {
+		t.Errorf("v.RawProblem = %s; want %s", v.RawProblem, s)
+	}
+	// The raw document matches the parsed fields, and keeps the others.
+	var raw struct {
+		Type     string
+		Detail   string
+		Status   int
+		Instance string
+	}
+	if err := json.Unmarshal(v.RawProblem, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw.Type != v.ProblemType || raw.Detail != v.Detail || raw.Status != v.StatusCode {
+		t.Errorf("raw problem %+v does not match %+v", raw, v)
+	}
+	if raw.Instance != "https://ca.tld/acme/rate-limits" {
+		t.Errorf("raw.Instance = %q; want https://ca.tld/acme/rate-limits", raw.Instance)
+	}
+
+	// A body which is not a problem document is not kept.
+	res = &http.Response{
+		StatusCode: 502,
+		Status:     "502 Bad Gateway",
+		Body:       ioutil.NopCloser(strings.NewReader("<html>bad gateway</html>")),
+	}
+	v = responseError(res).(*Error)
+	if v.RawProblem != nil {
+		t.Errorf("v.RawProblem = %q for an HTML body; want nil", v.RawProblem)
+	}
+	if v.Detail != "<html>bad gateway</html>" {
+		t.Errorf("v.Detail = %q; want the body", v.Detail)
+	}
+}
+
+func TestErrorResponseSubproblems(t *testing.T) {
+	s := `{
+		"type": "urn:ietf:params:acme:error:malformed",
+		"detail": "Some of the identifiers requested were rejected",
+		"subproblems": [
+			{
+				"type": "urn:ietf:params:acme:error:malformed",
+				"detail": "Invalid underscore in DNS name \"_example.org\"",
+				"identifier": {"type": "dns", "value": "_example.org"}
+			},
+			{
+				"type": "urn:ietf:params:acme:error:rejectedIdentifier",
+				"detail": "This CA will not issue for \"example.net\"",
+				"identifier": {"type": "dns", "value": "example.net"}
+			}
+		]
+	}`
+	res := &http.Response{
+		StatusCode: 403,
+		Status:     "403 Forbidden",
+		Body:       ioutil.NopCloser(strings.NewReader(s)),
+	}
+	err := responseError(res)
+	v, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("err = %+v (%T); want *Error type", err, err)
+	}
+	want := []Subproblem{
+		{
+			ProblemType: "urn:ietf:params:acme:error:malformed",
+			Detail:      `Invalid underscore in DNS name "_example.org"`,
+			Identifier:  AuthzID{Type: "dns", Value: "_example.org"},
+		},
+		{
+			ProblemType: "urn:ietf:params:acme:error:rejectedIdentifier",
+			Detail:      `This CA will not issue for "example.net"`,
+			Identifier:  AuthzID{Type: "dns", Value: "example.net"},
+		},
+	}
+	if !reflect.DeepEqual(v.Subproblems, want) {
+		t.Errorf("v.Subproblems = %+v; want %+v", v.Subproblems, want)
+	}
+}
+
+func TestErrorResponseIdentifier(t *testing.T) {
+	s := `{
+		"type": "urn:ietf:params:acme:error:rateLimited",
+		"detail": "too many certificates for www.example.org",
+		"status": 429,
+		"instance": "https://ca.tld/docs/rate-limits#certificates",
+		"identifier": {"type": "dns", "value": "www.example.org"}
+	}`
+	res := &http.Response{
+		StatusCode: 429,
+		Status:     "429 Too Many Requests",
+		Body:       ioutil.NopCloser(strings.NewReader(s)),
+	}
+	v, ok := responseError(res).(*Error)
+	if !ok {
+		t.Fatal("responseError did not return an *Error")
+	}
+	if v.Instance != "https://ca.tld/docs/rate-limits#certificates" {
+		t.Errorf("v.Instance = %q; want https://ca.tld/docs/rate-limits#certificates", v.Instance)
+	}
+	if want := (AuthzID{Type: "dns", Value: "www.example.org"}); v.Identifier != want {
+		t.Errorf("v.Identifier = %+v; want %+v", v.Identifier, want)
+	}
+
+	// Both are optional.
+	res = &http.Response{
+		StatusCode: 400,
+		Status:     "400 Bad Request",
+		Body:       ioutil.NopCloser(strings.NewReader(`{"type": "urn:ietf:params:acme:error:malformed"}`)),
+	}
+	v = responseError(res).(*Error)
+	if v.Instance != "" || v.Identifier != (AuthzID{}) {
+		t.Errorf("v.Instance, v.Identifier = %q, %+v; want them empty", v.Instance, v.Identifier)
+	}
+}
+
 func TestPostWithRetries(t *testing.T) {
 	var count int
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -211,3 +352,467 @@ func TestRetryBackoffArgs(t *testing.T) {
 		t.Errorf("nretry = %d; want 3", nretry)
 	}
 }
+
+func TestPostAsGet(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		switch {
+		case r.URL.Path == "/":
+			fmt.Fprintf(w, `{"new-reg": %q, "newNonce": %q}`, ts.URL+"/new-reg", ts.URL+"/new-nonce")
+			return
+		case r.URL.Path == "/new-nonce":
+			if r.Method != "HEAD" {
+				t.Errorf("%s %s; want HEAD", r.Method, r.URL.Path)
+			}
+			return
+		case r.Method != "POST":
+			http.Error(w, `{"type": "urn:ietf:params:acme:error:malformed"}`, http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct{ Protected, Payload string }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+		b, err := base64.RawURLEncoding.DecodeString(req.Protected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var head struct {
+			KID string `json:"kid"`
+			URL string `json:"url"`
+			JWK interface{}
+		}
+		if err := json.Unmarshal(b, &head); err != nil {
+			t.Fatal(err)
+		}
+		if head.URL != ts.URL+r.URL.Path {
+			t.Errorf("url header = %q; want %q", head.URL, ts.URL+r.URL.Path)
+		}
+		if r.URL.Path == "/new-reg" {
+			w.Header().Set("Location", ts.URL+"/acct/1")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("{}"))
+			return
+		}
+		if req.Payload != "" {
+			t.Errorf("%s: payload = %q; want empty", r.URL.Path, req.Payload)
+		}
+		if head.KID != ts.URL+"/acct/1" || head.JWK != nil {
+			t.Errorf("%s: kid = %q, jwk = %v; want kid only", r.URL.Path, head.KID, head.JWK)
+		}
+		switch r.URL.Path {
+		case "/authz/1":
+			w.Write([]byte(`{"status": "valid", "identifier": {"type": "dns", "value": "example.org"}}`))
+		case "/chal/1":
+			w.Write([]byte(`{"type": "http-01", "status": "valid"}`))
+		case "/cert/1":
+			w.Write([]byte{1})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	c := &Client{Key: testKeyEC, DirectoryURL: ts.URL}
+	if _, err := c.Register(ctx, &Account{}, AcceptTOS); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	authz, err := c.GetAuthorization(ctx, ts.URL+"/authz/1")
+	if err != nil {
+		t.Fatalf("GetAuthorization: %v", err)
+	}
+	if authz.Status != StatusValid {
+		t.Errorf("authz.Status = %q; want %q", authz.Status, StatusValid)
+	}
+	if _, err := c.WaitAuthorization(ctx, ts.URL+"/authz/1"); err != nil {
+		t.Fatalf("WaitAuthorization: %v", err)
+	}
+	chal, err := c.GetChallenge(ctx, ts.URL+"/chal/1")
+	if err != nil {
+		t.Fatalf("GetChallenge: %v", err)
+	}
+	if chal.Status != StatusValid {
+		t.Errorf("chal.Status = %q; want %q", chal.Status, StatusValid)
+	}
+	cert, err := c.FetchCert(ctx, ts.URL+"/cert/1", false)
+	if err != nil {
+		t.Fatalf("FetchCert: %v", err)
+	}
+	if !reflect.DeepEqual(cert, [][]byte{{1}}) {
+		t.Errorf("cert = %v; want [[1]]", cert)
+	}
+}
+
+func TestClientTrace(t *testing.T) {
+	const problem = `{"type": "urn:ietf:params:acme:error:unauthorized", "detail": "no"}`
+	var ts *httptest.Server
+	var nonce int
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce++
+		w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce%d", nonce))
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprintf(w, `{"new-reg": %q, "new-authz": %q}`, ts.URL+"/new-reg", ts.URL+"/new-authz")
+		case "/new-reg":
+			w.Header().Set("Location", ts.URL+"/reg/1")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("{}"))
+		case "/new-authz":
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(problem))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	var events []string
+	trace := &ClientTrace{
+		SendRequest: func(method, url string) {
+			events = append(events, fmt.Sprintf("send %s %s", method, strings.TrimPrefix(url, ts.URL)))
+		},
+		GotResponse: func(method, url string, status int, problem []byte) {
+			events = append(events, fmt.Sprintf("got %s %s %d %s", method, strings.TrimPrefix(url, ts.URL), status, problem))
+		},
+		GotNonce: func(nonce string) {
+			events = append(events, "nonce "+nonce)
+		},
+		UsedNonce: func(nonce string) {
+			events = append(events, "use "+nonce)
+		},
+	}
+	ctx := context.Background()
+	c := &Client{Key: testKeyEC, DirectoryURL: ts.URL, Trace: trace}
+	if _, err := c.Register(ctx, &Account{}, AcceptTOS); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	_, err := c.Authorize(ctx, "example.org")
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusForbidden || e.ProblemType != "urn:ietf:params:acme:error:unauthorized" {
+		t.Errorf("Authorize: err = %#v; want unauthorized *Error", err)
+	}
+
+	want := []string{
+		"send GET ",
+		"got GET  200 ",
+		"nonce nonce1",
+		"use nonce1",
+		"send POST /new-reg",
+		"got POST /new-reg 201 ",
+		"nonce nonce2",
+		"use nonce2",
+		"send POST /new-authz",
+		"got POST /new-authz 403 " + problem,
+		"nonce nonce3",
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events:\n%s\nwant:\n%s", strings.Join(events, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestSignedRequestHook(t *testing.T) {
+	var (
+		ts   *httptest.Server
+		sent [][]byte
+	)
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		if r.Method == "POST" {
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Errorf("reading the request: %v", err)
+			}
+			sent = append(sent, b)
+		}
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprintf(w, `{"new-reg": %q}`, ts.URL+"/new-reg")
+		case "/new-reg":
+			w.Header().Set("Location", ts.URL+"/reg/1")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("{}"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	type signed struct {
+		url string
+		jws []byte
+	}
+	var audited []signed
+	c := &Client{
+		Key:          testKeyEC,
+		DirectoryURL: ts.URL,
+		SignedRequestHook: func(url string, jws []byte) {
+			audited = append(audited, signed{url, jws})
+		},
+	}
+	if _, err := c.Register(context.Background(), &Account{Contact: []string{"mailto:a@example.org"}}, AcceptTOS); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if len(audited) != 1 || len(sent) != 1 {
+		t.Fatalf("%d requests audited and %d sent; want 1 and 1", len(audited), len(sent))
+	}
+	if got, want := audited[0].url, ts.URL+"/new-reg"; got != want {
+		t.Errorf("audited URL = %q; want %q", got, want)
+	}
+	if !bytes.Equal(audited[0].jws, sent[0]) {
+		t.Errorf("audited JWS differs from the request sent:\n%s\nsent:\n%s", audited[0].jws, sent[0])
+	}
+
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}
+	if err := json.Unmarshal(audited[0].jws, &jws); err != nil {
+		t.Fatalf("audited JWS: %v", err)
+	}
+	if strings.Contains(string(audited[0].jws), base64.RawURLEncoding.EncodeToString(testKeyEC.D.Bytes())) {
+		t.Error("audited JWS contains the private key")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil || len(sig) != 64 {
+		t.Fatalf("signature %q: %v", jws.Signature, err)
+	}
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	var r, s big.Int
+	r.SetBytes(sig[:32])
+	s.SetBytes(sig[32:])
+	if !ecdsa.Verify(&testKeyEC.PublicKey, digest[:], &r, &s) {
+		t.Error("audited JWS does not verify against the account key")
+	}
+	// A tampered payload does not.
+	digest = sha256.Sum256([]byte(jws.Protected + "." + base64.RawURLEncoding.EncodeToString([]byte("{}"))))
+	if ecdsa.Verify(&testKeyEC.PublicKey, digest[:], &r, &s) {
+		t.Error("audited JWS verifies with another payload")
+	}
+}
+
+// flakyHandler closes the connection without a response to the first
+// failures requests other than nonce fetches, and then calls h.
+type flakyHandler struct {
+	t        *testing.T
+	failures int32
+	requests int32 // non-HEAD requests received; accessed atomically
+	h        http.HandlerFunc
+}
+
+func (f *flakyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", "nonce")
+	if r.Method == "HEAD" {
+		return
+	}
+	if atomic.AddInt32(&f.requests, 1) <= f.failures {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			f.t.Errorf("Hijack: %v", err)
+			return
+		}
+		conn.Close()
+		return
+	}
+	f.h(w, r)
+}
+
+func TestRetryNetworkErrors(t *testing.T) {
+	authz := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status": "valid", "identifier": {"type": "dns", "value": "example.org"}}`))
+	}
+	defer func(f func(int, *http.Request, *http.Response) time.Duration) { netErrorBackoff = f }(netErrorBackoff)
+	netErrorBackoff = func(int, *http.Request, *http.Response) time.Duration { return time.Millisecond }
+	// Only called for the responses of the CA,
+	// never for the network errors.
+	backoff := func(n int, r *http.Request, res *http.Response) time.Duration {
+		t.Errorf("RetryBackoff called with status %d", res.StatusCode)
+		return time.Millisecond
+	}
+	for _, rfc := range []bool{false, true} {
+		name := "get"
+		if rfc {
+			name = "post-as-get"
+		}
+		t.Run(name, func(t *testing.T) {
+			h := &flakyHandler{t: t, failures: 2, h: authz}
+			ts := httptest.NewServer(h)
+			defer ts.Close()
+			client := &Client{
+				Key:          testKeyEC,
+				RetryBackoff: backoff,
+				dir:          &Directory{AuthzURL: ts.URL},
+			}
+			if rfc {
+				client.dir.NonceURL = ts.URL + "/new-nonce"
+			}
+			a, err := client.GetAuthorization(context.Background(), ts.URL+"/authz/1")
+			if err != nil {
+				t.Fatalf("GetAuthorization: %v", err)
+			}
+			if a.Status != StatusValid {
+				t.Errorf("a.Status = %q; want %q", a.Status, StatusValid)
+			}
+			if n := atomic.LoadInt32(&h.requests); n != 3 {
+				t.Errorf("got %d requests; want 3", n)
+			}
+		})
+	}
+
+	t.Run("bounded", func(t *testing.T) {
+		h := &flakyHandler{t: t, failures: maxNetErrorRetries + 1, h: authz}
+		ts := httptest.NewServer(h)
+		defer ts.Close()
+		client := &Client{
+			Key:          testKeyEC,
+			RetryBackoff: backoff,
+			dir:          &Directory{AuthzURL: ts.URL},
+		}
+		if _, err := client.GetAuthorization(context.Background(), ts.URL+"/authz/1"); err == nil {
+			t.Fatal("GetAuthorization: err is nil")
+		}
+		if n := atomic.LoadInt32(&h.requests); n != maxNetErrorRetries+1 {
+			t.Errorf("got %d requests; want %d", n, maxNetErrorRetries+1)
+		}
+	})
+
+	t.Run("state change", func(t *testing.T) {
+		h := &flakyHandler{t: t, failures: 1, h: func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"status": "valid"}`))
+		}}
+		ts := httptest.NewServer(h)
+		defer ts.Close()
+		client := &Client{
+			Key:          testKeyEC,
+			RetryBackoff: backoff,
+			dir:          &Directory{AuthzURL: ts.URL},
+		}
+		// A new authorization may have been created despite the error.
+		if _, err := client.Authorize(context.Background(), "example.org"); err == nil {
+			t.Fatal("Authorize: err is nil")
+		}
+		if n := atomic.LoadInt32(&h.requests); n != 1 {
+			t.Errorf("got %d requests; want 1", n)
+		}
+	})
+}
+
+func TestRetryServerErrorsThenSuccess(t *testing.T) {
+	var count int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		if r.Method == "HEAD" {
+			return
+		}
+		count++
+		if count <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"status": "valid", "identifier": {"type": "dns", "value": "example.org"}}`))
+	}))
+	defer ts.Close()
+
+	client := &Client{
+		Key: testKeyEC,
+		RetryBackoff: func(n int, r *http.Request, res *http.Response) time.Duration {
+			return time.Millisecond
+		},
+		dir: &Directory{AuthzURL: ts.URL, NonceURL: ts.URL + "/new-nonce"},
+	}
+	if _, err := client.GetAuthorization(context.Background(), ts.URL+"/authz/1"); err != nil {
+		t.Fatalf("GetAuthorization: %v", err)
+	}
+	if count != 3 {
+		t.Errorf("got %d requests; want 3", count)
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	for _, custom := range []string{"", "myapp/1.0"} {
+		var ts *httptest.Server
+		var agents []string
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			agents = append(agents, r.Header.Get("User-Agent"))
+			w.Header().Set("Replay-Nonce", "nonce")
+			switch r.URL.Path {
+			case "/":
+				fmt.Fprintf(w, `{"new-reg": %q}`, ts.URL+"/new-reg")
+			case "/new-reg":
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte("{}"))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+
+		c := &Client{Key: testKeyEC, DirectoryURL: ts.URL, UserAgent: custom}
+		if _, err := c.Register(context.Background(), &Account{}, AcceptTOS); err != nil {
+			t.Errorf("Register: %v", err)
+		}
+		ts.Close()
+
+		want := packageUserAgent + " ("
+		if custom != "" {
+			want = custom + " " + want
+		}
+		if len(agents) < 2 {
+			t.Errorf("%q: got %d requests; want at least 2", custom, len(agents))
+		}
+		for i, ua := range agents {
+			if !strings.HasPrefix(ua, want) {
+				t.Errorf("%q: request %d: User-Agent = %q; want %q prefix", custom, i, ua, want)
+			}
+		}
+	}
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	const limit = 1024
+	authz := `{"status": "valid", "identifier": {"type": "dns", "value": "example.org"}}`
+	problem := `{"type": "urn:ietf:params:acme:error:malformed", "detail": "bad"}`
+	tests := []struct {
+		name     string
+		code     int
+		body     string
+		tooLarge bool
+	}{
+		{"at limit", http.StatusOK, authz + strings.Repeat(" ", limit-len(authz)), false},
+		{"over limit", http.StatusOK, authz + strings.Repeat(" ", limit-len(authz)+1), true},
+		{"problem at limit", http.StatusBadRequest, problem + strings.Repeat(" ", limit-len(problem)), false},
+		{"problem over limit", http.StatusBadRequest, problem + strings.Repeat(" ", 10*limit), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Replay-Nonce", "nonce")
+				if r.Method == "HEAD" {
+					return
+				}
+				w.WriteHeader(test.code)
+				w.Write([]byte(test.body))
+			}))
+			defer ts.Close()
+
+			client := &Client{
+				Key:              testKeyEC,
+				MaxResponseBytes: limit,
+				dir:              &Directory{AuthzURL: ts.URL, NonceURL: ts.URL + "/new-nonce"},
+			}
+			_, err := client.GetAuthorization(context.Background(), ts.URL+"/authz/1")
+			var tooLarge *responseTooLargeError
+			if got := errors.As(err, &tooLarge); got != test.tooLarge {
+				t.Errorf("GetAuthorization: %v; want body too large: %v", err, test.tooLarge)
+			}
+			if !test.tooLarge && test.code == http.StatusBadRequest {
+				if e, ok := err.(*Error); !ok || e.Detail != "bad" {
+					t.Errorf("GetAuthorization: %v; want problem with detail %q", err, "bad")
+				}
+			}
+		})
+	}
+}
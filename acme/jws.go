@@ -7,6 +7,7 @@ package acme
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -15,27 +16,56 @@ import (
 	"encoding/json"
 	"fmt"
 	"math/big"
+
+	xed25519 "github.com/robarchibald/crypto/ed25519"
 )
 
+// noPayload indicates jwsEncodeJSON will encode zero-length octet string
+// in a JWS request. This is called POST-as-GET in RFC 8555 and is used to make
+// authenticated GET requests via POSTing with an empty payload.
+// See https://tools.ietf.org/html/rfc8555#section-6.3 for more details.
+const noPayload = ""
+
 // jwsEncodeJSON signs claimset using provided key and a nonce.
 // The result is serialized in JSON format.
 // See https://tools.ietf.org/html/rfc7515#section-7.
 func jwsEncodeJSON(claimset interface{}, key crypto.Signer, nonce string) ([]byte, error) {
-	jwk, err := jwkEncode(key.Public())
-	if err != nil {
-		return nil, err
-	}
+	return jwsEncodeJSONURL(claimset, key, "", nonce, "")
+}
+
+// jwsEncodeJSONURL is like jwsEncodeJSON but also adds the "url" header
+// and, if kid is not empty, identifies the key with the kid header
+// instead of embedding the JWK, as described in RFC 8555, Section 6.2.
+// The url header is omitted if url is empty.
+//
+// If claimset is noPayload, the JWS payload is empty.
+func jwsEncodeJSONURL(claimset interface{}, key crypto.Signer, kid, nonce, url string) ([]byte, error) {
 	alg, sha := jwsHasher(key.Public())
 	if alg == "" || !sha.Available() {
 		return nil, ErrUnsupportedKey
 	}
-	phead := fmt.Sprintf(`{"alg":%q,"jwk":%s,"nonce":%q}`, alg, jwk, nonce)
-	phead = base64.RawURLEncoding.EncodeToString([]byte(phead))
-	cs, err := json.Marshal(claimset)
-	if err != nil {
-		return nil, err
+	var phead string
+	if kid != "" {
+		phead = fmt.Sprintf(`{"alg":%q,"kid":%q,"nonce":%q`, alg, kid, nonce)
+	} else {
+		jwk, err := jwkEncode(key.Public())
+		if err != nil {
+			return nil, err
+		}
+		phead = fmt.Sprintf(`{"alg":%q,"jwk":%s,"nonce":%q`, alg, jwk, nonce)
+	}
+	if url != "" {
+		phead += fmt.Sprintf(`,"url":%q`, url)
+	}
+	phead = base64.RawURLEncoding.EncodeToString([]byte(phead + "}"))
+	var payload string
+	if claimset != noPayload {
+		cs, err := json.Marshal(claimset)
+		if err != nil {
+			return nil, err
+		}
+		payload = base64.RawURLEncoding.EncodeToString(cs)
 	}
-	payload := base64.RawURLEncoding.EncodeToString(cs)
 	hash := sha.New()
 	hash.Write([]byte(phead + "." + payload))
 	sig, err := jwsSign(key, sha, hash.Sum(nil))
@@ -55,7 +85,7 @@ func jwsEncodeJSON(claimset interface{}, key crypto.Signer, nonce string) ([]byt
 	return json.Marshal(&enc)
 }
 
-// jwkEncode encodes public part of an RSA or ECDSA key into a JWK.
+// jwkEncode encodes public part of an RSA, ECDSA or Ed25519 key into a JWK.
 // The result is also suitable for creating a JWK thumbprint.
 // https://tools.ietf.org/html/rfc7517
 func jwkEncode(pub crypto.PublicKey) (string, error) {
@@ -92,10 +122,24 @@ func jwkEncode(pub crypto.PublicKey) (string, error) {
 			base64.RawURLEncoding.EncodeToString(x),
 			base64.RawURLEncoding.EncodeToString(y),
 		), nil
+	case ed25519.PublicKey:
+		return jwkEncodeOKP(pub), nil
+	case xed25519.PublicKey:
+		return jwkEncodeOKP(pub), nil
 	}
 	return "", ErrUnsupportedKey
 }
 
+// jwkEncodeOKP encodes an Ed25519 public key into a JWK.
+// https://tools.ietf.org/html/rfc8037#section-2
+func jwkEncodeOKP(pub []byte) string {
+	// Field order is important.
+	// See https://tools.ietf.org/html/rfc7638#section-3.3 for details.
+	return fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":"%s"}`,
+		base64.RawURLEncoding.EncodeToString(pub),
+	)
+}
+
 // jwsSign signs the digest using the given key.
 // The hash is unused for ECDSA keys.
 //
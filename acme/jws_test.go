@@ -7,16 +7,20 @@ package acme
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"math/big"
 	"testing"
+
+	xed25519 "github.com/robarchibald/crypto/ed25519"
 )
 
 const (
@@ -386,6 +390,72 @@ func TestJWKThumbprintEC(t *testing.T) {
 	}
 }
 
+func TestJWKThumbprintOKP(t *testing.T) {
+	// Key example from RFC 8037, appendix A.3
+	const (
+		base64X  = "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"
+		expected = "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k"
+	)
+	x, err := base64.RawURLEncoding.DecodeString(base64X)
+	if err != nil {
+		t.Fatalf("Error parsing example key X: %v", err)
+	}
+	for _, pub := range []crypto.PublicKey{ed25519.PublicKey(x), xed25519.PublicKey(x)} {
+		th, err := JWKThumbprint(pub)
+		if err != nil {
+			t.Error(err)
+		}
+		if th != expected {
+			t.Errorf("%T thumbprint = %q; want %q", pub, th, expected)
+		}
+	}
+}
+
+// publicSigner is a crypto.Signer which only has a public key.
+type publicSigner struct{ pub crypto.PublicKey }
+
+func (s publicSigner) Public() crypto.PublicKey { return s.pub }
+
+func (s publicSigner) Sign(io.Reader, []byte, crypto.SignerOpts) ([]byte, error) {
+	return nil, errors.New("no private key")
+}
+
+func TestClientKeyAuthorization(t *testing.T) {
+	c := &Client{Key: testKeyEC}
+	th, err := c.JWKThumbprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if th != testKeyECThumbprint {
+		t.Errorf("c.JWKThumbprint() = %q; want %q", th, testKeyECThumbprint)
+	}
+
+	// Key example from RFC 7638, section 3.1
+	b, err := base64.RawURLEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAt" +
+		"VT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn6" +
+		"4tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FD" +
+		"W2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n9" +
+		"1CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINH" +
+		"aQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := new(big.Int).SetBytes(b)
+	c = &Client{Key: publicSigner{&rsa.PublicKey{N: n, E: 65537}}}
+	ka, err := c.KeyAuthorization("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "token.NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"; ka != want {
+		t.Errorf("c.KeyAuthorization(token) = %q; want %q", ka, want)
+	}
+
+	c = &Client{}
+	if _, err := c.KeyAuthorization("token"); err == nil {
+		t.Error("KeyAuthorization without a key succeeded")
+	}
+}
+
 func TestJWKThumbprintErrUnsupportedKey(t *testing.T) {
 	_, err := JWKThumbprint(struct{}{})
 	if err != ErrUnsupportedKey {
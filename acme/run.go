@@ -0,0 +1,211 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ChallengeSolver provisions the responses to the challenges of one type,
+// such as "http-01" or "dns-01", for Client.RunOrder.
+type ChallengeSolver interface {
+	// Present provisions the response to chal, a challenge proving the
+	// control of id, before RunOrder asks the CA to validate it.
+	// The response is derived from chal.Token with client, for instance
+	// with client.HTTP01ChallengeResponse.
+	Present(ctx context.Context, client *Client, id AuthzID, chal *Challenge) error
+
+	// CleanUp removes the response provisioned by Present once the CA
+	// validated chal, or failed to. RunOrder ignores its errors.
+	CleanUp(ctx context.Context, client *Client, id AuthzID, chal *Challenge) error
+}
+
+// runOrderAttempts is the number of times RunOrder submits the certificate
+// request, authorizing again the identifiers the CA reports as unauthorized.
+const runOrderAttempts = 2
+
+// RunOrder obtains a certificate for csr, a certificate request in DER
+// format, driving the whole sequence a caller otherwise orchestrates with
+// Authorize, Accept, WaitAuthorization and CreateCert.
+//
+// Each identifier of csr, its DNS names or else its common name, and its IP
+// addresses, is authorized with a challenge solved by solvers, keyed by
+// challenge type. The challenges are tried in the order the CA offers them;
+// when the validation of one fails, the identifier is authorized again with
+// a challenge of another type, as long as solvers has one. The request is
+// then submitted with CreateCert and opts. If the CA rejects it reporting,
+// in the subproblems of its error, identifiers whose authorization it no
+// longer considers valid, they are authorized again and the request is
+// submitted once more.
+//
+// The requests are retried as described in Client.RetryBackoff, honoring the
+// Retry-After header of the CA responses, and the authorizations are polled
+// as WaitAuthorization does. ctx bounds the whole sequence.
+//
+// RunOrder returns the certificate chain, the leaf first, and the parsed
+// leaf, which is checked to hold the public key of csr. A failed
+// authorization is reported as an *AuthorizationError.
+func (c *Client) RunOrder(ctx context.Context, csr []byte, solvers map[string]ChallengeSolver, opts ...OrderOption) (chain [][]byte, leaf *x509.Certificate, err error) {
+	req, err := x509.ParseCertificateRequest(csr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("acme: invalid certificate request: %v", err)
+	}
+	ids := csrAuthzIDs(req)
+	if len(ids) == 0 {
+		return nil, nil, errors.New("acme: certificate request has no identifiers")
+	}
+	for _, id := range ids {
+		if err := c.runAuthorization(ctx, id, solvers); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		chain, _, err = c.CreateCert(ctx, csr, 0, true, opts...)
+		if err == nil {
+			break
+		}
+		retry := unauthorizedIDs(err, ids)
+		if attempt == runOrderAttempts || len(retry) == 0 {
+			return nil, nil, err
+		}
+		for _, id := range retry {
+			c.forgetAuthzID(id)
+			if err := c.runAuthorization(ctx, id, solvers); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	if len(chain) == 0 {
+		return nil, nil, errors.New("acme: CA returned no certificate")
+	}
+	leaf, err = x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("acme: invalid certificate: %v", err)
+	}
+	pub, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(req.PublicKey) {
+		return nil, nil, errors.New("acme: certificate does not match the public key of the request")
+	}
+	return chain, leaf, nil
+}
+
+// csrAuthzIDs returns the identifiers to authorize for csr.
+func csrAuthzIDs(csr *x509.CertificateRequest) []AuthzID {
+	var ids []AuthzID
+	for _, name := range csr.DNSNames {
+		ids = append(ids, AuthzID{Type: "dns", Value: name})
+	}
+	if len(ids) == 0 && csr.Subject.CommonName != "" {
+		ids = append(ids, AuthzID{Type: "dns", Value: csr.Subject.CommonName})
+	}
+	for _, ip := range csr.IPAddresses {
+		ids = append(ids, AuthzID{Type: "ip", Value: ip.String()})
+	}
+	return ids
+}
+
+// runAuthorization authorizes id, trying the challenges solvers can solve
+// until the CA validates one of them.
+func (c *Client) runAuthorization(ctx context.Context, id AuthzID, solvers map[string]ChallengeSolver) error {
+	tried := make(map[string]bool)
+	failed := &AuthorizationError{Identifier: id.Value}
+	for {
+		a, err := c.authorize(ctx, id.Type, id.Value)
+		if err != nil {
+			return err
+		}
+		switch a.Status {
+		case StatusValid:
+			return nil
+		case StatusPending:
+		default:
+			return fmt.Errorf("acme: authorization %q is %s", a.URI, a.Status)
+		}
+
+		var chal *Challenge
+		for _, ch := range a.Challenges {
+			if solvers[ch.Type] != nil && !tried[ch.Type] {
+				chal = ch
+				break
+			}
+		}
+		if chal == nil {
+			if failed.URI == "" {
+				return fmt.Errorf("acme: no solver for the challenges offered for %s", id.Value)
+			}
+			return failed
+		}
+		tried[chal.Type] = true
+
+		err = c.solveChallenge(ctx, a, chal, solvers[chal.Type])
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		// Record the failure, and try the next challenge type
+		// with a new authorization.
+		failed.URI, failed.Status = a.URI, StatusInvalid
+		if ae, ok := err.(*AuthorizationError); ok {
+			failed.Status = ae.Status
+			if len(ae.Errors) > 0 {
+				failed.Errors = append(failed.Errors, ae.Errors...)
+				continue
+			}
+		}
+		failed.Errors = append(failed.Errors, fmt.Errorf("challenge %q: %v", chal.Type, err))
+	}
+}
+
+// solveChallenge provisions the response to chal with s, asks the CA to
+// validate it and waits for the authorization a to be final.
+func (c *Client) solveChallenge(ctx context.Context, a *Authorization, chal *Challenge, s ChallengeSolver) error {
+	if err := s.Present(ctx, c, a.Identifier, chal); err != nil {
+		return err
+	}
+	defer s.CleanUp(ctx, c, a.Identifier, chal)
+	if _, err := c.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err := c.WaitAuthorization(ctx, a.URI)
+	return err
+}
+
+// unauthorizedIDs returns the identifiers among ids which err, an error of
+// CreateCert, reports as unauthorized in its subproblems.
+func unauthorizedIDs(err error, ids []AuthzID) []AuthzID {
+	e, ok := err.(*Error)
+	if !ok {
+		return nil
+	}
+	var res []AuthzID
+	for _, sub := range e.Subproblems {
+		if !strings.HasSuffix(strings.ToLower(sub.ProblemType), ":unauthorized") {
+			continue
+		}
+		for _, id := range ids {
+			if sub.Identifier.Value == id.Value && (sub.Identifier.Type == "" || sub.Identifier.Type == id.Type) {
+				res = append(res, id)
+			}
+		}
+	}
+	return res
+}
+
+// forgetAuthzID drops the valid authorization for id recorded by
+// rememberAuthz, if any, so that it is requested from the CA again.
+func (c *Client) forgetAuthzID(id AuthzID) {
+	c.authzMu.Lock()
+	defer c.authzMu.Unlock()
+	delete(c.validAuthz, id)
+}
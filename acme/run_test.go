@@ -0,0 +1,358 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memSolver is a ChallengeSolver keeping the key authorizations it
+// provisions in memory, where runOrderCA validates them.
+type memSolver struct {
+	mu      sync.Mutex
+	tokens  map[string]string // key authorizations by token
+	wrong   bool              // provision invalid key authorizations
+	cleaned int               // number of CleanUp calls
+}
+
+func (s *memSolver) Present(ctx context.Context, client *Client, id AuthzID, chal *Challenge) error {
+	ka, err := client.KeyAuthorization(chal.Token)
+	if err != nil {
+		return err
+	}
+	if s.wrong {
+		ka += "-wrong"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tokens == nil {
+		s.tokens = make(map[string]string)
+	}
+	s.tokens[chal.Token] = ka
+	return nil
+}
+
+func (s *memSolver) CleanUp(ctx context.Context, client *Client, id AuthzID, chal *Challenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, chal.Token)
+	s.cleaned++
+	return nil
+}
+
+func (s *memSolver) keyAuth(token string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokens[token]
+}
+
+// runOrderCA is a CA implementing the new-authz and new-cert flow,
+// validating the challenges with the solvers of the test.
+type runOrderCA struct {
+	t          *testing.T
+	srv        *httptest.Server
+	challenges []string              // challenge types offered, in order
+	solvers    map[string]*memSolver // used to validate the challenges
+	caKey      *ecdsa.PrivateKey
+	caCert     *x509.Certificate
+
+	mu           sync.Mutex
+	authz        []*runOrderAuthz
+	unauthorized []string // names rejected once by new-cert
+	newAuthz     map[string]int
+}
+
+type runOrderAuthz struct {
+	domain string
+	status string
+	tokens map[string]string // challenge types by token
+}
+
+func newRunOrderCA(t *testing.T, challenges []string, solvers map[string]*memSolver) *runOrderCA {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Run Order CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &runOrderCA{
+		t:          t,
+		challenges: challenges,
+		solvers:    solvers,
+		caKey:      caKey,
+		caCert:     caCert,
+		newAuthz:   make(map[string]int),
+	}
+	ca.srv = httptest.NewServer(http.HandlerFunc(ca.serveHTTP))
+	t.Cleanup(ca.srv.Close)
+	return ca
+}
+
+func (ca *runOrderCA) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", "nonce")
+	if r.Method == "HEAD" {
+		return
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	switch {
+	case r.URL.Path == "/":
+		fmt.Fprintf(w, `{"new-authz": %q, "new-cert": %q}`, ca.srv.URL+"/new-authz", ca.srv.URL+"/new-cert")
+	case r.URL.Path == "/new-authz":
+		var req struct {
+			Identifier struct{ Value string }
+		}
+		decodeJWSRequest(ca.t, &req, r)
+		ca.newAuthz[req.Identifier.Value]++
+		z := &runOrderAuthz{domain: req.Identifier.Value, status: StatusPending, tokens: make(map[string]string)}
+		ca.authz = append(ca.authz, z)
+		for i, typ := range ca.challenges {
+			z.tokens[fmt.Sprintf("token-%d-%d", len(ca.authz)-1, i)] = typ
+		}
+		w.Header().Set("Location", fmt.Sprintf("%s/authz/%d", ca.srv.URL, len(ca.authz)-1))
+		w.WriteHeader(http.StatusCreated)
+		ca.writeAuthz(w, len(ca.authz)-1)
+	case strings.HasPrefix(r.URL.Path, "/authz/"):
+		var i int
+		fmt.Sscanf(r.URL.Path, "/authz/%d", &i)
+		ca.writeAuthz(w, i)
+	case strings.HasPrefix(r.URL.Path, "/challenge/"):
+		var i int
+		var token string
+		fmt.Sscanf(r.URL.Path, "/challenge/%d/%s", &i, &token)
+		var req struct{ KeyAuthorization string }
+		decodeJWSRequest(ca.t, &req, r)
+		z := ca.authz[i]
+		typ := z.tokens[token]
+		// Validate the response provisioned by the solver.
+		z.status = StatusInvalid
+		if s := ca.solvers[typ]; s != nil && s.keyAuth(token) == req.KeyAuthorization {
+			z.status = StatusValid
+		}
+		fmt.Fprintf(w, `{"uri": %q, "type": %q, "token": %q, "status": "processing"}`, ca.srv.URL+r.URL.Path, typ, token)
+	case r.URL.Path == "/new-cert":
+		var req struct{ CSR string }
+		decodeJWSRequest(ca.t, &req, r)
+		b, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(b)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(ca.unauthorized) > 0 {
+			var subs []string
+			for _, name := range ca.unauthorized {
+				subs = append(subs, fmt.Sprintf(`{"type": "urn:ietf:params:acme:error:unauthorized", "identifier": {"type": "dns", "value": %q}}`, name))
+			}
+			ca.unauthorized = nil
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, `{"type": "urn:ietf:params:acme:error:unauthorized", "status": 403, "subproblems": [%s]}`, strings.Join(subs, ","))
+			return
+		}
+		for _, name := range csr.DNSNames {
+			if !ca.authorized(name) {
+				http.Error(w, "unauthorized "+name, http.StatusForbidden)
+				return
+			}
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.caCert, csr.PublicKey, ca.caKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Location", ca.srv.URL+"/cert/2")
+		w.Header().Set("Link", fmt.Sprintf(`<%s/ca-cert>; rel="up"`, ca.srv.URL))
+		w.WriteHeader(http.StatusCreated)
+		w.Write(der)
+	case r.URL.Path == "/ca-cert":
+		w.Write(ca.caCert.Raw)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// writeAuthz writes the authorization i. ca.mu must be held.
+func (ca *runOrderCA) writeAuthz(w http.ResponseWriter, i int) {
+	z := ca.authz[i]
+	v := struct {
+		Status     string    `json:"status"`
+		Expires    time.Time `json:"expires"`
+		Identifier AuthzID   `json:"identifier"`
+		Challenges []map[string]string
+	}{
+		Status:     z.status,
+		Expires:    time.Now().Add(24 * time.Hour),
+		Identifier: AuthzID{Type: "dns", Value: z.domain},
+	}
+	var tokens []string
+	for token := range z.tokens {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	for _, token := range tokens {
+		v.Challenges = append(v.Challenges, map[string]string{
+			"uri":   fmt.Sprintf("%s/challenge/%d/%s", ca.srv.URL, i, token),
+			"type":  z.tokens[token],
+			"token": token,
+		})
+	}
+	json.NewEncoder(w).Encode(v)
+}
+
+// authorized reports whether name has a valid authorization. ca.mu must be held.
+func (ca *runOrderCA) authorized(name string) bool {
+	for _, z := range ca.authz {
+		if z.domain == name && z.status == StatusValid {
+			return true
+		}
+	}
+	return false
+}
+
+func runOrderCSR(t *testing.T, names ...string) (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: names}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, csr
+}
+
+func TestRunOrder(t *testing.T) {
+	httpSolver := &memSolver{}
+	ca := newRunOrderCA(t, []string{"dns-01", "http-01"}, map[string]*memSolver{"http-01": httpSolver})
+	client := &Client{Key: testKeyEC, DirectoryURL: ca.srv.URL}
+	key, csr := runOrderCSR(t, "example.org", "www.example.org")
+
+	solvers := map[string]ChallengeSolver{"http-01": httpSolver}
+	chain, leaf, err := client.RunOrder(context.Background(), csr, solvers)
+	if err != nil {
+		t.Fatalf("RunOrder: %v", err)
+	}
+	if len(chain) != 2 {
+		t.Fatalf("len(chain) = %d; want 2", len(chain))
+	}
+	if err := leaf.CheckSignatureFrom(ca.caCert); err != nil {
+		t.Errorf("leaf not issued by the CA: %v", err)
+	}
+	if want := []string{"example.org", "www.example.org"}; !reflect.DeepEqual(leaf.DNSNames, want) {
+		t.Errorf("leaf.DNSNames = %q; want %q", leaf.DNSNames, want)
+	}
+	if !key.PublicKey.Equal(leaf.PublicKey) {
+		t.Error("leaf does not hold the key of the request")
+	}
+	if httpSolver.cleaned != 2 || len(httpSolver.tokens) != 0 {
+		t.Errorf("http-01 solver cleaned %d times, holds %d tokens; want 2, 0", httpSolver.cleaned, len(httpSolver.tokens))
+	}
+
+	// The authorizations are valid: they are not requested again.
+	if _, _, err := client.RunOrder(context.Background(), csr, solvers); err != nil {
+		t.Fatalf("second RunOrder: %v", err)
+	}
+	if n := ca.newAuthz["example.org"]; n != 1 {
+		t.Errorf("example.org authorized %d times; want 1", n)
+	}
+}
+
+func TestRunOrderChallengeFallback(t *testing.T) {
+	alpnSolver := &memSolver{wrong: true}
+	httpSolver := &memSolver{}
+	ca := newRunOrderCA(t, []string{"tls-alpn-01", "http-01"}, map[string]*memSolver{
+		"tls-alpn-01": alpnSolver,
+		"http-01":     httpSolver,
+	})
+	client := &Client{Key: testKeyEC, DirectoryURL: ca.srv.URL}
+	_, csr := runOrderCSR(t, "example.org")
+
+	solvers := map[string]ChallengeSolver{"tls-alpn-01": alpnSolver, "http-01": httpSolver}
+	if _, _, err := client.RunOrder(context.Background(), csr, solvers); err != nil {
+		t.Fatalf("RunOrder: %v", err)
+	}
+	if n := ca.newAuthz["example.org"]; n != 2 {
+		t.Errorf("example.org authorized %d times; want 2", n)
+	}
+	if alpnSolver.cleaned != 1 || httpSolver.cleaned != 1 {
+		t.Errorf("solvers cleaned %d and %d times; want 1 each", alpnSolver.cleaned, httpSolver.cleaned)
+	}
+
+	// With no other challenge to try, the failure is reported.
+	client = &Client{Key: testKeyEC, DirectoryURL: ca.srv.URL}
+	_, csr = runOrderCSR(t, "other.example.org")
+	_, _, err := client.RunOrder(context.Background(), csr, map[string]ChallengeSolver{"tls-alpn-01": alpnSolver})
+	if ae, ok := err.(*AuthorizationError); !ok || ae.Identifier != "other.example.org" || ae.Status != StatusInvalid {
+		t.Errorf("RunOrder error = %v; want an invalid AuthorizationError for other.example.org", err)
+	}
+}
+
+func TestRunOrderNoSolver(t *testing.T) {
+	ca := newRunOrderCA(t, []string{"dns-01"}, nil)
+	client := &Client{Key: testKeyEC, DirectoryURL: ca.srv.URL}
+	_, csr := runOrderCSR(t, "example.org")
+	_, _, err := client.RunOrder(context.Background(), csr, map[string]ChallengeSolver{"http-01": &memSolver{}})
+	if err == nil || !strings.Contains(err.Error(), "no solver") {
+		t.Errorf("RunOrder error = %v; want no solver", err)
+	}
+}
+
+func TestRunOrderUnauthorizedSubproblem(t *testing.T) {
+	httpSolver := &memSolver{}
+	ca := newRunOrderCA(t, []string{"http-01"}, map[string]*memSolver{"http-01": httpSolver})
+	client := &Client{Key: testKeyEC, DirectoryURL: ca.srv.URL}
+	_, csr := runOrderCSR(t, "example.org", "www.example.org")
+	// The CA no longer considers the authorization of www.example.org valid.
+	ca.unauthorized = []string{"www.example.org"}
+
+	if _, _, err := client.RunOrder(context.Background(), csr, map[string]ChallengeSolver{"http-01": httpSolver}); err != nil {
+		t.Fatalf("RunOrder: %v", err)
+	}
+	if n := ca.newAuthz["example.org"]; n != 1 {
+		t.Errorf("example.org authorized %d times; want 1", n)
+	}
+	if n := ca.newAuthz["www.example.org"]; n != 2 {
+		t.Errorf("www.example.org authorized %d times; want 2", n)
+	}
+}
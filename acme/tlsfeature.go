@@ -0,0 +1,61 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package acme
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+)
+
+// idPeTLSFeature is the OID of the TLS feature extension, RFC 7633.
+var idPeTLSFeature = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+// TLS extensions which may be listed in the TLS feature extension
+// of a certificate, as returned by ParseTLSFeatures.
+const (
+	TLSFeatureStatusRequest   = 5  // status_request, RFC 6066: OCSP stapling
+	TLSFeatureStatusRequestV2 = 17 // status_request_v2, RFC 6961
+)
+
+// ParseTLSFeatures returns the TLS extensions listed in the TLS feature
+// extension of cert, RFC 7633, which a server must support when serving
+// cert, such as TLSFeatureStatusRequest. It returns nil if cert has no TLS
+// feature extension, and an error if the extension is malformed.
+func ParseTLSFeatures(cert *x509.Certificate) ([]int, error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(idPeTLSFeature) {
+			continue
+		}
+		var features []int
+		rest, err := asn1.Unmarshal(ext.Value, &features)
+		if err == nil && len(rest) > 0 {
+			err = errors.New("trailing data")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("acme: invalid TLS feature extension: %v", err)
+		}
+		return features, nil
+	}
+	return nil, nil
+}
+
+// CertHasMustStaple reports whether cert has the OCSP must-staple
+// extension: a TLS feature extension listing TLSFeatureStatusRequest,
+// which requires a server to staple an OCSP response to cert. Clients
+// may reject cert served without one. A malformed extension is ignored.
+func CertHasMustStaple(cert *x509.Certificate) bool {
+	features, err := ParseTLSFeatures(cert)
+	if err != nil {
+		return false
+	}
+	for _, f := range features {
+		if f == TLSFeatureStatusRequest {
+			return true
+		}
+	}
+	return false
+}
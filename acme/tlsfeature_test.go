@@ -0,0 +1,93 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package acme
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// tlsFeatureCert returns a self-signed certificate with the extensions ext.
+func tlsFeatureCert(t *testing.T, ext ...pkix.Extension) *x509.Certificate {
+	tmpl := &x509.Certificate{
+		SerialNumber:    big.NewInt(1),
+		Subject:         pkix.Name{CommonName: "example.org"},
+		NotBefore:       time.Now(),
+		NotAfter:        time.Now().Add(time.Hour),
+		ExtraExtensions: ext,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &testKeyEC.PublicKey, testKeyEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func tlsFeatureExt(t *testing.T, features ...int) pkix.Extension {
+	b, err := asn1.Marshal(features)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkix.Extension{Id: idPeTLSFeature, Value: b}
+}
+
+func TestCertHasMustStaple(t *testing.T) {
+	tests := []struct {
+		name     string
+		ext      []pkix.Extension
+		features []int
+		staple   bool
+		err      bool
+	}{
+		{name: "normal"},
+		{
+			name:     "must-staple",
+			ext:      []pkix.Extension{tlsFeatureExt(t, TLSFeatureStatusRequest)},
+			features: []int{TLSFeatureStatusRequest},
+			staple:   true,
+		},
+		{
+			name:     "several features",
+			ext:      []pkix.Extension{tlsFeatureExt(t, TLSFeatureStatusRequestV2, TLSFeatureStatusRequest)},
+			features: []int{TLSFeatureStatusRequestV2, TLSFeatureStatusRequest},
+			staple:   true,
+		},
+		{
+			name:     "other feature",
+			ext:      []pkix.Extension{tlsFeatureExt(t, TLSFeatureStatusRequestV2)},
+			features: []int{TLSFeatureStatusRequestV2},
+		},
+		{
+			name: "malformed",
+			ext:  []pkix.Extension{{Id: idPeTLSFeature, Value: []byte{0x30, 0x03, 0x02, 0x01}}},
+			err:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cert := tlsFeatureCert(t, test.ext...)
+			features, err := ParseTLSFeatures(cert)
+			if (err != nil) != test.err {
+				t.Errorf("ParseTLSFeatures: %v; want error: %v", err, test.err)
+			}
+			if !reflect.DeepEqual(features, test.features) {
+				t.Errorf("ParseTLSFeatures = %v; want %v", features, test.features)
+			}
+			if got := CertHasMustStaple(cert); got != test.staple {
+				t.Errorf("CertHasMustStaple = %v; want %v", got, test.staple)
+			}
+		})
+	}
+}
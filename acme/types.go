@@ -7,6 +7,7 @@ package acme
 import (
 	"crypto"
 	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
@@ -16,12 +17,14 @@ import (
 
 // ACME server response statuses used to describe Authorization and Challenge states.
 const (
-	StatusUnknown    = "unknown"
-	StatusPending    = "pending"
-	StatusProcessing = "processing"
-	StatusValid      = "valid"
-	StatusInvalid    = "invalid"
-	StatusRevoked    = "revoked"
+	StatusUnknown     = "unknown"
+	StatusPending     = "pending"
+	StatusProcessing  = "processing"
+	StatusValid       = "valid"
+	StatusInvalid     = "invalid"
+	StatusRevoked     = "revoked"
+	StatusDeactivated = "deactivated"
+	StatusExpired     = "expired"
 )
 
 // CRLReasonCode identifies the reason for a certificate revocation.
@@ -44,6 +47,15 @@ const (
 // ErrUnsupportedKey is returned when an unsupported key type is encountered.
 var ErrUnsupportedKey = errors.New("acme: unknown key type; only RSA and ECDSA are supported")
 
+// ErrNoAccount is returned by Client.GetAccount when the CA holds no account
+// for the key of the Client.
+var ErrNoAccount = errors.New("acme: account does not exist")
+
+// ErrPreAuthorizationNotSupported is returned by Client.Authorize and AuthorizeIP
+// when the CA directory advertises no URL to create authorizations with,
+// as CAs implementing RFC 8555 without its optional pre-authorization do.
+var ErrPreAuthorizationNotSupported = errors.New("acme: CA does not support pre-authorization")
+
 // Error is an ACME error, defined in Problem Details for HTTP APIs doc
 // http://tools.ietf.org/html/draft-ietf-appsawg-http-problem.
 type Error struct {
@@ -54,9 +66,37 @@ type Error struct {
 	ProblemType string
 	// Detail is a human-readable explanation specific to this occurrence of the problem.
 	Detail string
+	// Instance is a URI reference that identifies this occurrence of the
+	// problem, such as a page documenting a rate limit. It may be empty.
+	Instance string
+	// Identifier is the identifier the problem is about, as described in
+	// https://tools.ietf.org/html/rfc8555#section-6.7.
+	// Its Value is empty if the server did not specify it.
+	Identifier AuthzID
 	// Header is the original server error response headers.
 	// It may be nil.
 	Header http.Header
+	// Subproblems lists the problems of the individual identifiers
+	// of the request, if the server reported any.
+	Subproblems []Subproblem
+	// RawProblem is the problem document of the error response as received,
+	// for instance to log or forward it. It is nil if the body of the
+	// response was not JSON, and for the errors of the challenges
+	// reported within authorizations.
+	RawProblem []byte
+}
+
+// Subproblem is a problem with one of the identifiers of a request,
+// as described in https://tools.ietf.org/html/rfc8555#section-6.7.1.
+type Subproblem struct {
+	// ProblemType is a URI reference that identifies the problem type,
+	// typically in a "urn:ietf:params:acme:error:xxx" form.
+	ProblemType string
+	// Detail is a human-readable explanation specific to this occurrence of the problem.
+	Detail string
+	// Identifier is the identifier the problem is about.
+	// Its Value is empty if the server did not specify it.
+	Identifier AuthzID
 }
 
 func (e *Error) Error() string {
@@ -73,12 +113,19 @@ type AuthorizationError struct {
 	// Identifier is an AuthzID.Value of the failed Authorization.
 	Identifier string
 
+	// Status is the final status of the failed Authorization,
+	// such as StatusInvalid or StatusExpired.
+	Status string
+
 	// Errors is a collection of non-nil error values of Challenge items
 	// of the failed Authorization.
 	Errors []error
 }
 
 func (a *AuthorizationError) Error() string {
+	if len(a.Errors) == 0 && a.Status != "" {
+		return fmt.Sprintf("acme: authorization error for %s: authorization is %s", a.Identifier, a.Status)
+	}
 	e := make([]string, len(a.Errors))
 	for i, err := range a.Errors {
 		e[i] = err.Error()
@@ -151,6 +198,12 @@ type Directory struct {
 	// RevokeURL is used to initiate a certificate revocation flow.
 	RevokeURL string
 
+	// NonceURL is used to fetch fresh anti-replay nonces.
+	// It is only provided by CAs implementing RFC 8555, which require
+	// POST-as-GET requests instead of unauthenticated GETs for fetching
+	// resources other than the directory and nonces.
+	NonceURL string
+
 	// Term is a URI identifying the current terms of service.
 	Terms string
 
@@ -162,6 +215,21 @@ type Directory struct {
 	// recognises as referring to itself for the purposes of CAA record validation
 	// as defined in RFC6844.
 	CAA []string
+
+	// ExternalAccountRequired indicates that the CA requires new accounts
+	// to be bound to an existing non-ACME account, as described in
+	// RFC 8555, Section 7.3.4.
+	ExternalAccountRequired bool
+
+	// RenewalInfoURL is the base URL of the ACME Renewal Information (ARI)
+	// resources, if the CA supports them. See Client.FetchRenewalInfo.
+	RenewalInfoURL string
+
+	// Profiles maps the names of the certificate profiles the CA offers to
+	// their human-readable descriptions, as described in the ACME profiles
+	// extension draft. It is nil if the CA does not support profiles.
+	// See WithProfiles.
+	Profiles map[string]string
 }
 
 // Challenge encodes a returned CA challenge.
@@ -180,8 +248,12 @@ type Challenge struct {
 	// Status identifies the status of this challenge.
 	Status string
 
+	// Validated is the time at which the CA validated the challenge.
+	// It is zero if the challenge is not valid or the CA did not report it.
+	Validated time.Time
+
 	// Error indicates the reason for an authorization failure
-	// when this challenge was used.
+	// when this challenge was used, as reported by the CA.
 	// The type of a non-nil value is *Error.
 	Error error
 }
@@ -197,6 +269,10 @@ type Authorization struct {
 	// Identifier is what the account is authorized to represent.
 	Identifier AuthzID
 
+	// Expires is the time after which the CA no longer considers a valid
+	// authorization as such. It is the zero value if the CA did not say.
+	Expires time.Time
+
 	// Challenges that the client needs to fulfill in order to prove possession
 	// of the identifier (for pending authorizations).
 	// For final authorizations, the challenges that were used.
@@ -219,12 +295,26 @@ type AuthzID struct {
 // wireAuthz is ACME JSON representation of Authorization objects.
 type wireAuthz struct {
 	Status       string
+	Expires      time.Time
 	Challenges   []wireChallenge
 	Combinations [][]int
 	Identifier   struct {
 		Type  string
 		Value string
 	}
+	Wildcard json.RawMessage // unused, but known for StrictDecoding
+}
+
+func (z *wireAuthz) validate() error {
+	if z.Status == "" {
+		return errors.New("authorization has no status")
+	}
+	for i := range z.Challenges {
+		if err := z.Challenges[i].validate(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (z *wireAuthz) authorization(uri string) *Authorization {
@@ -232,6 +322,7 @@ func (z *wireAuthz) authorization(uri string) *Authorization {
 		URI:          uri,
 		Status:       z.Status,
 		Identifier:   AuthzID{Type: z.Identifier.Type, Value: z.Identifier.Value},
+		Expires:      z.Expires,
 		Combinations: z.Combinations, // shallow copy
 		Challenges:   make([]*Challenge, len(z.Challenges)),
 	}
@@ -245,6 +336,7 @@ func (z *wireAuthz) error(uri string) *AuthorizationError {
 	err := &AuthorizationError{
 		URI:        uri,
 		Identifier: z.Identifier.Value,
+		Status:     z.Status,
 	}
 	for _, raw := range z.Challenges {
 		if raw.Error != nil {
@@ -256,19 +348,32 @@ func (z *wireAuthz) error(uri string) *AuthorizationError {
 
 // wireChallenge is ACME JSON challenge representation.
 type wireChallenge struct {
-	URI    string `json:"uri"`
-	Type   string
-	Token  string
-	Status string
-	Error  *wireError
+	URI       string `json:"uri"`
+	Type      string
+	Token     string
+	Status    string
+	Validated time.Time
+	Error     *wireError
+
+	// Unused, but known for StrictDecoding.
+	URL              json.RawMessage
+	KeyAuthorization json.RawMessage
+}
+
+func (c *wireChallenge) validate() error {
+	if c.Type == "" {
+		return errors.New("challenge has no type")
+	}
+	return nil
 }
 
 func (c *wireChallenge) challenge() *Challenge {
 	v := &Challenge{
-		URI:    c.URI,
-		Type:   c.Type,
-		Token:  c.Token,
-		Status: c.Status,
+		URI:       c.URI,
+		Type:      c.Type,
+		Token:     c.Token,
+		Status:    c.Status,
+		Validated: c.Validated,
 	}
 	if v.Status == "" {
 		v.Status = StatusPending
@@ -282,18 +387,53 @@ func (c *wireChallenge) challenge() *Challenge {
 // wireError is a subset of fields of the Problem Details object
 // as described in https://tools.ietf.org/html/rfc7807#section-3.1.
 type wireError struct {
-	Status int
-	Type   string
-	Detail string
+	Status     int
+	Type       string
+	Detail     string
+	Instance   string
+	Identifier struct {
+		Type  string
+		Value string
+	}
+
+	Subproblems []wireSubproblem
+
+	// Unused, but known for StrictDecoding.
+	Title json.RawMessage
+}
+
+// wireSubproblem is an element of the subproblems of a wireError.
+type wireSubproblem struct {
+	Type       string
+	Detail     string
+	Identifier struct {
+		Type  string
+		Value string
+	}
+
+	// Unused, but known for StrictDecoding.
+	Status   json.RawMessage
+	Title    json.RawMessage
+	Instance json.RawMessage
 }
 
 func (e *wireError) error(h http.Header) *Error {
-	return &Error{
+	err := &Error{
 		StatusCode:  e.Status,
 		ProblemType: e.Type,
 		Detail:      e.Detail,
+		Instance:    e.Instance,
+		Identifier:  AuthzID{Type: e.Identifier.Type, Value: e.Identifier.Value},
 		Header:      h,
 	}
+	for _, sp := range e.Subproblems {
+		err.Subproblems = append(err.Subproblems, Subproblem{
+			ProblemType: sp.Type,
+			Detail:      sp.Detail,
+			Identifier:  AuthzID{Type: sp.Identifier.Type, Value: sp.Identifier.Value},
+		})
+	}
+	return err
 }
 
 // CertOption is an optional argument type for the TLS ChallengeCert methods for
@@ -327,3 +467,74 @@ func WithTemplate(t *x509.Certificate) CertOption {
 type certOptTemplate x509.Certificate
 
 func (*certOptTemplate) privateCertOpt() {}
+
+// OrderOption is an optional argument type for Client.CreateCert and
+// Client.RunOrder, for customizing the requested certificate.
+type OrderOption interface {
+	privateOrderOpt()
+}
+
+// WithNotBefore sets the requested notBefore time of the certificate.
+// If not set, it is the time of the request. CAs may ignore it.
+func WithNotBefore(t time.Time) OrderOption {
+	return orderNotBeforeOpt(t)
+}
+
+type orderNotBeforeOpt time.Time
+
+func (orderNotBeforeOpt) privateOrderOpt() {}
+
+// WithNotAfter sets the requested notAfter time of the certificate,
+// overriding the exp argument of CreateCert. CAs may ignore it.
+func WithNotAfter(t time.Time) OrderOption {
+	return orderNotAfterOpt(t)
+}
+
+type orderNotAfterOpt time.Time
+
+func (orderNotAfterOpt) privateOrderOpt() {}
+
+// WithPollInterval sets the interval between the polls of the certificate
+// URL while the CA issues the certificate requested with CreateCert, instead
+// of the Client's RetryBackoff. An interval requested by the CA with
+// a Retry-After header takes precedence.
+func WithPollInterval(d time.Duration) OrderOption {
+	return orderPollIntervalOpt(d)
+}
+
+type orderPollIntervalOpt time.Duration
+
+func (orderPollIntervalOpt) privateOrderOpt() {}
+
+// WithCSRVerification makes CreateCert check the issued certificate against
+// the certificate request with VerifyIssuedCert, returning the
+// *CertMismatchError along with the certificate URL if they do not match.
+func WithCSRVerification() OrderOption {
+	return orderVerifyCSROpt{}
+}
+
+type orderVerifyCSROpt struct{}
+
+func (orderVerifyCSROpt) privateOrderOpt() {}
+
+// WithProfiles requests the certificate with the first of the profiles names
+// advertised by the CA in Directory.Profiles, falling back to the next ones
+// if the CA does not advertise the previous ones, so that the same list
+// works with several CAs. The request fails if the CA advertises none.
+func WithProfiles(names ...string) OrderOption {
+	return orderProfilesOpt(names)
+}
+
+type orderProfilesOpt []string
+
+func (orderProfilesOpt) privateOrderOpt() {}
+
+// resolve returns the first of the profiles o advertised in dir.
+func (o orderProfilesOpt) resolve(dir *Directory) (string, error) {
+	for _, name := range o {
+		if _, ok := dir.Profiles[name]; ok {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("acme: CA advertises none of the profiles %q", []string(o))
+}
@@ -9,8 +9,9 @@
 // and for BLAKE2Xs see https://blake2.net/blake2x.pdf
 //
 // If you aren't sure which function you need, use BLAKE2s (Sum256 or New256).
-// If you need a secret-key MAC (message authentication code), use the New256
-// function with a non-nil key.
+// If you need a secret-key MAC (message authentication code), use the NewMAC
+// function, or the New256 function with a non-nil key. The parameters of tree
+// hashing, for parallel hashing schemes, can be set with NewWithConfig.
 //
 // BLAKE2X is a construction to compute hash values larger than 32 bytes. It
 // can produce hash values between 0 and 65535 bytes.
@@ -64,6 +65,100 @@ func New128(key []byte) (hash.Hash, error) {
 	return newDigest(Size128, key)
 }
 
+// NewMAC returns a new hash.Hash computing a BLAKE2s MAC of size bytes with
+// the given key. The size must be between 1 and 32 and the key between 1 and
+// 32 bytes long. Note that a MAC shorter than 16 bytes is likely too short to
+// be secure.
+func NewMAC(size int, key []byte) (hash.Hash, error) {
+	if len(key) == 0 {
+		return nil, errors.New("blake2s: a key is required for a MAC")
+	}
+	if size < 1 || size > Size {
+		return nil, errors.New("blake2s: invalid MAC size")
+	}
+	return newDigest(size, key)
+}
+
+// Config holds the parameters of a BLAKE2s hash computed by NewWithConfig.
+type Config struct {
+	// Size is the length of the hash in bytes, between 1 and 32.
+	// If zero, 32 is used.
+	Size int
+
+	// Key optionally turns the hash into a MAC. It must be at most
+	// 32 bytes long.
+	Key []byte
+
+	// Tree optionally holds the parameters of a node of a hash tree.
+	// If nil, the sequential mode of Sum256 and New256 is used.
+	Tree *Tree
+}
+
+// Tree holds the tree hashing parameters of a BLAKE2s hash, as defined in
+// section 2.10 of the BLAKE2 specification. Each node of the tree is hashed
+// separately with its own parameters: the leaves from the input data, and
+// the inner nodes from the concatenated hashes of their children.
+type Tree struct {
+	// Fanout is the maximum number of children of a node, or 0 if unlimited.
+	Fanout uint8
+	// MaxDepth is the maximum depth of the tree, between 1 and 255.
+	MaxDepth uint8
+	// LeafSize is the maximum length in bytes of the data of a leaf,
+	// or 0 if unlimited.
+	LeafSize uint32
+	// NodeOffset is the position of the node in its layer, starting from 0
+	// for the leftmost node. It must be less than 2^48.
+	NodeOffset uint64
+	// NodeDepth is the depth of the node, 0 for the leaves.
+	NodeDepth uint8
+	// InnerHashSize is the length in bytes of the hashes of the inner
+	// nodes, between 0 and 32.
+	InnerHashSize uint8
+	// IsLastNode indicates the last, rightmost node of its layer,
+	// as well as the root node.
+	IsLastNode bool
+}
+
+// NewWithConfig returns a new hash.Hash computing a BLAKE2s checksum with the
+// parameters of c. A nil Config is equivalent to a zero one, giving the same
+// checksum as New256(nil). Unlike the others, the hash.Hash of a keyed or tree
+// hash does not implement BinaryMarshaler and BinaryUnmarshaler.
+func NewWithConfig(c *Config) (hash.Hash, error) {
+	if c == nil {
+		c = &Config{}
+	}
+	size := c.Size
+	if size == 0 {
+		size = Size
+	}
+	if size < 1 || size > Size {
+		return nil, errors.New("blake2s: invalid hash size")
+	}
+	if c.Tree == nil {
+		return newDigest(size, c.Key)
+	}
+	switch t := c.Tree; {
+	case t.MaxDepth == 0:
+		return nil, errors.New("blake2s: invalid tree depth")
+	case t.NodeOffset >= 1<<48:
+		return nil, errors.New("blake2s: invalid tree node offset")
+	case t.InnerHashSize > Size:
+		return nil, errors.New("blake2s: invalid tree inner hash size")
+	}
+	if len(c.Key) > Size {
+		return nil, errKeySize
+	}
+	tree := *c.Tree
+	d := &digest{
+		size:   size,
+		keyLen: len(c.Key),
+		tree:   &tree,
+	}
+	copy(d.key[:], c.Key)
+	d.Reset()
+	return d, nil
+}
+
 func newDigest(hashSize int, key []byte) (*digest, error) {
 	if len(key) > Size {
 		return nil, errKeySize
@@ -120,6 +215,8 @@ type digest struct {
 
 	key    [BlockSize]byte
 	keyLen int
+
+	tree *Tree // tree hashing parameters; nil in sequential mode
 }
 
 const (
@@ -131,6 +228,9 @@ func (d *digest) MarshalBinary() ([]byte, error) {
 	if d.keyLen != 0 {
 		return nil, errors.New("crypto/blake2s: cannot marshal MACs")
 	}
+	if d.tree != nil {
+		return nil, errors.New("crypto/blake2s: cannot marshal tree hashes")
+	}
 	b := make([]byte, 0, marshaledSize)
 	b = append(b, magic...)
 	for i := 0; i < 8; i++ {
@@ -172,7 +272,14 @@ func (d *digest) Size() int { return d.size }
 
 func (d *digest) Reset() {
 	d.h = iv
-	d.h[0] ^= uint32(d.size) | (uint32(d.keyLen) << 8) | (1 << 16) | (1 << 24)
+	if t := d.tree; t != nil {
+		d.h[0] ^= uint32(d.size) | (uint32(d.keyLen) << 8) | (uint32(t.Fanout) << 16) | (uint32(t.MaxDepth) << 24)
+		d.h[1] ^= t.LeafSize
+		d.h[2] ^= uint32(t.NodeOffset)
+		d.h[3] ^= uint32(t.NodeOffset>>32) | (uint32(t.NodeDepth) << 16) | (uint32(t.InnerHashSize) << 24)
+	} else {
+		d.h[0] ^= uint32(d.size) | (uint32(d.keyLen) << 8) | (1 << 16) | (1 << 24)
+	}
 	d.offset, d.c[0], d.c[1] = 0, 0, 0
 	if d.keyLen > 0 {
 		d.block = d.key
@@ -226,7 +333,11 @@ func (d *digest) finalize(hash *[Size]byte) {
 	}
 	c[0] -= remaining
 
-	hashBlocks(&h, &c, 0xFFFFFFFF, block[:])
+	if d.tree != nil && d.tree.IsLastNode {
+		hashBlocksGenericNode(&h, &c, 0xFFFFFFFF, 0xFFFFFFFF, block[:])
+	} else {
+		hashBlocks(&h, &c, 0xFFFFFFFF, block[:])
+	}
 	for i, v := range h {
 		binary.LittleEndian.PutUint32(hash[4*i:], v)
 	}
@@ -21,6 +21,12 @@ var precomputed = [10][16]byte{
 }
 
 func hashBlocksGeneric(h *[8]uint32, c *[2]uint32, flag uint32, blocks []byte) {
+	hashBlocksGenericNode(h, c, flag, 0, blocks)
+}
+
+// hashBlocksGenericNode is hashBlocksGeneric also taking the last node flag
+// of tree hashing, which the assembly implementations do not support.
+func hashBlocksGenericNode(h *[8]uint32, c *[2]uint32, flag, nodeFlag uint32, blocks []byte) {
 	var m [16]uint32
 	c0, c1 := c[0], c[1]
 
@@ -35,6 +41,7 @@ func hashBlocksGeneric(h *[8]uint32, c *[2]uint32, flag uint32, blocks []byte) {
 		v12 ^= c0
 		v13 ^= c1
 		v14 ^= flag
+		v15 ^= nodeFlag
 
 		for j := range m {
 			m[j] = uint32(blocks[i]) | uint32(blocks[i+1])<<8 | uint32(blocks[i+2])<<16 | uint32(blocks[i+3])<<24
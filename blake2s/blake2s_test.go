@@ -66,6 +66,114 @@ func TestHashes2X(t *testing.T) {
 	testHashes2X(t)
 }
 
+func TestNewMAC(t *testing.T) {
+	key, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	input := make([]byte, 255)
+	for i := range input {
+		input[i] = byte(i)
+	}
+	for i, expectedHex := range hashes {
+		h, err := NewMAC(Size, key)
+		if err != nil {
+			t.Fatalf("#%d: error from NewMAC: %v", i, err)
+		}
+		h.Write(input[:i])
+		if gotHex := fmt.Sprintf("%x", h.Sum(nil)); gotHex != expectedHex {
+			t.Fatalf("#%d: got %s, wanted %s", i, gotHex, expectedHex)
+		}
+	}
+
+	h, err := NewMAC(Size128, key)
+	if err != nil {
+		t.Fatalf("error from NewMAC: %v", err)
+	}
+	h.Write(input[:3])
+	if gotHex, expectedHex := fmt.Sprintf("%x", h.Sum(nil)), hashes128[3]; gotHex != expectedHex {
+		t.Errorf("128-bit MAC: got %s, wanted %s", gotHex, expectedHex)
+	}
+
+	for _, tt := range []struct {
+		size int
+		key  []byte
+	}{
+		{Size, nil},
+		{Size, make([]byte, Size+1)},
+		{0, key},
+		{Size + 1, key},
+		{-1, key},
+	} {
+		if _, err := NewMAC(tt.size, tt.key); err == nil {
+			t.Errorf("NewMAC(%d, %d byte key) succeeded", tt.size, len(tt.key))
+		}
+	}
+}
+
+func TestTreeHash(t *testing.T) {
+	// The expected values were computed with Python's hashlib.blake2s.
+	hashNode := func(c *Config, data []byte) []byte {
+		h, err := NewWithConfig(c)
+		if err != nil {
+			t.Fatalf("NewWithConfig: %v", err)
+		}
+		h.Write(data)
+		return h.Sum(nil)
+	}
+
+	// A tree of two leaves, the second of which is the last node.
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	tree := func(offset uint64, depth uint8, last bool) *Config {
+		return &Config{Tree: &Tree{
+			Fanout:        2,
+			MaxDepth:      2,
+			LeafSize:      64,
+			NodeOffset:    offset,
+			NodeDepth:     depth,
+			InnerHashSize: Size,
+			IsLastNode:    last,
+		}}
+	}
+	leaves := append(hashNode(tree(0, 0, false), data[:64]), hashNode(tree(1, 0, true), data[64:])...)
+	root := hashNode(tree(0, 1, true), leaves)
+	if gotHex, expectedHex := fmt.Sprintf("%x", root), "c10c02db09c5a2074669c08e92f02fc921dd2c3fcb15fcf08e42cd0d30b23d43"; gotHex != expectedHex {
+		t.Errorf("tree root: got %s, wanted %s", gotHex, expectedHex)
+	}
+
+	// All the parameters at once.
+	c := &Config{
+		Size: 20,
+		Key:  []byte("kkkkkkk"),
+		Tree: &Tree{
+			Fanout:        4,
+			MaxDepth:      2,
+			LeafSize:      64,
+			NodeOffset:    1<<40 + 5,
+			NodeDepth:     1,
+			InnerHashSize: 20,
+		},
+	}
+	if gotHex, expectedHex := fmt.Sprintf("%x", hashNode(c, []byte("abc"))), "56c30c298dd846330799b8c69ae46b642906a400"; gotHex != expectedHex {
+		t.Errorf("keyed node: got %s, wanted %s", gotHex, expectedHex)
+	}
+
+	// Without tree parameters, the sequential mode is used.
+	if sum := Sum256(data); !bytes.Equal(hashNode(nil, data), sum[:]) {
+		t.Error("NewWithConfig(nil) differs from Sum256")
+	}
+
+	for _, bad := range []*Tree{
+		{MaxDepth: 0},
+		{MaxDepth: 1, NodeOffset: 1 << 48},
+		{MaxDepth: 1, InnerHashSize: Size + 1},
+	} {
+		if _, err := NewWithConfig(&Config{Tree: bad}); err == nil {
+			t.Errorf("NewWithConfig(%+v) succeeded", bad)
+		}
+	}
+}
+
 func TestMarshal(t *testing.T) {
 	input := make([]byte, 255)
 	for i := range input {
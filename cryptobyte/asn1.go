@@ -126,6 +126,43 @@ func (b *Builder) AddASN1BitString(data []byte) {
 	})
 }
 
+// AddASN1BitStringValue appends a DER-encoded ASN.1 BIT STRING of the first
+// bs.BitLength bits of bs.Bytes. It is an error if bs.Bytes is not exactly
+// long enough for them, or if the unused bits of its last byte are not zero.
+func (b *Builder) AddASN1BitStringValue(bs encoding_asn1.BitString) {
+	unusedBits := uint8(len(bs.Bytes)*8 - bs.BitLength)
+	if bs.BitLength < 0 || len(bs.Bytes) != (bs.BitLength+7)/8 ||
+		len(bs.Bytes) > 0 && bs.Bytes[len(bs.Bytes)-1]&(1<<unusedBits-1) != 0 {
+		b.err = fmt.Errorf("cryptobyte: invalid BIT STRING of %d bits in %d bytes", bs.BitLength, len(bs.Bytes))
+		return
+	}
+	b.AddASN1(asn1.BIT_STRING, func(b *Builder) {
+		b.AddUint8(unusedBits)
+		b.AddBytes(bs.Bytes)
+	})
+}
+
+// AddASN1NamedBitString appends a DER-encoded ASN.1 BIT STRING with the given
+// named bits set, such as the KeyUsage of an X.509 certificate. As required
+// by DER, trailing zero bits are omitted. It is an error if a bit is negative.
+func (b *Builder) AddASN1NamedBitString(bits ...int) {
+	var bs encoding_asn1.BitString
+	for _, bit := range bits {
+		if bit < 0 {
+			b.err = fmt.Errorf("cryptobyte: invalid named bit %d", bit)
+			return
+		}
+		if bit >= bs.BitLength {
+			bs.BitLength = bit + 1
+		}
+	}
+	bs.Bytes = make([]byte, (bs.BitLength+7)/8)
+	for _, bit := range bits {
+		bs.Bytes[bit/8] |= 0x80 >> uint(bit%8)
+	}
+	b.AddASN1BitStringValue(bs)
+}
+
 func (b *Builder) addBase128Int(n int64) {
 	var length int
 	if n == 0 {
@@ -487,6 +524,23 @@ func (s *String) ReadASN1BitString(out *encoding_asn1.BitString) bool {
 	return true
 }
 
+// ReadASN1NamedBitString decodes an ASN.1 BIT STRING of named bits, such as
+// the KeyUsage of an X.509 certificate, into out and advances. In addition
+// to the checks of ReadASN1BitString, it is an error if the BIT STRING has
+// trailing zero bits, which DER requires to be omitted. Whether a named bit
+// is set is reported by out.At. It reports whether the read was successful.
+func (s *String) ReadASN1NamedBitString(out *encoding_asn1.BitString) bool {
+	var bs encoding_asn1.BitString
+	rest := *s
+	if !rest.ReadASN1BitString(&bs) ||
+		bs.BitLength > 0 && bs.At(bs.BitLength-1) == 0 {
+		return false
+	}
+	*s = rest
+	*out = bs
+	return true
+}
+
 // ReadASN1BitString decodes an ASN.1 BIT STRING into out and advances. It is
 // an error if the BIT STRING is not a whole number of bytes. It reports
 // whether the read was successful.
@@ -331,3 +331,118 @@ func TestReadASN1BitString(t *testing.T) {
 		}
 	}
 }
+
+func TestASN1BitStringValue(t *testing.T) {
+	testData := []struct {
+		in  encoding_asn1.BitString
+		out []byte
+	}{
+		{encoding_asn1.BitString{}, []byte{3, 1, 0}},
+		{encoding_asn1.BitString{Bytes: []byte{0x80}, BitLength: 1}, []byte{3, 2, 7, 0x80}},
+		{encoding_asn1.BitString{Bytes: []byte{0xa0}, BitLength: 3}, []byte{3, 2, 5, 0xa0}},
+		{encoding_asn1.BitString{Bytes: []byte{0xff, 0x80}, BitLength: 9}, []byte{3, 3, 7, 0xff, 0x80}},
+		{encoding_asn1.BitString{Bytes: []byte{0x01, 0x02}, BitLength: 16}, []byte{3, 3, 0, 0x01, 0x02}},
+	}
+	for i, test := range testData {
+		var b Builder
+		b.AddASN1BitStringValue(test.in)
+		result, err := b.Bytes()
+		if err != nil {
+			t.Errorf("#%d: AddASN1BitStringValue failed: %s", i, err)
+			continue
+		}
+		if !bytes.Equal(result, test.out) {
+			t.Errorf("#%d: AddASN1BitStringValue: got %x, want %x", i, result, test.out)
+		}
+
+		in := String(result)
+		var out encoding_asn1.BitString
+		if !in.ReadASN1BitString(&out) || !bytes.Equal(out.Bytes, test.in.Bytes) || out.BitLength != test.in.BitLength {
+			t.Errorf("#%d: in.ReadASN1BitString() = %v, want %v", i, out, test.in)
+		}
+	}
+
+	for i, bs := range []encoding_asn1.BitString{
+		{Bytes: []byte{0xa8}, BitLength: 3}, // nonzero unused bits
+		{Bytes: []byte{0x80}, BitLength: 9},
+		{Bytes: []byte{0x80, 0x00}, BitLength: 1},
+		{Bytes: []byte{0x80}, BitLength: -1},
+	} {
+		var b Builder
+		b.AddASN1BitStringValue(bs)
+		if _, err := b.Bytes(); err == nil {
+			t.Errorf("#%d: AddASN1BitStringValue(%v) succeeded, want error", i, bs)
+		}
+	}
+}
+
+func TestASN1NamedBitString(t *testing.T) {
+	// KeyUsage bits of RFC 5280, Section 4.2.1.3.
+	const (
+		digitalSignature = 0
+		keyEncipherment  = 2
+		keyCertSign      = 5
+		cRLSign          = 6
+		decipherOnly     = 8
+	)
+	testData := []struct {
+		bits []int
+		out  []byte
+	}{
+		{nil, []byte{3, 1, 0}},
+		{[]int{digitalSignature, keyEncipherment}, []byte{3, 2, 5, 0xa0}},
+		{[]int{keyCertSign, cRLSign}, []byte{3, 2, 1, 0x06}},
+		{[]int{digitalSignature, decipherOnly}, []byte{3, 3, 7, 0x80, 0x80}},
+		{[]int{cRLSign, keyCertSign, cRLSign}, []byte{3, 2, 1, 0x06}},
+	}
+	for i, test := range testData {
+		var b Builder
+		b.AddASN1NamedBitString(test.bits...)
+		result, err := b.Bytes()
+		if err != nil {
+			t.Errorf("#%d: AddASN1NamedBitString failed: %s", i, err)
+			continue
+		}
+		if !bytes.Equal(result, test.out) {
+			t.Errorf("#%d: AddASN1NamedBitString: got %x, want %x", i, result, test.out)
+		}
+
+		in := String(result)
+		var out encoding_asn1.BitString
+		if !in.ReadASN1NamedBitString(&out) {
+			t.Errorf("#%d: in.ReadASN1NamedBitString() failed", i)
+			continue
+		}
+		set := make(map[int]bool)
+		for _, bit := range test.bits {
+			set[bit] = true
+		}
+		for bit := 0; bit <= decipherOnly; bit++ {
+			if got := out.At(bit) == 1; got != set[bit] {
+				t.Errorf("#%d: bit %d set = %v, want %v", i, bit, got, set[bit])
+			}
+		}
+	}
+
+	var b Builder
+	b.AddASN1NamedBitString(digitalSignature, -1)
+	if _, err := b.Bytes(); err == nil {
+		t.Error("AddASN1NamedBitString(-1) succeeded, want error")
+	}
+
+	for i, in := range [][]byte{
+		{3, 2, 5, 0xa8}, // nonzero unused bits
+		{3, 2, 8, 0x00}, // too many unused bits
+		{3, 2, 4, 0xa0}, // trailing zero bit
+		{3, 3, 0, 0xa0, 0x00},
+	} {
+		s := String(in)
+		var out encoding_asn1.BitString
+		if s.ReadASN1NamedBitString(&out) {
+			t.Errorf("#%d: in.ReadASN1NamedBitString(%x) succeeded, want failure", i, in)
+		}
+		if len(s) != len(in) {
+			t.Errorf("#%d: in.ReadASN1NamedBitString(%x) advanced on failure", i, in)
+		}
+	}
+}
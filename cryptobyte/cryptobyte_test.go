@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"reflect"
 	"testing"
 )
 
@@ -179,6 +180,29 @@ func TestUint32(t *testing.T) {
 	}
 }
 
+func TestUint64(t *testing.T) {
+	var b Builder
+	b.AddUint64(0xfffefdfcfbfaf9f8)
+	if err := builderBytesEq(&b, 255, 254, 253, 252, 251, 250, 249, 248); err != nil {
+		t.Error(err)
+	}
+
+	var s String = b.BytesOrPanic()
+	var v uint64
+	if !s.ReadUint64(&v) {
+		t.Error("ReadUint64() = false, want true")
+	}
+	if v != 0xfffefdfcfbfaf9f8 {
+		t.Errorf("v = %x, want fffefdfcfbfaf9f8", v)
+	}
+	if len(s) != 0 {
+		t.Errorf("len(s) = %d, want 0", len(s))
+	}
+	if s.ReadUint64(&v) {
+		t.Error("ReadUint64() on empty string = true, want false")
+	}
+}
+
 func TestUMultiple(t *testing.T) {
 	var b Builder
 	b.AddUint8(23)
@@ -305,6 +329,83 @@ func TestUint8LengthPrefixedNested(t *testing.T) {
 	}
 }
 
+func TestUint24LengthPrefixedHandshake(t *testing.T) {
+	// A TLS 1.3 Certificate handshake message: a 1-byte type and a
+	// 24-bit length, followed by a context and a 24-bit length-prefixed
+	// list of 24-bit length-prefixed certificates with 16-bit length-
+	// prefixed extensions.
+	certs := [][]byte{{1, 2, 3}, {4, 5}}
+	var b Builder
+	b.AddUint8(11)
+	b.AddUint24LengthPrefixed(func(msg *Builder) {
+		msg.AddUint8LengthPrefixed(func(ctx *Builder) {})
+		msg.AddUint24LengthPrefixed(func(list *Builder) {
+			for _, c := range certs {
+				list.AddUint24LengthPrefixed(func(entry *Builder) {
+					entry.AddBytes(c)
+				})
+				list.AddUint16LengthPrefixed(func(exts *Builder) {})
+			}
+		})
+	})
+	if err := builderBytesEq(&b,
+		11, 0, 0, 19,
+		0,
+		0, 0, 15,
+		0, 0, 3, 1, 2, 3, 0, 0,
+		0, 0, 2, 4, 5, 0, 0,
+	); err != nil {
+		t.Error(err)
+	}
+
+	var s String = b.BytesOrPanic()
+	var (
+		typ            uint8
+		msg, ctx, list String
+		got            [][]byte
+	)
+	if !s.ReadUint8(&typ) || !s.ReadUint24LengthPrefixed(&msg) || !s.Empty() {
+		t.Fatal("parsing message header failed")
+	}
+	if !msg.ReadUint8LengthPrefixed(&ctx) || !msg.ReadUint24LengthPrefixed(&list) || !msg.Empty() {
+		t.Fatal("parsing message body failed")
+	}
+	for !list.Empty() {
+		var entry, exts String
+		if !list.ReadUint24LengthPrefixed(&entry) || !list.ReadUint16LengthPrefixed(&exts) {
+			t.Fatal("parsing certificate entry failed")
+		}
+		got = append(got, []byte(entry))
+	}
+	if typ != 11 || len(ctx) != 0 || !reflect.DeepEqual(got, certs) {
+		t.Errorf("got type %d, context %v, certificates %v; want 11, [], %v", typ, ctx, got, certs)
+	}
+}
+
+func TestUint32LengthPrefixed(t *testing.T) {
+	var b Builder
+	b.AddUint32LengthPrefixed(func(c *Builder) {
+		c.AddUint64(42)
+	})
+	if err := builderBytesEq(&b, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 42); err != nil {
+		t.Error(err)
+	}
+
+	var s, child String = b.BytesOrPanic(), nil
+	var v uint64
+	if !s.ReadUint32LengthPrefixed(&child) || !child.ReadUint64(&v) || !child.Empty() || !s.Empty() {
+		t.Error("parsing failed")
+	}
+	if v != 42 {
+		t.Errorf("v = %d, want 42", v)
+	}
+
+	s = String{0, 0, 0, 9, 1}
+	if s.ReadUint32LengthPrefixed(&child) {
+		t.Error("ReadUint32LengthPrefixed() on truncated input = true, want false")
+	}
+}
+
 func TestPreallocatedBuffer(t *testing.T) {
 	var buf [5]byte
 	b := NewBuilder(buf[0:0])
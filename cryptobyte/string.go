@@ -81,6 +81,18 @@ func (s *String) ReadUint32(out *uint32) bool {
 	return true
 }
 
+// ReadUint64 decodes a big-endian, 64-bit value into out and advances over it.
+// It reports whether the read was successful.
+func (s *String) ReadUint64(out *uint64) bool {
+	v := s.read(8)
+	if v == nil {
+		return false
+	}
+	*out = uint64(v[0])<<56 | uint64(v[1])<<48 | uint64(v[2])<<40 | uint64(v[3])<<32 |
+		uint64(v[4])<<24 | uint64(v[5])<<16 | uint64(v[6])<<8 | uint64(v[7])
+	return true
+}
+
 func (s *String) readUnsigned(out *uint32, length int) bool {
 	v := s.read(length)
 	if v == nil {
@@ -106,8 +118,7 @@ func (s *String) readLengthPrefixed(lenLen int, outChild *String) bool {
 		length = length | uint32(b)
 	}
 	if int(length) < 0 {
-		// This currently cannot overflow because we read uint24 at most, but check
-		// anyway in case that changes in the future.
+		// A 32-bit length overflows int on 32-bit platforms.
 		return false
 	}
 	v := s.read(int(length))
@@ -138,6 +149,13 @@ func (s *String) ReadUint24LengthPrefixed(out *String) bool {
 	return s.readLengthPrefixed(3, out)
 }
 
+// ReadUint32LengthPrefixed reads the content of a big-endian, 32-bit
+// length-prefixed value into out and advances over it. It reports whether
+// the read was successful.
+func (s *String) ReadUint32LengthPrefixed(out *String) bool {
+	return s.readLengthPrefixed(4, out)
+}
+
 // ReadBytes reads n bytes into out and advances over them. It reports
 // whether the read was successful.
 func (s *String) ReadBytes(out *[]byte, n int) bool {
@@ -7,6 +7,7 @@ package curve25519
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"testing"
 )
@@ -77,3 +78,58 @@ func BenchmarkScalarBaseMult(b *testing.B) {
 		ScalarBaseMult(&out, &in)
 	}
 }
+
+func TestX25519(t *testing.T) {
+	for _, tv := range testVectors {
+		got, err := X25519(tv.In[:], tv.Base[:])
+		if err != nil {
+			t.Fatalf("X25519(%x, %x): %v", tv.In, tv.Base, err)
+		}
+		if !bytes.Equal(got, tv.Expect[:]) {
+			t.Errorf("X25519(%x, %x) = %x; want %x", tv.In, tv.Base, got, tv.Expect)
+		}
+	}
+
+	var scalar [32]byte
+	scalar[0] = 1
+	var want [32]byte
+	ScalarBaseMult(&want, &scalar)
+	got, err := X25519(scalar[:], Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want[:]) {
+		t.Errorf("X25519(1, Basepoint) = %x; want %x", got, want)
+	}
+}
+
+func TestX25519LowOrderPoints(t *testing.T) {
+	// Points of order 1, 2, 4 and 8, and their non-canonical encodings,
+	// as listed in https://cr.yp.to/ecdh.html#validate.
+	lowOrder := []string{
+		"0000000000000000000000000000000000000000000000000000000000000000",
+		"0100000000000000000000000000000000000000000000000000000000000000",
+		"e0eb7a7c3b41b8ae1656e3faf19fc46ada098deb9c32b1fd866205165f49b800",
+		"5f9c95bca3508c24b1d0b1559c83ef5b04445cc4581c8e86d8224eddd09f1157",
+		"ecffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f",
+		"edffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f",
+		"eeffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f",
+	}
+	scalar := make([]byte, ScalarSize)
+	rand.Read(scalar)
+	for _, p := range lowOrder {
+		point, _ := hex.DecodeString(p)
+		if _, err := X25519(scalar, point); err == nil {
+			t.Errorf("X25519(_, %s): err is nil", p)
+		}
+	}
+}
+
+func TestX25519BadLength(t *testing.T) {
+	if _, err := X25519(make([]byte, ScalarSize-1), Basepoint); err == nil {
+		t.Error("short scalar: err is nil")
+	}
+	if _, err := X25519(make([]byte, ScalarSize), make([]byte, PointSize+1)); err == nil {
+		t.Error("long point: err is nil")
+	}
+}
@@ -6,11 +6,27 @@
 // the elliptic curve known as curve25519. See https://cr.yp.to/ecdh.html
 package curve25519 // import "github.com/robarchibald/crypto/curve25519"
 
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+)
+
+const (
+	// ScalarSize is the size of the scalar input to X25519.
+	ScalarSize = 32
+	// PointSize is the size of the point input to X25519.
+	PointSize = 32
+)
+
 // basePoint is the x coordinate of the generator of the curve.
 var basePoint = [32]byte{9, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
 
 // ScalarMult sets dst to the product in*base where dst and base are the x
 // coordinates of group points and all values are in little-endian form.
+//
+// ScalarMult does not reject low order points: if base is one, dst is set to
+// all zeroes. Use X25519 for key agreement with untrusted peers.
 func ScalarMult(dst, in, base *[32]byte) {
 	scalarMult(dst, in, base)
 }
@@ -21,3 +37,36 @@ func ScalarMult(dst, in, base *[32]byte) {
 func ScalarBaseMult(dst, in *[32]byte) {
 	ScalarMult(dst, in, &basePoint)
 }
+
+// Basepoint is the canonical Curve25519 generator, for use with X25519.
+var Basepoint = basePoint[:]
+
+// errLowOrderPoint is returned by X25519 when the result is all zeroes.
+var errLowOrderPoint = errors.New("curve25519: bad input point: low order point")
+
+// X25519 returns the result of the scalar multiplication (scalar * point),
+// according to RFC 7748, Section 5. scalar, point and the return value are
+// slices of 32 bytes.
+//
+// scalar can be generated at random, for example with crypto/rand. point should
+// be either Basepoint or the output of another X25519 call.
+//
+// Unlike ScalarMult, X25519 returns an error if the result is the all-zero
+// value, which happens when point is of low order, as recommended by
+// RFC 7748, Section 6.1. The check runs in constant time.
+func X25519(scalar, point []byte) ([]byte, error) {
+	if l := len(scalar); l != ScalarSize {
+		return nil, fmt.Errorf("curve25519: bad scalar length: %d, expected %d", l, ScalarSize)
+	}
+	if l := len(point); l != PointSize {
+		return nil, fmt.Errorf("curve25519: bad point length: %d, expected %d", l, PointSize)
+	}
+	var in, base, dst, zero [32]byte
+	copy(in[:], scalar)
+	copy(base[:], point)
+	ScalarMult(&dst, &in, &base)
+	if subtle.ConstantTimeCompare(dst[:], zero[:]) == 1 {
+		return nil, errLowOrderPoint
+	}
+	return dst[:], nil
+}
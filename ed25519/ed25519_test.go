@@ -10,6 +10,7 @@ import (
 	"compress/gzip"
 	"crypto"
 	"crypto/rand"
+	"crypto/sha512"
 	"encoding/hex"
 	"os"
 	"strings"
@@ -89,6 +90,142 @@ func TestCryptoSigner(t *testing.T) {
 	}
 }
 
+func TestSignVerifyHashed(t *testing.T) {
+	// From RFC 8032, Section 7.3
+	key, _ := hex.DecodeString("833fe62409237b9d62ec77587520911e9a759cec1d19755b7da901b96dca3d42ec172b93ad5e563bf4932c70e1245034c35467ef2efd4d64ebf819683467e2bf")
+	expectedSig, _ := hex.DecodeString("98a70222f0b8121aa9d30f813d683f809e462b469c7ff87639499bb94e6dae4131f85042463c2a355a2003d062adf5aaa10b8c61e636062aaad11c2a26083406")
+	message, _ := hex.DecodeString("616263")
+
+	private := PrivateKey(key)
+	public := private.Public().(PublicKey)
+	hash := sha512.Sum512(message)
+	sig, err := private.Sign(nil, hash[:], crypto.SHA512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sig, expectedSig) {
+		t.Error("signature doesn't match test vector")
+	}
+	sig, err = private.Sign(nil, hash[:], &Options{Hash: crypto.SHA512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sig, expectedSig) {
+		t.Error("signature doesn't match test vector")
+	}
+	if err := VerifyWithOptions(public, hash[:], sig, &Options{Hash: crypto.SHA512}); err != nil {
+		t.Errorf("valid signature rejected: %v", err)
+	}
+
+	wrongHash := sha512.Sum512([]byte("wrong message"))
+	if VerifyWithOptions(public, wrongHash[:], sig, &Options{Hash: crypto.SHA512}) == nil {
+		t.Errorf("signature of different message accepted")
+	}
+	if VerifyWithOptions(public, hash[:], sig, &Options{}) == nil {
+		t.Errorf("Ed25519ph signature accepted as Ed25519")
+	}
+	if VerifyWithOptions(public, hash[:], sig, &Options{Hash: crypto.SHA256}) == nil {
+		t.Errorf("signature accepted with unsupported hash")
+	}
+	if _, err := private.Sign(nil, message, crypto.SHA512); err == nil {
+		t.Errorf("Ed25519ph accepted an unhashed message")
+	}
+
+	sig, err = private.Sign(nil, hash[:], &Options{Hash: crypto.SHA512, Context: "123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyWithOptions(public, hash[:], sig, &Options{Hash: crypto.SHA512, Context: "123"}); err != nil {
+		t.Errorf("valid signature rejected: %v", err)
+	}
+	if VerifyWithOptions(public, hash[:], sig, &Options{Hash: crypto.SHA512, Context: "321"}) == nil {
+		t.Errorf("signature with different context accepted")
+	}
+}
+
+func TestSignVerifyContext(t *testing.T) {
+	// From RFC 8032, Section 7.2
+	for _, tt := range []struct {
+		seed, public, message, context, sig string
+	}{
+		{
+			seed:    "0305334e381af78f141cb666f6199f57bc3495335a256a95bd2a55bf546663f6",
+			public:  "dfc9425e4f968f7f0c29f0259cf5f9aed6851c2bb4ad8bfb860cfee0ab248292",
+			message: "f726936d19c800494e3fdaff20b276a8",
+			context: "foo",
+			sig:     "55a4cc2f70a54e04288c5f4cd1e45a7bb520b36292911876cada7323198dd87a8b36950b95130022907a7fb7c4e9b2d5f6cca685a587b4b21f4b888e4e7edb0d",
+		},
+		{
+			seed:    "0305334e381af78f141cb666f6199f57bc3495335a256a95bd2a55bf546663f6",
+			public:  "dfc9425e4f968f7f0c29f0259cf5f9aed6851c2bb4ad8bfb860cfee0ab248292",
+			message: "f726936d19c800494e3fdaff20b276a8",
+			context: "bar",
+			sig:     "fc60d5872fc46b3aa69f8b5b4351d5808f92bcc044606db097abab6dbcb1aee3216c48e8b3b66431b5b186d1d28f8ee15a5ca2df6668346291c2043d4eb3e90d",
+		},
+		{
+			seed:    "0305334e381af78f141cb666f6199f57bc3495335a256a95bd2a55bf546663f6",
+			public:  "dfc9425e4f968f7f0c29f0259cf5f9aed6851c2bb4ad8bfb860cfee0ab248292",
+			message: "508e9e6882b979fea900f62adceaca35",
+			context: "foo",
+			sig:     "8b70c1cc8310e1de20ac53ce28ae6e7207f33c3295e03bb5c0732a1d20dc64908922a8b052cf99b7c4fe107a5abb5b2c4085ae75890d02df26269d8945f84b0b",
+		},
+		{
+			seed:    "ab9c2853ce297ddab85c993b3ae14bcad39b2c682beabc27d6d4eb20711d6560",
+			public:  "0f1d1274943b91415889152e893d80e93275a1fc0b65fd71b4b0dda10ad7d772",
+			message: "f726936d19c800494e3fdaff20b276a8",
+			context: "foo",
+			sig:     "21655b5f1aa965996b3f97b3c849eafba922a0a62992f73b3d1b73106a84ad85e9b86a7b6005ea868337ff2d20a7f5fbd4cd10b0be49a68da2b2e0dc0ad8960f",
+		},
+	} {
+		seed, _ := hex.DecodeString(tt.seed)
+		message, _ := hex.DecodeString(tt.message)
+		expectedSig, _ := hex.DecodeString(tt.sig)
+
+		private := NewKeyFromSeed(seed)
+		public := private.Public().(PublicKey)
+		if got := hex.EncodeToString(public); got != tt.public {
+			t.Errorf("public key = %s; want %s", got, tt.public)
+		}
+		sig, err := private.Sign(nil, message, &Options{Context: tt.context})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(sig, expectedSig) {
+			t.Errorf("context %q: signature doesn't match test vector", tt.context)
+		}
+		if err := VerifyWithOptions(public, message, sig, &Options{Context: tt.context}); err != nil {
+			t.Errorf("context %q: valid signature rejected: %v", tt.context, err)
+		}
+		if VerifyWithOptions(public, message, sig, &Options{Context: "baz"}) == nil {
+			t.Errorf("context %q: signature with different context accepted", tt.context)
+		}
+		if Verify(public, message, sig) {
+			t.Errorf("context %q: Ed25519ctx signature accepted as Ed25519", tt.context)
+		}
+	}
+}
+
+func TestContextTooLong(t *testing.T) {
+	_, private, _ := GenerateKey(zeroReader{})
+	public := private.Public().(PublicKey)
+	context := strings.Repeat("x", 256)
+	hash := sha512.Sum512([]byte("message"))
+
+	if _, err := private.Sign(nil, []byte("message"), &Options{Context: context}); err == nil {
+		t.Error("Ed25519ctx accepted a 256 byte context")
+	}
+	if _, err := private.Sign(nil, hash[:], &Options{Hash: crypto.SHA512, Context: context}); err == nil {
+		t.Error("Ed25519ph accepted a 256 byte context")
+	}
+	sig := Sign(private, []byte("message"))
+	if VerifyWithOptions(public, []byte("message"), sig, &Options{Context: context}) == nil {
+		t.Error("VerifyWithOptions accepted a 256 byte context")
+	}
+	if _, err := private.Sign(nil, []byte("message"), &Options{Context: context[:255]}); err != nil {
+		t.Errorf("Ed25519ctx rejected a 255 byte context: %v", err)
+	}
+}
+
 func TestGolden(t *testing.T) {
 	// sign.input.gz is a selection of test cases from
 	// https://ed25519.cr.yp.to/python/sign.input
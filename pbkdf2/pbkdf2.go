@@ -21,6 +21,8 @@ package pbkdf2 // import "github.com/robarchibald/crypto/pbkdf2"
 import (
 	"crypto/hmac"
 	"hash"
+	"math"
+	"time"
 )
 
 // Key derives a key from the password, salt and iteration count, returning a
@@ -75,3 +77,42 @@ func Key(password, salt []byte, iter, keyLen int, h func() hash.Hash) []byte {
 	}
 	return dk[:keyLen]
 }
+
+// maxCalibrationSample bounds the duration of the measurement made by Calibrate.
+const maxCalibrationSample = 100 * time.Millisecond
+
+// Calibrate returns the iteration count for which Key, called with hash
+// function h and key length keyLen, takes about target on the current machine.
+// Because hardware gets faster, the count should be calibrated periodically
+// rather than hard-coded, and stored along with each derived key.
+//
+// Calibrate measures Key with increasing iteration counts for up to about
+// twice the lesser of target and 100ms, and extrapolates from the last
+// measurement. It returns at least 1.
+func Calibrate(h func() hash.Hash, keyLen int, target time.Duration) (iterations int) {
+	if target <= 0 {
+		return 1
+	}
+	sample := target
+	if sample > maxCalibrationSample {
+		sample = maxCalibrationSample
+	}
+	password, salt := []byte("calibration password"), []byte("calibration salt")
+	iter := 1
+	for {
+		start := time.Now()
+		Key(password, salt, iter, keyLen, h)
+		elapsed := time.Since(start)
+		if elapsed >= sample/2 || iter >= math.MaxInt32/2 {
+			n := float64(iter) * float64(target) / float64(elapsed+1)
+			switch {
+			case n < 1:
+				return 1
+			case n > math.MaxInt32:
+				return math.MaxInt32
+			}
+			return int(n)
+		}
+		iter *= 2
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"crypto/sha256"
 	"hash"
 	"testing"
+	"time"
 )
 
 type testVector struct {
@@ -174,3 +175,30 @@ func BenchmarkHMACSHA1(b *testing.B) {
 func BenchmarkHMACSHA256(b *testing.B) {
 	benchmark(b, sha256.New)
 }
+
+func TestCalibrate(t *testing.T) {
+	const target = 50 * time.Millisecond
+	iter := Calibrate(sha256.New, 32, target)
+	start := time.Now()
+	Key([]byte("password"), []byte("salt"), iter, 32, sha256.New)
+	// Allow for noisy machines.
+	if d := time.Since(start); d < target/5 || d > target*5 {
+		t.Errorf("Key with %d iterations took %v; want about %v", iter, d, target)
+	}
+
+	if iter := Calibrate(sha256.New, 32, 0); iter != 1 {
+		t.Errorf("Calibrate(0) = %d; want 1", iter)
+	}
+}
+
+func TestCalibrateBounded(t *testing.T) {
+	start := time.Now()
+	short := Calibrate(sha1.New, 20, 10*time.Millisecond)
+	long := Calibrate(sha1.New, 20, time.Hour)
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Calibrate took %v", d)
+	}
+	if long <= short {
+		t.Errorf("Calibrate(1h) = %d; want more than Calibrate(10ms) = %d", long, short)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sha3
+
+// This file provides the KMAC message authentication codes, based on cSHAKE,
+// as specified in NIST SP 800-185, section 4 [1].
+//
+// [1] https://doi.org/10.6028/NIST.SP.800-185
+
+import (
+	"encoding/binary"
+	"hash"
+)
+
+// kmac implements hash.Hash for KMAC128 and KMAC256.
+// The cSHAKE state is not embedded so that its Read and Clone, which
+// skip the final right_encode of the output length, are not exposed.
+type kmac struct {
+	h         ShakeHash
+	outputLen int
+	// initBlock is bytepad(encode_string(K), rate). It is kept so that
+	// Reset can restore the keyed state.
+	initBlock []byte
+	rate      int
+}
+
+// NewKMAC128 returns a new KMAC128 hash.Hash computing a MAC of size bytes
+// with the given key and customization string S, which may be empty.
+// The security strength of KMAC128 is 128 bits if the key is at least
+// 16 bytes long.
+func NewKMAC128(key []byte, size int, S []byte) hash.Hash {
+	return newKMAC(key, size, S, rate128)
+}
+
+// NewKMAC256 returns a new KMAC256 hash.Hash computing a MAC of size bytes
+// with the given key and customization string S, which may be empty.
+// The security strength of KMAC256 is 256 bits if the key is at least
+// 32 bytes long.
+func NewKMAC256(key []byte, size int, S []byte) hash.Hash {
+	return newKMAC(key, size, S, rate256)
+}
+
+// KMAC128 returns the outLen byte KMAC128 of data with the given key and
+// customization string S.
+func KMAC128(key, data []byte, outLen int, S []byte) []byte {
+	h := NewKMAC128(key, outLen, S)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// KMAC256 returns the outLen byte KMAC256 of data with the given key and
+// customization string S.
+func KMAC256(key, data []byte, outLen int, S []byte) []byte {
+	h := NewKMAC256(key, outLen, S)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func newKMAC(key []byte, size int, S []byte, rate int) hash.Hash {
+	if size < 0 {
+		panic("sha3: negative KMAC output size")
+	}
+	k := &kmac{
+		h:         newCShake([]byte("KMAC"), S, rate, dsbyteCShake),
+		outputLen: size,
+		initBlock: bytepad(encodeString(key), rate),
+		rate:      rate,
+	}
+	k.h.Write(k.initBlock)
+	return k
+}
+
+// Write absorbs more data into the MAC. It never returns an error.
+func (k *kmac) Write(p []byte) (int, error) { return k.h.Write(p) }
+
+// Size returns the size of the MAC in bytes.
+func (k *kmac) Size() int { return k.outputLen }
+
+// BlockSize returns the rate of the underlying sponge.
+func (k *kmac) BlockSize() int { return k.rate }
+
+// Reset restores the keyed state, discarding any written data.
+func (k *kmac) Reset() {
+	k.h.Reset()
+	k.h.Write(k.initBlock)
+}
+
+// Sum appends the MAC of the data written so far to b.
+// It does not change the underlying state.
+func (k *kmac) Sum(b []byte) []byte {
+	d := k.h.Clone()
+	d.Write(rightEncode(uint64(k.outputLen) * 8))
+	out := make([]byte, k.outputLen)
+	d.Read(out)
+	return append(b, out...)
+}
+
+// encodeString implements encode_string of NIST SP 800-185, section 2.3.2.
+func encodeString(s []byte) []byte {
+	b := leftEncode(uint64(len(s)) * 8)
+	return append(b, s...)
+}
+
+// rightEncode implements right_encode of NIST SP 800-185, section 2.3.1.
+func rightEncode(value uint64) []byte {
+	var b [9]byte
+	binary.BigEndian.PutUint64(b[:8], value)
+	// Trim all but last leading zero bytes
+	i := byte(0)
+	for i < 7 && b[i] == 0 {
+		i++
+	}
+	// Append number of encoded bytes
+	b[8] = 8 - i
+	return b[i:]
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sha3
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// sequence returns n bytes counting up from start,
+// as used in the NIST SP 800-185 samples.
+func sequence(start byte, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = start + byte(i)
+	}
+	return b
+}
+
+// KMAC samples from
+// https://csrc.nist.gov/CSRC/media/Projects/Cryptographic-Standards-and-Guidelines/documents/examples/KMAC_samples.pdf
+var kmacTests = []struct {
+	name   string
+	kmac   func(key, data []byte, outLen int, S []byte) []byte
+	data   []byte
+	S      string
+	outLen int
+	want   string
+}{
+	{"KMAC128 #1", KMAC128, sequence(0, 4), "", 32,
+		"E5780B0D3EA6F7D3A429C5706AA43A00FADBD7D49628839E3187243F456EE14E"},
+	{"KMAC128 #2", KMAC128, sequence(0, 4), "My Tagged Application", 32,
+		"3B1FBA963CD8B0B59E8C1A6D71888B7143651AF8BA0A7070C0979E2811324AA5"},
+	{"KMAC128 #3", KMAC128, sequence(0, 200), "My Tagged Application", 32,
+		"1F5B4E6CCA02209E0DCB5CA635B89A15E271ECC760071DFD805FAA38F9729230"},
+	{"KMAC256 #4", KMAC256, sequence(0, 4), "My Tagged Application", 64,
+		"20C570C31346F703C9AC36C61C03CB64C3970D0CFC787E9B79599D273A68D2F7F69D4CC3DE9D104A351689F27CF6F5951F0103F33F4F24871024D9C27773A8DD"},
+	{"KMAC256 #5", KMAC256, sequence(0, 200), "", 64,
+		"75358CF39E41494E949707927CEE0AF20A3FF553904C86B08F21CC414BCFD691589D27CF5E15369CBBFF8B9A4C2EB17800855D0235FF635DA82533EC6B759B69"},
+	{"KMAC256 #6", KMAC256, sequence(0, 200), "My Tagged Application", 64,
+		"B58618F71F92E1D56C1B8C55DDD7CD188B97B4CA4D99831EB2699A837DA2E4D970FBACFDE50033AEA585F1A2708510C32D07880801BD182898FE476876FC8965"},
+}
+
+func TestKMAC(t *testing.T) {
+	key := sequence(0x40, 32)
+	for _, tt := range kmacTests {
+		want := decodeHex(tt.want)
+		if got := tt.kmac(key, tt.data, tt.outLen, []byte(tt.S)); !bytes.Equal(got, want) {
+			t.Errorf("%s: got %X; want %X", tt.name, got, want)
+		}
+	}
+}
+
+func TestKMACHash(t *testing.T) {
+	key := sequence(0x40, 32)
+	tt := kmacTests[2]
+	h := NewKMAC128(key, tt.outLen, []byte(tt.S))
+	if h.Size() != tt.outLen {
+		t.Errorf("Size = %d; want %d", h.Size(), tt.outLen)
+	}
+	want := decodeHex(tt.want)
+
+	// Write in pieces; Sum must not change the state.
+	h.Write(tt.data[:100])
+	h.Sum(nil)
+	h.Write(tt.data[100:])
+	if got := h.Sum(nil); !bytes.Equal(got, want) {
+		t.Errorf("got %X; want %X", got, want)
+	}
+
+	h.Reset()
+	h.Write(tt.data)
+	if got := h.Sum([]byte{0xff}); !bytes.Equal(got[1:], want) || got[0] != 0xff {
+		t.Errorf("after Reset: got %X; want ff%X", got, want)
+	}
+
+	// The output is only available through Sum.
+	if _, ok := h.(io.Reader); ok {
+		t.Error("KMAC hash.Hash is an io.Reader")
+	}
+	if _, ok := h.(ShakeHash); ok {
+		t.Error("KMAC hash.Hash is a ShakeHash")
+	}
+}
+
+func TestRightEncode(t *testing.T) {
+	for _, tt := range []struct {
+		in   uint64
+		want []byte
+	}{
+		{0, []byte{0, 1}},
+		{255, []byte{255, 1}},
+		{256, []byte{1, 0, 2}},
+		{1<<64 - 1, []byte{255, 255, 255, 255, 255, 255, 255, 255, 8}},
+	} {
+		if got := rightEncode(tt.in); !bytes.Equal(got, tt.want) {
+			t.Errorf("rightEncode(%d) = %v; want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -64,14 +64,20 @@ func (d *state) Reset() {
 }
 
 func (d *state) clone() *state {
-	ret := *d
+	ret := new(state)
+	d.cloneInto(ret)
+	return ret
+}
+
+// cloneInto copies d into ret, making the buffer of ret point into
+// its own storage.
+func (d *state) cloneInto(ret *state) {
+	*ret = *d
 	if ret.state == spongeAbsorbing {
 		ret.buf = ret.storage[:len(ret.buf)]
 	} else {
 		ret.buf = ret.storage[d.rate-cap(d.buf) : d.rate]
 	}
-
-	return &ret
 }
 
 // permute applies the KeccakF-1600 permutation. It handles
@@ -358,6 +358,57 @@ func TestClone(t *testing.T) {
 	}
 }
 
+// TestCloneShortWrite checks that clones don't share their buffer
+// when the data written after cloning doesn't fill a block.
+func TestCloneShortWrite(t *testing.T) {
+	out1 := make([]byte, 16)
+	out2 := make([]byte, 16)
+	for name, v := range testShakes {
+		h1 := v.constructor([]byte(v.defAlgoName), []byte(v.defCustomStr))
+		h1.Write([]byte{0x01})
+
+		h2 := h1.Clone()
+		h2.Write([]byte{0x02})
+		h2.Read(out2)
+
+		h1.Write([]byte{0x02})
+		h1.Read(out1)
+
+		if !bytes.Equal(out1, out2) {
+			t.Errorf("%s: got %x; want %x", name, out2, out1)
+		}
+	}
+}
+
+// cSHAKE samples from
+// https://csrc.nist.gov/CSRC/media/Projects/Cryptographic-Standards-and-Guidelines/documents/examples/cSHAKE_samples.pdf
+func TestCShakeSamples(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		cshake func(N, S []byte) ShakeHash
+		input  []byte
+		want   string
+	}{
+		{"cSHAKE128 #1", NewCShake128, sequentialBytes(4),
+			"c1c36925b6409a04f1b504fcbca9d82b4017277cb5ed2b2065fc1d3814d5aaf5"},
+		{"cSHAKE128 #2", NewCShake128, sequentialBytes(200),
+			"c5221d50e4f822d96a2e8881a961420f294b7b24fe3d2094baed2c6524cc166b"},
+		{"cSHAKE256 #3", NewCShake256, sequentialBytes(4),
+			"d008828e2b80ac9d2218ffee1d070c48b8e4c87bff32c9699d5b6896eee0edd164020e2be0560858d9c00c037e34a96937c561a74c412bb4c746469527281c8c"},
+		{"cSHAKE256 #4", NewCShake256, sequentialBytes(200),
+			"07dc27b11e51fbac75bc7b3c1d983e8b4b85fb1defaf218912ac86430273091727f42b17ed1df63e8ec118f04b23633c1dfb1574c8fb55cb45da8e25afb092bb"},
+	} {
+		c := tt.cshake(nil, []byte("Email Signature"))
+		c.Write(tt.input)
+		want := decodeHex(tt.want)
+		got := make([]byte, len(want))
+		c.Read(got)
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got %x; want %x", tt.name, got, want)
+		}
+	}
+}
+
 // BenchmarkPermutationFunction measures the speed of the permutation function
 // with no input data.
 func BenchmarkPermutationFunction(b *testing.B) {
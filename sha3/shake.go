@@ -104,7 +104,9 @@ func (c *cshakeState) Reset() {
 func (c *cshakeState) Clone() ShakeHash {
 	b := make([]byte, len(c.initBlock))
 	copy(b, c.initBlock)
-	return &cshakeState{state: *c.clone(), initBlock: b}
+	ret := &cshakeState{initBlock: b}
+	c.state.cloneInto(&ret.state)
+	return ret
 }
 
 // Clone returns copy of SHAKE context within its current state.
@@ -13,6 +13,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"sync"
 	"testing"
@@ -532,3 +533,72 @@ func TestAgentExtensions(t *testing.T) {
 		t.Fatal("should have gotten agent extension failure")
 	}
 }
+
+func TestExtensionAgent(t *testing.T) {
+	echo := func(contents []byte) ([]byte, error) {
+		return append([]byte{agentSuccess}, contents...), nil
+	}
+	fail := func(contents []byte) ([]byte, error) {
+		return nil, errors.New("failed")
+	}
+	agent, cleanup := startAgent(t, NewExtensionAgent(&keyringExtended{NewKeyring().(*keyring)}, map[string]ExtensionHandler{
+		"echo@example.com": echo,
+		"fail@example.com": fail,
+	}))
+	defer cleanup()
+
+	names, err := QueryExtensions(agent)
+	if err != nil {
+		t.Fatalf("QueryExtensions: %v", err)
+	}
+	if want := []string{"echo@example.com", "fail@example.com", "query"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("QueryExtensions = %q; want %q", names, want)
+	}
+
+	result, err := agent.Extension("echo@example.com", []byte{0x00, 0x01, 0x02})
+	if err != nil {
+		t.Fatalf("echo extension: %v", err)
+	}
+	if !bytes.Equal(result, []byte{agentSuccess, 0x00, 0x01, 0x02}) {
+		t.Errorf("echo extension result = %v", result)
+	}
+	if _, err := agent.Extension("fail@example.com", nil); err == nil || err == ErrExtensionUnsupported {
+		t.Errorf("failing extension: err = %v; want extension failure", err)
+	}
+	// Extensions of the wrapped agent are still served.
+	result, err = agent.Extension("my-extension@example.com", []byte{0x03})
+	if err != nil {
+		t.Fatalf("wrapped agent extension: %v", err)
+	}
+	if !bytes.Equal(result, []byte{agentSuccess, 0x03}) {
+		t.Errorf("wrapped agent extension result = %v", result)
+	}
+
+	// As are its other requests.
+	testAgentInterface(t, agent, testPrivateKeys["ecdsa"], nil, 0)
+
+	// The other extensions are unsupported by a wrapped agent which
+	// does not implement ExtendedAgent.
+	agent, cleanup = startAgent(t, NewExtensionAgent(NewKeyring(), map[string]ExtensionHandler{
+		"echo@example.com": echo,
+	}))
+	defer cleanup()
+	if _, err := agent.Extension("unknown@example.com", nil); err != ErrExtensionUnsupported {
+		t.Errorf("unknown extension: err = %v; want ErrExtensionUnsupported", err)
+	}
+	names, err = QueryExtensions(agent)
+	if err != nil {
+		t.Fatalf("QueryExtensions: %v", err)
+	}
+	if want := []string{"echo@example.com", "query"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("QueryExtensions = %q; want %q", names, want)
+	}
+}
+
+func TestQueryExtensionsUnsupported(t *testing.T) {
+	agent, cleanup := startAgent(t, NewKeyring())
+	defer cleanup()
+	if _, err := QueryExtensions(agent); err != ErrExtensionUnsupported {
+		t.Errorf("QueryExtensions: err = %v; want ErrExtensionUnsupported", err)
+	}
+}
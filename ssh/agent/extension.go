@@ -0,0 +1,136 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package agent
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/robarchibald/crypto/ssh"
+)
+
+// See [PROTOCOL.agent], section 4.7.
+const agentExtensionResponse = 29
+
+// ExtensionQuery is the extension type of the "query" extension, which
+// lists the extension types an agent supports. See QueryExtensions.
+const ExtensionQuery = "query"
+
+// queryResponse is the response to a "query" extension request.
+type queryResponse struct {
+	ExtensionType string `sshtype:"29"`
+	Rest          []byte `ssh:"rest"`
+}
+
+// An ExtensionHandler processes the contents of an extension request and
+// returns the complete response, including its message type byte, as
+// ExtendedAgent.Extension does. It may return ErrExtensionUnsupported, or
+// any other error to send a SSH_AGENT_EXTENSION_FAILURE message.
+type ExtensionHandler func(contents []byte) ([]byte, error)
+
+// extensionAgent serves the extensions of handlers in front of an Agent.
+type extensionAgent struct {
+	Agent
+	handlers map[string]ExtensionHandler
+}
+
+// NewExtensionAgent returns an ExtendedAgent which handles the extension
+// requests of the types in handlers, for instance "session-bind@openssh.com",
+// and passes everything else to agent, including the extension requests of
+// other types if agent is an ExtendedAgent. It also answers "query" extension
+// requests with the types of handlers and those advertised by agent.
+//
+// The result can be served with ServeAgent.
+func NewExtensionAgent(agent Agent, handlers map[string]ExtensionHandler) ExtendedAgent {
+	return &extensionAgent{Agent: agent, handlers: handlers}
+}
+
+func (a *extensionAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags SignatureFlags) (*ssh.Signature, error) {
+	if extendedAgent, ok := a.Agent.(ExtendedAgent); ok {
+		return extendedAgent.SignWithFlags(key, data, flags)
+	}
+	// As ServeAgent does for agents not implementing ExtendedAgent.
+	return a.Agent.Sign(key, data)
+}
+
+func (a *extensionAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	if h, ok := a.handlers[extensionType]; ok {
+		return h(contents)
+	}
+	extendedAgent, ok := a.Agent.(ExtendedAgent)
+	if extensionType != ExtensionQuery {
+		if !ok {
+			return nil, ErrExtensionUnsupported
+		}
+		return extendedAgent.Extension(extensionType, contents)
+	}
+
+	types := map[string]bool{ExtensionQuery: true}
+	for t := range a.handlers {
+		types[t] = true
+	}
+	if ok {
+		// The wrapped agent may support other extensions.
+		if res, err := extendedAgent.Extension(ExtensionQuery, nil); err == nil {
+			if names, err := parseQueryResponse(res); err == nil {
+				for _, t := range names {
+					types[t] = true
+				}
+			}
+		}
+	}
+	names := make([]string, 0, len(types))
+	for t := range types {
+		names = append(names, t)
+	}
+	sort.Strings(names)
+	return marshalQueryResponse(names), nil
+}
+
+// marshalQueryResponse returns the response to a "query" extension
+// request advertising the extension types names.
+func marshalQueryResponse(names []string) []byte {
+	var rest []byte
+	for _, n := range names {
+		rest = append(rest, ssh.Marshal(struct{ Name string }{n})...)
+	}
+	return ssh.Marshal(queryResponse{ExtensionType: ExtensionQuery, Rest: rest})
+}
+
+// parseQueryResponse returns the extension types advertised
+// in the response to a "query" extension request.
+func parseQueryResponse(res []byte) ([]string, error) {
+	var msg queryResponse
+	if err := ssh.Unmarshal(res, &msg); err != nil {
+		return nil, err
+	}
+	if msg.ExtensionType != ExtensionQuery {
+		return nil, errors.New("agent: invalid query extension response")
+	}
+	var names []string
+	for rest := msg.Rest; len(rest) > 0; {
+		var name struct {
+			Name string
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(rest, &name); err != nil {
+			return nil, err
+		}
+		names = append(names, name.Name)
+		rest = name.Rest
+	}
+	return names, nil
+}
+
+// QueryExtensions returns the extension types supported by agent, using the
+// "query" extension. It returns ErrExtensionUnsupported if agent does not
+// support it.
+func QueryExtensions(agent ExtendedAgent) ([]string, error) {
+	res, err := agent.Extension(ExtensionQuery, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseQueryResponse(res)
+}
@@ -0,0 +1,264 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AuthorizedKey is an entry of an authorized_keys file.
+type AuthorizedKey struct {
+	PublicKey PublicKey
+	Options   AuthorizedKeyOptions
+	Comment   string
+}
+
+// AuthorizedKeyOptions holds the options of an authorized_keys entry,
+// as documented in the "AUTHORIZED_KEYS FILE FORMAT" section of the
+// sshd(8) manual page. The values are unquoted. The options which may
+// be repeated, such as environment, are listed in their order in the file.
+type AuthorizedKeyOptions struct {
+	// Command is the value of the command option: the command to
+	// run instead of the one requested by the client, if not empty.
+	Command string
+
+	// Environment lists the values of the environment options,
+	// in the form "NAME=value".
+	Environment []string
+
+	// From lists the patterns of the from option, separated by commas
+	// in the file, matching the hosts the key may be used from.
+	From []string
+
+	// PermitOpen and PermitListen list the values of the permitopen and
+	// permitlisten options, in the form "host:port".
+	PermitOpen   []string
+	PermitListen []string
+
+	// Principals lists the names of the principals option,
+	// separated by commas in the file.
+	Principals []string
+
+	// Tunnel is the value of the tunnel option: the tun device to use.
+	Tunnel string
+
+	// ExpiryTime is the value of the expiry-time option, if not zero.
+	// Times without a zone in the file are in the local time zone.
+	ExpiryTime time.Time
+
+	CertAuthority bool
+
+	// The permissions removed by the no-* options. The restrict option
+	// removes all of them, and the options without the "no-" prefix,
+	// such as pty, grant them again.
+	NoAgentForwarding bool
+	NoPortForwarding  bool
+	NoPTY             bool
+	NoUserRC          bool
+	NoX11Forwarding   bool
+
+	NoTouchRequired bool
+	VerifyRequired  bool
+}
+
+// ParseAuthorizedKeys parses the entries of an authorized_keys file used
+// in OpenSSH according to the sshd(8) manual page, skipping blank lines and
+// comments. Unlike ParseAuthorizedKey, it fails on the first malformed
+// line, including lines with an unknown option, which sshd skips.
+func ParseAuthorizedKeys(in []byte) ([]AuthorizedKey, error) {
+	var keys []AuthorizedKey
+	for n := 1; len(in) > 0; n++ {
+		line := in
+		if i := bytes.IndexByte(in, '\n'); i != -1 {
+			line, in = in[:i], in[i+1:]
+		} else {
+			in = nil
+		}
+		line = bytes.TrimSpace(bytes.TrimSuffix(line, []byte("\r")))
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, err := parseAuthorizedKeyLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("ssh: line %d of authorized keys: %v", n, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func parseAuthorizedKeyLine(line []byte) (AuthorizedKey, error) {
+	var key AuthorizedKey
+	var err error
+	i := bytes.IndexAny(line, " \t")
+	if i == -1 {
+		return key, errors.New("missing key")
+	}
+	// A key type contains a hyphen, which is not valid base64, so that
+	// the options are tried only if the line does not start with a key.
+	key.PublicKey, key.Comment, err = parseAuthorizedKey(line[i:])
+	if err == nil {
+		return key, nil
+	}
+	keyErr := err
+
+	options, rest, err := splitAuthorizedKeyOptions(line)
+	if err != nil {
+		return key, err
+	}
+	i = bytes.IndexAny(rest, " \t")
+	if i == -1 {
+		// Not options either.
+		return key, keyErr
+	}
+	if key.PublicKey, key.Comment, err = parseAuthorizedKey(rest[i:]); err != nil {
+		return key, err
+	}
+	for _, opt := range options {
+		if err := key.Options.set(opt); err != nil {
+			return key, err
+		}
+	}
+	return key, nil
+}
+
+// splitAuthorizedKeyOptions splits the comma separated options at the start
+// of line from the rest of it. The commas and blanks in the double-quoted
+// values, in which \" stands for a double quote, do not separate options.
+func splitAuthorizedKeyOptions(line []byte) (options []string, rest []byte, err error) {
+	start := 0
+	inQuote := false
+	for i := 0; i < len(line); i++ {
+		b := line[i]
+		switch {
+		case inQuote && b == '\\' && i+1 < len(line) && line[i+1] == '"':
+			i++
+		case b == '"':
+			inQuote = !inQuote
+		case !inQuote && (b == ',' || b == ' ' || b == '\t'):
+			if i == start {
+				return nil, nil, fmt.Errorf("empty option at %q", line[start:])
+			}
+			options = append(options, string(line[start:i]))
+			start = i + 1
+			if b != ',' {
+				return options, bytes.TrimLeft(line[i:], " \t"), nil
+			}
+		}
+	}
+	if inQuote {
+		return nil, nil, fmt.Errorf("missing closing quote in %q", line[start:])
+	}
+	return nil, nil, errors.New("missing key")
+}
+
+// set applies the option opt, in the form name or name="value".
+func (o *AuthorizedKeyOptions) set(opt string) error {
+	name, value, hasValue := strings.Cut(opt, "=")
+	if hasValue {
+		if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+			return fmt.Errorf("unquoted value of option %q", name)
+		}
+		value = strings.ReplaceAll(value[1:len(value)-1], `\"`, `"`)
+	}
+
+	// Option names are case-insensitive in sshd.
+	name = strings.ToLower(name)
+	flags := map[string]func(){
+		"agent-forwarding":    func() { o.NoAgentForwarding = false },
+		"cert-authority":      func() { o.CertAuthority = true },
+		"no-agent-forwarding": func() { o.NoAgentForwarding = true },
+		"no-port-forwarding":  func() { o.NoPortForwarding = true },
+		"no-pty":              func() { o.NoPTY = true },
+		"no-touch-required":   func() { o.NoTouchRequired = true },
+		"no-user-rc":          func() { o.NoUserRC = true },
+		"no-x11-forwarding":   func() { o.NoX11Forwarding = true },
+		"port-forwarding":     func() { o.NoPortForwarding = false },
+		"pty":                 func() { o.NoPTY = false },
+		"user-rc":             func() { o.NoUserRC = false },
+		"verify-required":     func() { o.VerifyRequired = true },
+		"x11-forwarding":      func() { o.NoX11Forwarding = false },
+		"restrict": func() {
+			o.NoAgentForwarding = true
+			o.NoPortForwarding = true
+			o.NoPTY = true
+			o.NoUserRC = true
+			o.NoX11Forwarding = true
+		},
+	}
+	if f, ok := flags[name]; ok {
+		if hasValue {
+			return fmt.Errorf("option %q takes no value", name)
+		}
+		f()
+		return nil
+	}
+
+	if !hasValue {
+		if isAuthorizedKeyValueOption(name) {
+			return fmt.Errorf("missing value of option %q", name)
+		}
+		return fmt.Errorf("unknown option %q", name)
+	}
+	switch name {
+	case "command":
+		o.Command = value
+	case "environment":
+		if i := strings.IndexByte(value, '='); i <= 0 {
+			return fmt.Errorf("invalid environment %q", value)
+		}
+		o.Environment = append(o.Environment, value)
+	case "from":
+		o.From = strings.Split(value, ",")
+	case "permitopen":
+		o.PermitOpen = append(o.PermitOpen, value)
+	case "permitlisten":
+		o.PermitListen = append(o.PermitListen, value)
+	case "principals":
+		o.Principals = strings.Split(value, ",")
+	case "tunnel":
+		o.Tunnel = value
+	case "expiry-time":
+		t, err := parseExpiryTime(value)
+		if err != nil {
+			return err
+		}
+		o.ExpiryTime = t
+	default:
+		return fmt.Errorf("unknown option %q", name)
+	}
+	return nil
+}
+
+func isAuthorizedKeyValueOption(name string) bool {
+	switch name {
+	case "command", "environment", "from", "permitopen", "permitlisten", "principals", "tunnel", "expiry-time":
+		return true
+	}
+	return false
+}
+
+// parseExpiryTime parses the value of the expiry-time option,
+// YYYYMMDD[HHMM[SS]], optionally followed by Z for UTC.
+func parseExpiryTime(s string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(s, "Z") {
+		s, loc = s[:len(s)-1], time.UTC
+	}
+	layouts := map[int]string{8: "20060102", 12: "200601021504", 14: "20060102150405"}
+	layout, ok := layouts[len(s)]
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid expiry-time %q", s)
+	}
+	t, err := time.ParseInLocation(layout, s, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiry-time %q", s)
+	}
+	return t, nil
+}
@@ -6,6 +6,7 @@ package ssh
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -23,6 +24,12 @@ const (
 	CertAlgoECDSA384v01 = "ecdsa-sha2-nistp384-cert-v01@openssh.com"
 	CertAlgoECDSA521v01 = "ecdsa-sha2-nistp521-cert-v01@openssh.com"
 	CertAlgoED25519v01  = "ssh-ed25519-cert-v01@openssh.com"
+
+	// CertAlgoRSASHA256v01 and CertAlgoRSASHA512v01 are the names of the
+	// public key algorithms of RSA certificates signing with SHA-256 and
+	// SHA-512, RFC 8332, rather than SHA-1. They are not certificate types.
+	CertAlgoRSASHA256v01 = "rsa-sha2-256-cert-v01@openssh.com"
+	CertAlgoRSASHA512v01 = "rsa-sha2-512-cert-v01@openssh.com"
 )
 
 // Certificate types distinguish between host and user
@@ -243,6 +250,48 @@ func NewCertSigner(cert *Certificate, signer Signer) (Signer, error) {
 	}
 }
 
+// NewCertSignerFromFiles returns a Signer that signs with the PEM encoded
+// private key keyPEM and presents the certificate certPub, in the OpenSSH
+// authorized_keys format. They are typically the contents of a pair of
+// files such as "id_ed25519" and "id_ed25519-cert.pub". It returns an error
+// if certPub is not a certificate for the private key.
+func NewCertSignerFromFiles(keyPEM, certPub []byte) (Signer, error) {
+	signer, err := ParsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return newCertSignerFromAuthorizedKey(certPub, signer)
+}
+
+// NewCertSignerFromFilesWithPassphrase is like NewCertSignerFromFiles, for
+// a private key encrypted with passphrase.
+func NewCertSignerFromFilesWithPassphrase(keyPEM, certPub, passphrase []byte) (Signer, error) {
+	signer, err := ParsePrivateKeyWithPassphrase(keyPEM, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return newCertSignerFromAuthorizedKey(certPub, signer)
+}
+
+// newCertSignerFromAuthorizedKey parses the certificate certPub, in the
+// OpenSSH authorized_keys format, and returns a Signer presenting it on
+// behalf of signer.
+func newCertSignerFromAuthorizedKey(certPub []byte, signer Signer) (Signer, error) {
+	pub, _, _, _, err := ParseAuthorizedKey(certPub)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pub.(*Certificate)
+	if !ok {
+		return nil, fmt.Errorf("ssh: got a %s public key, not a certificate", pub.Type())
+	}
+	if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+		return nil, fmt.Errorf("ssh: certificate is for the key %s, not for the private key %s",
+			FingerprintSHA256(cert.Key), FingerprintSHA256(signer.PublicKey()))
+	}
+	return NewCertSigner(cert, signer)
+}
+
 func (s *openSSHCertSigner) Sign(rand io.Reader, data []byte) (*Signature, error) {
 	return s.signer.Sign(rand, data)
 }
@@ -255,7 +304,10 @@ func (s *algorithmOpenSSHCertSigner) SignWithAlgorithm(rand io.Reader, data []by
 	return s.algorithmSigner.SignWithAlgorithm(rand, data, algorithm)
 }
 
-const sourceAddressCriticalOption = "source-address"
+const (
+	sourceAddressCriticalOption = "source-address"
+	forceCommandCriticalOption  = "force-command"
+)
 
 // CertChecker does the work of verifying a certificate. Its methods
 // can be plugged into ClientConfig.HostKeyCallback and
@@ -264,7 +316,10 @@ const sourceAddressCriticalOption = "source-address"
 type CertChecker struct {
 	// SupportedCriticalOptions lists the CriticalOptions that the
 	// server application layer understands. These are only used
-	// for user certificates.
+	// for user certificates. "force-command" must be listed for
+	// certificates carrying it to be accepted; the server then
+	// enforces it if the Permissions returned by its
+	// PublicKeyCallback carry it, as those of Authenticate do.
 	SupportedCriticalOptions []string
 
 	// IsUserAuthority should return true if the key is recognized as an
@@ -428,6 +483,128 @@ func (c *Certificate) SignCert(rand io.Reader, authority Signer) error {
 	return nil
 }
 
+// CertificateParams holds the parameters of a certificate created by
+// NewUserCertificate or NewHostCertificate.
+type CertificateParams struct {
+	// Key is the public key being certified. It must not be nil.
+	Key PublicKey
+
+	// Serial is the certificate serial number. If zero, a random serial
+	// is generated.
+	Serial uint64
+
+	// KeyId is a free-form identifier, typically logged by servers
+	// when the certificate is used.
+	KeyId string
+
+	// Principals are the user names or host names the certificate is
+	// valid for. They must be specified for user certificates. An empty
+	// list in a host certificate makes it valid for any host.
+	Principals []string
+
+	// ValidAfter and ValidBefore define the validity window of the
+	// certificate. A zero ValidAfter makes the certificate valid from the
+	// beginning of time and a zero ValidBefore makes it never expire.
+	ValidAfter  time.Time
+	ValidBefore time.Time
+
+	// CriticalOptions and Extensions are copied into the certificate's
+	// Permissions. If Extensions is nil, user certificates get the
+	// same default extensions as the ones added by ssh-keygen.
+	CriticalOptions map[string]string
+	Extensions      map[string]string
+}
+
+// defaultUserCertExtensions are the extensions ssh-keygen adds to
+// user certificates by default.
+var defaultUserCertExtensions = []string{
+	"permit-X11-forwarding",
+	"permit-agent-forwarding",
+	"permit-port-forwarding",
+	"permit-pty",
+	"permit-user-rc",
+}
+
+// NewUserCertificate creates a user certificate from params and signs it
+// using authority. Entropy for the nonce and, if needed, the serial
+// is read from rand.
+func NewUserCertificate(rand io.Reader, authority Signer, params CertificateParams) (*Certificate, error) {
+	if len(params.Principals) == 0 {
+		return nil, errors.New("ssh: user certificate requires at least one principal")
+	}
+	if params.Extensions == nil {
+		params.Extensions = make(map[string]string, len(defaultUserCertExtensions))
+		for _, ext := range defaultUserCertExtensions {
+			params.Extensions[ext] = ""
+		}
+	}
+	return newCertificate(rand, authority, UserCert, params)
+}
+
+// NewHostCertificate creates a host certificate from params and signs it
+// using authority. Entropy for the nonce and, if needed, the serial
+// is read from rand.
+func NewHostCertificate(rand io.Reader, authority Signer, params CertificateParams) (*Certificate, error) {
+	return newCertificate(rand, authority, HostCert, params)
+}
+
+func newCertificate(rand io.Reader, authority Signer, certType uint32, params CertificateParams) (*Certificate, error) {
+	if params.Key == nil {
+		return nil, errors.New("ssh: certificate requires a public key")
+	}
+	if _, ok := params.Key.(*Certificate); ok {
+		return nil, errors.New("ssh: cannot certify a certificate")
+	}
+	if _, ok := certAlgoNames[params.Key.Type()]; !ok {
+		return nil, fmt.Errorf("ssh: unsupported key type %q for certificate", params.Key.Type())
+	}
+
+	validAfter := uint64(0)
+	if !params.ValidAfter.IsZero() {
+		if params.ValidAfter.Unix() < 0 {
+			return nil, errors.New("ssh: certificate ValidAfter predates the Unix epoch")
+		}
+		validAfter = uint64(params.ValidAfter.Unix())
+	}
+	validBefore := uint64(CertTimeInfinity)
+	if !params.ValidBefore.IsZero() {
+		if params.ValidBefore.Unix() < 0 {
+			return nil, errors.New("ssh: certificate ValidBefore predates the Unix epoch")
+		}
+		validBefore = uint64(params.ValidBefore.Unix())
+	}
+	if validAfter > validBefore {
+		return nil, errors.New("ssh: certificate ValidAfter is after ValidBefore")
+	}
+
+	serial := params.Serial
+	if serial == 0 {
+		var b [8]byte
+		if _, err := io.ReadFull(rand, b[:]); err != nil {
+			return nil, err
+		}
+		serial = binary.BigEndian.Uint64(b[:])
+	}
+
+	cert := &Certificate{
+		Key:             params.Key,
+		Serial:          serial,
+		CertType:        certType,
+		KeyId:           params.KeyId,
+		ValidPrincipals: params.Principals,
+		ValidAfter:      validAfter,
+		ValidBefore:     validBefore,
+		Permissions: Permissions{
+			CriticalOptions: params.CriticalOptions,
+			Extensions:      params.Extensions,
+		},
+	}
+	if err := cert.SignCert(rand, authority); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
 var certAlgoNames = map[string]string{
 	KeyAlgoRSA:      CertAlgoRSAv01,
 	KeyAlgoDSA:      CertAlgoDSAv01,
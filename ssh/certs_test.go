@@ -11,6 +11,7 @@ import (
 	"crypto/rand"
 	"net"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -333,3 +334,148 @@ func TestCertTypes(t *testing.T) {
 		})
 	}
 }
+
+func TestNewHostCertificate(t *testing.T) {
+	validAfter := time.Unix(1500000000, 0)
+	validBefore := validAfter.Add(24 * time.Hour)
+	cert, err := NewHostCertificate(rand.Reader, testSigners["ecdsa"], CertificateParams{
+		Key:         testPublicKeys["ed25519"],
+		KeyId:       "host-1",
+		Principals:  []string{"host.example.com"},
+		ValidAfter:  validAfter,
+		ValidBefore: validBefore,
+	})
+	if err != nil {
+		t.Fatalf("NewHostCertificate: %v", err)
+	}
+	if cert.Serial == 0 {
+		t.Error("no serial was generated")
+	}
+
+	checker := &CertChecker{
+		IsHostAuthority: func(auth PublicKey, addr string) bool {
+			return bytes.Equal(auth.Marshal(), testPublicKeys["ecdsa"].Marshal())
+		},
+		Clock: func() time.Time { return validAfter.Add(time.Hour) },
+	}
+	if err := checker.CheckHostKey("host.example.com:22", nil, cert); err != nil {
+		t.Errorf("CheckHostKey: %v", err)
+	}
+
+	pub, err := ParsePublicKey(cert.Marshal())
+	if err != nil {
+		t.Fatalf("ParsePublicKey: %v", err)
+	}
+	parsed, ok := pub.(*Certificate)
+	if !ok {
+		t.Fatalf("got %T, want *Certificate", pub)
+	}
+	if !reflect.DeepEqual(parsed.Marshal(), cert.Marshal()) {
+		t.Error("certificate does not round-trip through marshaling")
+	}
+	if parsed.CertType != HostCert || parsed.KeyId != "host-1" ||
+		parsed.ValidAfter != uint64(validAfter.Unix()) || parsed.ValidBefore != uint64(validBefore.Unix()) ||
+		!reflect.DeepEqual(parsed.ValidPrincipals, []string{"host.example.com"}) {
+		t.Errorf("unexpected certificate fields: %+v", parsed)
+	}
+}
+
+func TestNewUserCertificate(t *testing.T) {
+	cert, err := NewUserCertificate(rand.Reader, testSigners["ecdsa"], CertificateParams{
+		Key:        testPublicKeys["rsa"],
+		Serial:     42,
+		Principals: []string{"user"},
+	})
+	if err != nil {
+		t.Fatalf("NewUserCertificate: %v", err)
+	}
+	if cert.Serial != 42 || cert.CertType != UserCert {
+		t.Errorf("got serial %d, type %d", cert.Serial, cert.CertType)
+	}
+	if cert.ValidAfter != 0 || cert.ValidBefore != CertTimeInfinity {
+		t.Errorf("got validity [%d, %d); want [0, infinity)", cert.ValidAfter, cert.ValidBefore)
+	}
+	if _, ok := cert.Extensions["permit-pty"]; !ok {
+		t.Errorf("default extensions missing: %v", cert.Extensions)
+	}
+	checker := &CertChecker{}
+	if err := checker.CheckCert("user", cert); err != nil {
+		t.Errorf("CheckCert: %v", err)
+	}
+
+	for _, params := range []CertificateParams{
+		{Key: testPublicKeys["rsa"]},
+		{Principals: []string{"user"}},
+		{Key: testPublicKeys["rsa"], Principals: []string{"user"}, ValidAfter: time.Unix(100, 0), ValidBefore: time.Unix(50, 0)},
+	} {
+		if _, err := NewUserCertificate(rand.Reader, testSigners["ecdsa"], params); err == nil {
+			t.Errorf("NewUserCertificate(%+v) succeeded", params)
+		}
+	}
+}
+
+func TestNewCertSignerFromFiles(t *testing.T) {
+	signer, err := NewCertSignerFromFiles(testdata.PEMBytes["rsa"], testdata.SSHCertificates["rsa"])
+	if err != nil {
+		t.Fatalf("NewCertSignerFromFiles: %v", err)
+	}
+	cert, ok := signer.PublicKey().(*Certificate)
+	if !ok {
+		t.Fatalf("got a %T public key, want *Certificate", signer.PublicKey())
+	}
+	if !bytes.Equal(cert.Key.Marshal(), testPublicKeys["rsa"].Marshal()) {
+		t.Error("certificate is not for the private key")
+	}
+	data := []byte("data")
+	sig, err := signer.Sign(rand.Reader, data)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if err := cert.Verify(data, sig); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+
+	// Mismatched key and certificate.
+	_, err = NewCertSignerFromFiles(testdata.PEMBytes["ed25519"], testdata.SSHCertificates["rsa"])
+	if err == nil || !strings.Contains(err.Error(), "not for the private key") {
+		t.Errorf("NewCertSignerFromFiles with mismatched key: %v; want a mismatch error", err)
+	}
+
+	// A plain public key.
+	_, err = NewCertSignerFromFiles(testdata.PEMBytes["rsa"], MarshalAuthorizedKey(testPublicKeys["rsa"]))
+	if err == nil || !strings.Contains(err.Error(), "not a certificate") {
+		t.Errorf("NewCertSignerFromFiles with a public key: %v; want an error", err)
+	}
+}
+
+func TestNewCertSignerFromFilesWithPassphrase(t *testing.T) {
+	k := testdata.PEMEncryptedKeys[0]
+	key, err := ParsePrivateKeyWithPassphrase(k.PEMBytes, []byte(k.EncryptionKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := NewUserCertificate(rand.Reader, testSigners["ecdsa"], CertificateParams{
+		Key:        key.PublicKey(),
+		KeyId:      "user-1",
+		Principals: []string{"user"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPub := MarshalAuthorizedKey(cert)
+
+	signer, err := NewCertSignerFromFilesWithPassphrase(k.PEMBytes, certPub, []byte(k.EncryptionKey))
+	if err != nil {
+		t.Fatalf("NewCertSignerFromFilesWithPassphrase: %v", err)
+	}
+	if !bytes.Equal(signer.PublicKey().Marshal(), cert.Marshal()) {
+		t.Error("signer does not present the certificate")
+	}
+
+	if _, err := NewCertSignerFromFilesWithPassphrase(k.PEMBytes, certPub, []byte("wrong")); err == nil {
+		t.Error("NewCertSignerFromFilesWithPassphrase succeeded with a wrong passphrase")
+	}
+	if _, err := NewCertSignerFromFiles(k.PEMBytes, certPub); err == nil {
+		t.Error("NewCertSignerFromFiles succeeded with an encrypted key")
+	}
+}
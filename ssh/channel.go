@@ -10,6 +10,8 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"path"
+	"strings"
 	"sync"
 )
 
@@ -180,6 +182,15 @@ type channel struct {
 
 	incomingRequests chan *Request
 
+	// replyMu guards replies, which is only used when the package answers
+	// some requests of the peer itself, see mux.acceptEnv, as the replies
+	// must be sent in the order of the requests. It lists the requests
+	// awaiting a reply: false for those delivered to the application,
+	// true for those refused by the package, whose reply is sent once the
+	// earlier ones are answered.
+	replyMu sync.Mutex
+	replies []bool
+
 	sentEOF bool
 
 	// thread-safe data
@@ -403,6 +414,7 @@ func (ch *channel) handlePacket(packet []byte) error {
 		ch.sendMessage(channelCloseMsg{PeersID: ch.remoteId})
 		ch.mux.chanList.remove(ch.localId)
 		ch.close()
+		ch.mux.closeIfDrained()
 		return nil
 	case msgChannelEOF:
 		// RFC 4254 is mute on how EOF affects dataExt messages but
@@ -424,6 +436,7 @@ func (ch *channel) handlePacket(packet []byte) error {
 		}
 		ch.mux.chanList.remove(msg.PeersID)
 		ch.msg <- msg
+		ch.mux.closeIfDrained()
 	case *channelOpenConfirmMsg:
 		if err := ch.responseMessageReceived(); err != nil {
 			return err
@@ -446,6 +459,21 @@ func (ch *channel) handlePacket(packet []byte) error {
 			Payload:   msg.RequestSpecificData,
 			ch:        ch,
 		}
+		if ch.direction == channelInbound && ch.chanType == "session" {
+			if ch.mux.acceptEnv != nil {
+				if req.Type == "env" && !acceptEnv(ch.mux.acceptEnv, req.Payload) {
+					return ch.refuseRequest(req.WantReply)
+				}
+				if req.WantReply {
+					ch.replyMu.Lock()
+					ch.replies = append(ch.replies, false)
+					ch.replyMu.Unlock()
+				}
+			}
+			if ch.mux.forceCommand != nil {
+				ch.forceCommand(&req)
+			}
+		}
 
 		ch.incomingRequests <- &req
 	default:
@@ -454,6 +482,78 @@ func (ch *channel) handlePacket(packet []byte) error {
 	return nil
 }
 
+// forceCommand turns the exec, shell and subsystem requests into an exec
+// request for the command returned by ch.mux.forceCommand.
+func (ch *channel) forceCommand(req *Request) {
+	var requested string
+	switch req.Type {
+	case "exec":
+		var msg execMsg
+		if err := Unmarshal(req.Payload, &msg); err == nil {
+			requested = msg.Command
+		}
+	case "subsystem":
+		var msg subsystemRequestMsg
+		if err := Unmarshal(req.Payload, &msg); err == nil {
+			requested = msg.Subsystem
+		}
+	case "shell":
+	default:
+		return
+	}
+	req.Type = "exec"
+	req.Payload = Marshal(execMsg{Command: ch.mux.forceCommand(requested)})
+}
+
+// acceptEnv reports whether the env request payload sets a variable
+// matching one of patterns, with a valid name and value.
+func acceptEnv(patterns []string, payload []byte) bool {
+	env, ok := ParseEnvRequest(payload)
+	if !ok || !validEnvName(env.Name) || strings.IndexByte(env.Value, 0) >= 0 {
+		return false
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, env.Name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validEnvName reports whether name is a portable environment variable
+// name: letters, digits and underscores, not starting with a digit.
+func validEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '_', 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case '0' <= c && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// refuseRequest refuses a request of the peer without delivering it to
+// the application. If a reply is wanted, it is sent right away unless
+// earlier requests are still awaiting theirs.
+func (ch *channel) refuseRequest(wantReply bool) error {
+	if !wantReply {
+		return nil
+	}
+	ch.replyMu.Lock()
+	defer ch.replyMu.Unlock()
+	if len(ch.replies) > 0 {
+		ch.replies = append(ch.replies, true)
+		return nil
+	}
+	return ch.sendMessage(channelRequestFailureMsg{PeersID: ch.remoteId})
+}
+
 func (m *mux) newChannel(chanType string, direction channelDirection, extraData []byte) *channel {
 	ch := &channel{
 		remoteWin:        window{Cond: newCond()},
@@ -503,6 +603,7 @@ func (ch *channel) Accept() (Channel, <-chan *Request, error) {
 	if err := ch.sendMessage(confirm); err != nil {
 		return nil, nil, err
 	}
+	ch.mux.channels.Add(1)
 
 	return ch, ch.incomingRequests, nil
 }
@@ -518,7 +619,10 @@ func (ch *channel) Reject(reason RejectionReason, message string) error {
 		Language: "en",
 	}
 	ch.decided = true
-	return ch.sendMessage(reject)
+	err := ch.sendMessage(reject)
+	ch.mux.chanList.remove(ch.localId)
+	ch.mux.closeIfDrained()
+	return err
 }
 
 func (ch *channel) Read(data []byte) (int, error) {
@@ -621,7 +725,26 @@ func (ch *channel) ackRequest(ok bool) error {
 			PeersID: ch.remoteId,
 		}
 	}
-	return ch.sendMessage(msg)
+	if ch.mux.acceptEnv == nil || ch.direction != channelInbound {
+		return ch.sendMessage(msg)
+	}
+
+	// Send the replies of the refused requests following this one.
+	ch.replyMu.Lock()
+	defer ch.replyMu.Unlock()
+	if err := ch.sendMessage(msg); err != nil {
+		return err
+	}
+	if len(ch.replies) > 0 {
+		ch.replies = ch.replies[1:]
+	}
+	for len(ch.replies) > 0 && ch.replies[0] {
+		ch.replies = ch.replies[1:]
+		if err := ch.sendMessage(channelRequestFailureMsg{PeersID: ch.remoteId}); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (ch *channel) ChannelType() string {
@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"crypto"
 	"crypto/rand"
+	"encoding/hex"
 	"testing"
 )
 
@@ -129,3 +130,82 @@ func TestCBCOracleCounterMeasure(t *testing.T) {
 		lastRead = bytesRead
 	}
 }
+
+// The packets sent by the OpenSSH_9.2p1 client to a Go server after the key
+// exchange, with "none" authentication and an "echo-this-command" exec
+// request, and their payloads and padding. The invocation counter of the
+// client to server IV, the last 8 bytes, was set to 2^64-3 on both sides,
+// in the client by hooking OpenSSL EVP_CTRL_GCM_SET_IV_FIXED, so that the
+// nonces of the packets wrap around without changing the fixed field, as
+// RFC 5647 requires.
+var openSSHGCMPackets = map[string]struct {
+	key, iv string
+	packets [][3]string // packet, payload, padding
+}{
+	gcm128CipherID: {
+		key: "ffd6c56a94870e3e4412608e70dee147",
+		iv:  "fcd6d8dafffffffffffffffd",
+		packets: [][3]string{
+			{"00000020102c72023bc3eae4efec3ff85ea6f9443552b79c84ddc6104fc27fb73dca7e6fa48afd258b9d956c50fbd423ef4b55d9", "050000000c7373682d7573657261757468", "6baf6fc13cc597ed87bf5c6f0820"},
+			{"0000003027898583a159c67c12c97b9c2212e59dacd5905afe7d809c6d052607d891398645019fd6bcefc1dd061fb01957bae1158be5c769c891b750b482b01b81c64899", "3200000004757365720000000e7373682d636f6e6e656374696f6e000000046e6f6e65", "0c6b1f48c5d288135593af7f"},
+			{"000000209f956fdbd2cf4f3e792c2948a9de05129e61697e0a993a439c46a71137da31bc3710ae271f2542e580bdf9a311d9d48e", "5a0000000773657373696f6e000000000020000000008000", "39d721489c8de3"},
+			{"00000030daf40e05f77b959de4bda8d9d92cfc6ba81da6ed563f62e770173c6ae3bb6cd7157c69eb7d41b4c64c10c8bfec63ebc3792e15dfdcfdbf00817aae9ecfdd0c81", "6200000000000000046578656301000000116563686f2d746869732d636f6d6d616e64", "bca5fa394ca7e63b2d322833"},
+			{"00000010a5a3905e1a775cd3e5d78074b5b389448d1e45a11c309561cf1e202e0a7be0a7", "6000000000", "4189cad1a126f294577d"},
+			{"00000010cc15d424f53261aa9ce04ac1fcb352dba2e1bfad20934b9d15306bad16b8b7d3", "6100000000", "6bf175b4fedc5b59bf6f"},
+			{"0000003057019fb21329cf082d361537d1cdf5d8730dbcdda4a3a39c9cc24622f97e23f09bb2ee8a1941303ff02599a0d82b8bc78e9e75dca0d32c61c6bcca1608fba707", "010000000b00000014646973636f6e6e6563746564206279207573657200000000", "28e15b4e5b4620f9b804eb282c38"},
+		},
+	},
+	gcm256CipherID: {
+		key: "65b5ecd03e40418fb390c48db41a3c4824a7639e99faeac46749929917e6f1bb",
+		iv:  "787574bafffffffffffffffd",
+		packets: [][3]string{
+			{"00000020a5611d7e2fce8c7c478180bc5cf9ddc5b84db9aa0fb4a6fde4785d7d275b2fc4eb60e28526ec8d37680082327b67101d", "050000000c7373682d7573657261757468", "19b2ee2c68202d1064ed054368a7"},
+			{"000000308661389ab86864254139d91e93029ffc2bd33064bd0f8c7330f7f733156685c2bccc3e6e3ce846e27a334f3bfc9dec3de18d48982eca3a357e4bd990fda1ce99", "3200000004757365720000000e7373682d636f6e6e656374696f6e000000046e6f6e65", "75623df56620e45200c9237d"},
+			{"0000002094789573dfc5d37f0723e28c2a6e7a046babbcb4d8d6eaaa97ad270afaa2b4a66656b4078ec1e1feadc6401e97c5a24f", "5a0000000773657373696f6e000000000020000000008000", "0ca8e1e43577f3"},
+			{"000000303de5ae25781c0a2693c0586d0abf00cae0be16b9347ef0e723bd67d4fe481503e19bacac2a4f3130921b1d02f931306c7bb888b1ecad1340ad73be2fe538ddbd", "6200000000000000046578656301000000116563686f2d746869732d636f6d6d616e64", "4c38992228b57b024254de6f"},
+			{"0000001031a06df68f2df187c5fca95e379775266695d1f775977f7cbacf668dbdf9aa27", "6000000000", "ec32d63c93ec8551fca4"},
+			{"00000010ebf1b0495404ead6a8c269114c060c7c4d570b870b9a2717570d2649d70ec04c", "6100000000", "0100cb5f7d3459ceb52c"},
+			{"000000306904017bf1a822dc553997645a1c500dabcefd74266ed350801e73409b8f345990e8e0b5db10a6d8bf9f27bd3c04707f76dc46a2e61c915adc4f9a1fb6f725b5", "010000000b00000014646973636f6e6e6563746564206279207573657200000000", "f267fda547429ed0d8be5024ceb7"},
+		},
+	},
+}
+
+// TestGCMNonceSequence checks the AES-GCM ciphers against the packets of
+// openSSHGCMPackets.
+func TestGCMNonceSequence(t *testing.T) {
+	for cipher, v := range openSSHGCMPackets {
+		t.Run(cipher, func(t *testing.T) {
+			key, _ := hex.DecodeString(v.key)
+			iv, _ := hex.DecodeString(v.iv)
+			r, err := newGCMCipher(key, append([]byte(nil), iv...), nil, directionAlgorithms{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, err := newGCMCipher(key, append([]byte(nil), iv...), nil, directionAlgorithms{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, p := range v.packets {
+				packet, _ := hex.DecodeString(p[0])
+				got, err := r.readCipherPacket(uint32(i), bytes.NewReader(packet))
+				if err != nil {
+					t.Fatalf("readCipherPacket %d: %v", i, err)
+				}
+				if hex.EncodeToString(got) != p[1] {
+					t.Fatalf("readCipherPacket %d = %x; want %s", i, got, p[1])
+				}
+
+				// With the padding of OpenSSH, the packet is the same.
+				payload, _ := hex.DecodeString(p[1])
+				padding, _ := hex.DecodeString(p[2])
+				var buf bytes.Buffer
+				if err := w.writeCipherPacket(uint32(i), &buf, bytes.NewReader(padding), payload); err != nil {
+					t.Fatalf("writeCipherPacket %d: %v", i, err)
+				}
+				if !bytes.Equal(buf.Bytes(), packet) {
+					t.Fatalf("writeCipherPacket %d:\n got %x\nwant %x", i, buf.Bytes(), packet)
+				}
+			}
+		})
+	}
+}
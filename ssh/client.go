@@ -69,6 +69,10 @@ func NewClient(c Conn, chans <-chan NewChannel, reqs <-chan *Request) *Client {
 // as the underlying transport.  The Request and NewChannel channels
 // must be serviced or the connection will hang.
 func NewClientConn(c net.Conn, addr string, config *ClientConfig) (Conn, <-chan NewChannel, <-chan *Request, error) {
+	if err := config.checkAlgorithms(); err != nil {
+		c.Close()
+		return nil, nil, nil, err
+	}
 	fullConf := *config
 	fullConf.SetDefaults()
 	if fullConf.HostKeyCallback == nil {
@@ -80,9 +84,12 @@ func NewClientConn(c net.Conn, addr string, config *ClientConfig) (Conn, <-chan
 		sshConn: sshConn{conn: c},
 	}
 
-	if err := conn.clientHandshake(addr, &fullConf); err != nil {
+	err := withHandshakeTimeout(c, fullConf.HandshakeTimeout, func() error {
+		return conn.clientHandshake(addr, &fullConf)
+	})
+	if err != nil {
 		c.Close()
-		return nil, nil, nil, fmt.Errorf("ssh: handshake failed: %v", err)
+		return nil, nil, nil, fmt.Errorf("ssh: handshake failed: %w", err)
 	}
 	conn.mux = newMux(conn.transport)
 	return conn, conn.mux.incomingChannels, conn.mux.incomingRequests, nil
@@ -126,12 +133,15 @@ func verifyHostKeySignature(hostKey PublicKey, result *kexResult) error {
 
 // NewSession opens a new Session for this client. (A session is a remote
 // execution of a program.)
+//
+// Servers limit the number of sessions a connection may have open at once;
+// see SessionPool to wait for a session to close rather than fail.
 func (c *Client) NewSession() (*Session, error) {
 	ch, in, err := c.OpenChannel("session", nil)
 	if err != nil {
 		return nil, err
 	}
-	return newSession(ch, in)
+	return newSession(ch, in, nil)
 }
 
 func (c *Client) handleGlobalRequests(incoming <-chan *Request) {
@@ -188,6 +198,26 @@ func Dial(network, addr string, config *ClientConfig) (*Client, error) {
 // net.Conn underlying the SSH connection.
 type HostKeyCallback func(hostname string, remote net.Addr, key PublicKey) error
 
+// HostKeyError is returned, wrapped, by NewClientConn and Dial when
+// ClientConfig.HostKeyCallback rejects the host key of the server.
+// Its message is that of the error returned by the callback.
+type HostKeyError struct {
+	// Hostname, Remote and Key are the arguments of the callback.
+	Hostname string
+	Remote   net.Addr
+	Key      PublicKey
+
+	// Err is the error returned by the callback, for instance
+	// a *knownhosts.KeyError.
+	Err error
+}
+
+func (e *HostKeyError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *HostKeyError) Unwrap() error { return e.Err }
+
 // BannerCallback is the function type used for treat the banner sent by
 // the server. A BannerCallback receives the message sent by the remote server.
 type BannerCallback func(message string) error
@@ -231,6 +261,20 @@ type ClientConfig struct {
 	// any of the CertAlgoXxxx and KeyAlgoXxxx constants.
 	HostKeyAlgorithms []string
 
+	// PublicKeyAlgorithms optionally lists the public key algorithms the
+	// client may use for the public key authentication, in order of
+	// preference, for instance to only sign with SHA-512 using RSA keys or
+	// to allow the SHA-1 based "ssh-rsa" for legacy servers. For each key,
+	// the algorithms matching its type are tried in order, until the server
+	// accepts one. Besides the key types, it may contain SigAlgoRSASHA2256
+	// and SigAlgoRSASHA2512 for RSA keys and CertAlgoRSASHA256v01 and
+	// CertAlgoRSASHA512v01 for RSA certificates, if their Signer is an
+	// AlgorithmSigner. Keys matching none of the algorithms are not offered.
+	// The list is used as is, whatever algorithms the server advertises.
+	//
+	// If nil, each key is offered with the algorithm of its type.
+	PublicKeyAlgorithms []string
+
 	// Timeout is the maximum amount of time for the TCP connection to establish.
 	//
 	// A Timeout of zero means no timeout.
@@ -29,6 +29,16 @@ func (c *connection) clientAuthenticate(config *ClientConfig) error {
 	if err != nil {
 		return err
 	}
+	// The extensions of the server, if it sent any, precede its reply.
+	var extensions map[string][]byte
+	if packet[0] == msgExtInfo {
+		if extensions, err = parseExtInfo(packet); err != nil {
+			return err
+		}
+		if packet, err = c.transport.readPacket(); err != nil {
+			return err
+		}
+	}
 	var serviceAccept serviceAcceptMsg
 	if err := Unmarshal(packet, &serviceAccept); err != nil {
 		return err
@@ -37,11 +47,23 @@ func (c *connection) clientAuthenticate(config *ClientConfig) error {
 	// during the authentication phase the client first attempts the "none" method
 	// then any untried methods suggested by the server.
 	tried := make(map[string]bool)
-	var lastMethods []string
+	var triedOrder, lastMethods []string
 
 	sessionID := c.transport.getSessionID()
+	var conn packetConn = c.transport
+	var hostKey []byte
+	if string(extensions[extPublicKeyHostBound]) == "0" {
+		hostKey = c.transport.sessionHostKey
+	}
+	if config.PublicKeyAlgorithms != nil || hostKey != nil {
+		conn = &publicKeyAlgorithmsConn{
+			packetConn: c.transport,
+			algorithms: config.PublicKeyAlgorithms,
+			hostKey:    hostKey,
+		}
+	}
 	for auth := AuthMethod(new(noneAuth)); auth != nil; {
-		ok, methods, err := auth.auth(sessionID, config.User, c.transport, config.Rand)
+		ok, methods, err := auth.auth(sessionID, config.User, conn, config.Rand)
 		if err != nil {
 			return err
 		}
@@ -49,7 +71,10 @@ func (c *connection) clientAuthenticate(config *ClientConfig) error {
 			// success
 			return nil
 		} else if ok == authFailure {
-			tried[auth.method()] = true
+			if m := auth.method(); !tried[m] {
+				tried[m] = true
+				triedOrder = append(triedOrder, m)
+			}
 		}
 		if methods == nil {
 			methods = lastMethods
@@ -72,16 +97,24 @@ func (c *connection) clientAuthenticate(config *ClientConfig) error {
 			}
 		}
 	}
-	return fmt.Errorf("ssh: unable to authenticate, attempted methods %v, no supported methods remain", keys(tried))
+	return &AuthError{Tried: triedOrder, Remaining: lastMethods}
 }
 
-func keys(m map[string]bool) []string {
-	s := make([]string, 0, len(m))
+// AuthError is returned, wrapped, by NewClientConn and Dial when the client
+// fails to authenticate with the server because all the authentication
+// methods of ClientConfig.Auth accepted by the server were rejected.
+type AuthError struct {
+	// Tried lists the authentication methods that failed, in the order
+	// they were attempted, starting with "none".
+	Tried []string
+
+	// Remaining lists the authentication methods the server last
+	// reported it would accept.
+	Remaining []string
+}
 
-	for key := range m {
-		s = append(s, key)
-	}
-	return s
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("ssh: unable to authenticate, attempted methods %v, no supported methods remain", e.Tried)
 }
 
 // An AuthMethod represents an instance of an RFC 4252 authentication method.
@@ -183,6 +216,50 @@ type publickeyAuthMsg struct {
 // pairs for authentication.
 type publicKeyCallback func() ([]Signer, error)
 
+// publicKeyAlgorithmsConn passes ClientConfig.PublicKeyAlgorithms, and
+// the host key to bind the signatures to if the server supports the
+// methodPublicKeyHostBound method, to the publicKeyCallback, through other
+// AuthMethods wrapping it.
+type publicKeyAlgorithmsConn struct {
+	packetConn
+	algorithms []string // nil for the type of the key only
+	hostKey    []byte
+}
+
+// rsaSHA2Algorithms maps the public key algorithms of RFC 8332 to the
+// key type they apply to and the format of their signatures.
+var rsaSHA2Algorithms = map[string]struct{ keyType, sigFormat string }{
+	SigAlgoRSASHA2256:    {KeyAlgoRSA, SigAlgoRSASHA2256},
+	SigAlgoRSASHA2512:    {KeyAlgoRSA, SigAlgoRSASHA2512},
+	CertAlgoRSASHA256v01: {CertAlgoRSAv01, SigAlgoRSASHA2256},
+	CertAlgoRSASHA512v01: {CertAlgoRSAv01, SigAlgoRSASHA2512},
+}
+
+// publicKeyAlgorithms returns the algorithms to offer signer with, in order.
+func publicKeyAlgorithms(signer Signer, c packetConn) []string {
+	keyType := signer.PublicKey().Type()
+	ac, ok := c.(*publicKeyAlgorithmsConn)
+	if !ok || ac.algorithms == nil {
+		return []string{keyType}
+	}
+	_, isAlgorithmSigner := signer.(AlgorithmSigner)
+	var algos []string
+	for _, algo := range ac.algorithms {
+		if algo == keyType || isAlgorithmSigner && rsaSHA2Algorithms[algo].keyType == keyType {
+			algos = append(algos, algo)
+		}
+	}
+	return algos
+}
+
+// signForAuth signs data with signer using the public key algorithm algo.
+func signForAuth(signer Signer, rand io.Reader, data []byte, algo string) (*Signature, error) {
+	if a, ok := rsaSHA2Algorithms[algo]; ok {
+		return signer.(AlgorithmSigner).SignWithAlgorithm(rand, data, a.sigFormat)
+	}
+	return signer.Sign(rand, data)
+}
+
 func (cb publicKeyCallback) method() string {
 	return "publickey"
 }
@@ -197,37 +274,53 @@ func (cb publicKeyCallback) auth(session []byte, user string, c packetConn, rand
 	if err != nil {
 		return authFailure, nil, err
 	}
+	// The signed request is host-bound if the server supports it.
+	method := cb.method()
+	var hostKey []byte
+	if ac, ok := c.(*publicKeyAlgorithmsConn); ok && ac.hostKey != nil {
+		method, hostKey = methodPublicKeyHostBound, ac.hostKey
+	}
 	var methods []string
 	for _, signer := range signers {
-		ok, err := validateKey(signer.PublicKey(), user, c)
-		if err != nil {
-			return authFailure, nil, err
+		pub := signer.PublicKey()
+		var algo string
+		for _, a := range publicKeyAlgorithms(signer, c) {
+			ok, err := validateKey(pub, a, user, c)
+			if err != nil {
+				return authFailure, nil, err
+			}
+			if ok {
+				algo = a
+				break
+			}
 		}
-		if !ok {
+		if algo == "" {
 			continue
 		}
 
-		pub := signer.PublicKey()
 		pubKey := pub.Marshal()
-		sign, err := signer.Sign(rand, buildDataSignedForAuth(session, userAuthRequestMsg{
+		sign, err := signForAuth(signer, rand, buildDataSignedForAuth(session, userAuthRequestMsg{
 			User:    user,
 			Service: serviceSSH,
-			Method:  cb.method(),
-		}, []byte(pub.Type()), pubKey))
+			Method:  method,
+		}, []byte(algo), pubKey, hostKey), algo)
 		if err != nil {
 			return authFailure, nil, err
 		}
 
-		// manually wrap the serialized signature in a string
-		s := Marshal(sign)
-		sig := make([]byte, stringLength(len(s)))
-		marshalString(sig, s)
+		// manually wrap the serialized signature in a string, preceded by
+		// the host key if the request is host-bound
+		var sig []byte
+		if hostKey != nil {
+			sig = appendString(sig, string(hostKey))
+		}
+		sig = appendString(sig, string(Marshal(sign)))
 		msg := publickeyAuthMsg{
 			User:     user,
 			Service:  serviceSSH,
-			Method:   cb.method(),
+			Method:   method,
 			HasSig:   true,
-			Algoname: pub.Type(),
+			Algoname: algo,
 			PubKey:   pubKey,
 			Sig:      sig,
 		}
@@ -263,27 +356,27 @@ func containsMethod(methods []string, method string) bool {
 	return false
 }
 
-// validateKey validates the key provided is acceptable to the server.
-func validateKey(key PublicKey, user string, c packetConn) (bool, error) {
+// validateKey validates the key provided with the public key
+// algorithm algo is acceptable to the server.
+func validateKey(key PublicKey, algo, user string, c packetConn) (bool, error) {
 	pubKey := key.Marshal()
 	msg := publickeyAuthMsg{
 		User:     user,
 		Service:  serviceSSH,
 		Method:   "publickey",
 		HasSig:   false,
-		Algoname: key.Type(),
+		Algoname: algo,
 		PubKey:   pubKey,
 	}
 	if err := c.writePacket(Marshal(&msg)); err != nil {
 		return false, err
 	}
 
-	return confirmKeyAck(key, c)
+	return confirmKeyAck(key, algo, c)
 }
 
-func confirmKeyAck(key PublicKey, c packetConn) (bool, error) {
+func confirmKeyAck(key PublicKey, algoname string, c packetConn) (bool, error) {
 	pubKey := key.Marshal()
-	algoname := key.Type()
 
 	for {
 		packet, err := c.readPacket()
@@ -350,6 +443,9 @@ func handleAuthResponse(c packetConn) (authResult, []string, error) {
 			return authFailure, msg.Methods, nil
 		case msgUserAuthSuccess:
 			return authSuccess, nil, nil
+		case msgExtInfo:
+			// RFC 8308 lets the server send its extensions again
+			// before its msgUserAuthSuccess; none of them matter then.
 		default:
 			return authFailure, nil, unexpectedMessageError(msgUserAuthSuccess, packet[0])
 		}
@@ -362,6 +458,9 @@ func handleBannerResponse(c packetConn, packet []byte) error {
 		return err
 	}
 
+	if ac, ok := c.(*publicKeyAlgorithmsConn); ok {
+		c = ac.packetConn
+	}
 	transport, ok := c.(*handshakeTransport)
 	if !ok {
 		return nil
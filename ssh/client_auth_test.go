@@ -13,7 +13,9 @@ import (
 	"log"
 	"net"
 	"os"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 )
 
@@ -313,8 +315,81 @@ func TestClientUnsupportedKex(t *testing.T) {
 		},
 		HostKeyCallback: InsecureIgnoreHostKey(),
 	}
-	if err := tryAuth(t, config); err == nil || !strings.Contains(err.Error(), "common algorithm") {
-		t.Errorf("got %v, expected 'common algorithm'", err)
+	if err := tryAuth(t, config); err == nil || !strings.Contains(err.Error(), "unsupported key exchange") {
+		t.Errorf("got %v, expected 'unsupported key exchange'", err)
+	}
+}
+
+func TestAuthErrorWrongPassword(t *testing.T) {
+	config := &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{
+			Password("wrong"),
+		},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	err := tryAuth(t, config)
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("got %v, want an *AuthError", err)
+	}
+	if want := []string{"none", "password"}; !reflect.DeepEqual(authErr.Tried, want) {
+		t.Errorf("got Tried %v, want %v", authErr.Tried, want)
+	}
+	if len(authErr.Remaining) == 0 {
+		t.Error("got no Remaining methods")
+	}
+	if want := "attempted methods [none password]"; !strings.Contains(err.Error(), want) {
+		t.Errorf("got message %q, want it to contain %q", err, want)
+	}
+}
+
+func TestAlgorithmNegotiationError(t *testing.T) {
+	config := &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{
+			Password(clientPassword),
+		},
+		Config: Config{
+			Ciphers: []string{"aes128-cbc"}, // not supported by the server
+		},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	err := tryAuth(t, config)
+	var algErr *AlgorithmNegotiationError
+	if !errors.As(err, &algErr) {
+		t.Fatalf("got %v, want an *AlgorithmNegotiationError", err)
+	}
+	if algErr.What != "client to server cipher" {
+		t.Errorf("got What %q, want %q", algErr.What, "client to server cipher")
+	}
+	if want := []string{"aes128-cbc"}; !reflect.DeepEqual(algErr.ClientOffered, want) {
+		t.Errorf("got ClientOffered %v, want %v", algErr.ClientOffered, want)
+	}
+	if len(algErr.ServerOffered) == 0 {
+		t.Error("got no ServerOffered ciphers")
+	}
+}
+
+func TestHostKeyError(t *testing.T) {
+	config := &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{
+			Password(clientPassword),
+		},
+		// The server presents testSigners["rsa"].
+		HostKeyCallback: FixedHostKey(testPublicKeys["ecdsa"]),
+	}
+	err := tryAuth(t, config)
+	var hkErr *HostKeyError
+	if !errors.As(err, &hkErr) {
+		t.Fatalf("got %v, want a *HostKeyError", err)
+	}
+	if !bytes.Equal(hkErr.Key.Marshal(), testPublicKeys["rsa"].Marshal()) {
+		t.Errorf("got Key %v, want the server host key", hkErr.Key.Type())
+	}
+	if !strings.Contains(err.Error(), "host key mismatch") {
+		t.Errorf("got message %q, want it to mention the host key mismatch", err)
 	}
 }
 
@@ -404,6 +479,32 @@ func TestClientLoginCert(t *testing.T) {
 	if err := tryAuth(t, clientConfig); err == nil {
 		t.Errorf("cert login with source-address succeeded")
 	}
+
+	// forced command, not listed in SupportedCriticalOptions
+	cert.CriticalOptions = map[string]string{"force-command": "/bin/true"}
+	cert.SignCert(rand.Reader, testSigners["ecdsa"])
+	if err := tryAuth(t, clientConfig); err == nil {
+		t.Errorf("cert login with force-command succeeded")
+	}
+}
+
+func TestCertCheckerForceCommand(t *testing.T) {
+	cert := &Certificate{
+		Key:         testPublicKeys["rsa"],
+		ValidBefore: CertTimeInfinity,
+		CertType:    UserCert,
+		Permissions: Permissions{CriticalOptions: map[string]string{"force-command": "/bin/true"}},
+	}
+	cert.SignCert(rand.Reader, testSigners["ecdsa"])
+
+	checker := &CertChecker{}
+	if err := checker.CheckCert("user", cert); err == nil {
+		t.Error("CheckCert accepted force-command without SupportedCriticalOptions")
+	}
+	checker.SupportedCriticalOptions = []string{"force-command"}
+	if err := checker.CheckCert("user", cert); err != nil {
+		t.Errorf("CheckCert with force-command supported: %v", err)
+	}
 }
 
 func testPermissionsPassing(withPermissions bool, t *testing.T) {
@@ -599,6 +700,52 @@ func TestClientAuthMaxAuthTries(t *testing.T) {
 	}
 }
 
+// Test if authentication attempts are limited on server by default,
+// and that the server disconnects once the limit is reached.
+func TestClientAuthMaxAuthTriesDefault(t *testing.T) {
+	var attempts int32
+	serverConfig := &ServerConfig{
+		PasswordCallback: func(conn ConnMetadata, pass []byte) (*Permissions, error) {
+			atomic.AddInt32(&attempts, 1)
+			return nil, errors.New("password auth failed")
+		},
+	}
+	serverConfig.AddHostKey(testSigners["rsa"])
+	clientConfig := &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{
+			RetryableAuthMethod(PasswordCallback(func() (string, error) {
+				return "wrong", nil
+			}), 100),
+		},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		_, err := newServer(c1, serverConfig)
+		serverErr <- err
+	}()
+	_, _, _, err = NewClientConn(c2, "", clientConfig)
+	want := &disconnectMsg{Reason: 2, Message: "too many authentication failures"}
+	if err == nil || !strings.Contains(err.Error(), want.Error()) {
+		t.Fatalf("client: got %v, want %v", err, want)
+	}
+	if err := <-serverErr; !reflect.DeepEqual(err, want) {
+		t.Errorf("server: got %v, want %v", err, want)
+	}
+	if n := atomic.LoadInt32(&attempts); n != defaultMaxAuthTries {
+		t.Errorf("got %d password attempts, want %d", n, defaultMaxAuthTries)
+	}
+}
+
 // Test if authentication attempts are correctly limited on server
 // when more public keys are provided then MaxAuthTries
 func TestClientAuthMaxAuthTriesPublicKey(t *testing.T) {
@@ -686,3 +833,257 @@ func TestClientAuthErrorList(t *testing.T) {
 		}
 	}
 }
+
+// algorithmsAuthConn is a packetConn playing the server side of the public
+// key authentication, accepting the algorithms in accept.
+type algorithmsAuthConn struct {
+	accept  map[string]bool
+	queries []string
+	signed  []publickeyAuthMsg
+	replies [][]byte
+}
+
+func (c *algorithmsAuthConn) writePacket(p []byte) error {
+	var msg publickeyAuthMsg
+	if err := Unmarshal(p, &msg); err != nil {
+		return err
+	}
+	switch {
+	case msg.HasSig:
+		c.signed = append(c.signed, msg)
+		c.replies = append(c.replies, []byte{msgUserAuthSuccess})
+	case c.accept[msg.Algoname]:
+		c.queries = append(c.queries, msg.Algoname)
+		c.replies = append(c.replies, Marshal(&userAuthPubKeyOkMsg{Algo: msg.Algoname, PubKey: msg.PubKey}))
+	default:
+		c.queries = append(c.queries, msg.Algoname)
+		c.replies = append(c.replies, Marshal(&userAuthFailureMsg{Methods: []string{"publickey"}}))
+	}
+	return nil
+}
+
+func (c *algorithmsAuthConn) readPacket() ([]byte, error) {
+	if len(c.replies) == 0 {
+		return nil, io.EOF
+	}
+	p := c.replies[0]
+	c.replies = c.replies[1:]
+	return p, nil
+}
+
+func (c *algorithmsAuthConn) Close() error { return nil }
+
+func TestClientAuthPublicKeyAlgorithms(t *testing.T) {
+	cert := &Certificate{
+		Key:         testPublicKeys["rsa"],
+		ValidBefore: CertTimeInfinity,
+		CertType:    UserCert,
+	}
+	cert.SignCert(rand.Reader, testSigners["ecdsa"])
+	certSigner, err := NewCertSigner(cert, testSigners["rsa"])
+	if err != nil {
+		t.Fatalf("NewCertSigner: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		signers    []Signer
+		algorithms []string
+		accept     []string
+		queries    []string
+		signed     string // algorithm of the signed request
+		sigFormat  string
+	}{
+		{
+			name:      "default",
+			signers:   []Signer{testSigners["rsa"]},
+			accept:    []string{KeyAlgoRSA},
+			queries:   []string{KeyAlgoRSA},
+			signed:    KeyAlgoRSA,
+			sigFormat: SigAlgoRSA,
+		},
+		{
+			name:       "sha512",
+			signers:    []Signer{testSigners["rsa"]},
+			algorithms: []string{SigAlgoRSASHA2512},
+			accept:     []string{SigAlgoRSASHA2512},
+			queries:    []string{SigAlgoRSASHA2512},
+			signed:     SigAlgoRSASHA2512,
+			sigFormat:  SigAlgoRSASHA2512,
+		},
+		{
+			name:       "fallback",
+			signers:    []Signer{testSigners["rsa"]},
+			algorithms: []string{SigAlgoRSASHA2512, KeyAlgoRSA},
+			accept:     []string{KeyAlgoRSA},
+			queries:    []string{SigAlgoRSASHA2512, KeyAlgoRSA},
+			signed:     KeyAlgoRSA,
+			sigFormat:  SigAlgoRSA,
+		},
+		{
+			name:       "skip unmatched key",
+			signers:    []Signer{testSigners["ecdsa"], testSigners["rsa"]},
+			algorithms: []string{SigAlgoRSASHA2256},
+			accept:     []string{SigAlgoRSASHA2256, KeyAlgoECDSA256},
+			queries:    []string{SigAlgoRSASHA2256},
+			signed:     SigAlgoRSASHA2256,
+			sigFormat:  SigAlgoRSASHA2256,
+		},
+		{
+			name:       "cert",
+			signers:    []Signer{certSigner},
+			algorithms: []string{SigAlgoRSASHA2512, CertAlgoRSASHA512v01},
+			accept:     []string{CertAlgoRSASHA512v01},
+			queries:    []string{CertAlgoRSASHA512v01},
+			signed:     CertAlgoRSASHA512v01,
+			sigFormat:  SigAlgoRSASHA2512,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := &algorithmsAuthConn{accept: make(map[string]bool)}
+			for _, a := range test.accept {
+				conn.accept[a] = true
+			}
+			var c packetConn = conn
+			if test.algorithms != nil {
+				c = &publicKeyAlgorithmsConn{packetConn: conn, algorithms: test.algorithms}
+			}
+			res, _, err := PublicKeys(test.signers...).auth([]byte("session"), "testuser", c, rand.Reader)
+			if err != nil {
+				t.Fatalf("auth: %v", err)
+			}
+			if res != authSuccess {
+				t.Fatalf("auth result = %v; want success", res)
+			}
+			if !reflect.DeepEqual(conn.queries, test.queries) {
+				t.Errorf("queried algorithms = %q; want %q", conn.queries, test.queries)
+			}
+			if len(conn.signed) != 1 {
+				t.Fatalf("got %d signed requests; want 1", len(conn.signed))
+			}
+			msg := conn.signed[0]
+			if msg.Algoname != test.signed {
+				t.Errorf("signed request algorithm = %q; want %q", msg.Algoname, test.signed)
+			}
+			sig, _, ok := parseSignature(msg.Sig)
+			if !ok {
+				t.Fatal("cannot parse the signature")
+			}
+			if sig.Format != test.sigFormat {
+				t.Errorf("signature format = %q; want %q", sig.Format, test.sigFormat)
+			}
+		})
+	}
+
+	// The server accepts the SHA-2 algorithms, for keys and certificates.
+	for _, test := range []struct {
+		signer Signer
+		algo   string
+	}{
+		{testSigners["rsa"], SigAlgoRSASHA2256},
+		{testSigners["rsa"], SigAlgoRSASHA2512},
+		{certSigner, CertAlgoRSASHA256v01},
+		{certSigner, CertAlgoRSASHA512v01},
+	} {
+		config := &ClientConfig{
+			User:                "testuser",
+			Auth:                []AuthMethod{PublicKeys(test.signer)},
+			PublicKeyAlgorithms: []string{test.algo},
+			HostKeyCallback:     InsecureIgnoreHostKey(),
+		}
+		if err := tryAuth(t, config); err != nil {
+			t.Errorf("%s: unable to dial remote side: %v", test.algo, err)
+		}
+	}
+}
+
+// hostBoundAuth is the public key authentication with signer, which checks
+// that the server supports the host-bound method and binds the signature
+// to hostKey, if set, rather than to the host key of the server.
+type hostBoundAuth struct {
+	signer  Signer
+	hostKey []byte
+}
+
+func (a *hostBoundAuth) auth(session []byte, user string, c packetConn, rand io.Reader) (authResult, []string, error) {
+	ac, ok := c.(*publicKeyAlgorithmsConn)
+	if !ok || !bytes.Equal(ac.hostKey, testSigners["rsa"].PublicKey().Marshal()) {
+		return authFailure, nil, errors.New("host-bound public key method not negotiated")
+	}
+	if a.hostKey != nil {
+		ac = &publicKeyAlgorithmsConn{packetConn: ac.packetConn, algorithms: ac.algorithms, hostKey: a.hostKey}
+	}
+	return PublicKeys(a.signer).auth(session, user, ac, rand)
+}
+
+func (a *hostBoundAuth) method() string { return "publickey" }
+
+func TestClientAuthPublicKeyHostBound(t *testing.T) {
+	config := &ClientConfig{
+		User:            "testuser",
+		Auth:            []AuthMethod{&hostBoundAuth{signer: testSigners["rsa"]}},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	if err := tryAuth(t, config); err != nil {
+		t.Fatalf("unable to dial remote side: %v", err)
+	}
+
+	// A signature bound to another host key, such as one obtained by a
+	// server relaying the authentication, is rejected.
+	config.Auth = []AuthMethod{&hostBoundAuth{signer: testSigners["rsa"], hostKey: testPublicKeys["ecdsa"].Marshal()}}
+	clientErr, serverErrs := tryAuthBothSides(t, config)
+	if clientErr == nil {
+		t.Fatal("tampered host key: client authenticated")
+	}
+	var found bool
+	for _, err := range serverErrs {
+		if err != nil && strings.Contains(err.Error(), "another host key") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("tampered host key: server errors = %v; want the host key rejected", serverErrs)
+	}
+}
+
+func TestClientAuthPublicKeyHostBoundSignature(t *testing.T) {
+	hostKey := testPublicKeys["ecdsa"].Marshal()
+	conn := &algorithmsAuthConn{accept: map[string]bool{KeyAlgoED25519: true}}
+	c := &publicKeyAlgorithmsConn{packetConn: conn, hostKey: hostKey}
+	session := []byte("session")
+	if res, _, err := PublicKeys(testSigners["ed25519"]).auth(session, "testuser", c, rand.Reader); err != nil || res != authSuccess {
+		t.Fatalf("auth = %v, %v; want success", res, err)
+	}
+	if len(conn.signed) != 1 {
+		t.Fatalf("got %d signed requests; want 1", len(conn.signed))
+	}
+	msg := conn.signed[0]
+	if msg.Method != methodPublicKeyHostBound {
+		t.Errorf("signed request method = %q; want %q", msg.Method, methodPublicKeyHostBound)
+	}
+	gotHostKey, rest, ok := parseString(msg.Sig)
+	if !ok || !bytes.Equal(gotHostKey, hostKey) {
+		t.Fatalf("signed request host key = %x; want %x", gotHostKey, hostKey)
+	}
+	sig, rest, ok := parseSignature(rest)
+	if !ok || len(rest) > 0 {
+		t.Fatal("cannot parse the signature")
+	}
+
+	pub := testPublicKeys["ed25519"]
+	req := userAuthRequestMsg{User: "testuser", Service: serviceSSH, Method: methodPublicKeyHostBound}
+	signed := func(hostKey []byte) []byte {
+		return buildDataSignedForAuth(session, req, []byte(msg.Algoname), pub.Marshal(), hostKey)
+	}
+	if err := pub.Verify(signed(hostKey), sig); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+	if err := pub.Verify(signed(testPublicKeys["rsa"].Marshal()), sig); err == nil {
+		t.Error("signature verifies with another host key")
+	}
+	req.Method = "publickey"
+	if err := pub.Verify(signed(nil), sig); err == nil {
+		t.Error("signature verifies without the host key")
+	}
+}
@@ -76,6 +76,70 @@ func TestClientVersion(t *testing.T) {
 	}
 }
 
+func TestServerVersion(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		version string
+		want    string
+	}{
+		{
+			name: "default version",
+			want: packageVersion,
+		},
+		{
+			name:    "custom version",
+			version: "SSH-2.0-OpenSSH_9.6",
+			want:    "SSH-2.0-OpenSSH_9.6",
+		},
+		{
+			name:    "custom version with comments",
+			version: "SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13",
+			want:    "SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c1, c2, err := netPipe()
+			if err != nil {
+				t.Fatalf("netPipe: %v", err)
+			}
+			defer c1.Close()
+			defer c2.Close()
+			conf := &ServerConfig{
+				NoClientAuth:  true,
+				ServerVersion: tt.version,
+			}
+			conf.AddHostKey(testSigners["rsa"])
+			done := make(chan *ServerConn, 1)
+			go func() {
+				conn, _, _, err := NewServerConn(c1, conf)
+				if err != nil {
+					t.Errorf("NewServerConn: %v", err)
+				}
+				done <- conn
+			}()
+			conn, _, _, err := NewClientConn(c2, "", &ClientConfig{
+				HostKeyCallback: InsecureIgnoreHostKey(),
+			})
+			if err != nil {
+				t.Fatalf("NewClientConn: %v", err)
+			}
+			defer conn.Close()
+			if got := string(conn.ServerVersion()); got != tt.want {
+				t.Errorf("client ServerVersion() = %q; want %q", got, tt.want)
+			}
+			if got := string(conn.ClientVersion()); got != packageVersion {
+				t.Errorf("client ClientVersion() = %q; want %q", got, packageVersion)
+			}
+			if sconn := <-done; sconn != nil {
+				if got := string(sconn.ServerVersion()); got != tt.want {
+					t.Errorf("server ServerVersion() = %q; want %q", got, tt.want)
+				}
+				sconn.Close()
+			}
+		})
+	}
+}
+
 func TestHostKeyCheck(t *testing.T) {
 	for _, tt := range []struct {
 		name      string
@@ -10,7 +10,10 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"net"
+	"os"
 	"sync"
+	"time"
 
 	_ "crypto/sha1"
 	_ "crypto/sha256"
@@ -27,7 +30,7 @@ const (
 // supportedCiphers lists ciphers we support but might not recommend.
 var supportedCiphers = []string{
 	"aes128-ctr", "aes192-ctr", "aes256-ctr",
-	"aes128-gcm@openssh.com",
+	gcm128CipherID, gcm256CipherID,
 	chacha20Poly1305ID,
 	"arcfour256", "arcfour128", "arcfour",
 	aes128cbcID,
@@ -36,7 +39,7 @@ var supportedCiphers = []string{
 
 // preferredCiphers specifies the default preference for ciphers.
 var preferredCiphers = []string{
-	"aes128-gcm@openssh.com",
+	gcm128CipherID, gcm256CipherID,
 	chacha20Poly1305ID,
 	"aes128-ctr", "aes192-ctr", "aes256-ctr",
 }
@@ -63,6 +66,13 @@ var supportedHostKeyAlgos = []string{
 	KeyAlgoED25519,
 }
 
+// DefaultHostKeyAlgorithms returns the host key algorithms a client
+// accepts, in order of preference, if ClientConfig.HostKeyAlgorithms is
+// empty.
+func DefaultHostKeyAlgorithms() []string {
+	return append([]string(nil), supportedHostKeyAlgos...)
+}
+
 // supportedMACs specifies a default set of MAC algorithms in preference order.
 // This is based on RFC 4253, section 6.4, but with hmac-md5 variants removed
 // because they have reached the end of their useful life.
@@ -70,8 +80,79 @@ var supportedMACs = []string{
 	"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1", "hmac-sha1-96",
 }
 
+// supportedCompressions specifies the default compression algorithms:
+// compression is opt in, see Config.Compressions.
 var supportedCompressions = []string{compressionNone}
 
+// The following slices list algorithms, in preference order, for common
+// deployment policies. They are intended to be assigned to the
+// corresponding Config fields, usually through ApplyPreset.
+var (
+	// KEXModern lists elliptic curve key exchanges only.
+	KEXModern = []string{
+		kexAlgoCurve25519SHA256,
+		kexAlgoECDH256, kexAlgoECDH384, kexAlgoECDH521,
+	}
+
+	// CiphersModern lists AEAD and CTR mode ciphers. It excludes RC4 and
+	// CBC mode ciphers.
+	CiphersModern = []string{
+		gcm256CipherID, gcm128CipherID, chacha20Poly1305ID,
+		"aes256-ctr", "aes192-ctr", "aes128-ctr",
+	}
+
+	// MACsModern lists SHA-2 based MACs, preferring encrypt-then-MAC.
+	MACsModern = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256",
+	}
+
+	// KEXFIPS lists key exchanges that use NIST curves.
+	KEXFIPS = []string{
+		kexAlgoECDH256, kexAlgoECDH384, kexAlgoECDH521,
+	}
+
+	// CiphersFIPS lists AES based ciphers in GCM and CTR mode.
+	CiphersFIPS = []string{
+		gcm256CipherID, gcm128CipherID,
+		"aes256-ctr", "aes192-ctr", "aes128-ctr",
+	}
+
+	// MACsFIPS lists HMAC-SHA2 based MACs.
+	MACsFIPS = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256",
+	}
+
+	// KEXCompatible lists every supported key exchange, including
+	// the SHA-1 based Diffie-Hellman groups.
+	KEXCompatible = append([]string(nil), supportedKexAlgos...)
+
+	// CiphersCompatible lists every supported cipher, including RC4 and
+	// CBC mode ciphers. Only use it to talk to legacy peers.
+	CiphersCompatible = append([]string(nil), supportedCiphers...)
+
+	// MACsCompatible lists every supported MAC.
+	MACsCompatible = append([]string(nil), supportedMACs...)
+)
+
+// AlgorithmPreset is a coherent set of key exchange, cipher and MAC
+// algorithms that can be applied to a Config with ApplyPreset.
+type AlgorithmPreset struct {
+	KeyExchanges []string
+	Ciphers      []string
+	MACs         []string
+}
+
+var (
+	// PresetModern only allows algorithms without known weaknesses.
+	PresetModern = AlgorithmPreset{KEXModern, CiphersModern, MACsModern}
+
+	// PresetFIPS only allows algorithms approved by FIPS 140-2.
+	PresetFIPS = AlgorithmPreset{KEXFIPS, CiphersFIPS, MACsFIPS}
+
+	// PresetCompatible allows every supported algorithm.
+	PresetCompatible = AlgorithmPreset{KEXCompatible, CiphersCompatible, MACsCompatible}
+)
+
 // hashFuncs keeps the mapping of supported algorithms to their respective
 // hashes needed for signature verification.
 var hashFuncs = map[string]crypto.Hash{
@@ -106,7 +187,24 @@ func findCommon(what string, client []string, server []string) (common string, e
 			}
 		}
 	}
-	return "", fmt.Errorf("ssh: no common algorithm for %s; client offered: %v, server offered: %v", what, client, server)
+	return "", &AlgorithmNegotiationError{What: what, ClientOffered: client, ServerOffered: server}
+}
+
+// AlgorithmNegotiationError is returned, wrapped, by NewClientConn, Dial and
+// NewServerConn when the client and the server support no common algorithm
+// of a kind, for instance no common cipher.
+type AlgorithmNegotiationError struct {
+	// What is the kind of algorithm, such as "key exchange", "host key"
+	// or "client to server cipher".
+	What string
+
+	// ClientOffered and ServerOffered are the algorithms of that kind
+	// supported by the client and by the server.
+	ClientOffered, ServerOffered []string
+}
+
+func (e *AlgorithmNegotiationError) Error() string {
+	return fmt.Sprintf("ssh: no common algorithm for %s; client offered: %v, server offered: %v", e.What, e.ClientOffered, e.ServerOffered)
 }
 
 // directionAlgorithms records algorithm choices in one direction (either read or write)
@@ -122,7 +220,7 @@ func (a *directionAlgorithms) rekeyBytes() int64 {
 	// 2^(BLOCKSIZE/4) blocks. For all AES flavors BLOCKSIZE is
 	// 128.
 	switch a.Cipher {
-	case "aes128-ctr", "aes192-ctr", "aes256-ctr", gcmCipherID, aes128cbcID:
+	case "aes128-ctr", "aes192-ctr", "aes256-ctr", gcm128CipherID, gcm256CipherID, aes128cbcID:
 		return 16 * (1 << 32)
 
 	}
@@ -208,6 +306,14 @@ type Config struct {
 
 	// The allowed key exchanges algorithms. If unspecified then a
 	// default set of algorithms is used.
+	//
+	// The post-quantum hybrid "sntrup761x25519-sha512@openssh.com" key
+	// exchange is supported but not part of the default set: it is only
+	// used if listed here.
+	//
+	// Setting up a connection fails if KeyExchanges, Ciphers or MACs
+	// name an algorithm that is not supported by this package. See
+	// ApplyPreset for predefined algorithm lists.
 	KeyExchanges []string
 
 	// The allowed cipher algorithms. If unspecified then a sensible
@@ -217,6 +323,49 @@ type Config struct {
 	// The allowed MAC algorithms. If unspecified then a sensible default
 	// is used.
 	MACs []string
+
+	// The allowed compression algorithms, in preference order:
+	// "zlib@openssh.com", the delayed compression of OpenSSH which starts
+	// once the user authentication succeeded, "zlib", which starts with
+	// the key exchange, and "none". Compression saves bandwidth for
+	// compressible data on slow links at the expense of CPU time.
+	//
+	// If unspecified, connections are not compressed. Keep "none" in the
+	// list to connect to peers which do not support compression.
+	Compressions []string
+
+	// HandshakeTimeout is the maximum amount of time for setting up a
+	// connection: the exchange of versions, the key exchange and the user
+	// authentication. If it elapses, the connection is closed and
+	// NewServerConn or NewClientConn return an error wrapping
+	// os.ErrDeadlineExceeded. This defends servers against peers which
+	// open connections but never complete the handshake.
+	//
+	// If zero, servers use a timeout of 2 minutes, as OpenSSH does, and
+	// clients none. A negative value means no timeout.
+	HandshakeTimeout time.Duration
+}
+
+// defaultServerHandshakeTimeout is the HandshakeTimeout of servers
+// which do not set it.
+const defaultServerHandshakeTimeout = 2 * time.Minute
+
+// withHandshakeTimeout runs handshake, which sets up the connection c,
+// with a deadline of timeout on c if positive.
+func withHandshakeTimeout(c net.Conn, timeout time.Duration, handshake func() error) error {
+	if timeout <= 0 {
+		return handshake()
+	}
+	deadline := time.Now().Add(timeout)
+	c.SetDeadline(deadline)
+	if err := handshake(); err != nil {
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("ssh: handshake timed out after %v: %w", timeout, os.ErrDeadlineExceeded)
+		}
+		return err
+	}
+	c.SetDeadline(time.Time{})
+	return nil
 }
 
 // SetDefaults sets sensible values for unset fields in config. This is
@@ -246,6 +395,10 @@ func (c *Config) SetDefaults() {
 		c.MACs = supportedMACs
 	}
 
+	if c.Compressions == nil {
+		c.Compressions = supportedCompressions
+	}
+
 	if c.RekeyThreshold == 0 {
 		// cipher specific default
 	} else if c.RekeyThreshold < minRekeyThreshold {
@@ -256,9 +409,45 @@ func (c *Config) SetDefaults() {
 	}
 }
 
+// ApplyPreset sets the key exchange, cipher and MAC algorithms of c to
+// those of p. The lists are copied, so later changes to either do not
+// affect the other.
+func (c *Config) ApplyPreset(p AlgorithmPreset) {
+	c.KeyExchanges = append([]string(nil), p.KeyExchanges...)
+	c.Ciphers = append([]string(nil), p.Ciphers...)
+	c.MACs = append([]string(nil), p.MACs...)
+}
+
+// checkAlgorithms returns an error if c lists a key exchange, cipher,
+// MAC or compression algorithm that is not implemented by this package.
+func (c *Config) checkAlgorithms() error {
+	for _, k := range c.KeyExchanges {
+		if kexAlgoMap[k] == nil {
+			return fmt.Errorf("ssh: unsupported key exchange algorithm %q", k)
+		}
+	}
+	for _, a := range c.Ciphers {
+		if cipherModes[a] == nil {
+			return fmt.Errorf("ssh: unsupported cipher %q", a)
+		}
+	}
+	for _, m := range c.MACs {
+		if macModes[m] == nil {
+			return fmt.Errorf("ssh: unsupported MAC algorithm %q", m)
+		}
+	}
+	for _, m := range c.Compressions {
+		if !compressionModes[m] {
+			return fmt.Errorf("ssh: unsupported compression algorithm %q", m)
+		}
+	}
+	return nil
+}
+
 // buildDataSignedForAuth returns the data that is signed in order to prove
-// possession of a private key. See RFC 4252, section 7.
-func buildDataSignedForAuth(sessionID []byte, req userAuthRequestMsg, algo, pubKey []byte) []byte {
+// possession of a private key. See RFC 4252, section 7. For the
+// methodPublicKeyHostBound method, the data ends with hostKey.
+func buildDataSignedForAuth(sessionID []byte, req userAuthRequestMsg, algo, pubKey, hostKey []byte) []byte {
 	data := struct {
 		Session []byte
 		Type    byte
@@ -278,6 +467,9 @@ func buildDataSignedForAuth(sessionID []byte, req userAuthRequestMsg, algo, pubK
 		algo,
 		pubKey,
 	}
+	if req.Method == methodPublicKeyHostBound {
+		return appendString(Marshal(data), string(hostKey))
+	}
 	return Marshal(data)
 }
 
@@ -6,6 +6,7 @@ package ssh
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -174,3 +175,67 @@ func TestFindAgreedAlgorithms(t *testing.T) {
 		})
 	}
 }
+
+func TestPresetModernExcludesWeakCiphers(t *testing.T) {
+	for _, c := range PresetModern.Ciphers {
+		if strings.HasSuffix(c, "-cbc") || strings.HasPrefix(c, "arcfour") {
+			t.Errorf("PresetModern includes weak cipher %q", c)
+		}
+	}
+}
+
+func TestPresetsSupported(t *testing.T) {
+	presets := map[string]AlgorithmPreset{
+		"modern":     PresetModern,
+		"fips":       PresetFIPS,
+		"compatible": PresetCompatible,
+	}
+	for name, p := range presets {
+		var c Config
+		c.ApplyPreset(p)
+		if err := c.checkAlgorithms(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestApplyPresetCopies(t *testing.T) {
+	var c Config
+	c.ApplyPreset(PresetModern)
+	if !reflect.DeepEqual(c.Ciphers, CiphersModern) {
+		t.Fatalf("Ciphers = %v, want %v", c.Ciphers, CiphersModern)
+	}
+	c.Ciphers[0] = "modified"
+	if CiphersModern[0] == "modified" {
+		t.Error("ApplyPreset shares its slices with the preset")
+	}
+}
+
+func TestUnknownAlgorithm(t *testing.T) {
+	tests := []struct {
+		config Config
+		want   string
+	}{
+		{Config{KeyExchanges: []string{"kex-unknown"}}, `key exchange algorithm "kex-unknown"`},
+		{Config{Ciphers: []string{"aes128-ctr", "cipher-unknown"}}, `cipher "cipher-unknown"`},
+		{Config{MACs: []string{"mac-unknown"}}, `MAC algorithm "mac-unknown"`},
+		{Config{Compressions: []string{"zlib", "lz4"}}, `compression algorithm "lz4"`},
+	}
+	for _, tt := range tests {
+		c1, c2, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+		_, _, _, err = NewClientConn(c1, "", &ClientConfig{
+			Config:          tt.config,
+			HostKeyCallback: InsecureIgnoreHostKey(),
+		})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("NewClientConn: got %v, want error containing %q", err, tt.want)
+		}
+		_, _, _, err = NewServerConn(c2, &ServerConfig{Config: tt.config})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("NewServerConn: got %v, want error containing %q", err, tt.want)
+		}
+	}
+}
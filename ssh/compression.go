@@ -0,0 +1,191 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	compressionZlib = "zlib"
+
+	// compressionZlibOpenSSH is the delayed zlib compression of OpenSSH,
+	// which starts once the user authentication succeeded, see
+	// https://cvsweb.openbsd.org/src/usr.bin/ssh/PROTOCOL.
+	compressionZlibOpenSSH = "zlib@openssh.com"
+)
+
+// compressionModes lists the supported compression algorithms.
+var compressionModes = map[string]bool{
+	compressionNone:        true,
+	compressionZlib:        true,
+	compressionZlibOpenSSH: true,
+}
+
+// newCompressionCipher wraps c, which reads or writes the packets of one
+// direction, with the compression algorithm named algo, if any.
+func newCompressionCipher(c packetCipher, algo string, t *transport) packetCipher {
+	switch algo {
+	case compressionZlib, compressionZlibOpenSSH:
+		return &zlibCipher{
+			packetCipher: c,
+			t:            t,
+			delayed:      algo == compressionZlibOpenSSH,
+		}
+	}
+	return c
+}
+
+// zlibCipher compresses the payload of the packets with zlib before
+// encrypting them, or decompresses them after decrypting them, as in
+// RFC 4253, section 6.2. The compression context spans all the packets
+// of the direction until the next key exchange.
+type zlibCipher struct {
+	packetCipher
+	t       *transport
+	delayed bool // compress only after the user authentication
+
+	// Writing.
+	buf bytes.Buffer
+	zw  *zlib.Writer
+
+	// Reading.
+	zr *inflater
+}
+
+func (c *zlibCipher) active() bool {
+	return !c.delayed || c.t.authenticated()
+}
+
+func (c *zlibCipher) writeCipherPacket(seqNum uint32, w io.Writer, rand io.Reader, packet []byte) error {
+	// The authentication success is the last uncompressed packet
+	// with the delayed compression.
+	if !c.active() || c.delayed && len(packet) > 0 && packet[0] == msgUserAuthSuccess {
+		return c.packetCipher.writeCipherPacket(seqNum, w, rand, packet)
+	}
+	if c.zw == nil {
+		c.zw = zlib.NewWriter(&c.buf)
+	}
+	c.buf.Reset()
+	if _, err := c.zw.Write(packet); err != nil {
+		return err
+	}
+	if err := c.zw.Flush(); err != nil {
+		return err
+	}
+	return c.packetCipher.writeCipherPacket(seqNum, w, rand, c.buf.Bytes())
+}
+
+func (c *zlibCipher) readCipherPacket(seqNum uint32, r io.Reader) ([]byte, error) {
+	packet, err := c.packetCipher.readCipherPacket(seqNum, r)
+	if err != nil || !c.active() {
+		return packet, err
+	}
+	if c.zr == nil {
+		c.zr = newInflater()
+	}
+	return c.zr.inflate(packet)
+}
+
+// close releases the decompressor, once the packets of the direction
+// are read with another cipher.
+func (c *zlibCipher) close() {
+	if c.zr != nil {
+		c.zr.close()
+	}
+}
+
+// closeCipher releases the resources held by c, which reads no more packets.
+func closeCipher(c packetCipher) {
+	if c, ok := c.(*zlibCipher); ok {
+		c.close()
+	}
+}
+
+var errInflaterClosed = errors.New("ssh: decompressor closed")
+
+// inflater decompresses a zlib stream split into packets. Its decoder runs
+// in a goroutine which waits for the next packet once it consumed the
+// input of the current one. The decoder reads no input ahead and outputs
+// each symbol as soon as it is decoded, so the output of a packet is
+// complete once its input is consumed, whether the compressor ends each
+// packet with a sync flush, as the Flush of package compress/zlib does, or
+// with a partial flush, as OpenSSH does.
+type inflater struct {
+	mu      sync.Mutex
+	cond    sync.Cond
+	in      []byte // unread input of the current packet
+	waiting bool   // whether the decoder waits for input
+	out     []byte // output of the current packet
+	err     error  // error of the decoder
+	closed  bool
+}
+
+func newInflater() *inflater {
+	f := &inflater{}
+	f.cond.L = &f.mu
+	go f.run()
+	return f
+}
+
+func (f *inflater) run() {
+	d := &zlibDecoder{next: f.next}
+	err := d.decode()
+	f.mu.Lock()
+	f.err = err
+	f.cond.Broadcast()
+	f.mu.Unlock()
+}
+
+// inflate returns the decompressed payload of the compressed packet.
+func (f *inflater) inflate(packet []byte) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.in = packet
+	f.waiting = false
+	f.out = nil
+	f.cond.Broadcast()
+	for f.err == nil && !(f.waiting && len(f.in) == 0) {
+		f.cond.Wait()
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.out, nil
+}
+
+func (f *inflater) close() {
+	f.mu.Lock()
+	f.closed = true
+	f.cond.Broadcast()
+	f.mu.Unlock()
+}
+
+// next returns the next input byte to the decoder, blocking until f has
+// input. Before blocking, it takes out, the output of the packet whose
+// input is consumed, and returns a nil slice for the output of the next
+// packet; otherwise it returns out.
+func (f *inflater) next(out []byte) (byte, []byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.in) == 0 {
+		f.out, out = out, nil
+		for len(f.in) == 0 {
+			if f.closed {
+				return 0, nil, errInflaterClosed
+			}
+			f.waiting = true
+			f.cond.Broadcast()
+			f.cond.Wait()
+		}
+	}
+	b := f.in[0]
+	f.in = f.in[1:]
+	return b, out, nil
+}
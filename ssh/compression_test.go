@@ -0,0 +1,202 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// countingConn counts the bytes written to a net.Conn.
+type countingConn struct {
+	net.Conn
+	n int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// echoCompressed connects a client to an echo server with the given
+// compression algorithms, sends data over a channel and returns the
+// number of bytes the client wrote.
+func echoCompressed(t *testing.T, clientAlgos, serverAlgos []string, rekeyThreshold uint64, data []byte) int64 {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{
+		PasswordCallback: func(conn ConnMetadata, password []byte) (*Permissions, error) {
+			return nil, nil
+		},
+	}
+	serverConf.Compressions = serverAlgos
+	serverConf.AddHostKey(testSigners["rsa"])
+	go func() {
+		_, chans, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			t.Errorf("server: %v", err)
+			return
+		}
+		go DiscardRequests(reqs)
+		for newCh := range chans {
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				t.Errorf("Accept: %v", err)
+				continue
+			}
+			go DiscardRequests(reqs)
+			go func() {
+				defer ch.Close()
+				io.Copy(ch, ch)
+			}()
+		}
+	}()
+
+	counter := &countingConn{Conn: c2}
+	clientConf := &ClientConfig{
+		User:            "testuser",
+		Auth:            []AuthMethod{Password("secret")},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	clientConf.Compressions = clientAlgos
+	clientConf.RekeyThreshold = rekeyThreshold
+	conn, chans, reqs, err := NewClientConn(counter, "", clientConf)
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	client := NewClient(conn, chans, reqs)
+	defer client.Close()
+
+	ch, reqs2, err := client.OpenChannel("echo", nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	go DiscardRequests(reqs2)
+	go func() {
+		if _, err := ch.Write(data); err != nil {
+			t.Errorf("Write: %v", err)
+		}
+		ch.CloseWrite()
+	}()
+	var got bytes.Buffer
+	if _, err := io.Copy(&got, ch); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Fatalf("echoed %d bytes, differing from the %d bytes sent", got.Len(), len(data))
+	}
+	return atomic.LoadInt64(&counter.n)
+}
+
+func TestCompression(t *testing.T) {
+	data := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog\n", 10000))
+	for _, algo := range []string{compressionZlib, compressionZlibOpenSSH} {
+		t.Run(algo, func(t *testing.T) {
+			n := echoCompressed(t, []string{algo}, []string{algo}, 0, data)
+			if n >= int64(len(data))/4 {
+				t.Errorf("wrote %d bytes for %d compressible bytes", n, len(data))
+			}
+		})
+	}
+}
+
+func TestCompressionRekey(t *testing.T) {
+	// Each key exchange restarts the compression.
+	data := []byte(strings.Repeat("0123456789", 20000))
+	for _, algo := range []string{compressionZlib, compressionZlibOpenSSH} {
+		t.Run(algo, func(t *testing.T) {
+			echoCompressed(t, []string{algo}, []string{algo}, 4096, data)
+		})
+	}
+}
+
+func TestCompressionFallback(t *testing.T) {
+	data := []byte(strings.Repeat("x", 100000))
+	n := echoCompressed(t, []string{compressionZlibOpenSSH, compressionNone}, nil, 0, data)
+	if n < int64(len(data)) {
+		t.Errorf("wrote %d bytes for %d bytes, want no compression", n, len(data))
+	}
+}
+
+func TestInflaterAcrossPackets(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	f := newInflater()
+	defer f.close()
+
+	msgs := []string{"a", strings.Repeat("b", 100000), "", "hello, world"}
+	for _, msg := range msgs {
+		buf.Reset()
+		zw.Write([]byte(msg))
+		zw.Flush()
+		got, err := f.inflate(append([]byte(nil), buf.Bytes()...))
+		if err != nil {
+			t.Fatalf("inflate: %v", err)
+		}
+		if string(got) != msg {
+			t.Fatalf("inflate returned %d bytes, want %d", len(got), len(msg))
+		}
+	}
+
+	f.close()
+	buf.Reset()
+	zw.Write([]byte("after close"))
+	zw.Flush()
+	if _, err := f.inflate(buf.Bytes()); err == nil {
+		t.Error("inflate succeeded after close")
+	}
+}
+
+// The compressed payloads of the packets sent by the OpenSSH_9.2p1 client
+// to a Go server after the key exchange, with "none" authentication and an
+// "echo-this-command" exec request, and their payloads as decompressed by
+// zlib 1.2.13. OpenSSH ends each packet with a partial flush, after which
+// the end of the empty block it emits may only be in the next packet.
+var openSSHCompressedPackets = map[string][][2]string{
+	compressionZlib: {
+		{"789c62656060e0292eced02d2d4e2d4a2c2dc90008", "050000000c7373682d7573657261757468"},
+		{"2023a0000b8803a4f94012c9f97979a9c92599f9792099bcfcbc548000", "3200000004757365720000000e7373682d636f6e6e656374696f6e000000046e6f6e65"},
+		{"8a0232d88b538b8b21620c0c0a20a2810120", "5a0000000773657373696f6e000000000020000000008000"},
+		{"809218208025b522359911c8104c4dcec8d72dc9c82c069a929b9b98970210", "6200000000000000046578656301000000116563686f2d746869732d636f6d6d616e64"},
+		{"400920798000", "6000000000"},
+	},
+	// The compression starts with the channel open request.
+	compressionZlibOpenSSH: {
+		{"789c8a626060602f4e2d2ececccf6300010510d1c00010", "5a0000000773657373696f6e000000000020000000008000"},
+		{"40490c10c0925a919acc086408a62667e4eb96646416eb26e7e7e626e6a50004", "6200000000000000046578656301000000116563686f2d746869732d636f6d6d616e64"},
+		{"5002481e20", "6000000000"},
+	},
+}
+
+func TestInflaterOpenSSH(t *testing.T) {
+	for algo, packets := range openSSHCompressedPackets {
+		t.Run(algo, func(t *testing.T) {
+			f := newInflater()
+			defer f.close()
+			for i, p := range packets {
+				in, _ := hex.DecodeString(p[0])
+				got, err := f.inflate(in)
+				if err != nil {
+					t.Fatalf("packet %d: inflate: %v", i, err)
+				}
+				if hex.EncodeToString(got) != p[1] {
+					t.Fatalf("packet %d: inflate returned %x, want %s", i, got, p[1])
+				}
+			}
+		})
+	}
+}
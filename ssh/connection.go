@@ -29,11 +29,13 @@ type ConnMetadata interface {
 	SessionID() []byte
 
 	// ClientVersion returns the client's version string as hashed
-	// into the session ID.
+	// into the session ID: the identification line the client sent,
+	// such as "SSH-2.0-OpenSSH_9.6", without its line terminator.
 	ClientVersion() []byte
 
 	// ServerVersion returns the server's version string as hashed
-	// into the session ID.
+	// into the session ID: the identification line the server sent,
+	// such as "SSH-2.0-OpenSSH_9.6", without its line terminator.
 	ServerVersion() []byte
 
 	// RemoteAddr returns the remote address for this connection.
@@ -74,6 +76,28 @@ type Conn interface {
 	//   Disconnect
 }
 
+// ConnStatser is implemented by the Conns of this package, such as the
+// Conn of ServerConn and Client, which keep traffic counters. Stats
+// returns the counters of the connection.
+type ConnStatser interface {
+	Stats() ConnStats
+}
+
+// ConnStats holds the traffic counters of a Conn.
+type ConnStats struct {
+	// BytesRead and BytesWritten count the payloads of the packets
+	// received and sent, excluding the packet framing (length, padding
+	// and MAC) and the key exchange messages.
+	BytesRead, BytesWritten uint64
+
+	// Channels is the number of channels opened in either direction.
+	Channels uint64
+
+	// Rekeys is the number of key exchanges completed after the
+	// initial one.
+	Rekeys uint64
+}
+
 // DiscardRequests consumes and rejects all requests from the
 // passed-in channel.
 func DiscardRequests(in <-chan *Request) {
@@ -97,6 +121,18 @@ func (c *connection) Close() error {
 	return c.sshConn.conn.Close()
 }
 
+func (c *connection) Stats() ConnStats {
+	st := ConnStats{
+		BytesRead:    c.transport.bytesRead.Load(),
+		BytesWritten: c.transport.bytesWritten.Load(),
+		Channels:     c.mux.channels.Load(),
+	}
+	if n := c.transport.kexCount.Load(); n > 0 {
+		st.Rekeys = n - 1
+	}
+	return st
+}
+
 // sshconn provides net.Conn metadata, but disallows direct reads and
 // writes.
 type sshConn struct {
@@ -0,0 +1,81 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import "strings"
+
+// The extension negotiation of RFC 8308. A client offering to receive the
+// extensions of the server lists the pseudo key exchange algorithm
+// extInfoClient in its first kexInitMsg; a server offering public key
+// authentication then sends its extensions, which only concern that method,
+// in an extInfoMsg right after its first msgNewKeys.
+const (
+	extInfoClient = "ext-info-c"
+
+	// extServerSigAlgs lists the public key algorithms the server accepts
+	// for user authentication.
+	extServerSigAlgs = "server-sig-algs"
+
+	// extPublicKeyHostBound advertises the support of the host-bound
+	// public key authentication method, methodPublicKeyHostBound, in its
+	// version "0".
+	extPublicKeyHostBound = "publickey-hostbound@openssh.com"
+)
+
+// methodPublicKeyHostBound is the variant of the "publickey" method of
+// RFC 4252 defined by OpenSSH in which the request, and thus the signature,
+// also holds the host key the server proved to own in the first key
+// exchange, so that a signature obtained by a server cannot be replayed by
+// it to another one.
+const methodPublicKeyHostBound = "publickey-hostbound-v00@openssh.com"
+
+// serverSigAlgs are the algorithms advertised with extServerSigAlgs: those
+// accepted by isAcceptableAlgo.
+var serverSigAlgs = []string{
+	KeyAlgoED25519, KeyAlgoECDSA256, KeyAlgoECDSA384, KeyAlgoECDSA521,
+	SigAlgoRSASHA2512, SigAlgoRSASHA2256, KeyAlgoRSA, KeyAlgoDSA,
+	CertAlgoED25519v01, CertAlgoECDSA256v01, CertAlgoECDSA384v01, CertAlgoECDSA521v01,
+	CertAlgoRSASHA512v01, CertAlgoRSASHA256v01, CertAlgoRSAv01, CertAlgoDSAv01,
+}
+
+// marshalServerExtInfo returns the extInfoMsg sent by a server.
+func marshalServerExtInfo() []byte {
+	exts := [][2]string{
+		{extServerSigAlgs, strings.Join(serverSigAlgs, ",")},
+		{extPublicKeyHostBound, "0"},
+	}
+	var payload []byte
+	for _, e := range exts {
+		payload = appendString(payload, e[0])
+		payload = appendString(payload, e[1])
+	}
+	return Marshal(&extInfoMsg{
+		NumExtensions: uint32(len(exts)),
+		Payload:       payload,
+	})
+}
+
+// parseExtInfo returns the extensions of the extInfoMsg packet, by name.
+func parseExtInfo(packet []byte) (map[string][]byte, error) {
+	var msg extInfoMsg
+	if err := Unmarshal(packet, &msg); err != nil {
+		return nil, err
+	}
+	exts := make(map[string][]byte)
+	rest := msg.Payload
+	for i := uint32(0); i < msg.NumExtensions; i++ {
+		name, r, ok := parseString(rest)
+		if !ok {
+			return nil, parseError(msgExtInfo)
+		}
+		value, r, ok := parseString(r)
+		if !ok {
+			return nil, parseError(msgExtInfo)
+		}
+		exts[string(name)] = value
+		rest = r
+	}
+	return exts, nil
+}
@@ -12,6 +12,7 @@ import (
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 )
 
 // debugHandshake, if set, prints messages sent and received.  Key
@@ -50,6 +51,11 @@ type handshakeTransport struct {
 	// connection.
 	hostKeys []Signer
 
+	// sendExtInfo is set if we are a server offering public key
+	// authentication, whose extensions are then sent to the clients
+	// asking for them.
+	sendExtInfo bool
+
 	// hostKeyAlgorithms is non-empty if we are the client. In that case,
 	// we accept these key types from the server as host key.
 	hostKeyAlgorithms []string
@@ -94,6 +100,15 @@ type handshakeTransport struct {
 
 	// The session ID or nil if first kex did not complete yet.
 	sessionID []byte
+
+	// The host key of the server in the first kex, in wire format, to
+	// which host-bound public key signatures are bound.
+	sessionHostKey []byte
+
+	// Counters reported by connection.Stats.
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+	kexCount     atomic.Uint64 // completed key exchanges, including the first one
 }
 
 type pendingKex struct {
@@ -139,6 +154,7 @@ func newClientTransport(conn keyingTransport, clientVersion, serverVersion []byt
 func newServerTransport(conn keyingTransport, clientVersion, serverVersion []byte, config *ServerConfig) *handshakeTransport {
 	t := newHandshakeTransport(conn, &config.Config, clientVersion, serverVersion)
 	t.hostKeys = config.hostKeys
+	t.sendExtInfo = config.PublicKeyCallback != nil
 	go t.readLoop()
 	go t.kexLoop()
 	return t
@@ -299,6 +315,9 @@ write:
 		// channel on the pendingKex request.
 
 		err := t.enterKeyExchange(request.otherInit)
+		if err == nil {
+			t.kexCount.Add(1)
+		}
 
 		t.mu.Lock()
 		t.writeError = err
@@ -397,6 +416,9 @@ func (t *handshakeTransport) readOnePacket(first bool) ([]byte, error) {
 	}
 
 	if p[0] != msgKexInit {
+		if !isKexMsg(p[0]) {
+			t.bytesRead.Add(uint64(len(p)))
+		}
 		return p, nil
 	}
 
@@ -432,6 +454,13 @@ func (t *handshakeTransport) readOnePacket(first bool) ([]byte, error) {
 	return successPacket, nil
 }
 
+// isKexMsg reports whether typ is a key exchange message, in the range
+// RFC 4250, section 4.1.2, reserves for the algorithm negotiation and the
+// key exchange methods. These are not counted by connection.Stats.
+func isKexMsg(typ byte) bool {
+	return typ >= msgKexInit && typ <= 49
+}
+
 // sendKexInit sends a key change message.
 func (t *handshakeTransport) sendKexInit() error {
 	t.mu.Lock()
@@ -450,8 +479,8 @@ func (t *handshakeTransport) sendKexInit() error {
 		CiphersServerClient:     t.config.Ciphers,
 		MACsClientServer:        t.config.MACs,
 		MACsServerClient:        t.config.MACs,
-		CompressionClientServer: supportedCompressions,
-		CompressionServerClient: supportedCompressions,
+		CompressionClientServer: t.config.Compressions,
+		CompressionServerClient: t.config.Compressions,
 	}
 	io.ReadFull(rand.Reader, msg.Cookie[:])
 
@@ -462,6 +491,13 @@ func (t *handshakeTransport) sendKexInit() error {
 		}
 	} else {
 		msg.ServerHostKeyAlgos = t.hostKeyAlgorithms
+
+		// Ask the server for its extensions, in the first kex only.
+		if t.sessionID == nil {
+			msg.KexAlgos = make([]string, len(t.config.KeyExchanges), len(t.config.KeyExchanges)+1)
+			copy(msg.KexAlgos, t.config.KeyExchanges)
+			msg.KexAlgos = append(msg.KexAlgos, extInfoClient)
+		}
 	}
 	packet := Marshal(msg)
 
@@ -492,6 +528,9 @@ func (t *handshakeTransport) writePacket(p []byte) error {
 	if t.writeError != nil {
 		return t.writeError
 	}
+	if !isKexMsg(p[0]) {
+		t.bytesWritten.Add(uint64(len(p)))
+	}
 
 	if t.sentInitMsg != nil {
 		// Copy the packet so the writer can reuse the buffer.
@@ -591,8 +630,10 @@ func (t *handshakeTransport) enterKeyExchange(otherInitPacket []byte) error {
 		return err
 	}
 
-	if t.sessionID == nil {
+	firstKex := t.sessionID == nil
+	if firstKex {
 		t.sessionID = result.H
+		t.sessionHostKey = result.HostKey
 	}
 	result.SessionID = t.sessionID
 
@@ -608,6 +649,12 @@ func (t *handshakeTransport) enterKeyExchange(otherInitPacket []byte) error {
 		return unexpectedMessageError(msgNewKeys, packet[0])
 	}
 
+	if firstKex && t.sendExtInfo && containsMethod(clientInit.KexAlgos, extInfoClient) {
+		if err := t.conn.writePacket(marshalServerExtInfo()); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -640,7 +687,7 @@ func (t *handshakeTransport) client(kex kexAlgorithm, algs *algorithms, magics *
 
 	err = t.hostKeyCallback(t.dialAddress, t.remoteAddr, hostKey)
 	if err != nil {
-		return nil, err
+		return nil, &HostKeyError{Hostname: t.dialAddress, Remote: t.remoteAddr, Key: hostKey, Err: err}
 	}
 
 	return result, nil
@@ -10,12 +10,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
 	"reflect"
 	"runtime"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 type testChecker struct {
@@ -123,6 +126,55 @@ func handshakePair(clientConf *ClientConfig, addr string, noise bool) (client *h
 	return client, server, nil
 }
 
+func TestHandshakeExtInfo(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		publicKey bool
+		want      byte
+	}{
+		{"publickey", true, msgExtInfo},
+		{"password", false, msgRequestSuccess},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b, err := netPipe()
+			if err != nil {
+				t.Fatalf("netPipe: %v", err)
+			}
+			clientConf := &ClientConfig{HostKeyCallback: InsecureIgnoreHostKey()}
+			clientConf.SetDefaults()
+			v := []byte("version")
+			client := newClientTransport(newTransport(a, rand.Reader, true), v, v, clientConf, "addr", a.RemoteAddr())
+			defer client.Close()
+
+			serverConf := &ServerConfig{}
+			if tt.publicKey {
+				serverConf.PublicKeyCallback = func(ConnMetadata, PublicKey) (*Permissions, error) { return nil, nil }
+			}
+			serverConf.AddHostKey(testSigners["ecdsa"])
+			serverConf.SetDefaults()
+			server := newServerTransport(newTransport(b, rand.Reader, false), v, v, serverConf)
+			defer server.Close()
+
+			if err := server.waitSession(); err != nil {
+				t.Fatalf("server.waitSession: %v", err)
+			}
+			if err := client.waitSession(); err != nil {
+				t.Fatalf("client.waitSession: %v", err)
+			}
+			if err := server.writePacket([]byte{msgRequestSuccess}); err != nil {
+				t.Fatalf("server.writePacket: %v", err)
+			}
+			p, err := client.readPacket()
+			if err != nil {
+				t.Fatalf("client.readPacket: %v", err)
+			}
+			if p[0] != tt.want {
+				t.Errorf("first packet of the server has type %d; want %d", p[0], tt.want)
+			}
+		})
+	}
+}
+
 func TestHandshakeBasic(t *testing.T) {
 	if runtime.GOOS == "plan9" {
 		t.Skip("see golang.org/issue/7237")
@@ -557,3 +609,91 @@ func TestHandshakeRekeyDefault(t *testing.T) {
 		t.Errorf("got rekey after %dG write, want 64G", wgb)
 	}
 }
+
+func TestHandshakeTimeoutServer(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	// The peer sends its version, then stalls.
+	go func() {
+		io.WriteString(c2, "SSH-2.0-stalling\r\n")
+		io.Copy(ioutil.Discard, c2)
+	}()
+
+	conf := &ServerConfig{NoClientAuth: true}
+	conf.AddHostKey(testSigners["ecdsa"])
+	conf.HandshakeTimeout = 100 * time.Millisecond
+	start := time.Now()
+	_, _, _, err = NewServerConn(c1, conf)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("NewServerConn: %v; want a timeout", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("NewServerConn returned after %v", d)
+	}
+}
+
+func TestHandshakeTimeoutClient(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	// The peer never sends anything.
+	go io.Copy(ioutil.Discard, c2)
+
+	conf := &ClientConfig{
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	conf.HandshakeTimeout = 100 * time.Millisecond
+	_, _, _, err = NewClientConn(c1, "", conf)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("NewClientConn: %v; want a timeout", err)
+	}
+}
+
+func TestHandshakeTimeoutCleared(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["ecdsa"])
+	serverConf.HandshakeTimeout = 300 * time.Millisecond
+	done := make(chan error, 1)
+	go func() {
+		conn, _, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			done <- err
+			return
+		}
+		go DiscardRequests(reqs)
+		// Outlive the handshake timeout.
+		time.Sleep(time.Second)
+		done <- conn.Close()
+	}()
+
+	clientConf := &ClientConfig{HostKeyCallback: InsecureIgnoreHostKey()}
+	clientConf.HandshakeTimeout = 300 * time.Millisecond
+	conn, _, _, err := NewClientConn(c2, "", clientConf)
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(500 * time.Millisecond)
+	if _, _, err := conn.SendRequest("ping", true, nil); err != nil {
+		t.Errorf("SendRequest after the handshake timeout: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("server: %v", err)
+	}
+}
@@ -0,0 +1,357 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import "errors"
+
+var (
+	errCorruptCompressed = errors.New("ssh: corrupt compressed data")
+	errPacketTooLarge    = errors.New("ssh: decompressed packet too large")
+)
+
+// zlibDecoder decodes a zlib stream, RFC 1950, of DEFLATE blocks, RFC 1951.
+// Unlike the decompressor of package compress/flate, which keeps its output
+// until the end of a block or a sync flush, it outputs each symbol as soon
+// as it is decoded, and reads input only when needed to decode the next one.
+type zlibDecoder struct {
+	// next returns the next input byte. It is passed the output decoded
+	// so far and returns the slice to append the next output to.
+	next func(out []byte) (byte, []byte, error)
+	out  []byte
+
+	bitBuf uint32 // unread bits of the last input bytes, LSB first
+	nBits  uint   // number of bits in bitBuf
+
+	window [1 << 15]byte // the last 32 KiB of output, for back references
+	pos    int           // number of bytes output
+}
+
+// decode decodes the stream until an error occurs.
+func (d *zlibDecoder) decode() error {
+	cmf, err := d.readByte()
+	if err != nil {
+		return err
+	}
+	flg, err := d.readByte()
+	if err != nil {
+		return err
+	}
+	// Compression method 8, a window of at most 32 KiB and no preset dictionary.
+	if cmf&0x0f != 8 || cmf>>4 > 7 || flg&0x20 != 0 || (uint16(cmf)<<8|uint16(flg))%31 != 0 {
+		return errors.New("ssh: invalid zlib header")
+	}
+	for {
+		final, err := d.bits(1)
+		if err != nil {
+			return err
+		}
+		typ, err := d.bits(2)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 0:
+			err = d.stored()
+		case 1:
+			err = d.codes(fixedLitLen, fixedDist)
+		case 2:
+			err = d.dynamic()
+		default:
+			err = errCorruptCompressed
+		}
+		if err != nil {
+			return err
+		}
+		if final == 1 {
+			// The peer ended the stream, although further packets may follow.
+			return errors.New("ssh: compressed stream ended")
+		}
+	}
+}
+
+func (d *zlibDecoder) readByte() (byte, error) {
+	b, out, err := d.next(d.out)
+	d.out = out
+	return b, err
+}
+
+// bits returns the next n bits of input, n <= 16.
+func (d *zlibDecoder) bits(n uint) (uint32, error) {
+	for d.nBits < n {
+		b, err := d.readByte()
+		if err != nil {
+			return 0, err
+		}
+		d.bitBuf |= uint32(b) << d.nBits
+		d.nBits += 8
+	}
+	v := d.bitBuf & (1<<n - 1)
+	d.bitBuf >>= n
+	d.nBits -= n
+	return v, nil
+}
+
+func (d *zlibDecoder) put(b byte) error {
+	if len(d.out) >= maxPacket {
+		return errPacketTooLarge
+	}
+	d.out = append(d.out, b)
+	d.window[d.pos&(len(d.window)-1)] = b
+	d.pos++
+	return nil
+}
+
+// stored copies a stored block, which starts at the next byte boundary.
+func (d *zlibDecoder) stored() error {
+	d.bitBuf, d.nBits = 0, 0
+	var hdr [4]byte
+	for i := range hdr {
+		b, err := d.readByte()
+		if err != nil {
+			return err
+		}
+		hdr[i] = b
+	}
+	n := uint16(hdr[0]) | uint16(hdr[1])<<8
+	if ^n != uint16(hdr[2])|uint16(hdr[3])<<8 {
+		return errCorruptCompressed
+	}
+	for ; n > 0; n-- {
+		b, err := d.readByte()
+		if err != nil {
+			return err
+		}
+		if err := d.put(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	lengthBase  = [29]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [29]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = [30]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = [30]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+)
+
+// codes decodes the symbols of a Huffman compressed block.
+func (d *zlibDecoder) codes(litLen, dist *huffman) error {
+	for {
+		sym, err := d.symbol(litLen)
+		if err != nil {
+			return err
+		}
+		if sym < 256 {
+			if err := d.put(byte(sym)); err != nil {
+				return err
+			}
+			continue
+		}
+		if sym == 256 {
+			return nil
+		}
+		sym -= 257
+		if sym >= len(lengthBase) {
+			return errCorruptCompressed
+		}
+		e, err := d.bits(uint(lengthExtra[sym]))
+		if err != nil {
+			return err
+		}
+		length := int(lengthBase[sym]) + int(e)
+		if sym, err = d.symbol(dist); err != nil {
+			return err
+		}
+		if sym >= len(distBase) {
+			return errCorruptCompressed
+		}
+		if e, err = d.bits(uint(distExtra[sym])); err != nil {
+			return err
+		}
+		distance := int(distBase[sym]) + int(e)
+		if distance > d.pos {
+			return errCorruptCompressed
+		}
+		for ; length > 0; length-- {
+			if err := d.put(d.window[(d.pos-distance)&(len(d.window)-1)]); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// codeLengthOrder is the order of the code lengths of the code length
+// alphabet in a dynamic block header.
+var codeLengthOrder = [19]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+// dynamic decodes a block compressed with the Huffman codes of its header.
+func (d *zlibDecoder) dynamic() error {
+	nLitLen, err := d.bits(5)
+	if err != nil {
+		return err
+	}
+	nDist, err := d.bits(5)
+	if err != nil {
+		return err
+	}
+	nCode, err := d.bits(4)
+	if err != nil {
+		return err
+	}
+	nLitLen += 257
+	nDist++
+	nCode += 4
+	if nLitLen > 286 || nDist > 30 {
+		return errCorruptCompressed
+	}
+
+	var codeLengths [19]uint8
+	for _, i := range codeLengthOrder[:nCode] {
+		l, err := d.bits(3)
+		if err != nil {
+			return err
+		}
+		codeLengths[i] = uint8(l)
+	}
+	lengthCode, err := newHuffman(codeLengths[:])
+	if err != nil {
+		return err
+	}
+
+	lengths := make([]uint8, nLitLen+nDist)
+	for i := 0; i < len(lengths); {
+		sym, err := d.symbol(lengthCode)
+		if err != nil {
+			return err
+		}
+		if sym < 16 {
+			lengths[i] = uint8(sym)
+			i++
+			continue
+		}
+		var l uint8
+		var rep uint32
+		switch sym {
+		case 16:
+			if i == 0 {
+				return errCorruptCompressed
+			}
+			l = lengths[i-1]
+			rep, err = d.bits(2)
+			rep += 3
+		case 17:
+			rep, err = d.bits(3)
+			rep += 3
+		default:
+			rep, err = d.bits(7)
+			rep += 11
+		}
+		if err != nil {
+			return err
+		}
+		if i+int(rep) > len(lengths) {
+			return errCorruptCompressed
+		}
+		for ; rep > 0; rep-- {
+			lengths[i] = l
+			i++
+		}
+	}
+	if lengths[256] == 0 {
+		// No end of block code.
+		return errCorruptCompressed
+	}
+	litLen, err := newHuffman(lengths[:nLitLen])
+	if err != nil {
+		return err
+	}
+	dist, err := newHuffman(lengths[nLitLen:])
+	if err != nil {
+		return err
+	}
+	return d.codes(litLen, dist)
+}
+
+// huffman is a canonical Huffman code.
+type huffman struct {
+	count  [16]uint16 // number of codes of each length
+	symbol []uint16   // symbols ordered by code
+}
+
+// newHuffman returns the canonical Huffman code of the symbols with the
+// given code lengths, a zero length meaning the symbol is not used.
+// The code may be incomplete but not over-subscribed.
+func newHuffman(lengths []uint8) (*huffman, error) {
+	h := &huffman{symbol: make([]uint16, len(lengths))}
+	for _, l := range lengths {
+		h.count[l]++
+	}
+	left := 1
+	for l := 1; l < len(h.count); l++ {
+		left = left<<1 - int(h.count[l])
+		if left < 0 {
+			return nil, errCorruptCompressed
+		}
+	}
+	var offs [16]uint16
+	for l := 1; l < len(offs)-1; l++ {
+		offs[l+1] = offs[l] + h.count[l]
+	}
+	for s, l := range lengths {
+		if l != 0 {
+			h.symbol[offs[l]] = uint16(s)
+			offs[l]++
+		}
+	}
+	return h, nil
+}
+
+// symbol decodes the next symbol of h, one bit at a time.
+func (d *zlibDecoder) symbol(h *huffman) (int, error) {
+	code, first, index := 0, 0, 0
+	for l := 1; l < len(h.count); l++ {
+		b, err := d.bits(1)
+		if err != nil {
+			return 0, err
+		}
+		code |= int(b)
+		count := int(h.count[l])
+		if code-first < count {
+			return int(h.symbol[index+code-first]), nil
+		}
+		index += count
+		first = (first + count) << 1
+		code <<= 1
+	}
+	return 0, errCorruptCompressed
+}
+
+// fixedLitLen and fixedDist are the codes of the blocks compressed with
+// fixed Huffman codes.
+var fixedLitLen, fixedDist = fixedHuffman()
+
+func fixedHuffman() (*huffman, *huffman) {
+	var lengths [288]uint8
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	litLen, _ := newHuffman(lengths[:])
+	var distLengths [30]uint8
+	for i := range distLengths {
+		distLengths[i] = 5
+	}
+	dist, _ := newHuffman(distLengths[:])
+	return litLen, dist
+}
@@ -24,6 +24,10 @@ const (
 	kexAlgoECDH384          = "ecdh-sha2-nistp384"
 	kexAlgoECDH521          = "ecdh-sha2-nistp521"
 	kexAlgoCurve25519SHA256 = "curve25519-sha256@libssh.org"
+
+	// kexAlgoSNTRUP761X25519SHA512 is not enabled by default: it must be
+	// listed in Config.KeyExchanges to be used.
+	kexAlgoSNTRUP761X25519SHA512 = "sntrup761x25519-sha512@openssh.com"
 )
 
 // kexResult captures the outcome of a key exchange.
@@ -402,6 +406,7 @@ func init() {
 	kexAlgoMap[kexAlgoECDH384] = &ecdh{elliptic.P384()}
 	kexAlgoMap[kexAlgoECDH256] = &ecdh{elliptic.P256()}
 	kexAlgoMap[kexAlgoCurve25519SHA256] = &curve25519sha256{}
+	kexAlgoMap[kexAlgoSNTRUP761X25519SHA512] = &sntrup761x25519sha512{}
 }
 
 // curve25519sha256 implements the curve25519-sha256@libssh.org key
@@ -538,3 +543,143 @@ func (kex *curve25519sha256) Server(c packetConn, rand io.Reader, magics *handsh
 		Hash:      crypto.SHA256,
 	}, nil
 }
+
+// sntrup761x25519sha512 implements the sntrup761x25519-sha512@openssh.com
+// hybrid key agreement protocol of OpenSSH, which combines the sntrup761
+// post-quantum key encapsulation mechanism with curve25519, so that the
+// shared secret stays safe as long as either of them is unbroken. See
+// https://cvsweb.openbsd.org/src/usr.bin/ssh/kexsntrup761x25519.c.
+type sntrup761x25519sha512 struct{}
+
+const (
+	sntrupClientPubSize = sntrupPublicKeySize + 32
+	sntrupServerPubSize = sntrupCiphertextSize + 32
+)
+
+// sntrupSharedSecret returns the shared secret K, as hashed into H: the
+// SHA-512 hash of the two shared keys, encoded as a string.
+func sntrupSharedSecret(kemKey []byte, secret *[32]byte) []byte {
+	h := crypto.SHA512.New()
+	h.Write(kemKey)
+	h.Write(secret[:])
+	return appendString(nil, string(h.Sum(nil)))
+}
+
+func (kex *sntrup761x25519sha512) Client(c packetConn, rand io.Reader, magics *handshakeMagics) (*kexResult, error) {
+	pub, priv, err := sntrupGenerateKey(rand)
+	if err != nil {
+		return nil, err
+	}
+	var kp curve25519KeyPair
+	if err := kp.generate(rand); err != nil {
+		return nil, err
+	}
+	clientPub := append(pub, kp.pub[:]...)
+	if err := c.writePacket(Marshal(&kexECDHInitMsg{clientPub})); err != nil {
+		return nil, err
+	}
+
+	packet, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+
+	var reply kexECDHReplyMsg
+	if err = Unmarshal(packet, &reply); err != nil {
+		return nil, err
+	}
+	if len(reply.EphemeralPubKey) != sntrupServerPubSize {
+		return nil, errors.New("ssh: peer's sntrup761x25519 public value has wrong length")
+	}
+
+	kemKey := sntrupDecapsulate(priv, reply.EphemeralPubKey[:sntrupCiphertextSize])
+	var servPub, secret [32]byte
+	copy(servPub[:], reply.EphemeralPubKey[sntrupCiphertextSize:])
+	curve25519.ScalarMult(&secret, &kp.priv, &servPub)
+	if subtle.ConstantTimeCompare(secret[:], curve25519Zeros[:]) == 1 {
+		return nil, errors.New("ssh: peer's curve25519 public value has wrong order")
+	}
+
+	h := crypto.SHA512.New()
+	magics.write(h)
+	writeString(h, reply.HostKey)
+	writeString(h, clientPub)
+	writeString(h, reply.EphemeralPubKey)
+
+	K := sntrupSharedSecret(kemKey, &secret)
+	h.Write(K)
+
+	return &kexResult{
+		H:         h.Sum(nil),
+		K:         K,
+		HostKey:   reply.HostKey,
+		Signature: reply.Signature,
+		Hash:      crypto.SHA512,
+	}, nil
+}
+
+func (kex *sntrup761x25519sha512) Server(c packetConn, rand io.Reader, magics *handshakeMagics, priv Signer) (result *kexResult, err error) {
+	packet, err := c.readPacket()
+	if err != nil {
+		return
+	}
+	var kexInit kexECDHInitMsg
+	if err = Unmarshal(packet, &kexInit); err != nil {
+		return
+	}
+
+	if len(kexInit.ClientPubKey) != sntrupClientPubSize {
+		return nil, errors.New("ssh: peer's sntrup761x25519 public value has wrong length")
+	}
+
+	ct, kemKey, err := sntrupEncapsulate(rand, kexInit.ClientPubKey[:sntrupPublicKeySize])
+	if err != nil {
+		return nil, err
+	}
+	var kp curve25519KeyPair
+	if err := kp.generate(rand); err != nil {
+		return nil, err
+	}
+
+	var clientPub, secret [32]byte
+	copy(clientPub[:], kexInit.ClientPubKey[sntrupPublicKeySize:])
+	curve25519.ScalarMult(&secret, &kp.priv, &clientPub)
+	if subtle.ConstantTimeCompare(secret[:], curve25519Zeros[:]) == 1 {
+		return nil, errors.New("ssh: peer's curve25519 public value has wrong order")
+	}
+	serverPub := append(ct, kp.pub[:]...)
+
+	hostKeyBytes := priv.PublicKey().Marshal()
+
+	h := crypto.SHA512.New()
+	magics.write(h)
+	writeString(h, hostKeyBytes)
+	writeString(h, kexInit.ClientPubKey)
+	writeString(h, serverPub)
+
+	K := sntrupSharedSecret(kemKey, &secret)
+	h.Write(K)
+
+	H := h.Sum(nil)
+
+	sig, err := signAndMarshal(priv, rand, H)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := kexECDHReplyMsg{
+		EphemeralPubKey: serverPub,
+		HostKey:         hostKeyBytes,
+		Signature:       sig,
+	}
+	if err := c.writePacket(Marshal(&reply)); err != nil {
+		return nil, err
+	}
+	return &kexResult{
+		H:         H,
+		K:         K,
+		HostKey:   hostKeyBytes,
+		Signature: sig,
+		Hash:      crypto.SHA512,
+	}, nil
+}
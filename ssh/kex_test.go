@@ -7,8 +7,14 @@ package ssh
 // Key exchange tests.
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -48,3 +54,91 @@ func TestKexes(t *testing.T) {
 		}
 	}
 }
+
+// replayConn is a packetConn which reads recorded packets, and records
+// the written ones.
+type replayConn struct {
+	in, out [][]byte
+}
+
+func (c *replayConn) writePacket(packet []byte) error {
+	c.out = append(c.out, append([]byte(nil), packet...))
+	return nil
+}
+
+func (c *replayConn) readPacket() ([]byte, error) {
+	if len(c.in) == 0 {
+		return nil, errors.New("no more packets")
+	}
+	p := c.in[0]
+	c.in = c.in[1:]
+	return p, nil
+}
+
+func (c *replayConn) Close() error { return nil }
+
+// readTranscript reads the hex encoded fields of a key exchange recorded
+// in testdata.
+func readTranscript(t *testing.T, name string) map[string][]byte {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fields := make(map[string][]byte)
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<16)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.Fields(line)
+		if len(kv) != 2 {
+			t.Fatalf("%s: malformed line %q", name, line)
+		}
+		if fields[kv[0]], err = hex.DecodeString(kv[1]); err != nil {
+			t.Fatalf("%s: field %s: %v", name, kv[0], err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return fields
+}
+
+func TestSNTRUP761X25519Transcript(t *testing.T) {
+	tr := readTranscript(t, "testdata/sntrup761x25519.txt")
+	magics := handshakeMagics{
+		clientVersion: tr["V_C"],
+		serverVersion: tr["V_S"],
+		clientKexInit: tr["I_C"],
+		serverKexInit: tr["I_S"],
+	}
+	c := &replayConn{in: [][]byte{tr["init"]}}
+	random := &hashReader{seed: "sntrup761x25519 transcript"}
+	res, err := kexAlgoMap[kexAlgoSNTRUP761X25519SHA512].Server(c, random, &magics, testSigners["ed25519"])
+	if err != nil {
+		t.Fatalf("Server: %v", err)
+	}
+	if len(c.out) != 1 || !bytes.Equal(c.out[0], tr["reply"]) {
+		t.Errorf("server reply does not match the transcript")
+	}
+	if !bytes.Equal(res.H, tr["H"]) {
+		t.Errorf("got H %x, want %x", res.H, tr["H"])
+	}
+	if !bytes.Equal(res.K, tr["K"]) {
+		t.Errorf("got K %x, want %x", res.K, tr["K"])
+	}
+
+	// The client rejects a truncated reply.
+	var reply kexECDHReplyMsg
+	if err := Unmarshal(tr["reply"], &reply); err != nil {
+		t.Fatal(err)
+	}
+	reply.EphemeralPubKey = reply.EphemeralPubKey[:sntrupCiphertextSize]
+	c = &replayConn{in: [][]byte{Marshal(&reply)}}
+	if _, err := kexAlgoMap[kexAlgoSNTRUP761X25519SHA512].Client(c, random, &magics); err == nil {
+		t.Error("Client accepted a reply without a curve25519 public value")
+	}
+}
@@ -700,6 +700,41 @@ func NewSignerFromKey(key interface{}) (Signer, error) {
 	}
 }
 
+// SignerOptions configures the Signers returned by NewSignerWithOpts.
+type SignerOptions struct {
+	// DeterministicECDSA makes ECDSA keys produce deterministic signatures,
+	// as specified in RFC 6979, instead of using a random nonce. The same
+	// data then always has the same signature, which is useful for tests
+	// and reproducible outputs. The signatures verify like any other.
+	// Unlike those of crypto/ecdsa, they are not computed in constant time.
+	//
+	// It requires key to be an *ecdsa.PrivateKey and has no effect on
+	// other key types.
+	DeterministicECDSA bool
+}
+
+// NewSignerWithOpts is like NewSignerFromKey but configures the returned
+// Signer with opts, which may be nil.
+func NewSignerWithOpts(key interface{}, opts *SignerOptions) (Signer, error) {
+	if opts == nil || !opts.DeterministicECDSA {
+		return NewSignerFromKey(key)
+	}
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		s, err := NewSignerFromSigner(key)
+		if err != nil {
+			return nil, err
+		}
+		s.(*wrappedSigner).deterministic = true
+		return s, nil
+	case crypto.Signer:
+		if _, ok := key.Public().(*ecdsa.PublicKey); ok {
+			return nil, fmt.Errorf("ssh: deterministic ECDSA signatures need an *ecdsa.PrivateKey, got %T", key)
+		}
+	}
+	return NewSignerFromKey(key)
+}
+
 func newDSAPrivateKey(key *dsa.PrivateKey) (Signer, error) {
 	if err := checkDSAParams(&key.PublicKey.Parameters); err != nil {
 		return nil, err
@@ -711,6 +746,10 @@ func newDSAPrivateKey(key *dsa.PrivateKey) (Signer, error) {
 type wrappedSigner struct {
 	signer crypto.Signer
 	pubKey PublicKey
+
+	// deterministic is set for an *ecdsa.PrivateKey signer
+	// producing RFC 6979 signatures.
+	deterministic bool
 }
 
 // NewSignerFromSigner takes any crypto.Signer implementation and
@@ -722,7 +761,7 @@ func NewSignerFromSigner(signer crypto.Signer) (Signer, error) {
 		return nil, err
 	}
 
-	return &wrappedSigner{signer, pubKey}, nil
+	return &wrappedSigner{signer: signer, pubKey: pubKey}, nil
 }
 
 func (s *wrappedSigner) PublicKey() PublicKey {
@@ -777,6 +816,16 @@ func (s *wrappedSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm
 		digest = data
 	}
 
+	if s.deterministic {
+		r, sigS, err := signRFC6979(s.signer.(*ecdsa.PrivateKey), digest, hashFunc)
+		if err != nil {
+			return nil, err
+		}
+		return &Signature{
+			Format: algorithm,
+			Blob:   Marshal(struct{ R, S *big.Int }{r, sigS}),
+		}, nil
+	}
 	signature, err := s.signer.Sign(rand, digest, hashFunc)
 	if err != nil {
 		return nil, err
@@ -868,7 +917,8 @@ func encryptedBlock(block *pem.Block) bool {
 }
 
 // ParseRawPrivateKey returns a private key from a PEM encoded private key. It
-// supports RSA (PKCS#1), PKCS#8, DSA (OpenSSL), and ECDSA private keys.
+// supports RSA (PKCS#1), PKCS#8, DSA (OpenSSL), and ECDSA private keys. If the
+// private key is an encrypted PKCS#8 key, it returns a *PassphraseMissingError.
 func ParseRawPrivateKey(pemBytes []byte) (interface{}, error) {
 	block, _ := pem.Decode(pemBytes)
 	if block == nil {
@@ -891,6 +941,8 @@ func ParseRawPrivateKey(pemBytes []byte) (interface{}, error) {
 		return ParseDSAPrivateKey(block.Bytes)
 	case "OPENSSH PRIVATE KEY":
 		return parseOpenSSHPrivateKey(block.Bytes)
+	case "ENCRYPTED PRIVATE KEY":
+		return nil, &PassphraseMissingError{}
 	default:
 		return nil, fmt.Errorf("ssh: unsupported key type %q", block.Type)
 	}
@@ -898,7 +950,9 @@ func ParseRawPrivateKey(pemBytes []byte) (interface{}, error) {
 
 // ParseRawPrivateKeyWithPassphrase returns a private key decrypted with
 // passphrase from a PEM encoded private key. If wrong passphrase, return
-// x509.IncorrectPasswordError.
+// x509.IncorrectPasswordError. It also supports the PKCS#8 keys encrypted
+// with PBES2, using PBKDF2 and AES-CBC or AES-GCM, for which an empty
+// passphrase returns a *PassphraseMissingError.
 func ParseRawPrivateKeyWithPassphrase(pemBytes, passPhrase []byte) (interface{}, error) {
 	block, _ := pem.Decode(pemBytes)
 	if block == nil {
@@ -928,6 +982,9 @@ func ParseRawPrivateKeyWithPassphrase(pemBytes, passPhrase []byte) (interface{},
 		return ParseDSAPrivateKey(buf)
 	case "OPENSSH PRIVATE KEY":
 		return parseOpenSSHPrivateKey(buf)
+	// RFC5208 - https://tools.ietf.org/html/rfc5208
+	case "ENCRYPTED PRIVATE KEY":
+		return parseEncryptedPKCS8PrivateKey(buf, passPhrase)
 	default:
 		return nil, fmt.Errorf("ssh: unsupported key type %q", block.Type)
 	}
@@ -1098,3 +1155,140 @@ func FingerprintSHA256(pubKey PublicKey) string {
 	hash := base64.RawStdEncoding.EncodeToString(sha256sum[:])
 	return "SHA256:" + hash
 }
+
+// Fingerprints holds the user presentations of the fingerprint of a key,
+// as printed by ssh-keygen -lv.
+type Fingerprints struct {
+	// SHA256 is the fingerprint as returned by FingerprintSHA256.
+	SHA256 string
+
+	// MD5 is the fingerprint as returned by FingerprintLegacyMD5.
+	MD5 string
+
+	// RandomArt is the OpenSSH visual host key of the SHA256 fingerprint,
+	// the lines of which are separated by newlines.
+	RandomArt string
+}
+
+// FingerprintAll returns the fingerprint of pubKey in all the formats
+// recognized by OpenSSH users, for instance to have them verify a host key
+// out-of-band.
+//
+// The fingerprints of a *Certificate are those of the whole certificate,
+// as with FingerprintSHA256, while ssh-keygen prints those of its key;
+// pass cert.Key to get the latter.
+func FingerprintAll(pubKey PublicKey) Fingerprints {
+	sha256sum := sha256.Sum256(pubKey.Marshal())
+	return Fingerprints{
+		SHA256:    "SHA256:" + base64.RawStdEncoding.EncodeToString(sha256sum[:]),
+		MD5:       FingerprintLegacyMD5(pubKey),
+		RandomArt: randomArt(sha256sum[:], "SHA256", pubKey),
+	}
+}
+
+// Dimensions of the randomart field, as in OpenSSH.
+const (
+	randomArtBase   = 8
+	randomArtHeight = randomArtBase + 1
+	randomArtWidth  = randomArtBase*2 + 1
+)
+
+// randomArt renders the digest dgst of pubKey, computed with the hash
+// named alg, as OpenSSH does: a bishop starts at the center of the field
+// and moves diagonally, two bits of dgst at a time, leaving more coins on
+// the squares it visits more often. See "The drunken bishop: An analysis
+// of the OpenSSH fingerprint visualization algorithm" by Dirk Loss et al.
+func randomArt(dgst []byte, alg string, pubKey PublicKey) string {
+	const augmentation = " .o+=*BOX@%&#/^SE"
+	const n = len(augmentation) - 1
+
+	var field [randomArtWidth][randomArtHeight]int
+	x, y := randomArtWidth/2, randomArtHeight/2
+	for _, input := range dgst {
+		for b := 0; b < 4; b++ {
+			if input&1 != 0 {
+				x++
+			} else {
+				x--
+			}
+			if input&2 != 0 {
+				y++
+			} else {
+				y--
+			}
+			x = clamp(x, randomArtWidth-1)
+			y = clamp(y, randomArtHeight-1)
+			// The last two symbols mark the start and the end.
+			if field[x][y] < n-2 {
+				field[x][y]++
+			}
+			input >>= 2
+		}
+	}
+	field[randomArtWidth/2][randomArtHeight/2] = n - 1
+	field[x][y] = n
+
+	name, size := randomArtKeyType(pubKey)
+	title := fmt.Sprintf("[%s %d]", name, size)
+	if len(title) > randomArtWidth {
+		title = "[" + name + "]"
+	}
+	if len(title) >= randomArtWidth {
+		// OpenSSH truncates the title to its buffer.
+		title = title[:randomArtWidth-1]
+	}
+
+	var buf strings.Builder
+	randomArtBorder(&buf, title)
+	buf.WriteByte('\n')
+	for y := 0; y < randomArtHeight; y++ {
+		buf.WriteByte('|')
+		for x := 0; x < randomArtWidth; x++ {
+			buf.WriteByte(augmentation[clamp(field[x][y], n)])
+		}
+		buf.WriteString("|\n")
+	}
+	randomArtBorder(&buf, "["+alg+"]")
+	return buf.String()
+}
+
+// clamp returns v limited to the range [0, hi].
+func clamp(v, hi int) int {
+	if v < 0 {
+		return 0
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// randomArtBorder writes a border of the randomart field with label in its
+// middle.
+func randomArtBorder(buf *strings.Builder, label string) {
+	pad := (randomArtWidth - len(label)) / 2
+	buf.WriteByte('+')
+	buf.WriteString(strings.Repeat("-", pad))
+	buf.WriteString(label)
+	buf.WriteString(strings.Repeat("-", randomArtWidth-pad-len(label)))
+	buf.WriteByte('+')
+}
+
+// randomArtKeyType returns the name and size of pubKey printed in the
+// title of its randomart, as OpenSSH names them.
+func randomArtKeyType(pubKey PublicKey) (string, int) {
+	switch k := pubKey.(type) {
+	case *rsaPublicKey:
+		return "RSA", k.N.BitLen()
+	case *dsaPublicKey:
+		return "DSA", k.P.BitLen()
+	case *ecdsaPublicKey:
+		return "ECDSA", k.Params().BitSize
+	case ed25519PublicKey:
+		return "ED25519", 256
+	case *Certificate:
+		name, size := randomArtKeyType(k.Key)
+		return name + "-CERT", size
+	}
+	return "unknown", 0
+}
@@ -6,6 +6,7 @@ package ssh
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/dsa"
 	"crypto/ecdsa"
 	"crypto/elliptic"
@@ -16,9 +17,11 @@ import (
 	"encoding/pem"
 	"fmt"
 	"io"
+	"math/big"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/robarchibald/crypto/ed25519"
 	"github.com/robarchibald/crypto/ssh/testdata"
@@ -152,6 +155,88 @@ func TestKeySignWithAlgorithmVerify(t *testing.T) {
 	}
 }
 
+func TestDeterministicECDSA(t *testing.T) {
+	data := []byte("sign me")
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		raw, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatalf("GenerateKey: %v", err)
+		}
+		for _, deterministic := range []bool{false, true} {
+			priv, err := NewSignerWithOpts(raw, &SignerOptions{DeterministicECDSA: deterministic})
+			if err != nil {
+				t.Fatalf("NewSignerWithOpts: %v", err)
+			}
+			sig1, err := priv.Sign(rand.Reader, data)
+			if err != nil {
+				t.Fatalf("Sign: %v", err)
+			}
+			sig2, err := priv.Sign(rand.Reader, data)
+			if err != nil {
+				t.Fatalf("Sign: %v", err)
+			}
+			for _, sig := range []*Signature{sig1, sig2} {
+				if err := priv.PublicKey().Verify(data, sig); err != nil {
+					t.Errorf("%s, deterministic %v: Verify: %v", curve.Params().Name, deterministic, err)
+				}
+			}
+			if same := bytes.Equal(sig1.Blob, sig2.Blob); same != deterministic {
+				t.Errorf("%s, deterministic %v: identical signatures = %v", curve.Params().Name, deterministic, same)
+			}
+		}
+	}
+}
+
+// The test vectors of RFC 6979, appendix A.2.5.
+func TestDeterministicECDSAVectors(t *testing.T) {
+	d, _ := new(big.Int).SetString("C9AFA9D845BA75166B5C215767B1D6934E50C3DB36E89B127B8A622B120F6721", 16)
+	priv := &ecdsa.PrivateKey{D: d}
+	priv.Curve = elliptic.P256()
+	priv.X, priv.Y = priv.Curve.ScalarBaseMult(d.Bytes())
+	for _, tt := range []struct {
+		msg, r, s string
+	}{
+		{"sample", "EFD48B2AACB6A8FD1140DD9CD45E81D69D2C877B56AAF991C34D0EA84EAF3716", "F7CB1C942D657C41D436C7A1B6E29F65F3E900DBB9AFF4064DC4AB2F843ACDA8"},
+		{"test", "F1ABB023518351CD71D881567B1EA663ED3EFCF6C5132B354F28D3B0B7D38367", "019F4113742A2B14BD25926B49C649155F267E60D3814B4C0CC84250E46F0083"},
+	} {
+		signer, err := NewSignerWithOpts(priv, &SignerOptions{DeterministicECDSA: true})
+		if err != nil {
+			t.Fatalf("NewSignerWithOpts: %v", err)
+		}
+		sig, err := signer.Sign(rand.Reader, []byte(tt.msg))
+		if err != nil {
+			t.Fatalf("Sign: %v", err)
+		}
+		var rs struct{ R, S *big.Int }
+		if err := Unmarshal(sig.Blob, &rs); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		if r := fmt.Sprintf("%064X", rs.R); r != tt.r {
+			t.Errorf("%q: r = %s, want %s", tt.msg, r, tt.r)
+		}
+		if s := fmt.Sprintf("%064X", rs.S); s != tt.s {
+			t.Errorf("%q: s = %s, want %s", tt.msg, s, tt.s)
+		}
+	}
+}
+
+type opaqueSigner struct{ crypto.Signer }
+
+func TestDeterministicECDSAUnsupportedSigner(t *testing.T) {
+	raw, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	opts := &SignerOptions{DeterministicECDSA: true}
+	if _, err := NewSignerWithOpts(opaqueSigner{raw}, opts); err == nil {
+		t.Error("NewSignerWithOpts succeeded with an opaque ECDSA signer")
+	}
+	// Other key types are not affected.
+	if _, err := NewSignerWithOpts(testPrivateKeys["ed25519"], opts); err != nil {
+		t.Errorf("NewSignerWithOpts(ed25519): %v", err)
+	}
+}
+
 func TestParseRSAPrivateKey(t *testing.T) {
 	key := testPrivateKeys["rsa"]
 
@@ -395,6 +480,73 @@ func TestInvalidEntry(t *testing.T) {
 	}
 }
 
+func TestParseAuthorizedKeys(t *testing.T) {
+	pub, pubSerialized := getTestKey()
+	in := strings.Join([]string{
+		`# comment`,
+		``,
+		`ssh-rsa ` + pubSerialized + ` user@host`,
+		`command="echo \"hi, there\"",no-pty,environment="HOME=/home/root dir",environment="LANG=C"` + "\t" + `ssh-rsa ` + pubSerialized + ` user2@host`,
+		`restrict,PTY,from="*.example.com,!bad.example.com",permitopen="localhost:80",expiry-time="20300102Z" ssh-rsa ` + pubSerialized,
+		`cert-authority,principals="alice,bob" ssh-rsa ` + pubSerialized + "\r",
+	}, "\n")
+	keys, err := ParseAuthorizedKeys([]byte(in))
+	if err != nil {
+		t.Fatalf("ParseAuthorizedKeys: %v", err)
+	}
+	want := []AuthorizedKey{
+		{PublicKey: pub, Comment: "user@host"},
+		{PublicKey: pub, Comment: "user2@host", Options: AuthorizedKeyOptions{
+			Command:     `echo "hi, there"`,
+			NoPTY:       true,
+			Environment: []string{"HOME=/home/root dir", "LANG=C"},
+		}},
+		{PublicKey: pub, Options: AuthorizedKeyOptions{
+			NoAgentForwarding: true,
+			NoPortForwarding:  true,
+			NoUserRC:          true,
+			NoX11Forwarding:   true,
+			From:              []string{"*.example.com", "!bad.example.com"},
+			PermitOpen:        []string{"localhost:80"},
+			ExpiryTime:        time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC),
+		}},
+		{PublicKey: pub, Options: AuthorizedKeyOptions{
+			CertAuthority: true,
+			Principals:    []string{"alice", "bob"},
+		}},
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("got %#v, want %#v", keys, want)
+	}
+}
+
+func TestParseAuthorizedKeysErrors(t *testing.T) {
+	_, pubSerialized := getTestKey()
+	key := " ssh-rsa " + pubSerialized + " user@host"
+	for _, tt := range []struct {
+		line, err string
+	}{
+		{"ssh-rsa", "missing key"},
+		{"ssh-rsa data-that-will-not-parse", "illegal base64"},
+		{`command="ls` + key, "missing closing quote"},
+		{`no-pty,,no-user-rc` + key, "empty option"},
+		{`no-pty, no-user-rc` + key, "empty option"},
+		{`command=ls` + key, "unquoted value"},
+		{`command` + key, "missing value"},
+		{`no-pty="yes"` + key, "takes no value"},
+		{`shared-control` + key, "unknown option"},
+		{`environment="HOME"` + key, "invalid environment"},
+		{`expiry-time="2030"` + key, "invalid expiry-time"},
+		{`no-pty`, "missing key"},
+	} {
+		in := "# comment\nssh-rsa " + pubSerialized + "\n" + tt.line + "\n"
+		_, err := ParseAuthorizedKeys([]byte(in))
+		if err == nil || !strings.Contains(err.Error(), tt.err) || !strings.Contains(err.Error(), "line 3") {
+			t.Errorf("ParseAuthorizedKeys(%q): %v; want an error on line 3 containing %q", tt.line, err, tt.err)
+		}
+	}
+}
+
 var knownHostsParseTests = []struct {
 	input string
 	err   string
@@ -544,6 +696,66 @@ func TestFingerprintSHA256(t *testing.T) {
 	}
 }
 
+func TestFingerprintAll(t *testing.T) {
+	// ssh-keygen -lv -f key; ssh-keygen -l -E md5 -f key
+	tests := []struct {
+		key  string
+		want Fingerprints
+	}{
+		{"rsa", Fingerprints{
+			SHA256: "SHA256:Anr3LjZK8YVpjrxu79myrW9Hrb/wpcMNpVvTq/RcBm8",
+			MD5:    "fb:61:6d:1a:e3:f0:95:45:3c:a0:79:be:4a:93:63:66",
+			RandomArt: `+---[RSA 1024]----+
+|                 |
+|                 |
+|    .            |
+|   . . o      .  |
+|  . o * S  . o.. |
+|   o B +  . + oo.|
+|    + o ...o *..E|
+|   ...==. oo=o++.|
+|   o+=*O=. .=+.o |
++----[SHA256]-----+`,
+		}},
+		{"ed25519", Fingerprints{
+			SHA256: "SHA256:mV1mPX4S6TE+odyfWDXGrC5fvQbLh+w8o2NK3q2MmYw",
+			MD5:    "85:0f:3d:13:3b:c7:a0:5c:91:bb:94:07:22:08:13:44",
+			RandomArt: `+--[ED25519 256]--+
+|                 |
+|             .o. |
+|            + O=.|
+|         + = *o*o|
+|        S . o.B..|
+|            ..o=o|
+|         . .oo+oo|
+|        = *o=B.o.|
+|       E Bo====. |
++----[SHA256]-----+`,
+		}},
+	}
+	for _, test := range tests {
+		got := FingerprintAll(testPublicKeys[test.key])
+		if got != test.want {
+			t.Errorf("%s: got fingerprints\n%+v\nwant\n%+v", test.key, got, test.want)
+		}
+	}
+}
+
+func TestFingerprintAllCert(t *testing.T) {
+	cert := &Certificate{
+		Key:         testPublicKeys["ecdsa"],
+		CertType:    UserCert,
+		ValidBefore: CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, testSigners["ca"]); err != nil {
+		t.Fatal(err)
+	}
+	art := FingerprintAll(cert).RandomArt
+	if want := "+[ECDSA-CERT 256]-+\n"; !strings.HasPrefix(art, want) {
+		t.Errorf("got randomart\n%s\nwant title %q", art, want)
+	}
+}
+
 func TestInvalidKeys(t *testing.T) {
 	keyTypes := []string{
 		"RSA PRIVATE KEY",
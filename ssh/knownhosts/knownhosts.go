@@ -415,6 +415,22 @@ func (db *hostKeyDB) Read(r io.Reader, filename string) error {
 // IP address, the host key check will still succeed, even though a
 // record of the new IP address is not available.
 func New(files ...string) (ssh.HostKeyCallback, error) {
+	db, err := NewDB(files...)
+	if err != nil {
+		return nil, err
+	}
+	return db.HostKeyCallback(), nil
+}
+
+// DB is a host key database read from OpenSSH host key files.
+type DB struct {
+	db *hostKeyDB
+}
+
+// NewDB reads the given OpenSSH host key files into a DB, providing both
+// the host key callback New returns and the host key algorithms to
+// request from the hosts.
+func NewDB(files ...string) (*DB, error) {
 	db := newHostKeyDB()
 	for _, fn := range files {
 		f, err := os.Open(fn)
@@ -426,13 +442,65 @@ func New(files ...string) (ssh.HostKeyCallback, error) {
 			return nil, err
 		}
 	}
+	return &DB{db: db}, nil
+}
 
+// HostKeyCallback returns the host key callback checking the host keys
+// against db, as returned by New.
+func (db *DB) HostKeyCallback() ssh.HostKeyCallback {
 	var certChecker ssh.CertChecker
-	certChecker.IsHostAuthority = db.IsHostAuthority
-	certChecker.IsRevoked = db.IsRevoked
-	certChecker.HostKeyFallback = db.check
+	certChecker.IsHostAuthority = db.db.IsHostAuthority
+	certChecker.IsRevoked = db.db.IsRevoked
+	certChecker.HostKeyFallback = db.db.check
+	return certChecker.CheckHostKey
+}
+
+// HostKeyAlgorithms returns the host key algorithms for
+// ssh.ClientConfig.HostKeyAlgorithms to connect to address, a "host:port"
+// pair or a host: ssh.DefaultHostKeyAlgorithms, with the algorithms of the
+// keys db lists for address first, and those of the certificates signed by
+// the authorities it lists for address before them. A server offering
+// several types of host keys then presents one which is known, rather than
+// one of another type the host key callback would report as a mismatch,
+// as OpenSSH does.
+func (db *DB) HostKeyAlgorithms(address string) []string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = address, "22"
+	}
+	a := addr{host: host, port: port}
+	known := make(map[string]bool)
+	for _, l := range db.db.lines {
+		if !l.match(a) {
+			continue
+		}
+		typ := l.knownKey.Key.Type()
+		if l.cert {
+			typ = certAlgos[typ]
+		}
+		known[typ] = true
+	}
 
-	return certChecker.CheckHostKey, nil
+	var first, rest []string
+	for _, algo := range ssh.DefaultHostKeyAlgorithms() {
+		if known[algo] {
+			first = append(first, algo)
+		} else {
+			rest = append(rest, algo)
+		}
+	}
+	return append(first, rest...)
+}
+
+// certAlgos maps the key types of the certificate authorities to the
+// algorithms of the host certificates they sign.
+var certAlgos = map[string]string{
+	ssh.KeyAlgoRSA:      ssh.CertAlgoRSAv01,
+	ssh.KeyAlgoDSA:      ssh.CertAlgoDSAv01,
+	ssh.KeyAlgoECDSA256: ssh.CertAlgoECDSA256v01,
+	ssh.KeyAlgoECDSA384: ssh.CertAlgoECDSA384v01,
+	ssh.KeyAlgoECDSA521: ssh.CertAlgoECDSA521v01,
+	ssh.KeyAlgoED25519:  ssh.CertAlgoED25519v01,
 }
 
 // Normalize normalizes an address into the form used in known_hosts
@@ -461,6 +529,16 @@ func Line(addresses []string, key ssh.PublicKey) string {
 	return strings.Join(trimmed, ",") + " " + serialize(key)
 }
 
+// HashedLine returns a line to append to the known_hosts files, in which
+// the address is hashed as done by OpenSSH with the HashKnownHosts option.
+// The address is normalized before hashing.
+//
+// OpenSSH only matches hashed hostnames which are alone on their line, so
+// each address of a host, such as its name and IP address, needs its own line.
+func HashedLine(address string, key ssh.PublicKey) string {
+	return HashHostname(Normalize(address)) + " " + serialize(key)
+}
+
 // HashHostname hashes the given hostname. The hostname is not
 // normalized before hashing.
 func HashHostname(hostname string) string {
@@ -6,11 +6,18 @@ package knownhosts
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/robarchibald/crypto/ed25519"
 	"github.com/robarchibald/crypto/ssh"
 )
 
@@ -319,6 +326,33 @@ func testHostHash(t *testing.T, hostname, encoded string) {
 	}
 }
 
+func TestHashedLine(t *testing.T) {
+	for address, dial := range map[string]string{
+		"server.org":                             "server.org:22",
+		"server.org:22":                          "server.org:22",
+		"server.org:23":                          "server.org:23",
+		"[c629:1ec4:102:304:102:304:102:304]:23": "[c629:1ec4:102:304:102:304:102:304]:23",
+	} {
+		line := HashedLine(address, edKey)
+		if !strings.HasPrefix(line, "|1|") || !strings.HasSuffix(line, " "+edKeyStr) {
+			t.Errorf("HashedLine(%q) = %q; want hashed host and key", address, line)
+		}
+		if strings.Contains(line, "server.org") || strings.Contains(line, "c629") {
+			t.Errorf("HashedLine(%q) = %q contains the address", address, line)
+		}
+		hash, _ := nextWord([]byte(line))
+		testHostHash(t, Normalize(address), hash)
+
+		db := testDB(t, line)
+		if err := db.check(dial, testAddr, edKey); err != nil {
+			t.Errorf("check(%q): %v", dial, err)
+		}
+		if err := db.check("other.org:23", testAddr, edKey); err == nil {
+			t.Errorf("check(%q) of another host succeeded", address)
+		}
+	}
+}
+
 func TestNormalize(t *testing.T) {
 	for in, want := range map[string]string{
 		"127.0.0.1:22":             "127.0.0.1",
@@ -354,3 +388,111 @@ func TestHashedHostkeyCheck(t *testing.T) {
 		t.Errorf("got error %v, want %v", got, want)
 	}
 }
+
+func TestHostKeyAlgorithms(t *testing.T) {
+	db := &DB{db: testDB(t, "server.org "+edKeyStr+"\n"+
+		"@cert-authority *.example.org "+ecKeyStr+"\n")}
+	defaults := ssh.DefaultHostKeyAlgorithms()
+	for _, tt := range []struct {
+		address string
+		first   []string
+	}{
+		{"server.org:22", []string{ssh.KeyAlgoED25519}},
+		{"server.org", []string{ssh.KeyAlgoED25519}},
+		{"host.example.org:22", []string{ssh.CertAlgoECDSA256v01}},
+		{"unknown.org:22", nil},
+	} {
+		got := db.HostKeyAlgorithms(tt.address)
+		want := append([]string(nil), tt.first...)
+		for _, algo := range defaults {
+			if len(tt.first) == 0 || algo != tt.first[0] {
+				want = append(want, algo)
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("HostKeyAlgorithms(%q) = %q; want %q", tt.address, got, want)
+		}
+	}
+}
+
+func TestHostKeyAlgorithmsHandshake(t *testing.T) {
+	_, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edSigner, err := ssh.NewSignerFromKey(edPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecSigner, err := ssh.NewSignerFromKey(ecPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server offers both keys, and only its ed25519 key is known.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	serverConf := &ssh.ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(ecSigner)
+	serverConf.AddHostKey(edSigner)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				ssh.NewServerConn(c, serverConf)
+			}()
+		}
+	}()
+
+	fn := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(fn, []byte(Line([]string{l.Addr().String()}, edSigner.PublicKey())+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDB(fn)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+
+	dial := func(algos []string) (string, error) {
+		var got string
+		callback := db.HostKeyCallback()
+		conn, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			HostKeyAlgorithms: algos,
+			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				got = key.Type()
+				return callback(hostname, remote, key)
+			},
+		})
+		if err == nil {
+			conn.Close()
+		}
+		return got, err
+	}
+
+	// By default, the server presents its ECDSA key, which is unknown.
+	if _, err := dial(nil); err == nil {
+		t.Fatal("Dial with the default host key algorithms succeeded")
+	}
+	algos := db.HostKeyAlgorithms(l.Addr().String())
+	if len(algos) == 0 || algos[0] != ssh.KeyAlgoED25519 {
+		t.Fatalf("HostKeyAlgorithms = %q; want %s first", algos, ssh.KeyAlgoED25519)
+	}
+	got, err := dial(algos)
+	if err != nil {
+		t.Fatalf("Dial with HostKeyAlgorithms: %v", err)
+	}
+	if got != ssh.KeyAlgoED25519 {
+		t.Errorf("server presented a %s host key; want %s", got, ssh.KeyAlgoED25519)
+	}
+}
@@ -0,0 +1,431 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// krlMagic starts the KRLs, followed by the format version krlFormatVersion.
+const (
+	krlMagic         = "SSHKRL\n\x00"
+	krlFormatVersion = 1
+)
+
+// The sections of a KRL.
+const (
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSHA256 = 5
+)
+
+// The subsections of a krlSectionCertificates section.
+const (
+	krlSectionCertSerialList   = 0x20
+	krlSectionCertSerialRange  = 0x21
+	krlSectionCertSerialBitmap = 0x22
+	krlSectionCertKeyID        = 0x23
+)
+
+// KRL is an OpenSSH Key Revocation List, as created by "ssh-keygen -k" and
+// used by the RevokedKeys option of sshd, in the format described in the
+// PROTOCOL.krl file of the OpenSSH sources. Its IsRevokedCert method may be
+// used as the IsRevoked function of a CertChecker.
+type KRL struct {
+	// Version is the version of the KRL, increased with each update.
+	Version uint64
+
+	// GeneratedDate is the time the KRL was generated, in seconds,
+	// or the zero time if unknown.
+	GeneratedDate time.Time
+
+	Comment string
+
+	// Certificates lists the certificates revoked, by CA.
+	Certificates []KRLCertificates
+
+	// Keys lists the keys revoked. The certificates for them are revoked too.
+	Keys []PublicKey
+
+	// SHA1Hashes and SHA256Hashes list the hashes of the wire encoding
+	// of revoked keys, as in their fingerprints.
+	SHA1Hashes   [][sha1.Size]byte
+	SHA256Hashes [][sha256.Size]byte
+}
+
+// KRLCertificates lists the certificates a KRL revokes among those signed
+// by a CA, by serial number or by key ID.
+type KRLCertificates struct {
+	// CA is the key which signed the certificates. If nil, the certificates
+	// are revoked whatever CA signed them; OpenSSH only creates such
+	// sections to revoke key IDs.
+	CA PublicKey
+
+	// Serials lists the ranges of the serial numbers revoked, sorted by
+	// ParseKRL. The certificates with serial number zero cannot be revoked
+	// by serial.
+	Serials []KRLSerialRange
+
+	// KeyIDs lists the key IDs revoked.
+	KeyIDs []string
+}
+
+// KRLSerialRange is the range of serial numbers from First to Last, included.
+type KRLSerialRange struct {
+	First, Last uint64
+}
+
+// ParseKRL parses an OpenSSH Key Revocation List. The signatures of the
+// KRL, if any, are ignored: OpenSSH no longer creates them.
+func ParseKRL(in []byte) (*KRL, error) {
+	if !bytes.HasPrefix(in, []byte(krlMagic)) {
+		return nil, errors.New("ssh: not a KRL")
+	}
+	in = in[len(krlMagic):]
+	var header struct {
+		FormatVersion uint32
+		Version       uint64
+		GeneratedDate uint64
+		Flags         uint64
+		Reserved      []byte
+		Comment       string
+		Rest          []byte `ssh:"rest"`
+	}
+	if err := Unmarshal(in, &header); err != nil {
+		return nil, errors.New("ssh: invalid KRL header")
+	}
+	if header.FormatVersion != krlFormatVersion {
+		return nil, fmt.Errorf("ssh: unsupported KRL format version %d", header.FormatVersion)
+	}
+	k := &KRL{
+		Version: header.Version,
+		Comment: header.Comment,
+	}
+	if header.GeneratedDate != 0 {
+		k.GeneratedDate = time.Unix(int64(header.GeneratedDate), 0)
+	}
+
+	in = header.Rest
+	for len(in) > 0 {
+		typ := in[0]
+		data, rest, ok := parseString(in[1:])
+		if !ok {
+			return nil, errors.New("ssh: truncated KRL section")
+		}
+		in = rest
+		var err error
+		switch typ {
+		case krlSectionCertificates:
+			err = k.parseCertificates(data)
+		case krlSectionExplicitKey:
+			err = parseKRLStrings(data, func(b []byte) error {
+				key, err := ParsePublicKey(b)
+				if err != nil {
+					return err
+				}
+				k.Keys = append(k.Keys, key)
+				return nil
+			})
+		case krlSectionFingerprintSHA1:
+			err = parseKRLStrings(data, func(b []byte) error {
+				var h [sha1.Size]byte
+				if len(b) != len(h) {
+					return errors.New("ssh: invalid SHA-1 hash in KRL")
+				}
+				copy(h[:], b)
+				k.SHA1Hashes = append(k.SHA1Hashes, h)
+				return nil
+			})
+		case krlSectionFingerprintSHA256:
+			err = parseKRLStrings(data, func(b []byte) error {
+				var h [sha256.Size]byte
+				if len(b) != len(h) {
+					return errors.New("ssh: invalid SHA-256 hash in KRL")
+				}
+				copy(h[:], b)
+				k.SHA256Hashes = append(k.SHA256Hashes, h)
+				return nil
+			})
+		case krlSectionSignature:
+			// The signatures come last.
+			return k, nil
+		default:
+			return nil, fmt.Errorf("ssh: unknown KRL section %d", typ)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// parseCertificates parses the data of a krlSectionCertificates section.
+func (k *KRL) parseCertificates(data []byte) error {
+	var section struct {
+		CA       []byte
+		Reserved []byte
+		Rest     []byte `ssh:"rest"`
+	}
+	if err := Unmarshal(data, &section); err != nil {
+		return errors.New("ssh: invalid KRL certificates section")
+	}
+	var c KRLCertificates
+	if len(section.CA) > 0 {
+		ca, err := ParsePublicKey(section.CA)
+		if err != nil {
+			return err
+		}
+		c.CA = ca
+	}
+
+	in := section.Rest
+	for len(in) > 0 {
+		typ := in[0]
+		data, rest, ok := parseString(in[1:])
+		if !ok {
+			return errors.New("ssh: truncated KRL certificates section")
+		}
+		in = rest
+		switch typ {
+		case krlSectionCertSerialList:
+			for len(data) > 0 {
+				var serial uint64
+				if serial, data, ok = parseUint64(data); !ok {
+					return errors.New("ssh: invalid KRL serial list")
+				}
+				c.Serials = append(c.Serials, KRLSerialRange{serial, serial})
+			}
+		case krlSectionCertSerialRange:
+			for len(data) > 0 {
+				var r KRLSerialRange
+				if r.First, data, ok = parseUint64(data); !ok {
+					return errors.New("ssh: invalid KRL serial range")
+				}
+				if r.Last, data, ok = parseUint64(data); !ok || r.Last < r.First {
+					return errors.New("ssh: invalid KRL serial range")
+				}
+				c.Serials = append(c.Serials, r)
+			}
+		case krlSectionCertSerialBitmap:
+			offset, data, ok := parseUint64(data)
+			if !ok {
+				return errors.New("ssh: invalid KRL serial bitmap")
+			}
+			bitmap, data, ok := parseInt(data)
+			if !ok || len(data) > 0 || bitmap.Sign() < 0 || bitmap.BitLen() > 0 && uint64(bitmap.BitLen()-1) > ^uint64(0)-offset {
+				return errors.New("ssh: invalid KRL serial bitmap")
+			}
+			c.Serials = append(c.Serials, bitmapSerialRanges(offset, bitmap)...)
+		case krlSectionCertKeyID:
+			err := parseKRLStrings(data, func(b []byte) error {
+				c.KeyIDs = append(c.KeyIDs, string(b))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("ssh: unknown KRL certificates section %d", typ)
+		}
+	}
+	sort.Slice(c.Serials, func(i, j int) bool { return c.Serials[i].First < c.Serials[j].First })
+	k.Certificates = append(k.Certificates, c)
+	return nil
+}
+
+// parseKRLStrings calls f for each of the strings making up data.
+func parseKRLStrings(data []byte, f func([]byte) error) error {
+	for len(data) > 0 {
+		b, rest, ok := parseString(data)
+		if !ok {
+			return errors.New("ssh: truncated KRL section")
+		}
+		if err := f(b); err != nil {
+			return err
+		}
+		data = rest
+	}
+	return nil
+}
+
+// bitmapSerialRanges returns the ranges of the serial numbers revoked by
+// bitmap, whose bit n stands for the serial number offset+n.
+func bitmapSerialRanges(offset uint64, bitmap *big.Int) []KRLSerialRange {
+	var ranges []KRLSerialRange
+	n := bitmap.BitLen()
+	for i := 0; i < n; i++ {
+		if bitmap.Bit(i) == 0 {
+			continue
+		}
+		first := i
+		for i+1 < n && bitmap.Bit(i+1) == 1 {
+			i++
+		}
+		ranges = append(ranges, KRLSerialRange{offset + uint64(first), offset + uint64(i)})
+	}
+	return ranges
+}
+
+// Marshal returns the KRL in the OpenSSH format, without signature.
+func (k *KRL) Marshal() []byte {
+	var b bytes.Buffer
+	var date uint64
+	if !k.GeneratedDate.IsZero() {
+		date = uint64(k.GeneratedDate.Unix())
+	}
+	b.WriteString(krlMagic)
+	b.Write(Marshal(struct {
+		FormatVersion uint32
+		Version       uint64
+		GeneratedDate uint64
+		Flags         uint64
+		Reserved      []byte
+		Comment       string
+	}{krlFormatVersion, k.Version, date, 0, nil, k.Comment}))
+
+	for _, c := range k.Certificates {
+		var section bytes.Buffer
+		var ca []byte
+		if c.CA != nil {
+			ca = c.CA.Marshal()
+		}
+		writeString(&section, ca)
+		writeString(&section, nil) // reserved
+		serials := append([]KRLSerialRange(nil), c.Serials...)
+		sort.Slice(serials, func(i, j int) bool { return serials[i].First < serials[j].First })
+		var list []byte
+		for _, r := range serials {
+			if r.First == r.Last {
+				list = binary.BigEndian.AppendUint64(list, r.First)
+				continue
+			}
+			var data []byte
+			data = binary.BigEndian.AppendUint64(data, r.First)
+			data = binary.BigEndian.AppendUint64(data, r.Last)
+			writeKRLSection(&section, krlSectionCertSerialRange, data)
+		}
+		if len(list) > 0 {
+			writeKRLSection(&section, krlSectionCertSerialList, list)
+		}
+		if len(c.KeyIDs) > 0 {
+			var ids bytes.Buffer
+			for _, id := range c.KeyIDs {
+				writeString(&ids, []byte(id))
+			}
+			writeKRLSection(&section, krlSectionCertKeyID, ids.Bytes())
+		}
+		writeKRLSection(&b, krlSectionCertificates, section.Bytes())
+	}
+
+	// The keys and hashes are sorted, as by OpenSSH.
+	var keys [][]byte
+	for _, key := range k.Keys {
+		keys = append(keys, key.Marshal())
+	}
+	writeKRLStrings(&b, krlSectionExplicitKey, keys)
+	var hashes [][]byte
+	for i := range k.SHA1Hashes {
+		hashes = append(hashes, k.SHA1Hashes[i][:])
+	}
+	writeKRLStrings(&b, krlSectionFingerprintSHA1, hashes)
+	hashes = nil
+	for i := range k.SHA256Hashes {
+		hashes = append(hashes, k.SHA256Hashes[i][:])
+	}
+	writeKRLStrings(&b, krlSectionFingerprintSHA256, hashes)
+	return b.Bytes()
+}
+
+func writeKRLSection(b *bytes.Buffer, typ byte, data []byte) {
+	b.WriteByte(typ)
+	writeString(b, data)
+}
+
+// writeKRLStrings writes the section typ made up of the sorted strings
+// list, unless it is empty.
+func writeKRLStrings(b *bytes.Buffer, typ byte, list [][]byte) {
+	if len(list) == 0 {
+		return
+	}
+	sort.Slice(list, func(i, j int) bool { return bytes.Compare(list[i], list[j]) < 0 })
+	var data bytes.Buffer
+	for _, s := range list {
+		writeString(&data, s)
+	}
+	writeKRLSection(b, typ, data.Bytes())
+}
+
+// IsRevoked reports whether k revokes key, or the certificate key is,
+// as reported by IsRevokedCert.
+func (k *KRL) IsRevoked(key PublicKey) bool {
+	if cert, ok := key.(*Certificate); ok {
+		return k.IsRevokedCert(cert)
+	}
+	return k.isRevokedKey(key)
+}
+
+// IsRevokedCert reports whether k revokes cert, its key, or the key of the
+// CA which signed it.
+func (k *KRL) IsRevokedCert(cert *Certificate) bool {
+	if k.isRevokedKey(cert.Key) || cert.SignatureKey != nil && k.isRevokedKey(cert.SignatureKey) {
+		return true
+	}
+	for _, c := range k.Certificates {
+		if c.CA != nil && (cert.SignatureKey == nil || !bytes.Equal(c.CA.Marshal(), cert.SignatureKey.Marshal())) {
+			continue
+		}
+		for _, id := range c.KeyIDs {
+			if id == cert.KeyId {
+				return true
+			}
+		}
+		if cert.Serial == 0 {
+			continue
+		}
+		for _, r := range c.Serials {
+			if r.First <= cert.Serial && cert.Serial <= r.Last {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isRevokedKey reports whether k revokes key, which is not a certificate.
+func (k *KRL) isRevokedKey(key PublicKey) bool {
+	blob := key.Marshal()
+	for _, revoked := range k.Keys {
+		if bytes.Equal(revoked.Marshal(), blob) {
+			return true
+		}
+	}
+	if len(k.SHA1Hashes) > 0 {
+		h := sha1.Sum(blob)
+		for _, revoked := range k.SHA1Hashes {
+			if revoked == h {
+				return true
+			}
+		}
+	}
+	if len(k.SHA256Hashes) > 0 {
+		h := sha256.Sum256(blob)
+		for _, revoked := range k.SHA256Hashes {
+			if revoked == h {
+				return true
+			}
+		}
+	}
+	return false
+}
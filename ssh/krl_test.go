@@ -0,0 +1,179 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testKRL was created by "ssh-keygen -k -s ca.pub -z 7", ca.pub being the
+// "ecdsa" test key, revoking the serials 5, 10-20, 1000 and 70000 and the
+// key ID "bad-id", then updated with "ssh-keygen -k -u" to revoke the
+// "ed25519" key, the SHA-1 hash of the "dsa" key and the SHA-256 hash of
+// the "rsa" key.
+const testKRL = `U1NIS1JMCgAAAAABAAAAAAAAAAcAAAAAas8pOQAAAAAAAAAAAAAAAAAAAAABAAAAqAAAAGgAAAATZWNkc2Etc2hhMi1uaXN0cDI1NgAAAAhuaXN0cDI1NgAAAEEEi9Hdw6KvZcWxfg2IDhA7UkpDtzzt6ZqJXSsFdLd+Kx4S3Sx4cVO+6/ZOXRnPmNAlLUqjShUsUBBngG0u2fqEqAAAAAAiAAAADwAAAAAAAAAFAAAAAwD/4SAAAAAQAAAAAAAAA+gAAAAAAAERcCMAAAAKAAAABmJhZC1pZAIAAAA3AAAAMwAAAAtzc2gtZWQyNTUxOQAAACA+3f7hS7g5UWwXOGVTrMfhmxyrjqz7Sxxbx7I1j8DvvwMAAAAYAAAAFPV4dw27W4MPVABjH65yAivEt/7mBQAAACQAAAAgAnr3LjZK8YVpjrxu79myrW9Hrb/wpcMNpVvTq/RcBm8=`
+
+func testKRLCert(t *testing.T, key PublicKey, ca Signer, serial uint64, keyID string) *Certificate {
+	cert := &Certificate{
+		Key:         key,
+		Serial:      serial,
+		KeyId:       keyID,
+		CertType:    UserCert,
+		ValidBefore: CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("SignCert: %v", err)
+	}
+	return cert
+}
+
+func TestParseKRL(t *testing.T) {
+	data, err := base64.StdEncoding.DecodeString(testKRL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	krl, err := ParseKRL(data)
+	if err != nil {
+		t.Fatalf("ParseKRL: %v", err)
+	}
+	if krl.Version != 7 {
+		t.Errorf("Version = %d; want 7", krl.Version)
+	}
+	if len(krl.Certificates) != 1 {
+		t.Fatalf("got %d certificate sections; want 1", len(krl.Certificates))
+	}
+	c := krl.Certificates[0]
+	if c.CA == nil || !bytes.Equal(c.CA.Marshal(), testPublicKeys["ecdsa"].Marshal()) {
+		t.Errorf("CA = %v; want the ecdsa test key", c.CA)
+	}
+	wantSerials := []KRLSerialRange{{5, 5}, {10, 20}, {1000, 1000}, {70000, 70000}}
+	if !reflect.DeepEqual(c.Serials, wantSerials) {
+		t.Errorf("Serials = %v; want %v", c.Serials, wantSerials)
+	}
+	if want := []string{"bad-id"}; !reflect.DeepEqual(c.KeyIDs, want) {
+		t.Errorf("KeyIDs = %q; want %q", c.KeyIDs, want)
+	}
+	if len(krl.Keys) != 1 || !bytes.Equal(krl.Keys[0].Marshal(), testPublicKeys["ed25519"].Marshal()) {
+		t.Errorf("Keys = %v; want the ed25519 test key", krl.Keys)
+	}
+	if len(krl.SHA1Hashes) != 1 || len(krl.SHA256Hashes) != 1 {
+		t.Errorf("got %d SHA-1 and %d SHA-256 hashes; want 1 of each", len(krl.SHA1Hashes), len(krl.SHA256Hashes))
+	}
+
+	for name, revoked := range map[string]bool{"ed25519": true, "dsa": true, "rsa": true, "ecdsa": false, "ecdsap384": false} {
+		if got := krl.IsRevoked(testPublicKeys[name]); got != revoked {
+			t.Errorf("IsRevoked(%s key) = %v; want %v", name, got, revoked)
+		}
+	}
+
+	user := testPublicKeys["ecdsap384"]
+	certs := []struct {
+		name    string
+		cert    *Certificate
+		revoked bool
+	}{
+		{"serial", testKRLCert(t, user, testSigners["ecdsa"], 5, "id"), true},
+		{"serial range", testKRLCert(t, user, testSigners["ecdsa"], 12, "id"), true},
+		{"serial list", testKRLCert(t, user, testSigners["ecdsa"], 70000, "id"), true},
+		{"key ID", testKRLCert(t, user, testSigners["ecdsa"], 21, "bad-id"), true},
+		{"revoked key", testKRLCert(t, testPublicKeys["ed25519"], testSigners["ecdsa"], 21, "id"), true},
+		{"revoked CA", testKRLCert(t, user, testSigners["rsa"], 21, "id"), true},
+		{"valid", testKRLCert(t, user, testSigners["ecdsa"], 21, "id"), false},
+		{"serial zero", testKRLCert(t, user, testSigners["ecdsa"], 0, "id"), false},
+		{"other CA", testKRLCert(t, user, testSigners["ecdsap256"], 5, "id"), false},
+	}
+	for _, test := range certs {
+		if got := krl.IsRevokedCert(test.cert); got != test.revoked {
+			t.Errorf("%s: IsRevokedCert = %v; want %v", test.name, got, test.revoked)
+		}
+		if got := krl.IsRevoked(test.cert); got != test.revoked {
+			t.Errorf("%s: IsRevoked = %v; want %v", test.name, got, test.revoked)
+		}
+	}
+
+	// The CertChecker rejects the revoked certificates.
+	checker := &CertChecker{
+		IsUserAuthority: func(auth PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), testPublicKeys["ecdsa"].Marshal())
+		},
+		IsRevoked: krl.IsRevokedCert,
+	}
+	if err := checker.CheckCert("user", certs[0].cert); err == nil {
+		t.Error("CheckCert accepted a revoked certificate")
+	}
+	if err := checker.CheckCert("user", certs[6].cert); err != nil {
+		t.Errorf("CheckCert: %v", err)
+	}
+}
+
+func TestKRLMarshal(t *testing.T) {
+	dsaHash := sha1.Sum(testPublicKeys["dsa"].Marshal())
+	rsaHash := sha256.Sum256(testPublicKeys["rsa"].Marshal())
+	krl := &KRL{
+		Version:       3,
+		GeneratedDate: time.Unix(1500000000, 0),
+		Comment:       "test",
+		Certificates: []KRLCertificates{
+			{
+				CA:      testPublicKeys["ecdsa"],
+				Serials: []KRLSerialRange{{5, 5}, {10, 20}, {1 << 40, 1 << 40}},
+			},
+			{KeyIDs: []string{"bad-id", "other-id"}},
+		},
+		Keys:         []PublicKey{testPublicKeys["ed25519"]},
+		SHA1Hashes:   [][sha1.Size]byte{dsaHash},
+		SHA256Hashes: [][sha256.Size]byte{rsaHash},
+	}
+	data := krl.Marshal()
+	parsed, err := ParseKRL(data)
+	if err != nil {
+		t.Fatalf("ParseKRL: %v", err)
+	}
+	if got := parsed.Marshal(); !bytes.Equal(got, data) {
+		t.Error("the parsed KRL marshals differently")
+	}
+	if parsed.Version != 3 || !parsed.GeneratedDate.Equal(krl.GeneratedDate) || parsed.Comment != "test" {
+		t.Errorf("header = %d, %v, %q; want 3, %v, %q", parsed.Version, parsed.GeneratedDate, parsed.Comment, krl.GeneratedDate, "test")
+	}
+	if !reflect.DeepEqual(parsed.Certificates[0].Serials, krl.Certificates[0].Serials) {
+		t.Errorf("Serials = %v; want %v", parsed.Certificates[0].Serials, krl.Certificates[0].Serials)
+	}
+	if parsed.Certificates[1].CA != nil || !reflect.DeepEqual(parsed.Certificates[1].KeyIDs, krl.Certificates[1].KeyIDs) {
+		t.Errorf("wildcard section = %+v; want %+v", parsed.Certificates[1], krl.Certificates[1])
+	}
+	for _, name := range []string{"ed25519", "dsa", "rsa"} {
+		if !parsed.IsRevoked(testPublicKeys[name]) {
+			t.Errorf("%s key not revoked", name)
+		}
+	}
+	if !parsed.IsRevokedCert(testKRLCert(t, testPublicKeys["ecdsap384"], testSigners["ecdsap256"], 21, "other-id")) {
+		t.Error("key ID of any CA not revoked")
+	}
+}
+
+func TestParseKRLErrors(t *testing.T) {
+	data, err := base64.StdEncoding.DecodeString(testKRL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, in := range [][]byte{
+		nil,
+		[]byte("SSH-2.0-OpenSSH"),
+		data[:len(krlMagic)+4],
+		data[:len(data)-1],
+		append(append([]byte(nil), data...), 9, 0, 0, 0, 0),
+	} {
+		if _, err := ParseKRL(in); err == nil {
+			t.Errorf("ParseKRL(%q) succeeded", in)
+		}
+	}
+}
@@ -67,6 +67,31 @@ func (c *chanList) remove(id uint32) {
 	c.Unlock()
 }
 
+// inbound returns the number of channels opened by the peer in the list.
+func (c *chanList) inbound() int {
+	c.Lock()
+	defer c.Unlock()
+	n := 0
+	for _, ch := range c.chans {
+		if ch != nil && ch.direction == channelInbound {
+			n++
+		}
+	}
+	return n
+}
+
+// empty reports whether the list has no channels.
+func (c *chanList) empty() bool {
+	c.Lock()
+	defer c.Unlock()
+	for _, ch := range c.chans {
+		if ch != nil {
+			return false
+		}
+	}
+	return true
+}
+
 // dropAll forgets all channels it knows, returning them in a slice.
 func (c *chanList) dropAll() []*channel {
 	c.Lock()
@@ -97,8 +122,41 @@ type mux struct {
 
 	errCond *sync.Cond
 	err     error
+
+	// channels counts the channels opened in either direction.
+	channels atomic.Uint64
+
+	// server is set for server side connections, which honor the
+	// no-more-sessions@openssh.com global request.
+	server bool
+	// singleSession refuses all session channels after the first,
+	// as if the peer had sent no-more-sessions@openssh.com.
+	singleSession bool
+	// noMoreSessions is set once session channels are refused.
+	// It is only accessed by the loop goroutine.
+	noMoreSessions bool
+	// forceCommand, if set, returns the command replacing the one
+	// requested on a session channel, as per the force-command
+	// critical option of the client.
+	forceCommand func(requested string) string
+	// acceptEnv, if non-nil, lists the patterns of the environment
+	// variables accepted in the env requests of session channels.
+	// See ServerConfig.AcceptEnv.
+	acceptEnv []string
+	// maxChannels, if positive, is the number of channels the peer may
+	// have open at once. See ServerConfig.MaxChannels.
+	maxChannels int
+
+	// drainMu guards draining, and is held while incoming channels
+	// are added so that a drained mux is never left with a new channel.
+	drainMu  sync.Mutex
+	draining bool
 }
 
+// noMoreSessionsRequest is the OpenSSH global request by which a client
+// announces that it will not open any further session channels.
+const noMoreSessionsRequest = "no-more-sessions@openssh.com"
+
 // When debugging, each new chanList instantiation has a different
 // offset.
 var globalOff uint32
@@ -114,6 +172,30 @@ func (m *mux) Wait() error {
 
 // newMux returns a mux that runs over the given connection.
 func newMux(p packetConn) *mux {
+	m := allocMux(p)
+	go m.loop()
+	return m
+}
+
+// newServerMux returns a mux for the server side of the given
+// connection. If singleSession is set, at most one session channel
+// is accepted. If forceCommand is set, it rewrites the commands
+// requested on session channels. If acceptEnv is non-nil, env requests
+// on session channels are refused unless they match one of its patterns.
+// If maxChannels is positive, the channels opened by the client beyond
+// maxChannels open ones are refused.
+func newServerMux(p packetConn, singleSession bool, forceCommand func(string) string, acceptEnv []string, maxChannels int) *mux {
+	m := allocMux(p)
+	m.server = true
+	m.singleSession = singleSession
+	m.forceCommand = forceCommand
+	m.acceptEnv = acceptEnv
+	m.maxChannels = maxChannels
+	go m.loop()
+	return m
+}
+
+func allocMux(p packetConn) *mux {
 	m := &mux{
 		conn:             p,
 		incomingChannels: make(chan NewChannel, chanSize),
@@ -124,8 +206,6 @@ func newMux(p packetConn) *mux {
 	if debugMux {
 		m.chanList.offset = atomic.AddUint32(&globalOff, 1)
 	}
-
-	go m.loop()
 	return m
 }
 
@@ -254,6 +334,13 @@ func (m *mux) handleGlobalPacket(packet []byte) error {
 
 	switch msg := msg.(type) {
 	case *globalRequestMsg:
+		if m.server && msg.Type == noMoreSessionsRequest {
+			m.noMoreSessions = true
+			if msg.WantReply {
+				return m.ackRequest(true, nil)
+			}
+			return nil
+		}
 		m.incomingRequests <- &Request{
 			Type:      msg.Type,
 			WantReply: msg.WantReply,
@@ -286,7 +373,50 @@ func (m *mux) handleChannelOpen(packet []byte) error {
 		return m.sendMessage(failMsg)
 	}
 
+	// The channel is added under drainMu, but without blocking on
+	// incomingChannels, as the goroutine servicing it may need drainMu
+	// to reject a channel.
+	m.drainMu.Lock()
+	if m.draining {
+		m.drainMu.Unlock()
+		failMsg := channelOpenFailureMsg{
+			PeersID:  msg.PeersID,
+			Reason:   Prohibited,
+			Message:  "server is shutting down",
+			Language: "en_US.UTF-8",
+		}
+		return m.sendMessage(failMsg)
+	}
+
+	if m.maxChannels > 0 && m.chanList.inbound() >= m.maxChannels {
+		m.drainMu.Unlock()
+		failMsg := channelOpenFailureMsg{
+			PeersID:  msg.PeersID,
+			Reason:   ResourceShortage,
+			Message:  "too many open channels",
+			Language: "en_US.UTF-8",
+		}
+		return m.sendMessage(failMsg)
+	}
+
+	if msg.ChanType == "session" {
+		if m.noMoreSessions {
+			m.drainMu.Unlock()
+			failMsg := channelOpenFailureMsg{
+				PeersID:  msg.PeersID,
+				Reason:   Prohibited,
+				Message:  "no more sessions",
+				Language: "en_US.UTF-8",
+			}
+			return m.sendMessage(failMsg)
+		}
+		if m.singleSession {
+			m.noMoreSessions = true
+		}
+	}
+
 	c := m.newChannel(msg.ChanType, channelInbound, msg.TypeSpecificData)
+	m.drainMu.Unlock()
 	c.remoteId = msg.PeersID
 	c.maxRemotePayload = msg.MaxPacketSize
 	c.remoteWin.add(msg.PeersWindow)
@@ -294,6 +424,25 @@ func (m *mux) handleChannelOpen(packet []byte) error {
 	return nil
 }
 
+// drain refuses all further incoming channels and closes the
+// connection once the open channels are closed.
+func (m *mux) drain() {
+	m.drainMu.Lock()
+	m.draining = true
+	m.drainMu.Unlock()
+	m.closeIfDrained()
+}
+
+// closeIfDrained closes the connection if it is draining
+// and no channel is left.
+func (m *mux) closeIfDrained() {
+	m.drainMu.Lock()
+	defer m.drainMu.Unlock()
+	if m.draining && m.chanList.empty() {
+		m.conn.Close()
+	}
+}
+
 func (m *mux) OpenChannel(chanType string, extra []byte) (Channel, <-chan *Request, error) {
 	ch, err := m.openChannel(chanType, extra)
 	if err != nil {
@@ -321,6 +470,7 @@ func (m *mux) openChannel(chanType string, extra []byte) (*channel, error) {
 
 	switch msg := (<-ch.msg).(type) {
 	case *channelOpenConfirmMsg:
+		m.channels.Add(1)
 		return ch, nil
 	case *channelOpenFailureMsg:
 		return nil, &OpenChannelError{msg.Reason, msg.Message}
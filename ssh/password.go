@@ -0,0 +1,29 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+)
+
+// ConstantTimePasswordMatch reports whether the password provided by a
+// client, as passed to ServerConfig.PasswordCallback, equals expected,
+// in a time which does not depend on their contents nor on the length of
+// their common prefix, unlike == or bytes.Equal. Passwords of different
+// lengths are compared in full too.
+//
+// Passwords should not be stored in plaintext: to check a password against
+// a stored hash, use the comparison function of the hash instead, such as
+// bcrypt.CompareHashAndPassword, which is also constant-time.
+func ConstantTimePasswordMatch(provided, expected []byte) bool {
+	// Hashing both passwords makes the comparison independent of
+	// their lengths, which subtle.ConstantTimeCompare is not.
+	p := sha256.Sum256(provided)
+	e := sha256.Sum256(expected)
+	same := subtle.ConstantTimeCompare(p[:], e[:])
+	sameLen := subtle.ConstantTimeEq(int32(len(provided)), int32(len(expected)))
+	return same&sameLen == 1
+}
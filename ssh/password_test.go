@@ -0,0 +1,69 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestConstantTimePasswordMatch(t *testing.T) {
+	for _, tt := range []struct {
+		provided, expected string
+		want               bool
+	}{
+		{"secret", "secret", true},
+		{"", "", true},
+		{"secret", "Secret", false},
+		{"secret", "secreT", false},
+		{"secret", "", false},
+		{"", "secret", false},
+		// Prefixes, of different lengths.
+		{"secre", "secret", false},
+		{"secret", "secret2", false},
+		{"secret\x00", "secret", false},
+	} {
+		if got := ConstantTimePasswordMatch([]byte(tt.provided), []byte(tt.expected)); got != tt.want {
+			t.Errorf("ConstantTimePasswordMatch(%q, %q) = %v, want %v", tt.provided, tt.expected, got, tt.want)
+		}
+	}
+}
+
+func TestConstantTimePasswordMatchAuth(t *testing.T) {
+	config := &ServerConfig{
+		PasswordCallback: func(conn ConnMetadata, password []byte) (*Permissions, error) {
+			if conn.User() == "testuser" && ConstantTimePasswordMatch(password, []byte("tiger")) {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+	}
+	config.AddHostKey(testSigners["rsa"])
+	for _, tt := range []struct {
+		password string
+		ok       bool
+	}{
+		{"tiger", true},
+		{"tige", false},
+		{"tigers", false},
+	} {
+		c1, c2, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+		go NewServerConn(c1, config)
+		clientConf := &ClientConfig{
+			User:            "testuser",
+			Auth:            []AuthMethod{Password(tt.password)},
+			HostKeyCallback: InsecureIgnoreHostKey(),
+		}
+		_, _, _, err = NewClientConn(c2, "", clientConf)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("password %q: authenticated = %v (%v), want %v", tt.password, ok, err, tt.ok)
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
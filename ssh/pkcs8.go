@@ -0,0 +1,220 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	stded25519 "crypto/ed25519"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+
+	"github.com/robarchibald/crypto/ed25519"
+	"github.com/robarchibald/crypto/pbkdf2"
+)
+
+// A PassphraseMissingError indicates that parsing this private key requires
+// a passphrase. Use ParsePrivateKeyWithPassphrase.
+type PassphraseMissingError struct{}
+
+func (*PassphraseMissingError) Error() string {
+	return "ssh: this private key is encrypted with a passphrase"
+}
+
+// The object identifiers of PBES2, RFC 8018, and of the algorithms it is
+// supported with.
+var (
+	oidPBES2  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA224 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 8}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+
+	oidAES128CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidAES128GCM = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 6}
+	oidAES192GCM = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 26}
+	oidAES256GCM = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 46}
+)
+
+// See RFC 5208, section 6.
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// See RFC 8018, appendix A.4.
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+// See RFC 8018, appendix A.2.
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// See RFC 5084, section 3.2.
+type gcmParams struct {
+	Nonce  []byte
+	ICVLen int `asn1:"default:12"`
+}
+
+// parseEncryptedPKCS8PrivateKey returns the private key of der, an
+// EncryptedPrivateKeyInfo encrypted with PBES2, using PBKDF2 and AES in CBC
+// or GCM mode, decrypted with passphrase. If the passphrase is wrong, it
+// returns x509.IncorrectPasswordError.
+func parseEncryptedPKCS8PrivateKey(der, passphrase []byte) (crypto.PrivateKey, error) {
+	if len(passphrase) == 0 {
+		return nil, &PassphraseMissingError{}
+	}
+	var info encryptedPrivateKeyInfo
+	if rest, err := asn1.Unmarshal(der, &info); err != nil || len(rest) > 0 {
+		return nil, errors.New("ssh: invalid encrypted PKCS#8 private key")
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("ssh: unsupported PKCS#8 encryption algorithm %v", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, errors.New("ssh: invalid PBES2 parameters")
+	}
+
+	var keyLen int
+	var gcm bool
+	switch scheme := params.EncryptionScheme.Algorithm; {
+	case scheme.Equal(oidAES128CBC):
+		keyLen = 16
+	case scheme.Equal(oidAES192CBC):
+		keyLen = 24
+	case scheme.Equal(oidAES256CBC):
+		keyLen = 32
+	case scheme.Equal(oidAES128GCM):
+		keyLen, gcm = 16, true
+	case scheme.Equal(oidAES192GCM):
+		keyLen, gcm = 24, true
+	case scheme.Equal(oidAES256GCM):
+		keyLen, gcm = 32, true
+	default:
+		return nil, fmt.Errorf("ssh: unsupported PBES2 encryption scheme %v", scheme)
+	}
+	key, err := pbkdf2Key(params.KeyDerivationFunc, passphrase, keyLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var plain []byte
+	if gcm {
+		var p gcmParams
+		if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &p); err != nil {
+			return nil, errors.New("ssh: invalid AES-GCM parameters")
+		}
+		aead, err := cipher.NewGCMWithNonceSize(block, len(p.Nonce))
+		if err != nil {
+			return nil, err
+		}
+		if p.ICVLen != aead.Overhead() {
+			return nil, fmt.Errorf("ssh: unsupported AES-GCM tag length %d", p.ICVLen)
+		}
+		if plain, err = aead.Open(nil, p.Nonce, info.EncryptedData, nil); err != nil {
+			return nil, x509.IncorrectPasswordError
+		}
+	} else {
+		var iv []byte
+		if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+			return nil, errors.New("ssh: invalid AES-CBC parameters")
+		}
+		data := info.EncryptedData
+		if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+			return nil, errors.New("ssh: invalid encrypted PKCS#8 private key")
+		}
+		plain = make([]byte, len(data))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+		// A wrong key is likely to break the PKCS #7 padding.
+		n := int(plain[len(plain)-1])
+		if n == 0 || n > aes.BlockSize || !bytes.Equal(plain[len(plain)-n:], bytes.Repeat([]byte{byte(n)}, n)) {
+			return nil, x509.IncorrectPasswordError
+		}
+		plain = plain[:len(plain)-n]
+	}
+
+	k, err := parsePKCS8PrivateKey(plain)
+	if err != nil {
+		// The padding was valid by chance.
+		return nil, x509.IncorrectPasswordError
+	}
+	return k, nil
+}
+
+// maxPBKDF2Iterations bounds the iteration count read from an encrypted
+// key, so that a crafted one cannot keep the CPU busy for hours.
+const maxPBKDF2Iterations = 10000000
+
+// pbkdf2Key derives a key of keyLen bytes from passphrase with kdf, which
+// must be PBKDF2.
+func pbkdf2Key(kdf pkix.AlgorithmIdentifier, passphrase []byte, keyLen int) ([]byte, error) {
+	if !kdf.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("ssh: unsupported PBES2 key derivation function %v", kdf.Algorithm)
+	}
+	var p pbkdf2Params
+	if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &p); err != nil {
+		return nil, errors.New("ssh: invalid PBKDF2 parameters")
+	}
+	if p.IterationCount <= 0 || p.KeyLength != 0 && p.KeyLength != keyLen {
+		return nil, errors.New("ssh: invalid PBKDF2 parameters")
+	}
+	if p.IterationCount > maxPBKDF2Iterations {
+		return nil, fmt.Errorf("ssh: PBKDF2 iteration count %d exceeds %d", p.IterationCount, maxPBKDF2Iterations)
+	}
+	var h func() hash.Hash
+	switch prf := p.PRF.Algorithm; {
+	case len(prf) == 0, prf.Equal(oidHMACWithSHA1):
+		h = sha1.New
+	case prf.Equal(oidHMACWithSHA224):
+		h = sha256.New224
+	case prf.Equal(oidHMACWithSHA256):
+		h = sha256.New
+	case prf.Equal(oidHMACWithSHA384):
+		h = sha512.New384
+	case prf.Equal(oidHMACWithSHA512):
+		h = sha512.New
+	default:
+		return nil, fmt.Errorf("ssh: unsupported PBKDF2 pseudorandom function %v", prf)
+	}
+	return pbkdf2.Key(passphrase, p.Salt, p.IterationCount, keyLen, h), nil
+}
+
+// parsePKCS8PrivateKey is like x509.ParsePKCS8PrivateKey, but returns the
+// Ed25519 keys as ed25519.PrivateKey values of this module.
+func parsePKCS8PrivateKey(der []byte) (crypto.PrivateKey, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	if k, ok := key.(stded25519.PrivateKey); ok {
+		return ed25519.PrivateKey(k), nil
+	}
+	return key, nil
+}
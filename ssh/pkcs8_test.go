@@ -0,0 +1,150 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"testing"
+
+	"github.com/robarchibald/crypto/pbkdf2"
+	"github.com/robarchibald/crypto/ssh/testdata"
+)
+
+func testPKCS8Signer(t *testing.T, name string, pemBytes, passphrase []byte) {
+	t.Helper()
+	signer, err := ParsePrivateKeyWithPassphrase(pemBytes, passphrase)
+	if err != nil {
+		t.Fatalf("ParsePrivateKeyWithPassphrase: %v", err)
+	}
+	want := testPublicKeys[name]
+	if !bytes.Equal(signer.PublicKey().Marshal(), want.Marshal()) {
+		t.Errorf("got public key %q; want %q", MarshalAuthorizedKey(signer.PublicKey()), MarshalAuthorizedKey(want))
+	}
+	data := []byte("sign me")
+	sig, err := signer.Sign(rand.Reader, data)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if err := want.Verify(data, sig); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+}
+
+func TestParseEncryptedPKCS8PrivateKey(t *testing.T) {
+	for _, k := range testdata.PKCS8EncryptedKeys {
+		t.Run(k.Name, func(t *testing.T) {
+			testPKCS8Signer(t, k.Name, k.PEMBytes, []byte(k.Passphrase))
+		})
+	}
+}
+
+// encryptPKCS8GCM encrypts the PKCS#8 key der with PBES2, using
+// PBKDF2 with HMAC-SHA256 and AES-256-GCM, which OpenSSL does not support.
+func encryptPKCS8GCM(t *testing.T, der, passphrase []byte) []byte {
+	salt := make([]byte, 16)
+	nonce := make([]byte, 12)
+	rand.Read(salt)
+	rand.Read(nonce)
+	key := pbkdf2.Key(passphrase, salt, 1000, 32, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{Salt: salt, IterationCount: 1000, PRF: pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcmParamsDER, err := asn1.Marshal(gcmParams{Nonce: nonce, ICVLen: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256GCM, Parameters: asn1.RawValue{FullBytes: gcmParamsDER}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: aead.Seal(nil, nonce, der, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: info})
+}
+
+func TestParseEncryptedPKCS8PrivateKeyGCM(t *testing.T) {
+	der, err := x509.MarshalPKCS8PrivateKey(testPrivateKeys["ecdsa"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	passphrase := []byte("gcm-p8_t3st")
+	pemBytes := encryptPKCS8GCM(t, der, passphrase)
+	testPKCS8Signer(t, "ecdsa", pemBytes, passphrase)
+
+	if _, err := ParsePrivateKeyWithPassphrase(pemBytes, []byte("wrong")); err != x509.IncorrectPasswordError {
+		t.Errorf("got error %v; want %v", err, x509.IncorrectPasswordError)
+	}
+}
+
+func TestParseEncryptedPKCS8PrivateKeyWrongPassphrase(t *testing.T) {
+	for _, k := range testdata.PKCS8EncryptedKeys {
+		_, err := ParsePrivateKeyWithPassphrase(k.PEMBytes, []byte("wrong"))
+		if err != x509.IncorrectPasswordError {
+			t.Errorf("%s: got error %v; want %v", k.Name, err, x509.IncorrectPasswordError)
+		}
+	}
+}
+
+func TestParseEncryptedPKCS8PrivateKeyMissingPassphrase(t *testing.T) {
+	for _, k := range testdata.PKCS8EncryptedKeys {
+		if _, err := ParsePrivateKey(k.PEMBytes); err == nil {
+			t.Errorf("%s: ParsePrivateKey: err is nil", k.Name)
+		} else if _, ok := err.(*PassphraseMissingError); !ok {
+			t.Errorf("%s: ParsePrivateKey: got error %v; want a *PassphraseMissingError", k.Name, err)
+		}
+		if _, err := ParsePrivateKeyWithPassphrase(k.PEMBytes, nil); err == nil {
+			t.Errorf("%s: ParsePrivateKeyWithPassphrase: err is nil", k.Name)
+		} else if _, ok := err.(*PassphraseMissingError); !ok {
+			t.Errorf("%s: ParsePrivateKeyWithPassphrase: got error %v; want a *PassphraseMissingError", k.Name, err)
+		}
+	}
+}
+
+func TestPBKDF2KeyIterationLimit(t *testing.T) {
+	for _, tt := range []struct {
+		iterations int
+		ok         bool
+	}{
+		{1000, true},
+		{maxPBKDF2Iterations + 1, false},
+		{1 << 62, false},
+	} {
+		params, err := asn1.Marshal(pbkdf2Params{Salt: []byte("salt"), IterationCount: tt.iterations})
+		if err != nil {
+			t.Fatal(err)
+		}
+		kdf := pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: params}}
+		_, err = pbkdf2Key(kdf, []byte("passphrase"), 16)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("pbkdf2Key with %d iterations: got error %v; want ok = %v", tt.iterations, err, tt.ok)
+		}
+	}
+}
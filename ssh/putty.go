@@ -0,0 +1,327 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/robarchibald/crypto/argon2"
+	"github.com/robarchibald/crypto/ed25519"
+)
+
+// ParsePuTTYPrivateKey returns a Signer from a PuTTY private key file (.ppk)
+// in format version 2 or 3. The passphrase is only used if the key is
+// encrypted. RSA, DSA, ECDSA and Ed25519 keys are supported.
+//
+// The MAC of the file is always verified, so tampered files are rejected.
+// If the key is encrypted and the MAC does not match, the passphrase is
+// presumed wrong and x509.IncorrectPasswordError is returned.
+//
+// The format is documented at
+// https://the.earth.li/~sgtatham/putty/0.76/htmldoc/AppendixC.html
+func ParsePuTTYPrivateKey(data, passphrase []byte) (Signer, error) {
+	key, err := parsePuTTYPrivateKey(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return NewSignerFromKey(key)
+}
+
+// puttyKeyFile holds the fields of a PuTTY private key file.
+type puttyKeyFile struct {
+	version    int
+	algo       string
+	encryption string
+	comment    string
+	public     []byte
+	private    []byte
+	mac        []byte
+	headers    map[string]string // all "Name: value" headers, such as the key derivation parameters
+}
+
+func parsePuTTYKeyFile(data []byte) (*puttyKeyFile, error) {
+	lines := strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+	const prefix = "PuTTY-User-Key-File-"
+	name, value, ok := splitPuTTYHeader(lines[0])
+	if !ok || !strings.HasPrefix(name, prefix) {
+		return nil, errors.New("ssh: not a PuTTY private key file")
+	}
+	f := &puttyKeyFile{algo: value, headers: make(map[string]string)}
+	switch name[len(prefix):] {
+	case "2":
+		f.version = 2
+	case "3":
+		f.version = 3
+	default:
+		return nil, fmt.Errorf("ssh: unsupported PuTTY key file version %q", name[len(prefix):])
+	}
+
+	lines = lines[1:]
+	for len(lines) > 0 {
+		line := lines[0]
+		lines = lines[1:]
+		if line == "" {
+			continue
+		}
+		name, value, ok := splitPuTTYHeader(line)
+		if !ok {
+			return nil, fmt.Errorf("ssh: malformed PuTTY key file line %q", line)
+		}
+		if !strings.HasSuffix(name, "-Lines") {
+			f.headers[name] = value
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > len(lines) {
+			return nil, fmt.Errorf("ssh: malformed PuTTY key file header %q", line)
+		}
+		b, err := base64.StdEncoding.DecodeString(strings.Join(lines[:n], ""))
+		if err != nil {
+			return nil, fmt.Errorf("ssh: malformed PuTTY key file %s: %v", name, err)
+		}
+		lines = lines[n:]
+		switch name {
+		case "Public-Lines":
+			f.public = b
+		case "Private-Lines":
+			f.private = b
+		}
+	}
+
+	if f.public == nil || f.private == nil || f.headers["Private-MAC"] == "" {
+		return nil, errors.New("ssh: incomplete PuTTY key file")
+	}
+	f.encryption = f.headers["Encryption"]
+	f.comment = f.headers["Comment"]
+	mac, err := hex.DecodeString(f.headers["Private-MAC"])
+	if err != nil {
+		return nil, errors.New("ssh: malformed PuTTY key file MAC")
+	}
+	f.mac = mac
+	return f, nil
+}
+
+// splitPuTTYHeader splits a "Name: value" line.
+func splitPuTTYHeader(line string) (name, value string, ok bool) {
+	i := strings.Index(line, ": ")
+	if i < 0 {
+		return "", "", false
+	}
+	return line[:i], line[i+2:], true
+}
+
+// keys derives the cipher key, IV and MAC key of f from passphrase.
+// If f is not encrypted, the returned cipher key and IV are nil.
+func (f *puttyKeyFile) keys(passphrase []byte) (cipherKey, iv, macKey []byte, err error) {
+	switch f.encryption {
+	case "none":
+		passphrase = nil
+	case "aes256-cbc":
+	default:
+		return nil, nil, nil, fmt.Errorf("ssh: unsupported PuTTY key encryption %q", f.encryption)
+	}
+
+	if f.version == 2 {
+		h := sha1.New()
+		h.Write([]byte("putty-private-key-file-mac-key"))
+		h.Write(passphrase)
+		macKey = h.Sum(nil)
+		if passphrase == nil {
+			return nil, nil, macKey, nil
+		}
+		var k []byte
+		for i := byte(0); i < 2; i++ {
+			h := sha1.New()
+			h.Write([]byte{0, 0, 0, i})
+			h.Write(passphrase)
+			k = h.Sum(k)
+		}
+		return k[:32], make([]byte, aes.BlockSize), macKey, nil
+	}
+
+	if passphrase == nil {
+		return nil, nil, []byte{}, nil
+	}
+	var kdf func(password, salt []byte, time, memory uint32, threads uint8, keyLen uint32) []byte
+	switch f.headers["Key-Derivation"] {
+	case "Argon2id":
+		kdf = argon2.IDKey
+	case "Argon2i":
+		kdf = argon2.Key
+	default:
+		return nil, nil, nil, fmt.Errorf("ssh: unsupported PuTTY key derivation %q", f.headers["Key-Derivation"])
+	}
+	var params [3]uint64
+	for i, name := range []string{"Argon2-Memory", "Argon2-Passes", "Argon2-Parallelism"} {
+		if params[i], err = strconv.ParseUint(f.headers[name], 10, 32); err != nil || params[i] == 0 {
+			return nil, nil, nil, fmt.Errorf("ssh: malformed PuTTY key file %s", name)
+		}
+	}
+	if params[2] > 255 {
+		return nil, nil, nil, errors.New("ssh: malformed PuTTY key file Argon2-Parallelism")
+	}
+	// The parameters come from the key file: bound the memory and time
+	// a crafted one can make the key derivation use.
+	if params[0] > maxPuTTYArgon2Memory {
+		return nil, nil, nil, fmt.Errorf("ssh: PuTTY key file Argon2-Memory %d exceeds %d", params[0], maxPuTTYArgon2Memory)
+	}
+	if params[1] > maxPuTTYArgon2Passes {
+		return nil, nil, nil, fmt.Errorf("ssh: PuTTY key file Argon2-Passes %d exceeds %d", params[1], maxPuTTYArgon2Passes)
+	}
+	salt, err := hex.DecodeString(f.headers["Argon2-Salt"])
+	if err != nil {
+		return nil, nil, nil, errors.New("ssh: malformed PuTTY key file Argon2-Salt")
+	}
+	k := kdf(passphrase, salt, uint32(params[1]), uint32(params[0]), uint8(params[2]), 80)
+	return k[:32], k[32:48], k[48:], nil
+}
+
+// The maximum Argon2 parameters accepted in PuTTY key files, well above
+// those PuTTY generates: 1 GiB of memory, in KiB, and 128 passes.
+const (
+	maxPuTTYArgon2Memory = 1 << 20
+	maxPuTTYArgon2Passes = 128
+)
+
+func parsePuTTYPrivateKey(data, passphrase []byte) (crypto.PrivateKey, error) {
+	f, err := parsePuTTYKeyFile(data)
+	if err != nil {
+		return nil, err
+	}
+	cipherKey, iv, macKey, err := f.keys(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	private := f.private
+	if cipherKey != nil {
+		if len(private)%aes.BlockSize != 0 {
+			return nil, errors.New("ssh: malformed PuTTY key file private blob")
+		}
+		block, err := aes.NewCipher(cipherKey)
+		if err != nil {
+			return nil, err
+		}
+		private = make([]byte, len(f.private))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(private, f.private)
+	}
+
+	var h func() hash.Hash = sha1.New
+	if f.version == 3 {
+		h = sha256.New
+	}
+	mac := hmac.New(h, macKey)
+	mac.Write(Marshal(struct {
+		Algo, Encryption, Comment string
+		Public, Private           []byte
+	}{f.algo, f.encryption, f.comment, f.public, private}))
+	if !hmac.Equal(mac.Sum(nil), f.mac) {
+		if cipherKey != nil {
+			return nil, x509.IncorrectPasswordError
+		}
+		return nil, errors.New("ssh: PuTTY key file MAC mismatch")
+	}
+
+	return parsePuTTYKey(f.algo, f.public, private)
+}
+
+var errPuTTYKeyMismatch = errors.New("ssh: PuTTY private key does not match public key")
+
+// parsePuTTYKey decodes the public and private blobs of a PuTTY key.
+// The private blob may be followed by padding.
+func parsePuTTYKey(algo string, public, private []byte) (crypto.PrivateKey, error) {
+	pub, err := ParsePublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	if pub.Type() != algo {
+		return nil, fmt.Errorf("ssh: PuTTY key algorithm %q does not match public key type %q", algo, pub.Type())
+	}
+
+	switch pub := pub.(type) {
+	case *rsaPublicKey:
+		var k struct {
+			D, P, Q, Iqmp *big.Int
+			Rest          []byte `ssh:"rest"`
+		}
+		if err := Unmarshal(private, &k); err != nil {
+			return nil, err
+		}
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey(*pub),
+			D:         k.D,
+			Primes:    []*big.Int{k.P, k.Q},
+		}
+		if err := key.Validate(); err != nil {
+			return nil, err
+		}
+		key.Precompute()
+		return key, nil
+	case *dsaPublicKey:
+		var k struct {
+			X    *big.Int
+			Rest []byte `ssh:"rest"`
+		}
+		if err := Unmarshal(private, &k); err != nil {
+			return nil, err
+		}
+		if new(big.Int).Exp(pub.G, k.X, pub.P).Cmp(pub.Y) != 0 {
+			return nil, errPuTTYKeyMismatch
+		}
+		return &dsa.PrivateKey{PublicKey: dsa.PublicKey(*pub), X: k.X}, nil
+	case *ecdsaPublicKey:
+		var k struct {
+			D    *big.Int
+			Rest []byte `ssh:"rest"`
+		}
+		if err := Unmarshal(private, &k); err != nil {
+			return nil, err
+		}
+		if x, y := pub.Curve.ScalarBaseMult(k.D.Bytes()); x.Cmp(pub.X) != 0 || y.Cmp(pub.Y) != 0 {
+			return nil, errPuTTYKeyMismatch
+		}
+		return &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey(*pub), D: k.D}, nil
+	case ed25519PublicKey:
+		var k struct {
+			// The private scalar as a little-endian integer,
+			// with leading zeroes trimmed.
+			Priv []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if err := Unmarshal(private, &k); err != nil {
+			return nil, err
+		}
+		if len(k.Priv) > ed25519.SeedSize {
+			return nil, errors.New("ssh: private key unexpected length")
+		}
+		seed := make([]byte, ed25519.SeedSize)
+		copy(seed, k.Priv)
+		key := ed25519.NewKeyFromSeed(seed)
+		if !bytes.Equal(key.Public().(ed25519.PublicKey), pub) {
+			return nil, errPuTTYKeyMismatch
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("ssh: unsupported PuTTY key type %q", algo)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// requestPayload returns the wire encoding of the payload of a request:
+// payload itself if it is a []byte, nothing if it is nil, and its encoding
+// by Marshal if it is a struct or a pointer to one, which Marshal requires.
+func requestPayload(payload interface{}) ([]byte, error) {
+	switch p := payload.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return p, nil
+	}
+	if v := reflect.Indirect(reflect.ValueOf(payload)); v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("ssh: request payload of type %T is not a struct, a pointer to a struct or a []byte", payload)
+	}
+	return Marshal(payload), nil
+}
+
+// SendGlobalRequest sends the global request name on conn, with payload
+// encoded by Marshal, which must thus be a struct or a pointer to a struct,
+// or else SendGlobalRequest returns an error; a []byte payload is sent as
+// is, and a nil one is empty.
+//
+// If wantReply is true, SendGlobalRequest waits for the reply of the peer
+// and returns whether it accepted the request, along with the payload of
+// the reply, which is specific to each request and may be decoded with
+// Unmarshal; a rejection carries no payload. Otherwise it returns false
+// and a nil payload. The receiving side decodes the request with
+// Unmarshal(req.Payload, &msg) and replies with Request.Reply.
+// See RFC 4254, section 4.
+func SendGlobalRequest(conn Conn, name string, wantReply bool, payload interface{}) (bool, []byte, error) {
+	p, err := requestPayload(payload)
+	if err != nil {
+		return false, nil, err
+	}
+	return conn.SendRequest(name, wantReply, p)
+}
+
+// SendChannelRequest sends the request name on ch, with payload encoded as
+// by SendGlobalRequest. If wantReply is true, it waits for the reply of the
+// peer and returns whether it accepted the request; channel replies carry
+// no payload. Otherwise it returns false. See RFC 4254, section 5.4.
+func SendChannelRequest(ch Channel, name string, wantReply bool, payload interface{}) (bool, error) {
+	p, err := requestPayload(payload)
+	if err != nil {
+		return false, err
+	}
+	return ch.SendRequest(name, wantReply, p)
+}
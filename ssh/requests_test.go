@@ -0,0 +1,136 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"testing"
+)
+
+type echoRequestMsg struct {
+	Text  string
+	Count uint32
+}
+
+type echoReplyMsg struct {
+	Texts []string
+}
+
+// echoReply replies to the "echo@example.com" requests with Count copies of
+// their Text, and rejects the other ones and the malformed ones.
+func echoReply(req *Request) {
+	if req.Type != "echo@example.com" {
+		req.Reply(false, nil)
+		return
+	}
+	var msg echoRequestMsg
+	if err := Unmarshal(req.Payload, &msg); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	var reply echoReplyMsg
+	for i := uint32(0); i < msg.Count; i++ {
+		reply.Texts = append(reply.Texts, msg.Text)
+	}
+	req.Reply(true, Marshal(&reply))
+}
+
+func TestSendGlobalAndChannelRequest(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["ecdsa"])
+	go func() {
+		_, chans, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			return
+		}
+		go func() {
+			for req := range reqs {
+				echoReply(req)
+			}
+		}()
+		for newCh := range chans {
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				t.Errorf("Accept: %v", err)
+				continue
+			}
+			go func() {
+				defer ch.Close()
+				for req := range reqs {
+					echoReply(req)
+				}
+			}()
+		}
+	}()
+
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	conn, chans, reqs, err := NewClientConn(c2, "", clientConf)
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	defer conn.Close()
+	go DiscardRequests(reqs)
+	go func() {
+		for newCh := range chans {
+			newCh.Reject(Prohibited, "")
+		}
+	}()
+
+	ok, payload, err := SendGlobalRequest(conn, "echo@example.com", true, &echoRequestMsg{Text: "hi", Count: 2})
+	if err != nil || !ok {
+		t.Fatalf("SendGlobalRequest = %v, %v; want accepted", ok, err)
+	}
+	var reply echoReplyMsg
+	if err := Unmarshal(payload, &reply); err != nil {
+		t.Fatalf("Unmarshal reply: %v", err)
+	}
+	if len(reply.Texts) != 2 || reply.Texts[0] != "hi" || reply.Texts[1] != "hi" {
+		t.Errorf("reply = %q; want [hi hi]", reply.Texts)
+	}
+
+	if ok, payload, err := SendGlobalRequest(conn, "unknown@example.com", true, nil); err != nil || ok || len(payload) != 0 {
+		t.Errorf("SendGlobalRequest(unknown) = %v, %q, %v; want rejected", ok, payload, err)
+	}
+	if ok, _, err := SendGlobalRequest(conn, "echo@example.com", false, echoRequestMsg{Text: "x"}); err != nil || ok {
+		t.Errorf("SendGlobalRequest without reply = %v, %v; want false, nil", ok, err)
+	}
+
+	ch, chReqs, err := conn.OpenChannel("session", nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	defer ch.Close()
+	go DiscardRequests(chReqs)
+	if ok, err := SendChannelRequest(ch, "echo@example.com", true, &echoRequestMsg{Text: "hi", Count: 1}); err != nil || !ok {
+		t.Errorf("SendChannelRequest = %v, %v; want accepted", ok, err)
+	}
+	if ok, err := SendChannelRequest(ch, "echo@example.com", true, []byte("malformed")); err != nil || ok {
+		t.Errorf("SendChannelRequest(malformed) = %v, %v; want rejected", ok, err)
+	}
+}
+
+func TestRequestPayloadNotStruct(t *testing.T) {
+	var nilMsg *echoRequestMsg
+	for _, payload := range []interface{}{"text", 42, []string{"a"}, nilMsg} {
+		if _, err := requestPayload(payload); err == nil {
+			t.Errorf("requestPayload(%#v): err is nil", payload)
+		}
+	}
+	for _, payload := range []interface{}{echoRequestMsg{Text: "a"}, &echoRequestMsg{Text: "a"}, []byte("a"), nil} {
+		if _, err := requestPayload(payload); err != nil {
+			t.Errorf("requestPayload(%#v): %v", payload, err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"errors"
+	"math/big"
+)
+
+// signRFC6979 returns the ECDSA signature of digest, computed with hash,
+// by priv, with the nonce derived from priv and digest as specified in
+// RFC 6979, section 3.2. Unlike crypto/ecdsa, its arithmetic does not run
+// in constant time.
+func signRFC6979(priv *ecdsa.PrivateKey, digest []byte, hash crypto.Hash) (r, s *big.Int, err error) {
+	n := priv.Curve.Params().N
+	qlen := n.BitLen()
+	rlen := (qlen + 7) / 8
+
+	// bits2int of section 2.3.2.
+	bits2int := func(b []byte) *big.Int {
+		v := new(big.Int).SetBytes(b)
+		if blen := len(b) * 8; blen > qlen {
+			v.Rsh(v, uint(blen-qlen))
+		}
+		return v
+	}
+	// int2octets of section 2.3.3.
+	int2octets := func(v *big.Int) []byte {
+		return v.FillBytes(make([]byte, rlen))
+	}
+	e := bits2int(digest)
+	// bits2octets of section 2.3.4.
+	h1 := int2octets(new(big.Int).Mod(e, n))
+	x := int2octets(priv.D)
+
+	mac := func(key []byte, data ...[]byte) []byte {
+		m := hmac.New(hash.New, key)
+		for _, d := range data {
+			m.Write(d)
+		}
+		return m.Sum(nil)
+	}
+	V := make([]byte, hash.Size())
+	K := make([]byte, hash.Size())
+	for i := range V {
+		V[i] = 0x01
+	}
+	K = mac(K, V, []byte{0x00}, x, h1)
+	V = mac(K, V)
+	K = mac(K, V, []byte{0x01}, x, h1)
+	V = mac(K, V)
+
+	for i := 0; i < 100; i++ {
+		var T []byte
+		for len(T)*8 < qlen {
+			V = mac(K, V)
+			T = append(T, V...)
+		}
+		k := bits2int(T)
+		if k.Sign() > 0 && k.Cmp(n) < 0 {
+			kx, _ := priv.Curve.ScalarBaseMult(int2octets(k))
+			r = kx.Mod(kx, n)
+			if r.Sign() != 0 {
+				s = new(big.Int).Mul(r, priv.D)
+				s.Add(s, e)
+				s.Mul(s, new(big.Int).ModInverse(k, n))
+				s.Mod(s, n)
+				if s.Sign() != 0 {
+					return r, s, nil
+				}
+			}
+		}
+		K = mac(K, V, []byte{0x00})
+		V = mac(K, V)
+	}
+	// Each candidate fails with a negligible probability.
+	return nil, nil, errors.New("ssh: no valid RFC 6979 nonce found")
+}
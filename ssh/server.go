@@ -24,13 +24,13 @@ type Permissions struct {
 	// user certificates. The standard for SSH certificates
 	// defines "force-command" (only allow the given command to
 	// execute) and "source-address" (only allow connections from
-	// the given address). The SSH package currently only enforces
-	// the "source-address" critical option. It is up to server
-	// implementations to enforce other critical options, such as
-	// "force-command", by checking them after the SSH handshake
-	// is successful. In general, SSH servers should reject
-	// connections that specify critical options that are unknown
-	// or not supported.
+	// the given address). The SSH package enforces both: see
+	// ServerConfig.ForceCommandCallback and
+	// CertChecker.SupportedCriticalOptions. It is up to server
+	// implementations to enforce other critical options, by
+	// checking them after the SSH handshake is successful. In
+	// general, SSH servers should reject connections that specify
+	// critical options that are unknown or not supported.
 	CriticalOptions map[string]string
 
 	// Extensions are extra functionality that the server may
@@ -57,13 +57,17 @@ type ServerConfig struct {
 	NoClientAuth bool
 
 	// MaxAuthTries specifies the maximum number of authentication attempts
-	// permitted per connection. If set to a negative number, the number of
-	// attempts are unlimited. If set to zero, the number of attempts are limited
-	// to 6.
+	// permitted per connection, like the MaxAuthTries option of OpenSSH.
+	// Once a client reaches it, the server disconnects with the message
+	// "too many authentication failures". The initial "none" request of
+	// clients is not counted. If set to a negative number, the number of
+	// attempts are unlimited. If set to zero, the number of attempts are
+	// limited to 6.
 	MaxAuthTries int
 
 	// PasswordCallback, if non-nil, is called when a user
-	// attempts to authenticate using a password.
+	// attempts to authenticate using a password. See
+	// ConstantTimePasswordMatch for comparing passwords.
 	PasswordCallback func(conn ConnMetadata, password []byte) (*Permissions, error)
 
 	// PublicKeyCallback, if non-nil, is called when a client
@@ -86,7 +90,8 @@ type ServerConfig struct {
 	KeyboardInteractiveCallback func(conn ConnMetadata, client KeyboardInteractiveChallenge) (*Permissions, error)
 
 	// AuthLogCallback, if non-nil, is called to log all authentication
-	// attempts.
+	// attempts. The host-bound variant of the public key method is
+	// reported as "publickey".
 	AuthLogCallback func(conn ConnMetadata, method string, err error)
 
 	// ServerVersion is the version identification string to announce in
@@ -99,6 +104,42 @@ type ServerConfig struct {
 	// BannerCallback, if present, is called and the return string is sent to
 	// the client after key exchange completed but before authentication.
 	BannerCallback func(conn ConnMetadata) string
+
+	// NoMoreSessions, if true, makes the server refuse all session
+	// channels after the first one, as if the client had sent the
+	// no-more-sessions@openssh.com global request. That request is
+	// honored regardless of this setting.
+	NoMoreSessions bool
+
+	// MaxChannels, if positive, limits the number of channels a client
+	// may have open at once on a connection. Further channel open requests
+	// are refused with ResourceShortage until some of them are closed.
+	// If zero, the number of channels is unlimited; servers exposed to
+	// untrusted clients should set a limit, such as 10 as OpenSSH does
+	// for sessions.
+	MaxChannels int
+
+	// ForceCommandCallback, if non-nil, chooses the command to run when the
+	// Permissions of an authenticated client carry the "force-command"
+	// critical option. When they do, every "exec", "shell" and "subsystem"
+	// request of the client's session channels is delivered to the
+	// application as an "exec" request for the forced command. The callback
+	// receives the forced command and the command or subsystem name
+	// requested by the client, which is empty for a shell, and returns the
+	// command to deliver instead. If nil, the forced command is delivered.
+	ForceCommandCallback func(conn ConnMetadata, forced, requested string) string
+
+	// AcceptEnv, if non-nil, restricts the environment variables clients
+	// may set with "env" requests on session channels to those whose names
+	// match one of its patterns, in the syntax of path.Match, such as
+	// "LC_*". Other requests, and those with a name other than letters,
+	// digits and underscores not starting with a digit, or a value holding
+	// a NUL byte, are refused by the package and never delivered to the
+	// application, which can parse the accepted ones with ParseEnvRequest.
+	//
+	// If nil, all env requests are delivered. An empty, non-nil AcceptEnv
+	// refuses them all.
+	AcceptEnv []string
 }
 
 // AddHostKey adds a private key as a host key. If an existing host
@@ -161,6 +202,21 @@ type ServerConn struct {
 	Permissions *Permissions
 }
 
+// Drain starts a graceful shutdown of the connection, for instance before
+// restarting the server: the channels opened by the client from now on are
+// refused with the Prohibited reason, while the open ones keep running.
+// Once they are all closed, the connection is closed.
+//
+// Drain does not block; use Wait to wait for the connection to shut down,
+// and Close to abort the open channels.
+func (c *ServerConn) Drain() {
+	if conn, ok := c.Conn.(*connection); ok {
+		conn.drain()
+		return
+	}
+	c.Conn.Close()
+}
+
 // NewServerConn starts a new SSH server with c as the underlying
 // transport.  It starts with a handshake and, if the handshake is
 // unsuccessful, it closes the connection and returns an error.  The
@@ -170,16 +226,28 @@ type ServerConn struct {
 // The returned error may be of type *ServerAuthError for
 // authentication errors.
 func NewServerConn(c net.Conn, config *ServerConfig) (*ServerConn, <-chan NewChannel, <-chan *Request, error) {
+	if err := config.checkAlgorithms(); err != nil {
+		c.Close()
+		return nil, nil, nil, err
+	}
 	fullConf := *config
 	fullConf.SetDefaults()
 	if fullConf.MaxAuthTries == 0 {
-		fullConf.MaxAuthTries = 6
+		fullConf.MaxAuthTries = defaultMaxAuthTries
 	}
 
 	s := &connection{
 		sshConn: sshConn{conn: c},
 	}
-	perms, err := s.serverHandshake(&fullConf)
+	timeout := fullConf.HandshakeTimeout
+	if timeout == 0 {
+		timeout = defaultServerHandshakeTimeout
+	}
+	var perms *Permissions
+	err := withHandshakeTimeout(c, timeout, func() (err error) {
+		perms, err = s.serverHandshake(&fullConf)
+		return err
+	})
 	if err != nil {
 		c.Close()
 		return nil, nil, nil, err
@@ -252,14 +320,25 @@ func (s *connection) serverHandshake(config *ServerConfig) (*Permissions, error)
 	if err != nil {
 		return nil, err
 	}
-	s.mux = newMux(s.transport)
+	var forceCommand func(string) string
+	if perms != nil && perms.CriticalOptions[forceCommandCriticalOption] != "" {
+		forced := perms.CriticalOptions[forceCommandCriticalOption]
+		forceCommand = func(requested string) string {
+			if config.ForceCommandCallback != nil {
+				return config.ForceCommandCallback(s, forced, requested)
+			}
+			return forced
+		}
+	}
+	s.mux = newServerMux(s.transport, config.NoMoreSessions, forceCommand, config.AcceptEnv, config.MaxChannels)
 	return perms, err
 }
 
 func isAcceptableAlgo(algo string) bool {
 	switch algo {
 	case KeyAlgoRSA, KeyAlgoDSA, KeyAlgoECDSA256, KeyAlgoECDSA384, KeyAlgoECDSA521, KeyAlgoED25519,
-		CertAlgoRSAv01, CertAlgoDSAv01, CertAlgoECDSA256v01, CertAlgoECDSA384v01, CertAlgoECDSA521v01, CertAlgoED25519v01:
+		CertAlgoRSAv01, CertAlgoDSAv01, CertAlgoECDSA256v01, CertAlgoECDSA384v01, CertAlgoECDSA521v01, CertAlgoED25519v01,
+		SigAlgoRSASHA2256, SigAlgoRSASHA2512, CertAlgoRSASHA256v01, CertAlgoRSASHA512v01:
 		return true
 	}
 	return false
@@ -320,6 +399,10 @@ func (l ServerAuthError) Error() string {
 // It is returned in ServerAuthError.Errors from NewServerConn.
 var ErrNoAuth = errors.New("ssh: no auth passed yet")
 
+// defaultMaxAuthTries is the number of authentication attempts
+// permitted per connection if ServerConfig.MaxAuthTries is zero.
+const defaultMaxAuthTries = 6
+
 func (s *connection) serverAuthenticate(config *ServerConfig) (*Permissions, error) {
 	sessionID := s.transport.getSessionID()
 	var cache pubKeyCache
@@ -410,7 +493,7 @@ userAuthLoop:
 
 			prompter := &sshClientKeyboardInteractive{s}
 			perms, authErr = config.KeyboardInteractiveCallback(s, prompter.Challenge)
-		case "publickey":
+		case "publickey", methodPublicKeyHostBound:
 			if config.PublicKeyCallback == nil {
 				authErr = errors.New("ssh: publickey auth not configured")
 				break
@@ -441,6 +524,19 @@ userAuthLoop:
 				return nil, err
 			}
 
+			// A host-bound request also holds the host key, which
+			// must be ours.
+			var hostKeyData []byte
+			if userAuthReq.Method == methodPublicKeyHostBound {
+				if hostKeyData, payload, ok = parseString(payload); !ok {
+					return nil, parseError(msgUserAuthRequest)
+				}
+				if !bytes.Equal(hostKeyData, s.transport.sessionHostKey) {
+					authErr = errors.New("ssh: public key request bound to another host key")
+					break
+				}
+			}
+
 			candidate, ok := cache.get(s.user, pubKeyData)
 			if !ok {
 				candidate.user = s.user
@@ -487,7 +583,12 @@ userAuthLoop:
 					authErr = fmt.Errorf("ssh: algorithm %q not accepted", sig.Format)
 					break
 				}
-				signedData := buildDataSignedForAuth(sessionID, userAuthReq, algoBytes, pubKeyData)
+				// The RFC 8332 algorithms require their hash.
+				if a, ok := rsaSHA2Algorithms[algo]; ok && (sig.Format != a.sigFormat || pubKey.Type() != a.keyType) {
+					authErr = fmt.Errorf("ssh: signature %q for algorithm %q", sig.Format, algo)
+					break
+				}
+				signedData := buildDataSignedForAuth(sessionID, userAuthReq, algoBytes, pubKeyData, hostKeyData)
 
 				if err := pubKey.Verify(signedData, sig); err != nil {
 					return nil, err
@@ -503,7 +604,11 @@ userAuthLoop:
 		authErrs = append(authErrs, authErr)
 
 		if config.AuthLogCallback != nil {
-			config.AuthLogCallback(s, userAuthReq.Method, authErr)
+			method := userAuthReq.Method
+			if method == methodPublicKeyHostBound {
+				method = "publickey"
+			}
+			config.AuthLogCallback(s, method, authErr)
 		}
 
 		if authErr == nil {
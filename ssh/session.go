@@ -9,6 +9,7 @@ package ssh
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -218,17 +219,54 @@ type subsystemRequestMsg struct {
 	Subsystem string
 }
 
+// SubsystemDeniedError is returned when the remote host refuses to
+// associate a subsystem with a session, for instance because the
+// subsystem is not configured. The SSH protocol does not convey why.
+type SubsystemDeniedError struct {
+	// Name is the name of the subsystem requested.
+	Name string
+}
+
+func (e *SubsystemDeniedError) Error() string {
+	return fmt.Sprintf("ssh: subsystem %q request denied by peer", e.Name)
+}
+
 // RequestSubsystem requests the association of a subsystem with the session on the remote host.
 // A subsystem is a predefined command that runs in the background when the ssh session is initiated
 func (s *Session) RequestSubsystem(subsystem string) error {
+	return s.RequestSubsystemContext(context.Background(), subsystem)
+}
+
+// RequestSubsystemContext is like RequestSubsystem, but gives up waiting
+// for the reply of the remote host when ctx is done. The session is then
+// closed, since whether the subsystem was started is unknown, and the
+// error of ctx is returned.
+//
+// If the remote host refuses the subsystem, the error is a
+// *SubsystemDeniedError.
+func (s *Session) RequestSubsystemContext(ctx context.Context, subsystem string) error {
 	msg := subsystemRequestMsg{
 		Subsystem: subsystem,
 	}
-	ok, err := s.ch.SendRequest("subsystem", true, Marshal(&msg))
-	if err == nil && !ok {
-		err = errors.New("ssh: subsystem request failed")
+	type reply struct {
+		ok  bool
+		err error
+	}
+	done := make(chan reply, 1)
+	go func() {
+		ok, err := s.ch.SendRequest("subsystem", true, Marshal(&msg))
+		done <- reply{ok, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err == nil && !r.ok {
+			return &SubsystemDeniedError{Name: subsystem}
+		}
+		return r.err
+	case <-ctx.Done():
+		s.Close()
+		return ctx.Err()
 	}
-	return err
 }
 
 // RFC 4254 Section 6.7.
@@ -251,6 +289,103 @@ func (s *Session) WindowChange(h, w int) error {
 	return err
 }
 
+// EnvRequest holds the contents of an "env" channel request,
+// as sent by Session.Setenv.
+type EnvRequest struct {
+	Name  string
+	Value string
+}
+
+// ParseEnvRequest parses the payload of an "env" channel request.
+// It reports false if the payload is malformed.
+func ParseEnvRequest(payload []byte) (EnvRequest, bool) {
+	var msg setenvRequest
+	if err := Unmarshal(payload, &msg); err != nil {
+		return EnvRequest{}, false
+	}
+	return EnvRequest{Name: msg.Name, Value: msg.Value}, true
+}
+
+// PtyRequest holds the contents of a "pty-req" channel request,
+// as sent by Session.RequestPty.
+type PtyRequest struct {
+	// Term is the value of the TERM environment variable, e.g. "xterm".
+	Term string
+
+	// Columns and Rows are the terminal dimensions in characters.
+	Columns uint32
+	Rows    uint32
+
+	// Width and Height are the terminal dimensions in pixels.
+	Width  uint32
+	Height uint32
+
+	// Modes contains the encoded terminal modes.
+	Modes TerminalModes
+}
+
+// ParsePtyRequest parses the payload of a "pty-req" channel request.
+// It reports false if the payload or its encoded terminal modes are malformed.
+func ParsePtyRequest(payload []byte) (PtyRequest, bool) {
+	var msg ptyRequestMsg
+	if err := Unmarshal(payload, &msg); err != nil {
+		return PtyRequest{}, false
+	}
+	modes, ok := parseTerminalModes([]byte(msg.Modelist))
+	if !ok {
+		return PtyRequest{}, false
+	}
+	return PtyRequest{
+		Term:    msg.Term,
+		Columns: msg.Columns,
+		Rows:    msg.Rows,
+		Width:   msg.Width,
+		Height:  msg.Height,
+		Modes:   modes,
+	}, true
+}
+
+// parseTerminalModes decodes the terminal modes as described in RFC 4254
+// Section 8. Opcodes from 160 to 255 are not defined and, as required by
+// the RFC, stop the parsing.
+func parseTerminalModes(in []byte) (TerminalModes, bool) {
+	modes := make(TerminalModes)
+	for len(in) > 0 {
+		op := in[0]
+		if op == tty_OP_END || op >= 160 {
+			break
+		}
+		if len(in) < 5 {
+			return nil, false
+		}
+		modes[op] = binary.BigEndian.Uint32(in[1:5])
+		in = in[5:]
+	}
+	return modes, true
+}
+
+// WindowChangeRequest holds the contents of a "window-change" channel
+// request, as sent by Session.WindowChange.
+type WindowChangeRequest struct {
+	// Columns and Rows are the terminal dimensions in characters.
+	Columns uint32
+	Rows    uint32
+
+	// Width and Height are the terminal dimensions in pixels.
+	Width  uint32
+	Height uint32
+}
+
+// ParseWindowChangeRequest parses the payload of a "window-change" channel
+// request. It reports false if the payload is malformed.
+func ParseWindowChangeRequest(payload []byte) (WindowChangeRequest, bool) {
+	var msg ptyWindowChangeMsg
+	if err := Unmarshal(payload, &msg); err != nil {
+		return WindowChangeRequest{}, false
+	}
+	return WindowChangeRequest(msg), true
+}
+
 // RFC 4254 Section 6.9.
 type signalMsg struct {
 	Signal string
@@ -583,14 +718,18 @@ func (s *Session) StderrPipe() (io.Reader, error) {
 	return s.ch.Stderr(), nil
 }
 
-// newSession returns a new interactive session on the remote host.
-func newSession(ch Channel, reqs <-chan *Request) (*Session, error) {
+// newSession returns a Session for ch. If closed is not nil, it is called
+// once the remote side has closed ch.
+func newSession(ch Channel, reqs <-chan *Request, closed func()) (*Session, error) {
 	s := &Session{
 		ch: ch,
 	}
 	s.exitStatus = make(chan error, 1)
 	go func() {
 		s.exitStatus <- s.wait(reqs)
+		if closed != nil {
+			closed()
+		}
 	}()
 
 	return s, nil
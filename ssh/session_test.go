@@ -8,13 +8,17 @@ package ssh
 
 import (
 	"bytes"
+	"context"
 	crypto_rand "crypto/rand"
 	"errors"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/robarchibald/crypto/ssh/terminal"
 )
@@ -774,3 +778,726 @@ func TestHostKeyAlgorithms(t *testing.T) {
 		t.Fatal("succeeded connecting with unknown hostkey algorithm")
 	}
 }
+
+func TestParseEnvRequest(t *testing.T) {
+	// "env" payload for LANG=en_US.UTF-8 as sent by OpenSSH.
+	payload := []byte{
+		0, 0, 0, 4, 'L', 'A', 'N', 'G',
+		0, 0, 0, 11, 'e', 'n', '_', 'U', 'S', '.', 'U', 'T', 'F', '-', '8',
+	}
+	req, ok := ParseEnvRequest(payload)
+	if !ok {
+		t.Fatal("ParseEnvRequest failed")
+	}
+	if want := (EnvRequest{Name: "LANG", Value: "en_US.UTF-8"}); req != want {
+		t.Errorf("got %+v, want %+v", req, want)
+	}
+	if _, ok := ParseEnvRequest(payload[:10]); ok {
+		t.Error("ParseEnvRequest succeeded on truncated payload")
+	}
+}
+
+func TestParsePtyRequest(t *testing.T) {
+	payload := []byte{
+		0, 0, 0, 5, 'x', 't', 'e', 'r', 'm', // term
+		0, 0, 0, 80, // columns
+		0, 0, 0, 24, // rows
+		0, 0, 2, 128, // width
+		0, 0, 0, 192, // height
+		0, 0, 0, 11, // modelist length
+		ECHO, 0, 0, 0, 1,
+		TTY_OP_ISPEED, 0, 0, 0x96, 0,
+		tty_OP_END,
+	}
+	req, ok := ParsePtyRequest(payload)
+	if !ok {
+		t.Fatal("ParsePtyRequest failed")
+	}
+	want := PtyRequest{
+		Term:    "xterm",
+		Columns: 80,
+		Rows:    24,
+		Width:   640,
+		Height:  192,
+		Modes:   TerminalModes{ECHO: 1, TTY_OP_ISPEED: 38400},
+	}
+	if !reflect.DeepEqual(req, want) {
+		t.Errorf("got %+v, want %+v", req, want)
+	}
+
+	// Truncate the last mode's argument.
+	bad := append([]byte(nil), payload[:len(payload)-15]...)
+	bad = append(bad, 0, 0, 0, 8, ECHO, 0, 0, 0, 1, TTY_OP_ISPEED, 0, 0)
+	if _, ok := ParsePtyRequest(bad); ok {
+		t.Error("ParsePtyRequest succeeded on malformed terminal modes")
+	}
+}
+
+func TestParseWindowChangeRequest(t *testing.T) {
+	payload := []byte{
+		0, 0, 0, 132, // columns
+		0, 0, 0, 43, // rows
+		0, 0, 4, 32, // width
+		0, 0, 1, 88, // height
+	}
+	req, ok := ParseWindowChangeRequest(payload)
+	if !ok {
+		t.Fatal("ParseWindowChangeRequest failed")
+	}
+	if want := (WindowChangeRequest{Columns: 132, Rows: 43, Width: 1056, Height: 344}); req != want {
+		t.Errorf("got %+v, want %+v", req, want)
+	}
+	if _, ok := ParseWindowChangeRequest(payload[:12]); ok {
+		t.Error("ParseWindowChangeRequest succeeded on truncated payload")
+	}
+}
+
+func TestSessionRequestsRoundTrip(t *testing.T) {
+	reqs := make(chan *Request, 3)
+	conn := dial(func(ch Channel, in <-chan *Request, t *testing.T) {
+		defer ch.Close()
+		for req := range in {
+			req.Reply(true, nil)
+			reqs <- req
+			if req.Type == "window-change" {
+				return
+			}
+		}
+	}, t)
+	defer conn.Close()
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatalf("Unable to request new session: %v", err)
+	}
+	defer session.Close()
+
+	if err := session.Setenv("TERM_PROGRAM", "test"); err != nil {
+		t.Fatalf("Setenv: %v", err)
+	}
+	if err := session.RequestPty("vt100", 25, 80, TerminalModes{ECHO: 0}); err != nil {
+		t.Fatalf("RequestPty: %v", err)
+	}
+	if err := session.WindowChange(50, 120); err != nil {
+		t.Fatalf("WindowChange: %v", err)
+	}
+
+	env, ok := ParseEnvRequest((<-reqs).Payload)
+	if !ok || env.Name != "TERM_PROGRAM" || env.Value != "test" {
+		t.Errorf("got env %+v, %v", env, ok)
+	}
+	pty, ok := ParsePtyRequest((<-reqs).Payload)
+	wantPty := PtyRequest{Term: "vt100", Columns: 80, Rows: 25, Width: 640, Height: 200, Modes: TerminalModes{ECHO: 0}}
+	if !ok || !reflect.DeepEqual(pty, wantPty) {
+		t.Errorf("got pty %+v, %v; want %+v", pty, ok, wantPty)
+	}
+	wc, ok := ParseWindowChangeRequest((<-reqs).Payload)
+	if !ok || wc.Columns != 120 || wc.Rows != 50 {
+		t.Errorf("got window change %+v, %v", wc, ok)
+	}
+}
+
+// dialNoMoreSessions connects a client to a server which accepts all
+// channels and discards their requests.
+func dialNoMoreSessions(t *testing.T, serverConf *ServerConfig) *Client {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	serverConf.AddHostKey(testSigners["rsa"])
+	go func() {
+		defer c1.Close()
+		_, chans, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			return
+		}
+		go DiscardRequests(reqs)
+		for newCh := range chans {
+			ch, in, err := newCh.Accept()
+			if err != nil {
+				t.Errorf("Accept: %v", err)
+				continue
+			}
+			go DiscardRequests(in)
+			defer ch.Close()
+		}
+	}()
+
+	conn, chans, reqs, err := NewClientConn(c2, "", &ClientConfig{
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	return NewClient(conn, chans, reqs)
+}
+
+func TestNoMoreSessionsRequest(t *testing.T) {
+	conn := dialNoMoreSessions(t, &ServerConfig{NoClientAuth: true})
+	defer conn.Close()
+
+	if _, _, err := conn.SendRequest(noMoreSessionsRequest, false, nil); err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+
+	// Other channel types are not affected.
+	ch, in, err := conn.OpenChannel("direct-tcpip", Marshal(&channelOpenDirectMsg{}))
+	if err != nil {
+		t.Fatalf("OpenChannel(direct-tcpip): %v", err)
+	}
+	go DiscardRequests(in)
+	ch.Close()
+
+	_, err = conn.NewSession()
+	if openErr, ok := err.(*OpenChannelError); !ok || openErr.Reason != Prohibited {
+		t.Fatalf("NewSession after %s: got %v, want prohibited", noMoreSessionsRequest, err)
+	}
+}
+
+func TestNoMoreSessionsConfig(t *testing.T) {
+	conn := dialNoMoreSessions(t, &ServerConfig{NoClientAuth: true, NoMoreSessions: true})
+	defer conn.Close()
+
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatalf("first NewSession: %v", err)
+	}
+	defer session.Close()
+
+	_, err = conn.NewSession()
+	if openErr, ok := err.(*OpenChannelError); !ok || openErr.Reason != Prohibited {
+		t.Fatalf("second NewSession: got %v, want prohibited", err)
+	}
+}
+
+func TestMaxChannels(t *testing.T) {
+	const max = 3
+	conn := dialNoMoreSessions(t, &ServerConfig{NoClientAuth: true, MaxChannels: max})
+	defer conn.Close()
+
+	var chans []Channel
+	for i := 0; i < max; i++ {
+		ch, in, err := conn.OpenChannel("direct-tcpip", Marshal(&channelOpenDirectMsg{}))
+		if err != nil {
+			t.Fatalf("OpenChannel %d: %v", i, err)
+		}
+		go DiscardRequests(in)
+		chans = append(chans, ch)
+	}
+	_, err := conn.NewSession()
+	if openErr, ok := err.(*OpenChannelError); !ok || openErr.Reason != ResourceShortage {
+		t.Fatalf("NewSession beyond %d channels: got %v, want resource shortage", max, err)
+	}
+
+	// Closing a channel makes room for another.
+	chans[0].Close()
+	for i := 0; ; i++ {
+		session, err := conn.NewSession()
+		if err == nil {
+			session.Close()
+			break
+		}
+		// The server frees the channel once it has seen the close.
+		if openErr, ok := err.(*OpenChannelError); !ok || openErr.Reason != ResourceShortage || i == 100 {
+			t.Fatalf("NewSession after a close: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, ch := range chans[1:] {
+		ch.Close()
+	}
+}
+
+func TestServerConnDrain(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["rsa"])
+	serverConns := make(chan *ServerConn, 1)
+	go func() {
+		conn, chans, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			close(serverConns)
+			return
+		}
+		serverConns <- conn
+		go DiscardRequests(reqs)
+		for newCh := range chans {
+			ch, in, err := newCh.Accept()
+			if err != nil {
+				t.Errorf("Accept: %v", err)
+				continue
+			}
+			go DiscardRequests(in)
+			go func() {
+				io.Copy(ch, ch)
+				ch.Close()
+			}()
+		}
+	}()
+
+	conn, chans, reqs, err := NewClientConn(c2, "", &ClientConfig{
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := NewClient(conn, chans, reqs)
+	defer client.Close()
+
+	ch, in, err := client.OpenChannel("echo", nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	go DiscardRequests(in)
+
+	server := <-serverConns
+	if server == nil {
+		t.FailNow()
+	}
+	server.Drain()
+
+	if _, _, err := client.OpenChannel("echo", nil); err == nil {
+		t.Fatal("OpenChannel succeeded on a draining connection")
+	} else if openErr, ok := err.(*OpenChannelError); !ok || openErr.Reason != Prohibited {
+		t.Fatalf("OpenChannel: got %v, want prohibited", err)
+	}
+	if _, err := client.NewSession(); err == nil {
+		t.Fatal("NewSession succeeded on a draining connection")
+	}
+
+	// The open channel keeps working until it is closed.
+	const msg = "still there"
+	if _, err := io.WriteString(ch, msg); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := ch.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	got, err := ioutil.ReadAll(ch)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != msg {
+		t.Errorf("got %q, want %q", got, msg)
+	}
+	ch.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- server.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("drained connection was not closed")
+	}
+}
+
+// dialForceCommand connects a client authenticating with a certificate
+// carrying the force-command critical option to a server sending the
+// type and command of each session request it receives to reqs.
+func dialForceCommand(t *testing.T, serverConf *ServerConfig, reqs chan<- string) *Client {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	checker := &CertChecker{
+		SupportedCriticalOptions: []string{"force-command"},
+		IsUserAuthority: func(k PublicKey) bool {
+			return bytes.Equal(k.Marshal(), testPublicKeys["ecdsa"].Marshal())
+		},
+	}
+	serverConf.PublicKeyCallback = checker.Authenticate
+	serverConf.AddHostKey(testSigners["rsa"])
+	go func() {
+		defer c1.Close()
+		_, chans, globalReqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			return
+		}
+		go DiscardRequests(globalReqs)
+		for newCh := range chans {
+			ch, in, err := newCh.Accept()
+			if err != nil {
+				t.Errorf("Accept: %v", err)
+				continue
+			}
+			go func() {
+				for req := range in {
+					var msg execMsg
+					Unmarshal(req.Payload, &msg)
+					reqs <- req.Type + " " + msg.Command
+					req.Reply(true, nil)
+					ch.SendRequest("exit-status", false, Marshal(exitStatusMsg{}))
+					ch.Close()
+				}
+			}()
+		}
+	}()
+
+	cert := &Certificate{
+		Key:             testPublicKeys["rsa"],
+		ValidBefore:     CertTimeInfinity,
+		CertType:        UserCert,
+		Permissions:     Permissions{CriticalOptions: map[string]string{"force-command": "/bin/forced"}},
+		ValidPrincipals: []string{"user"},
+	}
+	cert.SignCert(crypto_rand.Reader, testSigners["ecdsa"])
+	certSigner, err := NewCertSigner(cert, testSigners["rsa"])
+	if err != nil {
+		t.Fatalf("NewCertSigner: %v", err)
+	}
+	conn, chans, globalReqs, err := NewClientConn(c2, "", &ClientConfig{
+		User:            "user",
+		Auth:            []AuthMethod{PublicKeys(certSigner)},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	return NewClient(conn, chans, globalReqs)
+}
+
+func TestForceCommand(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		callback func(ConnMetadata, string, string) string
+		want     []string
+	}{
+		{"forced", nil, []string{"/bin/forced", "/bin/forced", "/bin/forced"}},
+		{"callback", func(conn ConnMetadata, forced, requested string) string {
+			return forced + " " + conn.User() + " " + requested
+		}, []string{"/bin/forced user ls", "/bin/forced user ", "/bin/forced user sftp"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			reqs := make(chan string, 1)
+			conn := dialForceCommand(t, &ServerConfig{ForceCommandCallback: tt.callback}, reqs)
+			defer conn.Close()
+
+			for i, start := range []func(*Session) error{
+				func(s *Session) error { return s.Start("ls") },
+				func(s *Session) error { return s.Shell() },
+				func(s *Session) error { return s.RequestSubsystem("sftp") },
+			} {
+				session, err := conn.NewSession()
+				if err != nil {
+					t.Fatalf("NewSession: %v", err)
+				}
+				if err := start(session); err != nil {
+					t.Fatalf("request %d: %v", i, err)
+				}
+				if got, want := <-reqs, "exec "+tt.want[i]; got != want {
+					t.Errorf("request %d: server got %q, want %q", i, got, want)
+				}
+				session.Wait()
+			}
+
+			// Other requests are not affected.
+			session, err := conn.NewSession()
+			if err != nil {
+				t.Fatalf("NewSession: %v", err)
+			}
+			if err := session.Setenv("LANG", "C"); err != nil {
+				t.Fatalf("Setenv: %v", err)
+			}
+			if got := <-reqs; !strings.HasPrefix(got, "env ") {
+				t.Errorf("server got %q, want an env request", got)
+			}
+			session.Close()
+		})
+	}
+}
+
+func TestServerAcceptEnv(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{
+		NoClientAuth: true,
+		AcceptEnv:    []string{"LANG", "LC_*", "BAD*"},
+	}
+	serverConf.AddHostKey(testSigners["rsa"])
+	envs := make(chan string, 10)
+	go func() {
+		_, chans, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			return
+		}
+		go DiscardRequests(reqs)
+		for newCh := range chans {
+			ch, in, err := newCh.Accept()
+			if err != nil {
+				t.Errorf("Accept: %v", err)
+				continue
+			}
+			go func() {
+				defer ch.Close()
+				for req := range in {
+					switch req.Type {
+					case "env":
+						env, ok := ParseEnvRequest(req.Payload)
+						if !ok {
+							t.Errorf("ParseEnvRequest failed on delivered request")
+						}
+						envs <- env.Name + "=" + env.Value
+						req.Reply(true, nil)
+					case "exec":
+						close(envs)
+						req.Reply(true, nil)
+						ch.SendRequest("exit-status", false, Marshal(exitStatusMsg{}))
+						return
+					default:
+						req.Reply(false, nil)
+					}
+				}
+			}()
+		}
+	}()
+
+	conn, chans, reqs, err := NewClientConn(c2, "", &ClientConfig{
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := NewClient(conn, chans, reqs)
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	for _, env := range []struct {
+		name, value string
+		ok          bool
+	}{
+		{"LANG", "en_US.UTF-8", true},
+		{"PATH", "/tmp", false},
+		{"LC_ALL", "C", true},
+		{"LD_PRELOAD", "/tmp/evil.so", false},
+		{"BAD-NAME", "x", false},
+		{"BAD_VALUE", "a\x00b", false},
+		{"BAD_", "ok", true},
+	} {
+		err := session.Setenv(env.name, env.value)
+		if env.ok && err != nil {
+			t.Errorf("Setenv(%q): %v", env.name, err)
+		} else if !env.ok && err == nil {
+			t.Errorf("Setenv(%q) succeeded; want refused", env.name)
+		}
+	}
+	// A refused request not wanting a reply is silently dropped.
+	if _, err := session.SendRequest("env", false, Marshal(setenvRequest{Name: "PATH", Value: "/tmp"})); err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+	if err := session.Run("true"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	var got []string
+	for env := range envs {
+		got = append(got, env)
+	}
+	if want := []string{"LANG=en_US.UTF-8", "LC_ALL=C", "BAD_=ok"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("delivered env requests %q; want %q", got, want)
+	}
+}
+
+func TestAcceptEnvValidation(t *testing.T) {
+	for _, tt := range []struct {
+		name, value string
+		want        bool
+	}{
+		{"LANG", "C", true},
+		{"_X1", "", true},
+		{"", "C", false},
+		{"1X", "C", false},
+		{"LC ALL", "C", false},
+		{"LC_ALL=x", "C", false},
+		{"LANG", "C\x00", false},
+		{"PATH", "/bin", false},
+	} {
+		// The patterns match all the names but PATH.
+		payload := Marshal(setenvRequest{Name: tt.name, Value: tt.value})
+		if got := acceptEnv([]string{"", "L*", "_*", "1*"}, payload); got != tt.want {
+			t.Errorf("acceptEnv(%q, %q) = %v; want %v", tt.name, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestConnStats(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.AddHostKey(testSigners["rsa"])
+	const numChannels, size = 2, 64 << 10
+	serverDone := make(chan ConnStats, 1)
+	go func() {
+		conn, chans, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			close(serverDone)
+			return
+		}
+		go DiscardRequests(reqs)
+		for i := 0; i < numChannels; i++ {
+			ch, in, err := (<-chans).Accept()
+			if err != nil {
+				t.Errorf("Accept: %v", err)
+				break
+			}
+			go DiscardRequests(in)
+			if n, err := io.Copy(ioutil.Discard, ch); n != size || err != nil {
+				t.Errorf("server read %d bytes, %v; want %d", n, err, size)
+			}
+			ch.Close()
+		}
+		serverDone <- conn.Conn.(ConnStatser).Stats()
+	}()
+
+	clientConf := &ClientConfig{HostKeyCallback: InsecureIgnoreHostKey()}
+	// Rekey about once per channel.
+	clientConf.RekeyThreshold = size
+	conn, _, _, err := NewClientConn(c2, "", clientConf)
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	defer conn.Close()
+
+	data := make([]byte, size)
+	for i := 0; i < numChannels; i++ {
+		ch, in, err := conn.OpenChannel("test", nil)
+		if err != nil {
+			t.Fatalf("OpenChannel: %v", err)
+		}
+		go DiscardRequests(in)
+		if _, err := ch.Write(data); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		ch.CloseWrite()
+		// Wait for the server to close the channel.
+		io.Copy(ioutil.Discard, ch)
+		ch.Close()
+	}
+
+	serverStats := <-serverDone
+	clientStats := conn.(ConnStatser).Stats()
+
+	// Each packet of channel data has 9 bytes of header. The remaining
+	// overhead comes from the authentication, channel and window messages.
+	const total = numChannels * size
+	const maxOverhead = total/100 + 4096
+	check := func(side string, got, want uint64) {
+		if got < want || got > want+maxOverhead {
+			t.Errorf("%s: got %d bytes; want between %d and %d", side, got, want, want+maxOverhead)
+		}
+	}
+	check("client written", clientStats.BytesWritten, total)
+	check("server read", serverStats.BytesRead, total)
+	if clientStats.BytesRead > maxOverhead || serverStats.BytesWritten > maxOverhead {
+		t.Errorf("client read %d bytes, server written %d bytes; want at most %d", clientStats.BytesRead, serverStats.BytesWritten, maxOverhead)
+	}
+	if clientStats.Channels != numChannels || serverStats.Channels != numChannels {
+		t.Errorf("got %d client and %d server channels; want %d", clientStats.Channels, serverStats.Channels, numChannels)
+	}
+	if clientStats.Rekeys == 0 || serverStats.Rekeys == 0 {
+		t.Errorf("got %d client and %d server rekeys; want > 0", clientStats.Rekeys, serverStats.Rekeys)
+	}
+}
+
+// subsystemHandler accepts the "sftp" subsystem, refuses the others, and
+// never replies to a request for the "hang" subsystem.
+func subsystemHandler(ch Channel, in <-chan *Request, t *testing.T) {
+	defer ch.Close()
+	for req := range in {
+		if req.Type != "subsystem" {
+			req.Reply(false, nil)
+			continue
+		}
+		var msg subsystemRequestMsg
+		if err := Unmarshal(req.Payload, &msg); err != nil {
+			t.Errorf("Unmarshal: %v", err)
+			req.Reply(false, nil)
+			continue
+		}
+		switch msg.Subsystem {
+		case "sftp":
+			req.Reply(true, nil)
+		case "hang":
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func TestRequestSubsystemContext(t *testing.T) {
+	conn := dial(subsystemHandler, t)
+	defer conn.Close()
+
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	if err := session.RequestSubsystemContext(context.Background(), "sftp"); err != nil {
+		t.Errorf("RequestSubsystemContext(sftp): %v", err)
+	}
+	session.Close()
+
+	session, err = conn.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	err = session.RequestSubsystemContext(context.Background(), "netconf")
+	var denied *SubsystemDeniedError
+	if !errors.As(err, &denied) || denied.Name != "netconf" {
+		t.Errorf("RequestSubsystemContext(netconf) = %v, want a *SubsystemDeniedError for netconf", err)
+	}
+	if err := session.RequestSubsystem("netconf"); !errors.As(err, &denied) {
+		t.Errorf("RequestSubsystem(netconf) = %v, want a *SubsystemDeniedError", err)
+	}
+	session.Close()
+}
+
+func TestRequestSubsystemContextTimeout(t *testing.T) {
+	conn := dial(subsystemHandler, t)
+	defer conn.Close()
+
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := session.RequestSubsystemContext(ctx, "hang"); err != context.DeadlineExceeded {
+		t.Fatalf("RequestSubsystemContext(hang) = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// The session is closed.
+	if _, err := session.SendRequest("env", true, nil); err == nil {
+		t.Error("SendRequest succeeded on a session whose subsystem request timed out")
+	}
+
+	// The connection is still usable.
+	session, err = conn.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+	if err := session.RequestSubsystemContext(context.Background(), "sftp"); err != nil {
+		t.Errorf("RequestSubsystemContext(sftp): %v", err)
+	}
+}
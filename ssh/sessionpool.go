@@ -0,0 +1,62 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import "context"
+
+// defaultMaxSessions is the default MaxSessions of OpenSSH's sshd.
+const defaultMaxSessions = 10
+
+// SessionPool bounds the number of sessions open at once on a Client,
+// making the excess wait for others to close rather than fail.
+//
+// Many sessions can share the single connection of a Client, but servers
+// limit how many a connection may have open at once: sshd refuses more than
+// its MaxSessions setting, 10 by default, and Client.NewSession then fails
+// with an *OpenChannelError. The sessions of a SessionPool count against the
+// limit from when they are opened until the server closes them, as it does
+// when their command exits or once they are closed with Session.Close.
+// Sessions opened with Client.NewSession are not counted, so the max of a
+// SessionPool must leave room for them.
+//
+// A SessionPool is safe for concurrent use by multiple goroutines.
+type SessionPool struct {
+	client *Client
+	slots  chan struct{}
+}
+
+// NewSessionPool returns a SessionPool opening at most max sessions at once
+// on c. If max is zero or negative, the default MaxSessions of sshd, 10, is
+// used.
+func NewSessionPool(c *Client, max int) *SessionPool {
+	if max <= 0 {
+		max = defaultMaxSessions
+	}
+	return &SessionPool{
+		client: c,
+		slots:  make(chan struct{}, max),
+	}
+}
+
+// NewSession opens a new Session, first waiting for one of the sessions of
+// p to be closed if max of them are already open. If ctx is done before,
+// it returns the error of ctx.
+func (p *SessionPool) NewSession(ctx context.Context) (*Session, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	ch, in, err := p.client.OpenChannel("session", nil)
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+	return newSession(ch, in, p.release)
+}
+
+func (p *SessionPool) release() {
+	<-p.slots
+}
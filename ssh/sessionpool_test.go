@@ -0,0 +1,126 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sessionCounter is a server handler counting the open sessions, which it
+// closes on "done" requests.
+type sessionCounter struct {
+	mu        sync.Mutex
+	open, max int
+}
+
+func (c *sessionCounter) handle(ch Channel, in <-chan *Request, t *testing.T) {
+	c.mu.Lock()
+	c.open++
+	if c.open > c.max {
+		c.max = c.open
+	}
+	c.mu.Unlock()
+
+	for req := range in {
+		if req.Type == "done" {
+			break
+		}
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+	}
+	c.mu.Lock()
+	c.open--
+	c.mu.Unlock()
+	ch.Close()
+}
+
+func (c *sessionCounter) maxOpen() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.max
+}
+
+func TestSessionPool(t *testing.T) {
+	var counter sessionCounter
+	conn := dial(counter.handle, t)
+	defer conn.Close()
+
+	const max = 2
+	pool := NewSessionPool(conn, max)
+	ctx := context.Background()
+	var sessions []*Session
+	for i := 0; i < max; i++ {
+		s, err := pool.NewSession(ctx)
+		if err != nil {
+			t.Fatalf("NewSession %d: %v", i, err)
+		}
+		sessions = append(sessions, s)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := pool.NewSession(timeoutCtx); err != context.DeadlineExceeded {
+		t.Fatalf("NewSession with %d sessions open = %v; want %v", max, err, context.DeadlineExceeded)
+	}
+
+	// Queued sessions proceed as the server closes others.
+	const queued = 4
+	opened := make(chan *Session)
+	for i := 0; i < queued; i++ {
+		go func() {
+			s, err := pool.NewSession(ctx)
+			if err != nil {
+				t.Errorf("queued NewSession: %v", err)
+			}
+			opened <- s
+		}()
+	}
+	select {
+	case <-opened:
+		t.Fatal("queued NewSession returned while the pool is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	for i := 0; i < queued; i++ {
+		if _, err := sessions[0].SendRequest("done", false, nil); err != nil {
+			t.Fatalf("SendRequest: %v", err)
+		}
+		sessions = append(sessions[1:], <-opened)
+	}
+	if got := counter.maxOpen(); got != max {
+		t.Errorf("server had up to %d sessions open at once; want %d", got, max)
+	}
+
+	// And as the client closes them.
+	sessions[0].Close()
+	s, err := pool.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("NewSession after Close: %v", err)
+	}
+	sessions = append(sessions[1:], s)
+	for _, s := range sessions {
+		s.Close()
+	}
+}
+
+func TestSessionPoolOpenError(t *testing.T) {
+	var counter sessionCounter
+	conn := dial(counter.handle, t)
+	pool := NewSessionPool(conn, 1)
+	conn.Close()
+
+	// A failed open does not hold a slot.
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := pool.NewSession(ctx)
+		cancel()
+		if err == nil || err == context.DeadlineExceeded {
+			t.Fatalf("NewSession %d on a closed connection = %v; want the open error", i, err)
+		}
+	}
+}
@@ -0,0 +1,608 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+// This file implements the sntrup761 key encapsulation mechanism, the
+// Streamlined NTRU Prime instance with parameters p = 761, q = 4591 and
+// w = 286, as specified in https://ntruprime.cr.yp.to/nist/ntruprime-20201007.pdf
+// and used by OpenSSH. It follows the reference implementation, including
+// its constant-time arithmetic, so that the encodings and hashes match.
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	sntrupP   = 761
+	sntrupQ   = 4591
+	sntrupW   = 286
+	sntrupQ12 = (sntrupQ - 1) / 2
+
+	sntrupSmallBytes   = (sntrupP + 3) / 4
+	sntrupRqBytes      = 1158
+	sntrupRoundedBytes = 1007
+	sntrupHashBytes    = 32
+
+	sntrupPublicKeySize  = sntrupRqBytes
+	sntrupPrivateKeySize = 2*sntrupSmallBytes + sntrupPublicKeySize + sntrupSmallBytes + sntrupHashBytes
+	sntrupCiphertextSize = sntrupRoundedBytes + sntrupHashBytes
+	sntrupSharedKeySize  = sntrupHashBytes
+)
+
+// uint32DivMod14 returns x/m and x%m in constant time, for 0 < m < 16384.
+func uint32DivMod14(x uint32, m uint16) (uint32, uint16) {
+	v := uint32(0x80000000) / uint32(m)
+	q := uint32(0)
+
+	qpart := uint32((uint64(x) * uint64(v)) >> 31)
+	x -= qpart * uint32(m)
+	q += qpart
+
+	qpart = uint32((uint64(x) * uint64(v)) >> 31)
+	x -= qpart * uint32(m)
+	q += qpart
+
+	x -= uint32(m)
+	q++
+	mask := -(x >> 31)
+	x += mask & uint32(m)
+	q += mask
+	return q, uint16(x)
+}
+
+func uint32Mod14(x uint32, m uint16) uint16 {
+	_, r := uint32DivMod14(x, m)
+	return r
+}
+
+// int32Mod14 returns x mod m, in [0, m), in constant time.
+func int32Mod14(x int32, m uint16) uint16 {
+	_, r := uint32DivMod14(0x80000000+uint32(x), m)
+	_, r2 := uint32DivMod14(0x80000000, m)
+	r -= r2
+	mask := -(r >> 15)
+	r += mask & m
+	return r
+}
+
+// nonzeroMask returns -1 if x is not zero, and 0 otherwise.
+func nonzeroMask(x int16) int {
+	u := uint32(uint16(x))
+	return -int((u | -u) >> 31)
+}
+
+// negativeMask returns -1 if x is negative, and 0 otherwise.
+func negativeMask(x int16) int {
+	return int(x >> 15)
+}
+
+// fqFreeze reduces x to the representative of its class mod q in
+// [-(q-1)/2, (q-1)/2].
+func fqFreeze(x int32) int16 {
+	return int16(int32Mod14(x+sntrupQ12, sntrupQ)) - sntrupQ12
+}
+
+// f3Freeze reduces x to the representative of its class mod 3 in [-1, 1].
+func f3Freeze(x int32) int8 {
+	return int8(int32Mod14(x+1, 3)) - 1
+}
+
+// fqRecip returns the inverse of a mod q, a^(q-2).
+func fqRecip(a int16) int16 {
+	ai := a
+	for i := 1; i < sntrupQ-2; i++ {
+		ai = fqFreeze(int32(a) * int32(ai))
+	}
+	return ai
+}
+
+// weightMask returns 0 if r has exactly w nonzero coefficients, and -1
+// otherwise.
+func weightMask(r *[sntrupP]int8) int {
+	weight := 0
+	for _, c := range r {
+		weight += int(c & 1)
+	}
+	return nonzeroMask(int16(weight - sntrupW))
+}
+
+// r3Mult sets h to f*g in R3, the ring (Z/3)[x]/(x^p-x-1).
+func r3Mult(h, f, g *[sntrupP]int8) {
+	var fg [2*sntrupP - 1]int8
+	for i := 0; i < sntrupP; i++ {
+		var r int8
+		for j := 0; j <= i; j++ {
+			r = f3Freeze(int32(r) + int32(f[j])*int32(g[i-j]))
+		}
+		fg[i] = r
+	}
+	for i := sntrupP; i < 2*sntrupP-1; i++ {
+		var r int8
+		for j := i - sntrupP + 1; j < sntrupP; j++ {
+			r = f3Freeze(int32(r) + int32(f[j])*int32(g[i-j]))
+		}
+		fg[i] = r
+	}
+	for i := 2*sntrupP - 2; i >= sntrupP; i-- {
+		fg[i-sntrupP] = f3Freeze(int32(fg[i-sntrupP]) + int32(fg[i]))
+		fg[i-sntrupP+1] = f3Freeze(int32(fg[i-sntrupP+1]) + int32(fg[i]))
+	}
+	copy(h[:], fg[:sntrupP])
+}
+
+// r3Recip sets out to the inverse of in in R3, and returns 0 if in is
+// invertible, and -1 otherwise.
+func r3Recip(out, in *[sntrupP]int8) int {
+	var f, g, v, r [sntrupP + 1]int8
+	r[0] = 1
+	f[0] = 1
+	f[sntrupP-1] = -1
+	f[sntrupP] = -1
+	for i := 0; i < sntrupP; i++ {
+		g[sntrupP-1-i] = in[i]
+	}
+	delta := 1
+
+	for loop := 0; loop < 2*sntrupP-1; loop++ {
+		copy(v[1:], v[:sntrupP])
+		v[0] = 0
+
+		sign := int32(-g[0] * f[0])
+		swap := int8(negativeMask(int16(-delta)) & nonzeroMask(int16(g[0])))
+		delta ^= int(swap) & (delta ^ -delta)
+		delta++
+
+		for i := range f {
+			t := swap & (f[i] ^ g[i])
+			f[i] ^= t
+			g[i] ^= t
+			t = swap & (v[i] ^ r[i])
+			v[i] ^= t
+			r[i] ^= t
+		}
+		for i := range g {
+			g[i] = f3Freeze(int32(g[i]) + sign*int32(f[i]))
+		}
+		for i := range r {
+			r[i] = f3Freeze(int32(r[i]) + sign*int32(v[i]))
+		}
+		copy(g[:sntrupP], g[1:])
+		g[sntrupP] = 0
+	}
+
+	sign := f[0]
+	for i := 0; i < sntrupP; i++ {
+		out[i] = sign * v[sntrupP-1-i]
+	}
+	return nonzeroMask(int16(delta))
+}
+
+// rqMultSmall sets h to f*g in Rq, the ring (Z/q)[x]/(x^p-x-1).
+func rqMultSmall(h, f *[sntrupP]int16, g *[sntrupP]int8) {
+	var fg [2*sntrupP - 1]int16
+	for i := 0; i < sntrupP; i++ {
+		var r int16
+		for j := 0; j <= i; j++ {
+			r = fqFreeze(int32(r) + int32(f[j])*int32(g[i-j]))
+		}
+		fg[i] = r
+	}
+	for i := sntrupP; i < 2*sntrupP-1; i++ {
+		var r int16
+		for j := i - sntrupP + 1; j < sntrupP; j++ {
+			r = fqFreeze(int32(r) + int32(f[j])*int32(g[i-j]))
+		}
+		fg[i] = r
+	}
+	for i := 2*sntrupP - 2; i >= sntrupP; i-- {
+		fg[i-sntrupP] = fqFreeze(int32(fg[i-sntrupP]) + int32(fg[i]))
+		fg[i-sntrupP+1] = fqFreeze(int32(fg[i-sntrupP+1]) + int32(fg[i]))
+	}
+	copy(h[:], fg[:sntrupP])
+}
+
+// rqRecip3 sets out to the inverse of 3*in in Rq, and returns 0 if it
+// exists, which is always the case for a small in, and -1 otherwise.
+func rqRecip3(out *[sntrupP]int16, in *[sntrupP]int8) int {
+	var f, g, v, r [sntrupP + 1]int16
+	r[0] = fqRecip(3)
+	f[0] = 1
+	f[sntrupP-1] = -1
+	f[sntrupP] = -1
+	for i := 0; i < sntrupP; i++ {
+		g[sntrupP-1-i] = int16(in[i])
+	}
+	delta := 1
+
+	for loop := 0; loop < 2*sntrupP-1; loop++ {
+		copy(v[1:], v[:sntrupP])
+		v[0] = 0
+
+		swap := int16(negativeMask(int16(-delta)) & nonzeroMask(g[0]))
+		delta ^= int(swap) & (delta ^ -delta)
+		delta++
+
+		for i := range f {
+			t := swap & (f[i] ^ g[i])
+			f[i] ^= t
+			g[i] ^= t
+			t = swap & (v[i] ^ r[i])
+			v[i] ^= t
+			r[i] ^= t
+		}
+		f0, g0 := int32(f[0]), int32(g[0])
+		for i := range g {
+			g[i] = fqFreeze(f0*int32(g[i]) - g0*int32(f[i]))
+		}
+		for i := range r {
+			r[i] = fqFreeze(f0*int32(r[i]) - g0*int32(v[i]))
+		}
+		copy(g[:sntrupP], g[1:])
+		g[sntrupP] = 0
+	}
+
+	scale := int32(fqRecip(f[0]))
+	for i := 0; i < sntrupP; i++ {
+		out[i] = fqFreeze(scale * int32(v[sntrupP-1-i]))
+	}
+	return nonzeroMask(int16(delta))
+}
+
+// sortUint32 sorts x in increasing order with a data-independent sequence
+// of comparisons, the djbsort network.
+func sortUint32(x []uint32) {
+	n := len(x)
+	if n < 2 {
+		return
+	}
+	minmax := func(a, b *uint32) {
+		// mask is all ones if *b < *a.
+		mask := uint32(int64(uint64(*b)-uint64(*a)) >> 63)
+		t := (*a ^ *b) & mask
+		*a ^= t
+		*b ^= t
+	}
+	top := 1
+	for top < n-top {
+		top += top
+	}
+	for p := top; p > 0; p >>= 1 {
+		for i := 0; i < n-p; i++ {
+			if i&p == 0 {
+				minmax(&x[i], &x[i+p])
+			}
+		}
+		i := 0
+		for q := top; q > p; q >>= 1 {
+			for ; i < n-q; i++ {
+				if i&p == 0 {
+					a := x[i+p]
+					for r := q; r > p; r >>= 1 {
+						minmax(&a, &x[i+r])
+					}
+					x[i+p] = a
+				}
+			}
+		}
+	}
+}
+
+// randomUint32s fills out with random values read from rand.
+func randomUint32s(rand io.Reader, out []uint32) error {
+	buf := make([]byte, 4*len(out))
+	if _, err := io.ReadFull(rand, buf); err != nil {
+		return err
+	}
+	for i := range out {
+		out[i] = binary.LittleEndian.Uint32(buf[4*i:])
+	}
+	return nil
+}
+
+// shortRandom sets out to a random small polynomial with exactly w
+// nonzero coefficients.
+func shortRandom(rand io.Reader, out *[sntrupP]int8) error {
+	var l [sntrupP]uint32
+	if err := randomUint32s(rand, l[:]); err != nil {
+		return err
+	}
+	for i := 0; i < sntrupW; i++ {
+		l[i] &= 0xfffffffe
+	}
+	for i := sntrupW; i < sntrupP; i++ {
+		l[i] = (l[i] & 0xfffffffd) | 1
+	}
+	sortUint32(l[:])
+	for i, v := range l {
+		out[i] = int8(v&3) - 1
+	}
+	return nil
+}
+
+// smallRandom sets out to a random small polynomial.
+func smallRandom(rand io.Reader, out *[sntrupP]int8) error {
+	var l [sntrupP]uint32
+	if err := randomUint32s(rand, l[:]); err != nil {
+		return err
+	}
+	for i, v := range l {
+		out[i] = int8((((v & 0x3fffffff) * 3) >> 30)) - 1
+	}
+	return nil
+}
+
+// sntrupEncode encodes r, whose values are bounded by m, as in the
+// reference implementation: pairs of values are merged recursively, and
+// the low bytes of large merged values emitted.
+func sntrupEncode(out []byte, r, m []uint16) []byte {
+	if len(r) == 1 {
+		rr, mm := r[0], m[0]
+		for mm > 1 {
+			out = append(out, byte(rr))
+			rr >>= 8
+			mm = (mm + 255) >> 8
+		}
+		return out
+	}
+	n := len(r)
+	r2 := make([]uint16, (n+1)/2)
+	m2 := make([]uint16, (n+1)/2)
+	i := 0
+	for ; i < n-1; i += 2 {
+		m0 := uint32(m[i])
+		rr := uint32(r[i]) + uint32(r[i+1])*m0
+		mm := uint32(m[i+1]) * m0
+		for mm >= 16384 {
+			out = append(out, byte(rr))
+			rr >>= 8
+			mm = (mm + 255) >> 8
+		}
+		r2[i/2] = uint16(rr)
+		m2[i/2] = uint16(mm)
+	}
+	if i < n {
+		r2[i/2] = r[i]
+		m2[i/2] = m[i]
+	}
+	return sntrupEncode(out, r2, m2)
+}
+
+// sntrupDecode is the inverse of sntrupEncode. It returns the number of
+// bytes of s consumed.
+func sntrupDecode(out []uint16, s []byte, m []uint16) int {
+	if len(m) == 1 {
+		switch {
+		case m[0] == 1:
+			out[0] = 0
+			return 0
+		case m[0] <= 256:
+			out[0] = uint32Mod14(uint32(s[0]), m[0])
+			return 1
+		default:
+			out[0] = uint32Mod14(uint32(s[0])+uint32(s[1])<<8, m[0])
+			return 2
+		}
+	}
+	n := len(m)
+	r2 := make([]uint16, (n+1)/2)
+	m2 := make([]uint16, (n+1)/2)
+	bottomr := make([]uint16, n/2)
+	bottomt := make([]uint32, n/2)
+	off := 0
+	i := 0
+	for ; i < n-1; i += 2 {
+		mm := uint32(m[i]) * uint32(m[i+1])
+		switch {
+		case mm > 256*16383:
+			bottomt[i/2] = 256 * 256
+			bottomr[i/2] = uint16(s[off]) + 256*uint16(s[off+1])
+			off += 2
+			m2[i/2] = uint16((((mm + 255) >> 8) + 255) >> 8)
+		case mm >= 16384:
+			bottomt[i/2] = 256
+			bottomr[i/2] = uint16(s[off])
+			off++
+			m2[i/2] = uint16((mm + 255) >> 8)
+		default:
+			bottomt[i/2] = 1
+			bottomr[i/2] = 0
+			m2[i/2] = uint16(mm)
+		}
+	}
+	if i < n {
+		m2[i/2] = m[i]
+	}
+	off += sntrupDecode(r2, s[off:], m2)
+	for i = 0; i < n-1; i += 2 {
+		r := uint32(bottomr[i/2]) + bottomt[i/2]*uint32(r2[i/2])
+		r1, r0 := uint32DivMod14(r, m[i])
+		// Only needed for invalid inputs.
+		r1 = uint32(uint32Mod14(r1, m[i+1]))
+		out[i] = r0
+		out[i+1] = uint16(r1)
+	}
+	if i < n {
+		out[i] = r2[i/2]
+	}
+	return off
+}
+
+func smallEncode(s []byte, f *[sntrupP]int8) {
+	for i := 0; i < sntrupP/4; i++ {
+		x := f[4*i] + 1
+		x += (f[4*i+1] + 1) << 2
+		x += (f[4*i+2] + 1) << 4
+		x += (f[4*i+3] + 1) << 6
+		s[i] = byte(x)
+	}
+	s[sntrupP/4] = byte(f[sntrupP-1] + 1)
+}
+
+func smallDecode(f *[sntrupP]int8, s []byte) {
+	for i := 0; i < sntrupP/4; i++ {
+		x := s[i]
+		for j := 0; j < 4; j++ {
+			f[4*i+j] = int8(x&3) - 1
+			x >>= 2
+		}
+	}
+	f[sntrupP-1] = int8(s[sntrupP/4]&3) - 1
+}
+
+var (
+	sntrupRqModuli      [sntrupP]uint16
+	sntrupRoundedModuli [sntrupP]uint16
+)
+
+func init() {
+	for i := range sntrupRqModuli {
+		sntrupRqModuli[i] = sntrupQ
+		sntrupRoundedModuli[i] = (sntrupQ + 2) / 3
+	}
+}
+
+func rqEncode(r *[sntrupP]int16) []byte {
+	var v [sntrupP]uint16
+	for i, c := range r {
+		v[i] = uint16(c + sntrupQ12)
+	}
+	return sntrupEncode(make([]byte, 0, sntrupRqBytes), v[:], sntrupRqModuli[:])
+}
+
+func rqDecode(r *[sntrupP]int16, s []byte) {
+	var v [sntrupP]uint16
+	sntrupDecode(v[:], s, sntrupRqModuli[:])
+	for i, c := range v {
+		r[i] = int16(c) - sntrupQ12
+	}
+}
+
+func roundedEncode(r *[sntrupP]int16) []byte {
+	var v [sntrupP]uint16
+	for i, c := range r {
+		v[i] = uint16((uint32(int32(c)+sntrupQ12) * 10923) >> 15)
+	}
+	return sntrupEncode(make([]byte, 0, sntrupCiphertextSize), v[:], sntrupRoundedModuli[:])
+}
+
+func roundedDecode(r *[sntrupP]int16, s []byte) {
+	var v [sntrupP]uint16
+	sntrupDecode(v[:], s, sntrupRoundedModuli[:])
+	for i, c := range v {
+		r[i] = int16(c*3) - sntrupQ12
+	}
+}
+
+// sntrupHash returns the first 32 bytes of the SHA-512 hash of b followed
+// by the inputs.
+func sntrupHash(b byte, in ...[]byte) []byte {
+	h := sha512.New()
+	h.Write([]byte{b})
+	for _, x := range in {
+		h.Write(x)
+	}
+	return h.Sum(nil)[:sntrupHashBytes]
+}
+
+// sntrupGenerateKey returns a new sntrup761 key pair.
+func sntrupGenerateKey(rand io.Reader) (pub, priv []byte, err error) {
+	var g, v, f [sntrupP]int8
+	for {
+		if err := smallRandom(rand, &g); err != nil {
+			return nil, nil, err
+		}
+		if r3Recip(&v, &g) == 0 {
+			break
+		}
+	}
+	if err := shortRandom(rand, &f); err != nil {
+		return nil, nil, err
+	}
+	var finv, h [sntrupP]int16
+	rqRecip3(&finv, &f)
+	rqMultSmall(&h, &finv, &g)
+	pub = rqEncode(&h)
+
+	priv = make([]byte, sntrupPrivateKeySize)
+	smallEncode(priv, &f)
+	smallEncode(priv[sntrupSmallBytes:], &v)
+	k := priv[2*sntrupSmallBytes:]
+	k = k[copy(k, pub):]
+	// rho, the implicit rejection secret.
+	if _, err := io.ReadFull(rand, k[:sntrupSmallBytes]); err != nil {
+		return nil, nil, err
+	}
+	copy(k[sntrupSmallBytes:], sntrupHash(4, pub))
+	return pub, priv, nil
+}
+
+// sntrupHide returns the ciphertext encapsulating r to pub, as well as the
+// encoding of r.
+func sntrupHide(r *[sntrupP]int8, pub, cache []byte) (ct, rEnc []byte) {
+	rEnc = make([]byte, sntrupSmallBytes)
+	smallEncode(rEnc, r)
+
+	var h, hr [sntrupP]int16
+	rqDecode(&h, pub)
+	rqMultSmall(&hr, &h, r)
+	for i, c := range hr {
+		hr[i] = c - int16(f3Freeze(int32(c)))
+	}
+	ct = roundedEncode(&hr)
+	ct = append(ct, sntrupHash(2, sntrupHash(3, rEnc), cache)...)
+	return ct, rEnc
+}
+
+// sntrupEncapsulate returns a ciphertext and the shared key it
+// encapsulates to pub, which must be sntrupPublicKeySize bytes long.
+func sntrupEncapsulate(rand io.Reader, pub []byte) (ct, key []byte, err error) {
+	var r [sntrupP]int8
+	if err := shortRandom(rand, &r); err != nil {
+		return nil, nil, err
+	}
+	ct, rEnc := sntrupHide(&r, pub, sntrupHash(4, pub))
+	return ct, sntrupHash(1, sntrupHash(3, rEnc), ct), nil
+}
+
+// sntrupDecapsulate returns the shared key encapsulated in ct, which must
+// be sntrupCiphertextSize bytes long. An invalid ciphertext is implicitly
+// rejected: it results in a pseudorandom key unknown to the sender.
+func sntrupDecapsulate(priv, ct []byte) []byte {
+	pub := priv[2*sntrupSmallBytes : 2*sntrupSmallBytes+sntrupPublicKeySize]
+	rho := priv[2*sntrupSmallBytes+sntrupPublicKeySize : 2*sntrupSmallBytes+sntrupPublicKeySize+sntrupSmallBytes]
+	cache := priv[2*sntrupSmallBytes+sntrupPublicKeySize+sntrupSmallBytes:]
+
+	var f, v, e, ev, r [sntrupP]int8
+	smallDecode(&f, priv)
+	smallDecode(&v, priv[sntrupSmallBytes:])
+	var c, cf [sntrupP]int16
+	roundedDecode(&c, ct)
+	rqMultSmall(&cf, &c, &f)
+	for i, x := range cf {
+		e[i] = f3Freeze(int32(fqFreeze(3 * int32(x))))
+	}
+	r3Mult(&ev, &e, &v)
+	mask := int8(weightMask(&ev))
+	for i := 0; i < sntrupW; i++ {
+		r[i] = ((ev[i] ^ 1) & ^mask) ^ 1
+	}
+	for i := sntrupW; i < sntrupP; i++ {
+		r[i] = ev[i] & ^mask
+	}
+
+	cnew, rEnc := sntrupHide(&r, pub, cache)
+	var diff uint16
+	for i := range cnew {
+		diff |= uint16(cnew[i] ^ ct[i])
+	}
+	// fail is 0 if the ciphertexts are equal, and 0xff otherwise.
+	fail := byte((1 & ((uint32(diff) - 1) >> 8)) - 1)
+	for i := range rEnc {
+		rEnc[i] ^= fail & (rEnc[i] ^ rho[i])
+	}
+	return sntrupHash(1+fail, sntrupHash(3, rEnc), ct)
+}
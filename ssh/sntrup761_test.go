@@ -0,0 +1,172 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"testing"
+)
+
+// hashReader is a deterministic source of randomness: it returns the
+// SHA-256 hashes of seed followed by a big-endian block counter.
+type hashReader struct {
+	seed string
+	ctr  uint64
+	buf  []byte
+}
+
+func (r *hashReader) Read(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if len(r.buf) == 0 {
+			h := sha256.New()
+			h.Write([]byte(r.seed))
+			binary.Write(h, binary.BigEndian, r.ctr)
+			r.ctr++
+			r.buf = h.Sum(nil)
+		}
+		c := copy(p, r.buf)
+		p, r.buf = p[c:], r.buf[c:]
+	}
+	return n, nil
+}
+
+func TestSNTRUP761RoundTrip(t *testing.T) {
+	for i := 0; i < 3; i++ {
+		pub, priv, err := sntrupGenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pub) != sntrupPublicKeySize || len(priv) != sntrupPrivateKeySize {
+			t.Fatalf("got key sizes %d and %d, want %d and %d", len(pub), len(priv), sntrupPublicKeySize, sntrupPrivateKeySize)
+		}
+		ct, key, err := sntrupEncapsulate(rand.Reader, pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ct) != sntrupCiphertextSize || len(key) != sntrupSharedKeySize {
+			t.Fatalf("got ciphertext and key sizes %d and %d, want %d and %d", len(ct), len(key), sntrupCiphertextSize, sntrupSharedKeySize)
+		}
+		if got := sntrupDecapsulate(priv, ct); !bytes.Equal(got, key) {
+			t.Errorf("decapsulated key %x, want %x", got, key)
+		}
+
+		// A modified ciphertext is implicitly rejected, with a key
+		// derived from the rho secret.
+		ct[0] ^= 1
+		rho := priv[2*sntrupSmallBytes+sntrupPublicKeySize:][:sntrupSmallBytes]
+		want := sntrupHash(0, sntrupHash(3, rho), ct)
+		if got := sntrupDecapsulate(priv, ct); !bytes.Equal(got, want) {
+			t.Errorf("key of modified ciphertext %x, want rejection key %x", got, want)
+		}
+	}
+}
+
+// TestSNTRUP761KeyGen checks the key generation against that of the
+// reference implementation in OpenSSH, see testdata/sntrup761keygen.txt. Its
+// encapsulation is checked against OpenSSH by TestSNTRUP761X25519Transcript.
+func TestSNTRUP761KeyGen(t *testing.T) {
+	v := readTranscript(t, "testdata/sntrup761keygen.txt")
+	r := bytes.NewReader(v["random"])
+	pub, priv, err := sntrupGenerateKey(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != 0 {
+		t.Errorf("%d bytes of randomness left unread", r.Len())
+	}
+	if !bytes.Equal(pub, v["pk"]) {
+		t.Errorf("got public key %x, want %x", pub, v["pk"])
+	}
+	k := priv[2*sntrupSmallBytes:]
+	if !bytes.Equal(k[:sntrupPublicKeySize], pub) {
+		t.Error("private key does not hold the public key")
+	}
+	if rho := v["random"][len(v["random"])-sntrupSmallBytes:]; !bytes.Equal(k[sntrupPublicKeySize:][:sntrupSmallBytes], rho) {
+		t.Error("private key does not hold the rejection secret")
+	}
+
+	ct, key, err := sntrupEncapsulate(rand.Reader, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sntrupDecapsulate(priv, ct); !bytes.Equal(got, key) {
+		t.Errorf("decapsulated key %x, want %x", got, key)
+	}
+}
+
+func TestSNTRUP761Encoding(t *testing.T) {
+	var a, b [sntrupP]int16
+	for i := range a {
+		a[i] = int16(i*37%sntrupQ) - sntrupQ12
+	}
+	a[0], a[1] = -sntrupQ12, sntrupQ12
+	enc := rqEncode(&a)
+	if len(enc) != sntrupRqBytes {
+		t.Fatalf("got Rq encoding of %d bytes, want %d", len(enc), sntrupRqBytes)
+	}
+	rqDecode(&b, enc)
+	if a != b {
+		t.Errorf("Rq decoding does not match the encoded values")
+	}
+
+	// Rounded values are multiples of 3.
+	for i := range a {
+		a[i] = 3*int16(i*37%((sntrupQ+2)/3)) - sntrupQ12
+	}
+	enc = roundedEncode(&a)
+	if len(enc) != sntrupRoundedBytes {
+		t.Fatalf("got rounded encoding of %d bytes, want %d", len(enc), sntrupRoundedBytes)
+	}
+	roundedDecode(&b, enc)
+	if a != b {
+		t.Errorf("rounded decoding does not match the encoded values")
+	}
+
+	var f, g [sntrupP]int8
+	if err := smallRandom(rand.Reader, &f); err != nil {
+		t.Fatal(err)
+	}
+	s := make([]byte, sntrupSmallBytes)
+	smallEncode(s, &f)
+	smallDecode(&g, s)
+	if f != g {
+		t.Errorf("small decoding does not match the encoded values")
+	}
+}
+
+func TestSNTRUP761ShortRandom(t *testing.T) {
+	var f [sntrupP]int8
+	if err := shortRandom(rand.Reader, &f); err != nil {
+		t.Fatal(err)
+	}
+	if weightMask(&f) != 0 {
+		t.Errorf("short polynomial does not have weight %d", sntrupW)
+	}
+}
+
+func TestSortUint32(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 3, 17, 64, sntrupP} {
+		x := make([]uint32, n)
+		if err := randomUint32s(rand.Reader, x); err != nil {
+			t.Fatal(err)
+		}
+		if n > 2 {
+			x[1] = x[0]
+		}
+		want := append([]uint32(nil), x...)
+		sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+		sortUint32(x)
+		for i := range x {
+			if x[i] != want[i] {
+				t.Fatalf("n = %d: sortUint32 returned %v, want %v", n, x, want)
+			}
+		}
+	}
+}
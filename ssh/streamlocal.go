@@ -42,7 +42,7 @@ func (c *Client) ListenUnix(socketPath string) (net.Listener, error) {
 		return nil, err
 	}
 	if !ok {
-		return nil, errors.New("ssh: streamlocal-forward@openssh.com request denied by peer")
+		return nil, &ForwardDeniedError{Type: "streamlocal-forward@openssh.com", Addr: socketPath}
 	}
 	ch := c.forwards.add(&net.UnixAddr{Name: socketPath, Net: "unix"})
 
@@ -93,10 +93,12 @@ func (l *unixListener) Accept() (net.Conn, error) {
 	}, nil
 }
 
-// Close closes the listener.
+// Close closes the listener: Accept returns io.EOF right away, and the
+// remote peer is asked to stop listening. Closing it again does nothing.
 func (l *unixListener) Close() error {
-	// this also closes the listener.
-	l.conn.forwards.remove(&net.UnixAddr{Name: l.socketPath, Net: "unix"})
+	if !l.conn.forwards.removeChan(l.in) {
+		return nil
+	}
 	m := streamLocalChannelForwardMsg{
 		l.socketPath,
 	}
@@ -21,6 +21,9 @@ import (
 // the returned net.Listener. The listener must be serviced, or the
 // SSH connection may hang.
 // N must be "tcp", "tcp4", "tcp6", or "unix".
+// For "tcp", an addr without a host, such as ":8080", listens on all the
+// addresses of the peer, while for "tcp4" and "tcp6" it listens on all its
+// IPv4 or IPv6 addresses.
 func (c *Client) Listen(n, addr string) (net.Listener, error) {
 	switch n {
 	case "tcp", "tcp4", "tcp6":
@@ -28,6 +31,14 @@ func (c *Client) Listen(n, addr string) (net.Listener, error) {
 		if err != nil {
 			return nil, err
 		}
+		if len(laddr.IP) == 0 {
+			switch n {
+			case "tcp4":
+				laddr.IP = net.IPv4zero
+			case "tcp6":
+				laddr.IP = net.IPv6unspecified
+			}
+		}
 		return c.ListenTCP(laddr)
 	case "unix":
 		return c.ListenUnix(addr)
@@ -84,6 +95,23 @@ func (c *Client) autoPortListenWorkaround(laddr *net.TCPAddr) (net.Listener, err
 	return nil, fmt.Errorf("ssh: listen on random port failed after %d tries: %v", tries, err)
 }
 
+// ForwardDeniedError is returned when the remote peer denies a request to
+// forward connections from a listening socket. The SSH protocol does not
+// convey why, for instance because the address is in use or because
+// forwarding is not permitted.
+type ForwardDeniedError struct {
+	// Type is the request type, "tcpip-forward" or
+	// "streamlocal-forward@openssh.com".
+	Type string
+
+	// Addr is the address the remote peer was asked to listen on.
+	Addr string
+}
+
+func (e *ForwardDeniedError) Error() string {
+	return fmt.Sprintf("ssh: %s request for %s denied by peer", e.Type, e.Addr)
+}
+
 // RFC 4254 7.1
 type channelForwardMsg struct {
 	addr  string
@@ -100,7 +128,8 @@ func (c *Client) handleForwards() {
 
 // ListenTCP requests the remote peer open a listening socket
 // on laddr. Incoming connections will be available by calling
-// Accept on the returned net.Listener.
+// Accept on the returned net.Listener. If laddr has no IP, the
+// peer listens on all its addresses.
 func (c *Client) ListenTCP(laddr *net.TCPAddr) (net.Listener, error) {
 	c.handleForwardsOnce.Do(c.handleForwards)
 	if laddr.Port == 0 && isBrokenOpenSSHVersion(string(c.ServerVersion())) {
@@ -108,7 +137,7 @@ func (c *Client) ListenTCP(laddr *net.TCPAddr) (net.Listener, error) {
 	}
 
 	m := channelForwardMsg{
-		laddr.IP.String(),
+		forwardHost(laddr),
 		uint32(laddr.Port),
 	}
 	// send message
@@ -117,7 +146,10 @@ func (c *Client) ListenTCP(laddr *net.TCPAddr) (net.Listener, error) {
 		return nil, err
 	}
 	if !ok {
-		return nil, errors.New("ssh: tcpip-forward request denied by peer")
+		return nil, &ForwardDeniedError{
+			Type: "tcpip-forward",
+			Addr: net.JoinHostPort(m.addr, strconv.Itoa(laddr.Port)),
+		}
 	}
 
 	// If the original port was 0, then the remote side will
@@ -138,6 +170,42 @@ func (c *Client) ListenTCP(laddr *net.TCPAddr) (net.Listener, error) {
 	return &tcpListener{laddr, c, ch}, nil
 }
 
+// forwardHost returns the address to send in the tcpip-forward request
+// for laddr: its IP, with its zone if any, or "" for all the addresses of
+// the peer, RFC 4254 section 7.1.
+func forwardHost(laddr *net.TCPAddr) string {
+	if len(laddr.IP) == 0 {
+		return ""
+	}
+	if laddr.Zone != "" {
+		return laddr.IP.String() + "%" + laddr.Zone
+	}
+	return laddr.IP.String()
+}
+
+// ListenTCPEphemeral requests the remote peer open a listening socket on
+// host, an IP address, and a port of its choosing. It returns the port
+// assigned by the peer along with the listener. If the peer denies the
+// request, the error is a *ForwardDeniedError.
+func (c *Client) ListenTCPEphemeral(host string) (net.Listener, int, error) {
+	laddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return nil, 0, err
+	}
+	l, err := c.ListenTCP(laddr)
+	if err != nil {
+		return nil, 0, err
+	}
+	// The port is either reported by the peer or, with the peers which
+	// fail to, picked by autoPortListenWorkaround.
+	port := l.Addr().(*net.TCPAddr).Port
+	if port == 0 {
+		l.Close()
+		return nil, 0, errors.New("ssh: peer did not report the port of the tcpip-forward listener")
+	}
+	return l, port, nil
+}
+
 // forwardList stores a mapping between remote
 // forward requests and the tcpListeners.
 type forwardList struct {
@@ -180,15 +248,45 @@ type forwardedTCPPayload struct {
 }
 
 // parseTCPAddr parses the originating address from the remote into a *net.TCPAddr.
+// IPv6 addresses may be enclosed in brackets and carry a zone, as in
+// "[fe80::1%eth0]".
 func parseTCPAddr(addr string, port uint32) (*net.TCPAddr, error) {
 	if port == 0 || port > 65535 {
 		return nil, fmt.Errorf("ssh: port number out of range: %d", port)
 	}
-	ip := net.ParseIP(string(addr))
+	ip, zone := parseIPZone(addr)
 	if ip == nil {
 		return nil, fmt.Errorf("ssh: cannot parse IP address %q", addr)
 	}
-	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	return &net.TCPAddr{IP: ip, Port: int(port), Zone: zone}, nil
+}
+
+// parseBindAddr is like parseTCPAddr for the address a forwarded connection
+// was received on, which is empty for a listener on all addresses.
+func parseBindAddr(addr string, port uint32) (*net.TCPAddr, error) {
+	if addr == "" {
+		if port == 0 || port > 65535 {
+			return nil, fmt.Errorf("ssh: port number out of range: %d", port)
+		}
+		return &net.TCPAddr{Port: int(port)}, nil
+	}
+	return parseTCPAddr(addr, port)
+}
+
+// parseIPZone parses addr, an IP address optionally enclosed in brackets
+// and followed by a zone. It returns a nil IP if addr is invalid.
+func parseIPZone(addr string) (net.IP, string) {
+	if len(addr) > 2 && addr[0] == '[' && addr[len(addr)-1] == ']' {
+		addr = addr[1 : len(addr)-1]
+	}
+	var zone string
+	if i := strings.LastIndexByte(addr, '%'); i > 0 {
+		addr, zone = addr[:i], addr[i+1:]
+		if zone == "" || !strings.Contains(addr, ":") {
+			return nil, ""
+		}
+	}
+	return net.ParseIP(addr), zone
 }
 
 func (l *forwardList) handleChannels(in <-chan NewChannel) {
@@ -211,7 +309,7 @@ func (l *forwardList) handleChannels(in <-chan NewChannel) {
 			// format. It is implied that this should be an IP
 			// address, as it would be impossible to connect to it
 			// otherwise.
-			laddr, err = parseTCPAddr(payload.Addr, payload.Port)
+			laddr, err = parseBindAddr(payload.Addr, payload.Port)
 			if err != nil {
 				ch.Reject(ConnectionFailed, err.Error())
 				continue
@@ -249,18 +347,33 @@ func (l *forwardList) handleChannels(in <-chan NewChannel) {
 	}
 }
 
-// remove removes the forward entry, and the channel feeding its
-// listener.
-func (l *forwardList) remove(addr net.Addr) {
+// remove removes the forward entry of addr, and the channel feeding its
+// listener. It reports whether there was one.
+func (l *forwardList) remove(addr net.Addr) bool {
+	return l.removeFunc(func(f forwardEntry) bool {
+		return sameAddr(addr, f.laddr)
+	})
+}
+
+// removeChan removes the forward entry feeding c, the channel of
+// a listener, and closes c. It reports whether there was one.
+func (l *forwardList) removeChan(c <-chan forward) bool {
+	return l.removeFunc(func(f forwardEntry) bool {
+		return f.c == c
+	})
+}
+
+func (l *forwardList) removeFunc(match func(forwardEntry) bool) bool {
 	l.Lock()
 	defer l.Unlock()
 	for i, f := range l.entries {
-		if addr.Network() == f.laddr.Network() && addr.String() == f.laddr.String() {
+		if match(f) {
 			l.entries = append(l.entries[:i], l.entries[i+1:]...)
 			close(f.c)
-			return
+			return true
 		}
 	}
+	return false
 }
 
 // closeAll closes and clears all forwards.
@@ -277,14 +390,40 @@ func (l *forwardList) forward(laddr, raddr net.Addr, ch NewChannel) bool {
 	l.Lock()
 	defer l.Unlock()
 	for _, f := range l.entries {
-		if laddr.Network() == f.laddr.Network() && laddr.String() == f.laddr.String() {
+		if sameAddr(laddr, f.laddr) {
 			f.c <- forward{newCh: ch, raddr: raddr}
 			return true
 		}
 	}
+	// A peer may report a listener on all addresses with another
+	// wildcard address than requested, such as "0.0.0.0" for "".
+	if a, ok := laddr.(*net.TCPAddr); ok && isWildcard(a.IP) {
+		for _, f := range l.entries {
+			if b, ok := f.laddr.(*net.TCPAddr); ok && isWildcard(b.IP) && a.Port == b.Port {
+				f.c <- forward{newCh: ch, raddr: raddr}
+				return true
+			}
+		}
+	}
 	return false
 }
 
+// sameAddr reports whether a and b are the same address. IP addresses are
+// compared by value, so that "::ffff:127.0.0.1" is the same as "127.0.0.1".
+func sameAddr(a, b net.Addr) bool {
+	ta, ok1 := a.(*net.TCPAddr)
+	tb, ok2 := b.(*net.TCPAddr)
+	if ok1 && ok2 {
+		return ta.Port == tb.Port && ta.Zone == tb.Zone && ta.IP.Equal(tb.IP)
+	}
+	return a.Network() == b.Network() && a.String() == b.String()
+}
+
+// isWildcard reports whether ip designates all the addresses of a host.
+func isWildcard(ip net.IP) bool {
+	return len(ip) == 0 || ip.IsUnspecified()
+}
+
 type tcpListener struct {
 	laddr *net.TCPAddr
 
@@ -311,18 +450,40 @@ func (l *tcpListener) Accept() (net.Conn, error) {
 	}, nil
 }
 
-// Close closes the listener.
+// Close closes the listener: Accept returns io.EOF right away, and the
+// remote peer is asked to stop listening, as with Client.CancelForward.
+// Closing a listener whose forward was canceled already does nothing.
 func (l *tcpListener) Close() error {
-	m := channelForwardMsg{
-		l.laddr.IP.String(),
-		uint32(l.laddr.Port),
+	if !l.conn.forwards.removeChan(l.in) {
+		return nil
 	}
+	return l.conn.cancelTCPForward(forwardHost(l.laddr), uint32(l.laddr.Port))
+}
+
+// CancelForward asks the remote peer to stop listening on bindAddr and
+// bindPort for the forward set up by Listen or ListenTCP, and waits for its
+// reply. bindAddr is the IP address of the listener, as in its Addr, or ""
+// for a listener on all the addresses of the peer.
+// Once the peer confirms, the listener of the forward, if any, is closed:
+// its Accept returns io.EOF, while the connections it accepted remain open.
+func (c *Client) CancelForward(bindAddr string, bindPort uint32) error {
+	if err := c.cancelTCPForward(bindAddr, bindPort); err != nil {
+		return err
+	}
+	if bindAddr == "" {
+		c.forwards.remove(&net.TCPAddr{Port: int(bindPort)})
+	} else if ip, zone := parseIPZone(bindAddr); ip != nil {
+		c.forwards.remove(&net.TCPAddr{IP: ip, Port: int(bindPort), Zone: zone})
+	}
+	return nil
+}
 
-	// this also closes the listener.
-	l.conn.forwards.remove(l.laddr)
-	ok, _, err := l.conn.SendRequest("cancel-tcpip-forward", true, Marshal(&m))
+// cancelTCPForward sends a cancel-tcpip-forward request and waits for the reply.
+func (c *Client) cancelTCPForward(addr string, port uint32) error {
+	m := channelForwardMsg{addr, port}
+	ok, _, err := c.SendRequest("cancel-tcpip-forward", true, Marshal(&m))
 	if err == nil && !ok {
-		err = errors.New("ssh: cancel-tcpip-forward failed")
+		err = fmt.Errorf("ssh: cancel-tcpip-forward for %s denied by peer", net.JoinHostPort(addr, strconv.FormatUint(uint64(port), 10)))
 	}
 	return err
 }
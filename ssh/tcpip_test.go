@@ -5,7 +5,11 @@
 package ssh
 
 import (
+	"io"
+	"io/ioutil"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestAutoPortListenBroken(t *testing.T) {
@@ -18,3 +22,439 @@ func TestAutoPortListenBroken(t *testing.T) {
 		t.Errorf("version %q marked as broken", works)
 	}
 }
+
+// dialForwarding returns a client of a server answering tcpip-forward
+// requests with port, or denying them if port is 0. Once forwarding is
+// set up, a "connect@test" request makes the server open a forwarded-tcpip
+// channel, and its reply reports whether the client accepted the channel.
+// The payload of the request, if any, is a forwardedTCPPayload overriding
+// the channel's default one, from 192.0.2.1:5555 to the forward.
+// The server accepts a cancel-tcpip-forward request for the forward once.
+func dialForwarding(t *testing.T, port uint32) *Client {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	go func() {
+		defer c1.Close()
+		conf := &ServerConfig{NoClientAuth: true}
+		conf.AddHostKey(testSigners["rsa"])
+		conn, chans, reqs, err := NewServerConn(c1, conf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			return
+		}
+		go func() {
+			for newCh := range chans {
+				newCh.Reject(Prohibited, "no channels")
+			}
+		}()
+		var addr string
+		var forwarding bool
+		for req := range reqs {
+			switch req.Type {
+			case "tcpip-forward":
+				var m struct {
+					Addr string
+					Port uint32
+				}
+				if err := Unmarshal(req.Payload, &m); err != nil || m.Port != 0 {
+					t.Errorf("tcpip-forward request %+v, %v; want port 0", m, err)
+				}
+				if port == 0 {
+					req.Reply(false, nil)
+					continue
+				}
+				addr = m.Addr
+				forwarding = true
+				req.Reply(true, Marshal(struct{ Port uint32 }{port}))
+			case "cancel-tcpip-forward":
+				var m struct {
+					Addr string
+					Port uint32
+				}
+				if err := Unmarshal(req.Payload, &m); err != nil {
+					t.Errorf("cancel-tcpip-forward request: %v", err)
+				}
+				ok := forwarding && m.Addr == addr && m.Port == port
+				if ok {
+					forwarding = false
+				}
+				req.Reply(ok, nil)
+			case "connect@test":
+				payload := forwardedTCPPayload{
+					Addr:       addr,
+					Port:       port,
+					OriginAddr: "192.0.2.1",
+					OriginPort: 5555,
+				}
+				if len(req.Payload) > 0 {
+					if err := Unmarshal(req.Payload, &payload); err != nil {
+						t.Errorf("connect@test request: %v", err)
+					}
+				}
+				ch, in, err := conn.OpenChannel("forwarded-tcpip", Marshal(&payload))
+				if req.WantReply {
+					req.Reply(err == nil, nil)
+				}
+				if err != nil {
+					continue
+				}
+				go DiscardRequests(in)
+				ch.Write([]byte("hello"))
+				ch.Close()
+			default:
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+			}
+		}
+	}()
+
+	conn, chans, reqs, err := NewClientConn(c2, "", &ClientConfig{
+		User:            "testuser",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	return NewClient(conn, chans, reqs)
+}
+
+func TestListenTCPEphemeral(t *testing.T) {
+	client := dialForwarding(t, 4242)
+	defer client.Close()
+
+	l, port, err := client.ListenTCPEphemeral("127.0.0.1")
+	if err != nil {
+		t.Fatalf("ListenTCPEphemeral: %v", err)
+	}
+	if port != 4242 {
+		t.Errorf("port = %d, want 4242", port)
+	}
+	if got := l.Addr().String(); got != "127.0.0.1:4242" {
+		t.Errorf("Addr = %s, want 127.0.0.1:4242", got)
+	}
+	if _, _, err := client.SendRequest("connect@test", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != "192.0.2.1:5555" {
+		t.Errorf("RemoteAddr = %s, want 192.0.2.1:5555", got)
+	}
+	b, err := ioutil.ReadAll(conn)
+	if err != nil || string(b) != "hello" {
+		t.Errorf("read %q, %v; want \"hello\"", b, err)
+	}
+}
+
+func TestListenTCPEphemeralBrokenPeer(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	go func() {
+		// The OpenSSH versions which do not report the ports they pick.
+		conf := &ServerConfig{NoClientAuth: true, ServerVersion: "SSH-2.0-OpenSSH_5.9"}
+		conf.AddHostKey(testSigners["rsa"])
+		_, chans, reqs, err := NewServerConn(c1, conf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			return
+		}
+		go func() {
+			for newCh := range chans {
+				newCh.Reject(Prohibited, "no channels")
+			}
+		}()
+		for req := range reqs {
+			var m struct {
+				Addr string
+				Port uint32
+			}
+			if err := Unmarshal(req.Payload, &m); err != nil || m.Port == 0 {
+				t.Errorf("%s request %+v, %v; want a port", req.Type, m, err)
+			}
+			// Accept it, without a port in the reply.
+			req.Reply(true, nil)
+		}
+	}()
+	conn, chans, reqs, err := NewClientConn(c2, "", &ClientConfig{
+		User:            "testuser",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := NewClient(conn, chans, reqs)
+	defer client.Close()
+
+	l, port, err := client.ListenTCPEphemeral("127.0.0.1")
+	if err != nil {
+		t.Fatalf("ListenTCPEphemeral: %v", err)
+	}
+	defer l.Close()
+	if want := l.Addr().(*net.TCPAddr).Port; port != want || port == 0 {
+		t.Errorf("port = %d, want the port of the listener, %d", port, want)
+	}
+}
+
+func TestListenTCPEphemeralDenied(t *testing.T) {
+	client := dialForwarding(t, 0)
+	defer client.Close()
+
+	_, _, err := client.ListenTCPEphemeral("127.0.0.1")
+	derr, ok := err.(*ForwardDeniedError)
+	if !ok {
+		t.Fatalf("ListenTCPEphemeral: err = %v, want a *ForwardDeniedError", err)
+	}
+	if derr.Type != "tcpip-forward" || derr.Addr != "127.0.0.1:0" {
+		t.Errorf("ForwardDeniedError = %+v, want a tcpip-forward request for 127.0.0.1:0", derr)
+	}
+}
+
+func TestCancelForward(t *testing.T) {
+	client := dialForwarding(t, 4242)
+	defer client.Close()
+
+	l, _, err := client.ListenTCPEphemeral("127.0.0.1")
+	if err != nil {
+		t.Fatalf("ListenTCPEphemeral: %v", err)
+	}
+	defer l.Close()
+	accepted := make(chan error, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				accepted <- err
+				return
+			}
+			conn.Close()
+		}
+	}()
+	if ok, _, err := client.SendRequest("connect@test", true, nil); err != nil || !ok {
+		t.Fatalf("connect@test = %v, %v; want the connection delivered", ok, err)
+	}
+
+	if err := client.CancelForward("127.0.0.1", 4243); err == nil {
+		t.Error("CancelForward succeeded for a port not forwarded")
+	}
+	if err := client.CancelForward("127.0.0.1", 4242); err != nil {
+		t.Fatalf("CancelForward: %v", err)
+	}
+	select {
+	case err := <-accepted:
+		if err != io.EOF {
+			t.Errorf("Accept: %v, want io.EOF", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept did not return after CancelForward")
+	}
+
+	// Connections are no longer delivered.
+	if ok, _, err := client.SendRequest("connect@test", true, nil); err != nil || ok {
+		t.Errorf("connect@test = %v, %v; want the connection rejected", ok, err)
+	}
+	// Closing the listener does not cancel the forward again.
+	if err := l.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
+
+func TestListenerCloseCancelsForward(t *testing.T) {
+	client := dialForwarding(t, 4242)
+	defer client.Close()
+
+	l, err := client.ListenTCP(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenTCP: %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := l.Accept(); err != io.EOF {
+		t.Errorf("Accept after Close: %v, want io.EOF", err)
+	}
+	// The forward was canceled on the server.
+	if err := client.CancelForward("127.0.0.1", 4242); err == nil {
+		t.Error("CancelForward after Close succeeded")
+	}
+	if err := l.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+// acceptForwarded sends a connect@test request with payload to the server
+// of dialForwarding and returns the connection accepted by l, or nil if the
+// client rejected it.
+func acceptForwarded(t *testing.T, client *Client, l net.Listener, payload []byte) net.Conn {
+	t.Helper()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			conn = nil
+		}
+		accepted <- conn
+	}()
+	// The server replies once the client accepted or rejected the channel.
+	if ok, _, err := client.SendRequest("connect@test", true, payload); err != nil || !ok {
+		var p forwardedTCPPayload
+		Unmarshal(payload, &p)
+		t.Errorf("connect@test from %s to %s = %v, %v; want the connection delivered", p.OriginAddr, p.Addr, ok, err)
+		return nil
+	}
+	return <-accepted
+}
+
+func TestListenTCPIPv6(t *testing.T) {
+	client := dialForwarding(t, 4242)
+	defer client.Close()
+
+	l, err := client.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	if got := l.Addr().String(); got != "[::1]:4242" {
+		t.Errorf("Addr = %s, want [::1]:4242", got)
+	}
+
+	for _, tt := range []struct {
+		addr, origin string
+		want         string
+	}{
+		{"::1", "2001:db8::2", "[2001:db8::2]:5555"},
+		{"[::1]", "[2001:db8::2]", "[2001:db8::2]:5555"},
+		{"0:0:0:0:0:0:0:1", "fe80::1%eth0", "[fe80::1%eth0]:5555"},
+		{"::1", "::ffff:192.0.2.1", "192.0.2.1:5555"},
+	} {
+		payload := Marshal(&forwardedTCPPayload{
+			Addr:       tt.addr,
+			Port:       4242,
+			OriginAddr: tt.origin,
+			OriginPort: 5555,
+		})
+		conn := acceptForwarded(t, client, l, payload)
+		if conn == nil {
+			continue
+		}
+		if got := conn.RemoteAddr().String(); got != tt.want {
+			t.Errorf("RemoteAddr from %s = %s, want %s", tt.origin, got, tt.want)
+		}
+		if got := conn.LocalAddr().String(); got != "[::1]:4242" {
+			t.Errorf("LocalAddr = %s, want [::1]:4242", got)
+		}
+		conn.Close()
+	}
+
+	// Connections to other addresses are rejected.
+	payload := Marshal(&forwardedTCPPayload{
+		Addr:       "::2",
+		Port:       4242,
+		OriginAddr: "2001:db8::2",
+		OriginPort: 5555,
+	})
+	if ok, _, err := client.SendRequest("connect@test", true, payload); err != nil || ok {
+		t.Errorf("connect@test to ::2 = %v, %v; want the connection rejected", ok, err)
+	}
+}
+
+func TestListenTCPBindAddr(t *testing.T) {
+	client := dialForwarding(t, 0)
+	defer client.Close()
+
+	for _, tt := range []struct {
+		n, addr string
+		want    string
+	}{
+		{"tcp", ":0", ":0"},
+		{"tcp4", ":0", "0.0.0.0:0"},
+		{"tcp6", ":0", "[::]:0"},
+		{"tcp", "0.0.0.0:0", "0.0.0.0:0"},
+		{"tcp", "[::]:0", "[::]:0"},
+		{"tcp6", "[::1]:0", "[::1]:0"},
+		{"tcp6", "[fe80::1%lo]:0", "[fe80::1%lo]:0"},
+	} {
+		_, err := client.Listen(tt.n, tt.addr)
+		derr, ok := err.(*ForwardDeniedError)
+		if !ok {
+			t.Errorf("Listen(%q, %q): err = %v, want a *ForwardDeniedError", tt.n, tt.addr, err)
+			continue
+		}
+		if derr.Addr != tt.want {
+			t.Errorf("Listen(%q, %q) requested %s, want %s", tt.n, tt.addr, derr.Addr, tt.want)
+		}
+	}
+}
+
+func TestListenTCPWildcard(t *testing.T) {
+	client := dialForwarding(t, 4242)
+	defer client.Close()
+
+	l, err := client.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+
+	// The peer may report the listener as on "", "0.0.0.0" or "::".
+	for _, addr := range []string{"", "0.0.0.0", "::"} {
+		payload := Marshal(&forwardedTCPPayload{
+			Addr:       addr,
+			Port:       4242,
+			OriginAddr: "::1",
+			OriginPort: 5555,
+		})
+		conn := acceptForwarded(t, client, l, payload)
+		if conn == nil {
+			continue
+		}
+		if got := conn.RemoteAddr().String(); got != "[::1]:5555" {
+			t.Errorf("RemoteAddr = %s, want [::1]:5555", got)
+		}
+		conn.Close()
+	}
+
+	if err := client.CancelForward("", 4242); err != nil {
+		t.Fatalf("CancelForward: %v", err)
+	}
+	if _, err := l.Accept(); err != io.EOF {
+		t.Errorf("Accept after CancelForward: %v, want io.EOF", err)
+	}
+}
+
+func TestParseTCPAddr(t *testing.T) {
+	for _, tt := range []struct {
+		addr string
+		want string // empty if invalid
+	}{
+		{"192.0.2.1", "192.0.2.1:22"},
+		{"2001:db8::1", "[2001:db8::1]:22"},
+		{"[2001:db8::1]", "[2001:db8::1]:22"},
+		{"fe80::1%eth0", "[fe80::1%eth0]:22"},
+		{"[fe80::1%25]", "[fe80::1%25]:22"},
+		{"", ""},
+		{"[]", ""},
+		{"[::1", ""},
+		{"192.0.2.1%eth0", ""},
+		{"fe80::1%", ""},
+		{"example.com", ""},
+	} {
+		a, err := parseTCPAddr(tt.addr, 22)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("parseTCPAddr(%q) = %v, want an error", tt.addr, a)
+		case tt.want != "" && err != nil:
+			t.Errorf("parseTCPAddr(%q): %v", tt.addr, err)
+		case tt.want != "" && a.String() != tt.want:
+			t.Errorf("parseTCPAddr(%q) = %v, want %s", tt.addr, a, tt.want)
+		}
+	}
+}
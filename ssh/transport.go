@@ -10,6 +10,7 @@ import (
 	"errors"
 	"io"
 	"log"
+	"sync/atomic"
 )
 
 // debugTransport if set, will print packet types as they go over the
@@ -17,7 +18,8 @@ import (
 const debugTransport = false
 
 const (
-	gcmCipherID    = "aes128-gcm@openssh.com"
+	gcm128CipherID = "aes128-gcm@openssh.com"
+	gcm256CipherID = "aes256-gcm@openssh.com"
 	aes128cbcID    = "aes128-cbc"
 	tripledescbcID = "3des-cbc"
 )
@@ -48,6 +50,15 @@ type transport struct {
 	rand      io.Reader
 	isClient  bool
 	io.Closer
+
+	// userAuthDone is set once the user authentication succeeded,
+	// which starts the delayed compression, if negotiated.
+	userAuthDone int32
+}
+
+// authenticated reports whether the user authentication succeeded.
+func (t *transport) authenticated() bool {
+	return atomic.LoadInt32(&t.userAuthDone) != 0
 }
 
 // packetCipher represents a combination of SSH encryption/MAC
@@ -81,13 +92,13 @@ func (t *transport) prepareKeyChange(algs *algorithms, kexResult *kexResult) err
 	if err != nil {
 		return err
 	}
-	t.reader.pendingKeyChange <- ciph
+	t.reader.pendingKeyChange <- newCompressionCipher(ciph, algs.r.Compression, t)
 
 	ciph, err = newPacketCipher(t.writer.dir, algs.w, kexResult)
 	if err != nil {
 		return err
 	}
-	t.writer.pendingKeyChange <- ciph
+	t.writer.pendingKeyChange <- newCompressionCipher(ciph, algs.w.Compression, t)
 
 	return nil
 }
@@ -122,6 +133,9 @@ func (t *transport) readPacket() (p []byte, err error) {
 	if debugTransport {
 		t.printPacket(p, false)
 	}
+	if t.isClient && len(p) > 0 && p[0] == msgUserAuthSuccess {
+		atomic.StoreInt32(&t.userAuthDone, 1)
+	}
 
 	return p, err
 }
@@ -129,6 +143,10 @@ func (t *transport) readPacket() (p []byte, err error) {
 func (s *connectionState) readPacket(r *bufio.Reader) ([]byte, error) {
 	packet, err := s.packetCipher.readCipherPacket(s.seqNum, r)
 	s.seqNum++
+	if err != nil {
+		// The connection is unusable: release the decompressor, if any.
+		closeCipher(s.packetCipher)
+	}
 	if err == nil && len(packet) == 0 {
 		err = errors.New("ssh: zero length packet")
 	}
@@ -138,6 +156,7 @@ func (s *connectionState) readPacket(r *bufio.Reader) ([]byte, error) {
 		case msgNewKeys:
 			select {
 			case cipher := <-s.pendingKeyChange:
+				closeCipher(s.packetCipher)
 				s.packetCipher = cipher
 			default:
 				return nil, errors.New("ssh: got bogus newkeys message")
@@ -169,6 +188,10 @@ func (t *transport) writePacket(packet []byte) error {
 	if debugTransport {
 		t.printPacket(packet, true)
 	}
+	if !t.isClient && len(packet) > 0 && packet[0] == msgUserAuthSuccess {
+		// Set before the client can answer with compressed packets.
+		atomic.StoreInt32(&t.userAuthDone, 1)
+	}
 	return t.writer.writePacket(t.bufWriter, t.rand, packet)
 }
 